@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// apiKeyPrefix marks API keys so AuthHandler can tell them from session tokens
+const apiKeyPrefix = "mvk_"
+
+// APIKey describes an API key; the key itself is only returned on creation
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	KeyPrefix  string     `json:"key_prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateAPIKeyRequest names the key and selects its scopes
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreateAPIKeyResponse contains the new key
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey creates an API key limited to the given scopes. The key is
+// only shown once.
+//
+//encore:api auth method=POST path=/auth/api-keys
+func CreateAPIKey(ctx context.Context, req *CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	if req.Name == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("name is required").Err()
+	}
+	if len(req.Scopes) == 0 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("at least one scope is required").Err()
+	}
+	for _, scope := range req.Scopes {
+		if !IsValidScope(scope) {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown scope: " + scope).Err()
+		}
+	}
+
+	key := apiKeyPrefix + strings.TrimRight(generateSessionToken(), "=")
+	resp := &CreateAPIKeyResponse{Key: key}
+	err := db.QueryRow(ctx, `
+		INSERT INTO api_keys (user_id, name, key_hash, key_prefix, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id, name, key_prefix, scopes, created_at
+	`, userData.UserID, req.Name, hashToken(key), key[:len(apiKeyPrefix)+6], req.Scopes).Scan(
+		&resp.ID, &resp.Name, &resp.KeyPrefix, &resp.Scopes, &resp.CreatedAt)
+	if err != nil {
+		rlog.Error("failed to create API key", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create API key").Err()
+	}
+
+	return resp, nil
+}
+
+// ListAPIKeysResponse contains the caller's active API keys
+type ListAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// ListAPIKeys returns the caller's active API keys
+//
+//encore:api auth method=GET path=/auth/api-keys
+func ListAPIKeys(ctx context.Context) (*ListAPIKeysResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT id, name, key_prefix, scopes, created_at, last_used_at
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list API keys").Err()
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.KeyPrefix, &k.Scopes, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	return &ListAPIKeysResponse{Keys: keys}, nil
+}
+
+// RevokeAPIKey revokes one of the caller's API keys
+//
+//encore:api auth method=DELETE path=/auth/api-keys/:id
+func RevokeAPIKey(ctx context.Context, id string) (*LogoutResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	result, err := db.Exec(ctx, `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to revoke API key").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("API key not found").Err()
+	}
+
+	entry := callerAudit(AuditTokenRevoked, userData.UserID)
+	entry.Details = map[string]string{"token": "api_key", "api_key_id": id}
+	recordAudit(ctx, entry)
+
+	return &LogoutResponse{Success: true}, nil
+}
+
+// lookupAPIKey resolves an API key to its owner, limited to the key's scopes
+func lookupAPIKey(ctx context.Context, key string) (*UserData, error) {
+	var keyID string
+	var userData UserData
+	var quota *int64
+	err := db.QueryRow(ctx, `
+		SELECT k.id, u.id, COALESCE(u.discord_id, ''), u.username, k.scopes, u.roles, u.storage_quota_bytes
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL
+	`, hashToken(key)).Scan(&keyID, &userData.UserID, &userData.DiscordID, &userData.Username, &userData.Scopes,
+		&userData.Roles, &quota)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errors.New("invalid API key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userData.Scopes == nil {
+		userData.Scopes = []string{}
+	}
+	userData.StorageQuotaBytes = effectiveQuota(quota)
+
+	_, _ = db.Exec(ctx, `UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`, keyID)
+	return &userData, nil
+}
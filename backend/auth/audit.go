@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+// Audit log events
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditLogout           = "logout"
+	AuditTokenRevoked     = "token_revoked"
+	AuditPermissionDenied = "permission_denied"
+	AuditPasskeyAdded     = "passkey_added"
+	AuditPasskeyRemoved   = "passkey_removed"
+)
+
+// auditEntry is an event to record in the audit log
+type auditEntry struct {
+	UserID    int64 // 0 when the user is unknown
+	Event     string
+	Provider  string
+	IP        string
+	UserAgent string
+	Details   map[string]string
+}
+
+// recordAudit stores an audit log entry. Auditing never fails the request it
+// describes, so errors are only logged.
+func recordAudit(ctx context.Context, entry auditEntry) {
+	details, err := json.Marshal(entry.Details)
+	if err != nil || entry.Details == nil {
+		details = []byte("{}")
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO audit_log (user_id, event, provider, ip_address, user_agent, details, created_at)
+		VALUES (NULLIF($1, 0), $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6, NOW())
+	`, entry.UserID, entry.Event, entry.Provider, entry.IP, entry.UserAgent, string(details))
+	if err != nil {
+		rlog.Error("failed to record audit event", "error", err, "event", entry.Event, "user_id", entry.UserID)
+	}
+}
+
+// AuditRecord is a change made by another service, published to
+// AuditTopic. Before and After are JSON snapshots of the resource, left
+// out for creations and deletions respectively.
+type AuditRecord struct {
+	// EventID makes redelivered records idempotent
+	EventID      string            `json:"event_id"`
+	UserID       int64             `json:"user_id"`
+	Event        string            `json:"event"`
+	Service      string            `json:"service"`
+	ResourceType string            `json:"resource_type"`
+	ResourceID   string            `json:"resource_id"`
+	IP           string            `json:"ip,omitempty"`
+	UserAgent    string            `json:"user_agent,omitempty"`
+	Details      map[string]string `json:"details,omitempty"`
+	Before       json.RawMessage   `json:"before,omitempty"`
+	After        json.RawMessage   `json:"after,omitempty"`
+	OccurredAt   time.Time         `json:"occurred_at"`
+}
+
+// AuditTopic carries the audit records of all services into the audit log
+var AuditTopic = pubsub.NewTopic[*AuditRecord]("audit-events", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(AuditTopic, "audit-log",
+	pubsub.SubscriptionConfig[*AuditRecord]{
+		Handler: storeAuditRecord,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// storeAuditRecord stores a published audit record. Records of users
+// deleted in the meantime are kept without the user, like their other
+// events.
+func storeAuditRecord(ctx context.Context, msg *AuditRecord) error {
+	details, err := json.Marshal(msg.Details)
+	if err != nil || msg.Details == nil {
+		details = []byte("{}")
+	}
+	var before, after *string
+	if len(msg.Before) > 0 {
+		b := string(msg.Before)
+		before = &b
+	}
+	if len(msg.After) > 0 {
+		a := string(msg.After)
+		after = &a
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO audit_log (event_id, user_id, event, service, resource_type, resource_id, ip_address, user_agent,
+			details, before, after, created_at)
+		VALUES ($1, (SELECT id FROM users WHERE id = $2), $3, $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''),
+			NULLIF($8, ''), $9, $10, $11, $12)
+		ON CONFLICT (event_id) DO NOTHING
+	`, msg.EventID, msg.UserID, msg.Event, msg.Service, msg.ResourceType, msg.ResourceID, msg.IP, msg.UserAgent,
+		string(details), before, after, msg.OccurredAt)
+	return err
+}
+
+// clientIP returns the caller's address, preferring the first
+// X-Forwarded-For entry set by the reverse proxy
+func clientIP(header http.Header, remoteAddr string) string {
+	if forwarded := header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// requestAudit returns an entry for an event of a raw HTTP request
+func requestAudit(req *http.Request, event string, provider oauthProvider) auditEntry {
+	return auditEntry{
+		Event:     event,
+		Provider:  provider.Name(),
+		IP:        clientIP(req.Header, req.RemoteAddr),
+		UserAgent: req.UserAgent(),
+	}
+}
+
+// callerAudit returns an entry for an event of the current API call
+func callerAudit(event string, userID int64) auditEntry {
+	entry := auditEntry{UserID: userID, Event: event}
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		entry.IP = clientIP(req.Headers, "")
+		entry.UserAgent = req.Headers.Get("User-Agent")
+	}
+	return entry
+}
+
+// AuditEvent is an audit log entry
+type AuditEvent struct {
+	ID     int64  `json:"id"`
+	UserID *int64 `json:"user_id,omitempty"`
+	Event  string `json:"event"`
+	// Service is the service that recorded the event
+	Service      string            `json:"service"`
+	ResourceType string            `json:"resource_type,omitempty"`
+	ResourceID   string            `json:"resource_id,omitempty"`
+	Provider     string            `json:"provider,omitempty"`
+	IPAddress    string            `json:"ip_address,omitempty"`
+	UserAgent    string            `json:"user_agent,omitempty"`
+	Details      map[string]string `json:"details"`
+	Before       json.RawMessage   `json:"before,omitempty"`
+	After        json.RawMessage   `json:"after,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// auditFilter selects audit events; zero fields don't filter
+type auditFilter struct {
+	UserID       int64
+	Event        string
+	ResourceType string
+	ResourceID   string
+	Since        *time.Time
+}
+
+// ListAuditLogRequest contains pagination and filter parameters
+type ListAuditLogRequest struct {
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+	Event    string `query:"event"`
+	// ResourceType and ResourceID limit the log to one kind of resource,
+	// e.g. "media" or "collection", or to one resource
+	ResourceType string `query:"resource_type"`
+	ResourceID   string `query:"resource_id"`
+}
+
+// ListAuditLogResponse contains audit events, newest first
+type ListAuditLogResponse struct {
+	Items      []AuditEvent `json:"items"`
+	TotalCount int          `json:"total_count"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"page_size"`
+}
+
+// ListAuditLog returns the caller's own audit events
+//
+//encore:api auth method=GET path=/auth/audit
+func ListAuditLog(ctx context.Context, req *ListAuditLogRequest) (*ListAuditLogResponse, error) {
+	userData := auth.Data().(*UserData)
+	return queryAuditLog(ctx, auditFilter{
+		UserID:       userData.UserID,
+		Event:        req.Event,
+		ResourceType: req.ResourceType,
+		ResourceID:   req.ResourceID,
+	}, req.Page, req.PageSize)
+}
+
+// ListAllAuditLogRequest contains the filters of the admin-wide audit log
+type ListAllAuditLogRequest struct {
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+	Event    string `query:"event"`
+	// UserID limits the log to one user
+	UserID       int64  `query:"user_id"`
+	ResourceType string `query:"resource_type"`
+	ResourceID   string `query:"resource_id"`
+	// Since limits the log to events at or after this time (RFC 3339)
+	Since string `query:"since"`
+}
+
+// ListAllAuditLog returns the audit events of all users (admin only)
+//
+//encore:api auth method=GET path=/admin/audit
+func ListAllAuditLog(ctx context.Context, req *ListAllAuditLogRequest) (*ListAuditLogResponse, error) {
+	userData := auth.Data().(*UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+
+	var since *time.Time
+	if req.Since != "" {
+		t, err := time.Parse(time.RFC3339, req.Since)
+		if err != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("since must be an RFC 3339 time").Err()
+		}
+		since = &t
+	}
+
+	return queryAuditLog(ctx, auditFilter{
+		UserID:       req.UserID,
+		Event:        req.Event,
+		ResourceType: req.ResourceType,
+		ResourceID:   req.ResourceID,
+		Since:        since,
+	}, req.Page, req.PageSize)
+}
+
+// queryAuditLog returns a page of the audit events matching the filter
+func queryAuditLog(ctx context.Context, f auditFilter, page, pageSize int) (*ListAuditLogResponse, error) {
+	// Set defaults
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	const filter = `
+		WHERE ($1 = 0 OR user_id = $1)
+		  AND ($2 = '' OR event = $2)
+		  AND ($3::timestamp IS NULL OR created_at >= $3)
+		  AND ($4 = '' OR resource_type = $4)
+		  AND ($5 = '' OR resource_id = $5)
+	`
+	args := []any{f.UserID, f.Event, f.Since, f.ResourceType, f.ResourceID}
+
+	var totalCount int
+	err := db.QueryRow(ctx, `SELECT COUNT(*) FROM audit_log`+filter, args...).Scan(&totalCount)
+	if err != nil {
+		totalCount = 0
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, user_id, event, service, COALESCE(resource_type, ''), COALESCE(resource_id, ''),
+			   COALESCE(provider, ''), COALESCE(ip_address, ''), COALESCE(user_agent, ''), details::text,
+			   COALESCE(before::text, ''), COALESCE(after::text, ''), created_at
+		FROM audit_log`+filter+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT $6 OFFSET $7
+	`, append(args, pageSize, offset)...)
+	if err != nil {
+		rlog.Error("failed to query audit log", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list audit log").Err()
+	}
+	defer rows.Close()
+
+	items := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var details, before, after string
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Event, &e.Service, &e.ResourceType, &e.ResourceID, &e.Provider,
+			&e.IPAddress, &e.UserAgent, &details, &before, &after, &e.CreatedAt); err != nil {
+			continue
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		if err := json.Unmarshal([]byte(details), &e.Details); err != nil || e.Details == nil {
+			e.Details = map[string]string{}
+		}
+		items = append(items, e)
+	}
+
+	return &ListAuditLogResponse{
+		Items:      items,
+		TotalCount: totalCount,
+		Page:       page,
+		PageSize:   pageSize,
+	}, nil
+}
@@ -1,15 +1,13 @@
-// Package auth handles Discord OAuth2 authentication and session management.
+// Package auth handles OAuth2 login (Discord, Google) and session management.
 package auth
 
 import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -20,11 +18,16 @@ import (
 	"encore.dev/storage/sqldb"
 )
 
-// Secrets for Discord OAuth2 - loaded via Encore secrets
+// Secrets for the OAuth2 providers and S3 - loaded via Encore secrets
 var secrets struct {
 	DiscordClientID     string
 	DiscordClientSecret string
+	DiscordBotToken     string // optional, reads member roles for the role mapping
+	GoogleClientID      string
+	GoogleClientSecret  string
 	SessionSecret       string
+	S3AccessKey         string // data export archives
+	S3SecretKey         string
 }
 
 // getEnvOrDefault returns the environment variable value or a default
@@ -35,28 +38,30 @@ func getEnvOrDefault(key, defaultVal string) string {
 	return defaultVal
 }
 
-// getDiscordRedirectURI returns the Discord OAuth redirect URI
-func getDiscordRedirectURI() string {
-	return getEnvOrDefault("DISCORD_REDIRECT_URI", "http://localhost:4000/auth/discord/callback")
-}
-
 // getFrontendURL returns the frontend URL for redirects
 func getFrontendURL() string {
 	return getEnvOrDefault("FRONTEND_URL", "http://localhost:3000")
 }
 
+// isAdmin reports whether the Discord user is listed in ADMIN_DISCORD_IDS
+// (comma-separated) or has the admin app role
+func isAdmin(discordID string, roles []string) bool {
+	if containsString(roles, RoleAdmin) {
+		return true
+	}
+	for _, id := range strings.Split(os.Getenv("ADMIN_DISCORD_IDS"), ",") {
+		if strings.TrimSpace(id) == discordID && discordID != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Database for users
 var db = sqldb.NewDatabase("auth", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
-// DiscordUser represents the Discord user data from OAuth
-type DiscordUser struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	Avatar   string `json:"avatar"`
-}
-
 // Session represents a user session
 type Session struct {
 	ID        string
@@ -69,6 +74,13 @@ type UserData struct {
 	UserID    int64
 	DiscordID string
 	Username  string
+	IsAdmin   bool
+	// Scopes limits an API key to the listed scopes; nil means unrestricted
+	Scopes []string
+	// Roles are the app roles mapped from the user's Discord roles
+	Roles []string
+	// StorageQuotaBytes limits the total size of the user's media; 0 means unlimited
+	StorageQuotaBytes int64
 }
 
 // sessions stores active sessions in memory (in production, use Redis)
@@ -79,23 +91,12 @@ type LoginResponse struct {
 	URL string `json:"url"`
 }
 
-// Login redirects to Discord OAuth URL
+// Login redirects to Discord OAuth URL. An optional ?redirect=/path is the
+// frontend path to return to after login.
 //
 //encore:api public raw method=GET path=/auth/discord/login
 func Login(w http.ResponseWriter, req *http.Request) {
-	state := generateRandomState()
-
-	params := url.Values{
-		"client_id":     {secrets.DiscordClientID},
-		"redirect_uri":  {getDiscordRedirectURI()},
-		"response_type": {"code"},
-		"scope":         {"identify"},
-		"state":         {state},
-	}
-
-	authURL := fmt.Sprintf("https://discord.com/api/oauth2/authorize?%s", params.Encode())
-
-	http.Redirect(w, req, authURL, http.StatusTemporaryRedirect)
+	startLogin(w, req, discord)
 }
 
 // CallbackRequest contains the OAuth callback parameters
@@ -114,64 +115,7 @@ type CallbackResponse struct {
 //
 //encore:api public raw method=GET path=/auth/discord/callback
 func Callback(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	code := req.URL.Query().Get("code")
-
-	if code == "" {
-		rlog.Error("callback: missing authorization code")
-		http.Error(w, "missing authorization code", http.StatusBadRequest)
-		return
-	}
-
-	// Exchange code for token
-	tokenData, err := exchangeCodeForToken(ctx, code)
-	if err != nil {
-		rlog.Error("failed to exchange code for token", "error", err)
-		http.Error(w, "failed to authenticate with Discord", http.StatusInternalServerError)
-		return
-	}
-
-	// Get user info from Discord
-	discordUser, err := getDiscordUser(ctx, tokenData.AccessToken)
-	if err != nil {
-		rlog.Error("failed to get Discord user", "error", err)
-		http.Error(w, "failed to get user info from Discord", http.StatusInternalServerError)
-		return
-	}
-
-	rlog.Info("Discord user retrieved",
-		"discord_id", discordUser.ID,
-		"username", discordUser.Username,
-	)
-
-	// Upsert user in database
-	user, err := upsertUser(ctx, discordUser)
-	if err != nil {
-		rlog.Error("failed to upsert user",
-			"error", err,
-			"discord_id", discordUser.ID,
-			"username", discordUser.Username,
-		)
-		http.Error(w, "failed to create user: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	rlog.Info("User upserted successfully", "user_id", user.ID)
-
-	// Create session
-	sessionToken := generateSessionToken()
-	session := &Session{
-		ID:        sessionToken,
-		UserID:    user.ID,
-		ExpiresAt: time.Now().Add(7 * 24 * time.Hour), // 7 days
-	}
-	sessions[sessionToken] = session
-
-	// Redirect to frontend with token
-	frontendURL := getFrontendURL()
-	redirectURL := fmt.Sprintf("%s/auth/callback?token=%s", frontendURL, sessionToken)
-
-	http.Redirect(w, req, redirectURL, http.StatusTemporaryRedirect)
+	finishLogin(w, req, discord)
 }
 
 // LogoutResponse confirms logout
@@ -192,15 +136,31 @@ func Logout(ctx context.Context) (*LogoutResponse, error) {
 		}
 	}
 
+	// Access tokens expire on their own; revoking the refresh tokens ends the session
+	if err := revokeRefreshTokens(ctx, userData.UserID); err != nil {
+		rlog.Error("failed to revoke refresh tokens", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to log out").Err()
+	}
+	recordAudit(ctx, callerAudit(AuditLogout, userData.UserID))
+
 	return &LogoutResponse{Success: true}, nil
 }
 
 // MeResponse returns current user info
 type MeResponse struct {
 	ID        int64  `json:"id"`
-	DiscordID string `json:"discord_id"`
+	Provider  string `json:"provider"`
+	DiscordID string `json:"discord_id,omitempty"`
 	Username  string `json:"username"`
 	AvatarURL string `json:"avatar_url"`
+	Email     string `json:"email,omitempty"`
+	// DisplayName is shown to other users; the username unless set
+	DisplayName string `json:"display_name"`
+	// AvatarMediaID is set when AvatarURL is a custom avatar
+	AvatarMediaID string   `json:"avatar_media_id,omitempty"`
+	Roles         []string `json:"roles"`
+	// StorageQuotaBytes is 0 when storage is unlimited
+	StorageQuotaBytes int64 `json:"storage_quota_bytes"`
 }
 
 // Me returns the current authenticated user
@@ -210,14 +170,20 @@ func Me(ctx context.Context) (*MeResponse, error) {
 	userData := auth.Data().(*UserData)
 
 	var user MeResponse
+	var quota *int64
 	err := db.QueryRow(ctx, `
-		SELECT id, discord_id, username, COALESCE(avatar_url, '') as avatar_url
+		SELECT id, provider, COALESCE(discord_id, ''), username, COALESCE(avatar_url, '') as avatar_url,
+			   COALESCE(email, ''), COALESCE(display_name, username), COALESCE(avatar_media_id::text, ''),
+			   roles, storage_quota_bytes
 		FROM users WHERE id = $1
-	`, userData.UserID).Scan(&user.ID, &user.DiscordID, &user.Username, &user.AvatarURL)
+	`, userData.UserID).Scan(&user.ID, &user.Provider, &user.DiscordID, &user.Username, &user.AvatarURL, &user.Email,
+		&user.DisplayName, &user.AvatarMediaID, &user.Roles, &quota)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
 	}
+	user.StorageQuotaBytes = effectiveQuota(quota)
+	user.AvatarURL = avatarURL(ctx, user.AvatarMediaID, user.AvatarURL)
 
 	return &user, nil
 }
@@ -225,41 +191,105 @@ func Me(ctx context.Context) (*MeResponse, error) {
 // User represents a user in the database
 type User struct {
 	ID        int64
+	Provider  string
 	DiscordID string
 	Username  string
 	AvatarURL string
+	Roles     []string
+	// StorageQuota is the quota granted by roles; nil means the default
+	StorageQuota *int64
 }
 
-func upsertUser(ctx context.Context, discordUser *DiscordUser) (*User, error) {
-	avatarURL := ""
-	if discordUser.Avatar != "" {
-		avatarURL = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", discordUser.ID, discordUser.Avatar)
-	}
-
+// upsertUser returns the user an identity is linked to, creating a user with
+// the identity as its primary identity on first login
+func upsertUser(ctx context.Context, providerUser *ProviderUser) (*User, error) {
 	rlog.Info("upserting user",
-		"discord_id", discordUser.ID,
-		"username", discordUser.Username,
-		"avatar_url", avatarURL,
+		"provider", providerUser.Provider,
+		"provider_id", providerUser.ID,
+		"username", providerUser.Username,
 	)
 
-	var user User
+	// Known identity: refresh its profile and log in to the user it belongs to
+	var userID int64
 	err := db.QueryRow(ctx, `
-		INSERT INTO users (discord_id, username, avatar_url, created_at)
-		VALUES ($1, $2, $3, NOW())
-		ON CONFLICT (discord_id) DO UPDATE SET
+		UPDATE auth_identities
+		SET username = $3, avatar_url = $4, email = COALESCE(NULLIF($5, ''), email), last_login_at = NOW()
+		WHERE provider = $1 AND provider_id = $2
+		RETURNING user_id
+	`, providerUser.Provider, providerUser.ID, providerUser.Username, providerUser.AvatarURL,
+		providerUser.Email).Scan(&userID)
+	if err == nil {
+		if deletionPending(ctx, userID) {
+			return nil, fmt.Errorf("%w: the account is being deleted", errLoginDenied)
+		}
+		// The profile follows the identity the account was created with
+		_, _ = db.Exec(ctx, `
+			UPDATE users SET username = $3, avatar_url = $4
+			WHERE id = $5 AND provider = $1 AND provider_id = $2
+		`, providerUser.Provider, providerUser.ID, providerUser.Username, providerUser.AvatarURL, userID)
+		return getUser(ctx, userID)
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, fmt.Errorf("identity lookup failed: %w", err)
+	}
+
+	// With a required Discord server, accounts can only be created through
+	// Discord, where membership is checked
+	if getRequiredGuildID() != "" && providerUser.Provider != "discord" {
+		return nil, fmt.Errorf("%w: sign up with Discord first", errLoginDenied)
+	}
+
+	// Discord users keep their ID in discord_id for the admin list
+	discordID := ""
+	if providerUser.Provider == "discord" {
+		discordID = providerUser.ID
+	}
+
+	var user User
+	err = db.QueryRow(ctx, `
+		INSERT INTO users (provider, provider_id, discord_id, username, avatar_url, email, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), NOW())
+		ON CONFLICT (provider, provider_id) DO UPDATE SET
 			username = EXCLUDED.username,
-			avatar_url = EXCLUDED.avatar_url
-		RETURNING id, discord_id, username, COALESCE(avatar_url, '')
-	`, discordUser.ID, discordUser.Username, avatarURL).Scan(&user.ID, &user.DiscordID, &user.Username, &user.AvatarURL)
+			avatar_url = EXCLUDED.avatar_url,
+			email = COALESCE(EXCLUDED.email, users.email)
+		RETURNING id, provider, COALESCE(discord_id, ''), username, COALESCE(avatar_url, '')
+	`, providerUser.Provider, providerUser.ID, discordID, providerUser.Username, providerUser.AvatarURL,
+		providerUser.Email).Scan(&user.ID, &user.Provider, &user.DiscordID, &user.Username, &user.AvatarURL)
 
 	if err != nil {
 		rlog.Error("database error in upsertUser",
 			"error", err.Error(),
-			"discord_id", discordUser.ID,
+			"provider", providerUser.Provider,
+			"provider_id", providerUser.ID,
 		)
 		return nil, fmt.Errorf("database upsert failed: %w", err)
 	}
 
+	_, err = db.Exec(ctx, `
+		INSERT INTO auth_identities (provider, provider_id, user_id, username, avatar_url, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NOW(), NOW())
+		ON CONFLICT DO NOTHING
+	`, providerUser.Provider, providerUser.ID, user.ID, providerUser.Username, providerUser.AvatarURL,
+		providerUser.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store identity: %w", err)
+	}
+
+	return &user, nil
+}
+
+// getUser loads a user by ID
+func getUser(ctx context.Context, userID int64) (*User, error) {
+	var user User
+	err := db.QueryRow(ctx, `
+		SELECT id, provider, COALESCE(discord_id, ''), username, COALESCE(avatar_url, ''), roles, storage_quota_bytes
+		FROM users WHERE id = $1
+	`, userID).Scan(&user.ID, &user.Provider, &user.DiscordID, &user.Username, &user.AvatarURL, &user.Roles,
+		&user.StorageQuota)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
 	return &user, nil
 }
 
@@ -271,66 +301,6 @@ type tokenResponse struct {
 	Scope        string `json:"scope"`
 }
 
-func exchangeCodeForToken(ctx context.Context, code string) (*tokenResponse, error) {
-	data := url.Values{
-		"client_id":     {secrets.DiscordClientID},
-		"client_secret": {secrets.DiscordClientSecret},
-		"grant_type":    {"authorization_code"},
-		"code":          {code},
-		"redirect_uri":  {getDiscordRedirectURI()},
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://discord.com/api/oauth2/token", strings.NewReader(data.Encode()))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to exchange code for token")
-	}
-
-	var tokenResp tokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return nil, err
-	}
-
-	return &tokenResp, nil
-}
-
-func getDiscordUser(ctx context.Context, accessToken string) (*DiscordUser, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://discord.com/api/users/@me", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to get Discord user")
-	}
-
-	var user DiscordUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
 func generateRandomState() string {
 	b := make([]byte, 16)
 	rand.Read(b)
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"time"
 
 	"encore.dev/beta/auth"
@@ -28,6 +30,32 @@ func AuthHandler(ctx context.Context, params *AuthParams) (auth.UID, *UserData,
 		return "", nil, errs.B().Code(errs.Unauthenticated).Msg("missing authorization token").Err()
 	}
 
+	// API keys are limited to their scopes by ScopeMiddleware
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		userData, err := lookupAPIKey(ctx, token)
+		if err != nil {
+			return "", nil, errs.B().Code(errs.Unauthenticated).Msg("invalid API key").Err()
+		}
+		return userUID(userData.UserID), userData, nil
+	}
+
+	// JWT access tokens are self-contained; the only lookup rejects tokens of
+	// accounts being or already deleted, which refresh tokens can't renew
+	if isJWT(token) {
+		userData, err := parseAccessToken(token)
+		if err != nil {
+			return "", nil, errs.B().Code(errs.Unauthenticated).Msg("invalid access token: " + err.Error()).Err()
+		}
+		deleted, err := accountDeleted(ctx, userData.UserID)
+		if err != nil {
+			return "", nil, errs.B().Code(errs.Unavailable).Msg("failed to check account").Err()
+		}
+		if deleted {
+			return "", nil, errs.B().Code(errs.Unauthenticated).Msg("account deleted").Err()
+		}
+		return userUID(userData.UserID), userData, nil
+	}
+
 	// Look up session
 	session, exists := sessions[token]
 	if !exists {
@@ -41,15 +69,50 @@ func AuthHandler(ctx context.Context, params *AuthParams) (auth.UID, *UserData,
 	}
 
 	// Get user from database
+	userData, err := loadUserData(ctx, session.UserID)
+	if err != nil {
+		return "", nil, errs.B().Code(errs.Unauthenticated).Msg("user not found").Err()
+	}
+
+	return userUID(userData.UserID), userData, nil
+}
+
+// loadUserData returns the auth data of a user from the database
+func loadUserData(ctx context.Context, userID int64) (*UserData, error) {
 	var userData UserData
+	var quota *int64
 	err := db.QueryRow(ctx, `
-		SELECT id, discord_id, username
+		SELECT id, COALESCE(discord_id, ''), username, roles, storage_quota_bytes
 		FROM users WHERE id = $1
-	`, session.UserID).Scan(&userData.UserID, &userData.DiscordID, &userData.Username)
-
+	`, userID).Scan(&userData.UserID, &userData.DiscordID, &userData.Username, &userData.Roles, &quota)
 	if err != nil {
-		return "", nil, errs.B().Code(errs.Unauthenticated).Msg("user not found").Err()
+		return nil, err
 	}
+	userData.IsAdmin = isAdmin(userData.DiscordID, userData.Roles)
+	userData.StorageQuotaBytes = effectiveQuota(quota)
+	return &userData, nil
+}
+
+// LookupUserRequest selects the user to look up
+type LookupUserRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// LookupUser returns a user's auth data for services acting on their behalf
+// outside a request of theirs, such as guest uploads. Accounts being deleted
+// are not found.
+//
+//encore:api private
+func LookupUser(ctx context.Context, req *LookupUserRequest) (*UserData, error) {
+	userData, err := loadUserData(ctx, req.UserID)
+	if err != nil || deletionPending(ctx, req.UserID) {
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
+	}
+	return userData, nil
+}
 
-	return auth.UID(userData.DiscordID), &userData, nil
+// userUID is the Encore user ID of a user; the numeric user ID, since not
+// every user has a Discord ID
+func userUID(userID int64) auth.UID {
+	return auth.UID(strconv.FormatInt(userID, 10))
 }
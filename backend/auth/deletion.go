@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// deletionServices are the services that clean up a deleted account's data
+// and report back with ReportDeletionProgress
+var deletionServices = []string{"media", "collection", "processing", "notification", "team"}
+
+// AccountDeletionRequested is published when a user deletes their account;
+// every service in deletionServices removes the user's data
+type AccountDeletionRequested struct {
+	DeletionID string `json:"deletion_id"`
+	UserID     int64  `json:"user_id"`
+}
+
+// AccountDeletionRequestedTopic fans account deletions out to the services
+var AccountDeletionRequestedTopic = pubsub.NewTopic[*AccountDeletionRequested]("account-deletion-requested", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// DeleteAccountRequest confirms the deletion with the account's username
+type DeleteAccountRequest struct {
+	Confirm string `json:"confirm"`
+}
+
+// DeletionStep is the cleanup progress of one service
+type DeletionStep struct {
+	Service      string     `json:"service"`
+	Status       string     `json:"status"`
+	DeletedItems int        `json:"deleted_items"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+}
+
+// AccountDeletion reports the progress of an account deletion
+type AccountDeletion struct {
+	ID          string         `json:"id"`
+	Status      string         `json:"status"`
+	Steps       []DeletionStep `json:"steps"`
+	RequestedAt time.Time      `json:"requested_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+}
+
+// DeleteAccount deletes the caller's account and all of their data. The
+// request must repeat the username as confirmation. Sign-in stops at once;
+// media, collections and stored files are removed asynchronously, and the
+// returned deletion ID can be polled with GetAccountDeletion.
+//
+//encore:api auth method=DELETE path=/auth/account
+func DeleteAccount(ctx context.Context, req *DeleteAccountRequest) (*AccountDeletion, error) {
+	userData := auth.Data().(*UserData)
+
+	if req.Confirm == "" || req.Confirm != userData.Username {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg("confirm must be the account's username").Err()
+	}
+
+	// A repeated request returns the deletion already in progress
+	var deletionID string
+	err := db.QueryRow(ctx, `
+		SELECT id FROM account_deletions WHERE user_id = $1 AND status = 'pending'
+	`, userData.UserID).Scan(&deletionID)
+	if err == nil {
+		return getAccountDeletion(ctx, deletionID)
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO account_deletions (user_id, requested_at) VALUES ($1, NOW()) RETURNING id
+	`, userData.UserID).Scan(&deletionID)
+	if err != nil {
+		rlog.Error("failed to create account deletion", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+	for _, service := range deletionServices {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO account_deletion_steps (deletion_id, service) VALUES ($1, $2)
+		`, deletionID, service); err != nil {
+			rlog.Error("failed to create account deletion step", "error", err, "service", service)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+		}
+	}
+
+	// Lock the account out before any data is removed
+	if _, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL
+	`, userData.UserID); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL
+	`, userData.UserID); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete account").Err()
+	}
+
+	for token, session := range sessions {
+		if session.UserID == userData.UserID {
+			delete(sessions, token)
+		}
+	}
+
+	_, err = AccountDeletionRequestedTopic.Publish(ctx, &AccountDeletionRequested{
+		DeletionID: deletionID,
+		UserID:     userData.UserID,
+	})
+	if err != nil {
+		// Nothing would clean up without the event, so drop the deletion and
+		// let the user try again
+		rlog.Error("failed to publish account deletion", "error", err, "deletion_id", deletionID)
+		_, _ = db.Exec(ctx, `DELETE FROM account_deletions WHERE id = $1`, deletionID)
+		return nil, errs.B().Code(errs.Unavailable).Msg("failed to start account deletion, try again").Err()
+	}
+
+	rlog.Info("account deletion requested", "user_id", userData.UserID, "deletion_id", deletionID)
+	return getAccountDeletion(ctx, deletionID)
+}
+
+// GetAccountDeletion returns the progress of an account deletion. It needs no
+// authentication since the account may already be gone; the ID is only
+// known to the user who requested the deletion.
+//
+//encore:api public method=GET path=/auth/account/deletions/:id
+func GetAccountDeletion(ctx context.Context, id string) (*AccountDeletion, error) {
+	return getAccountDeletion(ctx, id)
+}
+
+func getAccountDeletion(ctx context.Context, id string) (*AccountDeletion, error) {
+	var d AccountDeletion
+	err := db.QueryRow(ctx, `
+		SELECT id, status, requested_at, completed_at FROM account_deletions WHERE id = $1
+	`, id).Scan(&d.ID, &d.Status, &d.RequestedAt, &d.CompletedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("deletion not found").Err()
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT service, status, deleted_items, completed_at
+		FROM account_deletion_steps WHERE deletion_id = $1
+		ORDER BY service
+	`, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get deletion").Err()
+	}
+	defer rows.Close()
+
+	d.Steps = []DeletionStep{}
+	for rows.Next() {
+		var s DeletionStep
+		if err := rows.Scan(&s.Service, &s.Status, &s.DeletedItems, &s.CompletedAt); err != nil {
+			continue
+		}
+		d.Steps = append(d.Steps, s)
+	}
+
+	return &d, nil
+}
+
+// DeletionProgress is a service's report that it removed a user's data
+type DeletionProgress struct {
+	DeletionID   string `json:"deletion_id"`
+	Service      string `json:"service"`
+	DeletedItems int    `json:"deleted_items"`
+}
+
+// ReportDeletionProgress marks a service's cleanup done. When the last
+// service reports, the user and everything auth stores about them is deleted.
+//
+//encore:api private
+func ReportDeletionProgress(ctx context.Context, req *DeletionProgress) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var status string
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, status FROM account_deletions WHERE id = $1 FOR UPDATE
+	`, req.DeletionID).Scan(&userID, &status)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("deletion not found").Err()
+	}
+	if status == "completed" {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE account_deletion_steps
+		SET status = 'completed', deleted_items = deleted_items + $3, completed_at = NOW()
+		WHERE deletion_id = $1 AND service = $2 AND status = 'pending'
+	`, req.DeletionID, req.Service, req.DeletedItems); err != nil {
+		return err
+	}
+
+	var remaining int
+	if err := tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM account_deletion_steps WHERE deletion_id = $1 AND status = 'pending'
+	`, req.DeletionID).Scan(&remaining); err != nil {
+		return err
+	}
+	if remaining == 0 {
+		// Identities, refresh tokens and API keys cascade with the user
+		if _, err := tx.Exec(ctx, `DELETE FROM audit_log WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE account_deletions SET status = 'completed', completed_at = NOW() WHERE id = $1
+		`, req.DeletionID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if remaining == 0 {
+		removeExports(ctx, userID)
+	}
+
+	rlog.Info("account deletion progress", "deletion_id", req.DeletionID, "service", req.Service,
+		"deleted_items", req.DeletedItems, "remaining", remaining)
+	return nil
+}
+
+// deletionPending reports whether the user's account is being deleted
+func deletionPending(ctx context.Context, userID int64) bool {
+	var pending bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM account_deletions WHERE user_id = $1 AND status = 'pending')
+	`, userID).Scan(&pending)
+	return err == nil && pending
+}
+
+// accountDeleted reports whether a user's account is being or was deleted.
+// User IDs aren't reused, so a completed deletion keeps matching.
+func accountDeleted(ctx context.Context, userID int64) (bool, error) {
+	var deleted bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM account_deletions WHERE user_id = $1)
+	`, userID).Scan(&deleted)
+	return deleted, err
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DiscordUser represents the Discord user data from OAuth
+type DiscordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar"`
+}
+
+// getDiscordRedirectURI returns the Discord OAuth redirect URI
+func getDiscordRedirectURI() string {
+	return getEnvOrDefault("DISCORD_REDIRECT_URI", "http://localhost:4000/auth/discord/callback")
+}
+
+// getRequiredGuildID returns the Discord server users must be a member of
+// (DISCORD_REQUIRED_GUILD_ID); empty disables the gate
+func getRequiredGuildID() string {
+	return strings.TrimSpace(os.Getenv("DISCORD_REQUIRED_GUILD_ID"))
+}
+
+// discordGuild is a server from /users/@me/guilds
+type discordGuild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// discordProvider implements Discord login
+type discordProvider struct{}
+
+var discord oauthProvider = discordProvider{}
+
+func (discordProvider) Name() string { return "discord" }
+
+func (discordProvider) RedirectURI() string { return getDiscordRedirectURI() }
+
+func (discordProvider) AuthURL(state string) string {
+	// The guilds scope is only requested when membership is checked
+	scope := "identify"
+	if getRequiredGuildID() != "" {
+		scope += " guilds"
+	}
+	params := url.Values{
+		"client_id":     {secrets.DiscordClientID},
+		"redirect_uri":  {getDiscordRedirectURI()},
+		"response_type": {"code"},
+		"scope":         {scope},
+		"state":         {state},
+	}
+	return fmt.Sprintf("https://discord.com/api/oauth2/authorize?%s", params.Encode())
+}
+
+func (discordProvider) Exchange(ctx context.Context, code string) (*tokenResponse, error) {
+	return exchangeCode(ctx, "https://discord.com/api/oauth2/token", url.Values{
+		"client_id":     {secrets.DiscordClientID},
+		"client_secret": {secrets.DiscordClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {getDiscordRedirectURI()},
+	})
+}
+
+func (discordProvider) FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error) {
+	var user DiscordUser
+	if err := getJSON(ctx, "https://discord.com/api/users/@me", accessToken, &user); err != nil {
+		return nil, fmt.Errorf("failed to get Discord user: %w", err)
+	}
+
+	if guildID := getRequiredGuildID(); guildID != "" {
+		member, err := isGuildMember(ctx, accessToken, guildID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check Discord server membership: %w", err)
+		}
+		if !member {
+			return nil, fmt.Errorf("%w: not a member of the required Discord server", errLoginDenied)
+		}
+	}
+
+	avatarURL := ""
+	if user.Avatar != "" {
+		avatarURL = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", user.ID, user.Avatar)
+	}
+	return &ProviderUser{
+		Provider:  "discord",
+		ID:        user.ID,
+		Username:  user.Username,
+		AvatarURL: avatarURL,
+	}, nil
+}
+
+// isGuildMember reports whether the user of the access token is a member of
+// the guild. Discord returns at most 200 guilds, the membership limit.
+func isGuildMember(ctx context.Context, accessToken, guildID string) (bool, error) {
+	var guilds []discordGuild
+	if err := getJSON(ctx, "https://discord.com/api/users/@me/guilds?limit=200", accessToken, &guilds); err != nil {
+		return false, err
+	}
+	for _, guild := range guilds {
+		if guild.ID == guildID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
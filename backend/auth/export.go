@@ -0,0 +1,467 @@
+package auth
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/metrics"
+	"encore.app/objectstore"
+)
+
+// Databases of the other services storing user data, read for data exports
+var (
+	mediaDB        = sqldb.Named("media")
+	collectionDB   = sqldb.Named("collection")
+	teamDB         = sqldb.Named("team")
+	notificationDB = sqldb.Named("notification")
+)
+
+// exportLinkTTL is how long a download link of an export is valid
+const exportLinkTTL = time.Hour
+
+// getExportRetention returns how long export archives are kept
+// (DATA_EXPORT_RETENTION)
+func getExportRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("DATA_EXPORT_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// getMinioClient returns the shared MinIO client of the auth service
+func getMinioClient() (*minio.Client, error) {
+	return objectstore.Client("auth", secrets.S3AccessKey, secrets.S3SecretKey)
+}
+
+// DataExportRequested is published when a user requests a data export
+type DataExportRequested struct {
+	ExportID string `json:"export_id"`
+	UserID   int64  `json:"user_id"`
+}
+
+// DataExportRequestedTopic queues data exports
+var DataExportRequestedTopic = pubsub.NewTopic[*DataExportRequested]("data-export-requested", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(DataExportRequestedTopic, "data-export-worker",
+	pubsub.SubscriptionConfig[*DataExportRequested]{
+		Handler: buildDataExport,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// Expired archives are removed hourly
+var _ = cron.NewJob("data-export-cleanup", cron.JobConfig{
+	Title:    "Remove expired data export archives",
+	Every:    1 * cron.Hour,
+	Endpoint: CleanupDataExports,
+})
+
+// CreateDataExportRequest selects what the export contains
+type CreateDataExportRequest struct {
+	// IncludeOriginals adds the original uploaded files to the archive
+	IncludeOriginals bool `json:"include_originals,omitempty"`
+}
+
+// DataExport reports the state of a data export
+type DataExport struct {
+	ID               string     `json:"id"`
+	Status           string     `json:"status"`
+	IncludeOriginals bool       `json:"include_originals"`
+	SizeBytes        *int64     `json:"size_bytes,omitempty"`
+	ErrorMessage     string     `json:"error_message,omitempty"`
+	DownloadURL      string     `json:"download_url,omitempty"`
+	RequestedAt      time.Time  `json:"requested_at"`
+	CompletedAt      *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateDataExport starts assembling an archive of everything stored about
+// the caller: profile and settings, media metadata, tags and retention
+// rules, collections and their sharing, teams, notifications and audit
+// history, optionally with the original files. Poll GetDataExport for the
+// download link.
+//
+//encore:api auth method=POST path=/auth/export
+func CreateDataExport(ctx context.Context, req *CreateDataExportRequest) (*DataExport, error) {
+	userData := auth.Data().(*UserData)
+
+	// Only one export is assembled per user at a time
+	var exportID string
+	err := db.QueryRow(ctx, `
+		SELECT id FROM data_exports WHERE user_id = $1 AND status IN ('pending', 'processing')
+	`, userData.UserID).Scan(&exportID)
+	if err == nil {
+		return getDataExport(ctx, exportID, userData.UserID)
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create export").Err()
+	}
+
+	err = db.QueryRow(ctx, `
+		INSERT INTO data_exports (user_id, include_originals, requested_at) VALUES ($1, $2, NOW()) RETURNING id
+	`, userData.UserID, req.IncludeOriginals).Scan(&exportID)
+	if err != nil {
+		rlog.Error("failed to create data export", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create export").Err()
+	}
+
+	_, err = DataExportRequestedTopic.Publish(ctx, &DataExportRequested{ExportID: exportID, UserID: userData.UserID})
+	if err != nil {
+		rlog.Error("failed to publish data export", "error", err, "export_id", exportID)
+		_, _ = db.Exec(ctx, `
+			UPDATE data_exports SET status = 'failed', error_message = 'failed to queue export' WHERE id = $1
+		`, exportID)
+		return nil, errs.B().Code(errs.Unavailable).Msg("failed to queue export, try again").Err()
+	}
+
+	return getDataExport(ctx, exportID, userData.UserID)
+}
+
+// GetDataExport returns the state of one of the caller's data exports. Ready
+// exports include a download link valid for an hour.
+//
+//encore:api auth method=GET path=/auth/export/:id
+func GetDataExport(ctx context.Context, id string) (*DataExport, error) {
+	userData := auth.Data().(*UserData)
+	return getDataExport(ctx, id, userData.UserID)
+}
+
+func getDataExport(ctx context.Context, id string, userID int64) (*DataExport, error) {
+	var e DataExport
+	var s3Key string
+	err := db.QueryRow(ctx, `
+		SELECT id, status, include_originals, size_bytes, COALESCE(error_message, ''), COALESCE(s3_key, ''),
+			   requested_at, completed_at, expires_at
+		FROM data_exports WHERE id = $1 AND user_id = $2
+	`, id, userID).Scan(&e.ID, &e.Status, &e.IncludeOriginals, &e.SizeBytes, &e.ErrorMessage, &s3Key,
+		&e.RequestedAt, &e.CompletedAt, &e.ExpiresAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("export not found").Err()
+	}
+
+	if e.Status == "ready" && s3Key != "" && e.ExpiresAt != nil && time.Now().Before(*e.ExpiresAt) {
+		client, err := getMinioClient()
+		if err != nil {
+			rlog.Error("failed to create MinIO client", "error", err)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+		}
+		url, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), s3Key, exportLinkTTL, nil)
+		if err != nil {
+			rlog.Error("failed to presign export", "error", err, "export_id", id)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to generate download URL").Err()
+		}
+		e.DownloadURL = url.String()
+	}
+
+	return &e, nil
+}
+
+// buildDataExport assembles and uploads an export archive. Failures are
+// recorded on the export rather than retried; the user can request again.
+func buildDataExport(ctx context.Context, msg *DataExportRequested) error {
+	var includeOriginals bool
+	err := db.QueryRow(ctx, `
+		UPDATE data_exports SET status = 'processing'
+		WHERE id = $1 AND status IN ('pending', 'processing')
+		RETURNING include_originals
+	`, msg.ExportID).Scan(&includeOriginals)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil // already finished
+	}
+	if err != nil {
+		return err
+	}
+
+	s3Key := fmt.Sprintf("exports/%d/%s.zip", msg.UserID, msg.ExportID)
+	size, err := writeExportArchive(ctx, msg.UserID, s3Key, includeOriginals)
+	if err != nil {
+		rlog.Error("data export failed", "error", err, "export_id", msg.ExportID, "user_id", msg.UserID)
+		_, _ = db.Exec(ctx, `
+			UPDATE data_exports SET status = 'failed', error_message = $2, completed_at = NOW() WHERE id = $1
+		`, msg.ExportID, err.Error())
+		return nil
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE data_exports
+		SET status = 'ready', s3_key = $2, size_bytes = $3, completed_at = NOW(), expires_at = $4
+		WHERE id = $1
+	`, msg.ExportID, s3Key, size, time.Now().Add(getExportRetention()))
+	if err != nil {
+		return err
+	}
+
+	rlog.Info("data export ready", "export_id", msg.ExportID, "user_id", msg.UserID, "size_bytes", size)
+	return nil
+}
+
+// exportSection is a JSON file of the archive and the query producing it
+type exportSection struct {
+	name  string
+	db    *sqldb.Database
+	query string
+}
+
+// exportSections are the JSON files of every export; each query returns one
+// JSON document for the user $1
+var exportSections = []exportSection{
+	{"profile.json", db, `
+		SELECT json_build_object(
+			'user', (SELECT row_to_json(u) FROM (
+				SELECT id, provider, provider_id, discord_id, username, avatar_url, email, roles,
+					   storage_quota_bytes, created_at
+				FROM users WHERE id = $1) u),
+			'identities', (SELECT COALESCE(json_agg(i ORDER BY i.created_at), '[]') FROM (
+				SELECT provider, provider_id, username, avatar_url, email, created_at, last_login_at
+				FROM auth_identities WHERE user_id = $1) i),
+			'api_keys', (SELECT COALESCE(json_agg(k ORDER BY k.created_at), '[]') FROM (
+				SELECT id, name, key_prefix, scopes, created_at, last_used_at, revoked_at
+				FROM api_keys WHERE user_id = $1) k),
+			'login_sessions', (SELECT COALESCE(json_agg(l ORDER BY l.created_at), '[]') FROM (
+				SELECT provider, device, user_agent, ip_address, country, created_at
+				FROM login_sessions WHERE user_id = $1) l),
+			-- The Discord webhook URL is left out, as anyone holding it can post
+			'settings', (SELECT row_to_json(s) FROM (
+				SELECT default_collection_public, preferred_preset, presign_ttl_seconds, expired_media,
+					   discord_webhook_url IS NOT NULL AS discord_webhook_set, notify_processing_complete,
+					   notify_processing_failed, notify_new_login, notify_collection_updates, notify_team_usage,
+					   notify_scheduled_publish, updated_at
+				FROM user_settings WHERE user_id = $1) s),
+			'passkeys', (SELECT COALESCE(json_agg(p ORDER BY p.created_at), '[]') FROM (
+				SELECT credential_id, name, algorithm, sign_count, created_at, last_used_at
+				FROM webauthn_credentials WHERE user_id = $1) p)
+		)::text`},
+	{"audit_log.json", db, `
+		SELECT COALESCE(json_agg(a ORDER BY a.created_at), '[]')::text FROM (
+			SELECT event, service, resource_type, resource_id, provider, ip_address, user_agent, details, before,
+				   after, created_at
+			FROM audit_log WHERE user_id = $1) a`},
+	{"media.json", mediaDB, `
+		SELECT COALESCE(json_agg(m ORDER BY m.created_at), '[]')::text FROM (
+			SELECT media.*, ARRAY(
+				SELECT t.name FROM media_tags mt JOIN tags t ON t.id = mt.tag_id
+				WHERE mt.media_id = media.id ORDER BY t.name) AS tags
+			FROM media WHERE owner_id = $1) m`},
+	{"collections.json", collectionDB, `
+		SELECT COALESCE(json_agg(c ORDER BY c.created_at), '[]')::text FROM (
+			SELECT c.id, c.title, c.description, c.visibility, c.share_scopes, c.created_at, c.deleted_at, ARRAY(
+				SELECT i.media_id FROM collection_items i
+				WHERE i.collection_id = c.id ORDER BY i.added_at) AS media_ids
+			FROM collections c WHERE c.owner_id = $1) c`},
+	{"sharing.json", collectionDB, `
+		SELECT json_build_object(
+			'share_tokens', (SELECT COALESCE(json_agg(t ORDER BY t.created_at), '[]') FROM (
+				SELECT t.token, t.collection_id, t.label, t.scopes, t.media_ids, t.stream_only, t.max_downloads,
+					   t.downloads, t.expires_at, t.created_at
+				FROM collection_share_tokens t JOIN collections c ON c.id = t.collection_id
+				WHERE c.owner_id = $1) t),
+			'shared_with', (SELECT COALESCE(json_agg(s ORDER BY s.shared_at), '[]') FROM (
+				SELECT s.collection_id, s.user_id, s.shared_at
+				FROM collection_shares s JOIN collections c ON c.id = s.collection_id
+				WHERE c.owner_id = $1) s),
+			'shared_with_me', (SELECT COALESCE(json_agg(s ORDER BY s.shared_at), '[]') FROM (
+				SELECT collection_id, shared_at FROM collection_shares WHERE user_id = $1) s),
+			'follows', (SELECT COALESCE(json_agg(f ORDER BY f.followed_at), '[]') FROM (
+				SELECT collection_id, followed_at, last_seen_at FROM collection_follows WHERE user_id = $1) f)
+		)::text`},
+	{"retention_rules.json", mediaDB, `
+		SELECT COALESCE(json_agg(r ORDER BY r.created_at), '[]')::text FROM (
+			SELECT id, tag, action, after_days, created_at FROM retention_rules WHERE owner_id = $1) r`},
+	{"teams.json", teamDB, `
+		SELECT COALESCE(json_agg(t ORDER BY t.added_at), '[]')::text FROM (
+			SELECT t.id, t.name, m.role, m.added_by, m.added_at
+			FROM team_members m JOIN teams t ON t.id = m.team_id WHERE m.user_id = $1) t`},
+	{"notifications.json", notificationDB, `
+		SELECT json_build_object(
+			'preferences', (SELECT row_to_json(p) FROM (
+				SELECT discord_enabled, email_enabled, updated_at
+				FROM notification_preferences WHERE user_id = $1) p),
+			'deliveries', (SELECT COALESCE(json_agg(d ORDER BY d.created_at), '[]') FROM (
+				SELECT kind, channel, subject, status, error_message, attempts, created_at, sent_at
+				FROM notification_deliveries WHERE user_id = $1) d)
+		)::text`},
+}
+
+// writeExportArchive writes the user's export zip to a temp file and
+// uploads it to s3Key, returning its size
+func writeExportArchive(ctx context.Context, userID int64, s3Key string, includeOriginals bool) (int64, error) {
+	client, err := getMinioClient()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	file, err := os.CreateTemp("", "data-export-*.zip")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	for _, section := range exportSections {
+		var data string
+		if err := section.db.QueryRow(ctx, section.query, userID).Scan(&data); err != nil {
+			return 0, fmt.Errorf("failed to export %s: %w", section.name, err)
+		}
+		w, err := zw.Create(section.name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			return 0, err
+		}
+	}
+
+	if includeOriginals {
+		if err := writeExportOriginals(ctx, client, zw, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = objectstore.FPutObject(ctx, client, s3Key, file.Name(), minio.PutObjectOptions{
+		ContentType: "application/zip",
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload export: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// writeExportOriginals adds the original file of every media item as
+// originals/<media id>/<filename>; originals in cold storage are read from
+// the cold bucket
+func writeExportOriginals(ctx context.Context, client *minio.Client, zw *zip.Writer, userID int64) error {
+	rows, err := mediaDB.Query(ctx, `
+		SELECT id, s3_key_original, COALESCE(original_filename, ''), storage_tier <> 'hot' FROM media
+		WHERE owner_id = $1 AND status <> 'uploading'
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return err
+	}
+	type original struct {
+		mediaID, s3Key, filename string
+		cold                     bool
+	}
+	var originals []original
+	for rows.Next() {
+		var o original
+		if err := rows.Scan(&o.mediaID, &o.s3Key, &o.filename, &o.cold); err != nil {
+			continue
+		}
+		originals = append(originals, o)
+	}
+	rows.Close()
+
+	for _, o := range originals {
+		filename := path.Base(o.filename)
+		if o.filename == "" {
+			filename = path.Base(o.s3Key)
+		}
+		bucket := objectstore.Bucket()
+		if o.cold && objectstore.ColdBucket() != "" {
+			bucket = objectstore.ColdBucket()
+		}
+		object, err := client.GetObject(ctx, bucket, o.s3Key, minio.GetObjectOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to read original of %s: %w", o.mediaID, err)
+		}
+		// Originals are already compressed, so they are stored as-is
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "originals/" + o.mediaID + "/" + filename, Method: zip.Store})
+		if err == nil {
+			_, err = io.Copy(w, object)
+		}
+		object.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export original of %s: %w", o.mediaID, err)
+		}
+	}
+	return nil
+}
+
+// CleanupDataExportsResponse reports how many archives were removed
+type CleanupDataExportsResponse struct {
+	Expired int `json:"expired"`
+}
+
+// CleanupDataExports removes export archives past their retention
+//
+//encore:api private
+func CleanupDataExports(ctx context.Context) (*CleanupDataExportsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, s3_key FROM data_exports WHERE status = 'ready' AND expires_at < NOW()
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type expiredExport struct {
+		id, s3Key string
+	}
+	var expired []expiredExport
+	for rows.Next() {
+		var e expiredExport
+		if err := rows.Scan(&e.id, &e.s3Key); err != nil {
+			continue
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CleanupDataExportsResponse{}
+	for _, e := range expired {
+		if err := client.RemoveObject(ctx, objectstore.Bucket(), e.s3Key, minio.RemoveObjectOptions{}); err != nil {
+			rlog.Warn("failed to remove expired export", "error", err, "export_id", e.id)
+			continue
+		}
+		_, _ = db.Exec(ctx, `UPDATE data_exports SET status = 'expired' WHERE id = $1`, e.id)
+		resp.Expired++
+	}
+	return resp, nil
+}
+
+// removeExports deletes every export archive of a user
+func removeExports(ctx context.Context, userID int64) {
+	client, err := getMinioClient()
+	if err != nil {
+		return
+	}
+	prefix := fmt.Sprintf("exports/%d/", userID)
+	for object := range client.ListObjects(ctx, objectstore.Bucket(), minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			continue
+		}
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), object.Key, minio.RemoveObjectOptions{})
+	}
+}
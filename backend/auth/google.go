@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// googleUser is the OpenID Connect userinfo of a Google account
+type googleUser struct {
+	Sub     string `json:"sub"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Picture string `json:"picture"`
+}
+
+// getGoogleRedirectURI returns the Google OAuth redirect URI
+func getGoogleRedirectURI() string {
+	return getEnvOrDefault("GOOGLE_REDIRECT_URI", "http://localhost:4000/auth/google/callback")
+}
+
+// googleProvider implements Google sign-in
+type googleProvider struct{}
+
+var google oauthProvider = googleProvider{}
+
+func (googleProvider) Name() string { return "google" }
+
+func (googleProvider) RedirectURI() string { return getGoogleRedirectURI() }
+
+func (googleProvider) AuthURL(state string) string {
+	params := url.Values{
+		"client_id":     {secrets.GoogleClientID},
+		"redirect_uri":  {getGoogleRedirectURI()},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"prompt":        {"select_account"},
+	}
+	return fmt.Sprintf("https://accounts.google.com/o/oauth2/v2/auth?%s", params.Encode())
+}
+
+func (googleProvider) Exchange(ctx context.Context, code string) (*tokenResponse, error) {
+	return exchangeCode(ctx, "https://oauth2.googleapis.com/token", url.Values{
+		"client_id":     {secrets.GoogleClientID},
+		"client_secret": {secrets.GoogleClientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {getGoogleRedirectURI()},
+	})
+}
+
+func (googleProvider) FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error) {
+	var user googleUser
+	if err := getJSON(ctx, "https://openidconnect.googleapis.com/v1/userinfo", accessToken, &user); err != nil {
+		return nil, fmt.Errorf("failed to get Google user: %w", err)
+	}
+
+	username := user.Name
+	if username == "" {
+		username = user.Email
+	}
+	return &ProviderUser{
+		Provider:  "google",
+		ID:        user.Sub,
+		Username:  username,
+		AvatarURL: user.Picture,
+		Email:     user.Email,
+	}, nil
+}
+
+// GoogleLogin redirects to Google sign-in. An optional ?redirect=/path is the
+// frontend path to return to after login.
+//
+//encore:api public raw method=GET path=/auth/google/login
+func GoogleLogin(w http.ResponseWriter, req *http.Request) {
+	startLogin(w, req, google)
+}
+
+// GoogleCallback handles the Google OAuth callback
+//
+//encore:api public raw method=GET path=/auth/google/callback
+func GoogleCallback(w http.ResponseWriter, req *http.Request) {
+	finishLogin(w, req, google)
+}
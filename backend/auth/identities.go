@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// providers are the login providers by name
+var providers = map[string]oauthProvider{
+	"discord": discord,
+	"google":  google,
+}
+
+// linkTokenTTL is how long a link URL from LinkProvider can be used
+const linkTokenTTL = 5 * time.Minute
+
+// linkCookie prefixes the cookies that bind a link URL to the browser that
+// asked for it, one per provider
+const linkCookie = "mediavault_link_"
+
+// getAPIBaseURL returns the public URL of this API, used in link URLs
+func getAPIBaseURL() string {
+	return getEnvOrDefault("API_BASE_URL", "http://localhost:4000")
+}
+
+// signLinkToken returns a short-lived token that lets the login of provider
+// link the identity to the user. The nonce must also be in the browser's
+// link cookie.
+func signLinkToken(provider oauthProvider, userID int64, nonce string) string {
+	payload := strconv.FormatInt(userID, 10) + "." + nonce + "." + strconv.FormatInt(time.Now().Add(linkTokenTTL).Unix(), 10)
+	return payload + "." + jwtSignature("link:"+provider.Name()+":"+payload)
+}
+
+// verifyLinkToken checks a link token for provider and returns its user and
+// nonce
+func verifyLinkToken(provider oauthProvider, token string) (int64, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || secrets.SessionSecret == "" {
+		return 0, "", errors.New("malformed link token")
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(jwtSignature("link:"+provider.Name()+":"+payload))) {
+		return 0, "", errors.New("invalid link token signature")
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, "", errors.New("link token expired")
+	}
+	userID, err := strconv.ParseInt(parts[0], 10, 64)
+	return userID, parts[1], err
+}
+
+// newLinkCookie holds a link nonce for the login and callback of provider.
+// It outlives the link URL by the time a login may take.
+func newLinkCookie(provider oauthProvider, nonce string) *http.Cookie {
+	ttl := linkTokenTTL + oauthStateTTL
+	return &http.Cookie{
+		Name:     linkCookie + provider.Name(),
+		Value:    nonce,
+		Path:     "/auth/" + provider.Name(),
+		Expires:  time.Now().Add(ttl),
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(getAPIBaseURL(), "https://"),
+		// Lax so the cookie is sent on the top-level redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// verifyLinkCookie checks that the callback reached the browser that asked
+// for the link, so a link URL handed to someone else can't attach their
+// identity to the requester. The cookie is cleared either way.
+func verifyLinkCookie(w http.ResponseWriter, req *http.Request, provider oauthProvider, nonce string) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkCookie + provider.Name(),
+		Value:    "",
+		Path:     "/auth/" + provider.Name(),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	cookie, err := req.Cookie(linkCookie + provider.Name())
+	if err != nil {
+		return errors.New("missing link cookie")
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(nonce)) != 1 {
+		return errors.New("link cookie mismatch")
+	}
+	return nil
+}
+
+// Identity is an OAuth identity that logs in to the user
+type Identity struct {
+	Provider    string     `json:"provider"`
+	ProviderID  string     `json:"provider_id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email,omitempty"`
+	Primary     bool       `json:"primary"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// ListIdentitiesResponse contains the caller's identities
+type ListIdentitiesResponse struct {
+	Identities []Identity `json:"identities"`
+}
+
+// ListIdentities returns the OAuth identities linked to the caller
+//
+//encore:api auth method=GET path=/auth/identities
+func ListIdentities(ctx context.Context) (*ListIdentitiesResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT i.provider, i.provider_id, COALESCE(i.username, ''), COALESCE(i.email, ''),
+			   i.provider = u.provider AND i.provider_id = u.provider_id, i.created_at, i.last_login_at
+		FROM auth_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.user_id = $1
+		ORDER BY i.created_at
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list identities").Err()
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var i Identity
+		if err := rows.Scan(&i.Provider, &i.ProviderID, &i.Username, &i.Email, &i.Primary,
+			&i.CreatedAt, &i.LastLoginAt); err != nil {
+			continue
+		}
+		identities = append(identities, i)
+	}
+
+	return &ListIdentitiesResponse{Identities: identities}, nil
+}
+
+// LinkProviderRequest optionally selects the frontend path to return to
+type LinkProviderRequest struct {
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// LinkProviderResponse contains the URL the browser has to open to link
+type LinkProviderResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// SetCookie binds the URL to the browser that asked for it
+	SetCookie string `header:"Set-Cookie"`
+}
+
+// LinkProvider starts linking an identity of another provider to the caller.
+// The browser opens the returned URL, logs in with the provider and returns
+// to the frontend with ?linked=<provider>. Only the browser that made this
+// request, and so got its cookie, can complete the link.
+//
+//encore:api auth method=POST path=/auth/link/:provider
+func LinkProvider(ctx context.Context, provider string, req *LinkProviderRequest) (*LinkProviderResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	p, ok := providers[provider]
+	if !ok {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown provider").Err()
+	}
+	if secrets.SessionSecret == "" {
+		return nil, errs.B().Code(errs.Internal).Msg("linking is not configured").Err()
+	}
+
+	nonce := generateRandomState()
+	params := url.Values{"link": {signLinkToken(p, userData.UserID, nonce)}}
+	if redirect := sanitizeRedirect(req.Redirect); redirect != "" {
+		params.Set("redirect", redirect)
+	}
+
+	return &LinkProviderResponse{
+		URL:       fmt.Sprintf("%s/auth/%s/login?%s", getAPIBaseURL(), p.Name(), params.Encode()),
+		ExpiresAt: time.Now().Add(linkTokenTTL),
+		SetCookie: newLinkCookie(p, nonce).String(),
+	}, nil
+}
+
+// UnlinkProvider removes the caller's identity of a provider. The identity
+// the account was created with can't be unlinked.
+//
+//encore:api auth method=DELETE path=/auth/link/:provider
+func UnlinkProvider(ctx context.Context, provider string) (*LogoutResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	var primaryProvider string
+	err := db.QueryRow(ctx, `SELECT provider FROM users WHERE id = $1`, userData.UserID).Scan(&primaryProvider)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
+	}
+	if provider == primaryProvider {
+		return nil, errs.B().Code(errs.FailedPrecondition).
+			Msg("the identity the account was created with can't be unlinked").Err()
+	}
+
+	result, err := db.Exec(ctx, `
+		DELETE FROM auth_identities WHERE user_id = $1 AND provider = $2
+	`, userData.UserID, provider)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to unlink identity").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("identity not linked").Err()
+	}
+	if provider == "discord" {
+		_, _ = db.Exec(ctx, `UPDATE users SET discord_id = NULL WHERE id = $1`, userData.UserID)
+	}
+
+	rlog.Info("identity unlinked", "user_id", userData.UserID, "provider", provider)
+	return &LogoutResponse{Success: true}, nil
+}
+
+// linkIdentity adds a provider identity to a user. An identity can only
+// belong to one user, and a user has at most one identity per provider.
+func linkIdentity(ctx context.Context, userID int64, providerUser *ProviderUser) error {
+	var ownerID int64
+	err := db.QueryRow(ctx, `
+		SELECT user_id FROM auth_identities WHERE provider = $1 AND provider_id = $2
+	`, providerUser.Provider, providerUser.ID).Scan(&ownerID)
+	if err == nil {
+		if ownerID == userID {
+			return nil
+		}
+		return errors.New("this account is already used by another user")
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return err
+	}
+
+	result, err := db.Exec(ctx, `
+		INSERT INTO auth_identities (provider, provider_id, user_id, username, avatar_url, email, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NOW())
+		ON CONFLICT DO NOTHING
+	`, providerUser.Provider, providerUser.ID, userID, providerUser.Username, providerUser.AvatarURL,
+		providerUser.Email)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return fmt.Errorf("another %s account is already linked", providerUser.Provider)
+	}
+
+	// Linked Discord identities count for the admin list
+	if providerUser.Provider == "discord" {
+		_, _ = db.Exec(ctx, `UPDATE users SET discord_id = $2 WHERE id = $1 AND discord_id IS NULL`,
+			userID, providerUser.ID)
+	}
+
+	rlog.Info("identity linked", "user_id", userID, "provider", providerUser.Provider)
+	return nil
+}
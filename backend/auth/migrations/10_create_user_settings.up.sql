@@ -0,0 +1,13 @@
+-- Per-user options other services apply when acting for the user; users
+-- without a row get the defaults
+CREATE TABLE user_settings (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    default_collection_public BOOLEAN NOT NULL DEFAULT FALSE,
+    preferred_preset TEXT,
+    presign_ttl_seconds INT NOT NULL DEFAULT 14400,
+    notify_processing_complete BOOLEAN NOT NULL DEFAULT TRUE,
+    notify_processing_failed BOOLEAN NOT NULL DEFAULT TRUE,
+    notify_new_login BOOLEAN NOT NULL DEFAULT TRUE,
+    notify_collection_updates BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+-- Profile shown to other users instead of the provider's username and
+-- avatar; the avatar is an image uploaded as media
+ALTER TABLE users ADD COLUMN display_name TEXT;
+ALTER TABLE users ADD COLUMN avatar_media_id UUID;
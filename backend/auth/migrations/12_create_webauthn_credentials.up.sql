@@ -0,0 +1,34 @@
+-- Passkeys enrolled as a second factor. Once a user has one, logins stay
+-- pending until completed with a passkey assertion.
+CREATE TABLE webauthn_credentials (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- credential_id is base64url without padding, as browsers report it
+    credential_id TEXT NOT NULL UNIQUE,
+    -- public_key is the DER-encoded SubjectPublicKeyInfo
+    public_key BYTEA NOT NULL,
+    algorithm INT NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX idx_webauthn_credentials_user ON webauthn_credentials(user_id);
+
+-- Outstanding registration challenges, each usable once
+CREATE TABLE webauthn_challenges (
+    challenge TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Logins waiting for a passkey assertion
+CREATE TABLE pending_logins (
+    token_hash TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    challenge TEXT NOT NULL,
+    failed_attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,16 @@
+-- Every completed login with the device and rough location it came from;
+-- a login from a device or country not seen before raises an alert
+CREATE TABLE login_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    -- device is a coarse label derived from the user agent, e.g. "Firefox on Windows"
+    device TEXT NOT NULL,
+    user_agent TEXT,
+    ip_address TEXT,
+    -- ISO 3166-1 alpha-2 code from the proxy's geo header, when known
+    country TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_login_sessions_user ON login_sessions(user_id, created_at DESC);
@@ -0,0 +1,11 @@
+-- Changes recorded by other services (uploads, deletions, tag, share and
+-- collection edits), with snapshots of the resource before and after
+ALTER TABLE audit_log
+    ADD COLUMN event_id UUID UNIQUE,
+    ADD COLUMN service TEXT NOT NULL DEFAULT 'auth',
+    ADD COLUMN resource_type TEXT,
+    ADD COLUMN resource_id TEXT,
+    ADD COLUMN before JSONB,
+    ADD COLUMN after JSONB;
+
+CREATE INDEX idx_audit_log_resource ON audit_log(resource_type, resource_id, created_at DESC);
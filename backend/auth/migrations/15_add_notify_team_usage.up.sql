@@ -0,0 +1,2 @@
+-- Team usage warnings for team owners and admins
+ALTER TABLE user_settings ADD COLUMN notify_team_usage BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,5 @@
+-- A NULL URL lifetime follows the deployment's STREAM_URL_TTL; rows with
+-- the old fixed default of 4 hours now do
+ALTER TABLE user_settings ALTER COLUMN presign_ttl_seconds DROP NOT NULL;
+ALTER TABLE user_settings ALTER COLUMN presign_ttl_seconds DROP DEFAULT;
+UPDATE user_settings SET presign_ttl_seconds = NULL WHERE presign_ttl_seconds = 14400;
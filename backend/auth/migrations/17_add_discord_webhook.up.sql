@@ -0,0 +1,2 @@
+-- Discord webhook media and collections are posted to
+ALTER TABLE user_settings ADD COLUMN discord_webhook_url TEXT;
@@ -0,0 +1,2 @@
+-- Notices when a scheduled collection is published
+ALTER TABLE user_settings ADD COLUMN notify_scheduled_publish BOOLEAN NOT NULL DEFAULT TRUE;
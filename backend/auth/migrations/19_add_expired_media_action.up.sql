@@ -0,0 +1,4 @@
+-- What happens to media when its expires_at passes: moved to the trash, or
+-- deleted right away
+ALTER TABLE user_settings ADD COLUMN expired_media TEXT NOT NULL DEFAULT 'trash'
+    CHECK (expired_media IN ('trash', 'delete'));
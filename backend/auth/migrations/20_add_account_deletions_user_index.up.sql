@@ -0,0 +1,2 @@
+-- Every request with a JWT access token checks for a deletion of its user
+CREATE INDEX idx_account_deletions_user ON account_deletions(user_id);
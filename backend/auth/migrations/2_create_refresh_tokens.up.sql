@@ -0,0 +1,15 @@
+-- Refresh tokens issued with JWT access tokens (AUTH_TOKEN_MODE=jwt).
+-- Each refresh replaces the token with a new one of the same family; a
+-- replaced token being presented again revokes the whole family.
+CREATE TABLE refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    family_id UUID NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    replaced_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_user ON refresh_tokens(user_id);
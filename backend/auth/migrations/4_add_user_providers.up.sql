@@ -0,0 +1,10 @@
+-- Users are identified by the OAuth provider that created them and the
+-- provider's user ID; discord_id stays set for Discord users (admin checks)
+ALTER TABLE users ADD COLUMN provider TEXT NOT NULL DEFAULT 'discord';
+ALTER TABLE users ADD COLUMN provider_id TEXT;
+ALTER TABLE users ADD COLUMN email TEXT;
+UPDATE users SET provider_id = discord_id;
+ALTER TABLE users ALTER COLUMN provider_id SET NOT NULL;
+ALTER TABLE users ALTER COLUMN discord_id DROP NOT NULL;
+
+CREATE UNIQUE INDEX idx_users_provider ON users(provider, provider_id);
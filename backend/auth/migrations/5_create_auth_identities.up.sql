@@ -0,0 +1,17 @@
+-- OAuth identities that log in to a user; users.provider/provider_id is the
+-- identity the account was created with, further ones are linked
+CREATE TABLE auth_identities (
+    provider TEXT NOT NULL,
+    provider_id TEXT NOT NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    username TEXT,
+    avatar_url TEXT,
+    email TEXT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_login_at TIMESTAMP,
+    PRIMARY KEY (provider, provider_id),
+    UNIQUE (user_id, provider)
+);
+
+INSERT INTO auth_identities (provider, provider_id, user_id, username, avatar_url, email, created_at)
+SELECT provider, provider_id, id, username, avatar_url, email, created_at FROM users;
@@ -0,0 +1,7 @@
+-- App roles mapped from Discord roles, and the storage quota they grant
+-- (NULL = STORAGE_QUOTA_DEFAULT_GB)
+ALTER TABLE users ADD COLUMN roles TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE users ADD COLUMN storage_quota_bytes BIGINT;
+ALTER TABLE users ADD COLUMN roles_synced_at TIMESTAMP;
+
+CREATE INDEX idx_users_roles_synced_at ON users(roles_synced_at) WHERE discord_id IS NOT NULL;
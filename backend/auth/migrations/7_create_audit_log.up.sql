@@ -0,0 +1,15 @@
+-- Security-relevant events: logins, failed callbacks, logouts, token
+-- revocations and denied requests
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    event TEXT NOT NULL,
+    provider TEXT,
+    ip_address TEXT,
+    user_agent TEXT,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_log_user ON audit_log(user_id, created_at DESC);
+CREATE INDEX idx_audit_log_event ON audit_log(event, created_at DESC);
@@ -0,0 +1,21 @@
+-- Account deletions in progress; the user row is deleted once every service
+-- has reported its cleanup, the deletion record is kept for the status page
+CREATE TABLE account_deletions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed')),
+    requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_account_deletions_pending ON account_deletions(user_id) WHERE status = 'pending';
+
+-- Cleanup progress of each service
+CREATE TABLE account_deletion_steps (
+    deletion_id UUID NOT NULL REFERENCES account_deletions(id) ON DELETE CASCADE,
+    service TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed')),
+    deleted_items INT NOT NULL DEFAULT 0,
+    completed_at TIMESTAMP,
+    PRIMARY KEY (deletion_id, service)
+);
@@ -0,0 +1,16 @@
+-- Data exports: archives of everything stored about a user
+CREATE TABLE data_exports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processing', 'ready', 'failed', 'expired')),
+    include_originals BOOLEAN NOT NULL DEFAULT FALSE,
+    s3_key TEXT,
+    size_bytes BIGINT,
+    error_message TEXT,
+    requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_data_exports_user ON data_exports(user_id, requested_at DESC);
+CREATE INDEX idx_data_exports_expires ON data_exports(expires_at) WHERE status = 'ready';
@@ -0,0 +1,444 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// pendingLoginTTL bounds how long a login may wait for its passkey
+const pendingLoginTTL = 10 * time.Minute
+
+// maxPasskeyAttempts is the number of failed assertions after which a
+// pending login is dropped and the user has to log in again
+const maxPasskeyAttempts = 5
+
+// hasPasskeys reports whether the user enrolled a passkey, which makes it
+// a required second factor
+func hasPasskeys(ctx context.Context, userID int64) bool {
+	var enrolled bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`, userID).Scan(&enrolled)
+	return err == nil && enrolled
+}
+
+// createPendingLogin stores a login waiting for a passkey assertion and
+// returns its token
+func createPendingLogin(ctx context.Context, userID int64, provider string) (string, error) {
+	_, _ = db.Exec(ctx, `DELETE FROM pending_logins WHERE expires_at < NOW()`)
+
+	token := generateSessionToken()
+	_, err := db.Exec(ctx, `
+		INSERT INTO pending_logins (token_hash, user_id, provider, challenge, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, hashToken(token), userID, provider, newWebAuthnChallenge(), time.Now().Add(pendingLoginTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// userCredentialIDs returns the credential IDs of a user's passkeys
+func userCredentialIDs(ctx context.Context, userID int64) ([]string, error) {
+	rows, err := db.Query(ctx, `SELECT credential_id FROM webauthn_credentials WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RelyingParty identifies this app to the authenticator
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// PasskeyUser is the user a passkey is created for
+type PasskeyUser struct {
+	// ID is the base64url-encoded user handle
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// PubKeyCredParam is a signature algorithm the server accepts
+type PubKeyCredParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// RegistrationOptions are the options for navigator.credentials.create();
+// binary values are base64url-encoded
+type RegistrationOptions struct {
+	Challenge          string            `json:"challenge"`
+	RP                 RelyingParty      `json:"rp"`
+	User               PasskeyUser       `json:"user"`
+	PubKeyCredParams   []PubKeyCredParam `json:"pub_key_cred_params"`
+	ExcludeCredentials []string          `json:"exclude_credentials"`
+	TimeoutMs          int64             `json:"timeout_ms"`
+	Attestation        string            `json:"attestation"`
+}
+
+// BeginPasskeyRegistration starts enrolling a passkey for the caller
+//
+//encore:api auth method=POST path=/auth/passkeys/register/begin
+func BeginPasskeyRegistration(ctx context.Context) (*RegistrationOptions, error) {
+	userData := auth.Data().(*UserData)
+
+	existing, err := userCredentialIDs(ctx, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to start passkey registration").Err()
+	}
+
+	_, _ = db.Exec(ctx, `DELETE FROM webauthn_challenges WHERE expires_at < NOW()`)
+	challenge := newWebAuthnChallenge()
+	_, err = db.Exec(ctx, `
+		INSERT INTO webauthn_challenges (challenge, user_id, expires_at) VALUES ($1, $2, $3)
+	`, challenge, userData.UserID, time.Now().Add(webauthnTimeout))
+	if err != nil {
+		rlog.Error("failed to store passkey challenge", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to start passkey registration").Err()
+	}
+
+	return &RegistrationOptions{
+		Challenge: challenge,
+		RP:        RelyingParty{ID: getWebAuthnRPID(), Name: "MediaVault"},
+		User: PasskeyUser{
+			ID:          base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(userData.UserID, 10))),
+			Name:        userData.Username,
+			DisplayName: userData.Username,
+		},
+		PubKeyCredParams: []PubKeyCredParam{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		ExcludeCredentials: existing,
+		TimeoutMs:          webauthnTimeout.Milliseconds(),
+		Attestation:        "none",
+	}, nil
+}
+
+// FinishPasskeyRegistrationRequest is the browser's new credential; binary
+// values are base64url-encoded
+type FinishPasskeyRegistrationRequest struct {
+	// Name labels the passkey in the list, e.g. "YubiKey"
+	Name              string `json:"name"`
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	// PublicKey and PublicKeyAlgorithm are the results of the response's
+	// getPublicKey() and getPublicKeyAlgorithm()
+	PublicKey          string `json:"public_key"`
+	PublicKeyAlgorithm int    `json:"public_key_algorithm"`
+}
+
+// Passkey is an enrolled passkey
+type Passkey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// FinishPasskeyRegistration verifies and stores a new passkey. From then on
+// every login has to be completed with one of the caller's passkeys.
+//
+//encore:api auth method=POST path=/auth/passkeys/register/finish
+func FinishPasskeyRegistration(ctx context.Context, req *FinishPasskeyRegistrationRequest) (*Passkey, error) {
+	userData := auth.Data().(*UserData)
+
+	if req.Name == "" || len(req.Name) > 64 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("name must be 1 to 64 characters").Err()
+	}
+	clientDataJSON, err1 := decodeBase64URL(req.ClientDataJSON)
+	authData, err2 := decodeBase64URL(req.AuthenticatorData)
+	publicKey, err3 := decodeBase64URL(req.PublicKey)
+	credentialID, err4 := decodeBase64URL(req.CredentialID)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(credentialID) == 0 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("malformed credential").Err()
+	}
+
+	var challenge clientData
+	if err := json.Unmarshal(clientDataJSON, &challenge); err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("malformed client data").Err()
+	}
+	// Every challenge can only be used once
+	result, err := db.Exec(ctx, `
+		DELETE FROM webauthn_challenges WHERE challenge = $1 AND user_id = $2 AND expires_at > NOW()
+	`, challenge.Challenge, userData.UserID)
+	if err != nil || result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown or expired challenge").Err()
+	}
+
+	if err := verifyClientData(clientDataJSON, "webauthn.create", challenge.Challenge); err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid registration: " + err.Error()).Err()
+	}
+	data, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid registration: " + err.Error()).Err()
+	}
+	if !bytes.Equal(data.CredentialID, credentialID) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid registration: credential ID mismatch").Err()
+	}
+	if _, err := parsePasskeyPublicKey(publicKey, req.PublicKeyAlgorithm); err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid registration: " + err.Error()).Err()
+	}
+
+	passkey := Passkey{Name: req.Name}
+	err = db.QueryRow(ctx, `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, algorithm, sign_count, name, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		ON CONFLICT (credential_id) DO NOTHING
+		RETURNING id, created_at
+	`, userData.UserID, base64.RawURLEncoding.EncodeToString(credentialID), publicKey, req.PublicKeyAlgorithm,
+		int64(data.SignCount), req.Name).Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.AlreadyExists).Msg("passkey is already registered").Err()
+	}
+
+	entry := callerAudit(AuditPasskeyAdded, userData.UserID)
+	entry.Details = map[string]string{"passkey_id": strconv.FormatInt(passkey.ID, 10), "name": req.Name}
+	recordAudit(ctx, entry)
+
+	return &passkey, nil
+}
+
+// ListPasskeysResponse contains the caller's passkeys
+type ListPasskeysResponse struct {
+	Passkeys []Passkey `json:"passkeys"`
+}
+
+// ListPasskeys returns the caller's passkeys
+//
+//encore:api auth method=GET path=/auth/passkeys
+func ListPasskeys(ctx context.Context) (*ListPasskeysResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = $1
+		ORDER BY created_at
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list passkeys").Err()
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			continue
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	return &ListPasskeysResponse{Passkeys: passkeys}, nil
+}
+
+// DeletePasskey removes one of the caller's passkeys. Removing the last one
+// turns the second factor off.
+//
+//encore:api auth method=DELETE path=/auth/passkeys/:id
+func DeletePasskey(ctx context.Context, id int64) (*LogoutResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	result, err := db.Exec(ctx, `
+		DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2
+	`, id, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete passkey").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("passkey not found").Err()
+	}
+
+	entry := callerAudit(AuditPasskeyRemoved, userData.UserID)
+	entry.Details = map[string]string{"passkey_id": strconv.FormatInt(id, 10)}
+	recordAudit(ctx, entry)
+
+	return &LogoutResponse{Success: true}, nil
+}
+
+// pendingLogin is a login waiting for a passkey assertion
+type pendingLogin struct {
+	UserID    int64
+	Provider  string
+	Challenge string
+}
+
+// getPendingLogin returns the unexpired pending login of a token
+func getPendingLogin(ctx context.Context, token string) (*pendingLogin, error) {
+	var p pendingLogin
+	err := db.QueryRow(ctx, `
+		SELECT user_id, provider, challenge FROM pending_logins
+		WHERE token_hash = $1 AND expires_at > NOW()
+	`, hashToken(token)).Scan(&p.UserID, &p.Provider, &p.Challenge)
+	if err != nil {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("login expired, please log in again").Err()
+	}
+	return &p, nil
+}
+
+// PasskeyLoginRequest identifies the pending login
+type PasskeyLoginRequest struct {
+	PendingToken string `json:"pending_token"`
+}
+
+// AssertionOptions are the options for navigator.credentials.get(); binary
+// values are base64url-encoded
+type AssertionOptions struct {
+	Challenge        string   `json:"challenge"`
+	RPID             string   `json:"rp_id"`
+	AllowCredentials []string `json:"allow_credentials"`
+	TimeoutMs        int64    `json:"timeout_ms"`
+}
+
+// BeginPasskeyLogin returns the assertion options for a pending login, the
+// passkey_token the OAuth callback redirected to the frontend with
+//
+//encore:api public method=POST path=/auth/passkeys/login/begin
+func BeginPasskeyLogin(ctx context.Context, req *PasskeyLoginRequest) (*AssertionOptions, error) {
+	pending, err := getPendingLogin(ctx, req.PendingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := userCredentialIDs(ctx, pending.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to start passkey login").Err()
+	}
+
+	return &AssertionOptions{
+		Challenge:        pending.Challenge,
+		RPID:             getWebAuthnRPID(),
+		AllowCredentials: credentials,
+		TimeoutMs:        webauthnTimeout.Milliseconds(),
+	}, nil
+}
+
+// FinishPasskeyLoginRequest is the browser's assertion for a pending login;
+// binary values are base64url-encoded
+type FinishPasskeyLoginRequest struct {
+	PendingToken      string `json:"pending_token"`
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+}
+
+// FinishPasskeyLogin verifies a passkey assertion and completes the pending
+// login with the tokens the OAuth callback would have issued
+//
+//encore:api public method=POST path=/auth/passkeys/login/finish
+func FinishPasskeyLogin(ctx context.Context, req *FinishPasskeyLoginRequest) (*LoginTokens, error) {
+	pending, err := getPendingLogin(ctx, req.PendingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// A wrong assertion is audited and counts against the pending login
+	assertionFailed := func(reason string) error {
+		entry := callerAudit(AuditLoginFailed, pending.UserID)
+		entry.Provider = pending.Provider
+		entry.Details = map[string]string{"reason": "passkey: " + reason}
+		recordAudit(ctx, entry)
+
+		_, _ = db.Exec(ctx, `
+			UPDATE pending_logins SET failed_attempts = failed_attempts + 1 WHERE token_hash = $1
+		`, hashToken(req.PendingToken))
+		_, _ = db.Exec(ctx, `
+			DELETE FROM pending_logins WHERE token_hash = $1 AND failed_attempts >= $2
+		`, hashToken(req.PendingToken), maxPasskeyAttempts)
+		return errs.B().Code(errs.Unauthenticated).Msg("passkey verification failed").Err()
+	}
+
+	clientDataJSON, err1 := decodeBase64URL(req.ClientDataJSON)
+	authData, err2 := decodeBase64URL(req.AuthenticatorData)
+	signature, err3 := decodeBase64URL(req.Signature)
+	rawCredentialID, err4 := decodeBase64URL(req.CredentialID)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("malformed assertion").Err()
+	}
+
+	var credentialID int64
+	var publicKey []byte
+	var algorithm int
+	var signCount int64
+	err = db.QueryRow(ctx, `
+		SELECT id, public_key, algorithm, sign_count FROM webauthn_credentials
+		WHERE credential_id = $1 AND user_id = $2
+	`, base64.RawURLEncoding.EncodeToString(rawCredentialID), pending.UserID).Scan(&credentialID, &publicKey, &algorithm, &signCount)
+	if err != nil {
+		return nil, assertionFailed("unknown credential")
+	}
+
+	if err := verifyClientData(clientDataJSON, "webauthn.get", pending.Challenge); err != nil {
+		return nil, assertionFailed(err.Error())
+	}
+	data, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, assertionFailed(err.Error())
+	}
+	key, err := parsePasskeyPublicKey(publicKey, algorithm)
+	if err != nil {
+		return nil, assertionFailed(err.Error())
+	}
+	if err := verifyAssertionSignature(key, authData, clientDataJSON, signature); err != nil {
+		return nil, assertionFailed(err.Error())
+	}
+	// Authenticators that count signatures never repeat a count; a repeat
+	// means the credential was cloned
+	if (signCount != 0 || data.SignCount != 0) && int64(data.SignCount) <= signCount {
+		return nil, assertionFailed("signature counter did not increase")
+	}
+
+	// The pending login is used up; a concurrent request may have won
+	result, err := db.Exec(ctx, `DELETE FROM pending_logins WHERE token_hash = $1`, hashToken(req.PendingToken))
+	if err != nil || result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("login expired, please log in again").Err()
+	}
+	_, _ = db.Exec(ctx, `
+		UPDATE webauthn_credentials SET sign_count = $2, last_used_at = NOW() WHERE id = $1
+	`, credentialID, int64(data.SignCount))
+
+	user, err := getUser(ctx, pending.UserID)
+	if err != nil || deletionPending(ctx, pending.UserID) {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("user not found").Err()
+	}
+
+	entry := callerAudit(AuditLogin, user.ID)
+	entry.Provider = pending.Provider
+	entry.Details = map[string]string{
+		"second_factor": "passkey",
+		"passkey_id":    strconv.FormatInt(credentialID, 10),
+		"token_mode":    getTokenMode(),
+	}
+	recordAudit(ctx, entry)
+
+	tokens, err := issueLoginTokens(ctx, user, callerLoginContext(pending.Provider))
+	if err != nil {
+		rlog.Error("failed to issue tokens", "error", err, "user_id", user.ID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create session").Err()
+	}
+	return tokens, nil
+}
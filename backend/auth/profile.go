@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	"encore.app/metrics"
+	"encore.app/objectstore"
+)
+
+// maxDisplayNameLength bounds display names, in characters
+const maxDisplayNameLength = 64
+
+// UpdateMeRequest changes the profile; omitted fields are kept
+type UpdateMeRequest struct {
+	// DisplayName is shown instead of the username; "" resets it
+	DisplayName *string `json:"display_name,omitempty"`
+	// AvatarMediaID is an image uploaded with /media/upload/sign and
+	// /media/upload/confirm; "" resets to the provider's avatar
+	AvatarMediaID *string `json:"avatar_media_id,omitempty"`
+}
+
+// UpdateMe changes the caller's display name and avatar
+//
+//encore:api auth method=PATCH path=/auth/me
+func UpdateMe(ctx context.Context, req *UpdateMeRequest) (*MeResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if err := validateDisplayName(name); err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(ctx, `UPDATE users SET display_name = NULLIF($2, '') WHERE id = $1`,
+			userData.UserID, name); err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to update profile").Err()
+		}
+	}
+
+	if req.AvatarMediaID != nil {
+		if *req.AvatarMediaID != "" {
+			if err := validateAvatarMedia(ctx, userData.UserID, *req.AvatarMediaID); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := db.Exec(ctx, `UPDATE users SET avatar_media_id = NULLIF($2, '')::uuid WHERE id = $1`,
+			userData.UserID, *req.AvatarMediaID); err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to update profile").Err()
+		}
+	}
+
+	return Me(ctx)
+}
+
+// validateDisplayName accepts names of up to maxDisplayNameLength printable characters
+func validateDisplayName(name string) error {
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return errs.B().Code(errs.InvalidArgument).Msg("display_name is too long").Err()
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return errs.B().Code(errs.InvalidArgument).Msg("display_name contains invalid characters").Err()
+		}
+	}
+	return nil
+}
+
+// validateAvatarMedia checks that the media is a ready image of the user
+func validateAvatarMedia(ctx context.Context, userID int64, mediaID string) error {
+	var ownerID int64
+	var status, mimeType string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, status, COALESCE(mime_type, '') FROM media WHERE id::text = $1
+	`, mediaID).Scan(&ownerID, &status, &mimeType)
+	if err != nil || ownerID != userID {
+		return errs.B().Code(errs.NotFound).Msg("avatar media not found").Err()
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return errs.B().Code(errs.InvalidArgument).Msg("avatar must be an image").Err()
+	}
+	if status != "ready" {
+		return errs.B().Code(errs.FailedPrecondition).Msg("avatar image is not ready yet").Err()
+	}
+	return nil
+}
+
+// avatarURL returns a presigned URL of the custom avatar, preferring its
+// thumbnail, or the provider's avatar when there is none or it was deleted
+func avatarURL(ctx context.Context, avatarMediaID, providerAvatarURL string) string {
+	if avatarMediaID == "" {
+		return providerAvatarURL
+	}
+
+	var s3Key string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT COALESCE(s3_key_thumbnail, s3_key_processed, s3_key_original)
+		FROM media WHERE id::text = $1 AND status = 'ready'
+	`, avatarMediaID).Scan(&s3Key)
+	if err != nil {
+		return providerAvatarURL
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return providerAvatarURL
+	}
+	url, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), s3Key, objectstore.StreamTTL(), nil)
+	if err != nil {
+		rlog.Warn("failed to presign avatar", "error", err, "media_id", avatarMediaID)
+		return providerAvatarURL
+	}
+	return url.String()
+}
+
+// ProfileRequest selects the user whose public profile to read
+type ProfileRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// PublicProfile is what other users see of a user
+type PublicProfile struct {
+	UserID      int64  `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// GetPublicProfile returns the display name and avatar of a user, for
+// services showing a user to others
+//
+//encore:api private
+func GetPublicProfile(ctx context.Context, req *ProfileRequest) (*PublicProfile, error) {
+	var profile PublicProfile
+	var avatarMediaID, providerAvatarURL string
+	err := db.QueryRow(ctx, `
+		SELECT id, COALESCE(display_name, username), COALESCE(avatar_media_id::text, ''), COALESCE(avatar_url, '')
+		FROM users WHERE id = $1
+	`, req.UserID).Scan(&profile.UserID, &profile.DisplayName, &avatarMediaID, &providerAvatarURL)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
+	}
+	profile.AvatarURL = avatarURL(ctx, avatarMediaID, providerAvatarURL)
+	return &profile, nil
+}
+
+// ResolveUserRequest names a user by ID or Discord username
+type ResolveUserRequest struct {
+	Identifier string `json:"identifier"`
+}
+
+// ResolveUser returns the public profile of the user a numeric ID or a
+// Discord username names, for services letting users pick other users
+//
+//encore:api private
+func ResolveUser(ctx context.Context, req *ResolveUserRequest) (*PublicProfile, error) {
+	identifier := strings.TrimSpace(req.Identifier)
+	if userID, err := strconv.ParseInt(identifier, 10, 64); err == nil {
+		return GetPublicProfile(ctx, &ProfileRequest{UserID: userID})
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT user_id FROM auth_identities
+		WHERE provider = 'discord' AND LOWER(username) = LOWER($1)
+		LIMIT 2
+	`, identifier)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to look up user").Err()
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	switch len(userIDs) {
+	case 0:
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found: " + identifier).Err()
+	case 1:
+		return GetPublicProfile(ctx, &ProfileRequest{UserID: userIDs[0]})
+	default:
+		// Legacy Discord usernames with discriminators can repeat
+		return nil, errs.B().Code(errs.FailedPrecondition).
+			Msg("several users are named " + identifier + ", use the user ID").Err()
+	}
+}
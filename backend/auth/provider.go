@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"encore.dev/rlog"
+)
+
+// ProviderUser is the identity an OAuth provider returned for the logged in user
+type ProviderUser struct {
+	Provider  string
+	ID        string
+	Username  string
+	AvatarURL string
+	Email     string
+}
+
+// errLoginDenied is returned when a provider identity may not log in or sign up
+var errLoginDenied = errors.New("login denied")
+
+// oauthProvider is an OAuth2 login provider
+type oauthProvider interface {
+	// Name identifies the provider in the users table and in URLs
+	Name() string
+	// RedirectURI is the callback URL registered with the provider
+	RedirectURI() string
+	// AuthURL returns the provider's authorization URL for a login
+	AuthURL(state string) string
+	// Exchange trades an authorization code for an access token
+	Exchange(ctx context.Context, code string) (*tokenResponse, error)
+	// FetchUser returns the user the access token belongs to
+	FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error)
+}
+
+// startLogin redirects to the provider's authorization URL. An optional
+// ?redirect=/path is the frontend path to return to after login; ?link=
+// carries a link token from LinkProvider to link the identity instead.
+func startLogin(w http.ResponseWriter, req *http.Request, provider oauthProvider) {
+	state := generateRandomState()
+
+	var linkUserID int64
+	var linkNonce string
+	if link := req.URL.Query().Get("link"); link != "" {
+		userID, nonce, err := verifyLinkToken(provider, link)
+		if err != nil {
+			rlog.Warn("invalid link token", "error", err, "provider", provider.Name())
+			http.Error(w, "invalid or expired link request", http.StatusBadRequest)
+			return
+		}
+		linkUserID, linkNonce = userID, nonce
+	}
+
+	// Remember the state so the callback can reject forged or replayed callbacks
+	err := setStateCookie(w, req, provider, oauthState{
+		Nonce:      state,
+		Redirect:   sanitizeRedirect(req.URL.Query().Get("redirect")),
+		LinkUserID: linkUserID,
+		LinkNonce:  linkNonce,
+	})
+	if err != nil {
+		rlog.Error("failed to store OAuth state", "error", err)
+		http.Error(w, "failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, req, provider.AuthURL(state), http.StatusTemporaryRedirect)
+}
+
+// finishLogin handles a provider's OAuth callback: it verifies the state,
+// resolves the user and redirects to the frontend with a token
+func finishLogin(w http.ResponseWriter, req *http.Request, provider oauthProvider) {
+	ctx := req.Context()
+	code := req.URL.Query().Get("code")
+
+	// Every failed callback is audited with its reason
+	loginFailed := func(userID int64, reason string) {
+		entry := requestAudit(req, AuditLoginFailed, provider)
+		entry.UserID = userID
+		entry.Details = map[string]string{"reason": reason}
+		recordAudit(ctx, entry)
+	}
+
+	// The state must match the one startLogin issued to this browser
+	state, err := verifyStateCookie(w, req, provider)
+	if err != nil {
+		rlog.Warn("callback: invalid OAuth state", "error", err, "provider", provider.Name())
+		loginFailed(0, "invalid state: "+err.Error())
+		http.Error(w, "invalid OAuth state, please log in again", http.StatusBadRequest)
+		return
+	}
+
+	if code == "" {
+		rlog.Error("callback: missing authorization code")
+		loginFailed(0, "missing authorization code")
+		http.Error(w, "missing authorization code", http.StatusBadRequest)
+		return
+	}
+
+	// Exchange code for token
+	tokenData, err := provider.Exchange(ctx, code)
+	if err != nil {
+		rlog.Error("failed to exchange code for token", "error", err, "provider", provider.Name())
+		loginFailed(0, "code exchange failed")
+		http.Error(w, "failed to authenticate with "+provider.Name(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get user info from the provider
+	providerUser, err := provider.FetchUser(ctx, tokenData.AccessToken)
+	if errors.Is(err, errLoginDenied) {
+		rlog.Info("login denied", "error", err, "provider", provider.Name())
+		loginFailed(0, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		rlog.Error("failed to get provider user", "error", err, "provider", provider.Name())
+		loginFailed(0, "user lookup failed")
+		http.Error(w, "failed to get user info from "+provider.Name(), http.StatusInternalServerError)
+		return
+	}
+
+	rlog.Info("provider user retrieved",
+		"provider", providerUser.Provider,
+		"provider_id", providerUser.ID,
+		"username", providerUser.Username,
+	)
+
+	frontendURL := getFrontendURL()
+
+	// Linking adds the identity to the already logged in user; no new token
+	if state.LinkUserID != 0 {
+		if err := verifyLinkCookie(w, req, provider, state.LinkNonce); err != nil {
+			rlog.Warn("callback: link requested from another browser", "error", err, "user_id", state.LinkUserID)
+			loginFailed(state.LinkUserID, "invalid link: "+err.Error())
+			http.Error(w, "this link was requested from another browser", http.StatusBadRequest)
+			return
+		}
+		if err := linkIdentity(ctx, state.LinkUserID, providerUser); err != nil {
+			rlog.Warn("failed to link identity", "error", err, "user_id", state.LinkUserID,
+				"provider", providerUser.Provider)
+			loginFailed(state.LinkUserID, "link failed: "+err.Error())
+			http.Error(w, "failed to link account: "+err.Error(), http.StatusConflict)
+			return
+		}
+		redirectURL := fmt.Sprintf("%s/auth/callback?linked=%s", frontendURL, provider.Name())
+		if state.Redirect != "" {
+			redirectURL += "&redirect=" + url.QueryEscape(state.Redirect)
+		}
+		http.Redirect(w, req, redirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Upsert user in database
+	user, err := upsertUser(ctx, providerUser)
+	if errors.Is(err, errLoginDenied) {
+		rlog.Info("sign-up denied", "error", err, "provider", providerUser.Provider)
+		loginFailed(0, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		rlog.Error("failed to upsert user",
+			"error", err,
+			"provider", providerUser.Provider,
+			"provider_id", providerUser.ID,
+		)
+		loginFailed(0, "user upsert failed")
+		http.Error(w, "failed to create user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rlog.Info("User upserted successfully", "user_id", user.ID)
+
+	// Discord roles are refreshed on every login; a failure keeps the last synced roles
+	if user.DiscordID != "" && roleSyncEnabled() {
+		if err := syncUserRoles(ctx, user.ID, user.DiscordID); err != nil {
+			rlog.Warn("failed to sync Discord roles", "error", err, "user_id", user.ID)
+		} else if synced, err := getUser(ctx, user.ID); err == nil {
+			user = synced
+		}
+	}
+
+	// Users with passkeys complete the login with one; until then the
+	// frontend only holds a pending login token that AuthHandler rejects
+	if hasPasskeys(ctx, user.ID) {
+		pendingToken, err := createPendingLogin(ctx, user.ID, provider.Name())
+		if err != nil {
+			rlog.Error("failed to create pending login", "error", err, "user_id", user.ID)
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+		redirectURL := fmt.Sprintf("%s/auth/callback?passkey_token=%s", frontendURL, url.QueryEscape(pendingToken))
+		if state.Redirect != "" {
+			redirectURL += "&redirect=" + url.QueryEscape(state.Redirect)
+		}
+		http.Redirect(w, req, redirectURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	entry := requestAudit(req, AuditLogin, provider)
+	entry.UserID = user.ID
+	entry.Details = map[string]string{"provider_id": providerUser.ID, "token_mode": getTokenMode()}
+	recordAudit(ctx, entry)
+
+	tokens, err := issueLoginTokens(ctx, user, newLoginContext(req.Header, req.RemoteAddr, provider.Name()))
+	if err != nil {
+		rlog.Error("failed to issue tokens", "error", err, "user_id", user.ID)
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	// Redirect to frontend with token
+	redirectURL := fmt.Sprintf("%s/auth/callback?token=%s", frontendURL, url.QueryEscape(tokens.Token))
+	if tokens.RefreshToken != "" {
+		redirectURL += "&refresh_token=" + url.QueryEscape(tokens.RefreshToken)
+	}
+	if state.Redirect != "" {
+		redirectURL += "&redirect=" + url.QueryEscape(state.Redirect)
+	}
+
+	http.Redirect(w, req, redirectURL, http.StatusTemporaryRedirect)
+}
+
+// LoginTokens are the credentials of a completed login
+type LoginTokens struct {
+	// Token is a session token, or an access token in JWT mode
+	Token string `json:"token"`
+	// RefreshToken is only issued in JWT mode
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// issueLoginTokens starts a session for the user in the configured token
+// mode and records where the login came from
+func issueLoginTokens(ctx context.Context, user *User, lc loginContext) (*LoginTokens, error) {
+	recordLoginSession(ctx, user.ID, lc)
+
+	// In JWT mode the frontend gets an access token and a refresh token
+	if getTokenMode() == TokenModeJWT {
+		pair, err := issueTokenPair(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginTokens{Token: pair.AccessToken, RefreshToken: pair.RefreshToken}, nil
+	}
+
+	// Create session
+	sessionToken := generateSessionToken()
+	sessions[sessionToken] = &Session{
+		ID:        sessionToken,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(7 * 24 * time.Hour), // 7 days
+	}
+	return &LoginTokens{Token: sessionToken}, nil
+}
+
+// exchangeCode performs the standard OAuth2 authorization code exchange
+func exchangeCode(ctx context.Context, tokenURL string, data url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var tokenResp tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+
+	return &tokenResp, nil
+}
+
+// getJSON fetches a provider API resource with a bearer token
+func getJSON(ctx context.Context, apiURL, accessToken string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", apiURL, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
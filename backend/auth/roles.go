@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/rlog"
+)
+
+// RoleAdmin is the app role that grants admin access, in addition to
+// ADMIN_DISCORD_IDS
+const RoleAdmin = "admin"
+
+// gigabyte is the unit of storage quotas in the configuration
+const gigabyte = 1 << 30
+
+// roleSyncDelay spaces out Discord API calls of the periodic sync, well
+// below the bot rate limit
+const roleSyncDelay = 100 * time.Millisecond
+
+// roleMapping maps a Discord role to an app role and optionally the storage
+// quota the role grants
+type roleMapping struct {
+	DiscordRoleID  string  `json:"discord_role_id"`
+	Role           string  `json:"role"`
+	StorageQuotaGB float64 `json:"storage_quota_gb,omitempty"`
+}
+
+// getRoleMappings parses DISCORD_ROLE_MAP, a JSON array of role mappings
+func getRoleMappings() []roleMapping {
+	raw := strings.TrimSpace(os.Getenv("DISCORD_ROLE_MAP"))
+	if raw == "" {
+		return nil
+	}
+	var mappings []roleMapping
+	if err := json.Unmarshal([]byte(raw), &mappings); err != nil {
+		rlog.Error("invalid DISCORD_ROLE_MAP", "error", err)
+		return nil
+	}
+	return mappings
+}
+
+// getRoleGuildID returns the Discord server whose roles are mapped
+// (DISCORD_ROLE_GUILD_ID, defaulting to DISCORD_REQUIRED_GUILD_ID)
+func getRoleGuildID() string {
+	if id := strings.TrimSpace(os.Getenv("DISCORD_ROLE_GUILD_ID")); id != "" {
+		return id
+	}
+	return getRequiredGuildID()
+}
+
+// roleSyncEnabled reports whether Discord roles are mapped to app roles
+func roleSyncEnabled() bool {
+	return secrets.DiscordBotToken != "" && getRoleGuildID() != "" && len(getRoleMappings()) > 0
+}
+
+// getDefaultStorageQuota returns the storage quota in bytes of users without
+// a role granting one (STORAGE_QUOTA_DEFAULT_GB); 0 means unlimited
+func getDefaultStorageQuota() int64 {
+	gb, err := strconv.ParseFloat(os.Getenv("STORAGE_QUOTA_DEFAULT_GB"), 64)
+	if err != nil || gb <= 0 {
+		return 0
+	}
+	return int64(gb * gigabyte)
+}
+
+// effectiveQuota resolves a user's stored quota, falling back to the default
+func effectiveQuota(quota *int64) int64 {
+	if quota != nil {
+		return *quota
+	}
+	return getDefaultStorageQuota()
+}
+
+// HasRole reports whether the user has an app role
+func (u *UserData) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// mapRoles returns the app roles granted by a member's Discord roles and the
+// largest storage quota among them (nil when no role grants one)
+func mapRoles(discordRoles []string, mappings []roleMapping) ([]string, *int64) {
+	held := make(map[string]bool, len(discordRoles))
+	for _, id := range discordRoles {
+		held[id] = true
+	}
+
+	roles := []string{}
+	var quota *int64
+	for _, m := range mappings {
+		if !held[m.DiscordRoleID] {
+			continue
+		}
+		if m.Role != "" && !containsString(roles, m.Role) {
+			roles = append(roles, m.Role)
+		}
+		if m.StorageQuotaGB > 0 {
+			bytes := int64(m.StorageQuotaGB * gigabyte)
+			if quota == nil || bytes > *quota {
+				quota = &bytes
+			}
+		}
+	}
+	return roles, quota
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// discordMember is a guild member from the bot API
+type discordMember struct {
+	Roles []string `json:"roles"`
+}
+
+// fetchMemberRoles returns the Discord role IDs a user has in the guild,
+// using the bot token. member is false when the user is not in the guild.
+func fetchMemberRoles(ctx context.Context, guildID, discordID string) (roles []string, member bool, err error) {
+	apiURL := fmt.Sprintf("https://discord.com/api/guilds/%s/members/%s", guildID, discordID)
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "Bot "+secrets.DiscordBotToken)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%s returned %d", apiURL, resp.StatusCode)
+	}
+
+	var m discordMember
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, false, err
+	}
+	return m.Roles, true, nil
+}
+
+// syncUserRoles replaces a user's app roles and quota with the ones their
+// current Discord roles grant; users who left the server lose them
+func syncUserRoles(ctx context.Context, userID int64, discordID string) error {
+	discordRoles, member, err := fetchMemberRoles(ctx, getRoleGuildID(), discordID)
+	if err != nil {
+		return err
+	}
+
+	roles := []string{}
+	var quota *int64
+	if member {
+		roles, quota = mapRoles(discordRoles, getRoleMappings())
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE users SET roles = $2, storage_quota_bytes = $3, roles_synced_at = NOW() WHERE id = $1
+	`, userID, roles, quota)
+	return err
+}
+
+// Roles are also synced periodically, so role changes on the Discord server
+// apply without a new login
+var _ = cron.NewJob("discord-role-sync", cron.JobConfig{
+	Title:    "Sync app roles from Discord roles",
+	Every:    1 * cron.Hour,
+	Endpoint: SyncDiscordRoles,
+})
+
+// SyncDiscordRolesResponse reports what the sync did
+type SyncDiscordRolesResponse struct {
+	Synced int `json:"synced"`
+	Failed int `json:"failed"`
+}
+
+// SyncDiscordRoles refreshes the app roles of every user with a Discord
+// identity, least recently synced first
+//
+//encore:api private
+func SyncDiscordRoles(ctx context.Context) (*SyncDiscordRolesResponse, error) {
+	resp := &SyncDiscordRolesResponse{}
+	if !roleSyncEnabled() {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, discord_id FROM users
+		WHERE discord_id IS NOT NULL
+		ORDER BY roles_synced_at NULLS FIRST
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type discordUser struct {
+		id        int64
+		discordID string
+	}
+	var users []discordUser
+	for rows.Next() {
+		var u discordUser
+		if err := rows.Scan(&u.id, &u.discordID); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	for _, u := range users {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := syncUserRoles(ctx, u.id, u.discordID); err != nil {
+			rlog.Warn("failed to sync Discord roles", "error", err, "user_id", u.id)
+			resp.Failed++
+		} else {
+			resp.Synced++
+		}
+		time.Sleep(roleSyncDelay)
+	}
+
+	rlog.Info("Discord roles synced", "synced", resp.Synced, "failed", resp.Failed)
+	return resp, nil
+}
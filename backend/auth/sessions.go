@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+// getGeoCountryHeader returns the request header the reverse proxy puts the
+// client's country code in (Cloudflare's by default)
+func getGeoCountryHeader() string {
+	return getEnvOrDefault("GEOIP_COUNTRY_HEADER", "CF-IPCountry")
+}
+
+// loginContext is where a login came from
+type loginContext struct {
+	Provider  string
+	IP        string
+	UserAgent string
+	// Country is empty when the proxy doesn't know it
+	Country string
+}
+
+// newLoginContext returns the origin of a login from its request headers
+func newLoginContext(header http.Header, remoteAddr, provider string) loginContext {
+	country := strings.ToUpper(strings.TrimSpace(header.Get(getGeoCountryHeader())))
+	// XX is unknown and T1 is Tor for Cloudflare; neither is a country
+	if len(country) != 2 || country == "XX" || country == "T1" {
+		country = ""
+	}
+	return loginContext{
+		Provider:  provider,
+		IP:        clientIP(header, remoteAddr),
+		UserAgent: header.Get("User-Agent"),
+		Country:   country,
+	}
+}
+
+// callerLoginContext returns the origin of a login completed by an API call
+func callerLoginContext(provider string) loginContext {
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		return newLoginContext(req.Headers, "", provider)
+	}
+	return loginContext{Provider: provider}
+}
+
+// describeDevice returns a coarse browser and OS label for a user agent, so
+// browser updates don't count as new devices
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	system := "unknown OS"
+	switch {
+	case strings.Contains(userAgent, "Windows"):
+		system = "Windows"
+	case strings.Contains(userAgent, "Android"):
+		system = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		system = "iOS"
+	case strings.Contains(userAgent, "Mac OS X"):
+		system = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		system = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		system = "Linux"
+	}
+
+	return browser + " on " + system
+}
+
+// LoginAnomaly is published when a user logs in from a device or country
+// none of their earlier logins came from
+type LoginAnomaly struct {
+	UserID         int64     `json:"user_id"`
+	LoginSessionID int64     `json:"login_session_id"`
+	Provider       string    `json:"provider"`
+	Device         string    `json:"device"`
+	IPAddress      string    `json:"ip_address,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	NewDevice      bool      `json:"new_device"`
+	NewCountry     bool      `json:"new_country"`
+	LoggedInAt     time.Time `json:"logged_in_at"`
+}
+
+// LoginAnomalyTopic carries login alerts to the notification subsystem,
+// which delivers them to users who have new-login notifications enabled
+var LoginAnomalyTopic = pubsub.NewTopic[*LoginAnomaly]("login-anomaly", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// recordLoginSession stores a completed login and raises an alert when it
+// comes from a new device or country. A user's first login raises none.
+// Errors are logged and the login goes ahead without a session entry or
+// alert.
+func recordLoginSession(ctx context.Context, userID int64, lc loginContext) {
+	device := describeDevice(lc.UserAgent)
+
+	var seenBefore, knownDevice, knownCountry bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM login_sessions WHERE user_id = $1),
+			   EXISTS (SELECT 1 FROM login_sessions WHERE user_id = $1 AND device = $2),
+			   $3 = '' OR EXISTS (SELECT 1 FROM login_sessions WHERE user_id = $1 AND country = $3)
+	`, userID, device, lc.Country).Scan(&seenBefore, &knownDevice, &knownCountry)
+	if err != nil {
+		rlog.Error("failed to check login history", "error", err, "user_id", userID)
+		return
+	}
+
+	anomaly := LoginAnomaly{
+		UserID:     userID,
+		Provider:   lc.Provider,
+		Device:     device,
+		IPAddress:  lc.IP,
+		Country:    lc.Country,
+		NewDevice:  !knownDevice,
+		NewCountry: !knownCountry,
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO login_sessions (user_id, provider, device, user_agent, ip_address, country, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), NOW())
+		RETURNING id, created_at
+	`, userID, lc.Provider, device, lc.UserAgent, lc.IP, lc.Country).Scan(&anomaly.LoginSessionID, &anomaly.LoggedInAt)
+	if err != nil {
+		rlog.Error("failed to record login session", "error", err, "user_id", userID)
+		return
+	}
+
+	if !seenBefore || (knownDevice && knownCountry) {
+		return
+	}
+	if _, err := LoginAnomalyTopic.Publish(ctx, &anomaly); err != nil {
+		rlog.Error("failed to publish login anomaly", "error", err, "user_id", userID)
+		return
+	}
+	rlog.Info("login from new device or country", "user_id", userID, "device", device,
+		"country", lc.Country, "new_device", anomaly.NewDevice, "new_country", anomaly.NewCountry)
+}
+
+// LoginSession is a past login of the user
+type LoginSession struct {
+	ID        int64     `json:"id"`
+	Provider  string    `json:"provider"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPAddress string    `json:"ip_address,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListLoginSessionsResponse contains the user's recent logins
+type ListLoginSessionsResponse struct {
+	Sessions []LoginSession `json:"sessions"`
+}
+
+// ListLoginSessions returns the caller's 50 most recent logins with the
+// device and location they came from
+//
+//encore:api auth method=GET path=/auth/sessions
+func ListLoginSessions(ctx context.Context) (*ListLoginSessionsResponse, error) {
+	userData := auth.Data().(*UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT id, provider, device, COALESCE(user_agent, ''), COALESCE(ip_address, ''), COALESCE(country, ''),
+			   created_at
+		FROM login_sessions WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list sessions").Err()
+	}
+	defer rows.Close()
+
+	items := []LoginSession{}
+	for rows.Next() {
+		var s LoginSession
+		if err := rows.Scan(&s.ID, &s.Provider, &s.Device, &s.UserAgent, &s.IPAddress, &s.Country,
+			&s.CreatedAt); err != nil {
+			continue
+		}
+		items = append(items, s)
+	}
+
+	return &ListLoginSessionsResponse{Sessions: items}, nil
+}
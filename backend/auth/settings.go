@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	"encore.app/discordwebhook"
+	"encore.app/objectstore"
+	"encore.app/transcode"
+)
+
+// What happens to media when it expires
+const (
+	// ExpiredMediaTrash moves expired media to the trash, where it can be
+	// restored until it is purged
+	ExpiredMediaTrash = "trash"
+	// ExpiredMediaDelete deletes expired media right away
+	ExpiredMediaDelete = "delete"
+)
+
+// NotificationSettings selects which notifications the user receives
+type NotificationSettings struct {
+	ProcessingComplete bool `json:"processing_complete"`
+	ProcessingFailed   bool `json:"processing_failed"`
+	NewLogin           bool `json:"new_login"`
+	CollectionUpdates  bool `json:"collection_updates"`
+	TeamUsage          bool `json:"team_usage"`
+	ScheduledPublish   bool `json:"scheduled_publish"`
+}
+
+// Settings are per-user options other services apply when acting for the user
+type Settings struct {
+	// DefaultCollectionPublic is the visibility of new collections
+	DefaultCollectionPublic bool `json:"default_collection_public"`
+	// PreferredPreset is the transcode preset of uploads that don't name one
+	PreferredPreset string `json:"preferred_preset,omitempty"`
+	// PresignTTLSeconds is the lifetime of stream and download URLs; the
+	// deployment's STREAM_URL_TTL unless the user chose one
+	PresignTTLSeconds int                  `json:"presign_ttl_seconds"`
+	Notifications     NotificationSettings `json:"notifications"`
+	// DiscordWebhookURL is the channel webhook media and collections are
+	// posted to
+	DiscordWebhookURL string `json:"discord_webhook_url,omitempty"`
+	// ExpiredMedia is what happens to media once its expires_at passes,
+	// ExpiredMediaTrash or ExpiredMediaDelete
+	ExpiredMedia string `json:"expired_media"`
+}
+
+// PresignTTL returns the lifetime of presigned URLs for the user
+func (s *Settings) PresignTTL() time.Duration {
+	if s == nil || s.PresignTTLSeconds <= 0 {
+		return objectstore.StreamTTL()
+	}
+	return time.Duration(s.PresignTTLSeconds) * time.Second
+}
+
+// defaultSettings are the settings of users who never changed them
+func defaultSettings() *Settings {
+	return &Settings{
+		PresignTTLSeconds: int(objectstore.StreamTTL().Seconds()),
+		Notifications: NotificationSettings{
+			ProcessingComplete: true,
+			ProcessingFailed:   true,
+			NewLogin:           true,
+			CollectionUpdates:  true,
+			TeamUsage:          true,
+			ScheduledPublish:   true,
+		},
+		ExpiredMedia: ExpiredMediaTrash,
+	}
+}
+
+// loadSettings returns a user's settings, or the defaults
+func loadSettings(ctx context.Context, userID int64) (*Settings, error) {
+	s := defaultSettings()
+	err := db.QueryRow(ctx, `
+		SELECT default_collection_public, COALESCE(preferred_preset, ''),
+			   COALESCE(presign_ttl_seconds, $2), notify_processing_complete, notify_processing_failed, notify_new_login, notify_collection_updates,
+			   notify_team_usage, COALESCE(discord_webhook_url, ''), notify_scheduled_publish, expired_media
+		FROM user_settings WHERE user_id = $1
+	`, userID, s.PresignTTLSeconds).Scan(&s.DefaultCollectionPublic, &s.PreferredPreset, &s.PresignTTLSeconds,
+		&s.Notifications.ProcessingComplete, &s.Notifications.ProcessingFailed,
+		&s.Notifications.NewLogin, &s.Notifications.CollectionUpdates, &s.Notifications.TeamUsage,
+		&s.DiscordWebhookURL, &s.Notifications.ScheduledPublish, &s.ExpiredMedia)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSettings returns the caller's settings
+//
+//encore:api auth method=GET path=/auth/settings
+func GetSettings(ctx context.Context) (*Settings, error) {
+	userData := auth.Data().(*UserData)
+
+	s, err := loadSettings(ctx, userData.UserID)
+	if err != nil {
+		rlog.Error("failed to load settings", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load settings").Err()
+	}
+	return s, nil
+}
+
+// UpdateNotificationSettings changes individual notification settings
+type UpdateNotificationSettings struct {
+	ProcessingComplete *bool `json:"processing_complete,omitempty"`
+	ProcessingFailed   *bool `json:"processing_failed,omitempty"`
+	NewLogin           *bool `json:"new_login,omitempty"`
+	CollectionUpdates  *bool `json:"collection_updates,omitempty"`
+	TeamUsage          *bool `json:"team_usage,omitempty"`
+	ScheduledPublish   *bool `json:"scheduled_publish,omitempty"`
+}
+
+// UpdateSettingsRequest changes the given settings; omitted ones are kept
+type UpdateSettingsRequest struct {
+	DefaultCollectionPublic *bool `json:"default_collection_public,omitempty"`
+	// PreferredPreset set to "" clears the preference
+	PreferredPreset   *string                     `json:"preferred_preset,omitempty"`
+	PresignTTLSeconds *int                        `json:"presign_ttl_seconds,omitempty"`
+	Notifications     *UpdateNotificationSettings `json:"notifications,omitempty"`
+	// DiscordWebhookURL set to "" removes the webhook
+	DiscordWebhookURL *string `json:"discord_webhook_url,omitempty"`
+	// ExpiredMedia is "trash" or "delete"
+	ExpiredMedia *string `json:"expired_media,omitempty"`
+}
+
+// UpdateSettings changes the caller's settings
+//
+//encore:api auth method=PATCH path=/auth/settings
+func UpdateSettings(ctx context.Context, req *UpdateSettingsRequest) (*Settings, error) {
+	userData := auth.Data().(*UserData)
+
+	s, err := loadSettings(ctx, userData.UserID)
+	if err != nil {
+		rlog.Error("failed to load settings", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load settings").Err()
+	}
+
+	if req.DefaultCollectionPublic != nil {
+		s.DefaultCollectionPublic = *req.DefaultCollectionPublic
+	}
+	if req.PreferredPreset != nil {
+		// Only presets GET /presets lists can be preferred
+		if *req.PreferredPreset != "" && !transcode.Exists(*req.PreferredPreset) {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown preset").Err()
+		}
+		s.PreferredPreset = *req.PreferredPreset
+	}
+	if req.PresignTTLSeconds != nil {
+		ttl := time.Duration(*req.PresignTTLSeconds) * time.Second
+		switch {
+		case ttl == 0:
+			s.PresignTTLSeconds = int(objectstore.StreamTTL().Seconds())
+		case ttl < objectstore.MinStreamTTL || ttl > objectstore.MaxURLTTL:
+			return nil, errs.B().Code(errs.InvalidArgument).
+				Msg("presign_ttl_seconds must be 0 or between 300 and 604800").Err()
+		default:
+			s.PresignTTLSeconds = *req.PresignTTLSeconds
+		}
+	}
+	if req.DiscordWebhookURL != nil {
+		if *req.DiscordWebhookURL != "" {
+			if err := discordwebhook.Validate(*req.DiscordWebhookURL); err != nil {
+				return nil, errs.B().Code(errs.InvalidArgument).Msg("discord_webhook_url must be a Discord webhook URL").Err()
+			}
+		}
+		s.DiscordWebhookURL = *req.DiscordWebhookURL
+	}
+	if req.ExpiredMedia != nil {
+		if *req.ExpiredMedia != ExpiredMediaTrash && *req.ExpiredMedia != ExpiredMediaDelete {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("expired_media must be 'trash' or 'delete'").Err()
+		}
+		s.ExpiredMedia = *req.ExpiredMedia
+	}
+	if n := req.Notifications; n != nil {
+		if n.ProcessingComplete != nil {
+			s.Notifications.ProcessingComplete = *n.ProcessingComplete
+		}
+		if n.ProcessingFailed != nil {
+			s.Notifications.ProcessingFailed = *n.ProcessingFailed
+		}
+		if n.NewLogin != nil {
+			s.Notifications.NewLogin = *n.NewLogin
+		}
+		if n.CollectionUpdates != nil {
+			s.Notifications.CollectionUpdates = *n.CollectionUpdates
+		}
+		if n.TeamUsage != nil {
+			s.Notifications.TeamUsage = *n.TeamUsage
+		}
+		if n.ScheduledPublish != nil {
+			s.Notifications.ScheduledPublish = *n.ScheduledPublish
+		}
+	}
+
+	// A lifetime equal to the deployment's default is stored as NULL, so it
+	// follows STREAM_URL_TTL
+	_, err = db.Exec(ctx, `
+		INSERT INTO user_settings (user_id, default_collection_public, preferred_preset, presign_ttl_seconds,
+			notify_processing_complete, notify_processing_failed, notify_new_login, notify_collection_updates,
+			notify_team_usage, discord_webhook_url, notify_scheduled_publish, expired_media, updated_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, $10), $5, $6, $7, $8, $9, NULLIF($11, ''), $12, $13, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET
+			default_collection_public = EXCLUDED.default_collection_public,
+			preferred_preset = EXCLUDED.preferred_preset,
+			presign_ttl_seconds = EXCLUDED.presign_ttl_seconds,
+			notify_processing_complete = EXCLUDED.notify_processing_complete,
+			notify_processing_failed = EXCLUDED.notify_processing_failed,
+			notify_new_login = EXCLUDED.notify_new_login,
+			notify_collection_updates = EXCLUDED.notify_collection_updates,
+			notify_team_usage = EXCLUDED.notify_team_usage,
+			discord_webhook_url = EXCLUDED.discord_webhook_url,
+			notify_scheduled_publish = EXCLUDED.notify_scheduled_publish,
+			expired_media = EXCLUDED.expired_media,
+			updated_at = NOW()
+	`, userData.UserID, s.DefaultCollectionPublic, s.PreferredPreset, s.PresignTTLSeconds,
+		s.Notifications.ProcessingComplete, s.Notifications.ProcessingFailed,
+		s.Notifications.NewLogin, s.Notifications.CollectionUpdates, s.Notifications.TeamUsage,
+		int(objectstore.StreamTTL().Seconds()), s.DiscordWebhookURL, s.Notifications.ScheduledPublish,
+		s.ExpiredMedia)
+	if err != nil {
+		rlog.Error("failed to save settings", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to save settings").Err()
+	}
+
+	return s, nil
+}
+
+// UserSettingsRequest selects the user whose settings to read
+type UserSettingsRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+// GetUserSettings returns a user's settings for services acting on their behalf
+//
+//encore:api private
+func GetUserSettings(ctx context.Context, req *UserSettingsRequest) (*Settings, error) {
+	return loadSettings(ctx, req.UserID)
+}
+
+// SettingsOrDefault returns a user's settings for services acting on their
+// behalf; the zero value (default URL lifetime, no preferences) when they
+// can't be loaded, which is logged
+func SettingsOrDefault(ctx context.Context, userID int64) *Settings {
+	settings, err := GetUserSettings(ctx, &UserSettingsRequest{UserID: userID})
+	if err != nil {
+		rlog.Warn("failed to load user settings", "error", err, "user_id", userID)
+		return &Settings{}
+	}
+	return settings
+}
+
+// NotificationRecipient is how to reach a user and which notifications they want
+type NotificationRecipient struct {
+	UserID      int64  `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	// DiscordID is empty for users without a Discord login
+	DiscordID string `json:"discord_id,omitempty"`
+	// Email is the address a login provider reported, if any
+	Email         string               `json:"email,omitempty"`
+	Notifications NotificationSettings `json:"notifications"`
+}
+
+// GetNotificationRecipient returns the contact details and notification
+// settings of a user for the notification service. Accounts being deleted
+// are not found.
+//
+//encore:api private
+func GetNotificationRecipient(ctx context.Context, req *UserSettingsRequest) (*NotificationRecipient, error) {
+	var r NotificationRecipient
+	err := db.QueryRow(ctx, `
+		SELECT u.id, COALESCE(u.display_name, u.username), COALESCE(u.discord_id, ''),
+			   COALESCE(u.email, (
+				   SELECT email FROM auth_identities
+				   WHERE user_id = u.id AND email IS NOT NULL
+				   ORDER BY created_at LIMIT 1
+			   ), '')
+		FROM users u WHERE u.id = $1
+	`, req.UserID).Scan(&r.UserID, &r.DisplayName, &r.DiscordID, &r.Email)
+	if err != nil || deletionPending(ctx, req.UserID) {
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
+	}
+
+	settings, err := loadSettings(ctx, req.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load settings").Err()
+	}
+	r.Notifications = settings.Notifications
+	return &r, nil
+}
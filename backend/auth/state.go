@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oauthStateCookie prefixes the cookies holding the signed OAuth state
+// between login and callback, one per provider
+const oauthStateCookie = "mediavault_oauth_state_"
+
+// oauthStateTTL bounds how long a login may take on the provider's side
+const oauthStateTTL = 10 * time.Minute
+
+// oauthState is what the login remembers for the callback: the state nonce
+// sent to the provider and the frontend path to return to afterwards
+type oauthState struct {
+	Nonce    string
+	Redirect string
+	// LinkUserID is set when the identity is to be linked to this user
+	// instead of logging in; LinkNonce must then match the link cookie
+	LinkUserID int64
+	LinkNonce  string
+}
+
+// setStateCookie stores the state in a short-lived cookie signed with
+// SessionSecret, so the callback can verify it without server-side storage. The
+// redirect is part of the signed value, so it can't be swapped either.
+func setStateCookie(w http.ResponseWriter, req *http.Request, provider oauthProvider, state oauthState) error {
+	if secrets.SessionSecret == "" {
+		return errors.New("SessionSecret is not configured")
+	}
+
+	expires := time.Now().Add(oauthStateTTL)
+	payload := strings.Join([]string{
+		state.Nonce,
+		base64.RawURLEncoding.EncodeToString([]byte(state.Redirect)),
+		strconv.FormatInt(state.LinkUserID, 10),
+		state.LinkNonce,
+		strconv.FormatInt(expires.Unix(), 10),
+	}, ".")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie + provider.Name(),
+		Value:    payload + "." + stateSignature(provider, payload),
+		Path:     "/auth/" + provider.Name(),
+		Expires:  expires,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil || strings.HasPrefix(provider.RedirectURI(), "https://"),
+		// Lax so the cookie is sent on the top-level redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// verifyStateCookie checks the callback's state parameter against the signed
+// cookie and returns the remembered state. The cookie is cleared either way,
+// so every state can only be used once.
+func verifyStateCookie(w http.ResponseWriter, req *http.Request, provider oauthProvider) (oauthState, error) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie + provider.Name(),
+		Value:    "",
+		Path:     "/auth/" + provider.Name(),
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	cookie, err := req.Cookie(oauthStateCookie + provider.Name())
+	if err != nil {
+		return oauthState{}, errors.New("missing state cookie")
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 6 || secrets.SessionSecret == "" {
+		return oauthState{}, errors.New("malformed state cookie")
+	}
+	payload := strings.Join(parts[:5], ".")
+	if !hmac.Equal([]byte(parts[5]), []byte(stateSignature(provider, payload))) {
+		return oauthState{}, errors.New("invalid state cookie signature")
+	}
+
+	expires, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return oauthState{}, errors.New("state expired")
+	}
+	param := req.URL.Query().Get("state")
+	if param == "" || subtle.ConstantTimeCompare([]byte(param), []byte(parts[0])) != 1 {
+		return oauthState{}, errors.New("state mismatch")
+	}
+	redirect, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return oauthState{}, errors.New("malformed state cookie")
+	}
+	linkUserID, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return oauthState{}, errors.New("malformed state cookie")
+	}
+
+	return oauthState{Nonce: parts[0], Redirect: string(redirect), LinkUserID: linkUserID, LinkNonce: parts[3]}, nil
+}
+
+// stateSignature signs a state cookie payload for a provider; the prefix
+// keeps these signatures distinct from access token signatures and from the
+// other providers' states
+func stateSignature(provider oauthProvider, payload string) string {
+	return jwtSignature("oauth-state:" + provider.Name() + ":" + payload)
+}
+
+// sanitizeRedirect only accepts frontend-relative paths, so the login flow
+// can't be used as an open redirect
+func sanitizeRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.Contains(path, "\\") {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+)
+
+// Token modes selected with AUTH_TOKEN_MODE
+const (
+	// TokenModeSession issues opaque session tokens looked up on every request
+	TokenModeSession = "session"
+	// TokenModeJWT issues short-lived signed access tokens plus rotating
+	// refresh tokens
+	TokenModeJWT = "jwt"
+)
+
+// jwtIssuer is the iss claim of access tokens
+const jwtIssuer = "mediavault"
+
+// getTokenMode returns the configured token mode, defaulting to sessions
+func getTokenMode() string {
+	if os.Getenv("AUTH_TOKEN_MODE") == TokenModeJWT {
+		return TokenModeJWT
+	}
+	return TokenModeSession
+}
+
+// getAccessTokenTTL returns the lifetime of JWT access tokens
+func getAccessTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AUTH_ACCESS_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// getRefreshTokenTTL returns the lifetime of refresh tokens
+func getRefreshTokenTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AUTH_REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// accessClaims are the claims of a JWT access token. They carry everything
+// AuthHandler needs, so validating one needs neither a session nor a database
+// lookup.
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // user ID
+	DiscordID string `json:"discord_id,omitempty"`
+	Username  string `json:"name"`
+	// Roles and StorageQuota are refreshed with every access token
+	Roles        []string `json:"roles,omitempty"`
+	StorageQuota int64    `json:"storage_quota,omitempty"`
+	IssuedAt     int64    `json:"iat"`
+	ExpiresAt    int64    `json:"exp"`
+}
+
+// jwtHeader is the fixed header of HS256 tokens
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signAccessToken issues an HS256 access token for the user, signed with SessionSecret
+func signAccessToken(user *User) (string, time.Time, error) {
+	if secrets.SessionSecret == "" {
+		return "", time.Time{}, errors.New("SessionSecret is not configured")
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(getAccessTokenTTL())
+	payload, err := json.Marshal(accessClaims{
+		Issuer:       jwtIssuer,
+		Subject:      strconv.FormatInt(user.ID, 10),
+		DiscordID:    user.DiscordID,
+		Username:     user.Username,
+		Roles:        user.Roles,
+		StorageQuota: effectiveQuota(user.StorageQuota),
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + jwtSignature(signingInput), expiresAt, nil
+}
+
+// jwtSignature returns the encoded HMAC-SHA256 of the signing input
+func jwtSignature(signingInput string) string {
+	mac := hmac.New(sha256.New, []byte(secrets.SessionSecret))
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isJWT reports whether a bearer token is a JWT rather than a session token
+// (session tokens never contain dots)
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// parseAccessToken verifies the signature and expiry of an access token
+func parseAccessToken(token string) (*UserData, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader || secrets.SessionSecret == "" {
+		return nil, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(parts[0]+"."+parts[1]))) {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed token")
+	}
+	if claims.Issuer != jwtIssuer {
+		return nil, errors.New("invalid issuer")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	return &UserData{
+		UserID:            userID,
+		DiscordID:         claims.DiscordID,
+		Username:          claims.Username,
+		IsAdmin:           isAdmin(claims.DiscordID, claims.Roles),
+		Roles:             claims.Roles,
+		StorageQuotaBytes: claims.StorageQuota,
+	}, nil
+}
+
+// hashToken returns the SHA-256 of a refresh token; only hashes are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token of the given family
+func issueRefreshToken(ctx context.Context, userID int64, familyID string) (string, error) {
+	token := generateSessionToken()
+	_, err := db.Exec(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, hashToken(token), familyID, userID, time.Now().Add(getRefreshTokenTTL()))
+	if err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+	return token, nil
+}
+
+// TokenPair contains a JWT access token and its refresh token
+type TokenPair struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// issueTokenPair signs an access token and starts a new refresh token family
+func issueTokenPair(ctx context.Context, user *User) (*TokenPair, error) {
+	accessToken, expiresAt, err := signAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := issueRefreshToken(ctx, user.ID, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// RefreshRequest contains the refresh token to exchange
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Every refresh token can be used once; presenting a replaced
+// token again means it was stolen, so its whole family is revoked.
+//
+//encore:api public method=POST path=/auth/token/refresh
+func RefreshToken(ctx context.Context, req *RefreshRequest) (*TokenPair, error) {
+	if getTokenMode() != TokenModeJWT {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("refresh tokens are not enabled").Err()
+	}
+	if req.RefreshToken == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("refresh_token is required").Err()
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+	defer tx.Rollback()
+
+	var familyID string
+	var userID int64
+	var expiresAt time.Time
+	var replacedAt, revokedAt *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT family_id, user_id, expires_at, replaced_at, revoked_at
+		FROM refresh_tokens WHERE token_hash = $1
+		FOR UPDATE
+	`, hashToken(req.RefreshToken)).Scan(&familyID, &userID, &expiresAt, &replacedAt, &revokedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("invalid refresh token").Err()
+	}
+	if err != nil {
+		rlog.Error("failed to look up refresh token", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+
+	if replacedAt != nil {
+		// Reuse of a rotated token: revoke every token of the family so
+		// neither the thief nor the user can continue with it
+		rlog.Warn("refresh token reuse detected, revoking family", "user_id", userID, "family_id", familyID)
+		_, err = tx.Exec(ctx, `
+			UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL
+		`, familyID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			rlog.Error("failed to revoke refresh token family", "error", err, "family_id", familyID)
+		}
+		entry := callerAudit(AuditTokenRevoked, userID)
+		entry.Details = map[string]string{"token": "refresh_token", "family_id": familyID, "reason": "reuse detected"}
+		recordAudit(ctx, entry)
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("refresh token reuse detected").Err()
+	}
+	if revokedAt != nil || time.Now().After(expiresAt) {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("refresh token expired").Err()
+	}
+
+	var user User
+	err = tx.QueryRow(ctx, `
+		SELECT id, COALESCE(discord_id, ''), username, COALESCE(avatar_url, ''), roles, storage_quota_bytes
+		FROM users WHERE id = $1
+	`, userID).Scan(&user.ID, &user.DiscordID, &user.Username, &user.AvatarURL, &user.Roles, &user.StorageQuota)
+	if err != nil {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("user not found").Err()
+	}
+
+	// Rotate: mark the presented token replaced and issue its successor
+	_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET replaced_at = NOW() WHERE token_hash = $1`,
+		hashToken(req.RefreshToken))
+	if err != nil {
+		rlog.Error("failed to rotate refresh token", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+	refreshToken := generateSessionToken()
+	_, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, user_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, hashToken(refreshToken), familyID, userID, time.Now().Add(getRefreshTokenTTL()))
+	if err != nil {
+		rlog.Error("failed to store refresh token", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+
+	accessToken, accessExpiresAt, err := signAccessToken(&user)
+	if err != nil {
+		rlog.Error("failed to sign access token", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+	if err := tx.Commit(); err != nil {
+		rlog.Error("failed to commit refresh token rotation", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to refresh token").Err()
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    accessExpiresAt,
+	}, nil
+}
+
+// revokeRefreshTokens revokes every active refresh token of a user
+func revokeRefreshTokens(ctx context.Context, userID int64) error {
+	_, err := db.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	return err
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// COSE algorithm identifiers of the passkey signatures we verify
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// webauthnTimeout bounds how long a browser ceremony may take
+const webauthnTimeout = 5 * time.Minute
+
+// Authenticator data flags
+const (
+	flagUserPresent        = 0x01
+	flagAttestedCredential = 0x40
+)
+
+// getWebAuthnOrigin returns the origin passkey ceremonies run on, by default
+// the frontend's
+func getWebAuthnOrigin() string {
+	if val := os.Getenv("WEBAUTHN_ORIGIN"); val != "" {
+		return strings.TrimRight(val, "/")
+	}
+	u, err := url.Parse(getFrontendURL())
+	if err != nil {
+		return getFrontendURL()
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// getWebAuthnRPID returns the relying party ID passkeys are bound to, by
+// default the host name of the origin
+func getWebAuthnRPID() string {
+	if val := os.Getenv("WEBAUTHN_RP_ID"); val != "" {
+		return val
+	}
+	u, err := url.Parse(getWebAuthnOrigin())
+	if err != nil {
+		return "localhost"
+	}
+	return u.Hostname()
+}
+
+// newWebAuthnChallenge returns a random challenge, base64url-encoded
+func newWebAuthnChallenge() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeBase64URL decodes base64url with or without padding, as browsers
+// and libraries disagree on it
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// clientData is the part of the browser's collected client data we verify
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// verifyClientData checks that the client data belongs to a ceremony of the
+// given type ("webauthn.create" or "webauthn.get") for the challenge on our origin
+func verifyClientData(raw []byte, ceremony, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return errors.New("malformed client data")
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("unexpected ceremony %q", data.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(data.Challenge, "=")), []byte(challenge)) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if data.Origin != getWebAuthnOrigin() {
+		return fmt.Errorf("unexpected origin %q", data.Origin)
+	}
+	return nil
+}
+
+// authenticatorData is the part of the authenticator data we use
+type authenticatorData struct {
+	Flags     byte
+	SignCount uint32
+	// CredentialID is only set in registrations
+	CredentialID []byte
+}
+
+// parseAuthenticatorData parses authenticator data and checks that it is
+// for our relying party and the user was present
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	// 32-byte RP ID hash, flags, 4-byte signature counter
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(getWebAuthnRPID()))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, errors.New("relying party mismatch")
+	}
+
+	data := &authenticatorData{
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.Flags&flagUserPresent == 0 {
+		return nil, errors.New("user was not present")
+	}
+	if data.Flags&flagAttestedCredential != 0 {
+		// 16-byte AAGUID, 2-byte credential ID length, credential ID
+		if len(raw) < 55 {
+			return nil, errors.New("attested credential data too short")
+		}
+		n := int(binary.BigEndian.Uint16(raw[53:55]))
+		if len(raw) < 55+n {
+			return nil, errors.New("attested credential data too short")
+		}
+		data.CredentialID = raw[55 : 55+n]
+	}
+	return data, nil
+}
+
+// parsePasskeyPublicKey parses a DER-encoded SubjectPublicKeyInfo, as
+// returned by the browser's getPublicKey(), of the given COSE algorithm
+func parsePasskeyPublicKey(der []byte, algorithm int) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.New("malformed public key")
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		if algorithm == coseES256 {
+			return key, nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == coseEdDSA {
+			return key, nil
+		}
+	case *rsa.PublicKey:
+		if algorithm == coseRS256 {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %d", algorithm)
+}
+
+// verifyAssertionSignature checks an assertion's signature over the
+// authenticator data and the hash of the client data
+func verifyAssertionSignature(key crypto.PublicKey, authData, clientDataJSON, signature []byte) error {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	valid := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, signed, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
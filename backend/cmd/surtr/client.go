@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often processing status is checked
+const pollInterval = 5 * time.Second
+
+// client calls the API with an API key
+type client struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func newClient(baseURL, apiKey string) *client {
+	return &client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: time.Minute},
+	}
+}
+
+// apiError is an error response of the API
+type apiError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d", e.Status)
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// call sends a JSON request and decodes the response into out unless it is
+// nil. headers are added to the request.
+func (c *client) call(ctx context.Context, method, path string, body, out any, headers map[string]string) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		e := &apiError{Status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(e)
+		return e
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// uploadFile is a file to sign an upload for
+type uploadFile struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
+
+// signedUpload is where and how to upload a file
+type signedUpload struct {
+	UploadURL     string            `json:"upload_url"`
+	UploadHeaders map[string]string `json:"upload_headers"`
+	MediaID       string            `json:"media_id"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+}
+
+// signUploads signs uploads for up to 500 files, in the order given
+func (c *client) signUploads(ctx context.Context, teamID string, files []uploadFile) ([]signedUpload, error) {
+	var resp struct {
+		Uploads []signedUpload `json:"uploads"`
+	}
+	err := c.call(ctx, "POST", "/media/upload/sign-batch", map[string]any{
+		"files":   files,
+		"team_id": teamID,
+	}, &resp, nil)
+	return resp.Uploads, err
+}
+
+// reportProgress tells the server how far an upload has come; failures
+// don't matter to the upload
+func (c *client) reportProgress(ctx context.Context, mediaID string, sent, total int64) {
+	_ = c.call(ctx, "POST", "/media/"+mediaID+"/upload-progress", map[string]int64{
+		"bytes_uploaded": sent,
+		"total_bytes":    total,
+	}, nil, nil)
+}
+
+// confirmOptions are the options of a confirmed upload
+type confirmOptions struct {
+	Title     string `json:"title,omitempty"`
+	Preset    string `json:"preset,omitempty"`
+	Packaging string `json:"packaging,omitempty"`
+	// ExpiresAt trashes or deletes the media at this time, if set
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// confirmUpload confirms an uploaded file, queueing it for processing. The
+// idempotency key makes a retry after a timeout safe.
+func (c *client) confirmUpload(ctx context.Context, mediaID string, size int64, opts confirmOptions) error {
+	body := map[string]any{
+		"media_id":   mediaID,
+		"size_bytes": size,
+		"title":      opts.Title,
+		"preset":     opts.Preset,
+		"packaging":  opts.Packaging,
+		"expires_at": opts.ExpiresAt,
+	}
+	headers := map[string]string{"Idempotency-Key": newIdempotencyKey()}
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = c.call(ctx, "POST", "/media/upload/confirm", body, nil, headers); err == nil {
+			return nil
+		}
+		if e, ok := err.(*apiError); ok && e.Status < 500 && e.Code != "aborted" {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * 2 * time.Second)
+	}
+	return err
+}
+
+// media is what the CLI needs to know of a media item
+type media struct {
+	ID               string `json:"id"`
+	Title            string `json:"title"`
+	OriginalFilename string `json:"original_filename"`
+	Status           string `json:"status"`
+	SizeBytes        int64  `json:"size_bytes"`
+}
+
+// waitForMedia polls a media item until it is ready or failed
+func (c *client) waitForMedia(ctx context.Context, mediaID string) (*media, error) {
+	for {
+		var m media
+		if err := c.call(ctx, "GET", "/media/"+url.PathEscape(mediaID), nil, &m, nil); err != nil {
+			return nil, err
+		}
+		if m.Status == "ready" || m.Status == "failed" {
+			return &m, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("still %s: %w", m.Status, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// collectionItems lists every item of a collection
+func (c *client) collectionItems(ctx context.Context, collectionID string) ([]media, error) {
+	var items []media
+	for page := 1; ; page++ {
+		var resp struct {
+			Items     []media `json:"items"`
+			ItemCount int     `json:"item_count"`
+		}
+		path := fmt.Sprintf("/collection/%s?page=%d&page_size=100&lazy_streams=true", url.PathEscape(collectionID), page)
+		if err := c.call(ctx, "GET", path, nil, &resp, nil); err != nil {
+			return nil, err
+		}
+		items = append(items, resp.Items...)
+		if len(resp.Items) < 100 || len(items) >= resp.ItemCount {
+			return items, nil
+		}
+	}
+}
+
+// addBatch is the most media added to a collection per call, the server's
+// limit
+const addBatch = 500
+
+// addToCollection adds media to a collection, failing if any of them could
+// not be added
+func (c *client) addToCollection(ctx context.Context, collectionID string, mediaIDs []string) error {
+	for start := 0; start < len(mediaIDs); start += addBatch {
+		var resp struct {
+			Results []struct {
+				MediaID string `json:"media_id"`
+				Status  string `json:"status"`
+			} `json:"results"`
+		}
+		err := c.call(ctx, "POST", "/collection/"+url.PathEscape(collectionID)+"/add",
+			map[string][]string{"media_ids": mediaIDs[start:min(start+addBatch, len(mediaIDs))]},
+			&resp, map[string]string{"Idempotency-Key": newIdempotencyKey()})
+		if err != nil {
+			return err
+		}
+		for _, r := range resp.Results {
+			if r.Status != "added" && r.Status != "already_added" {
+				return fmt.Errorf("%s: %s", r.MediaID, r.Status)
+			}
+		}
+	}
+	return nil
+}
+
+// newIdempotencyKey returns a random key for one action
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
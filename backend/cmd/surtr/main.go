@@ -0,0 +1,139 @@
+// Command surtr uploads media to a surtr-media server with an API key: it
+// signs, uploads and confirms files, waits for processing and syncs local
+// folders to collections.
+//
+// Usage:
+//
+//	surtr upload [-collection ID] [-wait] FILE...
+//	surtr wait MEDIA_ID...
+//	surtr sync [-wait] [-dry-run] DIR COLLECTION_ID
+//
+// The server and key come from -api and -key, or SURTR_API_URL and
+// SURTR_API_KEY.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// defaultAPIURL is the server of a local development setup
+const defaultAPIURL = "http://localhost:4000"
+
+const usage = `surtr uploads media to a surtr-media server.
+
+Usage:
+  surtr upload [flags] FILE...          upload files
+  surtr wait [flags] MEDIA_ID...        wait until media finished processing
+  surtr sync [flags] DIR COLLECTION_ID  upload a folder's new files into a collection
+
+Every command takes -api (SURTR_API_URL, default ` + defaultAPIURL + `) and
+-key (SURTR_API_KEY), an API key with media:write, media:read and, to add
+files to collections, collection:read and collection:write.
+Run "surtr COMMAND -h" for the command's flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "upload":
+		err = runUpload(ctx, os.Args[2:])
+	case "wait":
+		err = runWait(ctx, os.Args[2:])
+	case "sync":
+		err = runSync(ctx, os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "surtr: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "surtr:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// commonFlags are the flags of every command
+type commonFlags struct {
+	apiURL string
+	apiKey string
+}
+
+// register adds the common flags to fs
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	apiURL := os.Getenv("SURTR_API_URL")
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	fs.StringVar(&c.apiURL, "api", apiURL, "server URL")
+	fs.StringVar(&c.apiKey, "key", os.Getenv("SURTR_API_KEY"), "API key (mvk_...)")
+}
+
+// client returns a client for the server, failing without a key
+func (c *commonFlags) client() (*client, error) {
+	if c.apiKey == "" {
+		return nil, errors.New("an API key is required: pass -key or set SURTR_API_KEY")
+	}
+	if !strings.HasPrefix(c.apiKey, "mvk_") {
+		return nil, errors.New("the API key should start with mvk_; create one with POST /auth/api-keys")
+	}
+	return newClient(c.apiURL, c.apiKey), nil
+}
+
+// runWait waits for media to finish processing
+func runWait(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+	var common commonFlags
+	common.register(fs)
+	timeout := fs.Duration("timeout", 2*time.Hour, "how long to wait at most")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: surtr wait [flags] MEDIA_ID...")
+	}
+	c, err := common.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	return waitAll(ctx, c, fs.Args())
+}
+
+// waitAll waits for every media item, failing if any of them failed
+func waitAll(ctx context.Context, c *client, mediaIDs []string) error {
+	failed := 0
+	for _, mediaID := range mediaIDs {
+		m, err := c.waitForMedia(ctx, mediaID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", mediaID, err)
+		}
+		fmt.Printf("%s\t%s\n", mediaID, m.Status)
+		if m.Status != "ready" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d media failed to process", failed, len(mediaIDs))
+	}
+	return nil
+}
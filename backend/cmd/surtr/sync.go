@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runSync uploads the files of a folder that a collection doesn't have
+// yet and adds them to it. Files are matched to items by file name, so a
+// renamed file is uploaded again and an edited one is not.
+func runSync(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	var common commonFlags
+	common.register(flags)
+	var opts uploadOptions
+	flags.StringVar(&opts.teamID, "team", "", "upload into this team")
+	flags.StringVar(&opts.confirm.Preset, "preset", "", "transcode preset (see GET /presets)")
+	flags.StringVar(&opts.confirm.Packaging, "packaging", "", `output packaging, "mp4" or "dash"`)
+	flags.IntVar(&opts.workers, "workers", 4, "files uploaded at once")
+	recursive := flags.Bool("recursive", false, "include files in subfolders")
+	dryRun := flags.Bool("dry-run", false, "only list the files that would be uploaded")
+	wait := flags.Bool("wait", false, "wait until the files are processed")
+	timeout := flags.Duration("timeout", 2*time.Hour, "how long -wait waits at most")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: surtr sync [flags] DIR COLLECTION_ID")
+	}
+	dir, collectionID := flags.Arg(0), flags.Arg(1)
+	c, err := common.client()
+	if err != nil {
+		return err
+	}
+
+	local, err := listFiles(dir, *recursive)
+	if err != nil {
+		return err
+	}
+	items, err := c.collectionItems(ctx, collectionID)
+	if err != nil {
+		return fmt.Errorf("failed to list collection: %w", err)
+	}
+	have := make(map[string]bool, len(items))
+	for _, item := range items {
+		have[item.OriginalFilename] = true
+	}
+	var missing []string
+	for _, path := range local {
+		name := filepath.Base(path)
+		if have[name] {
+			continue
+		}
+		// Two local files of the same name would both be uploaded on
+		// every run otherwise
+		have[name] = true
+		missing = append(missing, path)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d files, %d already in the collection, %d to upload\n",
+		len(local), len(local)-len(missing), len(missing))
+	if *dryRun {
+		for _, path := range missing {
+			fmt.Println(path)
+		}
+		return nil
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	mediaIDs, err := uploadFiles(ctx, c, missing, opts)
+	if len(mediaIDs) == 0 {
+		return err
+	}
+	if addErr := c.addToCollection(ctx, collectionID, mediaIDs); addErr != nil {
+		return fmt.Errorf("failed to add to collection: %w", addErr)
+	}
+	if *wait {
+		waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		if waitErr := waitAll(waitCtx, c, mediaIDs); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return err
+}
+
+// listFiles lists the regular files in dir, skipping hidden ones
+func listFiles(dir string, recursive bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := strings.HasPrefix(d.Name(), ".") && path != dir
+		if d.IsDir() {
+			if path != dir && (hidden || !recursive) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !hidden && d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
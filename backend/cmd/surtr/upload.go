@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upload tuning
+const (
+	// signBatch is the most files signed per call, the server's limit
+	signBatch = 500
+	// progressInterval is how often upload progress is reported
+	progressInterval = 5 * time.Second
+	// putAttempts is how often a failed PUT is tried before giving up
+	putAttempts = 3
+)
+
+// uploadOptions apply to every file of an upload
+type uploadOptions struct {
+	teamID  string
+	workers int
+	confirm confirmOptions
+}
+
+// runUpload uploads files, optionally adding them to a collection and
+// waiting for them to be processed
+func runUpload(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	var common commonFlags
+	common.register(fs)
+	var opts uploadOptions
+	fs.StringVar(&opts.teamID, "team", "", "upload into this team")
+	fs.StringVar(&opts.confirm.Title, "title", "", "title of the media (one file only; default: the file name)")
+	fs.StringVar(&opts.confirm.Preset, "preset", "", "transcode preset (see GET /presets)")
+	fs.StringVar(&opts.confirm.Packaging, "packaging", "", `output packaging, "mp4" or "dash"`)
+	fs.IntVar(&opts.workers, "workers", 4, "files uploaded at once")
+	expire := fs.Duration("expire", 0, "trash or delete the media this long after uploading (e.g. 168h)")
+	collectionID := fs.String("collection", "", "add the files to this collection")
+	wait := fs.Bool("wait", false, "wait until the files are processed")
+	timeout := fs.Duration("timeout", 2*time.Hour, "how long -wait waits at most")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: surtr upload [flags] FILE...")
+	}
+	if opts.confirm.Title != "" && fs.NArg() > 1 {
+		return errors.New("-title only works with a single file")
+	}
+	if *expire > 0 {
+		expiresAt := time.Now().Add(*expire)
+		opts.confirm.ExpiresAt = &expiresAt
+	}
+	c, err := common.client()
+	if err != nil {
+		return err
+	}
+
+	mediaIDs, err := uploadFiles(ctx, c, fs.Args(), opts)
+	if len(mediaIDs) == 0 {
+		return err
+	}
+	if *collectionID != "" {
+		if addErr := c.addToCollection(ctx, *collectionID, mediaIDs); addErr != nil {
+			return fmt.Errorf("failed to add to collection: %w", addErr)
+		}
+	}
+	if *wait {
+		waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		if waitErr := waitAll(waitCtx, c, mediaIDs); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return err
+}
+
+// uploadFiles signs, uploads and confirms files, a few at a time. It
+// returns the media IDs of the files that made it even when others failed.
+func uploadFiles(ctx context.Context, c *client, paths []string, opts uploadOptions) ([]string, error) {
+	var done []string
+	var failed int
+	for start := 0; start < len(paths); start += signBatch {
+		batch := paths[start:min(start+signBatch, len(paths))]
+		files := make([]uploadFile, len(batch))
+		for i, path := range batch {
+			files[i] = uploadFile{Filename: filepath.Base(path), MimeType: detectMimeType(path)}
+		}
+		uploads, err := c.signUploads(ctx, opts.teamID, files)
+		if err != nil {
+			return done, fmt.Errorf("failed to sign uploads: %w", err)
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		next := make(chan int)
+		for w := 0; w < max(opts.workers, 1); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					err := uploadOne(ctx, c, batch[i], files[i], uploads[i], opts.confirm)
+					mu.Lock()
+					if err != nil {
+						failed++
+						fmt.Fprintf(os.Stderr, "%s: %v\n", batch[i], err)
+					} else {
+						done = append(done, uploads[i].MediaID)
+						fmt.Printf("%s\t%s\n", uploads[i].MediaID, batch[i])
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		for i := range batch {
+			if ctx.Err() != nil {
+				break
+			}
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+		if ctx.Err() != nil {
+			return done, ctx.Err()
+		}
+	}
+	if failed > 0 {
+		return done, fmt.Errorf("%d of %d files failed to upload", failed, len(paths))
+	}
+	return done, nil
+}
+
+// uploadOne PUTs a file to its presigned URL, reporting progress on the
+// way, and confirms it. Files go up in a single PUT, as the server signs
+// single-part uploads; a failed PUT starts over.
+func uploadOne(ctx context.Context, c *client, path string, file uploadFile, upload signedUpload, opts confirmOptions) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	for attempt := 1; ; attempt++ {
+		err = putFile(ctx, c, path, file.MimeType, size, upload)
+		if err == nil || attempt == putAttempts || ctx.Err() != nil || time.Now().After(upload.ExpiresAt) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+
+	if opts.Title == "" {
+		opts.Title = strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+	}
+	if err := c.confirmUpload(ctx, upload.MediaID, size, opts); err != nil {
+		return fmt.Errorf("confirm failed: %w", err)
+	}
+	return nil
+}
+
+// putFile streams a file to its presigned URL
+func putFile(ctx context.Context, c *client, path, mimeType string, size int64, upload signedUpload) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	body := &countingReader{r: f}
+	req, err := http.NewRequestWithContext(ctx, "PUT", upload.UploadURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", mimeType)
+	for name, value := range upload.UploadHeaders {
+		req.Header.Set(name, value)
+	}
+
+	// Progress is reported while the PUT runs, so other clients of the
+	// account can follow it and stalls are noticed
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.reportProgress(ctx, upload.MediaID, body.n.Load(), size)
+			}
+		}
+	}()
+	// The upload may take far longer than API calls
+	resp, err := (&http.Client{}).Do(req)
+	close(stop)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// detectMimeType guesses a file's type from its extension, then from its
+// first bytes
+func detectMimeType(path string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); t != "" {
+		return t
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return http.DetectContentType(head[:n])
+}
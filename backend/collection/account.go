@@ -0,0 +1,56 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Deleting an account removes the user's personal collections and their
+// share links, the user's access to collections shared with them and their
+// follows; collections they created in a team stay with the team
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "collection-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountCollections,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteAccountCollections deletes every personal collection of a deleted
+// account (collection items cascade)
+func deleteAccountCollections(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	result, err := db.Exec(ctx, `DELETE FROM collections WHERE owner_id = $1 AND team_id IS NULL`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	deleted := int(result.RowsAffected())
+
+	// Other users' shares with the deleted user and their follows go too;
+	// their views of other collections stay, anonymized
+	if _, err := db.Exec(ctx, `DELETE FROM collection_shares WHERE user_id = $1`, msg.UserID); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM collection_follows WHERE user_id = $1`, msg.UserID); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `UPDATE collection_views SET user_id = NULL WHERE user_id = $1`, msg.UserID); err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1`, msg.UserID); err != nil {
+		return err
+	}
+
+	rlog.Info("account collections deleted", "user_id", msg.UserID, "deleted", deleted)
+	return authpkg.ReportDeletionProgress(ctx, &authpkg.DeletionProgress{
+		DeletionID:   msg.DeletionID,
+		Service:      "collection",
+		DeletedItems: deleted,
+	})
+}
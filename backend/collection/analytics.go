@@ -0,0 +1,220 @@
+package collection
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// collectionViewRetention is how long collection views are kept
+const collectionViewRetention = 365 * 24 * time.Hour
+
+// getGeoCountryHeader returns the request header the reverse proxy puts the
+// client's country code in (Cloudflare's by default)
+func getGeoCountryHeader() string {
+	if val := os.Getenv("GEOIP_COUNTRY_HEADER"); val != "" {
+		return val
+	}
+	return "CF-IPCountry"
+}
+
+// recordCollectionView stores a view or download of a collection; header is
+// the request's, or nil for the current API call. Views that can't be
+// stored are logged and go uncounted.
+func recordCollectionView(ctx context.Context, collectionID, kind string, access *collectionAccess, token string, header http.Header) {
+	if access.IsOwner {
+		return
+	}
+	if header == nil {
+		if req := encore.CurrentRequest(); req != nil {
+			header = req.Headers
+		}
+	}
+	var country, userAgent string
+	if header != nil {
+		country = strings.ToUpper(strings.TrimSpace(header.Get(getGeoCountryHeader())))
+		// XX is unknown and T1 is Tor for Cloudflare; neither is a country
+		if len(country) != 2 || country == "XX" || country == "T1" {
+			country = ""
+		}
+		userAgent = header.Get("User-Agent")
+	}
+	if access.Via != "token" {
+		token = ""
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO collection_views (collection_id, kind, via, share_token, user_id, country, user_agent, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid, NULLIF($5, 0), NULLIF($6, ''), NULLIF($7, ''), NOW())
+	`, collectionID, kind, access.Via, token, access.UserID, country, userAgent)
+	if err != nil {
+		rlog.Warn("failed to record collection view", "error", err, "collection_id", collectionID)
+	}
+}
+
+// CollectionAnalyticsRequest selects the period
+type CollectionAnalyticsRequest struct {
+	// Days back to report on, 30 by default and at most 365
+	Days int `query:"days"`
+}
+
+// CollectionView is one view or download of a collection
+type CollectionView struct {
+	Kind string `json:"kind"`
+	Via  string `json:"via"`
+	// CurrentToken is set when the share token used still works
+	CurrentToken bool `json:"current_token,omitempty"`
+	// TokenLabel is the label of the extra share token used
+	TokenLabel string                 `json:"token_label,omitempty"`
+	Viewer     *authpkg.PublicProfile `json:"viewer,omitempty"`
+	Country    string                 `json:"country,omitempty"`
+	UserAgent  string                 `json:"user_agent,omitempty"`
+	ViewedAt   time.Time              `json:"viewed_at"`
+}
+
+// ViewCount is a number of views of one kind
+type ViewCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// CollectionAnalytics sums up who opened a collection
+type CollectionAnalytics struct {
+	Since        time.Time  `json:"since"`
+	Views        int        `json:"views"`
+	Downloads    int        `json:"downloads"`
+	LastViewedAt *time.Time `json:"last_viewed_at,omitempty"`
+	// ByVia counts views by how access was granted: token, public or shared
+	ByVia     []ViewCount      `json:"by_via"`
+	ByCountry []ViewCount      `json:"by_country"`
+	Recent    []CollectionView `json:"recent"`
+}
+
+// GetCollectionAnalytics reports the views and downloads of a collection by
+// anyone but the owner, so the owner can tell whether a share link was
+// opened. The 100 most recent are listed individually.
+//
+//encore:api auth method=GET path=/collection/:id/analytics
+func GetCollectionAnalytics(ctx context.Context, id string, req *CollectionAnalyticsRequest) (*CollectionAnalytics, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	days := req.Days
+	if days < 1 || days > 365 {
+		days = 30
+	}
+
+	resp := &CollectionAnalytics{
+		Since:     time.Now().AddDate(0, 0, -days),
+		ByVia:     []ViewCount{},
+		ByCountry: []ViewCount{},
+		Recent:    []CollectionView{},
+	}
+
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FILTER (WHERE kind = 'view'), COUNT(*) FILTER (WHERE kind = 'download'), MAX(created_at)
+		FROM collection_views WHERE collection_id = $1 AND created_at > $2
+	`, id, resp.Since).Scan(&resp.Views, &resp.Downloads, &resp.LastViewedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get analytics").Err()
+	}
+
+	for _, group := range []struct {
+		column string
+		counts *[]ViewCount
+	}{{"via", &resp.ByVia}, {"COALESCE(country, '')", &resp.ByCountry}} {
+		rows, err := db.Query(ctx, `
+			SELECT `+group.column+`, COUNT(*) FROM collection_views
+			WHERE collection_id = $1 AND created_at > $2
+			GROUP BY 1 ORDER BY 2 DESC, 1
+		`, id, resp.Since)
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to get analytics").Err()
+		}
+		for rows.Next() {
+			var c ViewCount
+			if err := rows.Scan(&c.Key, &c.Count); err != nil {
+				continue
+			}
+			*group.counts = append(*group.counts, c)
+		}
+		rows.Close()
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT v.kind, v.via, COALESCE(v.share_token = c.share_token OR t.token IS NOT NULL, FALSE),
+			   COALESCE(t.label, ''), COALESCE(v.user_id, 0), COALESCE(v.country, ''), COALESCE(v.user_agent, ''),
+			   v.created_at
+		FROM collection_views v
+		JOIN collections c ON c.id = v.collection_id
+		LEFT JOIN collection_share_tokens t ON t.token = v.share_token
+		WHERE v.collection_id = $1 AND v.created_at > $2
+		ORDER BY v.created_at DESC
+		LIMIT 100
+	`, id, resp.Since)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get analytics").Err()
+	}
+	var viewerIDs []int64
+	for rows.Next() {
+		var v CollectionView
+		var viewerID int64
+		if err := rows.Scan(&v.Kind, &v.Via, &v.CurrentToken, &v.TokenLabel, &viewerID, &v.Country, &v.UserAgent,
+			&v.ViewedAt); err != nil {
+			continue
+		}
+		resp.Recent = append(resp.Recent, v)
+		viewerIDs = append(viewerIDs, viewerID)
+	}
+	rows.Close()
+
+	viewers := map[int64]*authpkg.PublicProfile{}
+	for i, viewerID := range viewerIDs {
+		if viewerID == 0 {
+			continue
+		}
+		if _, ok := viewers[viewerID]; !ok {
+			viewers[viewerID], _ = authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: viewerID})
+		}
+		resp.Recent[i].Viewer = viewers[viewerID]
+	}
+
+	return resp, nil
+}
+
+// Views past their retention are removed daily
+var _ = cron.NewJob("collection-view-retention", cron.JobConfig{
+	Title:    "Remove old collection views",
+	Every:    24 * cron.Hour,
+	Endpoint: CleanupCollectionViews,
+})
+
+// CleanupCollectionViewsResponse reports how many views were removed
+type CleanupCollectionViewsResponse struct {
+	Removed int `json:"removed"`
+}
+
+// CleanupCollectionViews removes collection views older than a year
+//
+//encore:api private
+func CleanupCollectionViews(ctx context.Context) (*CleanupCollectionViewsResponse, error) {
+	result, err := db.Exec(ctx, `
+		DELETE FROM collection_views WHERE created_at < $1
+	`, time.Now().Add(-collectionViewRetention))
+	if err != nil {
+		return nil, err
+	}
+	return &CleanupCollectionViewsResponse{Removed: int(result.RowsAffected())}, nil
+}
@@ -0,0 +1,114 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Audit log events of the collection service
+const (
+	auditCollectionCreated     = "collection_created"
+	auditCollectionUpdated     = "collection_updated"
+	auditCollectionDeleted     = "collection_deleted"
+	auditCollectionRestored    = "collection_restored"
+	auditCollectionMoved       = "collection_moved"
+	auditCollectionTagsUpdated = "collection_tags_updated"
+	auditCollectionImported    = "collection_imported"
+	auditCollectionCloned      = "collection_cloned"
+	auditItemsAdded            = "collection_items_added"
+	auditItemsRemoved          = "collection_items_removed"
+	auditItemNoteUpdated       = "collection_item_note_updated"
+	auditShareUpdated          = "collection_share_updated"
+	auditSharedWithUsers       = "collection_shared"
+	auditUnsharedWithUser      = "collection_unshared"
+	auditShareTokenCreated     = "share_token_created"
+	auditShareTokenUpdated     = "share_token_updated"
+	auditShareTokenRevoked     = "share_token_revoked"
+	auditUploadRequestCreated  = "upload_request_created"
+	auditUploadRequestRevoked  = "upload_request_revoked"
+	auditMediaTransferred      = "media_transferred"
+	auditCollectionTakenDown   = "collection_taken_down"
+	auditTakedownLifted        = "collection_takedown_lifted"
+	auditReportDismissed       = "report_dismissed"
+	auditPostedToDiscord       = "collection_posted_to_discord"
+	auditPublishScheduled      = "collection_publish_scheduled"
+	auditPublishUnscheduled    = "collection_publish_unscheduled"
+	auditCollectionPublished   = "collection_published"
+)
+
+// auditedCollection is a collection as the audit log shows it; the share
+// token itself is left out
+type auditedCollection struct {
+	Title               string      `json:"title"`
+	Description         string      `json:"description"`
+	Visibility          string      `json:"visibility"`
+	ParentID            *string     `json:"parent_id,omitempty"`
+	Rules               *SmartRules `json:"rules,omitempty"`
+	Tags                []string    `json:"tags"`
+	ShareScopes         []string    `json:"share_scopes"`
+	ShareTokenExpiresAt *time.Time  `json:"share_token_expires_at,omitempty"`
+	DeletedAt           *time.Time  `json:"deleted_at,omitempty"`
+	PublishAt           *time.Time  `json:"publish_at,omitempty"`
+	PublishVisibility   *string     `json:"publish_visibility,omitempty"`
+}
+
+// collectionSnapshot loads a collection for the audit log, nil when it
+// can't be loaded
+func collectionSnapshot(ctx context.Context, id string) *auditedCollection {
+	var c auditedCollection
+	var rules []byte
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(description, ''), visibility, parent_id::text, rules, tags, share_scopes,
+			   share_token_expires_at, deleted_at, publish_at, publish_visibility
+		FROM collections WHERE id = $1
+	`, id).Scan(&c.Title, &c.Description, &c.Visibility, &c.ParentID, &rules, &c.Tags, &c.ShareScopes,
+		&c.ShareTokenExpiresAt, &c.DeletedAt, &c.PublishAt, &c.PublishVisibility)
+	if err != nil {
+		return nil
+	}
+	c.Rules = parseRules(rules)
+	return &c
+}
+
+// recordAudit publishes a change the caller made to the audit log; before
+// and after are snapshots of the resource, nil when there is none. A
+// failure is only logged.
+func recordAudit(ctx context.Context, userID int64, event, resourceType, resourceID string, before, after any, details map[string]string) {
+	record := &authpkg.AuditRecord{
+		EventID:      uuid.New().String(),
+		UserID:       userID,
+		Event:        event,
+		Service:      "collection",
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Details:      details,
+		Before:       auditSnapshot(before),
+		After:        auditSnapshot(after),
+		OccurredAt:   time.Now(),
+	}
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		record.IP = strings.TrimSpace(strings.Split(req.Headers.Get("X-Forwarded-For"), ",")[0])
+		record.UserAgent = req.Headers.Get("User-Agent")
+	}
+
+	if _, err := authpkg.AuditTopic.Publish(ctx, record); err != nil {
+		rlog.Error("failed to publish audit event", "error", err, "event", event, "resource_id", resourceID)
+	}
+}
+
+// auditSnapshot encodes a snapshot, nil for none
+func auditSnapshot(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
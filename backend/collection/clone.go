@@ -0,0 +1,81 @@
+package collection
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// CloneCollectionRequest optionally names the copy
+type CloneCollectionRequest struct {
+	// Title defaults to the original's title with " (copy)"
+	Title string `json:"title,omitempty"`
+}
+
+// CloneCollection copies a collection with its description, items, their
+// notes and order (or its rules, for smart collections) into a new
+// collection next to it. The copy gets a fresh share token, the owner's default visibility and
+// none of the original's shares or upload requests. Taken down collections
+// can't be cloned.
+//
+//encore:api auth method=POST path=/collection/:id/clone
+func CloneCollection(ctx context.Context, id string, req *CloneCollectionRequest) (*CollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	// A copy would escape the takedown
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
+
+	visibility := defaultVisibility(ctx, userData.UserID)
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to clone collection").Err()
+	}
+	defer tx.Rollback()
+
+	var resp CollectionResponse
+	var rules []byte
+	err = tx.QueryRow(ctx, `
+		INSERT INTO collections (owner_id, title, description, visibility, parent_id, rules, tags, share_scopes,
+								 created_at)
+		SELECT owner_id, COALESCE(NULLIF($2, ''), title || ' (copy)'), description, $3, parent_id, rules, tags,
+			   share_scopes, NOW()
+		FROM collections WHERE id = $1
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, id, req.Title, visibility).Scan(
+		&resp.ID, &resp.ParentID, &resp.Title, &resp.Description, &resp.Visibility, &resp.ShareToken, &rules, &resp.Tags,
+		&resp.CreatedAt)
+	if err != nil {
+		rlog.Error("failed to clone collection", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to clone collection").Err()
+	}
+	resp.Rules = parseRules(rules)
+
+	// Items keep their added_at, which is what orders them
+	result, err := tx.Exec(ctx, `
+		INSERT INTO collection_items (collection_id, media_id, added_at, note)
+		SELECT $2, media_id, added_at, note FROM collection_items WHERE collection_id = $1
+	`, id, resp.ID)
+	if err != nil {
+		rlog.Error("failed to clone collection items", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to clone collection").Err()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to clone collection").Err()
+	}
+
+	rlog.Info("collection cloned", "collection_id", id, "clone_id", resp.ID, "items", result.RowsAffected())
+	recordAudit(ctx, userData.UserID, auditCollectionCloned, "collection", resp.ID, nil,
+		collectionSnapshot(ctx, resp.ID), map[string]string{"source_collection_id": id})
+	return &resp, nil
+}
@@ -3,76 +3,71 @@ package collection
 
 import (
 	"context"
-	"os"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
 	"encore.dev/storage/sqldb"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	authpkg "encore.app/auth"
+	"encore.app/idempotency"
+	"encore.app/media"
+	"encore.app/team"
 )
 
-// Secrets for S3/MinIO (for generating stream URLs)
-var secrets struct {
-	S3AccessKey string
-	S3SecretKey string
-}
-
-// getS3Endpoint returns the S3 endpoint
-func getS3Endpoint() string {
-	if val := os.Getenv("S3_ENDPOINT"); val != "" {
-		return val
-	}
-	return "localhost:9000"
-}
-
-// getS3Bucket returns the S3 bucket name
-func getS3Bucket() string {
-	if val := os.Getenv("S3_BUCKET"); val != "" {
-		return val
-	}
-	return "media-vault"
-}
-
-// getS3UseSSL returns whether to use SSL for S3
-func getS3UseSSL() bool {
-	return os.Getenv("S3_USE_SSL") == "true"
-}
-
 // Database for collections
 var db = sqldb.NewDatabase("collection", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
-// MediaDatabase for querying media
-var mediaDB = sqldb.Named("media")
-
-// getMinioClient creates a MinIO client
-func getMinioClient() (*minio.Client, error) {
-	return minio.New(getS3Endpoint(), &minio.Options{
-		Creds:  credentials.NewStaticV4(secrets.S3AccessKey, secrets.S3SecretKey, ""),
-		Secure: getS3UseSSL(),
-	})
-}
-
 // CreateCollectionRequest contains data for creating a collection
 type CreateCollectionRequest struct {
 	Title       string `json:"title"`
 	Description string `json:"description,omitempty"`
+	// Visibility is private, unlisted or public, by default the owner's
+	// default collection visibility
+	Visibility string `json:"visibility,omitempty"`
+	// IsPublic is the older form of Visibility: true for public, false for
+	// private
+	IsPublic *bool `json:"is_public,omitempty"`
+	// ParentID optionally nests the collection in another one
+	ParentID string `json:"parent_id,omitempty"`
+	// Rules make it a smart collection of the media matching them
+	Rules *SmartRules `json:"rules,omitempty"`
+	// TeamID creates the collection in a team the caller is an editor of;
+	// team collections can't be smart collections
+	TeamID string `json:"team_id,omitempty"`
 }
 
 // CollectionResponse represents a collection
 type CollectionResponse struct {
-	ID          string    `json:"id"`
+	ID string `json:"id"`
+	// ParentID is the collection this one is nested in
+	ParentID    *string   `json:"parent_id,omitempty"`
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
-	IsPublic    bool      `json:"is_public"`
+	Visibility  string    `json:"visibility"`
 	ShareToken  string    `json:"share_token"`
 	CreatedAt   time.Time `json:"created_at"`
+	// Rules are set for smart collections
+	Rules *SmartRules `json:"rules,omitempty"`
+	Tags  []string    `json:"tags"`
+	// TeamID is set for collections of a team
+	TeamID string `json:"team_id,omitempty"`
+	// ItemCount, TotalSizeBytes and TotalDurationSeconds sum up the items;
+	// only set by ListCollections
+	ItemCount            int   `json:"item_count"`
+	TotalSizeBytes       int64 `json:"total_size_bytes"`
+	TotalDurationSeconds int64 `json:"total_duration_seconds"`
+	// Depth (1 at the top level) and Path ("2024 / Weddings / Smith") place
+	// the collection in the tree; only set by ListCollections
+	Depth int    `json:"depth,omitempty"`
+	Path  string `json:"path,omitempty"`
 }
 
 // CreateCollection creates a new collection
@@ -85,68 +80,204 @@ func CreateCollection(ctx context.Context, req *CreateCollectionRequest) (*Colle
 		return nil, errs.B().Code(errs.InvalidArgument).Msg("title is required").Err()
 	}
 
-	var resp CollectionResponse
-	err := db.QueryRow(ctx, `
-		INSERT INTO collections (owner_id, title, description, created_at)
-		VALUES ($1, $2, $3, NOW())
-		RETURNING id, title, COALESCE(description, ''), is_public, share_token, created_at
-	`, userData.UserID, req.Title, req.Description).Scan(
-		&resp.ID, &resp.Title, &resp.Description, &resp.IsPublic, &resp.ShareToken, &resp.CreatedAt)
+	// New collections get the owner's default visibility unless given
+	visibility, err := requestedVisibility(req.Visibility, req.IsPublic)
+	if err != nil {
+		return nil, err
+	}
+	if visibility == "" {
+		visibility = defaultVisibility(ctx, userData.UserID)
+	}
+
+	if req.TeamID != "" {
+		if err := requireTeamRole(ctx, userData.UserID, req.TeamID, team.RoleEditor); err != nil {
+			return nil, err
+		}
+		if req.Rules != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("team collections can't have rules").Err()
+		}
+	}
+	if req.ParentID != "" {
+		if err := checkParent(ctx, userData.UserID, req.TeamID, "", req.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if req.Rules != nil {
+		if err := req.Rules.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := CollectionResponse{TeamID: req.TeamID}
+	var rules []byte
+	err = db.QueryRow(ctx, `
+		INSERT INTO collections (owner_id, title, description, visibility, parent_id, rules, created_at, team_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, $6, NOW(), NULLIF($7, '')::uuid)
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, userData.UserID, req.Title, req.Description, visibility, req.ParentID, encodeRules(req.Rules), req.TeamID).Scan(
+		&resp.ID, &resp.ParentID, &resp.Title, &resp.Description, &resp.Visibility, &resp.ShareToken, &rules, &resp.Tags,
+		&resp.CreatedAt)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to create collection").Err()
 	}
+	resp.Rules = parseRules(rules)
+	recordAudit(ctx, userData.UserID, auditCollectionCreated, "collection", resp.ID, nil,
+		collectionSnapshot(ctx, resp.ID), nil)
 
 	return &resp, nil
 }
 
-// AddMediaRequest contains media to add to a collection
+// maxAddMediaBatch is the most media one AddMedia call may add
+const maxAddMediaBatch = 500
+
+// AddMediaRequest contains media to add to a collection: one MediaID, or a
+// list of MediaIDs to add in one call
 type AddMediaRequest struct {
+	MediaID  string   `json:"media_id,omitempty"`
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// IdempotencyKey makes retries return the first response instead of
+	// adding (and announcing) the items again
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+// AddMediaResult is the outcome for one media item of a batch: "added",
+// "already_added", "not_found" or "not_authorized"
+type AddMediaResult struct {
 	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
 }
 
-// AddMediaResponse confirms the addition
+// AddMediaResponse confirms the addition; Success is false when any item
+// of a batch could not be added
 type AddMediaResponse struct {
-	Success bool `json:"success"`
+	Success bool             `json:"success"`
+	Results []AddMediaResult `json:"results,omitempty"`
 }
 
-// AddMedia adds a media item to a collection
+// AddMedia adds media items to a collection. A single media_id fails with
+// an error; a media_ids batch reports the outcome per item instead.
 //
 //encore:api auth method=POST path=/collection/:id/add
 func AddMedia(ctx context.Context, id string, req *AddMediaRequest) (*AddMediaResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
+	return idempotency.Do(ctx, db, userData.UserID, "collection.AddMedia", req.IdempotencyKey, []any{id, req},
+		func() (*AddMediaResponse, error) {
+			return addMedia(ctx, userData, id, req)
+		})
+}
 
-	// Verify collection ownership
-	var ownerID int64
-	err := db.QueryRow(ctx, `SELECT owner_id FROM collections WHERE id = $1`, id).Scan(&ownerID)
-	if err != nil {
-		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+// addMedia adds media items to a collection userData's user may edit: their
+// own media to a personal collection, the team's media to a team collection
+func addMedia(ctx context.Context, userData *authpkg.UserData, id string, req *AddMediaRequest) (*AddMediaResponse, error) {
+	batch := req.MediaIDs != nil
+	mediaIDs := req.MediaIDs
+	if !batch {
+		if req.MediaID == "" {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("media_id or media_ids is required").Err()
+		}
+		mediaIDs = []string{req.MediaID}
 	}
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if len(mediaIDs) > maxAddMediaBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("at most 500 media can be added at once").Err()
 	}
 
-	// Verify media ownership
-	var mediaOwnerID int64
-	err = mediaDB.QueryRow(ctx, `SELECT owner_id FROM media WHERE id = $1`, req.MediaID).Scan(&mediaOwnerID)
+	// Verify the caller may edit the collection
+	teamID, err := checkCollectionEditor(ctx, id, userData.UserID)
 	if err != nil {
-		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+		return nil, err
 	}
-	if mediaOwnerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized to add this media").Err()
+	if err := checkManualCollection(ctx, id); err != nil {
+		return nil, err
 	}
 
-	// Add media to collection
-	_, err = db.Exec(ctx, `
-		INSERT INTO collection_items (collection_id, media_id, added_at)
-		VALUES ($1, $2, NOW())
-		ON CONFLICT DO NOTHING
-	`, id, req.MediaID)
-	if err != nil {
-		return nil, errs.B().Code(errs.Internal).Msg("failed to add media to collection").Err()
+	// Verify media ownership of the whole batch in one call; malformed IDs
+	// can't exist
+	status := map[string]string{}
+	var valid []string
+	for i, mediaID := range mediaIDs {
+		parsed, err := uuid.Parse(mediaID)
+		if err == nil {
+			mediaIDs[i] = parsed.String()
+		}
+		if _, seen := status[mediaIDs[i]]; seen {
+			continue
+		}
+		status[mediaIDs[i]] = "not_found"
+		if err == nil {
+			valid = append(valid, mediaIDs[i])
+		}
+	}
+
+	var owned []string
+	if len(valid) > 0 {
+		info, err := mediaInfo(ctx, valid)
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to add media to collection").Err()
+		}
+		for _, m := range info {
+			if (teamID == "" && m.OwnerID != userData.UserID) || (teamID != "" && m.TeamID != teamID) {
+				status[m.ID] = "not_authorized"
+				continue
+			}
+			status[m.ID] = "already_added"
+			owned = append(owned, m.ID)
+		}
+	}
+
+	if !batch {
+		switch status[mediaIDs[0]] {
+		case "not_found":
+			return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+		case "not_authorized":
+			return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized to add this media").Err()
+		}
 	}
 
-	return &AddMediaResponse{Success: true}, nil
+	// Add all owned media in one statement; rows already there aren't returned
+	if len(owned) > 0 {
+		rows, err := db.Query(ctx, `
+			INSERT INTO collection_items (collection_id, media_id, added_at)
+			SELECT $1, unnest($2::uuid[]), NOW()
+			ON CONFLICT DO NOTHING
+			RETURNING media_id::text
+		`, id, owned)
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to add media to collection").Err()
+		}
+		var added []string
+		for rows.Next() {
+			var mediaID string
+			if err := rows.Scan(&mediaID); err == nil {
+				status[mediaID] = "added"
+				added = append(added, mediaID)
+			}
+		}
+		rows.Close()
+		notifyItemsAdded(ctx, id, added)
+		if len(added) > 0 {
+			recordAudit(ctx, userData.UserID, auditItemsAdded, "collection", id, nil,
+				map[string][]string{"media_ids": added}, nil)
+		}
+	}
+
+	if !batch {
+		return &AddMediaResponse{Success: true}, nil
+	}
+
+	resp := &AddMediaResponse{Success: true, Results: []AddMediaResult{}}
+	reported := map[string]bool{}
+	for _, mediaID := range mediaIDs {
+		if reported[mediaID] {
+			continue
+		}
+		reported[mediaID] = true
+		if status[mediaID] != "added" && status[mediaID] != "already_added" {
+			resp.Success = false
+		}
+		resp.Results = append(resp.Results, AddMediaResult{MediaID: mediaID, Status: status[mediaID]})
+	}
+	return resp, nil
 }
 
 // RemoveMediaRequest contains media to remove from a collection
@@ -165,38 +296,111 @@ type RemoveMediaResponse struct {
 func RemoveMedia(ctx context.Context, id string, mediaID string) (*RemoveMediaResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
-	// Verify collection ownership
-	var ownerID int64
-	err := db.QueryRow(ctx, `SELECT owner_id FROM collections WHERE id = $1`, id).Scan(&ownerID)
-	if err != nil {
-		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	// Verify the caller may edit the collection
+	if _, err := checkCollectionEditor(ctx, id, userData.UserID); err != nil {
+		return nil, err
 	}
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if err := checkManualCollection(ctx, id); err != nil {
+		return nil, err
 	}
 
 	// Remove media from collection
-	_, err = db.Exec(ctx, `
+	result, err := db.Exec(ctx, `
 		DELETE FROM collection_items WHERE collection_id = $1 AND media_id = $2
 	`, id, mediaID)
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to remove media from collection").Err()
 	}
+	if result.RowsAffected() > 0 {
+		recordAudit(ctx, userData.UserID, auditItemsRemoved, "collection", id,
+			map[string][]string{"media_ids": {mediaID}}, nil, nil)
+		publishUpdate(ctx, id, changeItemsRemoved, []string{mediaID})
+	}
 
 	return &RemoveMediaResponse{Success: true}, nil
 }
 
+// maxItemNoteLength is the longest note an item may carry
+const maxItemNoteLength = 1000
+
+// SetItemNoteRequest contains the note; empty removes it
+type SetItemNoteRequest struct {
+	Note string `json:"note"`
+}
+
+// SetItemNoteResponse returns the note as stored
+type SetItemNoteResponse struct {
+	MediaID string `json:"media_id"`
+	Note    string `json:"note"`
+}
+
+// SetItemNote sets the caption of an item in a collection, shown to
+// everyone who can view the collection
+//
+//encore:api auth method=PUT path=/collection/:id/media/:mediaID/note
+func SetItemNote(ctx context.Context, id string, mediaID string, req *SetItemNoteRequest) (*SetItemNoteResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if _, err := checkCollectionEditor(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	if err := checkManualCollection(ctx, id); err != nil {
+		return nil, err
+	}
+	note := strings.TrimSpace(req.Note)
+	if utf8.RuneCountInString(note) > maxItemNoteLength {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("note must be at most 1000 characters").Err()
+	}
+
+	var before string
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(note, '') FROM collection_items WHERE collection_id = $1 AND media_id::text = $2
+	`, id, mediaID).Scan(&before)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE collection_items SET note = NULLIF($3, '') WHERE collection_id = $1 AND media_id::text = $2
+	`, id, mediaID, note)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to set note").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+	}
+	if note != before {
+		recordAudit(ctx, userData.UserID, auditItemNoteUpdated, "collection", id,
+			map[string]string{"note": before}, map[string]string{"note": note}, map[string]string{"media_id": mediaID})
+		publishUpdate(ctx, id, changeUpdated, []string{mediaID})
+	}
+
+	return &SetItemNoteResponse{MediaID: mediaID, Note: note}, nil
+}
+
 // UpdateShareRequest contains sharing options
 type UpdateShareRequest struct {
-	IsPublic        *bool `json:"is_public,omitempty"`
-	RegenerateToken bool  `json:"regenerate_token,omitempty"`
+	// Visibility is private, unlisted or public; IsPublic is its older form
+	Visibility      string `json:"visibility,omitempty"`
+	IsPublic        *bool  `json:"is_public,omitempty"`
+	RegenerateToken bool   `json:"regenerate_token,omitempty"`
+	// ShareScopes sets what the share token grants: "collection:read" lists
+	// the items, "media:read" adds their stream URLs
+	ShareScopes []string `json:"share_scopes,omitempty"`
+	// ShareExpiresAt makes the share token stop working at this time; once
+	// it has passed the token is replaced
+	ShareExpiresAt *time.Time `json:"share_expires_at,omitempty"`
+	// ClearShareExpiry makes the share token valid until regenerated
+	ClearShareExpiry bool `json:"clear_share_expiry,omitempty"`
 }
 
 // UpdateShareResponse contains the updated share settings
 type UpdateShareResponse struct {
-	IsPublic   bool   `json:"is_public"`
-	ShareToken string `json:"share_token"`
-	ShareURL   string `json:"share_url"`
+	Visibility     string     `json:"visibility"`
+	ShareToken     string     `json:"share_token"`
+	ShareScopes    []string   `json:"share_scopes"`
+	ShareExpiresAt *time.Time `json:"share_expires_at,omitempty"`
+	ShareURL       string     `json:"share_url"`
 }
 
 // UpdateShare updates sharing settings for a collection
@@ -207,44 +411,133 @@ func UpdateShare(ctx context.Context, id string, req *UpdateShareRequest) (*Upda
 
 	// Verify collection ownership
 	var ownerID int64
-	var currentIsPublic bool
+	var currentVisibility string
 	var currentToken string
+	var currentScopes []string
+	var currentExpiry *time.Time
 	err := db.QueryRow(ctx, `
-		SELECT owner_id, is_public, share_token 
-		FROM collections WHERE id = $1
-	`, id).Scan(&ownerID, &currentIsPublic, &currentToken)
+		SELECT owner_id, visibility, share_token, share_scopes, share_token_expires_at
+		FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&ownerID, &currentVisibility, &currentToken, &currentScopes, &currentExpiry)
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
 	}
 	if ownerID != userData.UserID {
 		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
 	}
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
 
 	// Update settings
-	newIsPublic := currentIsPublic
+	newVisibility, err := requestedVisibility(req.Visibility, req.IsPublic)
+	if err != nil {
+		return nil, err
+	}
+	// Choosing a visibility cancels a scheduled publication
+	unschedule := newVisibility != ""
+	if newVisibility == "" {
+		newVisibility = currentVisibility
+	}
 	newToken := currentToken
 
-	if req.IsPublic != nil {
-		newIsPublic = *req.IsPublic
+	newExpiry := currentExpiry
+	// An expired token is never revived by extending its expiry; it is
+	// replaced by a new token without one
+	if currentExpiry != nil && currentExpiry.Before(time.Now()) {
+		newToken = uuid.New().String()
+		newExpiry = nil
 	}
 	if req.RegenerateToken {
 		newToken = uuid.New().String()
 	}
+	if req.ClearShareExpiry {
+		newExpiry = nil
+	}
+	if req.ShareExpiresAt != nil {
+		if !req.ShareExpiresAt.After(time.Now()) {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("share_expires_at must be in the future").Err()
+		}
+		newExpiry = req.ShareExpiresAt
+	}
+	newScopes := currentScopes
+	if req.ShareScopes != nil {
+		if err := validateShareScopes(req.ShareScopes); err != nil {
+			return nil, err
+		}
+		newScopes = req.ShareScopes
+	}
 
+	before := collectionSnapshot(ctx, id)
 	_, err = db.Exec(ctx, `
-		UPDATE collections SET is_public = $2, share_token = $3 WHERE id = $1
-	`, id, newIsPublic, newToken)
+		UPDATE collections
+		SET visibility = $2, share_token = $3, share_scopes = $4, share_token_expires_at = $5,
+			publish_at = CASE WHEN $6 THEN NULL ELSE publish_at END,
+			publish_visibility = CASE WHEN $6 THEN NULL ELSE publish_visibility END,
+			publish_to_discord = publish_to_discord AND NOT $6
+		WHERE id = $1
+	`, id, newVisibility, newToken, newScopes, newExpiry, unschedule)
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to update share settings").Err()
 	}
+	var details map[string]string
+	if newToken != currentToken {
+		details = map[string]string{"token_regenerated": "true"}
+	}
+	recordAudit(ctx, userData.UserID, auditShareUpdated, "collection", id, before, collectionSnapshot(ctx, id), details)
+	publishUpdate(ctx, id, changeUpdated, nil)
 
 	return &UpdateShareResponse{
-		IsPublic:   newIsPublic,
-		ShareToken: newToken,
-		ShareURL:   "/collection/" + id + "?token=" + newToken,
+		Visibility:     newVisibility,
+		ShareToken:     newToken,
+		ShareScopes:    newScopes,
+		ShareExpiresAt: newExpiry,
+		ShareURL:       "/collection/" + id + "?token=" + newToken,
 	}, nil
 }
 
+// Expired share tokens are replaced hourly
+var _ = cron.NewJob("collection-share-expiry", cron.JobConfig{
+	Title:    "Invalidate expired collection share tokens",
+	Every:    1 * cron.Hour,
+	Endpoint: InvalidateExpiredShareTokens,
+})
+
+// InvalidateExpiredShareTokensResponse reports how many tokens were replaced
+type InvalidateExpiredShareTokensResponse struct {
+	Invalidated int `json:"invalidated"`
+}
+
+// InvalidateExpiredShareTokens replaces share tokens past their expiry with
+// new tokens without one, so the old links stop working for good.
+// GetCollection already rejects expired tokens in between runs.
+//
+//encore:api private
+func InvalidateExpiredShareTokens(ctx context.Context) (*InvalidateExpiredShareTokensResponse, error) {
+	result, err := db.Exec(ctx, `
+		UPDATE collections
+		SET share_token = gen_random_uuid(), share_token_expires_at = NULL
+		WHERE share_token_expires_at < NOW()
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	invalidated := int(result.RowsAffected())
+
+	// Extra share tokens can't be revived, so expired ones just go
+	result, err = db.Exec(ctx, `DELETE FROM collection_share_tokens WHERE expires_at < NOW()`)
+	if err != nil {
+		return nil, err
+	}
+	invalidated += int(result.RowsAffected())
+
+	if invalidated > 0 {
+		rlog.Info("expired share tokens invalidated", "count", invalidated)
+	}
+	return &InvalidateExpiredShareTokensResponse{Invalidated: invalidated}, nil
+}
+
 // CollectionMediaItem represents a media item in a collection
 type CollectionMediaItem struct {
 	ID               string    `json:"id"`
@@ -253,43 +546,103 @@ type CollectionMediaItem struct {
 	MimeType         string    `json:"mime_type"`
 	Status           string    `json:"status"`
 	StreamURL        string    `json:"stream_url,omitempty"`
+	Note             string    `json:"note,omitempty"`
 	AddedAt          time.Time `json:"added_at"`
 }
 
-// GetCollectionRequest contains the optional token for access
+// GetCollectionRequest contains the optional token for access and pagination
 type GetCollectionRequest struct {
-	Token string `query:"token"`
+	Token    string `query:"token"`
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+	// LazyStreams leaves out stream URLs; clients fetch them per item with
+	// GetItemStream when they play an item
+	LazyStreams bool `query:"lazy_streams"`
 }
 
-// GetCollectionResponse contains collection details and items
+// GetCollectionResponse contains collection details and one page of items
 type GetCollectionResponse struct {
-	ID          string                `json:"id"`
-	Title       string                `json:"title"`
-	Description string                `json:"description"`
-	IsPublic    bool                  `json:"is_public"`
-	IsOwner     bool                  `json:"is_owner"`
-	ItemCount   int                   `json:"item_count"`
-	Items       []CollectionMediaItem `json:"items"`
-	CreatedAt   time.Time             `json:"created_at"`
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Visibility  string                 `json:"visibility"`
+	IsOwner     bool                   `json:"is_owner"`
+	Owner       *authpkg.PublicProfile `json:"owner,omitempty"`
+	// TeamID is set for collections of a team
+	TeamID string `json:"team_id,omitempty"`
+	// Rules are set for smart collections, whose items are evaluated from
+	// them on every fetch
+	Rules *SmartRules `json:"rules,omitempty"`
+	Tags  []string    `json:"tags"`
+	// ItemCount, TotalSizeBytes and TotalDurationSeconds sum up the whole
+	// collection
+	ItemCount            int                   `json:"item_count"`
+	TotalSizeBytes       int64                 `json:"total_size_bytes"`
+	TotalDurationSeconds int64                 `json:"total_duration_seconds"`
+	Items                []CollectionMediaItem `json:"items"`
+	Page                 int                   `json:"page"`
+	PageSize             int                   `json:"page_size"`
+	CreatedAt            time.Time             `json:"created_at"`
+	// TakenDownAt is set while the collection is taken down by moderation
+	TakenDownAt *time.Time `json:"taken_down_at,omitempty"`
+	// Schedule is set while the collection is scheduled to be published;
+	// only its owner and team see it
+	Schedule *CollectionSchedule `json:"schedule,omitempty"`
 }
 
-// GetCollection fetches collection details with access control
-//
-//encore:api public method=GET path=/collection/:id
-func GetCollection(ctx context.Context, id string, req *GetCollectionRequest) (*GetCollectionResponse, error) {
-	// Get collection
-	var resp GetCollectionResponse
-	var ownerID int64
+// collectionAccess is what a caller may see of a collection
+type collectionAccess struct {
+	OwnerID int64
+	IsOwner bool
+	// IncludeStreams is set when the caller may play the items
+	IncludeStreams bool
+	// Rules are set for smart collections
+	Rules *SmartRules
+	// UserID is the caller, 0 when anonymous
+	UserID int64
+	// Via is how access was granted: "owner", "team", "token", "public",
+	// "unlisted" or "shared"
+	Via string
+	// MediaIDs limits a restricted share token to these items; nil for all
+	MediaIDs []string
+	// StreamOnly keeps a share token holder from downloading the collection
+	// and from original files
+	StreamOnly bool
+	// DownloadToken is the download-limited share token granting access;
+	// its holder gets no stream URLs, only downloads that count against it
+	DownloadToken string
+	// Scheduled is set for the owner and team, who also see items
+	// scheduled to be published later
+	Scheduled bool
+}
+
+// checkCollectionAccess loads a collection into resp and returns what the
+// caller (the owner, members of its team, users it is shared with, anyone
+// for public and unlisted collections, or a share token holder) may see of
+// it
+func checkCollectionAccess(ctx context.Context, id, token string, resp *GetCollectionResponse) (*collectionAccess, error) {
+	var access collectionAccess
 	var shareToken string
+	var shareScopes []string
+	var shareExpiry *time.Time
+	var rules []byte
+	var schedule CollectionSchedule
+	var publishAt *time.Time
 
 	err := db.QueryRow(ctx, `
-		SELECT id, owner_id, title, COALESCE(description, ''), is_public, share_token, created_at
-		FROM collections WHERE id = $1
-	`, id).Scan(&resp.ID, &ownerID, &resp.Title, &resp.Description, &resp.IsPublic, &shareToken, &resp.CreatedAt)
+		SELECT id, owner_id, title, COALESCE(description, ''), visibility, share_token, share_scopes,
+			   share_token_expires_at, rules, tags, created_at, COALESCE(team_id::text, ''), taken_down_at,
+			   publish_at, COALESCE(publish_visibility, ''), publish_to_discord
+		FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&resp.ID, &access.OwnerID, &resp.Title, &resp.Description, &resp.Visibility, &shareToken, &shareScopes,
+		&shareExpiry, &rules, &resp.Tags, &resp.CreatedAt, &resp.TeamID, &resp.TakenDownAt,
+		&publishAt, &schedule.Visibility, &schedule.PostToDiscord)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
 	}
+	access.Rules = parseRules(rules)
+	resp.Rules = access.Rules
 
 	// Check access permissions
 	var userID int64
@@ -297,154 +650,457 @@ func GetCollection(ctx context.Context, id string, req *GetCollectionRequest) (*
 		userID = userData.UserID
 	}
 
-	resp.IsOwner = userID == ownerID
+	access.IsOwner = userID == access.OwnerID
 
 	// Security Rules:
 	// 1. Allow if requester is owner
-	// 2. Allow if collection is public
-	// 3. Allow if token matches share_token
-	// 4. Else: 403 Forbidden
-	hasAccess := resp.IsOwner || resp.IsPublic || (req.Token != "" && req.Token == shareToken)
+	// 2. Allow if the requester is a member of the collection's team
+	// 3. Allow if collection is public or unlisted
+	// 4. Allow if the collection is shared with the requester
+	// 5. Allow if token matches share_token or one of the collection's
+	//    extra share tokens, hasn't expired and grants collection:read
+	// 6. Else: 403 Forbidden
+	// Share token access only includes stream URLs with media:read. A taken
+	// down collection is only open to its owner and team.
+	viaToken := token != "" && token == shareToken && (shareExpiry == nil || shareExpiry.After(time.Now()))
+	var extra *ShareToken
+	if token != "" && !viaToken && !access.IsOwner {
+		if extra = lookupShareToken(ctx, id, token); extra != nil {
+			viaToken = true
+			shareScopes = extra.Scopes
+		}
+	}
+	isOpen := resp.Visibility != VisibilityPrivate
+	inTeam := !access.IsOwner && isTeamMember(ctx, userID, resp.TeamID, team.RoleViewer)
+	if resp.TakenDownAt != nil && !access.IsOwner && !inTeam {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("collection was taken down").Err()
+	}
+	hasAccess := access.IsOwner || inTeam || isOpen || (viaToken && hasScope(shareScopes, authpkg.ScopeCollectionRead))
+	sharedWith := !hasAccess && isSharedWith(ctx, id, userID)
 
-	if !hasAccess {
+	if !hasAccess && !sharedWith {
 		return nil, errs.B().Code(errs.PermissionDenied).Msg("access denied").Err()
 	}
+	access.IncludeStreams = access.IsOwner || inTeam || isOpen || sharedWith ||
+		hasScope(shareScopes, authpkg.ScopeMediaRead)
+
+	access.UserID = userID
+	access.Scheduled = access.IsOwner || inTeam
+	if access.Scheduled && publishAt != nil {
+		schedule.PublishAt = *publishAt
+		resp.Schedule = &schedule
+	}
+	switch {
+	case access.IsOwner:
+		access.Via = "owner"
+	case inTeam:
+		access.Via = "team"
+	case viaToken:
+		access.Via = "token"
+		// Restrictions only matter when the token is all that grants access
+		if extra != nil && !isOpen && !isSharedWith(ctx, id, userID) {
+			access.MediaIDs = extra.MediaIDs
+			access.StreamOnly = extra.StreamOnly
+			if extra.MaxDownloads != nil {
+				access.DownloadToken = extra.Token
+			}
+		}
+	case isOpen:
+		access.Via = resp.Visibility
+	default:
+		access.Via = "shared"
+	}
 
-	// Get collection items
-	rows, err := db.Query(ctx, `
-		SELECT media_id, added_at FROM collection_items 
-		WHERE collection_id = $1 
-		ORDER BY added_at DESC
-	`, id)
+	return &access, nil
+}
+
+// GetCollection fetches collection details and a page of its items, newest
+// first, with access control
+//
+//encore:api public method=GET path=/collection/:id
+func GetCollection(ctx context.Context, id string, req *GetCollectionRequest) (*GetCollectionResponse, error) {
+	var resp GetCollectionResponse
+	access, err := checkCollectionAccess(ctx, id, req.Token, &resp)
 	if err != nil {
-		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+		return nil, err
 	}
-	defer rows.Close()
+	resp.IsOwner = access.IsOwner
 
-	var items []CollectionMediaItem
-	client, _ := getMinioClient()
+	// Set defaults
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+	resp.Page = page
+	resp.PageSize = pageSize
+
+	// A visit starts at the first page; the owner's own views don't count
+	if !access.IsOwner && page == 1 {
+		if _, err := db.Exec(ctx, `UPDATE collections SET view_count = view_count + 1 WHERE id = $1`, id); err != nil {
+			rlog.Warn("failed to count collection view", "error", err, "collection_id", id)
+		}
+		markFollowSeen(ctx, id, access.UserID)
+		recordCollectionView(ctx, id, "view", access, req.Token, nil)
+	}
 
-	for rows.Next() {
-		var mediaID string
-		var addedAt time.Time
-		if err := rows.Scan(&mediaID, &addedAt); err != nil {
-			continue
+	// Viewers see the owner's display name and avatar, not the login identity
+	if owner, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: access.OwnerID}); err == nil {
+		resp.Owner = owner
+	}
+
+	// Get the page of collection items
+	pageItems, total, err := collectionItems(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, pageSize, offset)
+	if err != nil {
+		rlog.Error("failed to get collection items", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	resp.ItemCount = total
+
+	// Restricted share tokens only sum up the items they show, and viewers
+	// don't count items that aren't published yet
+	var stats collectionStats
+	if access.MediaIDs == nil && (access.Scheduled || !hasScheduledItems(ctx, id, access.OwnerID, access.Rules)) {
+		var all map[string]collectionStats
+		all, err = collectionStatsFor(ctx, access.OwnerID, map[string]*SmartRules{id: access.Rules})
+		stats = all[id]
+	} else {
+		var shown []collectionItem
+		if shown, _, err = collectionItems(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, 0, 0); err == nil {
+			stats, err = mediaStats(ctx, shown)
 		}
+	}
+	if err != nil {
+		rlog.Error("failed to sum up collection", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	resp.TotalSizeBytes = stats.TotalSizeBytes
+	resp.TotalDurationSeconds = stats.TotalDurationSeconds
+
+	var mediaIDs []string
+	byMediaID := map[string]collectionItem{}
+	for _, item := range pageItems {
+		mediaIDs = append(mediaIDs, item.MediaID)
+		byMediaID[item.MediaID] = item
+	}
+
+	resp.Items = []CollectionMediaItem{}
+	if len(mediaIDs) == 0 {
+		return &resp, nil
+	}
 
-		// Get media details
-		var item CollectionMediaItem
-		var s3KeyOriginal, s3KeyProcessed string
-		err = mediaDB.QueryRow(ctx, `
-			SELECT id, COALESCE(title, ''), COALESCE(original_filename, ''), 
-				   COALESCE(mime_type, ''), status,
-				   s3_key_original, COALESCE(s3_key_processed, '')
-			FROM media WHERE id = $1
-		`, mediaID).Scan(&item.ID, &item.Title, &item.OriginalFilename,
-			&item.MimeType, &item.Status, &s3KeyOriginal, &s3KeyProcessed)
+	// Get media details and stream URLs of the whole page at once
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	var streams map[string]media.ResolvedStream
+	if access.IncludeStreams && access.DownloadToken == "" && !req.LazyStreams {
+		// Stream URLs follow the owner's settings, whoever views the collection
+		streams, _ = resolveStreams(ctx, mediaIDs, media.ResolveStreamURLRequest{
+			StreamOnly: access.StreamOnly,
+			Viewer:     callerKey(access.UserID),
+		})
+	}
 
-		if err != nil {
+	// Items whose media is gone are left out until the media-deleted event
+	// removes them
+	for _, mediaID := range mediaIDs {
+		m, ok := info[mediaID]
+		if !ok {
 			continue
 		}
+		resp.Items = append(resp.Items, CollectionMediaItem{
+			ID:               m.ID,
+			Title:            m.Title,
+			OriginalFilename: m.OriginalFilename,
+			MimeType:         m.MimeType,
+			Status:           m.Status,
+			StreamURL:        streams[mediaID].StreamURL,
+			AddedAt:          byMediaID[mediaID].AddedAt,
+			Note:             byMediaID[mediaID].Note,
+		})
+	}
 
-		item.AddedAt = addedAt
+	return &resp, nil
+}
 
-		// Generate stream URL if ready
-		if item.Status == "ready" && client != nil {
-			s3Key := s3KeyProcessed
-			if s3Key == "" {
-				s3Key = s3KeyOriginal
-			}
-			streamURL, err := client.PresignedGetObject(ctx, getS3Bucket(), s3Key, 4*time.Hour, nil)
-			if err == nil {
-				item.StreamURL = streamURL.String()
-			}
-		}
+// GetItemStreamRequest contains the optional token for access
+type GetItemStreamRequest struct {
+	Token string `query:"token"`
+}
+
+// GetItemStreamResponse contains a presigned stream URL
+type GetItemStreamResponse struct {
+	StreamURL string    `json:"stream_url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetItemStream returns the stream URL of one collection item, with the same
+// access rules as GetCollection
+//
+//encore:api public method=GET path=/collection/:id/media/:mediaID/stream
+func GetItemStream(ctx context.Context, id string, mediaID string, req *GetItemStreamRequest) (*GetItemStreamResponse, error) {
+	var collection GetCollectionResponse
+	access, err := checkCollectionAccess(ctx, id, req.Token, &collection)
+	if err != nil {
+		return nil, err
+	}
+	if !access.IncludeStreams {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token does not grant media:read").Err()
+	}
+	if access.DownloadToken != "" {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token only allows downloads").Err()
+	}
 
-		items = append(items, item)
+	if !hasCollectionItem(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, mediaID) {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
 	}
 
-	if items == nil {
-		items = []CollectionMediaItem{}
+	if parsed, err := uuid.Parse(mediaID); err == nil {
+		mediaID = parsed.String()
+	}
+	info, err := mediaInfo(ctx, []string{mediaID})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get media").Err()
+	}
+	m, ok := info[mediaID]
+	if !ok {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if m.Status != "ready" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is not ready").Err()
 	}
 
-	resp.Items = items
-	resp.ItemCount = len(items)
+	streams, err := resolveStreams(ctx, []string{mediaID}, media.ResolveStreamURLRequest{
+		StreamOnly: access.StreamOnly,
+		Viewer:     callerKey(access.UserID),
+	})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to generate stream URL").Err()
+	}
+	stream, ok := streams[mediaID]
+	if !ok {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token does not grant original files").Err()
+	}
 
-	return &resp, nil
+	return &GetItemStreamResponse{
+		StreamURL: stream.StreamURL,
+		ExpiresAt: stream.ExpiresAt,
+	}, nil
 }
 
 // ListCollectionsResponse contains the user's collections
 type ListCollectionsResponse struct {
 	Collections []CollectionResponse `json:"collections"`
+	// SharedWithMe are other users' collections shared with the caller
+	SharedWithMe []SharedCollection `json:"shared_with_me"`
 }
 
-// ListCollections returns all collections for the authenticated user
+// ListCollectionsRequest optionally filters the caller's collections
+type ListCollectionsRequest struct {
+	// Tags keeps collections with any of these tags
+	Tags []string `query:"tags"`
+	// Query keeps collections whose title contains it, ignoring case
+	Query string `query:"q"`
+	// TeamID lists a team's collections instead of the caller's own
+	TeamID string `query:"team_id"`
+}
+
+// ListCollections returns all collections for the authenticated user in
+// tree order: every collection is followed by its sub-collections, and
+// siblings are newest first. Filtered lists keep the tree order and paths
+// of the collections that match. Collections other users shared with the
+// caller are listed separately. With team_id, the team's collections are
+// listed instead of the caller's personal ones.
 //
 //encore:api auth method=GET path=/collection
-func ListCollections(ctx context.Context) (*ListCollectionsResponse, error) {
+func ListCollections(ctx context.Context, req *ListCollectionsRequest) (*ListCollectionsResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
+	scope, scopeArg := "owner_id = $1 AND team_id IS NULL", any(userData.UserID)
+	if req.TeamID != "" {
+		if err := requireTeamRole(ctx, userData.UserID, req.TeamID, team.RoleViewer); err != nil {
+			return nil, err
+		}
+		scope, scopeArg = "team_id = $1", req.TeamID
+	}
+
 	rows, err := db.Query(ctx, `
-		SELECT id, title, COALESCE(description, ''), is_public, share_token, created_at
-		FROM collections 
-		WHERE owner_id = $1
+		SELECT id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at,
+			   COALESCE(team_id::text, '')
+		FROM collections
+		WHERE `+scope+` AND deleted_at IS NULL
 		ORDER BY created_at DESC
-	`, userData.UserID)
+	`, scopeArg)
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to list collections").Err()
 	}
 	defer rows.Close()
 
-	var collections []CollectionResponse
+	var all []CollectionResponse
 	for rows.Next() {
 		var c CollectionResponse
-		if err := rows.Scan(&c.ID, &c.Title, &c.Description, &c.IsPublic, &c.ShareToken, &c.CreatedAt); err != nil {
+		var rules []byte
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Title, &c.Description, &c.Visibility, &c.ShareToken, &rules, &c.Tags,
+			&c.CreatedAt, &c.TeamID); err != nil {
 			continue
 		}
-		collections = append(collections, c)
+		c.Rules = parseRules(rules)
+		all = append(all, c)
+	}
+
+	// Filter after building the tree, so paths still name every parent
+	all = filterCollections(collectionTree(all), req.Tags, req.Query)
+
+	rulesByID := map[string]*SmartRules{}
+	for _, c := range all {
+		rulesByID[c.ID] = c.Rules
+	}
+	stats, err := collectionStatsFor(ctx, userData.UserID, rulesByID)
+	if err != nil {
+		rlog.Error("failed to sum up collections", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list collections").Err()
+	}
+	for i := range all {
+		all[i].ItemCount = stats[all[i].ID].ItemCount
+		all[i].TotalSizeBytes = stats[all[i].ID].TotalSizeBytes
+		all[i].TotalDurationSeconds = stats[all[i].ID].TotalDurationSeconds
+	}
+
+	shared, err := sharedWithUser(ctx, userData.UserID)
+	if err != nil {
+		rlog.Error("failed to list shared collections", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list collections").Err()
+	}
+
+	return &ListCollectionsResponse{
+		Collections:  all,
+		SharedWithMe: shared,
+	}, nil
+}
+
+// filterCollections keeps the collections with any of the tags whose title
+// contains query, ignoring case; no tags or an empty query keep all
+func filterCollections(collections []CollectionResponse, tags []string, query string) []CollectionResponse {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if len(tags) == 0 && query == "" {
+		return collections
 	}
 
-	if collections == nil {
-		collections = []CollectionResponse{}
+	filtered := []CollectionResponse{}
+	for _, c := range collections {
+		if query != "" && !strings.Contains(strings.ToLower(c.Title), query) {
+			continue
+		}
+		if len(tags) > 0 && !hasAnyTag(c.Tags, tags) {
+			continue
+		}
+		filtered = append(filtered, c)
 	}
+	return filtered
+}
 
-	return &ListCollectionsResponse{Collections: collections}, nil
+// hasAnyTag reports whether tags contains any of wanted
+func hasAnyTag(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// collectionTree orders collections depth-first, keeping the order of
+// siblings, and sets their depth and path
+func collectionTree(all []CollectionResponse) []CollectionResponse {
+	known := map[string]bool{}
+	for _, c := range all {
+		known[c.ID] = true
+	}
+	children := map[string][]CollectionResponse{}
+	for _, c := range all {
+		parent := ""
+		if c.ParentID != nil && known[*c.ParentID] {
+			parent = *c.ParentID
+		}
+		children[parent] = append(children[parent], c)
+	}
+
+	tree := []CollectionResponse{}
+	var walk func(parent, path string, depth int)
+	walk = func(parent, path string, depth int) {
+		for _, c := range children[parent] {
+			c.Depth = depth
+			c.Path = c.Title
+			if path != "" {
+				c.Path = path + " / " + c.Title
+			}
+			tree = append(tree, c)
+			walk(c.ID, c.Path, depth+1)
+		}
+	}
+	walk("", "", 1)
+	return tree
 }
 
 // DeleteCollectionResponse confirms deletion
 type DeleteCollectionResponse struct {
 	Success bool `json:"success"`
+	// PurgeAt is when the collection leaves the trash for good
+	PurgeAt time.Time `json:"purge_at"`
 }
 
-// DeleteCollection deletes a collection
+// DeleteCollection moves a collection to the trash, where it can be
+// restored until the collection-trash-purge job removes it
 //
 //encore:api auth method=DELETE path=/collection/:id
 func DeleteCollection(ctx context.Context, id string) (*DeleteCollectionResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
-	// Verify ownership
-	var ownerID int64
-	err := db.QueryRow(ctx, `SELECT owner_id FROM collections WHERE id = $1`, id).Scan(&ownerID)
-	if err != nil {
-		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	// Verify the caller may edit the collection
+	if _, err := checkCollectionEditor(ctx, id, userData.UserID); err != nil {
+		return nil, err
 	}
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+
+	before := collectionSnapshot(ctx, id)
+
+	// Sub-collections move up to the deleted collection's parent
+	_, err := db.Exec(ctx, `
+		UPDATE collections SET parent_id = (SELECT parent_id FROM collections WHERE id = $1)
+		WHERE parent_id = $1
+	`, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete collection").Err()
 	}
 
-	// Delete collection (cascade will remove collection_items)
-	_, err = db.Exec(ctx, `DELETE FROM collections WHERE id = $1`, id)
+	// Items, shares and tokens stay until the purge, so a restore brings
+	// everything back
+	var deletedAt time.Time
+	err = db.QueryRow(ctx, `
+		UPDATE collections SET deleted_at = NOW() WHERE id = $1 RETURNING deleted_at
+	`, id).Scan(&deletedAt)
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to delete collection").Err()
 	}
+	recordAudit(ctx, userData.UserID, auditCollectionDeleted, "collection", id, before, nil, nil)
+	publishUpdate(ctx, id, changeDeleted, nil)
 
-	return &DeleteCollectionResponse{Success: true}, nil
+	return &DeleteCollectionResponse{Success: true, PurgeAt: deletedAt.Add(getTrashRetention())}, nil
 }
 
 // UpdateCollectionRequest contains data to update a collection
 type UpdateCollectionRequest struct {
 	Title       *string `json:"title,omitempty"`
 	Description *string `json:"description,omitempty"`
+	// Rules replace the rules of a smart collection
+	Rules *SmartRules `json:"rules,omitempty"`
 }
 
 // UpdateCollection updates collection details
@@ -453,30 +1109,86 @@ type UpdateCollectionRequest struct {
 func UpdateCollection(ctx context.Context, id string, req *UpdateCollectionRequest) (*CollectionResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
-	// Verify ownership
-	var ownerID int64
-	err := db.QueryRow(ctx, `SELECT owner_id FROM collections WHERE id = $1`, id).Scan(&ownerID)
+	// Verify the caller may edit the collection
+	teamID, err := checkCollectionEditor(ctx, id, userData.UserID)
 	if err != nil {
-		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+		return nil, err
 	}
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if req.Rules != nil {
+		if err := req.Rules.validate(); err != nil {
+			return nil, err
+		}
+		if err := checkManualCollection(ctx, id); err == nil {
+			return nil, errs.B().Code(errs.FailedPrecondition).Msg("manual collections can't get rules").Err()
+		}
 	}
 
+	before := collectionSnapshot(ctx, id)
+
 	// Update collection
-	var resp CollectionResponse
+	resp := CollectionResponse{TeamID: teamID}
+	var rules []byte
 	err = db.QueryRow(ctx, `
 		UPDATE collections 
 		SET title = COALESCE($2, title),
-			description = COALESCE($3, description)
+			description = COALESCE($3, description),
+			rules = COALESCE($4, rules)
 		WHERE id = $1
-		RETURNING id, title, COALESCE(description, ''), is_public, share_token, created_at
-	`, id, req.Title, req.Description).Scan(
-		&resp.ID, &resp.Title, &resp.Description, &resp.IsPublic, &resp.ShareToken, &resp.CreatedAt)
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, id, req.Title, req.Description, encodeRules(req.Rules)).Scan(
+		&resp.ID, &resp.ParentID, &resp.Title, &resp.Description, &resp.Visibility, &resp.ShareToken, &rules, &resp.Tags,
+		&resp.CreatedAt)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.Internal).Msg("failed to update collection").Err()
 	}
+	resp.Rules = parseRules(rules)
+	recordAudit(ctx, userData.UserID, auditCollectionUpdated, "collection", id, before, collectionSnapshot(ctx, id), nil)
+	publishUpdate(ctx, id, changeUpdated, nil)
 
 	return &resp, nil
 }
+
+// Collection visibility levels
+const (
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted opens the collection to anyone with its ID without
+	// listing it anywhere
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+// requestedVisibility returns the visibility a request asks for, from
+// visibility or else the older is_public, or "" when it asks for none
+func requestedVisibility(visibility string, isPublic *bool) (string, error) {
+	switch {
+	case visibility == VisibilityPrivate || visibility == VisibilityUnlisted || visibility == VisibilityPublic:
+		return visibility, nil
+	case visibility != "":
+		return "", errs.B().Code(errs.InvalidArgument).Msg("visibility must be private, unlisted or public").Err()
+	case isPublic == nil:
+		return "", nil
+	case *isPublic:
+		return VisibilityPublic, nil
+	default:
+		return VisibilityPrivate, nil
+	}
+}
+
+// defaultVisibility returns the visibility of the user's new collections
+func defaultVisibility(ctx context.Context, userID int64) string {
+	if authpkg.SettingsOrDefault(ctx, userID).DefaultCollectionPublic {
+		return VisibilityPublic
+	}
+	return VisibilityPrivate
+}
+
+// hasScope reports whether scopes contains scope
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
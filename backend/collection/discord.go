@@ -0,0 +1,353 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+	"encore.app/discordwebhook"
+	"encore.app/media"
+)
+
+// discordEmbedColor is the accent color of posted embeds
+const discordEmbedColor = 0x5865F2
+
+// discordCoverCandidates is how many items are looked at for a collection's
+// cover image
+const discordCoverCandidates = 20
+
+// PostToDiscordRequest is an optional message and the share token the
+// posted link carries
+type PostToDiscordRequest struct {
+	// Message is posted above the embed, at most 2000 characters
+	Message string `json:"message,omitempty"`
+	// Token is the share token of the link: the collection's share token
+	// or one of its extra ones. By default private collections use their
+	// share token and others need none.
+	Token string `json:"token,omitempty"`
+}
+
+// PostMediaToDiscordRequest posts a collection item
+type PostMediaToDiscordRequest struct {
+	// CollectionID is the collection the item is shared through
+	CollectionID string `json:"collection_id"`
+	Message      string `json:"message,omitempty"`
+	Token        string `json:"token,omitempty"`
+}
+
+// PostToDiscordResponse contains the link that was posted
+type PostToDiscordResponse struct {
+	ShareURL string `json:"share_url"`
+}
+
+// PostCollectionToDiscord posts an embed of one of the caller's
+// collections, with its cover thumbnail and share link, to the Discord
+// webhook in the caller's settings
+//
+//encore:api auth method=POST path=/collection/:id/post-to-discord
+func PostCollectionToDiscord(ctx context.Context, id string, req *PostToDiscordRequest) (*PostToDiscordResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	webhookURL, err := discordPostTarget(ctx, userData.UserID, id, req.Message)
+	if err != nil {
+		return nil, err
+	}
+	token, only, err := discordShareToken(ctx, id, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, shareURL, err := collectionDiscordMessage(ctx, id, token, only, req.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := postToDiscord(ctx, webhookURL, msg, id); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, userData.UserID, auditPostedToDiscord, "collection", id, nil, nil, discordPostDetails(token, ""))
+	return &PostToDiscordResponse{ShareURL: shareURL}, nil
+}
+
+// PostMediaToDiscord posts an embed of a collection item, with its
+// thumbnail and a link to it in the collection, to the Discord webhook in
+// the caller's settings
+//
+//encore:api auth method=POST path=/media/:id/post-to-discord
+func PostMediaToDiscord(ctx context.Context, id string, req *PostMediaToDiscordRequest) (*PostToDiscordResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if req.CollectionID == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("collection_id is required").Err()
+	}
+	webhookURL, err := discordPostTarget(ctx, userData.UserID, req.CollectionID, req.Message)
+	if err != nil {
+		return nil, err
+	}
+	token, only, err := discordShareToken(ctx, req.CollectionID, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	var title string
+	var ownerID int64
+	var rules []byte
+	err = db.QueryRow(ctx, `
+		SELECT title, owner_id, rules FROM collections WHERE id = $1
+	`, req.CollectionID).Scan(&title, &ownerID, &rules)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil || !hasCollectionItem(ctx, req.CollectionID, ownerID, parseRules(rules), only, false, parsed.String()) {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+	}
+	mediaID := parsed.String()
+
+	info, err := mediaInfo(ctx, []string{mediaID})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get media").Err()
+	}
+	m, ok := info[mediaID]
+	if !ok {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+
+	shareURL := embedTarget{Token: token}.withToken(getFrontendURL() + "/collection/" + req.CollectionID +
+		"/media/" + mediaID)
+	name := m.Title
+	if name == "" {
+		name = m.OriginalFilename
+	}
+	msg := discordwebhook.Message{
+		Content: req.Message,
+		Embed: discordwebhook.Embed{
+			Title:       name,
+			Description: discordMediaSummary(m),
+			URL:         shareURL,
+			Color:       discordEmbedColor,
+			Footer:      &discordwebhook.EmbedFooter{Text: title},
+		},
+	}
+	if m.Status == "ready" {
+		msg.Image, msg.ImageName = discordThumbnail(ctx, []string{mediaID})
+	}
+
+	if err := postToDiscord(ctx, webhookURL, msg, req.CollectionID); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, userData.UserID, auditPostedToDiscord, "collection", req.CollectionID, nil, nil,
+		discordPostDetails(token, mediaID))
+	return &PostToDiscordResponse{ShareURL: shareURL}, nil
+}
+
+// collectionDiscordMessage builds the post of a collection: an embed with
+// its description, item count and cover thumbnail, linking to it with token
+func collectionDiscordMessage(ctx context.Context, id, token string, only []string, content string) (discordwebhook.Message, string, error) {
+	var c struct {
+		title, description string
+		ownerID            int64
+		rules              []byte
+	}
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(description, ''), owner_id, rules FROM collections WHERE id = $1
+	`, id).Scan(&c.title, &c.description, &c.ownerID, &c.rules)
+	if err != nil {
+		return discordwebhook.Message{}, "", errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	items, total, err := collectionItems(ctx, id, c.ownerID, parseRules(c.rules), only, false, discordCoverCandidates, 0)
+	if err != nil {
+		return discordwebhook.Message{}, "", errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	var mediaIDs []string
+	for _, item := range items {
+		mediaIDs = append(mediaIDs, item.MediaID)
+	}
+
+	shareURL := embedTarget{Token: token}.withToken(getFrontendURL() + "/collection/" + id)
+	description := c.description
+	if description != "" {
+		description += "\n\n"
+	}
+	if total == 1 {
+		description += "1 item"
+	} else {
+		description += fmt.Sprintf("%d items", total)
+	}
+	msg := discordwebhook.Message{
+		Content: content,
+		Embed: discordwebhook.Embed{
+			Title:       c.title,
+			Description: description,
+			URL:         shareURL,
+			Color:       discordEmbedColor,
+		},
+	}
+	msg.Image, msg.ImageName = discordThumbnail(ctx, mediaIDs)
+
+	return msg, shareURL, nil
+}
+
+// discordPostTarget checks that the user may post the collection and
+// returns their webhook
+func discordPostTarget(ctx context.Context, userID int64, collectionID, message string) (string, error) {
+	if utf8.RuneCountInString(message) > 2000 {
+		return "", errs.B().Code(errs.InvalidArgument).Msg("message must be at most 2000 characters").Err()
+	}
+	if err := checkCollectionOwner(ctx, collectionID, userID); err != nil {
+		return "", err
+	}
+	if err := checkNotTakenDown(ctx, collectionID); err != nil {
+		return "", err
+	}
+	settings, err := authpkg.GetUserSettings(ctx, &authpkg.UserSettingsRequest{UserID: userID})
+	if err != nil {
+		return "", errs.B().Code(errs.Internal).Msg("failed to load settings").Err()
+	}
+	if settings.DiscordWebhookURL == "" {
+		return "", errs.B().Code(errs.FailedPrecondition).
+			Msg("set discord_webhook_url in /auth/settings first").Err()
+	}
+	return settings.DiscordWebhookURL, nil
+}
+
+// discordShareToken picks the share token the posted link carries, checking
+// that it opens the collection, and returns the items it is limited to
+func discordShareToken(ctx context.Context, collectionID, token string) (string, []string, error) {
+	var visibility, shareToken string
+	var shareScopes []string
+	var shareExpiry *time.Time
+	err := db.QueryRow(ctx, `
+		SELECT visibility, share_token, share_scopes, share_token_expires_at FROM collections WHERE id = $1
+	`, collectionID).Scan(&visibility, &shareToken, &shareScopes, &shareExpiry)
+	if err != nil {
+		return "", nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+
+	if token == "" {
+		if visibility != VisibilityPrivate {
+			return "", nil, nil
+		}
+		token = shareToken
+	}
+	if token == shareToken {
+		if shareExpiry != nil && !shareExpiry.After(time.Now()) {
+			return "", nil, errs.B().Code(errs.FailedPrecondition).Msg("share token has expired").Err()
+		}
+		if !hasScope(shareScopes, authpkg.ScopeCollectionRead) {
+			return "", nil, errs.B().Code(errs.FailedPrecondition).
+				Msg("share token does not grant collection:read").Err()
+		}
+		return token, nil, nil
+	}
+
+	extra := lookupShareToken(ctx, collectionID, token)
+	if extra == nil {
+		return "", nil, errs.B().Code(errs.NotFound).Msg("share token not found").Err()
+	}
+	if !hasScope(extra.Scopes, authpkg.ScopeCollectionRead) {
+		return "", nil, errs.B().Code(errs.FailedPrecondition).Msg("share token does not grant collection:read").Err()
+	}
+	// Restrictions only matter when the token is all that grants access
+	if visibility != VisibilityPrivate {
+		return token, nil, nil
+	}
+	return token, extra.MediaIDs, nil
+}
+
+// discordThumbnail downloads the thumbnail of the first of the media that
+// has one, so it can be attached to the post; nothing when none does
+func discordThumbnail(ctx context.Context, mediaIDs []string) ([]byte, string) {
+	if len(mediaIDs) == 0 {
+		return nil, ""
+	}
+	// Only the thumbnail is used, so the streams don't count as egress
+	streams, err := resolveStreams(ctx, mediaIDs, media.ResolveStreamURLRequest{Thumbnails: true, Proxied: true})
+	if err != nil {
+		return nil, ""
+	}
+	for _, mediaID := range mediaIDs {
+		thumbnailURL := streams[mediaID].ThumbnailURL
+		if thumbnailURL == "" {
+			continue
+		}
+		object, err := openStream(ctx, thumbnailURL)
+		if err != nil {
+			rlog.Warn("failed to read thumbnail", "error", err, "media_id", mediaID)
+			return nil, ""
+		}
+		image, err := io.ReadAll(io.LimitReader(object, discordwebhook.MaxImageBytes+1))
+		object.Close()
+		if err != nil || len(image) > discordwebhook.MaxImageBytes {
+			return nil, ""
+		}
+		ext := ".jpg"
+		if u, err := url.Parse(thumbnailURL); err == nil && path.Ext(u.Path) != "" {
+			ext = path.Ext(u.Path)
+		}
+		return image, "thumbnail" + ext
+	}
+	return nil, ""
+}
+
+// discordMediaSummary describes a media item in a line, e.g. "Video · 3:07"
+func discordMediaSummary(m media.MediaInfo) string {
+	kind, _, _ := strings.Cut(m.MimeType, "/")
+	var parts []string
+	switch kind {
+	case "video", "audio", "image":
+		parts = append(parts, strings.ToUpper(kind[:1])+kind[1:])
+	}
+	if m.DurationSeconds > 0 {
+		d := m.DurationSeconds
+		if d >= 3600 {
+			parts = append(parts, fmt.Sprintf("%d:%02d:%02d", d/3600, d/60%60, d%60))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%02d", d/60, d%60))
+		}
+	}
+	if m.Width > 0 && m.Height > 0 {
+		parts = append(parts, fmt.Sprintf("%d×%d", m.Width, m.Height))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// postToDiscord posts msg, telling a webhook that is gone apart from Discord
+// being unreachable
+func postToDiscord(ctx context.Context, webhookURL string, msg discordwebhook.Message, collectionID string) error {
+	err := discordwebhook.Post(ctx, webhookURL, msg)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, discordwebhook.ErrGone):
+		return errs.B().Code(errs.FailedPrecondition).
+			Msg("the Discord webhook no longer exists; update discord_webhook_url in /auth/settings").Err()
+	default:
+		rlog.Warn("failed to post to Discord", "error", err, "collection_id", collectionID)
+		return errs.B().Code(errs.Unavailable).Msg("failed to post to Discord").Err()
+	}
+}
+
+// discordPostDetails identifies what was posted in the audit log
+func discordPostDetails(token, mediaID string) map[string]string {
+	details := map[string]string{}
+	if token != "" {
+		details = shareTokenDetails(token)
+	}
+	if mediaID != "" {
+		details["media_id"] = mediaID
+	}
+	return details
+}
@@ -0,0 +1,320 @@
+package collection
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	"encore.app/media"
+)
+
+// downloadItem is a collection item that goes into the ZIP
+type downloadItem struct {
+	mediaID, title, filename, streamURL string
+}
+
+// DownloadCollection streams a ZIP of the collection's ready items, with the
+// same access rules as GetCollection. Items are named after their titles;
+// the processed file is used unless it is a DASH manifest. The archive
+// counts as one download of a download-limited share token.
+//
+//encore:api public raw method=GET path=/collection/:id/download
+func DownloadCollection(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/collection/"), "/download")
+
+	var collection GetCollectionResponse
+	access, ok := downloadAccess(w, req, id, &collection)
+	if !ok {
+		return
+	}
+
+	all, _, err := collectionItems(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, 0, 0)
+	if err != nil {
+		http.Error(w, "failed to get collection items", http.StatusInternalServerError)
+		return
+	}
+	var mediaIDs []string
+	for _, item := range all {
+		mediaIDs = append(mediaIDs, item.MediaID)
+	}
+
+	var items []downloadItem
+	if len(mediaIDs) > 0 {
+		info, err := mediaInfo(ctx, mediaIDs)
+		if err != nil {
+			http.Error(w, "failed to get collection items", http.StatusInternalServerError)
+			return
+		}
+
+		// Keep the collection's order, newest first
+		for _, mediaID := range mediaIDs {
+			if m, ok := info[mediaID]; ok && m.Status == "ready" {
+				items = append(items, downloadItem{mediaID: mediaID, title: m.Title, filename: m.OriginalFilename})
+			}
+		}
+	}
+	if len(items) == 0 {
+		http.Error(w, "collection has no ready items", http.StatusNotFound)
+		return
+	}
+
+	if !countDownload(ctx, w, id, access) {
+		return
+	}
+	if !access.IsOwner {
+		recordCollectionView(ctx, id, "download", access, req.URL.Query().Get("token"), req.Header)
+	}
+
+	archiveName := safeFilename(collection.Title, "collection") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
+		asciiFilename(archiveName), url.PathEscape(archiveName)))
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	// Once the first byte is written errors can only cut the archive short
+	viewer := callerKey(access.UserID)
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+	for _, item := range items {
+		// URLs are resolved one at a time so they can't expire while
+		// earlier items are still downloading
+		streams, err := resolveStreams(ctx, []string{item.mediaID}, media.ResolveStreamURLRequest{Progressive: true, Proxied: true})
+		if err != nil || streams[item.mediaID].StreamURL == "" {
+			rlog.Error("failed to resolve collection item", "error", err, "collection_id", id, "media_id", item.mediaID)
+			return
+		}
+		item.streamURL = streams[item.mediaID].StreamURL
+		name := uniqueFilename(downloadFilename(item), used)
+
+		object, err := openStream(ctx, item.streamURL)
+		if err != nil {
+			rlog.Error("failed to read collection item", "error", err, "collection_id", id, "media_id", item.mediaID)
+			return
+		}
+		// Media files are already compressed, so they are stored as-is
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		var n int64
+		if err == nil {
+			n, err = io.Copy(entry, object)
+		}
+		object.Close()
+		recordEgress(ctx, item.mediaID, n, viewer)
+		if err != nil {
+			rlog.Error("failed to download collection item", "error", err, "collection_id", id, "media_id", item.mediaID)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		rlog.Error("failed to finish collection archive", "error", err, "collection_id", id)
+	}
+}
+
+// DownloadItem streams one ready item of the collection through the
+// backend, with the same access rules as DownloadCollection. Holders of a
+// download-limited share token get files this way, each counting as one
+// download of the token.
+//
+//encore:api public raw method=GET path=/collection/:id/media/:mediaID/download
+func DownloadItem(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/collection/"), "/media/")
+	mediaID := strings.TrimSuffix(rest, "/download")
+
+	var collection GetCollectionResponse
+	access, ok := downloadAccess(w, req, id, &collection)
+	if !ok {
+		return
+	}
+	if !hasCollectionItem(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, mediaID) {
+		http.Error(w, "media not found in collection", http.StatusNotFound)
+		return
+	}
+	if parsed, err := uuid.Parse(mediaID); err == nil {
+		mediaID = parsed.String()
+	}
+
+	info, err := mediaInfo(ctx, []string{mediaID})
+	if err != nil {
+		http.Error(w, "failed to get media", http.StatusInternalServerError)
+		return
+	}
+	m, ok := info[mediaID]
+	if !ok || m.Status != "ready" {
+		http.Error(w, "media is not ready", http.StatusNotFound)
+		return
+	}
+	streams, err := resolveStreams(ctx, []string{mediaID}, media.ResolveStreamURLRequest{Progressive: true, Proxied: true})
+	if err != nil || streams[mediaID].StreamURL == "" {
+		http.Error(w, "media is not available", http.StatusNotFound)
+		return
+	}
+	item := downloadItem{mediaID: mediaID, title: m.Title, filename: m.OriginalFilename, streamURL: streams[mediaID].StreamURL}
+
+	// The download only counts once the file could be opened
+	object, err := openStream(ctx, item.streamURL)
+	if err != nil {
+		rlog.Error("failed to read collection item", "error", err, "collection_id", id, "media_id", mediaID)
+		http.Error(w, "failed to read media", http.StatusBadGateway)
+		return
+	}
+	defer object.Close()
+	if !countDownload(ctx, w, id, access) {
+		return
+	}
+	if !access.IsOwner {
+		recordCollectionView(ctx, id, "download", access, req.URL.Query().Get("token"), req.Header)
+	}
+
+	name := downloadFilename(item)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
+		asciiFilename(name), url.PathEscape(name)))
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	n, err := io.Copy(w, object)
+	recordEgress(ctx, mediaID, n, callerKey(access.UserID))
+	if err != nil {
+		rlog.Error("failed to download collection item", "error", err, "collection_id", id, "media_id", mediaID)
+	}
+}
+
+// downloadAccess checks that the caller may download from the collection,
+// writing the error when they may not
+func downloadAccess(w http.ResponseWriter, req *http.Request, id string, collection *GetCollectionResponse) (*collectionAccess, bool) {
+	access, err := checkCollectionAccess(req.Context(), id, req.URL.Query().Get("token"), collection)
+	if err != nil {
+		if errs.Code(err) == errs.NotFound {
+			http.Error(w, "collection not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "access denied", http.StatusForbidden)
+		}
+		return nil, false
+	}
+	if !access.IncludeStreams {
+		http.Error(w, "share token does not grant media:read", http.StatusForbidden)
+		return nil, false
+	}
+	if access.StreamOnly {
+		http.Error(w, "share token does not allow downloads", http.StatusForbidden)
+		return nil, false
+	}
+	return access, true
+}
+
+// countDownload counts a download against the share token granting access
+// when it limits downloads, writing the error when it has none left
+func countDownload(ctx context.Context, w http.ResponseWriter, id string, access *collectionAccess) bool {
+	if access.DownloadToken == "" {
+		return true
+	}
+	if err := consumeDownload(ctx, id, access.DownloadToken); err != nil {
+		if errs.Code(err) == errs.ResourceExhausted {
+			http.Error(w, "share token has no downloads left", http.StatusForbidden)
+		} else {
+			http.Error(w, "failed to count download", http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// downloadFilename names an item after its title, with the extension of the
+// file actually downloaded
+func downloadFilename(item downloadItem) string {
+	var ext string
+	if u, err := url.Parse(item.streamURL); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	base := item.title
+	if base == "" {
+		base = strings.TrimSuffix(path.Base(item.filename), path.Ext(item.filename))
+	}
+	return safeFilename(strings.TrimSuffix(base, ext), item.mediaID) + ext
+}
+
+// openStream reads a file from its presigned URL
+func openStream(ctx context.Context, streamURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("storage returned %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// uniqueFilename appends " (2)", " (3)", ... to names already in the archive
+func uniqueFilename(name string, used map[string]bool) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for n := 2; used[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// safeFilename strips path separators and characters file systems reject,
+// falling back when nothing is left
+func safeFilename(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f:
+			return -1
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if runes := []rune(name); len(runes) > 150 {
+		name = string(runes[:150])
+	}
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// asciiFilename is the filename for clients that don't support filename*
+func asciiFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > 0x7e {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// recordEgress counts bytes of a media item sent in a download towards its
+// owner's monthly egress
+func recordEgress(ctx context.Context, mediaID string, bytes int64, viewer string) {
+	err := media.RecordEgress(ctx, &media.RecordEgressRequest{MediaID: mediaID, Bytes: bytes, Viewer: viewer})
+	if err != nil {
+		rlog.Warn("failed to record egress", "error", err, "media_id", mediaID)
+	}
+}
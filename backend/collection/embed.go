@@ -0,0 +1,399 @@
+package collection
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+)
+
+// Default size of the embedded player
+const (
+	embedDefaultWidth  = 640
+	embedDefaultHeight = 360
+)
+
+// embedMaxItems is how many items the embedded player of a collection lists
+const embedMaxItems = 50
+
+// getAPIBaseURL returns the public URL of this API, which serves the embed pages
+func getAPIBaseURL() string {
+	if val := os.Getenv("API_BASE_URL"); val != "" {
+		return strings.TrimRight(val, "/")
+	}
+	return "http://localhost:4000"
+}
+
+// getFrontendURL returns the frontend URL share links point to
+func getFrontendURL() string {
+	if val := os.Getenv("FRONTEND_URL"); val != "" {
+		return strings.TrimRight(val, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// embedTarget is the collection, and optionally the item, a link points to
+type embedTarget struct {
+	CollectionID string
+	MediaID      string
+	Token        string
+}
+
+// embedPath returns the path of the embed page of the target
+func (t embedTarget) embedPath() string {
+	p := "/embed/collection/" + t.CollectionID
+	if t.MediaID != "" {
+		p += "/media/" + t.MediaID
+	}
+	return p
+}
+
+// withToken appends the share token of the target to a URL
+func (t embedTarget) withToken(u string) string {
+	if t.Token == "" {
+		return u
+	}
+	return u + "?token=" + url.QueryEscape(t.Token)
+}
+
+// parseEmbedPath parses /collection/:id[/media/:mediaID], optionally
+// prefixed with /embed
+func parseEmbedPath(p string) (embedTarget, bool) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(p, "/embed"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "collection" && parts[1] != "":
+		return embedTarget{CollectionID: parts[1]}, true
+	case len(parts) == 4 && parts[0] == "collection" && parts[2] == "media" && parts[1] != "" && parts[3] != "":
+		return embedTarget{CollectionID: parts[1], MediaID: parts[3]}, true
+	}
+	return embedTarget{}, false
+}
+
+// parseEmbedURL parses a frontend or API link to a collection or one of its
+// items, including its share token
+func parseEmbedURL(rawURL string) (embedTarget, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return embedTarget{}, false
+	}
+	known := false
+	for _, base := range []string{getFrontendURL(), getAPIBaseURL()} {
+		if b, err := url.Parse(base); err == nil && strings.EqualFold(b.Host, u.Host) {
+			known = true
+		}
+	}
+	if !known {
+		return embedTarget{}, false
+	}
+	target, ok := parseEmbedPath(u.Path)
+	target.Token = u.Query().Get("token")
+	return target, ok
+}
+
+// embedItem is a playable item of the embedded player
+type embedItem struct {
+	ID           string
+	Title        string
+	MimeType     string
+	Width        int
+	Height       int
+	StreamURL    string
+	ThumbnailURL string
+}
+
+// embedView is what an embed page or oEmbed response shows
+type embedView struct {
+	Title  string
+	Owner  *authpkg.PublicProfile
+	Items  []embedItem
+	Target embedTarget
+}
+
+// loadEmbedView checks access to the target like GetCollection does and
+// loads its playable items with fresh stream URLs. DASH-packaged items play
+// their original, as browsers can't play a DASH manifest on their own.
+func loadEmbedView(ctx context.Context, target embedTarget) (*embedView, error) {
+	var collection GetCollectionResponse
+	access, err := checkCollectionAccess(ctx, target.CollectionID, target.Token, &collection)
+	if err != nil {
+		return nil, err
+	}
+	if !access.IncludeStreams {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token does not grant media:read").Err()
+	}
+	if access.DownloadToken != "" {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token only allows downloads").Err()
+	}
+
+	view := &embedView{Title: collection.Title, Target: target}
+	if owner, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: access.OwnerID}); err == nil {
+		view.Owner = owner
+	}
+
+	var mediaIDs []string
+	if target.MediaID != "" {
+		if !hasCollectionItem(ctx, target.CollectionID, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, target.MediaID) {
+			return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+		}
+		mediaIDs = []string{target.MediaID}
+	} else {
+		all, _, err := collectionItems(ctx, target.CollectionID, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, 0, 0)
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+		}
+		for _, item := range all {
+			mediaIDs = append(mediaIDs, item.MediaID)
+		}
+	}
+	if len(mediaIDs) == 0 {
+		return view, nil
+	}
+
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	var playable []string
+	for _, mediaID := range mediaIDs {
+		m, ok := info[mediaID]
+		if ok && m.Status == "ready" && (strings.HasPrefix(m.MimeType, "video/") || strings.HasPrefix(m.MimeType, "audio/")) {
+			playable = append(playable, mediaID)
+		}
+	}
+	// Stream URLs follow the owner's settings, whoever views the collection
+	streams, err := resolveStreams(ctx, playable, media.ResolveStreamURLRequest{
+		Progressive: true,
+		StreamOnly:  access.StreamOnly,
+		Thumbnails:  true,
+		Viewer:      callerKey(access.UserID),
+	})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to generate stream URLs").Err()
+	}
+
+	for _, mediaID := range playable {
+		s, ok := streams[mediaID]
+		if !ok {
+			continue
+		}
+		m := info[mediaID]
+		item := embedItem{
+			ID:           m.ID,
+			Title:        m.Title,
+			MimeType:     m.MimeType,
+			Width:        m.Width,
+			Height:       m.Height,
+			StreamURL:    s.StreamURL,
+			ThumbnailURL: s.ThumbnailURL,
+		}
+		// Processed files are MP4
+		if s.Processed && strings.HasPrefix(item.MimeType, "video/") {
+			item.MimeType = "video/mp4"
+		}
+		view.Items = append(view.Items, item)
+		if len(view.Items) == embedMaxItems {
+			break
+		}
+	}
+
+	// A single item is titled after itself
+	if target.MediaID != "" && len(view.Items) == 1 && view.Items[0].Title != "" {
+		view.Title = view.Items[0].Title
+	}
+	return view, nil
+}
+
+// embedSize returns the player size for the view within the limits
+// (0 for none), keeping the aspect ratio of its first item
+func embedSize(view *embedView, maxWidth, maxHeight int) (int, int) {
+	width, height := embedDefaultWidth, embedDefaultHeight
+	if len(view.Items) > 0 && view.Items[0].Width > 0 && view.Items[0].Height > 0 {
+		height = width * view.Items[0].Height / view.Items[0].Width
+	}
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
+
+// OEmbedRequest is an oEmbed consumer's request for a link
+type OEmbedRequest struct {
+	URL       string `query:"url"`
+	MaxWidth  int    `query:"maxwidth"`
+	MaxHeight int    `query:"maxheight"`
+	Format    string `query:"format"`
+}
+
+// OEmbedResponse is a video oEmbed response
+type OEmbedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// OEmbed describes a link to a collection or a collection item as an
+// embeddable player, following the oEmbed spec (JSON only)
+//
+//encore:api public method=GET path=/oembed
+func OEmbed(ctx context.Context, req *OEmbedRequest) (*OEmbedResponse, error) {
+	if req.Format != "" && req.Format != "json" {
+		return nil, errs.B().Code(errs.Unimplemented).Msg("only the json format is supported").Err()
+	}
+	target, ok := parseEmbedURL(req.URL)
+	if !ok {
+		return nil, errs.B().Code(errs.NotFound).Msg("not an embeddable link").Err()
+	}
+
+	view, err := loadEmbedView(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(view.Items) == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("nothing to play").Err()
+	}
+
+	width, height := embedSize(view, req.MaxWidth, req.MaxHeight)
+	src := target.withToken(getAPIBaseURL() + target.embedPath())
+	resp := &OEmbedResponse{
+		Type:         "video",
+		Version:      "1.0",
+		Title:        view.Title,
+		ProviderName: "MediaVault",
+		ProviderURL:  getFrontendURL(),
+		HTML: `<iframe src="` + template.HTMLEscapeString(src) + `" width="` + strconv.Itoa(width) + `" height="` +
+			strconv.Itoa(height) + `" frameborder="0" allow="autoplay; fullscreen" allowfullscreen></iframe>`,
+		Width:  width,
+		Height: height,
+	}
+	if view.Owner != nil {
+		resp.AuthorName = view.Owner.DisplayName
+	}
+	if first := view.Items[0]; first.ThumbnailURL != "" {
+		resp.ThumbnailURL = first.ThumbnailURL
+		resp.ThumbnailWidth = first.Width
+		resp.ThumbnailHeight = first.Height
+	}
+	return resp, nil
+}
+
+// embedPage renders the embedded player: the first item plays, and further
+// items of a collection are listed below it. The Open Graph tags let chat
+// apps like Discord unfurl the page into a playable preview.
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta property="og:site_name" content="MediaVault">
+<meta property="og:title" content="{{.Title}}">
+{{with .Current}}<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.StreamURL}}">
+<meta property="og:video:secure_url" content="{{.StreamURL}}">
+<meta property="og:video:type" content="{{.MimeType}}">
+{{if .Width}}<meta property="og:video:width" content="{{.Width}}">
+<meta property="og:video:height" content="{{.Height}}">
+{{end}}{{with .ThumbnailURL}}<meta property="og:image" content="{{.}}">
+{{end}}{{end}}<meta name="twitter:card" content="player">
+<meta name="twitter:player" content="{{.EmbedURL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<style>
+html, body { margin: 0; height: 100%; background: #000; color: #eee; font: 14px sans-serif; }
+body { display: flex; flex-direction: column; }
+video { flex: 1; width: 100%; min-height: 0; }
+ol { margin: 0; padding: 6px 6px 6px 28px; max-height: 30%; overflow-y: auto; }
+a { color: inherit; }
+</style>
+</head>
+<body>
+{{with .Current}}<video id="player" controls playsinline preload="metadata" poster="{{.ThumbnailURL}}" src="{{.StreamURL}}"></video>
+{{end}}{{if gt (len .Items) 1}}<ol>
+{{range .Items}}<li><a href="#" data-src="{{.StreamURL}}" data-poster="{{.ThumbnailURL}}">{{or .Title "Untitled"}}</a></li>
+{{end}}</ol>
+<script>
+document.querySelectorAll('a[data-src]').forEach(function (a) {
+  a.addEventListener('click', function (e) {
+    e.preventDefault();
+    var player = document.getElementById('player');
+    player.poster = a.dataset.poster;
+    player.src = a.dataset.src;
+    player.play();
+  });
+});
+</script>
+{{end}}</body>
+</html>
+`))
+
+// GetEmbedPage serves the embeddable player page of a collection or one of
+// its items, with the same access rules as GetCollection
+//
+//encore:api public raw method=GET path=/embed/collection/*path
+func GetEmbedPage(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	target, ok := parseEmbedPath(req.URL.Path)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	target.Token = req.URL.Query().Get("token")
+
+	view, err := loadEmbedView(ctx, target)
+	if err != nil {
+		switch errs.Code(err) {
+		case errs.NotFound:
+			http.Error(w, "not found", http.StatusNotFound)
+		case errs.PermissionDenied:
+			http.Error(w, "access denied", http.StatusForbidden)
+		default:
+			http.Error(w, "failed to load player", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	embedURL := target.withToken(getAPIBaseURL() + target.embedPath())
+	data := struct {
+		*embedView
+		Current   *embedItem
+		EmbedURL  string
+		OEmbedURL string
+	}{
+		embedView: view,
+		EmbedURL:  embedURL,
+		OEmbedURL: getAPIBaseURL() + "/oembed?format=json&url=" + url.QueryEscape(embedURL),
+	}
+	if len(view.Items) > 0 {
+		data.Current = &view.Items[0]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Stream URLs in the page expire, so it must not be cached for long
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	if err := embedPage.Execute(w, data); err != nil {
+		rlog.Error("failed to render embed page", "error", err, "collection_id", target.CollectionID)
+	}
+}
@@ -0,0 +1,43 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.dev/rlog"
+
+	"encore.app/realtime"
+)
+
+// Changes reported in collection.updated events
+const (
+	changeItemsAdded   = "items_added"
+	changeItemsRemoved = "items_removed"
+	changeUpdated      = "updated"
+	changeDeleted      = "deleted"
+	changeRestored     = "restored"
+)
+
+// publishUpdate pushes a change of a collection to its owner's event
+// streams. Nothing is pushed for a collection that is gone, and a failed
+// publish is only logged: clients catch up on their next fetch.
+func publishUpdate(ctx context.Context, collectionID, change string, mediaIDs []string) {
+	var ownerID int64
+	if err := db.QueryRow(ctx, `SELECT owner_id FROM collections WHERE id = $1`, collectionID).Scan(&ownerID); err != nil {
+		return
+	}
+	publishEvent(ctx, []int64{ownerID}, collectionID, change, mediaIDs)
+}
+
+// publishEvent pushes a collection.updated event to the given users' event streams
+func publishEvent(ctx context.Context, userIDs []int64, collectionID, change string, mediaIDs []string) {
+	payload, err := json.Marshal(realtime.CollectionUpdated{CollectionID: collectionID, Change: change, MediaIDs: mediaIDs})
+	if err != nil {
+		return
+	}
+	ev := &realtime.Event{UserIDs: userIDs, Type: realtime.TypeCollectionUpdated, Data: payload, OccurredAt: time.Now()}
+	if _, err := realtime.EventsTopic.Publish(ctx, ev); err != nil {
+		rlog.Warn("failed to publish realtime event", "error", err, "collection_id", collectionID)
+	}
+}
@@ -0,0 +1,140 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Explore sort orders
+const (
+	ExploreSortRecent  = "recent"
+	ExploreSortPopular = "popular"
+)
+
+// ExploreRequest selects a page of public collections
+type ExploreRequest struct {
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+	Sort     string `query:"sort"`
+}
+
+// PublicCollection is a public collection listed on the explore page
+type PublicCollection struct {
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Owner       *authpkg.PublicProfile `json:"owner,omitempty"`
+	ItemCount   int                    `json:"item_count"`
+	ViewCount   int64                  `json:"view_count"`
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+// ExploreResponse contains a page of public collections
+type ExploreResponse struct {
+	Collections []PublicCollection `json:"collections"`
+	Total       int                `json:"total"`
+	Page        int                `json:"page"`
+	PageSize    int                `json:"page_size"`
+	Sort        string             `json:"sort"`
+}
+
+// Explore lists public collections that have items, newest first or, with
+// sort=popular, most viewed first, for a community gallery
+//
+//encore:api public method=GET path=/explore
+func Explore(ctx context.Context, req *ExploreRequest) (*ExploreResponse, error) {
+	// Set defaults
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	sort := req.Sort
+	orderBy := "c.created_at DESC, c.id"
+	switch sort {
+	case "", ExploreSortRecent:
+		sort = ExploreSortRecent
+	case ExploreSortPopular:
+		orderBy = "c.view_count DESC, c.created_at DESC, c.id"
+	default:
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("sort must be recent or popular").Err()
+	}
+
+	// Empty collections make for a poor gallery; smart collections are
+	// listed anyway, as their media changes over time
+	const listed = `
+		FROM collections c
+		WHERE c.visibility = 'public' AND c.deleted_at IS NULL
+		  AND (c.rules IS NOT NULL OR EXISTS (SELECT 1 FROM collection_items i WHERE i.collection_id = c.id))
+	`
+
+	resp := &ExploreResponse{
+		Collections: []PublicCollection{},
+		Page:        page,
+		PageSize:    pageSize,
+		Sort:        sort,
+	}
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) `+listed).Scan(&resp.Total); err != nil {
+		rlog.Error("failed to count public collections", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list collections").Err()
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.owner_id, c.title, COALESCE(c.description, ''), c.view_count, c.created_at, c.rules,
+			   (SELECT COUNT(*) FROM collection_items i WHERE i.collection_id = c.id)
+	`+listed+`
+		ORDER BY `+orderBy+`
+		LIMIT $1 OFFSET $2
+	`, pageSize, offset)
+	if err != nil {
+		rlog.Error("failed to list public collections", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list collections").Err()
+	}
+
+	var ownerIDs []int64
+	var rules []*SmartRules
+	for rows.Next() {
+		var c PublicCollection
+		var ownerID int64
+		var rawRules []byte
+		if err := rows.Scan(&c.ID, &ownerID, &c.Title, &c.Description, &c.ViewCount, &c.CreatedAt, &rawRules,
+			&c.ItemCount); err != nil {
+			continue
+		}
+		resp.Collections = append(resp.Collections, c)
+		ownerIDs = append(ownerIDs, ownerID)
+		rules = append(rules, parseRules(rawRules))
+	}
+	rows.Close()
+
+	// Smart collections are counted from their rules
+	for i, r := range rules {
+		if r == nil {
+			continue
+		}
+		if _, total, err := collectionItems(ctx, resp.Collections[i].ID, ownerIDs[i], r, nil, false, 1, 0); err == nil {
+			resp.Collections[i].ItemCount = total
+		}
+	}
+
+	// Viewers see the owner's display name and avatar, not the login identity
+	owners := map[int64]*authpkg.PublicProfile{}
+	for i, ownerID := range ownerIDs {
+		if _, ok := owners[ownerID]; !ok {
+			owners[ownerID], _ = authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: ownerID})
+		}
+		resp.Collections[i].Owner = owners[ownerID]
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,336 @@
+package collection
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+)
+
+// Collection exports carry this format name and version
+const (
+	collectionExportFormat  = "surtr-collection"
+	collectionExportVersion = 1
+)
+
+// maxImportItems is the most items one imported collection may reference
+const maxImportItems = 5000
+
+// ExportedItem references a media item by content rather than ID, so it can
+// be found again in another account or instance
+type ExportedItem struct {
+	// SHA256 is the checksum of the processed file (of the manifest for DASH)
+	SHA256           string    `json:"sha256,omitempty"`
+	OriginalFilename string    `json:"original_filename,omitempty"`
+	SizeBytes        int64     `json:"size_bytes,omitempty"`
+	Title            string    `json:"title,omitempty"`
+	MimeType         string    `json:"mime_type,omitempty"`
+	Note             string    `json:"note,omitempty"`
+	AddedAt          time.Time `json:"added_at"`
+}
+
+// CollectionExport is a portable copy of a collection
+type CollectionExport struct {
+	Format      string      `json:"format"`
+	Version     int         `json:"version"`
+	ExportedAt  time.Time   `json:"exported_at"`
+	Title       string      `json:"title"`
+	Description string      `json:"description,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Rules       *SmartRules `json:"rules,omitempty"`
+	// Items are newest first; smart collections have none, as their rules
+	// pick the items
+	Items []ExportedItem `json:"items"`
+}
+
+// ExportCollection returns a collection as JSON that ImportCollection can
+// recreate in another account or instance. Items are referenced by content
+// hash, with the file name and size as a fallback. Taken down collections
+// can't be exported.
+//
+//encore:api auth method=GET path=/collection/:id/export
+func ExportCollection(ctx context.Context, id string) (*CollectionExport, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	// Importing the export would recreate it without the takedown
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
+
+	export := &CollectionExport{
+		Format:     collectionExportFormat,
+		Version:    collectionExportVersion,
+		ExportedAt: time.Now(),
+		Items:      []ExportedItem{},
+	}
+	var rules []byte
+	err := db.QueryRow(ctx, `
+		SELECT title, COALESCE(description, ''), tags, rules FROM collections WHERE id = $1
+	`, id).Scan(&export.Title, &export.Description, &export.Tags, &rules)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	export.Rules = parseRules(rules)
+	if export.Rules != nil {
+		return export, nil
+	}
+
+	items, _, err := collectionItems(ctx, id, userData.UserID, nil, nil, true, 0, 0)
+	if err != nil {
+		rlog.Error("failed to get collection items", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to export collection").Err()
+	}
+	if len(items) == 0 {
+		return export, nil
+	}
+	var mediaIDs []string
+	for _, item := range items {
+		mediaIDs = append(mediaIDs, item.MediaID)
+	}
+
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		rlog.Error("failed to get media info", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to export collection").Err()
+	}
+
+	// Items whose media is gone are left out
+	for _, item := range items {
+		m, ok := info[item.MediaID]
+		if !ok {
+			continue
+		}
+		e := ExportedItem{
+			SHA256:           m.ChecksumSHA256,
+			OriginalFilename: m.OriginalFilename,
+			SizeBytes:        m.SizeBytes,
+			Title:            m.Title,
+			MimeType:         m.MimeType,
+		}
+		e.Note = item.Note
+		e.AddedAt = item.AddedAt
+		export.Items = append(export.Items, e)
+	}
+
+	return export, nil
+}
+
+// ImportCollectionRequest contains an exported collection, optionally
+// placed under a parent
+type ImportCollectionRequest struct {
+	Export   *CollectionExport `json:"export"`
+	ParentID string            `json:"parent_id,omitempty"`
+}
+
+// UnmatchedItem is an exported item none of the caller's media matched
+type UnmatchedItem struct {
+	Index            int    `json:"index"`
+	SHA256           string `json:"sha256,omitempty"`
+	OriginalFilename string `json:"original_filename,omitempty"`
+	Title            string `json:"title,omitempty"`
+}
+
+// ImportCollectionResponse contains the new collection and the items that
+// couldn't be matched
+type ImportCollectionResponse struct {
+	Collection *CollectionResponse `json:"collection"`
+	Matched    int                 `json:"matched"`
+	Unmatched  []UnmatchedItem     `json:"unmatched"`
+}
+
+// ImportCollection recreates an exported collection from the caller's own
+// media: items are matched by content hash, or else by file name and size,
+// and keep their order and notes. Items without a match are reported
+// rather than failing the import.
+//
+//encore:api auth method=POST path=/collection/import
+func ImportCollection(ctx context.Context, req *ImportCollectionRequest) (*ImportCollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	export := req.Export
+	if export == nil || export.Format != collectionExportFormat || export.Version != collectionExportVersion {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("not a supported collection export").Err()
+	}
+	title := strings.TrimSpace(export.Title)
+	if title == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("title is required").Err()
+	}
+	if len(export.Items) > maxImportItems {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("a collection can import at most 5000 items").Err()
+	}
+	for _, item := range export.Items {
+		if utf8.RuneCountInString(item.Note) > maxItemNoteLength {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("notes must be at most 1000 characters").Err()
+		}
+	}
+	if export.Rules != nil {
+		if err := export.Rules.validate(); err != nil {
+			return nil, err
+		}
+		if len(export.Items) > 0 {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("smart collections can't have items").Err()
+		}
+	}
+	tags := []string{}
+	for _, tag := range export.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxCollectionTagLength {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("tags must be at most 50 characters").Err()
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxCollectionTags {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("a collection can have at most 20 tags").Err()
+	}
+	if req.ParentID != "" {
+		if err := checkParent(ctx, userData.UserID, "", "", req.ParentID); err != nil {
+			return nil, err
+		}
+	}
+
+	matches, err := matchImportedItems(ctx, userData.UserID, export.Items)
+	if err != nil {
+		rlog.Error("failed to match imported items", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to import collection").Err()
+	}
+
+	resp := &ImportCollectionResponse{Unmatched: []UnmatchedItem{}}
+	var mediaIDs, notes []string
+	var addedAt []time.Time
+	seen := map[string]bool{}
+	for i, item := range export.Items {
+		mediaID, ok := matches[i]
+		if !ok {
+			resp.Unmatched = append(resp.Unmatched, UnmatchedItem{
+				Index:            i,
+				SHA256:           item.SHA256,
+				OriginalFilename: item.OriginalFilename,
+				Title:            item.Title,
+			})
+			continue
+		}
+		if seen[mediaID] {
+			continue
+		}
+		seen[mediaID] = true
+		mediaIDs = append(mediaIDs, mediaID)
+		notes = append(notes, item.Note)
+		// Items without a time keep their order behind the ones before them
+		if item.AddedAt.IsZero() {
+			item.AddedAt = time.Now().Add(-time.Duration(i) * time.Millisecond)
+		}
+		addedAt = append(addedAt, item.AddedAt)
+	}
+	resp.Matched = len(mediaIDs)
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to import collection").Err()
+	}
+	defer tx.Rollback()
+
+	var c CollectionResponse
+	var rules []byte
+	err = tx.QueryRow(ctx, `
+		INSERT INTO collections (owner_id, title, description, visibility, parent_id, rules, tags, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, $6, $7, NOW())
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, userData.UserID, title, export.Description, defaultVisibility(ctx, userData.UserID), req.ParentID,
+		encodeRules(export.Rules), tags).Scan(
+		&c.ID, &c.ParentID, &c.Title, &c.Description, &c.Visibility, &c.ShareToken, &rules, &c.Tags, &c.CreatedAt)
+	if err != nil {
+		rlog.Error("failed to create imported collection", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to import collection").Err()
+	}
+	c.Rules = parseRules(rules)
+
+	if len(mediaIDs) > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO collection_items (collection_id, media_id, added_at, note)
+			SELECT $1, i.media_id, i.added_at, NULLIF(i.note, '')
+			FROM unnest($2::uuid[], $3::timestamp[], $4::text[]) AS i(media_id, added_at, note)
+		`, c.ID, mediaIDs, addedAt, notes)
+		if err != nil {
+			rlog.Error("failed to add imported items", "error", err, "collection_id", c.ID)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to import collection").Err()
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to import collection").Err()
+	}
+
+	c.ItemCount = resp.Matched
+	resp.Collection = &c
+	recordAudit(ctx, userData.UserID, auditCollectionImported, "collection", c.ID, nil, collectionSnapshot(ctx, c.ID),
+		map[string]string{"matched": strconv.Itoa(resp.Matched), "unmatched": strconv.Itoa(len(resp.Unmatched))})
+	return resp, nil
+}
+
+// matchImportedItems finds the user's media for each exported item by index:
+// by checksum first, then by original file name and size
+func matchImportedItems(ctx context.Context, userID int64, items []ExportedItem) (map[int]string, error) {
+	matches := map[int]string{}
+	if len(items) == 0 {
+		return matches, nil
+	}
+
+	var checksums, filenames []string
+	for _, item := range items {
+		if item.SHA256 != "" {
+			checksums = append(checksums, strings.ToLower(item.SHA256))
+		}
+		if item.OriginalFilename != "" {
+			filenames = append(filenames, item.OriginalFilename)
+		}
+	}
+
+	// The oldest upload wins when the user has duplicates
+	found, err := media.FindMediaByContent(ctx, &media.FindMediaByContentRequest{
+		OwnerID:   userID,
+		Checksums: checksums,
+		Filenames: filenames,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type fileKey struct {
+		name string
+		size int64
+	}
+	byChecksum := map[string]string{}
+	byFile := map[fileKey]string{}
+	for _, m := range found.Media {
+		if _, ok := byChecksum[m.ChecksumSHA256]; m.ChecksumSHA256 != "" && !ok {
+			byChecksum[m.ChecksumSHA256] = m.ID
+		}
+		key := fileKey{m.OriginalFilename, m.SizeBytes}
+		if _, ok := byFile[key]; m.OriginalFilename != "" && !ok {
+			byFile[key] = m.ID
+		}
+	}
+
+	for i, item := range items {
+		if mediaID, ok := byChecksum[strings.ToLower(item.SHA256)]; ok && item.SHA256 != "" {
+			matches[i] = mediaID
+		} else if mediaID, ok := byFile[fileKey{item.OriginalFilename, item.SizeBytes}]; ok && item.OriginalFilename != "" {
+			matches[i] = mediaID
+		}
+	}
+	return matches, nil
+}
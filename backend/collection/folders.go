@@ -0,0 +1,114 @@
+package collection
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// maxCollectionDepth is the deepest a collection may be nested; top-level
+// collections have depth 1
+const maxCollectionDepth = 10
+
+// checkParent fails unless parentID is a collection in the same library
+// (the user's personal collections, or teamID's) that collectionID (empty
+// for a new collection) can be nested in: not the collection itself or one
+// of its descendants, and not too deep
+func checkParent(ctx context.Context, userID int64, teamID, collectionID, parentID string) error {
+	// Depth of the parent, walking up to its root
+	var parentOwnerID int64
+	var parentTeamID string
+	var parentDepth int
+	err := db.QueryRow(ctx, `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id, owner_id, COALESCE(team_id::text, '') AS team_id, 1 AS depth
+			FROM collections WHERE id::text = $1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT c.id, c.parent_id, a.owner_id, a.team_id, a.depth + 1
+			FROM collections c JOIN ancestors a ON c.id = a.parent_id
+			WHERE a.depth < $2
+		)
+		SELECT owner_id, team_id, MAX(depth) FROM ancestors GROUP BY owner_id, team_id
+	`, parentID, maxCollectionDepth+1).Scan(&parentOwnerID, &parentTeamID, &parentDepth)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("parent collection not found").Err()
+	}
+	if parentTeamID != teamID || (teamID == "" && parentOwnerID != userID) {
+		return errs.B().Code(errs.PermissionDenied).Msg("not authorized to use this parent collection").Err()
+	}
+
+	// Height of the moved subtree; a cycle would put the parent in it
+	height := 1
+	if collectionID != "" {
+		var containsParent bool
+		err := db.QueryRow(ctx, `
+			WITH RECURSIVE subtree AS (
+				SELECT id, 1 AS depth FROM collections WHERE id = $1
+				UNION ALL
+				SELECT c.id, s.depth + 1
+				FROM collections c JOIN subtree s ON c.parent_id = s.id
+				WHERE s.depth < $3
+			)
+			SELECT MAX(depth), bool_or(id::text = $2) FROM subtree
+		`, collectionID, parentID, maxCollectionDepth+1).Scan(&height, &containsParent)
+		if err != nil {
+			return errs.B().Code(errs.Internal).Msg("failed to check parent collection").Err()
+		}
+		if containsParent {
+			return errs.B().Code(errs.InvalidArgument).
+				Msg("a collection can't be moved into itself or one of its sub-collections").Err()
+		}
+	}
+
+	if parentDepth+height > maxCollectionDepth {
+		return errs.B().Code(errs.InvalidArgument).Msg("collections can be nested at most 10 levels deep").Err()
+	}
+	return nil
+}
+
+// MoveCollectionRequest names the new parent; empty moves to the top level
+type MoveCollectionRequest struct {
+	ParentID string `json:"parent_id"`
+}
+
+// MoveCollection nests a collection in another one, with its sub-collections
+//
+//encore:api auth method=PUT path=/collection/:id/move
+func MoveCollection(ctx context.Context, id string, req *MoveCollectionRequest) (*CollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	teamID, err := checkCollectionEditor(ctx, id, userData.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if req.ParentID != "" {
+		if err := checkParent(ctx, userData.UserID, teamID, id, req.ParentID); err != nil {
+			return nil, err
+		}
+	}
+
+	before := collectionSnapshot(ctx, id)
+
+	resp := CollectionResponse{TeamID: teamID}
+	var rules []byte
+	err = db.QueryRow(ctx, `
+		UPDATE collections SET parent_id = NULLIF($2, '')::uuid
+		WHERE id = $1
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, id, req.ParentID).Scan(
+		&resp.ID, &resp.ParentID, &resp.Title, &resp.Description, &resp.Visibility, &resp.ShareToken, &rules, &resp.Tags,
+		&resp.CreatedAt)
+	if err != nil {
+		rlog.Error("failed to move collection", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to move collection").Err()
+	}
+	resp.Rules = parseRules(rules)
+	recordAudit(ctx, userData.UserID, auditCollectionMoved, "collection", id, before, collectionSnapshot(ctx, id), nil)
+	publishUpdate(ctx, id, changeUpdated, nil)
+
+	return &resp, nil
+}
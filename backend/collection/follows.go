@@ -0,0 +1,236 @@
+package collection
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+)
+
+// CollectionItemsAdded is published when items are added to a public or
+// unlisted collection that has followers
+type CollectionItemsAdded struct {
+	CollectionID string    `json:"collection_id"`
+	Title        string    `json:"title"`
+	OwnerID      int64     `json:"owner_id"`
+	MediaIDs     []string  `json:"media_ids"`
+	FollowerIDs  []int64   `json:"follower_ids"`
+	AddedAt      time.Time `json:"added_at"`
+}
+
+// CollectionItemsAddedTopic carries new items of followed collections to the
+// notification subsystem, which tells the followers
+var CollectionItemsAddedTopic = pubsub.NewTopic[*CollectionItemsAdded]("collection-items-added", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// notifyItemsAdded pushes items just added to a collection to the event
+// streams of its owner and, for open collections, tells its followers
+// about those already published. The items stay added when publishing
+// fails; followers then just aren't told.
+func notifyItemsAdded(ctx context.Context, collectionID string, mediaIDs []string) {
+	if len(mediaIDs) == 0 {
+		return
+	}
+	publishUpdate(ctx, collectionID, changeItemsAdded, mediaIDs)
+	notifyFollowers(ctx, collectionID, publishedOnly(ctx, mediaIDs))
+}
+
+// notifyFollowers tells the followers of an open collection about new
+// items, through their event streams and the notification subsystem
+func notifyFollowers(ctx context.Context, collectionID string, mediaIDs []string) {
+	if len(mediaIDs) == 0 {
+		return
+	}
+
+	msg := CollectionItemsAdded{CollectionID: collectionID, MediaIDs: mediaIDs, AddedAt: time.Now()}
+	var visibility string
+	err := db.QueryRow(ctx, `
+		SELECT title, owner_id, visibility FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, collectionID).Scan(&msg.Title, &msg.OwnerID, &visibility)
+	if err != nil || visibility == VisibilityPrivate {
+		return
+	}
+
+	rows, err := db.Query(ctx, `SELECT user_id FROM collection_follows WHERE collection_id = $1`, collectionID)
+	if err != nil {
+		rlog.Error("failed to list followers", "error", err, "collection_id", collectionID)
+		return
+	}
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err == nil {
+			msg.FollowerIDs = append(msg.FollowerIDs, userID)
+		}
+	}
+	rows.Close()
+	if len(msg.FollowerIDs) == 0 {
+		return
+	}
+	publishEvent(ctx, msg.FollowerIDs, collectionID, changeItemsAdded, mediaIDs)
+
+	if _, err := CollectionItemsAddedTopic.Publish(ctx, &msg); err != nil {
+		rlog.Error("failed to publish collection update", "error", err, "collection_id", collectionID)
+	}
+}
+
+// FollowResponse confirms a follow or unfollow
+type FollowResponse struct {
+	Following bool `json:"following"`
+}
+
+// FollowCollection follows a public or unlisted collection of another user;
+// items added from now on count as new until the follower views the
+// collection
+//
+//encore:api auth method=POST path=/collection/:id/follow
+func FollowCollection(ctx context.Context, id string) (*FollowResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var visibility string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, visibility FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&ownerID, &visibility)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	if visibility == VisibilityPrivate {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("private collections can't be followed").Err()
+	}
+	if ownerID == userData.UserID {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("you can't follow your own collection").Err()
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO collection_follows (collection_id, user_id, followed_at, last_seen_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT DO NOTHING
+	`, id, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to follow collection").Err()
+	}
+
+	return &FollowResponse{Following: true}, nil
+}
+
+// UnfollowCollection stops following a collection
+//
+//encore:api auth method=DELETE path=/collection/:id/follow
+func UnfollowCollection(ctx context.Context, id string) (*FollowResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	_, err := db.Exec(ctx, `
+		DELETE FROM collection_follows WHERE collection_id = $1 AND user_id = $2
+	`, id, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to unfollow collection").Err()
+	}
+
+	return &FollowResponse{Following: false}, nil
+}
+
+// FollowedCollection is a collection the caller follows
+type FollowedCollection struct {
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Owner       *authpkg.PublicProfile `json:"owner,omitempty"`
+	// NewItemCount counts items added since the caller last viewed it
+	NewItemCount int       `json:"new_item_count"`
+	FollowedAt   time.Time `json:"followed_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+}
+
+// ListFollowingResponse contains the followed collections
+type ListFollowingResponse struct {
+	Collections []FollowedCollection `json:"collections"`
+}
+
+// ListFollowing returns the collections the caller follows, those with the
+// most new items first. Collections that were made private or deleted since
+// are left out.
+//
+//encore:api auth method=GET path=/following
+func ListFollowing(ctx context.Context) (*ListFollowingResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.owner_id, c.title, COALESCE(c.description, ''), c.rules, f.followed_at, f.last_seen_at,
+			   (SELECT COUNT(*) FROM collection_items i WHERE i.collection_id = c.id AND i.added_at > f.last_seen_at)
+		FROM collection_follows f JOIN collections c ON c.id = f.collection_id
+		WHERE f.user_id = $1 AND c.visibility <> 'private' AND c.deleted_at IS NULL
+		ORDER BY f.followed_at DESC
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list followed collections").Err()
+	}
+
+	collections := []FollowedCollection{}
+	var ownerIDs []int64
+	var rules []*SmartRules
+	for rows.Next() {
+		var c FollowedCollection
+		var ownerID int64
+		var rawRules []byte
+		if err := rows.Scan(&c.ID, &ownerID, &c.Title, &c.Description, &rawRules, &c.FollowedAt, &c.LastSeenAt,
+			&c.NewItemCount); err != nil {
+			continue
+		}
+		collections = append(collections, c)
+		ownerIDs = append(ownerIDs, ownerID)
+		rules = append(rules, parseRules(rawRules))
+	}
+	rows.Close()
+
+	// Media of smart collections is new when it was uploaded since
+	for i, r := range rules {
+		if r == nil {
+			continue
+		}
+		filter := r.filter(ownerIDs[i])
+		filter.CreatedAfter = &collections[i].LastSeenAt
+		matched, err := media.MatchMedia(ctx, &media.MatchMediaRequest{Filter: filter, CountOnly: true})
+		if err != nil {
+			rlog.Warn("failed to count new items", "error", err, "collection_id", collections[i].ID)
+			continue
+		}
+		collections[i].NewItemCount = matched.Total
+	}
+
+	owners := map[int64]*authpkg.PublicProfile{}
+	for i, ownerID := range ownerIDs {
+		if _, ok := owners[ownerID]; !ok {
+			owners[ownerID], _ = authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: ownerID})
+		}
+		collections[i].Owner = owners[ownerID]
+	}
+
+	// Most new items first, then most recently followed
+	sort.SliceStable(collections, func(i, j int) bool {
+		return collections[i].NewItemCount > collections[j].NewItemCount
+	})
+
+	return &ListFollowingResponse{Collections: collections}, nil
+}
+
+// markFollowSeen resets the new items of a followed collection when the
+// follower views it
+func markFollowSeen(ctx context.Context, collectionID string, userID int64) {
+	if userID == 0 {
+		return
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE collection_follows SET last_seen_at = NOW() WHERE collection_id = $1 AND user_id = $2
+	`, collectionID, userID)
+	if err != nil {
+		rlog.Warn("failed to mark followed collection seen", "error", err, "collection_id", collectionID)
+	}
+}
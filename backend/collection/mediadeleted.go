@@ -0,0 +1,71 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	"encore.app/media"
+)
+
+// Deleting media removes it from every collection and from the share
+// tokens restricted to it; tokens restricted to it alone are revoked
+var _ = pubsub.NewSubscription(media.MediaDeletedTopic, "collection-media-cleanup",
+	pubsub.SubscriptionConfig[*media.MediaDeleted]{
+		Handler: removeDeletedMedia,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// Trashing expired media removes it like deleting it
+var _ = pubsub.NewSubscription(media.MediaTrashedTopic, "collection-media-trashed",
+	pubsub.SubscriptionConfig[*media.MediaTrashed]{
+		Handler: removeTrashedMedia,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// removeDeletedMedia drops the collection items of deleted media
+func removeDeletedMedia(ctx context.Context, msg *media.MediaDeleted) error {
+	return removeMedia(ctx, msg.MediaID)
+}
+
+// removeTrashedMedia drops the collection items of trashed media
+func removeTrashedMedia(ctx context.Context, msg *media.MediaTrashed) error {
+	return removeMedia(ctx, msg.MediaID)
+}
+
+// removeMedia drops a media item from collections and share tokens
+func removeMedia(ctx context.Context, mediaID string) error {
+	result, err := db.Exec(ctx, `DELETE FROM collection_items WHERE media_id = $1`, mediaID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `DELETE FROM collection_share_tokens WHERE media_ids = ARRAY[$1::uuid]`, mediaID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+		UPDATE collection_share_tokens SET media_ids = array_remove(media_ids, $1::uuid)
+		WHERE $1::uuid = ANY(media_ids)
+	`, mediaID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM scheduled_media WHERE media_id = $1`, mediaID); err != nil {
+		return err
+	}
+
+	if removed := result.RowsAffected(); removed > 0 {
+		rlog.Info("media removed from collections", "media_id", mediaID, "collections", removed)
+	}
+	return nil
+}
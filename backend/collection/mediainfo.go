@@ -0,0 +1,45 @@
+package collection
+
+import (
+	"context"
+
+	"encore.app/media"
+)
+
+// mediaBatch is the most media looked up per call to the media service
+const mediaBatch = 5000
+
+// mediaInfo looks up media by ID through the media service, keyed by ID;
+// media that no longer exists is left out
+func mediaInfo(ctx context.Context, mediaIDs []string) (map[string]media.MediaInfo, error) {
+	info := map[string]media.MediaInfo{}
+	for start := 0; start < len(mediaIDs); start += mediaBatch {
+		resp, err := media.GetMediaInfo(ctx, &media.GetMediaInfoRequest{
+			MediaIDs: mediaIDs[start:min(start+mediaBatch, len(mediaIDs))],
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range resp.Media {
+			info[m.ID] = m
+		}
+	}
+	return info, nil
+}
+
+// resolveStreams gets presigned stream URLs of the ready media among
+// mediaIDs through the media service, keyed by ID; req.MediaIDs is ignored
+func resolveStreams(ctx context.Context, mediaIDs []string, req media.ResolveStreamURLRequest) (map[string]media.ResolvedStream, error) {
+	streams := map[string]media.ResolvedStream{}
+	for start := 0; start < len(mediaIDs); start += mediaBatch {
+		req.MediaIDs = mediaIDs[start:min(start+mediaBatch, len(mediaIDs))]
+		resp, err := media.ResolveStreamURL(ctx, &req)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Streams {
+			streams[s.MediaID] = s
+		}
+	}
+	return streams, nil
+}
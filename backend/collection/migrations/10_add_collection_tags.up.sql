@@ -0,0 +1,4 @@
+-- Tags on collections themselves, to filter long collection lists
+ALTER TABLE collections ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_collections_tags ON collections USING GIN (tags);
@@ -0,0 +1,11 @@
+-- Users following public collections; items added after last_seen_at count
+-- as new for the follower
+CREATE TABLE collection_follows (
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    followed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (collection_id, user_id)
+);
+
+CREATE INDEX idx_collection_follows_user ON collection_follows(user_id);
@@ -0,0 +1,18 @@
+-- Views and downloads of collections by anyone but the owner, for share
+-- link analytics; kept for a year
+CREATE TABLE collection_views (
+    id BIGSERIAL PRIMARY KEY,
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL CHECK (kind IN ('view', 'download')),
+    -- How access was granted: token, public or shared
+    via TEXT NOT NULL,
+    -- The share token used, when access came through one
+    share_token UUID,
+    user_id BIGINT,
+    country TEXT,
+    user_agent TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_collection_views_collection ON collection_views(collection_id, created_at DESC);
+CREATE INDEX idx_collection_views_created ON collection_views(created_at);
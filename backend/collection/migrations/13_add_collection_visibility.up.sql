@@ -0,0 +1,13 @@
+-- Visibility splits is_public: unlisted collections are open to anyone with
+-- the ID but, unlike public ones, never listed on the explore page
+ALTER TABLE collections ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private'
+    CHECK (visibility IN ('private', 'unlisted', 'public'));
+
+UPDATE collections SET visibility = 'public' WHERE is_public;
+
+DROP INDEX idx_collections_public_recent;
+DROP INDEX idx_collections_public_popular;
+ALTER TABLE collections DROP COLUMN is_public;
+
+CREATE INDEX idx_collections_public_recent ON collections(created_at DESC) WHERE visibility = 'public';
+CREATE INDEX idx_collections_public_popular ON collections(view_count DESC, created_at DESC) WHERE visibility = 'public';
@@ -0,0 +1,16 @@
+-- Extra share tokens besides collections.share_token, e.g. one per client;
+-- media_ids restricts a token to those items (NULL for all) and stream_only
+-- withholds downloads and original files
+CREATE TABLE collection_share_tokens (
+    token UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    label TEXT NOT NULL DEFAULT '',
+    scopes TEXT[] NOT NULL DEFAULT '{collection:read,media:read}',
+    media_ids UUID[],
+    stream_only BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_collection_share_tokens_collection ON collection_share_tokens(collection_id, created_at);
+CREATE INDEX idx_collection_share_tokens_expiry ON collection_share_tokens(expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Deleted collections stay in the trash, restorable, until the
+-- collection-trash-purge job removes them for good
+ALTER TABLE collections ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX idx_collections_deleted ON collections(deleted_at) WHERE deleted_at IS NOT NULL;
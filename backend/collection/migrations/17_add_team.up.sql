@@ -0,0 +1,4 @@
+-- Collections of a team belong to the team; owner_id stays the creator
+ALTER TABLE collections ADD COLUMN team_id UUID;
+
+CREATE INDEX idx_collections_team ON collections(team_id, created_at DESC) WHERE team_id IS NOT NULL;
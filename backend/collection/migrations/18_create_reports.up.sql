@@ -0,0 +1,27 @@
+-- Reports of shared collections, or of one of their items, for moderation.
+-- reporter is user:<id> for signed-in users and ip:<address> otherwise, so
+-- one reporter has one open report per collection or item.
+CREATE TABLE reports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    media_id UUID,
+    reason TEXT NOT NULL CHECK (reason IN ('spam', 'copyright', 'abuse', 'illegal', 'other')),
+    details TEXT NOT NULL DEFAULT '',
+    reporter TEXT NOT NULL,
+    reporter_id BIGINT,
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'actioned', 'dismissed')),
+    resolution_note TEXT NOT NULL DEFAULT '',
+    resolved_by BIGINT,
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_reports_open_reporter
+    ON reports(collection_id, COALESCE(media_id, '00000000-0000-0000-0000-000000000000'::uuid), reporter)
+    WHERE status = 'open';
+CREATE INDEX idx_reports_status ON reports(status, created_at);
+CREATE INDEX idx_reports_collection ON reports(collection_id, created_at DESC);
+
+-- Taken down collections have no share links and can't get new ones until
+-- the takedown is lifted
+ALTER TABLE collections ADD COLUMN taken_down_at TIMESTAMP;
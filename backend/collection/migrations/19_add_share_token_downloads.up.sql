@@ -0,0 +1,4 @@
+-- Share tokens can be limited to a number of downloads; holders of such a
+-- token only get files through the download endpoints, which count them
+ALTER TABLE collection_share_tokens ADD COLUMN max_downloads INT;
+ALTER TABLE collection_share_tokens ADD COLUMN downloads INT NOT NULL DEFAULT 0;
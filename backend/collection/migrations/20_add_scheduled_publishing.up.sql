@@ -0,0 +1,20 @@
+-- Scheduled publishing: a private collection switches to publish_visibility
+-- at publish_at
+ALTER TABLE collections
+    ADD COLUMN publish_at TIMESTAMP,
+    ADD COLUMN publish_visibility TEXT CHECK (publish_visibility IN ('unlisted', 'public')),
+    ADD COLUMN publish_to_discord BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX idx_collections_publish_at ON collections (publish_at) WHERE publish_at IS NOT NULL;
+
+-- Media the media service holds back until publish_at, mirrored from its
+-- media-schedule-changed events so item lists can leave it out. changed_at
+-- keeps a late event from undoing a newer one.
+CREATE TABLE scheduled_media (
+    media_id UUID PRIMARY KEY,
+    owner_id BIGINT NOT NULL,
+    publish_at TIMESTAMP,
+    changed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_scheduled_media_owner ON scheduled_media (owner_id, publish_at);
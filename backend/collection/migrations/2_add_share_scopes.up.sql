@@ -0,0 +1,3 @@
+-- What a share token grants: collection:read lists the items, media:read
+-- additionally includes stream URLs
+ALTER TABLE collections ADD COLUMN share_scopes TEXT[] NOT NULL DEFAULT '{collection:read,media:read}';
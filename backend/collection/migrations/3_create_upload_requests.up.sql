@@ -0,0 +1,27 @@
+-- Upload requests let guests upload into a collection with a token
+CREATE TABLE upload_requests (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    owner_id BIGINT NOT NULL,
+    token UUID NOT NULL UNIQUE DEFAULT gen_random_uuid(),
+    message TEXT,
+    max_files INT NOT NULL,
+    -- 0 means no per-file limit besides the owner's storage quota
+    max_file_size_bytes BIGINT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Uploads signed through an upload request; unconfirmed ones hold a slot
+-- while their upload URL is valid
+CREATE TABLE upload_request_uploads (
+    media_id UUID PRIMARY KEY,
+    upload_request_id UUID NOT NULL REFERENCES upload_requests(id) ON DELETE CASCADE,
+    size_bytes BIGINT,
+    confirmed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_upload_requests_collection ON upload_requests(collection_id);
+CREATE INDEX idx_upload_request_uploads_request ON upload_request_uploads(upload_request_id);
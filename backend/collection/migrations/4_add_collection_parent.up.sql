@@ -0,0 +1,5 @@
+-- Collections can be nested in a parent collection of the same owner, like
+-- folders. Children of a deleted collection move up to its parent.
+ALTER TABLE collections ADD COLUMN parent_id UUID REFERENCES collections(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_collections_parent ON collections(parent_id);
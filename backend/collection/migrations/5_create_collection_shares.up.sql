@@ -0,0 +1,10 @@
+-- Users a collection is shared with directly; they can view it and play its
+-- items without it being public or knowing the share token
+CREATE TABLE collection_shares (
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    shared_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (collection_id, user_id)
+);
+
+CREATE INDEX idx_collection_shares_user ON collection_shares(user_id);
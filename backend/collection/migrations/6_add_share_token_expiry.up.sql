@@ -0,0 +1,6 @@
+-- Share tokens can expire; expired tokens are replaced by the
+-- collection-share-expiry cron job so old links can't come back
+ALTER TABLE collections ADD COLUMN share_token_expires_at TIMESTAMP;
+
+CREATE INDEX idx_collections_share_token_expiry ON collections(share_token_expires_at)
+    WHERE share_token_expires_at IS NOT NULL;
@@ -0,0 +1,6 @@
+-- Views of a collection by other users, counted once per visit (its first
+-- page); the explore page sorts public collections by it
+ALTER TABLE collections ADD COLUMN view_count BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_collections_public_recent ON collections(created_at DESC) WHERE is_public;
+CREATE INDEX idx_collections_public_popular ON collections(view_count DESC, created_at DESC) WHERE is_public;
@@ -0,0 +1,4 @@
+-- Smart collections have no collection_items; their media is whatever of
+-- the owner's media matches the rules when the collection is fetched.
+-- NULL for manual collections.
+ALTER TABLE collections ADD COLUMN rules JSONB;
@@ -0,0 +1,2 @@
+-- Optional caption shown with an item of a collection, e.g. "take 3, approved"
+ALTER TABLE collection_items ADD COLUMN note TEXT;
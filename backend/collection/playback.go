@@ -0,0 +1,135 @@
+package collection
+
+import (
+	"context"
+	"math/rand"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	"encore.app/media"
+)
+
+// PlayRequest contains the optional token for access and how to play
+type PlayRequest struct {
+	Token string `query:"token"`
+	// Seed shuffles the collection the same way for the same seed; 0 plays
+	// it in order
+	Seed int64 `query:"seed"`
+	// Loop wraps around at the ends of the collection
+	Loop bool `query:"loop"`
+}
+
+// PlayResponse is the item to play next, or End when there is none
+type PlayResponse struct {
+	Item *CollectionMediaItem `json:"item,omitempty"`
+	// Position is the 1-based place of the item in the play order
+	Position int  `json:"position,omitempty"`
+	Total    int  `json:"total"`
+	End      bool `json:"end"`
+}
+
+// PlayNext returns the ready item after mediaID in the collection's order
+// (newest first, as GetCollection lists it) or its shuffled order, with its
+// stream URL, so players can continue playback
+//
+//encore:api public method=GET path=/collection/:id/play/:mediaID/next
+func PlayNext(ctx context.Context, id string, mediaID string, req *PlayRequest) (*PlayResponse, error) {
+	return playStep(ctx, id, mediaID, req, 1)
+}
+
+// PlayPrevious returns the ready item before mediaID, like PlayNext
+//
+//encore:api public method=GET path=/collection/:id/play/:mediaID/previous
+func PlayPrevious(ctx context.Context, id string, mediaID string, req *PlayRequest) (*PlayResponse, error) {
+	return playStep(ctx, id, mediaID, req, -1)
+}
+
+// playStep finds the first ready item from mediaID in direction (1 or -1)
+func playStep(ctx context.Context, id, mediaID string, req *PlayRequest, direction int) (*PlayResponse, error) {
+	var collection GetCollectionResponse
+	access, err := checkCollectionAccess(ctx, id, req.Token, &collection)
+	if err != nil {
+		return nil, err
+	}
+	if !access.IncludeStreams {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token does not grant media:read").Err()
+	}
+	if access.DownloadToken != "" {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("share token only allows downloads").Err()
+	}
+
+	all, _, err := collectionItems(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, 0, 0)
+	if err != nil {
+		rlog.Error("failed to get collection items", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	if req.Seed != 0 {
+		rand.New(rand.NewSource(req.Seed)).Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+	}
+
+	current := -1
+	var mediaIDs []string
+	for i, item := range all {
+		if item.MediaID == mediaID {
+			current = i
+		}
+		mediaIDs = append(mediaIDs, item.MediaID)
+	}
+	if current < 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+	}
+
+	// Only ready items can play; items a stream-only token can't play are
+	// skipped like unready ones
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get collection items").Err()
+	}
+	playable := func(m media.MediaInfo) bool {
+		return m.Status == "ready" && (m.HasProcessed || !access.StreamOnly)
+	}
+
+	// With Loop the walk may come back around to the current item itself
+	resp := &PlayResponse{Total: len(all)}
+	for step := 1; step < len(all) || (req.Loop && step == len(all)); step++ {
+		i := current + direction*step
+		if req.Loop {
+			i = ((i % len(all)) + len(all)) % len(all)
+		} else if i < 0 || i >= len(all) {
+			break
+		}
+		m, ok := info[all[i].MediaID]
+		if !ok || !playable(m) {
+			continue
+		}
+
+		// Stream URLs follow the owner's settings, whoever plays the collection
+		streams, err := resolveStreams(ctx, []string{m.ID}, media.ResolveStreamURLRequest{
+			StreamOnly: access.StreamOnly,
+			Viewer:     callerKey(access.UserID),
+		})
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to generate stream URL").Err()
+		}
+		item := CollectionMediaItem{
+			ID:               m.ID,
+			Title:            m.Title,
+			OriginalFilename: m.OriginalFilename,
+			MimeType:         m.MimeType,
+			Status:           m.Status,
+			StreamURL:        streams[m.ID].StreamURL,
+			AddedAt:          all[i].AddedAt,
+			Note:             all[i].Note,
+		}
+
+		resp.Item = &item
+		resp.Position = i + 1
+		return resp, nil
+	}
+
+	resp.End = true
+	return resp, nil
+}
@@ -0,0 +1,407 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Report statuses
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// reportReasons are the reasons a report can give
+var reportReasons = []string{"spam", "copyright", "abuse", "illegal", "other"}
+
+// maxReportDetailsRunes caps the details of a report and a resolution note
+const maxReportDetailsRunes = 2000
+
+// ReportRequest reports a collection, or one of its items, to the admins
+type ReportRequest struct {
+	// Token is the share token the reporter sees the collection with
+	Token string `json:"token,omitempty"`
+	// MediaID reports one item instead of the whole collection
+	MediaID string `json:"media_id,omitempty"`
+	// Reason is spam, copyright, abuse, illegal or other
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+// ReportResponse acknowledges a report
+type ReportResponse struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Report is a report in the moderation queue
+type Report struct {
+	ID              string `json:"id"`
+	CollectionID    string `json:"collection_id"`
+	CollectionTitle string `json:"collection_title"`
+	OwnerID         int64  `json:"owner_id"`
+	MediaID         string `json:"media_id,omitempty"`
+	Reason          string `json:"reason"`
+	Details         string `json:"details"`
+	// ReporterID is the reporting user, 0 for anonymous reports
+	ReporterID     int64      `json:"reporter_id,omitempty"`
+	Status         string     `json:"status"`
+	ResolutionNote string     `json:"resolution_note,omitempty"`
+	ResolvedBy     int64      `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	// TakenDownAt is set while the collection is taken down
+	TakenDownAt *time.Time `json:"taken_down_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ListReportsRequest selects a page of the moderation queue
+type ListReportsRequest struct {
+	// Status is open by default
+	Status       string `query:"status"`
+	CollectionID string `query:"collection_id"`
+	Page         int    `query:"page"`
+	PageSize     int    `query:"page_size"`
+}
+
+// ListReportsResponse is a page of the moderation queue
+type ListReportsResponse struct {
+	Reports    []Report `json:"reports"`
+	TotalCount int      `json:"total_count"`
+	Page       int      `json:"page"`
+	PageSize   int      `json:"page_size"`
+}
+
+// ResolveReportRequest closes an open report
+type ResolveReportRequest struct {
+	// Status is actioned, which takes the collection down, or dismissed
+	Status string `json:"status"`
+	Note   string `json:"note,omitempty"`
+}
+
+// ReportCollection reports a collection or one of its items to the admins.
+// Anyone who can see the collection may report it, signed in or not; a
+// reporter has at most one open report per collection or item, and
+// reporting again returns it.
+//
+//encore:api public method=POST path=/collection/:id/report
+func ReportCollection(ctx context.Context, id string, req *ReportRequest) (*ReportResponse, error) {
+	var collection GetCollectionResponse
+	access, err := checkCollectionAccess(ctx, id, req.Token, &collection)
+	if err != nil {
+		return nil, err
+	}
+	if access.IsOwner {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("you can't report your own collection").Err()
+	}
+
+	req.Reason = strings.ToLower(strings.TrimSpace(req.Reason))
+	if !slices.Contains(reportReasons, req.Reason) {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg("reason must be spam, copyright, abuse, illegal or other").Err()
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	if utf8.RuneCountInString(req.Details) > maxReportDetailsRunes {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("details must be at most 2000 characters").Err()
+	}
+	var mediaID *string
+	if req.MediaID != "" {
+		parsed, err := uuid.Parse(req.MediaID)
+		if err != nil || !hasCollectionItem(ctx, id, access.OwnerID, access.Rules, access.MediaIDs, access.Scheduled, parsed.String()) {
+			return nil, errs.B().Code(errs.NotFound).Msg("media not found in collection").Err()
+		}
+		m := parsed.String()
+		mediaID = &m
+	}
+
+	reporter := callerKey(access.UserID)
+	if reporter == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("reporter could not be identified").Err()
+	}
+
+	var resp ReportResponse
+	err = db.QueryRow(ctx, `
+		INSERT INTO reports (collection_id, media_id, reason, details, reporter, reporter_id, created_at)
+		VALUES ($1, $2::uuid, $3, $4, $5, NULLIF($6, 0), NOW())
+		ON CONFLICT (collection_id, COALESCE(media_id, '00000000-0000-0000-0000-000000000000'::uuid), reporter)
+			WHERE status = 'open' DO NOTHING
+		RETURNING id::text, status, created_at
+	`, id, mediaID, req.Reason, req.Details, reporter, access.UserID).Scan(&resp.ID, &resp.Status, &resp.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// Already reported by this reporter
+		err = db.QueryRow(ctx, `
+			SELECT id::text, status, created_at FROM reports
+			WHERE collection_id = $1 AND media_id IS NOT DISTINCT FROM $2::uuid AND reporter = $3 AND status = 'open'
+		`, id, mediaID, reporter).Scan(&resp.ID, &resp.Status, &resp.CreatedAt)
+	}
+	if err != nil {
+		rlog.Error("failed to store report", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to report collection").Err()
+	}
+
+	rlog.Info("collection reported", "report_id", resp.ID, "collection_id", id, "reason", req.Reason)
+	return &resp, nil
+}
+
+// ListReports returns a page of reports, oldest first, for the moderation
+// queue (admin only)
+//
+//encore:api auth method=GET path=/admin/reports
+func ListReports(ctx context.Context, req *ListReportsRequest) (*ListReportsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+
+	status := req.Status
+	if status == "" {
+		status = ReportOpen
+	}
+	if status != ReportOpen && status != ReportActioned && status != ReportDismissed {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("status must be open, actioned or dismissed").Err()
+	}
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	resp := &ListReportsResponse{Reports: []Report{}, Page: page, PageSize: pageSize}
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM reports WHERE status = $1 AND ($2 = '' OR collection_id::text = $2)
+	`, status, req.CollectionID).Scan(&resp.TotalCount)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list reports").Err()
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT r.id::text, r.collection_id::text, c.title, c.owner_id, COALESCE(r.media_id::text, ''), r.reason,
+			   r.details, COALESCE(r.reporter_id, 0), r.status, r.resolution_note, COALESCE(r.resolved_by, 0),
+			   r.resolved_at, c.taken_down_at, r.created_at
+		FROM reports r
+		JOIN collections c ON c.id = r.collection_id
+		WHERE r.status = $1 AND ($2 = '' OR r.collection_id::text = $2)
+		ORDER BY r.created_at, r.id
+		LIMIT $3 OFFSET $4
+	`, status, req.CollectionID, pageSize, offset)
+	if err != nil {
+		rlog.Error("failed to list reports", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list reports").Err()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Report
+		if err := rows.Scan(&r.ID, &r.CollectionID, &r.CollectionTitle, &r.OwnerID, &r.MediaID, &r.Reason,
+			&r.Details, &r.ReporterID, &r.Status, &r.ResolutionNote, &r.ResolvedBy, &r.ResolvedAt, &r.TakenDownAt,
+			&r.CreatedAt); err != nil {
+			continue
+		}
+		resp.Reports = append(resp.Reports, r)
+	}
+	return resp, nil
+}
+
+// ResolveReport closes an open report (admin only). Actioning it takes the
+// collection down: it becomes private, its share token is replaced, its
+// extra share tokens and upload requests go, and its owner can't share it
+// again until the takedown is lifted. The other open reports of the
+// collection are actioned with it.
+//
+//encore:api auth method=PATCH path=/admin/reports/:id
+func ResolveReport(ctx context.Context, id string, req *ResolveReportRequest) (*Report, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+	if req.Status != ReportActioned && req.Status != ReportDismissed {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("status must be actioned or dismissed").Err()
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if utf8.RuneCountInString(req.Note) > maxReportDetailsRunes {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("note must be at most 2000 characters").Err()
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("report not found").Err()
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to resolve report").Err()
+	}
+	defer tx.Rollback()
+
+	var collectionID, status string
+	err = tx.QueryRow(ctx, `
+		SELECT collection_id::text, status FROM reports WHERE id = $1 FOR UPDATE
+	`, id).Scan(&collectionID, &status)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.NotFound).Msg("report not found").Err()
+	}
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to resolve report").Err()
+	}
+	if status != ReportOpen {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg(fmt.Sprintf("report is already %s", status)).Err()
+	}
+
+	// Actioning closes every open report of the collection, dismissing only
+	// this one
+	_, err = tx.Exec(ctx, `
+		UPDATE reports SET status = $2, resolution_note = $3, resolved_by = $4, resolved_at = NOW()
+		WHERE status = 'open' AND (id = $1 OR ($2 = 'actioned' AND collection_id = $5))
+	`, id, req.Status, req.Note, userData.UserID, collectionID)
+	if err != nil {
+		rlog.Error("failed to resolve report", "error", err, "report_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to resolve report").Err()
+	}
+
+	var before *auditedCollection
+	if req.Status == ReportActioned {
+		before = collectionSnapshot(ctx, collectionID)
+		if err := takeDown(ctx, tx, collectionID); err != nil {
+			rlog.Error("failed to take collection down", "error", err, "collection_id", collectionID)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to resolve report").Err()
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to resolve report").Err()
+	}
+
+	details := map[string]string{"report_id": id, "status": req.Status}
+	if req.Status == ReportActioned {
+		recordAudit(ctx, userData.UserID, auditCollectionTakenDown, "collection", collectionID, before,
+			collectionSnapshot(ctx, collectionID), details)
+		publishUpdate(ctx, collectionID, changeUpdated, nil)
+	} else {
+		recordAudit(ctx, userData.UserID, auditReportDismissed, "collection", collectionID, nil, nil, details)
+	}
+
+	return getReport(ctx, id)
+}
+
+// LiftTakedownResponse confirms a lifted takedown
+type LiftTakedownResponse struct {
+	Success bool `json:"success"`
+}
+
+// LiftTakedown lets the owner of a taken down collection share it again
+// (admin only). The collection stays private and its old links stay dead.
+//
+//encore:api auth method=DELETE path=/admin/collections/:id/takedown
+func LiftTakedown(ctx context.Context, id string) (*LiftTakedownResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE collections SET taken_down_at = NULL WHERE id::text = $1 AND taken_down_at IS NOT NULL
+	`, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to lift takedown").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection is not taken down").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditTakedownLifted, "collection", id, nil, nil, nil)
+	publishUpdate(ctx, id, changeUpdated, nil)
+
+	return &LiftTakedownResponse{Success: true}, nil
+}
+
+// takeDown disables every link to a collection: it becomes private, its
+// share token is replaced, its scheduled publication is cancelled, and its
+// extra share tokens and open upload requests go
+func takeDown(ctx context.Context, tx *sqldb.Tx, collectionID string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE collections
+		SET visibility = 'private', share_token = gen_random_uuid(), share_token_expires_at = NULL,
+			taken_down_at = COALESCE(taken_down_at, NOW()), publish_at = NULL, publish_visibility = NULL,
+			publish_to_discord = FALSE
+		WHERE id = $1
+	`, collectionID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM collection_share_tokens WHERE collection_id = $1`, collectionID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE upload_requests SET revoked_at = NOW() WHERE collection_id = $1 AND revoked_at IS NULL
+	`, collectionID)
+	return err
+}
+
+// checkNotTakenDown fails for taken down collections, which can't be shared
+// or copied
+func checkNotTakenDown(ctx context.Context, collectionID string) error {
+	var takenDown bool
+	err := db.QueryRow(ctx, `
+		SELECT taken_down_at IS NOT NULL FROM collections WHERE id = $1
+	`, collectionID).Scan(&takenDown)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	if takenDown {
+		return errs.B().Code(errs.FailedPrecondition).Msg("collection was taken down and can't be shared or copied").Err()
+	}
+	return nil
+}
+
+// getReport loads a report for the moderation queue
+func getReport(ctx context.Context, id string) (*Report, error) {
+	var r Report
+	err := db.QueryRow(ctx, `
+		SELECT r.id::text, r.collection_id::text, c.title, c.owner_id, COALESCE(r.media_id::text, ''), r.reason,
+			   r.details, COALESCE(r.reporter_id, 0), r.status, r.resolution_note, COALESCE(r.resolved_by, 0),
+			   r.resolved_at, c.taken_down_at, r.created_at
+		FROM reports r
+		JOIN collections c ON c.id = r.collection_id
+		WHERE r.id = $1
+	`, id).Scan(&r.ID, &r.CollectionID, &r.CollectionTitle, &r.OwnerID, &r.MediaID, &r.Reason, &r.Details,
+		&r.ReporterID, &r.Status, &r.ResolutionNote, &r.ResolvedBy, &r.ResolvedAt, &r.TakenDownAt, &r.CreatedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("report not found").Err()
+	}
+	return &r, nil
+}
+
+// callerKey identifies a caller: the user, or the client's address when
+// anonymous. The address is the last X-Forwarded-For entry, the one the
+// reverse proxy appended; earlier entries come from the client and could be
+// anything.
+func callerKey(userID int64) string {
+	if userID != 0 {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	req := encore.CurrentRequest()
+	if req == nil || req.Headers == nil {
+		return ""
+	}
+	hops := strings.Split(req.Headers.Get("X-Forwarded-For"), ",")
+	ip := strings.TrimSpace(hops[len(hops)-1])
+	if ip == "" {
+		return ""
+	}
+	return "ip:" + ip
+}
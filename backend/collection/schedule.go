@@ -0,0 +1,355 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/discordwebhook"
+	"encore.app/media"
+)
+
+// maxScheduleAhead is how far ahead collections can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// publishBatch is the most collections one publishing run releases
+const publishBatch = 100
+
+// CollectionSchedule is when and how a private collection is published
+type CollectionSchedule struct {
+	PublishAt time.Time `json:"publish_at"`
+	// Visibility is what the collection switches to, "unlisted" or "public"
+	Visibility string `json:"visibility"`
+	// PostToDiscord posts the collection to the owner's Discord webhook
+	// once it is published
+	PostToDiscord bool `json:"post_to_discord"`
+}
+
+// CollectionPublished is published when a scheduled collection goes live
+type CollectionPublished struct {
+	CollectionID string    `json:"collection_id"`
+	Title        string    `json:"title"`
+	OwnerID      int64     `json:"owner_id"`
+	Visibility   string    `json:"visibility"`
+	PublishedAt  time.Time `json:"published_at"`
+}
+
+// CollectionPublishedTopic carries published collections to the
+// notification subsystem, which tells their owners
+var CollectionPublishedTopic = pubsub.NewTopic[*CollectionPublished]("collection-published", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// ScheduleCollectionRequest sets when a collection is published
+type ScheduleCollectionRequest struct {
+	PublishAt time.Time `json:"publish_at"`
+	// Visibility is "unlisted" or "public" (the default)
+	Visibility    string `json:"visibility,omitempty"`
+	PostToDiscord bool   `json:"post_to_discord,omitempty"`
+}
+
+// ScheduleCollectionResponse is the collection's visibility and schedule
+type ScheduleCollectionResponse struct {
+	Visibility string `json:"visibility"`
+	// Schedule is nil when nothing is scheduled
+	Schedule *CollectionSchedule `json:"schedule"`
+}
+
+// ScheduleCollection makes one of the caller's collections private until
+// publish_at, when the collection-scheduled-publish job switches it to the
+// requested visibility. Scheduling it again replaces the schedule;
+// choosing a visibility with PUT /collection/:id/share cancels it.
+//
+//encore:api auth method=PUT path=/collection/:id/schedule
+func ScheduleCollection(ctx context.Context, id string, req *ScheduleCollectionRequest) (*ScheduleCollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
+	if !req.PublishAt.After(time.Now()) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("publish_at must be in the future").Err()
+	}
+	if req.PublishAt.After(time.Now().Add(maxScheduleAhead)) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("publish_at must be within a year").Err()
+	}
+	schedule := CollectionSchedule{
+		PublishAt:     req.PublishAt.UTC(),
+		Visibility:    req.Visibility,
+		PostToDiscord: req.PostToDiscord,
+	}
+	switch schedule.Visibility {
+	case "":
+		schedule.Visibility = VisibilityPublic
+	case VisibilityUnlisted, VisibilityPublic:
+	default:
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("visibility must be unlisted or public").Err()
+	}
+	if schedule.PostToDiscord {
+		settings, err := authpkg.GetUserSettings(ctx, &authpkg.UserSettingsRequest{UserID: userData.UserID})
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to load settings").Err()
+		}
+		if settings.DiscordWebhookURL == "" {
+			return nil, errs.B().Code(errs.FailedPrecondition).
+				Msg("set discord_webhook_url in /auth/settings first").Err()
+		}
+	}
+
+	before := collectionSnapshot(ctx, id)
+	_, err := db.Exec(ctx, `
+		UPDATE collections
+		SET visibility = $2, publish_at = $3, publish_visibility = $4, publish_to_discord = $5
+		WHERE id = $1
+	`, id, VisibilityPrivate, schedule.PublishAt, schedule.Visibility, schedule.PostToDiscord)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to schedule collection").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditPublishScheduled, "collection", id, before, collectionSnapshot(ctx, id), nil)
+	publishUpdate(ctx, id, changeUpdated, nil)
+
+	return &ScheduleCollectionResponse{Visibility: VisibilityPrivate, Schedule: &schedule}, nil
+}
+
+// UnscheduleCollection cancels a collection's scheduled publication; the
+// collection stays private
+//
+//encore:api auth method=DELETE path=/collection/:id/schedule
+func UnscheduleCollection(ctx context.Context, id string) (*ScheduleCollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	before := collectionSnapshot(ctx, id)
+	var visibility string
+	err := db.QueryRow(ctx, `
+		UPDATE collections
+		SET publish_at = NULL, publish_visibility = NULL, publish_to_discord = FALSE
+		WHERE id = $1
+		RETURNING visibility
+	`, id).Scan(&visibility)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to cancel schedule").Err()
+	}
+	if before != nil && before.PublishAt != nil {
+		recordAudit(ctx, userData.UserID, auditPublishUnscheduled, "collection", id, before, collectionSnapshot(ctx, id), nil)
+		publishUpdate(ctx, id, changeUpdated, nil)
+	}
+
+	return &ScheduleCollectionResponse{Visibility: visibility}, nil
+}
+
+// Scheduled collections are published every minute
+var _ = cron.NewJob("collection-scheduled-publish", cron.JobConfig{
+	Title:    "Publish scheduled collections",
+	Every:    1 * cron.Minute,
+	Endpoint: PublishScheduledCollections,
+})
+
+// PublishScheduledCollectionsResponse reports how many collections were
+// published
+type PublishScheduledCollectionsResponse struct {
+	Published int `json:"published"`
+}
+
+// PublishScheduledCollections switches collections whose publish_at has
+// passed to their scheduled visibility, tells their owners and posts them
+// to Discord if asked to. Collections in the trash wait until they are
+// restored.
+//
+//encore:api private
+func PublishScheduledCollections(ctx context.Context) (*PublishScheduledCollectionsResponse, error) {
+	rows, err := db.Query(ctx, `
+		WITH due AS (
+			SELECT id, publish_to_discord FROM collections
+			WHERE publish_at <= NOW() AND deleted_at IS NULL AND taken_down_at IS NULL
+			ORDER BY publish_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE collections c
+		SET visibility = COALESCE(c.publish_visibility, c.visibility), publish_at = NULL, publish_visibility = NULL,
+			publish_to_discord = FALSE
+		FROM due
+		WHERE c.id = due.id
+		RETURNING c.id::text, c.owner_id, c.title, c.visibility, due.publish_to_discord
+	`, publishBatch)
+	if err != nil {
+		return nil, err
+	}
+	type publication struct {
+		msg           CollectionPublished
+		postToDiscord bool
+	}
+	var due []publication
+	for rows.Next() {
+		var d publication
+		if err := rows.Scan(&d.msg.CollectionID, &d.msg.OwnerID, &d.msg.Title, &d.msg.Visibility, &d.postToDiscord); err != nil {
+			continue
+		}
+		d.msg.PublishedAt = time.Now()
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		id := d.msg.CollectionID
+		recordAudit(ctx, d.msg.OwnerID, auditCollectionPublished, "collection", id, nil, collectionSnapshot(ctx, id),
+			map[string]string{"visibility": d.msg.Visibility})
+		publishUpdate(ctx, id, changeUpdated, nil)
+		if _, err := CollectionPublishedTopic.Publish(ctx, &d.msg); err != nil {
+			rlog.Error("failed to publish collection publication", "error", err, "collection_id", id)
+		}
+		if d.postToDiscord {
+			postPublishedToDiscord(ctx, d.msg.OwnerID, id)
+		}
+	}
+	if len(due) > 0 {
+		rlog.Info("scheduled collections published", "count", len(due))
+	}
+	return &PublishScheduledCollectionsResponse{Published: len(due)}, nil
+}
+
+// postPublishedToDiscord posts a just published collection to its owner's
+// Discord webhook. The collection is published either way, so failures
+// are only logged.
+func postPublishedToDiscord(ctx context.Context, ownerID int64, collectionID string) {
+	settings, err := authpkg.GetUserSettings(ctx, &authpkg.UserSettingsRequest{UserID: ownerID})
+	if err != nil || settings.DiscordWebhookURL == "" {
+		rlog.Warn("scheduled Discord post skipped, no webhook", "error", err, "collection_id", collectionID)
+		return
+	}
+	msg, _, err := collectionDiscordMessage(ctx, collectionID, "", nil, "")
+	if err == nil {
+		err = discordwebhook.Post(ctx, settings.DiscordWebhookURL, msg)
+	}
+	if err != nil {
+		rlog.Warn("failed to post scheduled collection to Discord", "error", err, "collection_id", collectionID,
+			"webhook_gone", errors.Is(err, discordwebhook.ErrGone))
+		return
+	}
+	recordAudit(ctx, ownerID, auditPostedToDiscord, "collection", collectionID, nil, nil,
+		map[string]string{"scheduled": "true"})
+}
+
+// Media schedules are mirrored so item lists can leave out media that
+// isn't published yet
+var _ = pubsub.NewSubscription(media.MediaScheduleChangedTopic, "collection-media-schedule",
+	pubsub.SubscriptionConfig[*media.MediaScheduleChanged]{
+		Handler: mirrorMediaSchedule,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// mirrorMediaSchedule records when media is published and, once media that
+// was held back is published, tells the followers of the collections it is
+// in. Changes older than the recorded one are ignored.
+func mirrorMediaSchedule(ctx context.Context, msg *media.MediaScheduleChanged) error {
+	var wasScheduled bool
+	err := db.QueryRow(ctx, `
+		WITH previous AS (
+			SELECT publish_at FROM scheduled_media WHERE media_id = $1
+		)
+		INSERT INTO scheduled_media (media_id, owner_id, publish_at, changed_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (media_id) DO UPDATE SET publish_at = EXCLUDED.publish_at, changed_at = EXCLUDED.changed_at
+		WHERE scheduled_media.changed_at < EXCLUDED.changed_at
+		RETURNING EXISTS (SELECT 1 FROM previous WHERE publish_at IS NOT NULL)
+	`, msg.MediaID, msg.OwnerID, msg.PublishAt, msg.ChangedAt).Scan(&wasScheduled)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if msg.PublishAt != nil || !wasScheduled {
+		return nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT i.collection_id::text FROM collection_items i
+		JOIN collections c ON c.id = i.collection_id
+		WHERE i.media_id = $1 AND c.deleted_at IS NULL
+	`, msg.MediaID)
+	if err != nil {
+		return err
+	}
+	var collectionIDs []string
+	for rows.Next() {
+		var collectionID string
+		if err := rows.Scan(&collectionID); err == nil {
+			collectionIDs = append(collectionIDs, collectionID)
+		}
+	}
+	rows.Close()
+	for _, collectionID := range collectionIDs {
+		notifyFollowers(ctx, collectionID, []string{msg.MediaID})
+	}
+	return nil
+}
+
+// publishedOnly leaves out the media that is scheduled to be published later
+func publishedOnly(ctx context.Context, mediaIDs []string) []string {
+	rows, err := db.Query(ctx, `
+		SELECT media_id::text FROM scheduled_media
+		WHERE media_id = ANY($1::uuid[]) AND publish_at > NOW()
+	`, mediaIDs)
+	if err != nil {
+		return mediaIDs
+	}
+	defer rows.Close()
+	scheduled := map[string]bool{}
+	for rows.Next() {
+		var mediaID string
+		if err := rows.Scan(&mediaID); err == nil {
+			scheduled[mediaID] = true
+		}
+	}
+	if len(scheduled) == 0 {
+		return mediaIDs
+	}
+	var published []string
+	for _, mediaID := range mediaIDs {
+		if !scheduled[mediaID] {
+			published = append(published, mediaID)
+		}
+	}
+	return published
+}
+
+// hasScheduledItems reports whether a collection has items scheduled to be
+// published later: for smart collections, whether the owner has any
+// scheduled media
+func hasScheduledItems(ctx context.Context, id string, ownerID int64, rules *SmartRules) bool {
+	var found bool
+	var err error
+	if rules != nil {
+		err = db.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM scheduled_media WHERE owner_id = $1 AND publish_at > NOW())
+		`, ownerID).Scan(&found)
+	} else {
+		err = db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM collection_items i JOIN scheduled_media s ON s.media_id = i.media_id
+				WHERE i.collection_id = $1 AND s.publish_at > NOW()
+			)
+		`, id).Scan(&found)
+	}
+	return err == nil && found
+}
@@ -0,0 +1,206 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// maxShareUsers is the most users one ShareWithUsers call may name
+const maxShareUsers = 50
+
+// SharedUser is a user a collection is shared with
+type SharedUser struct {
+	UserID      int64     `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	SharedAt    time.Time `json:"shared_at"`
+}
+
+// ShareWithUsersRequest names the users to share with, by user ID or
+// Discord username
+type ShareWithUsersRequest struct {
+	Users []string `json:"users"`
+}
+
+// SharedUsersResponse lists the users a collection is shared with
+type SharedUsersResponse struct {
+	Users []SharedUser `json:"users"`
+}
+
+// ShareWithUsers gives named users access to the collection, including its
+// stream URLs, without making it public or handing out the share token
+//
+//encore:api auth method=POST path=/collection/:id/share/users
+func ShareWithUsers(ctx context.Context, id string, req *ShareWithUsersRequest) (*SharedUsersResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	if len(req.Users) == 0 || len(req.Users) > maxShareUsers {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("users must name 1 to 50 users").Err()
+	}
+
+	// Resolve every user first, so a typo shares with nobody
+	var userIDs []int64
+	for _, identifier := range req.Users {
+		profile, err := authpkg.ResolveUser(ctx, &authpkg.ResolveUserRequest{Identifier: identifier})
+		if err != nil {
+			return nil, err
+		}
+		if profile.UserID == userData.UserID {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("a collection can't be shared with its owner").Err()
+		}
+		userIDs = append(userIDs, profile.UserID)
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO collection_shares (collection_id, user_id, shared_at)
+		SELECT $1, unnest($2::bigint[]), NOW()
+		ON CONFLICT DO NOTHING
+	`, id, userIDs)
+	if err != nil {
+		rlog.Error("failed to share collection", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to share collection").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditSharedWithUsers, "collection", id, nil,
+		map[string][]int64{"user_ids": userIDs}, nil)
+
+	return listSharedUsers(ctx, id)
+}
+
+// ListSharedUsers returns the users the collection is shared with
+//
+//encore:api auth method=GET path=/collection/:id/share/users
+func ListSharedUsers(ctx context.Context, id string) (*SharedUsersResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	return listSharedUsers(ctx, id)
+}
+
+// UnshareWithUser takes a user's access to the collection away
+//
+//encore:api auth method=DELETE path=/collection/:id/share/users/:userID
+func UnshareWithUser(ctx context.Context, id string, userID int64) (*SharedUsersResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec(ctx, `
+		DELETE FROM collection_shares WHERE collection_id = $1 AND user_id = $2
+	`, id, userID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to unshare collection").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection is not shared with this user").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditUnsharedWithUser, "collection", id,
+		map[string][]int64{"user_ids": {userID}}, nil, nil)
+
+	return listSharedUsers(ctx, id)
+}
+
+// listSharedUsers returns the users a collection is shared with and their
+// public profiles
+func listSharedUsers(ctx context.Context, collectionID string) (*SharedUsersResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT user_id, shared_at FROM collection_shares
+		WHERE collection_id = $1
+		ORDER BY shared_at, user_id
+	`, collectionID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list shared users").Err()
+	}
+	defer rows.Close()
+
+	users := []SharedUser{}
+	for rows.Next() {
+		var u SharedUser
+		if err := rows.Scan(&u.UserID, &u.SharedAt); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+
+	for i := range users {
+		profile, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: users[i].UserID})
+		if err != nil {
+			continue
+		}
+		users[i].DisplayName = profile.DisplayName
+		users[i].AvatarURL = profile.AvatarURL
+	}
+
+	return &SharedUsersResponse{Users: users}, nil
+}
+
+// isSharedWith reports whether the collection is shared with the user
+func isSharedWith(ctx context.Context, collectionID string, userID int64) bool {
+	if userID == 0 {
+		return false
+	}
+	var shared bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM collection_shares WHERE collection_id = $1 AND user_id = $2)
+	`, collectionID, userID).Scan(&shared)
+	return err == nil && shared
+}
+
+// SharedCollection is a collection another user shared with the caller
+type SharedCollection struct {
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Owner       *authpkg.PublicProfile `json:"owner,omitempty"`
+	SharedAt    time.Time              `json:"shared_at"`
+}
+
+// sharedWithUser returns the collections shared with the user, most
+// recently shared first
+func sharedWithUser(ctx context.Context, userID int64) ([]SharedCollection, error) {
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.owner_id, c.title, COALESCE(c.description, ''), s.shared_at
+		FROM collection_shares s JOIN collections c ON c.id = s.collection_id
+		WHERE s.user_id = $1 AND c.deleted_at IS NULL
+		ORDER BY s.shared_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []SharedCollection{}
+	ownerIDs := []int64{}
+	for rows.Next() {
+		var c SharedCollection
+		var ownerID int64
+		if err := rows.Scan(&c.ID, &ownerID, &c.Title, &c.Description, &c.SharedAt); err != nil {
+			continue
+		}
+		collections = append(collections, c)
+		ownerIDs = append(ownerIDs, ownerID)
+	}
+
+	// Owners usually share several collections
+	owners := map[int64]*authpkg.PublicProfile{}
+	for i, ownerID := range ownerIDs {
+		if _, ok := owners[ownerID]; !ok {
+			owners[ownerID], _ = authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: ownerID})
+		}
+		collections[i].Owner = owners[ownerID]
+	}
+
+	return collections, nil
+}
@@ -0,0 +1,414 @@
+package collection
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Limits on extra share tokens
+const (
+	maxShareTokens          = 50
+	maxShareTokenLabelRunes = 100
+	maxShareTokenDownloads  = 1000
+)
+
+// ShareToken is an extra share token of a collection, e.g. one per client
+type ShareToken struct {
+	Token  string   `json:"token"`
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+	// MediaIDs restricts the token to these items; empty for all of them
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// StreamOnly withholds the ZIP download and original files
+	StreamOnly bool       `json:"stream_only"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ShareURL   string     `json:"share_url"`
+	// MaxDownloads limits how many downloads the token allows, after which
+	// it stops working; its holder gets no stream URLs, only downloads
+	MaxDownloads *int `json:"max_downloads,omitempty"`
+	Downloads    int  `json:"downloads"`
+}
+
+// CreateShareTokenRequest describes a new share token
+type CreateShareTokenRequest struct {
+	Label string `json:"label,omitempty"`
+	// Scopes are collection:read and media:read by default
+	Scopes []string `json:"scopes,omitempty"`
+	// MediaIDs restricts the token to these items of the collection
+	MediaIDs   []string   `json:"media_ids,omitempty"`
+	StreamOnly bool       `json:"stream_only,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	// MaxDownloads makes a one-time (or n-time) delivery link, 1 to 1000
+	MaxDownloads *int `json:"max_downloads,omitempty"`
+}
+
+// UpdateShareTokenRequest changes a share token; fields left out stay
+type UpdateShareTokenRequest struct {
+	Label    *string  `json:"label,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// AllItems lifts the token's item restriction
+	AllItems    bool       `json:"all_items,omitempty"`
+	StreamOnly  *bool      `json:"stream_only,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	ClearExpiry bool       `json:"clear_expiry,omitempty"`
+	// MaxDownloads sets the download limit, counting the downloads made so
+	// far; 0 removes it
+	MaxDownloads *int `json:"max_downloads,omitempty"`
+}
+
+// ListShareTokensResponse lists a collection's extra share tokens
+type ListShareTokensResponse struct {
+	Tokens []ShareToken `json:"tokens"`
+}
+
+// CreateShareToken mints another share token for the collection, next to
+// its main one. Each can be limited to some of the items, so a client only
+// sees their own clips, to streaming them, or to a number of downloads.
+//
+//encore:api auth method=POST path=/collection/:id/share/tokens
+func CreateShareToken(ctx context.Context, id string, req *CreateShareTokenRequest) (*ShareToken, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
+
+	t := ShareToken{Label: strings.TrimSpace(req.Label), StreamOnly: req.StreamOnly, ExpiresAt: req.ExpiresAt}
+	if utf8.RuneCountInString(t.Label) > maxShareTokenLabelRunes {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("label must be at most 100 characters").Err()
+	}
+	t.Scopes = []string{authpkg.ScopeCollectionRead, authpkg.ScopeMediaRead}
+	if req.Scopes != nil {
+		if err := validateShareScopes(req.Scopes); err != nil {
+			return nil, err
+		}
+		t.Scopes = req.Scopes
+	}
+	if req.MediaIDs != nil {
+		mediaIDs, err := shareTokenMedia(ctx, id, req.MediaIDs)
+		if err != nil {
+			return nil, err
+		}
+		t.MediaIDs = mediaIDs
+	}
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("expires_at must be in the future").Err()
+	}
+	if req.MaxDownloads != nil {
+		if *req.MaxDownloads < 1 || *req.MaxDownloads > maxShareTokenDownloads {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("max_downloads must be between 1 and 1000").Err()
+		}
+		t.MaxDownloads = req.MaxDownloads
+	}
+	if err := checkDownloadLimit(t); err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM collection_share_tokens WHERE collection_id = $1
+	`, id).Scan(&count); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create share token").Err()
+	}
+	if count >= maxShareTokens {
+		return nil, errs.B().Code(errs.ResourceExhausted).Msg("a collection can have at most 50 share tokens").Err()
+	}
+
+	err := db.QueryRow(ctx, `
+		INSERT INTO collection_share_tokens (collection_id, label, scopes, media_ids, stream_only, max_downloads,
+			expires_at, created_at)
+		VALUES ($1, $2, $3, $4::uuid[], $5, $6, $7, NOW())
+		RETURNING token::text, created_at
+	`, id, t.Label, t.Scopes, t.MediaIDs, t.StreamOnly, t.MaxDownloads, t.ExpiresAt).Scan(&t.Token, &t.CreatedAt)
+	if err != nil {
+		rlog.Error("failed to create share token", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create share token").Err()
+	}
+	t.ShareURL = "/collection/" + id + "?token=" + t.Token
+	recordAudit(ctx, userData.UserID, auditShareTokenCreated, "collection", id, nil, auditedShareToken(t),
+		shareTokenDetails(t.Token))
+
+	return &t, nil
+}
+
+// ListShareTokens returns the collection's extra share tokens, oldest first
+//
+//encore:api auth method=GET path=/collection/:id/share/tokens
+func ListShareTokens(ctx context.Context, id string) (*ListShareTokensResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT token::text, label, scopes, media_ids::text[], stream_only, max_downloads, downloads, expires_at,
+			   created_at
+		FROM collection_share_tokens
+		WHERE collection_id = $1
+		ORDER BY created_at, token
+	`, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list share tokens").Err()
+	}
+	defer rows.Close()
+
+	resp := &ListShareTokensResponse{Tokens: []ShareToken{}}
+	for rows.Next() {
+		var t ShareToken
+		if err := rows.Scan(&t.Token, &t.Label, &t.Scopes, &t.MediaIDs, &t.StreamOnly, &t.MaxDownloads,
+			&t.Downloads, &t.ExpiresAt, &t.CreatedAt); err != nil {
+			continue
+		}
+		t.ShareURL = "/collection/" + id + "?token=" + t.Token
+		resp.Tokens = append(resp.Tokens, t)
+	}
+	return resp, nil
+}
+
+// UpdateShareToken changes a share token's label, scopes, items or expiry.
+// Like the main share token, an expired token can't be revived.
+//
+//encore:api auth method=PATCH path=/collection/:id/share/tokens/:token
+func UpdateShareToken(ctx context.Context, id string, token string, req *UpdateShareTokenRequest) (*ShareToken, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	t := lookupShareTokenAny(ctx, id, token)
+	if t == nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("share token not found").Err()
+	}
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("share token has expired").Err()
+	}
+	before := auditedShareToken(*t)
+
+	if req.Label != nil {
+		t.Label = strings.TrimSpace(*req.Label)
+		if utf8.RuneCountInString(t.Label) > maxShareTokenLabelRunes {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("label must be at most 100 characters").Err()
+		}
+	}
+	if req.Scopes != nil {
+		if err := validateShareScopes(req.Scopes); err != nil {
+			return nil, err
+		}
+		t.Scopes = req.Scopes
+	}
+	if req.AllItems {
+		t.MediaIDs = nil
+	} else if req.MediaIDs != nil {
+		mediaIDs, err := shareTokenMedia(ctx, id, req.MediaIDs)
+		if err != nil {
+			return nil, err
+		}
+		t.MediaIDs = mediaIDs
+	}
+	if req.StreamOnly != nil {
+		t.StreamOnly = *req.StreamOnly
+	}
+	if req.MaxDownloads != nil {
+		switch {
+		case *req.MaxDownloads == 0:
+			t.MaxDownloads = nil
+		case *req.MaxDownloads < 1 || *req.MaxDownloads > maxShareTokenDownloads:
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("max_downloads must be between 1 and 1000").Err()
+		default:
+			t.MaxDownloads = req.MaxDownloads
+		}
+	}
+	if err := checkDownloadLimit(*t); err != nil {
+		return nil, err
+	}
+	if req.ClearExpiry {
+		t.ExpiresAt = nil
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("expires_at must be in the future").Err()
+		}
+		t.ExpiresAt = req.ExpiresAt
+	}
+
+	_, err := db.Exec(ctx, `
+		UPDATE collection_share_tokens
+		SET label = $3, scopes = $4, media_ids = $5::uuid[], stream_only = $6, max_downloads = $7, expires_at = $8
+		WHERE collection_id = $1 AND token = $2::uuid
+	`, id, t.Token, t.Label, t.Scopes, t.MediaIDs, t.StreamOnly, t.MaxDownloads, t.ExpiresAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update share token").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditShareTokenUpdated, "collection", id, before, auditedShareToken(*t),
+		shareTokenDetails(t.Token))
+
+	return t, nil
+}
+
+// RevokeShareToken deletes a share token, cutting off whoever holds it
+//
+//encore:api auth method=DELETE path=/collection/:id/share/tokens/:token
+func RevokeShareToken(ctx context.Context, id string, token string) (*ListShareTokensResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	if _, err := uuid.Parse(token); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("share token not found").Err()
+	}
+
+	result, err := db.Exec(ctx, `
+		DELETE FROM collection_share_tokens WHERE collection_id = $1 AND token = $2::uuid
+	`, id, token)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to revoke share token").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("share token not found").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditShareTokenRevoked, "collection", id, nil, nil, shareTokenDetails(token))
+
+	return ListShareTokens(ctx, id)
+}
+
+// auditedShareToken is a share token as the audit log shows it, without the
+// token itself
+func auditedShareToken(t ShareToken) ShareToken {
+	t.Token = ""
+	t.ShareURL = ""
+	return t
+}
+
+// shareTokenDetails identifies a share token in the audit log by the start
+// of the token, enough to tell tokens apart but not to use one
+func shareTokenDetails(token string) map[string]string {
+	return map[string]string{"token_prefix": token[:min(8, len(token))]}
+}
+
+// validateShareScopes checks the scopes a share token may grant
+func validateShareScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if scope != authpkg.ScopeCollectionRead && scope != authpkg.ScopeMediaRead {
+			return errs.B().Code(errs.InvalidArgument).
+				Msg("share tokens only support collection:read and media:read").Err()
+		}
+	}
+	return nil
+}
+
+// shareTokenMedia checks that the media a token is restricted to are items
+// of the collection and returns them without duplicates
+func shareTokenMedia(ctx context.Context, id string, mediaIDs []string) ([]string, error) {
+	if len(mediaIDs) == 0 || len(mediaIDs) > maxAddMediaBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("media_ids must name 1 to 500 media").Err()
+	}
+
+	var ownerID int64
+	var rawRules []byte
+	if err := db.QueryRow(ctx, `SELECT owner_id, rules FROM collections WHERE id = $1`, id).Scan(&ownerID,
+		&rawRules); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	rules := parseRules(rawRules)
+
+	var unique []string
+	seen := map[string]bool{}
+	for _, mediaID := range mediaIDs {
+		parsed, err := uuid.Parse(mediaID)
+		if err != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid media ID: " + mediaID).Err()
+		}
+		mediaID = parsed.String()
+		if seen[mediaID] {
+			continue
+		}
+		seen[mediaID] = true
+		if !hasCollectionItem(ctx, id, ownerID, rules, nil, true, mediaID) {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("media not found in collection: " + mediaID).Err()
+		}
+		unique = append(unique, mediaID)
+	}
+	return unique, nil
+}
+
+// lookupShareTokenAny returns the collection's extra share token, expired
+// or not, or nil when there is none
+func lookupShareTokenAny(ctx context.Context, collectionID, token string) *ShareToken {
+	if _, err := uuid.Parse(token); err != nil {
+		return nil
+	}
+	var t ShareToken
+	err := db.QueryRow(ctx, `
+		SELECT token::text, label, scopes, media_ids::text[], stream_only, max_downloads, downloads, expires_at,
+			   created_at
+		FROM collection_share_tokens
+		WHERE collection_id = $1 AND token = $2::uuid
+	`, collectionID, token).Scan(&t.Token, &t.Label, &t.Scopes, &t.MediaIDs, &t.StreamOnly, &t.MaxDownloads,
+		&t.Downloads, &t.ExpiresAt, &t.CreatedAt)
+	if err != nil {
+		return nil
+	}
+	t.ShareURL = "/collection/" + collectionID + "?token=" + t.Token
+	return &t
+}
+
+// lookupShareToken returns the collection's extra share token if it hasn't
+// expired or used up its downloads, or nil
+func lookupShareToken(ctx context.Context, collectionID, token string) *ShareToken {
+	t := lookupShareTokenAny(ctx, collectionID, token)
+	if t == nil || (t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())) {
+		return nil
+	}
+	if t.MaxDownloads != nil && t.Downloads >= *t.MaxDownloads {
+		return nil
+	}
+	return t
+}
+
+// checkDownloadLimit rejects a download limit on a token that can't
+// download, or that could read the files some other way
+func checkDownloadLimit(t ShareToken) error {
+	if t.MaxDownloads == nil {
+		return nil
+	}
+	if t.StreamOnly {
+		return errs.B().Code(errs.InvalidArgument).Msg("stream_only tokens can't have max_downloads").Err()
+	}
+	if !hasScope(t.Scopes, authpkg.ScopeMediaRead) {
+		return errs.B().Code(errs.InvalidArgument).Msg("max_downloads requires the media:read scope").Err()
+	}
+	return nil
+}
+
+// consumeDownload counts a download against a download-limited share token,
+// failing when none are left
+func consumeDownload(ctx context.Context, collectionID, token string) error {
+	result, err := db.Exec(ctx, `
+		UPDATE collection_share_tokens SET downloads = downloads + 1
+		WHERE collection_id = $1 AND token = $2::uuid AND downloads < max_downloads
+	`, collectionID, token)
+	if err != nil {
+		rlog.Error("failed to count share token download", "error", err, "collection_id", collectionID)
+		return errs.B().Code(errs.Internal).Msg("failed to count download").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return errs.B().Code(errs.ResourceExhausted).Msg("share token has no downloads left").Err()
+	}
+	return nil
+}
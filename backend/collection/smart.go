@@ -0,0 +1,205 @@
+package collection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"encore.dev/beta/errs"
+
+	"encore.app/media"
+)
+
+// maxSmartRuleTags is the most tags one rule list may name
+const maxSmartRuleTags = 20
+
+// SmartRules define a smart collection: the owner's media matching every
+// rule given, evaluated whenever the collection is fetched
+type SmartRules struct {
+	// TagsAll matches media that has all of these tags
+	TagsAll []string `json:"tags_all,omitempty"`
+	// TagsAny matches media that has at least one of these tags
+	TagsAny []string `json:"tags_any,omitempty"`
+	// Status matches media in this processing status, e.g. "ready"
+	Status string `json:"status,omitempty"`
+	// MediaType is "video", "audio" or "image"
+	MediaType string `json:"media_type,omitempty"`
+	// CreatedWithinDays matches media uploaded in the last this many days
+	CreatedWithinDays int `json:"created_within_days,omitempty"`
+}
+
+// validate checks the rules and drops duplicate tags
+func (r *SmartRules) validate() error {
+	for _, tags := range []*[]string{&r.TagsAll, &r.TagsAny} {
+		if len(*tags) > maxSmartRuleTags {
+			return errs.B().Code(errs.InvalidArgument).Msg("rules may name at most 20 tags per list").Err()
+		}
+		seen := map[string]bool{}
+		unique := []string{}
+		for _, tag := range *tags {
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+		*tags = unique
+	}
+
+	switch r.Status {
+	case "", "queued", "processing", "ready", "failed":
+	default:
+		return errs.B().Code(errs.InvalidArgument).Msg("status must be queued, processing, ready or failed").Err()
+	}
+	switch r.MediaType {
+	case "", "video", "audio", "image":
+	default:
+		return errs.B().Code(errs.InvalidArgument).Msg("media_type must be video, audio or image").Err()
+	}
+	if r.CreatedWithinDays < 0 {
+		return errs.B().Code(errs.InvalidArgument).Msg("created_within_days can't be negative").Err()
+	}
+	if len(r.TagsAll) == 0 && len(r.TagsAny) == 0 && r.Status == "" && r.MediaType == "" && r.CreatedWithinDays == 0 {
+		return errs.B().Code(errs.InvalidArgument).Msg("rules must set at least one condition").Err()
+	}
+	return nil
+}
+
+// parseRules decodes the rules column; nil for manual collections
+func parseRules(raw []byte) *SmartRules {
+	if len(raw) == 0 {
+		return nil
+	}
+	var rules SmartRules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil
+	}
+	return &rules
+}
+
+// encodeRules encodes rules for the rules column
+func encodeRules(rules *SmartRules) []byte {
+	if rules == nil {
+		return nil
+	}
+	raw, _ := json.Marshal(rules)
+	return raw
+}
+
+// filter returns the media filter matching the rules of a collection of
+// ownerID
+func (r *SmartRules) filter(ownerID int64) media.MediaFilter {
+	return media.MediaFilter{
+		OwnerID:           ownerID,
+		TagsAll:           r.TagsAll,
+		TagsAny:           r.TagsAny,
+		Status:            r.Status,
+		MediaType:         r.MediaType,
+		CreatedWithinDays: r.CreatedWithinDays,
+	}
+}
+
+// collectionItem is a media item of a collection, when it got there and
+// its note; media of smart collections got there when it was uploaded and
+// has no note
+type collectionItem struct {
+	MediaID string
+	AddedAt time.Time
+	Note    string
+}
+
+// collectionItems returns the collection's items newest first, limit of them
+// from offset (0 for all), and the size of the whole collection. Items of
+// smart collections are matched by the media service from their rules. A
+// non-nil only keeps just those media, as for restricted share tokens, and
+// media scheduled to be published later is left out unless scheduled is set.
+func collectionItems(ctx context.Context, id string, ownerID int64, rules *SmartRules, only []string, scheduled bool, limit, offset int) ([]collectionItem, int, error) {
+	items := []collectionItem{}
+	if rules != nil {
+		filter := rules.filter(ownerID)
+		filter.MediaIDs = only
+		filter.Published = !scheduled
+		matched, err := media.MatchMedia(ctx, &media.MatchMediaRequest{Filter: filter, Limit: limit, Offset: offset})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, m := range matched.Media {
+			items = append(items, collectionItem{MediaID: m.ID, AddedAt: m.CreatedAt})
+		}
+		return items, matched.Total, nil
+	}
+
+	var total int
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM collection_items
+		WHERE collection_id = $1 AND ($2::uuid[] IS NULL OR media_id = ANY($2::uuid[]))
+		  AND ($3 OR media_id NOT IN (SELECT media_id FROM scheduled_media WHERE publish_at > NOW()))
+	`, id, only, scheduled).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := `
+		SELECT media_id::text, added_at, COALESCE(note, '') FROM collection_items
+		WHERE collection_id = $1 AND ($2::uuid[] IS NULL OR media_id = ANY($2::uuid[]))
+		  AND ($3 OR media_id NOT IN (SELECT media_id FROM scheduled_media WHERE publish_at > NOW()))
+		ORDER BY added_at DESC, media_id
+	`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	}
+
+	rows, err := db.Query(ctx, query, id, only, scheduled)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item collectionItem
+		if err := rows.Scan(&item.MediaID, &item.AddedAt, &item.Note); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, total, nil
+}
+
+// hasCollectionItem reports whether the media is in the collection and,
+// with a non-nil only, among those media; media scheduled to be published
+// later only counts when scheduled is set
+func hasCollectionItem(ctx context.Context, id string, ownerID int64, rules *SmartRules, only []string, scheduled bool, mediaID string) bool {
+	if only != nil && !slices.Contains(only, mediaID) {
+		return false
+	}
+	if rules != nil {
+		filter := rules.filter(ownerID)
+		filter.MediaIDs = []string{mediaID}
+		filter.Published = !scheduled
+		matched, err := media.MatchMedia(ctx, &media.MatchMediaRequest{Filter: filter, CountOnly: true})
+		return err == nil && matched.Total > 0
+	}
+
+	var found bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM collection_items WHERE collection_id = $1 AND media_id::text = $2
+			  AND ($3 OR media_id NOT IN (SELECT media_id FROM scheduled_media WHERE publish_at > NOW()))
+		)
+	`, id, mediaID, scheduled).Scan(&found)
+	return err == nil && found
+}
+
+// checkManualCollection fails for smart collections, whose items can't be
+// added or removed by hand
+func checkManualCollection(ctx context.Context, id string) error {
+	var isSmart bool
+	err := db.QueryRow(ctx, `SELECT rules IS NOT NULL FROM collections WHERE id = $1`, id).Scan(&isSmart)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	if isSmart {
+		return errs.B().Code(errs.FailedPrecondition).Msg("smart collections are defined by their rules").Err()
+	}
+	return nil
+}
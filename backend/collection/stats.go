@@ -0,0 +1,98 @@
+package collection
+
+import (
+	"context"
+
+	"encore.app/media"
+)
+
+// collectionStats sums up a collection's items
+type collectionStats struct {
+	ItemCount            int
+	TotalSizeBytes       int64
+	TotalDurationSeconds int64
+}
+
+// collectionStatsFor returns the stats of the owner's collections by ID;
+// rules holds the rules of each collection, nil for manual ones. Items of
+// manual collections are looked up together for all of them.
+func collectionStatsFor(ctx context.Context, ownerID int64, rules map[string]*SmartRules) (map[string]collectionStats, error) {
+	stats := map[string]collectionStats{}
+
+	var manual []string
+	for id, r := range rules {
+		if r == nil {
+			manual = append(manual, id)
+			continue
+		}
+		matched, err := media.MatchMedia(ctx, &media.MatchMediaRequest{Filter: r.filter(ownerID), CountOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		stats[id] = collectionStats{
+			ItemCount:            matched.Total,
+			TotalSizeBytes:       matched.TotalSizeBytes,
+			TotalDurationSeconds: matched.TotalDurationSeconds,
+		}
+	}
+	if len(manual) == 0 {
+		return stats, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT collection_id::text, media_id::text FROM collection_items WHERE collection_id = ANY($1::uuid[])
+	`, manual)
+	if err != nil {
+		return nil, err
+	}
+	var collectionIDs, mediaIDs []string
+	for rows.Next() {
+		var collectionID, mediaID string
+		if err := rows.Scan(&collectionID, &mediaID); err != nil {
+			continue
+		}
+		collectionIDs = append(collectionIDs, collectionID)
+		mediaIDs = append(mediaIDs, mediaID)
+		s := stats[collectionID]
+		s.ItemCount++
+		stats[collectionID] = s
+	}
+	rows.Close()
+	if len(mediaIDs) == 0 {
+		return stats, nil
+	}
+
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i, collectionID := range collectionIDs {
+		m := info[mediaIDs[i]]
+		s := stats[collectionID]
+		s.TotalSizeBytes += m.SizeBytes
+		s.TotalDurationSeconds += m.DurationSeconds
+		stats[collectionID] = s
+	}
+	return stats, nil
+}
+
+// mediaStats sums up the given items
+func mediaStats(ctx context.Context, items []collectionItem) (collectionStats, error) {
+	s := collectionStats{ItemCount: len(items)}
+	if len(items) == 0 {
+		return s, nil
+	}
+	var mediaIDs []string
+	for _, item := range items {
+		mediaIDs = append(mediaIDs, item.MediaID)
+	}
+	info, err := mediaInfo(ctx, mediaIDs)
+	if err != nil {
+		return s, err
+	}
+	for _, m := range info {
+		s.TotalSizeBytes += m.SizeBytes
+		s.TotalDurationSeconds += m.DurationSeconds
+	}
+	return s, nil
+}
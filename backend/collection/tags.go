@@ -0,0 +1,92 @@
+package collection
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	authpkg "encore.app/auth"
+)
+
+// Limits on collection tags
+const (
+	maxCollectionTags      = 20
+	maxCollectionTagLength = 50
+)
+
+// UpdateCollectionTagsRequest contains tags to add or remove
+type UpdateCollectionTagsRequest struct {
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+}
+
+// UpdateCollectionTagsResponse contains the collection's tags after the update
+type UpdateCollectionTagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// UpdateCollectionTags adds or removes tags of a collection
+//
+//encore:api auth method=PATCH path=/collection/:id/tags
+func UpdateCollectionTags(ctx context.Context, id string, req *UpdateCollectionTagsRequest) (*UpdateCollectionTagsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	var add []string
+	for _, tag := range req.AddTags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxCollectionTagLength {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("tags must be at most 50 characters").Err()
+		}
+		add = append(add, tag)
+	}
+
+	var current []string
+	if err := db.QueryRow(ctx, `SELECT tags FROM collections WHERE id = $1`, id).Scan(&current); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+
+	// Removals apply first, then additions not already there
+	remove := map[string]bool{}
+	for _, tag := range req.RemoveTags {
+		remove[strings.TrimSpace(tag)] = true
+	}
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range current {
+		if !remove[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range add {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxCollectionTags {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("a collection can have at most 20 tags").Err()
+	}
+
+	if _, err := db.Exec(ctx, `UPDATE collections SET tags = $2 WHERE id = $1`, id, tags); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update tags").Err()
+	}
+	if !slices.Equal(current, tags) {
+		recordAudit(ctx, userData.UserID, auditCollectionTagsUpdated, "collection", id,
+			map[string][]string{"tags": current}, map[string][]string{"tags": tags}, nil)
+		publishUpdate(ctx, id, changeUpdated, nil)
+	}
+
+	return &UpdateCollectionTagsResponse{Tags: tags}, nil
+}
@@ -0,0 +1,77 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	"encore.app/team"
+)
+
+// requireTeamRole returns an error unless the user has at least role min in
+// the team
+func requireTeamRole(ctx context.Context, userID int64, teamID string, min team.Role) error {
+	membership, err := team.GetMembership(ctx, &team.MembershipRequest{TeamID: teamID, UserID: userID})
+	if err != nil {
+		return errs.B().Code(errs.Internal).Msg("failed to check team membership").Err()
+	}
+	if membership.Role == "" {
+		return errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	if !membership.Role.AtLeast(min) {
+		return errs.B().Code(errs.PermissionDenied).Msg("your team role doesn't allow this").Err()
+	}
+	return nil
+}
+
+// isTeamMember reports whether the user has at least role min in the team
+func isTeamMember(ctx context.Context, userID int64, teamID string, min team.Role) bool {
+	if teamID == "" || userID == 0 {
+		return false
+	}
+	membership, err := team.GetMembership(ctx, &team.MembershipRequest{TeamID: teamID, UserID: userID})
+	return err == nil && membership.Role.AtLeast(min)
+}
+
+// checkCollectionEditor fails unless the collection exists and the user
+// created it or is an editor of its team; it returns the collection's team,
+// empty for a personal collection
+func checkCollectionEditor(ctx context.Context, collectionID string, userID int64) (string, error) {
+	var ownerID int64
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, collectionID).Scan(&ownerID, &teamID)
+	if err != nil {
+		return "", errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	if ownerID != userID && !isTeamMember(ctx, userID, teamID, team.RoleEditor) {
+		return "", errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	}
+	return teamID, nil
+}
+
+// A deleted team's collections go back to the members who created them
+var _ = pubsub.NewSubscription(team.TeamDeletedTopic, "collection-team-cleanup",
+	pubsub.SubscriptionConfig[*team.TeamDeleted]{
+		Handler: releaseTeamCollections,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// releaseTeamCollections makes the collections of a deleted team personal
+// collections of their creators
+func releaseTeamCollections(ctx context.Context, msg *team.TeamDeleted) error {
+	result, err := db.Exec(ctx, `UPDATE collections SET team_id = NULL WHERE team_id = $1`, msg.TeamID)
+	if err != nil {
+		return err
+	}
+	rlog.Info("team collections released", "team_id", msg.TeamID, "collections", result.RowsAffected())
+	return nil
+}
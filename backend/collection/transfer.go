@@ -0,0 +1,176 @@
+package collection
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+	"encore.app/idempotency"
+)
+
+// TransferMediaRequest names the items to move and where to
+type TransferMediaRequest struct {
+	MediaIDs []string `json:"media_ids"`
+	TargetID string   `json:"target_id"`
+	// Copy leaves the items in this collection too
+	Copy bool `json:"copy,omitempty"`
+	// IdempotencyKey makes retries return the first response
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+// TransferMediaResult is the outcome for one item: "moved", "copied",
+// "already_in_target" (and removed from this collection when moving) or
+// "not_in_collection"
+type TransferMediaResult struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// TransferMediaResponse reports the outcome per item
+type TransferMediaResponse struct {
+	Results []TransferMediaResult `json:"results"`
+}
+
+// TransferMedia moves items of the collection, with their notes, into
+// another collection of the caller, or copies them with copy set. It all
+// happens in one transaction, so no item ends up in neither collection.
+//
+//encore:api auth method=POST path=/collection/:id/items/transfer
+func TransferMedia(ctx context.Context, id string, req *TransferMediaRequest) (*TransferMediaResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	return idempotency.Do(ctx, db, userData.UserID, "collection.TransferMedia", req.IdempotencyKey, []any{id, req},
+		func() (*TransferMediaResponse, error) {
+			return transferMedia(ctx, userData, id, req)
+		})
+}
+
+// transferMedia moves or copies items between two collections of userData's user
+func transferMedia(ctx context.Context, userData *authpkg.UserData, id string, req *TransferMediaRequest) (*TransferMediaResponse, error) {
+
+	if len(req.MediaIDs) == 0 || len(req.MediaIDs) > maxAddMediaBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("media_ids must name 1 to 500 media").Err()
+	}
+	if req.TargetID == "" || req.TargetID == id {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("target_id must be another collection").Err()
+	}
+	for _, collectionID := range []string{id, req.TargetID} {
+		if err := checkCollectionOwner(ctx, collectionID, userData.UserID); err != nil {
+			return nil, err
+		}
+		if err := checkManualCollection(ctx, collectionID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Malformed IDs can't be in the collection
+	status := map[string]string{}
+	var valid []string
+	for i, mediaID := range req.MediaIDs {
+		parsed, err := uuid.Parse(mediaID)
+		if err == nil {
+			req.MediaIDs[i] = parsed.String()
+		}
+		if _, seen := status[req.MediaIDs[i]]; seen {
+			continue
+		}
+		status[req.MediaIDs[i]] = "not_in_collection"
+		if err == nil {
+			valid = append(valid, req.MediaIDs[i])
+		}
+	}
+
+	done := "moved"
+	if req.Copy {
+		done = "copied"
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+	}
+	defer tx.Rollback()
+
+	// Items in the source collection; ones already in the target keep
+	// their place and note there
+	rows, err := tx.Query(ctx, `
+		SELECT s.media_id::text, t.media_id IS NOT NULL
+		FROM collection_items s
+		LEFT JOIN collection_items t ON t.collection_id = $2 AND t.media_id = s.media_id
+		WHERE s.collection_id = $1 AND s.media_id = ANY($3::uuid[])
+		FOR UPDATE OF s
+	`, id, req.TargetID, valid)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+	}
+	var found []string
+	for rows.Next() {
+		var mediaID string
+		var inTarget bool
+		if err := rows.Scan(&mediaID, &inTarget); err != nil {
+			continue
+		}
+		found = append(found, mediaID)
+		status[mediaID] = done
+		if inTarget {
+			status[mediaID] = "already_in_target"
+		}
+	}
+	rows.Close()
+
+	if len(found) > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO collection_items (collection_id, media_id, added_at, note)
+			SELECT $2, media_id, NOW(), note FROM collection_items
+			WHERE collection_id = $1 AND media_id = ANY($3::uuid[])
+			ON CONFLICT DO NOTHING
+		`, id, req.TargetID, found)
+		if err != nil {
+			rlog.Error("failed to add media to target collection", "error", err, "collection_id", req.TargetID)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+		}
+		if !req.Copy {
+			_, err = tx.Exec(ctx, `
+				DELETE FROM collection_items WHERE collection_id = $1 AND media_id = ANY($2::uuid[])
+			`, id, found)
+			if err != nil {
+				rlog.Error("failed to remove moved media", "error", err, "collection_id", id)
+				return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+	}
+
+	var added []string
+	for _, mediaID := range found {
+		if status[mediaID] == done {
+			added = append(added, mediaID)
+		}
+	}
+	notifyItemsAdded(ctx, req.TargetID, added)
+	if len(added) > 0 {
+		details := map[string]string{"target_collection_id": req.TargetID, "mode": done}
+		recordAudit(ctx, userData.UserID, auditMediaTransferred, "collection", id, nil,
+			map[string][]string{"media_ids": added}, details)
+	}
+	if !req.Copy && len(found) > 0 {
+		publishUpdate(ctx, id, changeItemsRemoved, found)
+	}
+
+	resp := &TransferMediaResponse{Results: []TransferMediaResult{}}
+	reported := map[string]bool{}
+	for _, mediaID := range req.MediaIDs {
+		if reported[mediaID] {
+			continue
+		}
+		reported[mediaID] = true
+		resp.Results = append(resp.Results, TransferMediaResult{MediaID: mediaID, Status: status[mediaID]})
+	}
+	return resp, nil
+}
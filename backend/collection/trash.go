@@ -0,0 +1,148 @@
+package collection
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// getTrashRetention returns how long deleted collections can be restored
+// (COLLECTION_TRASH_RETENTION)
+func getTrashRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("COLLECTION_TRASH_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// TrashedCollection is a deleted collection that can still be restored
+type TrashedCollection struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	ItemCount   int       `json:"item_count"`
+	DeletedAt   time.Time `json:"deleted_at"`
+	PurgeAt     time.Time `json:"purge_at"`
+}
+
+// ListCollectionTrashResponse contains the caller's deleted collections
+type ListCollectionTrashResponse struct {
+	Collections []TrashedCollection `json:"collections"`
+}
+
+// ListCollectionTrash returns the caller's deleted collections, most
+// recently deleted first
+//
+//encore:api auth method=GET path=/collection-trash
+func ListCollectionTrash(ctx context.Context) (*ListCollectionTrashResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT c.id, c.title, COALESCE(c.description, ''), c.deleted_at,
+			   (SELECT COUNT(*) FROM collection_items i WHERE i.collection_id = c.id)
+		FROM collections c
+		WHERE c.owner_id = $1 AND c.deleted_at IS NOT NULL
+		ORDER BY c.deleted_at DESC
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list deleted collections").Err()
+	}
+	defer rows.Close()
+
+	retention := getTrashRetention()
+	resp := &ListCollectionTrashResponse{Collections: []TrashedCollection{}}
+	for rows.Next() {
+		var c TrashedCollection
+		if err := rows.Scan(&c.ID, &c.Title, &c.Description, &c.DeletedAt, &c.ItemCount); err != nil {
+			continue
+		}
+		c.PurgeAt = c.DeletedAt.Add(retention)
+		resp.Collections = append(resp.Collections, c)
+	}
+	return resp, nil
+}
+
+// RestoreCollection brings a deleted collection back with its items,
+// shares and share tokens. It returns to its parent unless that was
+// deleted too, in which case it goes to the top level; sub-collections
+// that moved up when it was deleted stay where they are.
+//
+//encore:api auth method=POST path=/collection/:id/restore
+func RestoreCollection(ctx context.Context, id string) (*CollectionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var parentID *string
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, parent_id::text, COALESCE(team_id::text, '')
+		FROM collections WHERE id = $1 AND deleted_at IS NOT NULL
+	`, id).Scan(&ownerID, &parentID, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("deleted collection not found").Err()
+	}
+	if ownerID != userData.UserID {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	}
+
+	newParentID := ""
+	if parentID != nil && checkParent(ctx, userData.UserID, teamID, id, *parentID) == nil {
+		newParentID = *parentID
+	}
+
+	resp := CollectionResponse{TeamID: teamID}
+	var rules []byte
+	err = db.QueryRow(ctx, `
+		UPDATE collections SET deleted_at = NULL, parent_id = NULLIF($2, '')::uuid
+		WHERE id = $1
+		RETURNING id, parent_id::text, title, COALESCE(description, ''), visibility, share_token, rules, tags, created_at
+	`, id, newParentID).Scan(
+		&resp.ID, &resp.ParentID, &resp.Title, &resp.Description, &resp.Visibility, &resp.ShareToken, &rules, &resp.Tags,
+		&resp.CreatedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to restore collection").Err()
+	}
+	resp.Rules = parseRules(rules)
+	recordAudit(ctx, userData.UserID, auditCollectionRestored, "collection", id, nil, collectionSnapshot(ctx, id), nil)
+	publishUpdate(ctx, id, changeRestored, nil)
+
+	return &resp, nil
+}
+
+// Deleted collections past the retention are purged hourly
+var _ = cron.NewJob("collection-trash-purge", cron.JobConfig{
+	Title:    "Purge deleted collections",
+	Every:    1 * cron.Hour,
+	Endpoint: PurgeDeletedCollections,
+})
+
+// PurgeDeletedCollectionsResponse reports how many collections were purged
+type PurgeDeletedCollectionsResponse struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeDeletedCollections permanently removes collections that have been in
+// the trash longer than the retention, with their items, shares and tokens
+//
+//encore:api private
+func PurgeDeletedCollections(ctx context.Context) (*PurgeDeletedCollectionsResponse, error) {
+	result, err := db.Exec(ctx, `
+		DELETE FROM collections WHERE deleted_at < $1
+	`, time.Now().Add(-getTrashRetention()))
+	if err != nil {
+		return nil, err
+	}
+
+	purged := int(result.RowsAffected())
+	if purged > 0 {
+		rlog.Info("deleted collections purged", "count", purged)
+	}
+	return &PurgeDeletedCollectionsResponse{Purged: purged}, nil
+}
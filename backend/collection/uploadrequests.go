@@ -0,0 +1,507 @@
+package collection
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+	"encore.app/objectstore"
+)
+
+// Limits of upload requests
+const (
+	maxUploadRequestFiles      = 1000
+	defaultUploadRequestExpiry = 7 * 24 * time.Hour
+	maxUploadRequestExpiry     = 90 * 24 * time.Hour
+)
+
+// guestUploadWindow is how long a signed but unconfirmed guest upload holds
+// a slot: the lifetime of the media service's upload URLs
+func guestUploadWindow() time.Duration {
+	return objectstore.UploadTTL() + objectstore.ClockSkew()
+}
+
+// guestUploadGrace is how long past its slot an unconfirmed guest upload is
+// kept, so a large file whose upload started in time can still finish and
+// be confirmed
+const guestUploadGrace = 24 * time.Hour
+
+// guestUploadSweepBatch is the most unconfirmed uploads one sweep removes
+const guestUploadSweepBatch = 500
+
+// UploadRequest is a link that lets guests upload into a collection
+type UploadRequest struct {
+	ID           string `json:"id"`
+	CollectionID string `json:"collection_id"`
+	Token        string `json:"token"`
+	Message      string `json:"message"`
+	MaxFiles     int    `json:"max_files"`
+	// MaxFileSizeBytes is 0 when only the owner's storage quota applies
+	MaxFileSizeBytes int64      `json:"max_file_size_bytes"`
+	FilesUploaded    int        `json:"files_uploaded"`
+	UploadURL        string     `json:"upload_url"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// CreateUploadRequestRequest sets the limits of a new upload request
+type CreateUploadRequestRequest struct {
+	// Message is shown to guests, e.g. what to upload
+	Message          string `json:"message,omitempty"`
+	MaxFiles         int    `json:"max_files"`
+	MaxFileSizeBytes int64  `json:"max_file_size_bytes,omitempty"`
+	// ExpiresInHours defaults to 7 days and may be at most 90 days
+	ExpiresInHours int `json:"expires_in_hours,omitempty"`
+}
+
+// CreateUploadRequest creates a link guests can use to upload files into the
+// collection without an account. Uploads are owned by the collection owner
+// and count against their storage quota.
+//
+//encore:api auth method=POST path=/collection/:id/upload-requests
+func CreateUploadRequest(ctx context.Context, id string, req *CreateUploadRequestRequest) (*UploadRequest, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+	// Guest uploads are added to the collection, which smart collections can't take
+	if err := checkManualCollection(ctx, id); err != nil {
+		return nil, err
+	}
+	if err := checkNotTakenDown(ctx, id); err != nil {
+		return nil, err
+	}
+	if req.MaxFiles < 1 || req.MaxFiles > maxUploadRequestFiles {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("max_files must be between 1 and 1000").Err()
+	}
+	if req.MaxFileSizeBytes < 0 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("max_file_size_bytes must not be negative").Err()
+	}
+	expiry := defaultUploadRequestExpiry
+	if req.ExpiresInHours != 0 {
+		expiry = time.Duration(req.ExpiresInHours) * time.Hour
+		if expiry <= 0 || expiry > maxUploadRequestExpiry {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("expires_in_hours must be between 1 and 2160").Err()
+		}
+	}
+
+	var requestID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO upload_requests (collection_id, owner_id, message, max_files, max_file_size_bytes, expires_at, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, NOW())
+		RETURNING id
+	`, id, userData.UserID, req.Message, req.MaxFiles, req.MaxFileSizeBytes, time.Now().Add(expiry)).Scan(&requestID)
+	if err != nil {
+		rlog.Error("failed to create upload request", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create upload request").Err()
+	}
+
+	requests, err := queryUploadRequests(ctx, `WHERE r.id = $1`, requestID)
+	if err != nil || len(requests) == 0 {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create upload request").Err()
+	}
+	// The token is left out of the audit log, like share tokens
+	audited := requests[0]
+	audited.Token, audited.UploadURL = "", ""
+	recordAudit(ctx, userData.UserID, auditUploadRequestCreated, "collection", id, nil, audited,
+		map[string]string{"upload_request_id": requestID})
+	return &requests[0], nil
+}
+
+// ListUploadRequestsResponse contains a collection's upload requests
+type ListUploadRequestsResponse struct {
+	UploadRequests []UploadRequest `json:"upload_requests"`
+}
+
+// ListUploadRequests returns the upload requests of a collection, including
+// expired and revoked ones
+//
+//encore:api auth method=GET path=/collection/:id/upload-requests
+func ListUploadRequests(ctx context.Context, id string) (*ListUploadRequestsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	requests, err := queryUploadRequests(ctx, `WHERE r.collection_id = $1`, id)
+	if err != nil {
+		rlog.Error("failed to list upload requests", "error", err, "collection_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list upload requests").Err()
+	}
+	return &ListUploadRequestsResponse{UploadRequests: requests}, nil
+}
+
+// RevokeUploadRequestResponse confirms the revocation
+type RevokeUploadRequestResponse struct {
+	Success bool `json:"success"`
+}
+
+// RevokeUploadRequest stops an upload request from accepting uploads; files
+// already uploaded stay in the collection
+//
+//encore:api auth method=DELETE path=/collection/:id/upload-requests/:requestID
+func RevokeUploadRequest(ctx context.Context, id string, requestID string) (*RevokeUploadRequestResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if err := checkCollectionOwner(ctx, id, userData.UserID); err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE upload_requests SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1 AND collection_id = $2
+	`, requestID, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to revoke upload request").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("upload request not found").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditUploadRequestRevoked, "collection", id, nil, nil,
+		map[string]string{"upload_request_id": requestID})
+
+	return &RevokeUploadRequestResponse{Success: true}, nil
+}
+
+// checkCollectionOwner fails unless the collection exists and belongs to the user
+func checkCollectionOwner(ctx context.Context, collectionID string, userID int64) error {
+	var ownerID int64
+	err := db.QueryRow(ctx, `
+		SELECT owner_id FROM collections WHERE id = $1 AND deleted_at IS NULL
+	`, collectionID).Scan(&ownerID)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("collection not found").Err()
+	}
+	if ownerID != userID {
+		return errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	}
+	return nil
+}
+
+// queryUploadRequests returns the upload requests matching a WHERE clause
+// on upload_requests r, newest first
+func queryUploadRequests(ctx context.Context, where string, args ...any) ([]UploadRequest, error) {
+	rows, err := db.Query(ctx, `
+		SELECT r.id, r.collection_id, r.token, COALESCE(r.message, ''), r.max_files, r.max_file_size_bytes,
+			   (SELECT COUNT(*) FROM upload_request_uploads u
+				WHERE u.upload_request_id = r.id AND u.confirmed_at IS NOT NULL),
+			   r.expires_at, r.revoked_at, r.created_at
+		FROM upload_requests r `+where+`
+		ORDER BY r.created_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []UploadRequest{}
+	for rows.Next() {
+		var r UploadRequest
+		if err := rows.Scan(&r.ID, &r.CollectionID, &r.Token, &r.Message, &r.MaxFiles, &r.MaxFileSizeBytes,
+			&r.FilesUploaded, &r.ExpiresAt, &r.RevokedAt, &r.CreatedAt); err != nil {
+			continue
+		}
+		r.UploadURL = "/upload-requests/" + r.Token
+		requests = append(requests, r)
+	}
+	return requests, nil
+}
+
+// activeUploadRequest is an upload request a guest is using
+type activeUploadRequest struct {
+	ID               string
+	CollectionID     string
+	OwnerID          int64
+	MaxFiles         int
+	MaxFileSizeBytes int64
+}
+
+// getActiveUploadRequest returns the upload request of a token, failing
+// when it is unknown, revoked or expired
+func getActiveUploadRequest(ctx context.Context, token string) (*activeUploadRequest, error) {
+	var r activeUploadRequest
+	var expiresAt time.Time
+	var revokedAt *time.Time
+	err := db.QueryRow(ctx, `
+		SELECT r.id, r.collection_id, r.owner_id, r.max_files, r.max_file_size_bytes, r.expires_at, r.revoked_at
+		FROM upload_requests r JOIN collections c ON c.id = r.collection_id
+		WHERE r.token::text = $1 AND c.deleted_at IS NULL
+	`, token).Scan(&r.ID, &r.CollectionID, &r.OwnerID, &r.MaxFiles, &r.MaxFileSizeBytes, &expiresAt, &revokedAt)
+	if err != nil || revokedAt != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("upload request not found").Err()
+	}
+	if time.Now().After(expiresAt) {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("upload request has expired").Err()
+	}
+	return &r, nil
+}
+
+// usedSlotsQuery counts the confirmed uploads of an upload request ($1) and
+// the uploads still in progress, whose upload URL is younger than $2 seconds
+const usedSlotsQuery = `
+	SELECT COUNT(*) FROM upload_request_uploads
+	WHERE upload_request_id = $1
+	  AND (confirmed_at IS NOT NULL OR created_at > NOW() - $2 * INTERVAL '1 second')
+`
+
+// GuestUploadRequestInfo is what a guest sees of an upload request
+type GuestUploadRequestInfo struct {
+	CollectionTitle  string                 `json:"collection_title"`
+	Message          string                 `json:"message"`
+	RequestedBy      *authpkg.PublicProfile `json:"requested_by,omitempty"`
+	FilesRemaining   int                    `json:"files_remaining"`
+	MaxFileSizeBytes int64                  `json:"max_file_size_bytes"`
+	ExpiresAt        time.Time              `json:"expires_at"`
+}
+
+// GetGuestUploadRequest describes an upload request to the guest holding its
+// token
+//
+//encore:api public method=GET path=/upload-requests/:token
+func GetGuestUploadRequest(ctx context.Context, token string) (*GuestUploadRequestInfo, error) {
+	r, err := getActiveUploadRequest(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var info GuestUploadRequestInfo
+	err = db.QueryRow(ctx, `
+		SELECT c.title, COALESCE(r.message, ''), r.max_file_size_bytes, r.expires_at
+		FROM upload_requests r JOIN collections c ON c.id = r.collection_id
+		WHERE r.id = $1
+	`, r.ID).Scan(&info.CollectionTitle, &info.Message, &info.MaxFileSizeBytes, &info.ExpiresAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("upload request not found").Err()
+	}
+
+	var used int
+	if err := db.QueryRow(ctx, usedSlotsQuery, r.ID, int(guestUploadWindow().Seconds())).Scan(&used); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get upload request").Err()
+	}
+	info.FilesRemaining = max(r.MaxFiles-used, 0)
+
+	if profile, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: r.OwnerID}); err == nil {
+		info.RequestedBy = profile
+	}
+
+	return &info, nil
+}
+
+// GuestSignUploadRequest names the file a guest wants to upload
+type GuestSignUploadRequest struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
+
+// GuestSignUpload returns a presigned upload URL for a guest, like
+// SignUpload, while the upload request has files left. With a size limit
+// it is a POST upload with upload_fields that storage enforces.
+//
+//encore:api public method=POST path=/upload-requests/:token/sign
+func GuestSignUpload(ctx context.Context, token string, req *GuestSignUploadRequest) (*media.SignUploadResponse, error) {
+	r, err := getActiveUploadRequest(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the upload request so concurrent guests can't exceed max_files
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign upload").Err()
+	}
+	defer tx.Rollback()
+
+	var used int
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM upload_requests WHERE id = $1 FOR UPDATE`, r.ID); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign upload").Err()
+	}
+	if err := tx.QueryRow(ctx, usedSlotsQuery, r.ID, int(guestUploadWindow().Seconds())).Scan(&used); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign upload").Err()
+	}
+	if used >= r.MaxFiles {
+		return nil, errs.B().Code(errs.ResourceExhausted).Msg("upload request has no files left").Err()
+	}
+
+	resp, err := media.SignGuestUpload(ctx, &media.SignGuestUploadRequest{
+		OwnerID:      r.OwnerID,
+		Filename:     req.Filename,
+		MimeType:     req.MimeType,
+		MaxSizeBytes: r.MaxFileSizeBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO upload_request_uploads (media_id, upload_request_id, created_at) VALUES ($1, $2, NOW())
+	`, resp.MediaID, r.ID); err != nil {
+		rlog.Error("failed to record guest upload", "error", err, "upload_request_id", r.ID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign upload").Err()
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign upload").Err()
+	}
+
+	return resp, nil
+}
+
+// GuestConfirmUploadRequest confirms a guest's upload
+type GuestConfirmUploadRequest struct {
+	MediaID string `json:"media_id"`
+	Title   string `json:"title,omitempty"`
+}
+
+// GuestConfirmUpload confirms a guest's upload, like ConfirmUpload, and adds
+// it to the upload request's collection. Files over the size limit are
+// rejected and deleted.
+//
+//encore:api public method=POST path=/upload-requests/:token/confirm
+func GuestConfirmUpload(ctx context.Context, token string, req *GuestConfirmUploadRequest) (*media.ConfirmUploadResponse, error) {
+	r, err := getActiveUploadRequest(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the upload request like GuestSignUpload: an upload signed before
+	// its slot lapsed may be confirmed after others took the slot, so the
+	// confirmed uploads are counted again
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to confirm upload").Err()
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM upload_requests WHERE id = $1 FOR UPDATE`, r.ID); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to confirm upload").Err()
+	}
+	var confirmed bool
+	err = tx.QueryRow(ctx, `
+		SELECT confirmed_at IS NOT NULL FROM upload_request_uploads
+		WHERE media_id::text = $1 AND upload_request_id = $2
+	`, req.MediaID, r.ID).Scan(&confirmed)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("upload not found").Err()
+	}
+	if confirmed {
+		return nil, errs.B().Code(errs.AlreadyExists).Msg("upload already confirmed").Err()
+	}
+	var used int
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM upload_request_uploads
+		WHERE upload_request_id = $1 AND confirmed_at IS NOT NULL
+	`, r.ID).Scan(&used)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to confirm upload").Err()
+	}
+	if used >= r.MaxFiles {
+		return nil, errs.B().Code(errs.ResourceExhausted).Msg("upload request has no files left").Err()
+	}
+
+	resp, err := media.ConfirmGuestUpload(ctx, &media.ConfirmGuestUploadRequest{
+		OwnerID:      r.OwnerID,
+		MediaID:      req.MediaID,
+		Title:        req.Title,
+		MaxSizeBytes: r.MaxFileSizeBytes,
+	})
+	if err != nil {
+		if errs.Code(err) == errs.InvalidArgument {
+			// The oversized file was deleted, so it no longer holds a slot
+			_, _ = tx.Exec(ctx, `DELETE FROM upload_request_uploads WHERE media_id::text = $1`, req.MediaID)
+			_ = tx.Commit()
+		}
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE upload_request_uploads SET confirmed_at = NOW(), size_bytes = $2 WHERE media_id::text = $1
+	`, req.MediaID, resp.SizeBytes)
+	if err != nil {
+		rlog.Error("failed to record guest upload", "error", err, "media_id", req.MediaID)
+	}
+	if err := tx.Commit(); err != nil {
+		rlog.Error("failed to record guest upload", "error", err, "media_id", req.MediaID)
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO collection_items (collection_id, media_id, added_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT DO NOTHING
+	`, r.CollectionID, req.MediaID)
+	if err != nil {
+		rlog.Error("failed to add guest upload to collection", "error", err, "media_id", req.MediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to add upload to collection").Err()
+	}
+
+	notifyItemsAdded(ctx, r.CollectionID, []string{req.MediaID})
+
+	rlog.Info("guest upload confirmed", "upload_request_id", r.ID, "media_id", req.MediaID)
+	return &media.ConfirmUploadResponse{
+		MediaID: resp.MediaID,
+		Status:  resp.Status,
+	}, nil
+}
+
+// Guest uploads never confirmed are swept hourly
+var _ = cron.NewJob("guest-upload-sweep", cron.JobConfig{
+	Title:    "Remove unconfirmed guest uploads",
+	Every:    1 * cron.Hour,
+	Endpoint: SweepGuestUploads,
+})
+
+// SweepGuestUploadsResponse reports how many uploads were removed
+type SweepGuestUploadsResponse struct {
+	Removed int `json:"removed"`
+}
+
+// SweepGuestUploads deletes guest uploads left unconfirmed past their slot
+// and guestUploadGrace, with the files guests stored for them
+//
+//encore:api private
+func SweepGuestUploads(ctx context.Context) (*SweepGuestUploadsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT u.media_id::text, r.owner_id
+		FROM upload_request_uploads u JOIN upload_requests r ON r.id = u.upload_request_id
+		WHERE u.confirmed_at IS NULL AND u.created_at < $1
+		ORDER BY u.created_at
+		LIMIT $2
+	`, time.Now().Add(-(guestUploadWindow() + guestUploadGrace)), guestUploadSweepBatch)
+	if err != nil {
+		return nil, err
+	}
+	type staleUpload struct {
+		mediaID string
+		ownerID int64
+	}
+	var stale []staleUpload
+	for rows.Next() {
+		var u staleUpload
+		if err := rows.Scan(&u.mediaID, &u.ownerID); err == nil {
+			stale = append(stale, u)
+		}
+	}
+	rows.Close()
+
+	resp := &SweepGuestUploadsResponse{}
+	for _, u := range stale {
+		err := media.DiscardGuestUpload(ctx, &media.DiscardGuestUploadRequest{OwnerID: u.ownerID, MediaID: u.mediaID})
+		if err != nil {
+			rlog.Warn("failed to discard guest upload", "error", err, "media_id", u.mediaID)
+			continue
+		}
+		if _, err := db.Exec(ctx, `DELETE FROM upload_request_uploads WHERE media_id::text = $1`, u.mediaID); err == nil {
+			resp.Removed++
+		}
+	}
+	if resp.Removed > 0 {
+		rlog.Info("unconfirmed guest uploads removed", "count", resp.Removed)
+	}
+	return resp, nil
+}
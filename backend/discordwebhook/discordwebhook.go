@@ -0,0 +1,146 @@
+// Package discordwebhook posts messages to Discord channels through
+// incoming webhooks, which users create in a channel's integration settings
+// and save as discord_webhook_url in their settings. No bot is involved.
+package discordwebhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"time"
+)
+
+// urlPattern matches the URLs of Discord's incoming webhooks
+var urlPattern = regexp.MustCompile(`^https://(?:(?:ptb|canary)\.)?discord(?:app)?\.com/api/(?:v\d+/)?webhooks/\d+/[\w-]+$`)
+
+// Discord's limits on message parts
+const (
+	maxContent     = 2000
+	maxTitle       = 256
+	maxDescription = 4096
+	// MaxImageBytes is the largest image attached to a message
+	MaxImageBytes = 8 << 20
+)
+
+// ErrGone is returned when Discord no longer knows the webhook, e.g.
+// because it was deleted from the channel
+var ErrGone = errors.New("discord webhook no longer exists")
+
+// Validate checks that rawURL is a Discord webhook URL
+func Validate(rawURL string) error {
+	if !urlPattern.MatchString(rawURL) {
+		return errors.New("not a Discord webhook URL")
+	}
+	return nil
+}
+
+// Embed is the rich preview of a message
+type Embed struct {
+	Title       string       `json:"title,omitempty"`
+	Description string       `json:"description,omitempty"`
+	URL         string       `json:"url,omitempty"`
+	Color       int          `json:"color,omitempty"`
+	Image       *EmbedImage  `json:"image,omitempty"`
+	Footer      *EmbedFooter `json:"footer,omitempty"`
+}
+
+// EmbedImage is the large image of an embed
+type EmbedImage struct {
+	URL string `json:"url"`
+}
+
+// EmbedFooter is the small print of an embed
+type EmbedFooter struct {
+	Text string `json:"text"`
+}
+
+// Message is posted to a webhook
+type Message struct {
+	Content string
+	Embed   Embed
+	// Image is uploaded with the message and shown as the embed's image, so
+	// it stays visible after presigned URLs expire
+	Image     []byte
+	ImageName string
+}
+
+// Post sends msg to the webhook. Mentions in it never ping anyone.
+func Post(ctx context.Context, webhookURL string, msg Message) error {
+	if err := Validate(webhookURL); err != nil {
+		return err
+	}
+	embed := msg.Embed
+	embed.Title = truncate(embed.Title, maxTitle)
+	embed.Description = truncate(embed.Description, maxDescription)
+	if len(msg.Image) > 0 {
+		embed.Image = &EmbedImage{URL: "attachment://" + msg.ImageName}
+	}
+	payload, err := json.Marshal(map[string]any{
+		"content":          truncate(msg.Content, maxContent),
+		"embeds":           []Embed{embed},
+		"allowed_mentions": map[string][]string{"parse": {}},
+	})
+	if err != nil {
+		return err
+	}
+
+	body := bytes.NewReader(payload)
+	contentType := "application/json"
+	if len(msg.Image) > 0 {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		if err := mw.WriteField("payload_json", string(payload)); err != nil {
+			return err
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files[0]"; filename="%s"`, msg.ImageName))
+		header.Set("Content-Type", http.DetectContentType(msg.Image))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(msg.Image); err != nil {
+			return err
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf.Bytes())
+		contentType = mw.FormDataContentType()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized:
+		return ErrGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("discord webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
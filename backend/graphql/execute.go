@@ -0,0 +1,424 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"encore.dev/beta/errs"
+)
+
+// maxDepth is how deeply fields can be nested in a query
+const maxDepth = 10
+
+// maxCalls caps the service calls one query can make, so nested lists
+// can't fan out without bound
+const maxCalls = 200
+
+// errTooComplex fails the fields resolved after maxCalls was reached
+var errTooComplex = errors.New("query needs too many lookups, split it up")
+
+// gqlError is an error as GraphQL responses report it
+type gqlError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// orderedMap is a response object, which keeps its fields in query order
+type orderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+func (m *orderedMap) set(key string, value any) {
+	if m.values == nil {
+		m.values = map[string]any{}
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// MarshalJSON writes the fields in query order
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// resolver computes a field that isn't part of its object's data, usually by
+// calling another service
+type resolver func(e *executor, obj *object, args map[string]any) (any, error)
+
+// objectType describes the fields of a GraphQL object type
+type objectType struct {
+	name string
+	// fields are read from the object's data, named like the REST API's JSON
+	fields map[string]bool
+	// nested are fields whose data is itself an object of the given type
+	nested map[string]*objectType
+	// relations are fields computed by resolvers
+	relations map[string]resolver
+	// load fetches the full data of an object that was built from a partial
+	// one, e.g. a media item from a list
+	load func(e *executor, obj *object) (map[string]any, error)
+}
+
+// object is a value of an object type
+type object struct {
+	typ    *objectType
+	data   map[string]any
+	loaded bool
+}
+
+// newObject wraps data in an object, converting nested objects
+func newObject(t *objectType, data map[string]any) *object {
+	obj := &object{typ: t, data: data}
+	obj.convertNested()
+	return obj
+}
+
+func (obj *object) convertNested() {
+	for key, nt := range obj.typ.nested {
+		switch v := obj.data[key].(type) {
+		case map[string]any:
+			obj.data[key] = newObject(nt, v)
+		case []any:
+			list := make([]any, len(v))
+			for i, item := range v {
+				if m, ok := item.(map[string]any); ok {
+					list[i] = newObject(nt, m)
+				} else {
+					list[i] = item
+				}
+			}
+			obj.data[key] = list
+		}
+	}
+}
+
+// executor runs one operation
+type executor struct {
+	ctx    context.Context
+	doc    *document
+	vars   map[string]any
+	errors []gqlError
+	calls  int
+	memo   map[string]memoEntry
+}
+
+type memoEntry struct {
+	value any
+	err   error
+}
+
+// memoize calls fn once per key and request, counting the calls against maxCalls
+func memoize[T any](e *executor, key string, fn func() (T, error)) (T, error) {
+	if m, ok := e.memo[key]; ok {
+		v, _ := m.value.(T)
+		return v, m.err
+	}
+	var zero T
+	if e.calls >= maxCalls {
+		return zero, errTooComplex
+	}
+	e.calls++
+	v, err := fn()
+	e.memo[key] = memoEntry{value: v, err: err}
+	return v, err
+}
+
+// execute runs the named operation of a document, or its only operation
+func execute(ctx context.Context, doc *document, operationName string, variables map[string]any) (any, []gqlError) {
+	var op *operation
+	for _, o := range doc.operations {
+		if operationName == "" || o.name == operationName {
+			if op != nil {
+				return nil, []gqlError{{Message: "operationName is required for documents with several operations"}}
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		return nil, []gqlError{{Message: fmt.Sprintf("unknown operation %q", operationName)}}
+	}
+	if op.kind != "query" {
+		return nil, []gqlError{{Message: "only queries are supported; use the REST API for changes"}}
+	}
+
+	vars := map[string]any{}
+	for _, def := range op.variables {
+		v, ok := variables[def.name]
+		if !ok {
+			v = def.defaultValue
+		}
+		if v == nil && def.nonNull {
+			return nil, []gqlError{{Message: fmt.Sprintf("variable $%s is required", def.name)}}
+		}
+		vars[def.name] = v
+	}
+
+	e := &executor{ctx: ctx, doc: doc, vars: vars, memo: map[string]memoEntry{}}
+	data := e.selectionSet(newObject(queryType, map[string]any{}), op.selections, nil, 0)
+	return data, e.errors
+}
+
+// fail records a field error
+func (e *executor) fail(err error, path []any) {
+	msg := err.Error()
+	var apiErr *errs.Error
+	if errors.As(err, &apiErr) && apiErr.Message != "" {
+		msg = apiErr.Message
+	}
+	e.errors = append(e.errors, gqlError{Message: msg, Path: path})
+}
+
+// selectionSet resolves the selected fields of an object
+func (e *executor) selectionSet(obj *object, sels []selection, path []any, depth int) *orderedMap {
+	result := &orderedMap{}
+	if depth >= maxDepth {
+		e.fail(fmt.Errorf("query is nested more than %d levels deep", maxDepth), path)
+		return nil
+	}
+
+	for _, sel := range e.collectFields(obj.typ, sels, map[string]bool{}) {
+		key := sel.name
+		if sel.alias != "" {
+			key = sel.alias
+		}
+		fieldPath := append(path[:len(path):len(path)], key)
+
+		value, err := e.resolveField(obj, sel)
+		if err != nil {
+			e.fail(err, fieldPath)
+			result.set(key, nil)
+			continue
+		}
+		result.set(key, e.complete(value, sel, fieldPath, depth+1))
+	}
+	return result
+}
+
+// collectFields flattens fragments and merges fields selected more than
+// once under the same response key
+func (e *executor) collectFields(t *objectType, sels []selection, visited map[string]bool) []selection {
+	var fields []selection
+	index := map[string]int{}
+	for _, sel := range sels {
+		if !e.included(sel.directives) {
+			continue
+		}
+
+		var inner []selection
+		switch {
+		case sel.spread != "":
+			f, ok := e.doc.fragments[sel.spread]
+			if !ok || visited[sel.spread] || f.typeCondition != t.name {
+				continue
+			}
+			visited[sel.spread] = true
+			inner = e.collectFields(t, f.selections, visited)
+		case sel.inline:
+			if sel.typeCondition != "" && sel.typeCondition != t.name {
+				continue
+			}
+			inner = e.collectFields(t, sel.selections, visited)
+		default:
+			inner = []selection{sel}
+		}
+
+		for _, f := range inner {
+			key := f.name
+			if f.alias != "" {
+				key = f.alias
+			}
+			if i, ok := index[key]; ok {
+				fields[i].selections = append(fields[i].selections[:len(fields[i].selections):len(fields[i].selections)], f.selections...)
+				continue
+			}
+			index[key] = len(fields)
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// included applies @skip and @include
+func (e *executor) included(dirs []directive) bool {
+	for _, d := range dirs {
+		cond, _ := e.value(d.args["if"]).(bool)
+		if (d.name == "skip" && cond) || (d.name == "include" && !cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveField returns the value of a field before completion
+func (e *executor) resolveField(obj *object, sel selection) (any, error) {
+	t := obj.typ
+	if sel.name == "__typename" {
+		return t.name, nil
+	}
+	if r, ok := t.relations[sel.name]; ok {
+		args := map[string]any{}
+		for name, v := range sel.args {
+			args[name] = e.value(v)
+		}
+		return r(e, obj, args)
+	}
+	if !t.fields[sel.name] {
+		return nil, fmt.Errorf("cannot query field %q on type %s", sel.name, t.name)
+	}
+
+	value, ok := obj.data[sel.name]
+	if !ok && t.load != nil && !obj.loaded {
+		obj.loaded = true
+		full, err := t.load(e, obj)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range full {
+			if _, exists := obj.data[k]; !exists {
+				obj.data[k] = v
+			}
+		}
+		obj.convertNested()
+		value = obj.data[sel.name]
+	}
+	return value, nil
+}
+
+// complete resolves the sub-selections of objects and lists of them
+func (e *executor) complete(value any, sel selection, path []any, depth int) any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case *object:
+		if len(sel.selections) == 0 {
+			e.fail(fmt.Errorf("field %q of type %s needs a selection of subfields", sel.name, v.typ.name), path)
+			return nil
+		}
+		return e.selectionSet(v, sel.selections, path, depth)
+	case []*object:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, sel, append(path[:len(path):len(path)], i), depth)
+		}
+		return list
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, sel, append(path[:len(path):len(path)], i), depth)
+		}
+		return list
+	}
+	if len(sel.selections) > 0 {
+		e.fail(fmt.Errorf("field %q has no subfields", sel.name), path)
+		return nil
+	}
+	return value
+}
+
+// value replaces variables in an argument value
+func (e *executor) value(v any) any {
+	switch v := v.(type) {
+	case variableRef:
+		return e.vars[string(v)]
+	case enumValue:
+		return string(v)
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.value(item)
+		}
+		return list
+	case map[string]any:
+		obj := map[string]any{}
+		for k, item := range v {
+			obj[k] = e.value(item)
+		}
+		return obj
+	}
+	return v
+}
+
+// argString returns a string argument, "" when it is missing
+func argString(args map[string]any, name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+// argInt returns an integer argument, 0 when it is missing
+func argInt(args map[string]any, name string) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case json.Number:
+		if n, err := strconv.Atoi(v.String()); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+// argBool returns a boolean argument, false when it is missing
+func argBool(args map[string]any, name string) (bool, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("argument %q must be a boolean", name)
+}
+
+// argStrings returns a list of strings argument; a single string is a list of one
+func argStrings(args map[string]any, name string) ([]string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("argument %q must be a list of strings", name)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("argument %q must be a list of strings", name)
+}
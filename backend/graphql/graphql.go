@@ -0,0 +1,102 @@
+// Package graphql serves a read-only GraphQL endpoint over media, tags,
+// collections and processing status, so dashboards can fetch exactly the
+// fields they show, nested collection → items → media → renditions, in one
+// request. Every field is resolved by calling the REST endpoints of the
+// owning service as the caller, so it sees and may do exactly what the REST
+// API allows.
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// maxBodyBytes caps the size of a request
+const maxBodyBytes = 1 << 20
+
+// maxQueryLength caps the length of a query document
+const maxQueryLength = 20000
+
+// request is a GraphQL request
+type request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// response is a GraphQL response; Data is left out when the query couldn't run
+type response struct {
+	Data   any        `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// Query runs a GraphQL query, sent as JSON in a POST body or as the query,
+// operationName and variables (JSON) parameters of a GET request. Only
+// queries are supported; changes go through the REST API.
+//
+//encore:api auth raw method=GET,POST path=/graphql
+func Query(w http.ResponseWriter, req *http.Request) {
+	var gqlReq request
+	if req.Method == http.MethodGet {
+		q := req.URL.Query()
+		gqlReq.Query = q.Get("query")
+		gqlReq.OperationName = q.Get("operationName")
+		if vars := q.Get("variables"); vars != "" {
+			if err := decodeJSON([]byte(vars), &gqlReq.Variables); err != nil {
+				writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: "variables must be a JSON object"}}})
+				return
+			}
+		}
+	} else {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: "failed to read request"}}})
+			return
+		}
+		if len(body) > maxBodyBytes {
+			writeResponse(w, http.StatusRequestEntityTooLarge, &response{Errors: []gqlError{{Message: "request too large"}}})
+			return
+		}
+		if err := decodeJSON(body, &gqlReq); err != nil {
+			writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: "request must be a JSON object with a query"}}})
+			return
+		}
+	}
+
+	if gqlReq.Query == "" {
+		writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: "query is required"}}})
+		return
+	}
+	if len(gqlReq.Query) > maxQueryLength {
+		writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: "query too long"}}})
+		return
+	}
+
+	doc, err := parse(gqlReq.Query)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, &response{Errors: []gqlError{{Message: err.Error()}}})
+		return
+	}
+
+	data, errors := execute(req.Context(), doc, gqlReq.OperationName, gqlReq.Variables)
+	if data == nil {
+		writeResponse(w, http.StatusBadRequest, &response{Errors: errors})
+		return
+	}
+	writeResponse(w, http.StatusOK, &response{Data: data, Errors: errors})
+}
+
+// decodeJSON decodes keeping numbers exact, so large IDs survive
+func decodeJSON(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,401 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	authpkg "encore.app/auth"
+	"encore.app/collection"
+	"encore.app/media"
+	"encore.app/processing"
+)
+
+// The object types. Fields are taken from the JSON of the REST responses
+// they are resolved from, so both APIs name things the same way.
+var (
+	queryType = &objectType{name: "Query"}
+
+	userType = &objectType{name: "User", fields: fieldsOf(authpkg.MeResponse{})}
+
+	profileType = &objectType{name: "Profile", fields: fieldsOf(authpkg.PublicProfile{})}
+
+	mediaType = &objectType{name: "Media", fields: fieldsOf(media.GetMediaResponse{}, media.MediaItem{})}
+
+	mediaPageType = &objectType{name: "MediaPage", fields: fieldsOf(media.ListMediaResponse{})}
+
+	processingStatusType = &objectType{name: "ProcessingStatus", fields: fieldsOf(processing.JobStatusResponse{})}
+
+	jobType = &objectType{name: "Job", fields: fieldsOf(processing.JobAttempt{})}
+
+	renditionType = &objectType{name: "Rendition", fields: fieldsOf(processing.RenditionResponse{})}
+
+	collectionType = &objectType{
+		name: "Collection",
+		// items is a relation with its own pagination
+		fields: without(fieldsOf(collection.CollectionResponse{}, collection.GetCollectionResponse{}, collection.SharedCollection{}),
+			"items", "page", "page_size"),
+	}
+
+	collectionItemType = &objectType{name: "CollectionItem", fields: fieldsOf(collection.CollectionMediaItem{})}
+)
+
+// The relations refer back to the types, so they are wired up here
+func init() {
+	queryType.relations = map[string]resolver{
+		"me":                 resolveMe,
+		"media":              resolveMedia,
+		"media_list":         resolveMediaList,
+		"collections":        resolveCollections,
+		"shared_collections": resolveSharedCollections,
+		"collection":         resolveCollection,
+		"processing_status":  resolveProcessingStatus,
+	}
+
+	mediaPageType.nested = map[string]*objectType{"items": mediaType}
+
+	mediaType.load = loadMedia
+	mediaType.relations = map[string]resolver{
+		"processing": resolveMediaProcessing,
+		"jobs":       resolveMediaJobs,
+		"renditions": resolveMediaRenditions,
+		"source":     resolveMediaSource,
+	}
+
+	collectionType.nested = map[string]*objectType{"owner": profileType}
+	collectionType.load = loadCollection
+	collectionType.relations = map[string]resolver{
+		"items": resolveCollectionItems,
+	}
+
+	collectionItemType.relations = map[string]resolver{
+		"media": resolveItemMedia,
+	}
+}
+
+// fieldsOf returns the JSON field names of structs
+func fieldsOf(structs ...any) map[string]bool {
+	fields := map[string]bool{}
+	for _, s := range structs {
+		t := reflect.TypeOf(s)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				fields[name] = true
+			}
+		}
+	}
+	return fields
+}
+
+// without removes names from a field set
+func without(fields map[string]bool, names ...string) map[string]bool {
+	for _, name := range names {
+		delete(fields, name)
+	}
+	return fields
+}
+
+// toMap turns a REST response into object data
+func toMap(v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// toObjects turns a list of REST items into objects of a type
+func toObjects[T any](t *objectType, items []T) ([]*object, error) {
+	objects := make([]*object, 0, len(items))
+	for _, item := range items {
+		data, err := toMap(item)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, newObject(t, data))
+	}
+	return objects, nil
+}
+
+// id returns the id field of an object
+func id(obj *object) string {
+	s, _ := obj.data["id"].(string)
+	return s
+}
+
+func resolveMe(e *executor, _ *object, _ map[string]any) (any, error) {
+	me, err := memoize(e, "me", func() (*authpkg.MeResponse, error) {
+		return authpkg.Me(e.ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := toMap(me)
+	if err != nil {
+		return nil, err
+	}
+	return newObject(userType, data), nil
+}
+
+// getMedia fetches the details of a media item once per request
+func getMedia(e *executor, mediaID string) (map[string]any, error) {
+	resp, err := memoize(e, "media:"+mediaID, func() (*media.GetMediaResponse, error) {
+		return media.GetMedia(e.ctx, mediaID, &media.GetMediaRequest{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toMap(resp)
+}
+
+func loadMedia(e *executor, obj *object) (map[string]any, error) {
+	return getMedia(e, id(obj))
+}
+
+func resolveMedia(e *executor, _ *object, args map[string]any) (any, error) {
+	mediaID, err := argString(args, "id")
+	if err != nil {
+		return nil, err
+	}
+	if mediaID == "" {
+		return nil, fmt.Errorf("argument %q is required", "id")
+	}
+	data, err := getMedia(e, mediaID)
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(mediaType, data)
+	obj.loaded = true
+	return obj, nil
+}
+
+func resolveMediaList(e *executor, _ *object, args map[string]any) (any, error) {
+	req := &media.ListMediaRequest{}
+	var err error
+	if req.Page, err = argInt(args, "page"); err != nil {
+		return nil, err
+	}
+	if req.PageSize, err = argInt(args, "page_size"); err != nil {
+		return nil, err
+	}
+	if req.Tags, err = argStrings(args, "tags"); err != nil {
+		return nil, err
+	}
+	if req.Status, err = argString(args, "status"); err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("media_list:%d:%d:%s:%s", req.Page, req.PageSize, strings.Join(req.Tags, ","), req.Status)
+	resp, err := memoize(e, key, func() (*media.ListMediaResponse, error) {
+		return media.ListMedia(e.ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := toMap(resp)
+	if err != nil {
+		return nil, err
+	}
+	return newObject(mediaPageType, data), nil
+}
+
+// resolveMediaSource returns the media a clip or extracted audio was derived from
+func resolveMediaSource(e *executor, obj *object, _ map[string]any) (any, error) {
+	// Only the details say whether the media was derived from another
+	if _, err := e.resolveField(obj, selection{name: "source_media_id"}); err != nil {
+		return nil, err
+	}
+	sourceID, _ := obj.data["source_media_id"].(string)
+	if sourceID == "" {
+		return nil, nil
+	}
+	return resolveMedia(e, nil, map[string]any{"id": sourceID})
+}
+
+// processingStatus fetches the processing status of a media item once per request
+func processingStatus(e *executor, mediaID string) (any, error) {
+	resp, err := memoize(e, "processing:"+mediaID, func() (*processing.JobStatusResponse, error) {
+		return processing.GetJobStatus(e.ctx, mediaID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := toMap(resp)
+	if err != nil {
+		return nil, err
+	}
+	return newObject(processingStatusType, data), nil
+}
+
+func resolveProcessingStatus(e *executor, _ *object, args map[string]any) (any, error) {
+	mediaID, err := argString(args, "media_id")
+	if err != nil {
+		return nil, err
+	}
+	if mediaID == "" {
+		return nil, fmt.Errorf("argument %q is required", "media_id")
+	}
+	return processingStatus(e, mediaID)
+}
+
+func resolveMediaProcessing(e *executor, obj *object, _ map[string]any) (any, error) {
+	return processingStatus(e, id(obj))
+}
+
+func resolveMediaJobs(e *executor, obj *object, _ map[string]any) (any, error) {
+	mediaID := id(obj)
+	resp, err := memoize(e, "jobs:"+mediaID, func() (*processing.ListJobsResponse, error) {
+		return processing.ListJobs(e.ctx, mediaID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toObjects(jobType, resp.Jobs)
+}
+
+func resolveMediaRenditions(e *executor, obj *object, _ map[string]any) (any, error) {
+	mediaID := id(obj)
+	resp, err := memoize(e, "renditions:"+mediaID, func() (*processing.ListRenditionsResponse, error) {
+		return processing.ListRenditions(e.ctx, mediaID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toObjects(renditionType, resp.Renditions)
+}
+
+// listCollections fetches the caller's collections once per request and filter
+func listCollections(e *executor, args map[string]any) (*collection.ListCollectionsResponse, error) {
+	req := &collection.ListCollectionsRequest{}
+	var err error
+	if req.Tags, err = argStrings(args, "tags"); err != nil {
+		return nil, err
+	}
+	if req.Query, err = argString(args, "q"); err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("collections:%s:%s", strings.Join(req.Tags, ","), req.Query)
+	return memoize(e, key, func() (*collection.ListCollectionsResponse, error) {
+		return collection.ListCollections(e.ctx, req)
+	})
+}
+
+func resolveCollections(e *executor, _ *object, args map[string]any) (any, error) {
+	resp, err := listCollections(e, args)
+	if err != nil {
+		return nil, err
+	}
+	return toObjects(collectionType, resp.Collections)
+}
+
+func resolveSharedCollections(e *executor, _ *object, _ map[string]any) (any, error) {
+	resp, err := listCollections(e, nil)
+	if err != nil {
+		return nil, err
+	}
+	return toObjects(collectionType, resp.SharedWithMe)
+}
+
+// getCollection fetches a collection with one page of its items once per request
+func getCollection(e *executor, collectionID string, req *collection.GetCollectionRequest) (*collection.GetCollectionResponse, error) {
+	key := fmt.Sprintf("collection:%s:%s:%d:%d:%t", collectionID, req.Token, req.Page, req.PageSize, req.LazyStreams)
+	return memoize(e, key, func() (*collection.GetCollectionResponse, error) {
+		return collection.GetCollection(e.ctx, collectionID, req)
+	})
+}
+
+// collectionData turns collection details into object data; the share
+// token it was opened with is kept for loading its items
+func collectionData(resp *collection.GetCollectionResponse, token string) (map[string]any, error) {
+	data, err := toMap(resp)
+	if err != nil {
+		return nil, err
+	}
+	delete(data, "items")
+	delete(data, "page")
+	delete(data, "page_size")
+	data["_token"] = token
+	return data, nil
+}
+
+func loadCollection(e *executor, obj *object) (map[string]any, error) {
+	token, _ := obj.data["_token"].(string)
+	resp, err := getCollection(e, id(obj), &collection.GetCollectionRequest{Token: token, Page: 1, PageSize: 1, LazyStreams: true})
+	if err != nil {
+		return nil, err
+	}
+	return collectionData(resp, token)
+}
+
+func resolveCollection(e *executor, _ *object, args map[string]any) (any, error) {
+	collectionID, err := argString(args, "id")
+	if err != nil {
+		return nil, err
+	}
+	if collectionID == "" {
+		return nil, fmt.Errorf("argument %q is required", "id")
+	}
+	token, err := argString(args, "token")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := getCollection(e, collectionID, &collection.GetCollectionRequest{Token: token, Page: 1, PageSize: 1, LazyStreams: true})
+	if err != nil {
+		return nil, err
+	}
+	data, err := collectionData(resp, token)
+	if err != nil {
+		return nil, err
+	}
+	obj := newObject(collectionType, data)
+	obj.loaded = true
+	return obj, nil
+}
+
+// resolveCollectionItems returns a page of a collection's items. Stream URLs
+// are left out unless streams: true is passed, as signing them is slow.
+func resolveCollectionItems(e *executor, obj *object, args map[string]any) (any, error) {
+	req := &collection.GetCollectionRequest{}
+	req.Token, _ = obj.data["_token"].(string)
+	var err error
+	if req.Page, err = argInt(args, "page"); err != nil {
+		return nil, err
+	}
+	if req.PageSize, err = argInt(args, "page_size"); err != nil {
+		return nil, err
+	}
+	streams, err := argBool(args, "streams")
+	if err != nil {
+		return nil, err
+	}
+	req.LazyStreams = !streams
+
+	resp, err := getCollection(e, id(obj), req)
+	if err != nil {
+		return nil, err
+	}
+	return toObjects(collectionItemType, resp.Items)
+}
+
+// resolveItemMedia returns the media of a collection item. Fields the item
+// doesn't carry are loaded from the media service, which only shows the
+// caller's own media.
+func resolveItemMedia(e *executor, obj *object, _ map[string]any) (any, error) {
+	data := map[string]any{}
+	for _, key := range []string{"id", "title", "original_filename", "mime_type", "status"} {
+		if v, ok := obj.data[key]; ok {
+			data[key] = v
+		}
+	}
+	return newObject(mediaType, data), nil
+}
@@ -0,0 +1,123 @@
+// Package idempotency lets mutating endpoints honour an Idempotency-Key
+// header: the first request with a key runs and its response is stored, and
+// retries with the same key get that response back instead of running
+// again. Each service keeps its keys in an idempotency_keys table of its own
+// database (see the services' migrations).
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Retention is how long a key is remembered
+const Retention = 24 * time.Hour
+
+// staleAfter is when a request that never stored its response, e.g.
+// because the instance crashed, no longer blocks retries
+const staleAfter = 10 * time.Minute
+
+// maxKeyLength caps the length of a key
+const maxKeyLength = 255
+
+// Do runs fn unless a request of the user to the same endpoint already used
+// key, in which case it returns that request's response. An empty key runs
+// fn as usual. req is fingerprinted, so reusing a key for a different
+// request fails; failed requests aren't stored and may be retried with the
+// same key.
+func Do[T any](ctx context.Context, db *sqldb.Database, userID int64, endpoint, key string, req any, fn func() (*T, error)) (*T, error) {
+	if key == "" {
+		return fn()
+	}
+	if len(key) > maxKeyLength {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("Idempotency-Key must be at most 255 characters").Err()
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to fingerprint request").Err()
+	}
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Expired keys of the user and abandoned attempts of this key are
+	// dropped first, so they can be used again
+	_, _ = db.Exec(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND (created_at < $2 OR (endpoint = $3 AND key = $4 AND response IS NULL AND created_at < $5))
+	`, userID, time.Now().Add(-Retention), endpoint, key, time.Now().Add(-staleAfter))
+
+	claimed, err := db.Exec(ctx, `
+		INSERT INTO idempotency_keys (user_id, endpoint, key, fingerprint, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT DO NOTHING
+	`, userID, endpoint, key, fingerprint)
+	if err != nil {
+		rlog.Error("failed to claim idempotency key", "error", err, "endpoint", endpoint)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to check Idempotency-Key").Err()
+	}
+
+	if claimed.RowsAffected() == 0 {
+		return replay[T](ctx, db, userID, endpoint, key, fingerprint)
+	}
+
+	resp, err := fn()
+	if err != nil {
+		_, _ = db.Exec(ctx, `
+			DELETE FROM idempotency_keys WHERE user_id = $1 AND endpoint = $2 AND key = $3
+		`, userID, endpoint, key)
+		return nil, err
+	}
+
+	stored, err := json.Marshal(resp)
+	if err == nil {
+		_, err = db.Exec(ctx, `
+			UPDATE idempotency_keys SET response = $4
+			WHERE user_id = $1 AND endpoint = $2 AND key = $3
+		`, userID, endpoint, key, stored)
+	}
+	if err != nil {
+		// The request succeeded; a retry will be told it is still in progress
+		rlog.Error("failed to store idempotent response", "error", err, "endpoint", endpoint)
+	}
+	return resp, nil
+}
+
+// replay returns the stored response of an earlier request with the key
+func replay[T any](ctx context.Context, db *sqldb.Database, userID int64, endpoint, key, fingerprint string) (*T, error) {
+	var storedFingerprint string
+	var stored []byte
+	err := db.QueryRow(ctx, `
+		SELECT fingerprint, response FROM idempotency_keys
+		WHERE user_id = $1 AND endpoint = $2 AND key = $3
+	`, userID, endpoint, key).Scan(&storedFingerprint, &stored)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// The earlier request failed and released the key just now
+		return nil, errs.B().Code(errs.Aborted).Msg("a request with this Idempotency-Key just failed, retry it").Err()
+	}
+	if err != nil {
+		rlog.Error("failed to load idempotency key", "error", err, "endpoint", endpoint)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to check Idempotency-Key").Err()
+	}
+
+	if storedFingerprint != fingerprint {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("Idempotency-Key was already used for a different request").Err()
+	}
+	if stored == nil {
+		return nil, errs.B().Code(errs.Aborted).Msg("a request with this Idempotency-Key is still in progress").Err()
+	}
+
+	var resp T
+	if err := json.Unmarshal(stored, &resp); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to replay response").Err()
+	}
+	return &resp, nil
+}
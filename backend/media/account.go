@@ -0,0 +1,126 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Deleting an account removes the user's media rows and stored files; media
+// they uploaded to a team stays with the team
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "media-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountMedia,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteAccountMedia deletes every personal media item of a deleted account.
+// Items are removed one by one, so a retry after a failure continues where
+// it stopped.
+func deleteAccountMedia(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	client, err := getMinioClient()
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, s3_key_original, COALESCE(s3_key_processed, '') FROM media WHERE owner_id = $1 AND team_id IS NULL
+	`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	type mediaObjects struct {
+		id, original, processed string
+	}
+	var items []mediaObjects
+	for rows.Next() {
+		var m mediaObjects
+		if err := rows.Scan(&m.id, &m.original, &m.processed); err != nil {
+			continue
+		}
+		items = append(items, m)
+	}
+	rows.Close()
+
+	for _, m := range items {
+		removeMediaObjects(ctx, client, m.id, m.original, m.processed)
+		if err := deleteMediaRow(ctx, m.id, msg.UserID); err != nil {
+			return fmt.Errorf("failed to delete media %s: %w", m.id, err)
+		}
+	}
+
+	// Uploads that were never confirmed or whose rows are gone, unless team
+	// media still keeps its originals under the prefix
+	var teamMedia int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM media WHERE owner_id = $1`, msg.UserID).Scan(&teamMedia); err != nil {
+		return fmt.Errorf("failed to count team media: %w", err)
+	}
+	if teamMedia == 0 {
+		removePrefix(ctx, client, fmt.Sprintf("original/%d/", msg.UserID))
+	}
+
+	if _, err := db.Exec(ctx, `DELETE FROM storage_snapshot_users WHERE user_id = $1`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to delete storage usage: %w", err)
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM retention_rules WHERE owner_id = $1`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to delete retention rules: %w", err)
+	}
+	if _, err := db.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to delete idempotency keys: %w", err)
+	}
+	// Team transcode minutes keep counting for the month, without the user
+	if _, err := db.Exec(ctx, `DELETE FROM transcode_usage WHERE owner_id = $1 AND team_id IS NULL`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to delete transcode usage: %w", err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE transcode_usage SET owner_id = NULL WHERE owner_id = $1`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to anonymize transcode usage: %w", err)
+	}
+
+	if _, err := db.Exec(ctx, `DELETE FROM egress_usage WHERE owner_id = $1`, msg.UserID); err != nil {
+		return fmt.Errorf("failed to delete egress usage: %w", err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE egress_usage SET viewer = '' WHERE viewer = $1`, userViewer(msg.UserID)); err != nil {
+		return fmt.Errorf("failed to anonymize egress usage: %w", err)
+	}
+
+	rlog.Info("account media deleted", "user_id", msg.UserID, "deleted", len(items))
+	return authpkg.ReportDeletionProgress(ctx, &authpkg.DeletionProgress{
+		DeletionID:   msg.DeletionID,
+		Service:      "media",
+		DeletedItems: len(items),
+	})
+}
+
+// deleteMediaRow deletes a media item's row, releasing its blob with it, and
+// announces the deletion so other services drop what they keep of it
+func deleteMediaRow(ctx context.Context, id string, ownerID int64) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := releaseOriginal(ctx, tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM media WHERE id = $1`, id); err != nil {
+		return err
+	}
+	outboxID, err := enqueue(ctx, tx, outboxMediaDeleted, &MediaDeleted{MediaID: id, OwnerID: ownerID})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishNow(ctx, outboxID)
+	return nil
+}
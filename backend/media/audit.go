@@ -0,0 +1,77 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Audit log events of the media service
+const (
+	auditMediaUploaded    = "media_uploaded"
+	auditMediaImported    = "media_imported"
+	auditMediaClipped     = "media_clip_created"
+	auditAudioExtracted   = "media_audio_extracted"
+	auditMediaTagsUpdated = "media_tags_updated"
+	auditMediaDeleted     = "media_deleted"
+	auditMediaTeamChanged = "media_team_changed"
+	auditOriginalRestored = "media_original_restored"
+	auditMediaScheduled   = "media_publish_scheduled"
+	auditMediaPublished   = "media_published"
+	auditMediaExpirySet   = "media_expiry_set"
+	auditMediaExpiryUnset = "media_expiry_cleared"
+	auditMediaTrashed     = "media_trashed"
+	auditMediaUntrashed   = "media_untrashed"
+)
+
+// recordAudit publishes a change to a media item to the audit log; before
+// and after are snapshots of it, nil when there is none. Like in the auth
+// service, auditing never fails the request.
+func recordAudit(ctx context.Context, userID int64, event, mediaID string, before, after any, details map[string]string) {
+	record := &authpkg.AuditRecord{
+		EventID:      uuid.New().String(),
+		UserID:       userID,
+		Event:        event,
+		Service:      "media",
+		ResourceType: "media",
+		ResourceID:   mediaID,
+		Details:      details,
+		OccurredAt:   time.Now(),
+	}
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		record.IP = strings.TrimSpace(strings.Split(req.Headers.Get("X-Forwarded-For"), ",")[0])
+		record.UserAgent = req.Headers.Get("User-Agent")
+	}
+	record.Before = auditSnapshot(before)
+	record.After = auditSnapshot(after)
+
+	if _, err := authpkg.AuditTopic.Publish(ctx, record); err != nil {
+		rlog.Error("failed to publish audit event", "error", err, "event", event, "media_id", mediaID)
+	}
+}
+
+// auditSnapshot encodes a snapshot for the audit log, nil for none
+func auditSnapshot(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// mediaSnapshot loads a media item as the audit log shows it, nil when it
+// can't be loaded
+func mediaSnapshot(ctx context.Context, mediaID string) *MediaInfo {
+	m, err := scanMediaInfo(db.QueryRow(ctx, `SELECT `+mediaInfoColumns+` FROM media m WHERE m.id = $1`, mediaID).Scan)
+	if err != nil {
+		return nil
+	}
+	return &m
+}
@@ -0,0 +1,142 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// CreateClipRequest selects the segment of the source video to cut
+type CreateClipRequest struct {
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+	Title        string  `json:"title,omitempty"`
+	// Reencode cuts frame-accurately by re-encoding to MP4; by default the
+	// streams are copied and the clip starts at the keyframe before StartSeconds
+	Reencode bool `json:"reencode,omitempty"`
+}
+
+// CreateClipResponse identifies a new media item derived from another one
+type CreateClipResponse struct {
+	MediaID       string `json:"media_id"`
+	SourceMediaID string `json:"source_media_id"`
+	Status        string `json:"status"`
+}
+
+// CreateClip cuts a segment of a video into a new media item owned by the
+// caller and linked to the source. Clips of team media belong to the team.
+//
+//encore:api auth method=POST path=/media/:id/clip
+func CreateClip(ctx context.Context, id string, req *CreateClipRequest) (*CreateClipResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if req.StartSeconds < 0 || req.EndSeconds <= req.StartSeconds {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("end_seconds must be after start_seconds").Err()
+	}
+
+	// Verify access and that the source is a processed video
+	var ownerID int64
+	var status, filename, mimeType, title, packaging, preset, teamID string
+	var duration int
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, status, COALESCE(original_filename, ''), COALESCE(mime_type, ''), COALESCE(title, ''),
+			   COALESCE(duration_seconds, 0), COALESCE(packaging, ''), COALESCE(preset, ''), COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &status, &filename, &mimeType, &title, &duration, &packaging, &preset, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "ready" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is not ready").Err()
+	}
+	if duration <= 0 {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("clips can only be cut from video or audio").Err()
+	}
+	if req.EndSeconds > float64(duration)+1 {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("end_seconds is past the end of the media").Err()
+	}
+	// Clips of team media stay in the team and count against its limits
+	if err := checkDerivedQuota(ctx, userData, teamID); err != nil {
+		return nil, err
+	}
+	// The clip is cut from the original
+	if err := useOriginal(ctx, id); err != nil {
+		return nil, err
+	}
+
+	// Re-encoded clips are always MP4; stream copies keep the source container
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	if req.Reencode {
+		ext = ".mp4"
+		mimeType = "video/mp4"
+	}
+	clipFilename := fmt.Sprintf("%s-clip%s", base, ext)
+
+	clipTitle := req.Title
+	if clipTitle == "" && title != "" {
+		clipTitle = title + " (clip)"
+	}
+
+	// The processing worker cuts the segment into this key before processing it
+	clipID := uuid.New().String()
+	s3Key := fmt.Sprintf("original/%d/%s/%s", userData.UserID, clipID, clipFilename)
+
+	// The record and its MediaUploaded event are written together
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		rlog.Error("failed to begin transaction", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create clip").Err()
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO media (id, owner_id, title, original_filename, s3_key_original, mime_type, status,
+						   packaging, preset, source_media_id, clip_start_seconds, clip_end_seconds,
+						   clip_reencode, team_id, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, 'queued', NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, $12,
+				NULLIF($13, '')::uuid, NOW())
+	`, clipID, userData.UserID, clipTitle, clipFilename, s3Key, mimeType, packaging, preset,
+		id, req.StartSeconds, req.EndSeconds, req.Reencode, teamID)
+	if err != nil {
+		rlog.Error("failed to create clip record", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create clip").Err()
+	}
+
+	outboxID, err := enqueue(ctx, tx, outboxMediaUploaded, &MediaUploaded{
+		MediaID:   clipID,
+		S3Key:     s3Key,
+		OwnerID:   userData.UserID,
+		Packaging: packaging,
+		Preset:    preset,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		rlog.Error("failed to queue clip", "error", err, "media_id", clipID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue clip").Err()
+	}
+	publishNow(ctx, outboxID)
+
+	publishStatus(ctx, userData.UserID, clipID, "queued")
+	recordAudit(ctx, userData.UserID, auditMediaClipped, clipID, nil, mediaSnapshot(ctx, clipID), map[string]string{"source_media_id": id})
+
+	return &CreateClipResponse{
+		MediaID:       clipID,
+		SourceMediaID: id,
+		Status:        "queued",
+	}, nil
+}
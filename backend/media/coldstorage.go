@@ -0,0 +1,339 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// Storage tiers of an original
+const (
+	// TierHot originals are in the main bucket
+	TierHot = "hot"
+	// TierCold originals are in the cold storage bucket
+	TierCold = "cold"
+	// TierRestoring originals are being copied back to the main bucket
+	TierRestoring = "restoring"
+)
+
+// tieringBatch caps the originals moved per run
+const tieringBatch = 100
+
+// coldEligible selects media m whose original may move to cold storage:
+// processed media whose original is neither the stream nor shared
+const coldEligible = `m.storage_tier = 'hot' AND m.status = 'ready'
+	AND m.s3_key_processed IS NOT NULL AND m.s3_key_processed <> m.s3_key_original
+	AND COALESCE(m.packaging, '') <> 'dash'
+	AND NOT EXISTS (SELECT 1 FROM blobs b WHERE b.s3_key = m.s3_key_original AND b.ref_count > 1)`
+
+// originalLinkTTL is how long a download link of an original is valid
+const originalLinkTTL = 15 * time.Minute
+
+// getColdStorageAfter returns how long an original of processed media
+// stays unused before it moves to cold storage (COLD_STORAGE_AFTER, 30
+// days by default)
+func getColdStorageAfter() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("COLD_STORAGE_AFTER")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// errOriginalCold is returned when an action needs an original that is in
+// cold storage
+var errOriginalCold = errs.B().Code(errs.FailedPrecondition).
+	Msg("the original is in cold storage; restore it with POST /media/:id/restore first").Err()
+
+// useOriginal marks the original of a media item as used now, so it isn't
+// moved to cold storage while an action reads it. It fails unless the
+// original is in the main bucket.
+func useOriginal(ctx context.Context, mediaID string) error {
+	var tier string
+	err := db.QueryRow(ctx, `
+		UPDATE media SET original_used_at = NOW() WHERE id = $1
+		RETURNING storage_tier
+	`, mediaID).Scan(&tier)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err != nil {
+		return errs.B().Code(errs.Internal).Msg("failed to check storage tier").Err()
+	}
+	if tier != TierHot {
+		return errOriginalCold
+	}
+	return nil
+}
+
+// Originals are moved to cold storage hourly
+var _ = cron.NewJob("media-cold-tiering", cron.JobConfig{
+	Title:    "Move unused originals to cold storage",
+	Every:    1 * cron.Hour,
+	Endpoint: TierOriginals,
+})
+
+// TierOriginalsResponse counts the originals moved
+type TierOriginalsResponse struct {
+	Moved int `json:"moved"`
+}
+
+// TierOriginals moves the originals of processed media unused for
+// COLD_STORAGE_AFTER to the cold storage bucket, when one is configured.
+// Originals still served as the stream stay: those of unprocessed media,
+// and of DASH media, whose progressive downloads use the original.
+//
+//encore:api private
+func TierOriginals(ctx context.Context) (*TierOriginalsResponse, error) {
+	resp := &TierOriginalsResponse{}
+	coldBucket := objectstore.ColdBucket()
+	if coldBucket == "" {
+		return resp, nil
+	}
+
+	cutoff := time.Now().Add(-getColdStorageAfter())
+	rows, err := db.Query(ctx, `
+		SELECT m.id::text, m.s3_key_original FROM media m
+		WHERE `+coldEligible+`
+		  AND COALESCE(m.original_used_at, m.created_at) < $1
+		ORDER BY COALESCE(m.original_used_at, m.created_at)
+		LIMIT $2
+	`, cutoff, tieringBatch)
+	if err != nil {
+		return nil, err
+	}
+	type original struct {
+		mediaID, key string
+	}
+	var originals []original
+	for rows.Next() {
+		var o original
+		if err := rows.Scan(&o.mediaID, &o.key); err == nil {
+			originals = append(originals, o)
+		}
+	}
+	rows.Close()
+	if len(originals) == 0 {
+		return resp, nil
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range originals {
+		moved, err := moveToColdStorage(ctx, client, o.mediaID, o.key, cutoff)
+		if err != nil {
+			rlog.Warn("failed to move original to cold storage", "error", err, "media_id", o.mediaID)
+			continue
+		}
+		if moved {
+			resp.Moved++
+		}
+	}
+	rlog.Info("originals moved to cold storage", "moved", resp.Moved)
+	return resp, nil
+}
+
+// moveToColdStorage copies an original to the cold bucket and removes it
+// from the main bucket, unless it was used since it was selected; it
+// reports whether it moved
+func moveToColdStorage(ctx context.Context, client *minio.Client, mediaID, key string, cutoff time.Time) (bool, error) {
+	coldBucket := objectstore.ColdBucket()
+	if err := objectstore.CopyObject(ctx, client, key, objectstore.Bucket(), coldBucket, objectstore.ColdStorageClass()); err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(ctx, `
+		UPDATE media SET storage_tier = 'cold', tiered_at = NOW()
+		WHERE id = $1 AND storage_tier = 'hot' AND COALESCE(original_used_at, created_at) < $2
+	`, mediaID, cutoff)
+	if err != nil || result.RowsAffected() == 0 {
+		// Used (or deleted) in the meantime: the copy goes
+		_ = client.RemoveObject(ctx, coldBucket, key, minio.RemoveObjectOptions{})
+		return false, err
+	}
+	if err := client.RemoveObject(ctx, objectstore.Bucket(), key, minio.RemoveObjectOptions{}); err != nil {
+		rlog.Warn("failed to remove tiered original", "error", err, "media_id", mediaID)
+	}
+	return true, nil
+}
+
+// OriginalRestoreRequested asks for an original to be copied back from cold
+// storage
+type OriginalRestoreRequested struct {
+	MediaID string `json:"media_id"`
+	UserID  int64  `json:"user_id"`
+}
+
+// OriginalRestoreRequestedTopic carries restores to the media service's
+// background worker
+var OriginalRestoreRequestedTopic = pubsub.NewTopic[*OriginalRestoreRequested]("original-restore-requested", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(OriginalRestoreRequestedTopic, "media-original-restore",
+	pubsub.SubscriptionConfig[*OriginalRestoreRequested]{
+		Handler: restoreOriginal,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// RestoreOriginalResponse is the tier of the original after the request
+type RestoreOriginalResponse struct {
+	MediaID     string `json:"media_id"`
+	StorageTier string `json:"storage_tier"`
+}
+
+// RestoreOriginal starts copying an original back from cold storage; it's
+// "restoring" until the copy is done and "hot" afterwards, when it can be
+// downloaded and reprocessed again. Restoring a hot original does nothing.
+//
+//encore:api auth method=POST path=/media/:id/restore
+func RestoreOriginal(ctx context.Context, id string) (*RestoreOriginalResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID, tier string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), storage_tier FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &tier)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	resp := &RestoreOriginalResponse{MediaID: id, StorageTier: tier}
+	if tier == TierHot {
+		return resp, nil
+	}
+	// A repeated request publishes again, which restoreOriginal tolerates
+	if _, err := db.Exec(ctx, `UPDATE media SET storage_tier = 'restoring' WHERE id = $1 AND storage_tier <> 'hot'`, id); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to restore original").Err()
+	}
+	if _, err := OriginalRestoreRequestedTopic.Publish(ctx, &OriginalRestoreRequested{MediaID: id, UserID: userData.UserID}); err != nil {
+		rlog.Error("failed to publish original restore", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to restore original").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditOriginalRestored, id,
+		map[string]string{"storage_tier": tier}, map[string]string{"storage_tier": TierRestoring}, nil)
+	resp.StorageTier = TierRestoring
+	return resp, nil
+}
+
+// restoreOriginal copies an original back to the main bucket and removes
+// its cold copy. The original counts as used, so it stays for another
+// COLD_STORAGE_AFTER.
+func restoreOriginal(ctx context.Context, msg *OriginalRestoreRequested) error {
+	var key, tier string
+	err := db.QueryRow(ctx, `SELECT s3_key_original, storage_tier FROM media WHERE id = $1`, msg.MediaID).Scan(&key, &tier)
+	if errors.Is(err, sqldb.ErrNoRows) || (err == nil && tier == TierHot) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return err
+	}
+	coldBucket := objectstore.ColdBucket()
+	if coldBucket == "" {
+		rlog.Error("original in cold storage but COLD_STORAGE_BUCKET is not set", "media_id", msg.MediaID)
+		return errors.New("cold storage bucket not configured")
+	}
+	if err := objectstore.CopyObject(ctx, client, key, coldBucket, objectstore.Bucket(), ""); err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+		UPDATE media SET storage_tier = 'hot', tiered_at = NULL, original_used_at = NOW() WHERE id = $1
+	`, msg.MediaID)
+	if err != nil {
+		return err
+	}
+	if err := client.RemoveObject(ctx, coldBucket, key, minio.RemoveObjectOptions{}); err != nil {
+		rlog.Warn("failed to remove restored cold copy", "error", err, "media_id", msg.MediaID)
+	}
+	rlog.Info("original restored", "media_id", msg.MediaID, "user_id", msg.UserID)
+	return nil
+}
+
+// GetOriginalResponse is a download link of an original
+type GetOriginalResponse struct {
+	URL       string    `json:"url"`
+	Filename  string    `json:"filename"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetOriginal returns a download link of the file as uploaded. Originals in
+// cold storage have to be restored first.
+//
+//encore:api auth method=GET path=/media/:id/original
+func GetOriginal(ctx context.Context, id string) (*GetOriginalResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID, key, filename, status string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), s3_key_original, COALESCE(original_filename, ''), status
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &key, &filename, &status)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+	if status == "uploading" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is still uploading").Err()
+	}
+	if err := useOriginal(ctx, id); err != nil {
+		return nil, err
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+	params := url.Values{}
+	params.Set("response-content-disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
+		asciiFilename(filename), url.PathEscape(filename)))
+	u, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), key, originalLinkTTL, params)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to generate download URL").Err()
+	}
+	return &GetOriginalResponse{URL: u.String(), Filename: filename, ExpiresAt: time.Now().Add(originalLinkTTL)}, nil
+}
+
+// asciiFilename makes a filename safe for the quoted filename parameter of
+// Content-Disposition
+func asciiFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,131 @@
+package media
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// dashSegmentRefPattern matches the segment and init references in a DASH
+// manifest produced with explicit segment lists
+var dashSegmentRefPattern = regexp.MustCompile(`(media|sourceURL|initialization)="([^"]+)"`)
+
+// GetManifest serves the DASH manifest of a media item with every segment
+// reference rewritten into a presigned URL, or a CDN URL when a CDN serves
+// playback
+//
+//encore:api auth raw method=GET path=/media/:id/manifest.mpd
+func GetManifest(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userData := auth.Data().(*authpkg.UserData)
+
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/media/"), "/manifest.mpd")
+
+	var ownerID int64
+	var teamID, manifestKey, packaging string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), COALESCE(s3_key_processed, ''), COALESCE(packaging, '')
+		FROM media WHERE id = $1 AND status = 'ready'
+	`, id).Scan(&ownerID, &teamID, &manifestKey, &packaging)
+	if err != nil || packaging != "dash" || manifestKey == "" {
+		http.Error(w, "manifest not found", http.StatusNotFound)
+		return
+	}
+	if authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer) != nil {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+
+	if checkEgress(ctx, ownerID) != nil {
+		http.Error(w, "monthly egress limit reached", http.StatusTooManyRequests)
+		return
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		rlog.Error("failed to create MinIO client", "error", err)
+		http.Error(w, "failed to create storage client", http.StatusInternalServerError)
+		return
+	}
+
+	object, err := client.GetObject(ctx, objectstore.Bucket(), manifestKey, minio.GetObjectOptions{})
+	if err != nil {
+		rlog.Error("failed to get manifest", "error", err, "media_id", id)
+		http.Error(w, "failed to get manifest", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	manifest, err := io.ReadAll(object)
+	if err != nil {
+		rlog.Error("failed to read manifest", "error", err, "media_id", id)
+		http.Error(w, "failed to read manifest", http.StatusInternalServerError)
+		return
+	}
+
+	// Segments live next to the manifest
+	prefix := path.Dir(manifestKey) + "/"
+	ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+
+	// With CDN cookies one set of cookies covers every segment, which are
+	// then referenced by their plain CDN URLs
+	cdn := objectstore.LoadCDN()
+	useCookies := false
+	if cdn.Cookies {
+		cookies, err := cdn.SignedCookies(prefix, time.Now().Add(ttl+objectstore.ClockSkew()))
+		if err != nil {
+			rlog.Error("failed to sign CDN cookies", "error", err, "media_id", id)
+		} else {
+			for _, cookie := range cookies {
+				http.SetCookie(w, cookie)
+			}
+			useCookies = true
+		}
+	}
+
+	manifest = dashSegmentRefPattern.ReplaceAllFunc(manifest, func(match []byte) []byte {
+		parts := dashSegmentRefPattern.FindSubmatch(match)
+		ref := html.UnescapeString(string(parts[2]))
+		if strings.Contains(ref, "://") {
+			return match
+		}
+
+		var signed string
+		if useCookies {
+			signed = cdn.ObjectURL(prefix + ref)
+		} else {
+			u, err := objectstore.PlaybackURL(ctx, client, prefix+ref, ttl)
+			if err != nil {
+				rlog.Error("failed to presign DASH segment", "error", err, "segment", ref)
+				return match
+			}
+			signed = u.String()
+		}
+
+		var buf bytes.Buffer
+		buf.Write(parts[1])
+		buf.WriteString(`="`)
+		buf.WriteString(html.EscapeString(signed))
+		buf.WriteString(`"`)
+		return buf.Bytes()
+	})
+
+	recordPresignedEgress(ctx, userViewer(userData.UserID), ttl, id)
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "private, no-store")
+	_, _ = w.Write(manifest)
+}
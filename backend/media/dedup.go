@@ -0,0 +1,278 @@
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+// blobPrefix is where originals stored by content live, as
+// blobs/sha256/<first two hex digits>/<sha256>
+const blobPrefix = "blobs/sha256/"
+
+const (
+	// dedupBatch caps the originals hashed per run
+	dedupBatch = 50
+	// dedupIdle is how long an original stays unused before it is moved to
+	// its blob, so no running job or download link still reads the old key
+	dedupIdle = 24 * time.Hour
+	// blobGracePeriod is how long a blob nobody references is kept, so an
+	// upload of the same content can take it over
+	blobGracePeriod = time.Hour
+)
+
+// blobKey returns the key of the blob with a SHA-256
+func blobKey(sum string) string {
+	return blobPrefix + sum[:2] + "/" + sum
+}
+
+// isBlobKey reports whether an original is stored as a blob
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobPrefix)
+}
+
+// releaseOriginal drops a media item's reference to its blob in the
+// transaction deleting it; a blob left without references is collected
+// after blobGracePeriod
+func releaseOriginal(ctx context.Context, tx *sqldb.Tx, mediaID string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE blobs b SET ref_count = b.ref_count - 1,
+			released_at = CASE WHEN b.ref_count = 1 THEN NOW() ELSE b.released_at END
+		FROM media m WHERE m.id = $1 AND b.s3_key = m.s3_key_original
+	`, mediaID)
+	return err
+}
+
+// Originals are deduplicated every 10 minutes
+var _ = cron.NewJob("media-original-dedup", cron.JobConfig{
+	Title:    "Deduplicate originals by content",
+	Every:    10 * cron.Minute,
+	Endpoint: DeduplicateOriginals,
+})
+
+// DeduplicateOriginalsResponse counts what a run did
+type DeduplicateOriginalsResponse struct {
+	Hashed       int `json:"hashed"`
+	Deduplicated int `json:"deduplicated"`
+	// BytesSaved is the size of the copies removed because a blob with the
+	// same content already existed
+	BytesSaved     int64 `json:"bytes_saved"`
+	BlobsCollected int   `json:"blobs_collected"`
+}
+
+// DeduplicateOriginals hashes the originals of processed media and moves
+// each to the blob of its content, so identical uploads (by anyone) are
+// stored once, and removes blobs nobody references anymore. Originals still
+// served as the stream are left where they are, like for cold storage.
+//
+//encore:api private
+func DeduplicateOriginals(ctx context.Context) (*DeduplicateOriginalsResponse, error) {
+	resp := &DeduplicateOriginalsResponse{}
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, err
+	}
+
+	collected, err := collectBlobs(ctx, client)
+	if err != nil {
+		rlog.Warn("failed to collect unreferenced blobs", "error", err)
+	}
+	resp.BlobsCollected = collected
+
+	cutoff := time.Now().Add(-dedupIdle)
+	rows, err := db.Query(ctx, `
+		SELECT id::text, s3_key_original FROM media
+		WHERE original_sha256 IS NULL AND status IN ('ready', 'failed') AND storage_tier = 'hot'
+		  AND s3_key_original LIKE 'original/%'
+		  AND s3_key_processed IS NOT NULL AND s3_key_processed <> s3_key_original
+		  AND COALESCE(packaging, '') <> 'dash'
+		  AND COALESCE(original_used_at, created_at) < $1
+		ORDER BY created_at
+		LIMIT $2
+	`, cutoff, dedupBatch)
+	if err != nil {
+		return nil, err
+	}
+	type original struct {
+		mediaID, key string
+	}
+	var originals []original
+	for rows.Next() {
+		var o original
+		if err := rows.Scan(&o.mediaID, &o.key); err == nil {
+			originals = append(originals, o)
+		}
+	}
+	rows.Close()
+
+	for _, o := range originals {
+		saved, err := dedupOriginal(ctx, client, o.mediaID, o.key, cutoff)
+		if err != nil {
+			rlog.Warn("failed to deduplicate original", "error", err, "media_id", o.mediaID)
+			continue
+		}
+		resp.Hashed++
+		if saved > 0 {
+			resp.Deduplicated++
+			resp.BytesSaved += saved
+		}
+	}
+	if resp.Hashed > 0 || resp.BlobsCollected > 0 {
+		rlog.Info("originals deduplicated", "hashed", resp.Hashed, "deduplicated", resp.Deduplicated,
+			"bytes_saved", resp.BytesSaved, "blobs_collected", resp.BlobsCollected)
+	}
+	return resp, nil
+}
+
+// dedupOriginal hashes an original and moves it to its blob, creating the
+// blob when it's the first of its content. It returns the bytes saved: the
+// original's size when the blob already existed.
+func dedupOriginal(ctx context.Context, client *minio.Client, mediaID, key string, cutoff time.Time) (int64, error) {
+	object, err := client.GetObject(ctx, objectstore.Bucket(), key, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, object)
+	object.Close()
+	if err != nil {
+		return 0, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	target := blobKey(sum)
+
+	// A blob whose media are in cold storage isn't in the main bucket; the
+	// original then keeps its own copy
+	var exists, shareable bool
+	err = db.QueryRow(ctx, `
+		SELECT TRUE, NOT EXISTS (SELECT 1 FROM media WHERE s3_key_original = b.s3_key AND storage_tier <> 'hot')
+		FROM blobs b WHERE sha256 = $1
+	`, sum).Scan(&exists, &shareable)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return 0, err
+	}
+	if exists && !shareable {
+		_, err := db.Exec(ctx, `UPDATE media SET original_sha256 = $2 WHERE id = $1`, mediaID, sum)
+		return 0, err
+	}
+	if !exists {
+		if err := objectstore.CopyToKey(ctx, client, key, target); err != nil {
+			return 0, err
+		}
+	}
+
+	moved, err := linkBlob(ctx, mediaID, key, sum, target, size, cutoff)
+	if err != nil || !moved {
+		// The media was used, changed or deleted meanwhile; a blob copied for
+		// it alone goes again
+		var referenced bool
+		if qerr := db.QueryRow(ctx, `SELECT TRUE FROM blobs WHERE sha256 = $1`, sum).Scan(&referenced); errors.Is(qerr, sqldb.ErrNoRows) {
+			_ = client.RemoveObject(ctx, objectstore.Bucket(), target, minio.RemoveObjectOptions{})
+		}
+		return 0, err
+	}
+
+	// A blob collected just before it was linked again is copied back while
+	// the original is still there
+	if _, err := client.StatObject(ctx, objectstore.Bucket(), target, minio.StatObjectOptions{}); err != nil {
+		if err := objectstore.CopyToKey(ctx, client, key, target); err != nil {
+			rlog.Error("failed to recreate blob; keeping the original", "error", err, "media_id", mediaID)
+			return 0, nil
+		}
+	}
+	if err := client.RemoveObject(ctx, objectstore.Bucket(), key, minio.RemoveObjectOptions{}); err != nil {
+		rlog.Warn("failed to remove deduplicated original", "error", err, "media_id", mediaID)
+	}
+	if exists {
+		return size, nil
+	}
+	return 0, nil
+}
+
+// linkBlob points a media item at its blob and counts the reference, unless
+// the item was used or changed since it was selected; it reports whether it
+// did
+func linkBlob(ctx context.Context, mediaID, key, sum, target string, size int64, cutoff time.Time) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO blobs (sha256, s3_key, size_bytes, ref_count, created_at) VALUES ($1, $2, $3, 0, NOW())
+		ON CONFLICT DO NOTHING
+	`, sum, target, size)
+	if err != nil {
+		return false, err
+	}
+	// Locking the blob keeps collectBlobs from removing it meanwhile; a blob
+	// moved to cold storage since it was checked isn't linked
+	var refs int
+	if err := tx.QueryRow(ctx, `SELECT ref_count FROM blobs WHERE sha256 = $1 FOR UPDATE`, sum).Scan(&refs); err != nil {
+		return false, err
+	}
+	var cold bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM media WHERE s3_key_original = $1 AND storage_tier <> 'hot')
+	`, target).Scan(&cold)
+	if err != nil || cold {
+		return false, err
+	}
+	result, err := tx.Exec(ctx, `
+		UPDATE media SET s3_key_original = $3, original_sha256 = $4
+		WHERE id = $1 AND s3_key_original = $2 AND status IN ('ready', 'failed') AND storage_tier = 'hot'
+		  AND COALESCE(original_used_at, created_at) < $5
+	`, mediaID, key, target, sum, cutoff)
+	if err != nil {
+		return false, err
+	}
+	if result.RowsAffected() == 0 {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + 1, released_at = NULL WHERE sha256 = $1`, sum)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// collectBlobs removes the blobs nobody referenced for blobGracePeriod,
+// from the cold bucket too, and returns how many it removed
+func collectBlobs(ctx context.Context, client *minio.Client) (int, error) {
+	rows, err := db.Query(ctx, `
+		DELETE FROM blobs WHERE ref_count = 0 AND released_at < $1
+		RETURNING s3_key
+	`, time.Now().Add(-blobGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+
+	coldBucket := objectstore.ColdBucket()
+	for _, key := range keys {
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), key, minio.RemoveObjectOptions{})
+		if coldBucket != "" {
+			_ = client.RemoveObject(ctx, coldBucket, key, minio.RemoveObjectOptions{})
+		}
+	}
+	return len(keys), nil
+}
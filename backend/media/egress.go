@@ -0,0 +1,267 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// egressGigabyte is the unit of EGRESS_MONTHLY_LIMIT_GB
+const egressGigabyte = 1 << 30
+
+// egressHistoryMonths is how many months GetEgress reports
+const egressHistoryMonths = 12
+
+// getEgressLimit returns how many bytes of each owner's media may be served
+// per month (EGRESS_MONTHLY_LIMIT_GB); 0 means unlimited
+func getEgressLimit() int64 {
+	gb, err := strconv.ParseFloat(os.Getenv("EGRESS_MONTHLY_LIMIT_GB"), 64)
+	if err != nil || gb <= 0 {
+		return 0
+	}
+	return int64(gb * egressGigabyte)
+}
+
+// egressUsed returns the bytes of an owner's media served this month
+func egressUsed(ctx context.Context, ownerID int64) (int64, error) {
+	var used int64
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(bytes), 0) FROM egress_usage
+		WHERE owner_id = $1 AND recorded_at >= date_trunc('month', NOW())
+	`, ownerID).Scan(&used)
+	return used, err
+}
+
+// checkEgress rejects serving an owner's media once they used up the
+// monthly egress limit. Failing to count lets the media through, so an
+// accounting hiccup never stops playback.
+func checkEgress(ctx context.Context, ownerID int64) error {
+	limit := getEgressLimit()
+	if limit <= 0 {
+		return nil
+	}
+	used, err := egressUsed(ctx, ownerID)
+	if err != nil {
+		rlog.Warn("failed to compute egress usage", "error", err, "owner_id", ownerID)
+		return nil
+	}
+	if used >= limit {
+		return errs.B().Code(errs.ResourceExhausted).
+			Msg(fmt.Sprintf("monthly egress limit reached: %d of %d bytes served", used, limit)).Err()
+	}
+	return nil
+}
+
+// anonymousEgressPerHour is how many media an anonymous viewer (ip:<address>)
+// is counted for per hour, so made-up viewers can't run up an owner's egress
+const anonymousEgressPerHour = 50
+
+// userViewer is how a signed-in viewer is recorded
+func userViewer(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// recordPresignedEgress counts the size of media whose stream URLs were
+// handed to viewer. A viewer is counted once per media for as long as the
+// URLs last, so reloading a page doesn't count the media again. Anonymous
+// viewers stop being counted after anonymousEgressPerHour media. Errors
+// are logged and the URLs handed out uncounted.
+func recordPresignedEgress(ctx context.Context, viewer string, ttl time.Duration, mediaIDs ...string) {
+	if len(mediaIDs) == 0 {
+		return
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO egress_usage (media_id, owner_id, team_id, source, viewer, bytes, recorded_at)
+		SELECT m.id, m.owner_id, m.team_id, 'presigned', $2, m.size_bytes, NOW() FROM media m
+		WHERE m.id = ANY($1::uuid[]) AND COALESCE(m.size_bytes, 0) > 0
+		AND NOT EXISTS (
+			SELECT 1 FROM egress_usage e
+			WHERE e.media_id = m.id AND e.viewer = $2 AND e.source = 'presigned'
+			AND e.recorded_at > NOW() - make_interval(secs => $3)
+		)
+		AND ($2 NOT LIKE 'ip:%' OR (
+			SELECT COUNT(*) FROM egress_usage e
+			WHERE e.viewer = $2 AND e.source = 'presigned' AND e.recorded_at > NOW() - INTERVAL '1 hour'
+		) < $4)
+	`, mediaIDs, viewer, ttl.Seconds(), anonymousEgressPerHour)
+	if err != nil {
+		rlog.Warn("failed to record egress", "error", err, "viewer", viewer)
+	}
+}
+
+// RecordEgressRequest reports bytes of a media item another service
+// streamed to a client
+type RecordEgressRequest struct {
+	MediaID string `json:"media_id"`
+	Bytes   int64  `json:"bytes"`
+	// Viewer is who the bytes went to (user:<id> or ip:<address>), if known
+	Viewer string `json:"viewer,omitempty"`
+}
+
+// RecordEgress counts bytes a service proxied to a client towards the media
+// owner's monthly egress. Proxies resolve stream URLs with Proxied set, so
+// the bytes aren't counted twice.
+//
+//encore:api private
+func RecordEgress(ctx context.Context, req *RecordEgressRequest) error {
+	if req.Bytes <= 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO egress_usage (media_id, owner_id, team_id, source, viewer, bytes, recorded_at)
+		SELECT id, owner_id, team_id, 'proxy', $2, $3, NOW() FROM media WHERE id = $1
+	`, req.MediaID, req.Viewer, req.Bytes)
+	if err != nil {
+		rlog.Error("failed to record egress", "error", err, "media_id", req.MediaID)
+		return errs.B().Code(errs.Internal).Msg("failed to record egress").Err()
+	}
+	return nil
+}
+
+// EgressMonth is what was served of a user's media in one month
+type EgressMonth struct {
+	// Period is the month, as YYYY-MM
+	Period         string `json:"period"`
+	PresignedBytes int64  `json:"presigned_bytes"`
+	ProxyBytes     int64  `json:"proxy_bytes"`
+	TotalBytes     int64  `json:"total_bytes"`
+}
+
+// EgressResponse contains the caller's egress this month and in the months
+// before it, newest first
+type EgressResponse struct {
+	Period    string `json:"period"`
+	UsedBytes int64  `json:"used_bytes"`
+	// LimitBytes is the monthly limit; 0 means unlimited
+	LimitBytes int64         `json:"limit_bytes"`
+	Months     []EgressMonth `json:"months"`
+}
+
+// GetEgress reports how many bytes of the caller's media were served this
+// month and in the past year. Presigned URLs count the media's size once
+// per viewer and URL lifetime, so the figures are an estimate of what the
+// storage bills.
+//
+//encore:api auth method=GET path=/egress
+func GetEgress(ctx context.Context) (*EgressResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT to_char(date_trunc('month', recorded_at), 'YYYY-MM'),
+			   COALESCE(SUM(bytes) FILTER (WHERE source = 'presigned'), 0),
+			   COALESCE(SUM(bytes) FILTER (WHERE source = 'proxy'), 0)
+		FROM egress_usage
+		WHERE owner_id = $1 AND recorded_at >= date_trunc('month', NOW()) - make_interval(months => $2)
+		GROUP BY 1
+		ORDER BY 1 DESC
+	`, userData.UserID, egressHistoryMonths-1)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get egress").Err()
+	}
+	defer rows.Close()
+
+	resp := &EgressResponse{Period: usagePeriod(), LimitBytes: getEgressLimit(), Months: []EgressMonth{}}
+	for rows.Next() {
+		var m EgressMonth
+		if err := rows.Scan(&m.Period, &m.PresignedBytes, &m.ProxyBytes); err != nil {
+			continue
+		}
+		m.TotalBytes = m.PresignedBytes + m.ProxyBytes
+		if m.Period == resp.Period {
+			resp.UsedBytes = m.TotalBytes
+		}
+		resp.Months = append(resp.Months, m)
+	}
+	return resp, nil
+}
+
+// UserEgress is what was served of one user's media in a month
+type UserEgress struct {
+	UserID         int64 `json:"user_id"`
+	PresignedBytes int64 `json:"presigned_bytes"`
+	ProxyBytes     int64 `json:"proxy_bytes"`
+	TotalBytes     int64 `json:"total_bytes"`
+	// OverLimit is set once the user reached the monthly limit
+	OverLimit bool `json:"over_limit"`
+}
+
+// EgressUsageRequest selects the month and how many users to list
+type EgressUsageRequest struct {
+	// Period is the month as YYYY-MM, the current one by default
+	Period string `query:"period"`
+	// Users is how many of the biggest users to list, 50 by default and at
+	// most 500
+	Users int `query:"users"`
+}
+
+// EgressUsageResponse contains the month's total and its biggest users
+type EgressUsageResponse struct {
+	Period     string       `json:"period"`
+	TotalBytes int64        `json:"total_bytes"`
+	LimitBytes int64        `json:"limit_bytes"`
+	Users      []UserEgress `json:"users"`
+}
+
+// GetEgressUsage reports how many bytes were served in a month, overall and
+// for the users whose media was served most (admin only)
+//
+//encore:api auth method=GET path=/admin/egress
+func GetEgressUsage(ctx context.Context, req *EgressUsageRequest) (*EgressUsageResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	period := req.Period
+	if period == "" {
+		period = usagePeriod()
+	}
+	start, err := time.Parse("2006-01", period)
+	if err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("period must be YYYY-MM").Err()
+	}
+	users := req.Users
+	if users < 1 || users > 500 {
+		users = 50
+	}
+	end := start.AddDate(0, 1, 0)
+
+	resp := &EgressUsageResponse{Period: period, LimitBytes: getEgressLimit(), Users: []UserEgress{}}
+	err = db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(bytes), 0) FROM egress_usage WHERE recorded_at >= $1 AND recorded_at < $2
+	`, start, end).Scan(&resp.TotalBytes)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get egress").Err()
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT owner_id,
+			   COALESCE(SUM(bytes) FILTER (WHERE source = 'presigned'), 0),
+			   COALESCE(SUM(bytes) FILTER (WHERE source = 'proxy'), 0)
+		FROM egress_usage
+		WHERE owner_id IS NOT NULL AND recorded_at >= $1 AND recorded_at < $2
+		GROUP BY owner_id
+		ORDER BY SUM(bytes) DESC, owner_id
+		LIMIT $3
+	`, start, end, users)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get egress").Err()
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u UserEgress
+		if err := rows.Scan(&u.UserID, &u.PresignedBytes, &u.ProxyBytes); err != nil {
+			continue
+		}
+		u.TotalBytes = u.PresignedBytes + u.ProxyBytes
+		u.OverLimit = resp.LimitBytes > 0 && u.TotalBytes >= resp.LimitBytes
+		resp.Users = append(resp.Users, u)
+	}
+	return resp, nil
+}
@@ -0,0 +1,42 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.dev/rlog"
+
+	"encore.app/realtime"
+)
+
+// publishStatus pushes a media status change to the owner's event streams.
+// A failed publish is logged; clients see the status on their next fetch.
+func publishStatus(ctx context.Context, ownerID int64, mediaID, status string) {
+	publishEvent(ctx, ownerID, mediaID, realtime.TypeMediaStatus, realtime.MediaStatus{MediaID: mediaID, Status: status})
+}
+
+// publishTags pushes the new tags of a media item to the owner's event streams
+func publishTags(ctx context.Context, ownerID int64, mediaID string, tags []string) {
+	if tags == nil {
+		tags = []string{}
+	}
+	publishEvent(ctx, ownerID, mediaID, realtime.TypeMediaUpdated, realtime.MediaUpdated{MediaID: mediaID, Tags: tags})
+}
+
+// publishEvent pushes an event about a media item to the owner's event streams
+func publishEvent(ctx context.Context, ownerID int64, mediaID, eventType string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	ev := &realtime.Event{
+		UserIDs:    []int64{ownerID},
+		Type:       eventType,
+		Data:       payload,
+		OccurredAt: time.Now(),
+	}
+	if _, err := realtime.EventsTopic.Publish(ctx, ev); err != nil {
+		rlog.Warn("failed to publish realtime event", "error", err, "media_id", mediaID)
+	}
+}
@@ -0,0 +1,398 @@
+package media
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// expiryBatch is the most media one expiry or purge run handles
+const expiryBatch = 500
+
+// getMediaTrashRetention returns how long trashed media can be restored
+// (MEDIA_TRASH_RETENTION)
+func getMediaTrashRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("MEDIA_TRASH_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// MediaTrashed is published when media is moved to the trash, because it
+// expired or by a retention rule
+type MediaTrashed struct {
+	MediaID string `json:"media_id"`
+	OwnerID int64  `json:"owner_id"`
+}
+
+// MediaTrashedTopic tells other services to drop their references to
+// trashed media like to deleted media: it leaves its collections and the
+// share tokens restricted to it, and stays out of them once restored
+var MediaTrashedTopic = pubsub.NewTopic[*MediaTrashed]("media-trashed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// SetMediaExpiryRequest sets when a media item expires
+type SetMediaExpiryRequest struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MediaExpiryResponse is the media's expiry
+type MediaExpiryResponse struct {
+	MediaID string `json:"media_id"`
+	// ExpiresAt is nil when the media never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// SetMediaExpiry makes a media item expire at expires_at, when it is
+// trashed or deleted as the owner's expired_media setting says. Setting it
+// again moves the time.
+//
+//encore:api auth method=PUT path=/media/:id/expiry
+func SetMediaExpiry(ctx context.Context, id string, req *SetMediaExpiryRequest) (*MediaExpiryResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if !req.ExpiresAt.After(time.Now()) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("expires_at must be in the future").Err()
+	}
+	if _, err := authorizeEdit(ctx, userData.UserID, id); err != nil {
+		return nil, err
+	}
+
+	before := mediaSnapshot(ctx, id)
+	expiresAt := req.ExpiresAt.UTC()
+	if _, err := db.Exec(ctx, `UPDATE media SET expires_at = $2 WHERE id = $1`, id, expiresAt); err != nil {
+		rlog.Error("failed to set media expiry", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to set expiry").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaExpirySet, id, before, mediaSnapshot(ctx, id), nil)
+	return &MediaExpiryResponse{MediaID: id, ExpiresAt: &expiresAt}, nil
+}
+
+// ClearMediaExpiry keeps a media item that was set to expire
+//
+//encore:api auth method=DELETE path=/media/:id/expiry
+func ClearMediaExpiry(ctx context.Context, id string) (*MediaExpiryResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if _, err := authorizeEdit(ctx, userData.UserID, id); err != nil {
+		return nil, err
+	}
+
+	before := mediaSnapshot(ctx, id)
+	result, err := db.Exec(ctx, `UPDATE media SET expires_at = NULL WHERE id = $1 AND expires_at IS NOT NULL`, id)
+	if err != nil {
+		rlog.Error("failed to clear media expiry", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to clear expiry").Err()
+	}
+	if result.RowsAffected() > 0 {
+		recordAudit(ctx, userData.UserID, auditMediaExpiryUnset, id, before, mediaSnapshot(ctx, id), nil)
+	}
+	return &MediaExpiryResponse{MediaID: id}, nil
+}
+
+// Expired media is trashed or deleted every ten minutes
+var _ = cron.NewJob("media-expiry", cron.JobConfig{
+	Title:    "Trash or delete expired media",
+	Every:    10 * cron.Minute,
+	Endpoint: ExpireMedia,
+})
+
+// ExpireMediaResponse reports what the expiry job did
+type ExpireMediaResponse struct {
+	Trashed int `json:"trashed"`
+	Deleted int `json:"deleted"`
+	Failed  int `json:"failed"`
+}
+
+// ExpireMedia trashes or deletes media whose expires_at has passed, each as
+// its owner's expired_media setting says
+//
+//encore:api private
+func ExpireMedia(ctx context.Context) (*ExpireMediaResponse, error) {
+	due, err := loadMediaObjects(ctx, `
+		SELECT id::text, owner_id, COALESCE(team_id::text, ''), s3_key_original, COALESCE(s3_key_processed, '')
+		FROM media
+		WHERE expires_at <= NOW() AND trashed_at IS NULL
+		ORDER BY expires_at
+		LIMIT $1
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ExpireMediaResponse{}
+	actions := map[int64]string{}
+	teams := map[string]bool{}
+	for _, m := range due {
+		action, ok := actions[m.ownerID]
+		if !ok {
+			action = authpkg.SettingsOrDefault(ctx, m.ownerID).ExpiredMedia
+			actions[m.ownerID] = action
+		}
+
+		before := mediaSnapshot(ctx, m.id)
+		details := map[string]string{"expired": "true"}
+		if action == authpkg.ExpiredMediaDelete {
+			// Only while still expired, e.g. unless the expiry was cleared
+			// meanwhile
+			deleted, err := deleteMedia(ctx, m.id, m.ownerID, m.s3KeyOriginal, m.s3KeyProcessed,
+				"trashed_at IS NULL AND expires_at <= NOW()")
+			if err != nil {
+				rlog.Error("failed to delete expired media", "error", err, "media_id", m.id)
+				resp.Failed++
+				continue
+			}
+			if !deleted {
+				continue
+			}
+			recordAudit(ctx, m.ownerID, auditMediaDeleted, m.id, before, nil, details)
+			publishStatus(ctx, m.ownerID, m.id, "deleted")
+			if m.teamID != "" {
+				teams[m.teamID] = true
+			}
+			resp.Deleted++
+			continue
+		}
+
+		// Users who never chose, or whose settings can't be loaded, keep
+		// their media in the trash
+		trashed, err := trashMedia(ctx, m.id, m.ownerID, true)
+		if err != nil {
+			rlog.Error("failed to trash expired media", "error", err, "media_id", m.id)
+			resp.Failed++
+			continue
+		}
+		if trashed {
+			recordAudit(ctx, m.ownerID, auditMediaTrashed, m.id, before, mediaSnapshot(ctx, m.id), details)
+			publishStatus(ctx, m.ownerID, m.id, "trashed")
+			resp.Trashed++
+		}
+	}
+	for teamID := range teams {
+		reportTeamStorage(ctx, teamID)
+	}
+
+	if resp.Trashed > 0 || resp.Deleted > 0 || resp.Failed > 0 {
+		rlog.Info("expired media handled", "trashed", resp.Trashed, "deleted", resp.Deleted, "failed", resp.Failed)
+	}
+	return resp, nil
+}
+
+// mediaObjects is what deleting a media item needs to know about it
+type mediaObjects struct {
+	id             string
+	ownerID        int64
+	teamID         string
+	s3KeyOriginal  string
+	s3KeyProcessed string
+}
+
+// loadMediaObjects runs a query selecting mediaObjects columns, limited to
+// expiryBatch rows by $1
+func loadMediaObjects(ctx context.Context, query string, args ...any) ([]mediaObjects, error) {
+	rows, err := db.Query(ctx, query, append([]any{expiryBatch}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []mediaObjects
+	for rows.Next() {
+		var m mediaObjects
+		if err := rows.Scan(&m.id, &m.ownerID, &m.teamID, &m.s3KeyOriginal, &m.s3KeyProcessed); err == nil {
+			items = append(items, m)
+		}
+	}
+	return items, rows.Err()
+}
+
+// trashMedia moves a media item to the trash, announcing it through the
+// outbox. With expired it only does so while the media is expired, and
+// reports false when it no longer is, e.g. because its expiry was cleared
+// meanwhile.
+func trashMedia(ctx context.Context, mediaID string, ownerID int64, expired bool) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(ctx, `
+		UPDATE media SET trashed_at = NOW(), expires_at = NULL
+		WHERE id = $1 AND trashed_at IS NULL AND (NOT $2 OR expires_at <= NOW())
+	`, mediaID, expired)
+	if err != nil {
+		return false, err
+	}
+	if result.RowsAffected() == 0 {
+		return false, nil
+	}
+	outboxID, err := enqueue(ctx, tx, outboxMediaTrashed, &MediaTrashed{MediaID: mediaID, OwnerID: ownerID})
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	publishNow(ctx, outboxID)
+	return true, nil
+}
+
+// TrashedMedia is a trashed media item that can still be restored
+type TrashedMedia struct {
+	ID               string `json:"id"`
+	Title            string `json:"title"`
+	OriginalFilename string `json:"original_filename"`
+	MimeType         string `json:"mime_type"`
+	SizeBytes        int64  `json:"size_bytes"`
+	// TeamID is set for media in a team
+	TeamID    string    `json:"team_id,omitempty"`
+	TrashedAt time.Time `json:"trashed_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// ListMediaTrashResponse contains the caller's trashed media
+type ListMediaTrashResponse struct {
+	Media []TrashedMedia `json:"media"`
+}
+
+// ListMediaTrash returns the media the caller uploaded that expired or a
+// retention rule moved into the trash, most recently trashed first
+//
+//encore:api auth method=GET path=/media-trash
+func ListMediaTrash(ctx context.Context) (*ListMediaTrashResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT id::text, COALESCE(title, ''), COALESCE(original_filename, ''), COALESCE(mime_type, ''),
+			   COALESCE(size_bytes, 0), COALESCE(team_id::text, ''), trashed_at
+		FROM media
+		WHERE owner_id = $1 AND trashed_at IS NOT NULL
+		ORDER BY trashed_at DESC
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list trashed media").Err()
+	}
+	defer rows.Close()
+
+	retention := getMediaTrashRetention()
+	resp := &ListMediaTrashResponse{Media: []TrashedMedia{}}
+	for rows.Next() {
+		var m TrashedMedia
+		if err := rows.Scan(&m.ID, &m.Title, &m.OriginalFilename, &m.MimeType, &m.SizeBytes, &m.TeamID,
+			&m.TrashedAt); err != nil {
+			continue
+		}
+		m.PurgeAt = m.TrashedAt.Add(retention)
+		resp.Media = append(resp.Media, m)
+	}
+	return resp, nil
+}
+
+// RestoreTrashedMediaResponse confirms the restore
+type RestoreTrashedMediaResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// RestoreTrashedMedia brings a trashed media item back. It no longer
+// expires, retention rules leave it alone, and it is not added back to the
+// collections it left.
+//
+//encore:api auth method=POST path=/media/:id/untrash
+func RestoreTrashedMedia(ctx context.Context, id string) (*RestoreTrashedMediaResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1 AND trashed_at IS NOT NULL
+	`, id).Scan(&ownerID, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not in trash").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	before := mediaSnapshot(ctx, id)
+	var status string
+	err = db.QueryRow(ctx, `
+		UPDATE media SET trashed_at = NULL, retention_exempt = TRUE WHERE id = $1 AND trashed_at IS NOT NULL
+		RETURNING status
+	`, id).Scan(&status)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not in trash").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaUntrashed, id, before, mediaSnapshot(ctx, id), nil)
+	publishStatus(ctx, ownerID, id, status)
+
+	return &RestoreTrashedMediaResponse{MediaID: id, Status: status}, nil
+}
+
+// Trashed media past the retention is purged hourly
+var _ = cron.NewJob("media-trash-purge", cron.JobConfig{
+	Title:    "Purge trashed media",
+	Every:    1 * cron.Hour,
+	Endpoint: PurgeTrashedMedia,
+})
+
+// PurgeTrashedMediaResponse reports how many media were purged
+type PurgeTrashedMediaResponse struct {
+	Purged int `json:"purged"`
+}
+
+// PurgeTrashedMedia permanently deletes media that has been in the trash
+// longer than the retention
+//
+//encore:api private
+func PurgeTrashedMedia(ctx context.Context) (*PurgeTrashedMediaResponse, error) {
+	due, err := loadMediaObjects(ctx, `
+		SELECT id::text, owner_id, COALESCE(team_id::text, ''), s3_key_original, COALESCE(s3_key_processed, '')
+		FROM media
+		WHERE trashed_at < $2
+		ORDER BY trashed_at
+		LIMIT $1
+	`, time.Now().Add(-getMediaTrashRetention()))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PurgeTrashedMediaResponse{}
+	teams := map[string]bool{}
+	for _, m := range due {
+		before := mediaSnapshot(ctx, m.id)
+		// Unless it was restored meanwhile
+		deleted, err := deleteMedia(ctx, m.id, m.ownerID, m.s3KeyOriginal, m.s3KeyProcessed, "trashed_at IS NOT NULL")
+		if err != nil {
+			rlog.Error("failed to purge trashed media", "error", err, "media_id", m.id)
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		recordAudit(ctx, m.ownerID, auditMediaDeleted, m.id, before, nil, map[string]string{"purged": "true"})
+		if m.teamID != "" {
+			teams[m.teamID] = true
+		}
+		resp.Purged++
+	}
+	for teamID := range teams {
+		reportTeamStorage(ctx, teamID)
+	}
+
+	if resp.Purged > 0 {
+		rlog.Info("trashed media purged", "count", resp.Purged)
+	}
+	return resp, nil
+}
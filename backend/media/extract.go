@@ -0,0 +1,175 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// audioProbeTimeout bounds probing an unprocessed original for audio
+const audioProbeTimeout = 30 * time.Second
+
+// audioFormatPresets maps extract-audio formats to processing presets
+var audioFormatPresets = map[string]string{
+	"m4a":  "audio-only",
+	"opus": "audio-opus",
+}
+
+// ExtractAudioRequest selects the output format of the extracted audio
+type ExtractAudioRequest struct {
+	// Format is "m4a" (AAC, default) or "opus"
+	Format string `json:"format,omitempty"`
+	Title  string `json:"title,omitempty"`
+}
+
+// ExtractAudio creates an audio-only media item from the audio tracks of a
+// video, owned by the caller and linked to the source. Audio extracted from
+// team media belongs to the team.
+//
+//encore:api auth method=POST path=/media/:id/extract-audio
+func ExtractAudio(ctx context.Context, id string, req *ExtractAudioRequest) (*CreateClipResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	format := req.Format
+	if format == "" {
+		format = "m4a"
+	}
+	preset, ok := audioFormatPresets[format]
+	if !ok {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("format must be 'm4a' or 'opus'").Err()
+	}
+
+	// Verify access and that the source has audio
+	var ownerID int64
+	var status, filename, title, teamID, sourceKey string
+	var audioTracks *int
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, status, COALESCE(original_filename, ''), COALESCE(title, ''),
+			   jsonb_array_length(audio_tracks), COALESCE(team_id::text, ''), s3_key_original
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &status, &filename, &title, &audioTracks, &teamID, &sourceKey)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "ready" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is not ready").Err()
+	}
+	if audioTracks != nil && *audioTracks == 0 {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media has no audio tracks").Err()
+	}
+	// Audio of team media stays in the team and counts against its limits
+	if err := checkDerivedQuota(ctx, userData, teamID); err != nil {
+		return nil, err
+	}
+	// The audio is copied from the original
+	if err := useOriginal(ctx, id); err != nil {
+		return nil, err
+	}
+	// Media served without processing has no audio tracks recorded, so the
+	// original is probed instead
+	if audioTracks == nil {
+		hasAudio, err := originalHasAudio(ctx, sourceKey)
+		if err != nil {
+			rlog.Error("failed to probe original for audio", "error", err, "media_id", id)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to read the original").Err()
+		}
+		if !hasAudio {
+			return nil, errs.B().Code(errs.FailedPrecondition).Msg("media has no audio tracks").Err()
+		}
+	}
+
+	// The worker copies the audio tracks into a Matroska original first
+	audioFilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".mka"
+	audioTitle := req.Title
+	if audioTitle == "" && title != "" {
+		audioTitle = title + " (audio)"
+	}
+
+	audioID := uuid.New().String()
+	s3Key := fmt.Sprintf("original/%d/%s/%s", userData.UserID, audioID, audioFilename)
+
+	// The record and its MediaUploaded event are written together
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		rlog.Error("failed to begin transaction", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create audio item").Err()
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO media (id, owner_id, title, original_filename, s3_key_original, mime_type, status,
+						   preset, source_media_id, extract_audio, team_id, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, 'audio/x-matroska', 'queued', $6, $7, TRUE, NULLIF($8, '')::uuid, NOW())
+	`, audioID, userData.UserID, audioTitle, audioFilename, s3Key, preset, id, teamID)
+	if err != nil {
+		rlog.Error("failed to create audio record", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create audio item").Err()
+	}
+
+	outboxID, err := enqueue(ctx, tx, outboxMediaUploaded, &MediaUploaded{
+		MediaID: audioID,
+		S3Key:   s3Key,
+		OwnerID: userData.UserID,
+		Preset:  preset,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		rlog.Error("failed to queue audio extraction", "error", err, "media_id", audioID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue audio extraction").Err()
+	}
+	publishNow(ctx, outboxID)
+
+	publishStatus(ctx, userData.UserID, audioID, "queued")
+	recordAudit(ctx, userData.UserID, auditAudioExtracted, audioID, nil, mediaSnapshot(ctx, audioID), map[string]string{"source_media_id": id})
+
+	return &CreateClipResponse{
+		MediaID:       audioID,
+		SourceMediaID: id,
+		Status:        "queued",
+	}, nil
+}
+
+// originalHasAudio runs ffprobe on a presigned URL of an original and
+// reports whether it has an audio stream
+func originalHasAudio(ctx context.Context, key string) (bool, error) {
+	client, err := getMinioClient()
+	if err != nil {
+		return false, err
+	}
+	u, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), key, audioProbeTimeout, nil)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, audioProbeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		u.String(),
+	).Output()
+	if err != nil {
+		return false, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	return strings.TrimSpace(string(output)) != "", nil
+}
@@ -0,0 +1,158 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// ownerData returns the auth data of the user a guest uploads for
+func ownerData(ctx context.Context, ownerID int64) (*authpkg.UserData, error) {
+	userData, err := authpkg.LookupUser(ctx, &authpkg.LookupUserRequest{UserID: ownerID})
+	if err != nil {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("uploads are no longer accepted").Err()
+	}
+	return userData, nil
+}
+
+// SignGuestUploadRequest signs an upload a guest makes for another user
+type SignGuestUploadRequest struct {
+	OwnerID  int64  `json:"owner_id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	// MaxSizeBytes limits the upload; 0 means no limit besides the quota
+	MaxSizeBytes int64 `json:"max_size_bytes,omitempty"`
+}
+
+// SignGuestUpload generates a presigned upload URL for media owned by
+// OwnerID; the calling service decides whether the guest may upload. With
+// MaxSizeBytes the URL is a POST policy, so storage refuses larger files.
+//
+//encore:api private
+func SignGuestUpload(ctx context.Context, req *SignGuestUploadRequest) (*SignUploadResponse, error) {
+	userData, err := ownerData(ctx, req.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := signUpload(ctx, userData, &SignUploadRequest{Filename: req.Filename, MimeType: req.MimeType})
+	if err != nil || req.MaxSizeBytes <= 0 {
+		return resp, err
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+	postURL, fields, err := objectstore.PresignedPost(ctx, client, resp.S3Key, objectstore.UploadTTL(), req.MaxSizeBytes)
+	if err != nil {
+		rlog.Error("failed to generate presigned POST policy", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to generate upload URL").Err()
+	}
+	resp.UploadURL = postURL.String()
+	resp.UploadHeaders = nil
+	resp.UploadFields = fields
+	return resp, nil
+}
+
+// ConfirmGuestUploadRequest confirms an upload a guest made for another user
+type ConfirmGuestUploadRequest struct {
+	OwnerID int64  `json:"owner_id"`
+	MediaID string `json:"media_id"`
+	Title   string `json:"title,omitempty"`
+	// MaxSizeBytes rejects larger uploads; 0 means no limit besides the quota
+	MaxSizeBytes int64 `json:"max_size_bytes,omitempty"`
+}
+
+// ConfirmGuestUploadResponse reports the confirmed upload
+type ConfirmGuestUploadResponse struct {
+	MediaID   string `json:"media_id"`
+	Status    string `json:"status"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// ConfirmGuestUpload confirms a guest upload with the owner's defaults.
+// Uploads over MaxSizeBytes are deleted.
+//
+//encore:api private
+func ConfirmGuestUpload(ctx context.Context, req *ConfirmGuestUploadRequest) (*ConfirmGuestUploadResponse, error) {
+	userData, err := ownerData(ctx, req.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var s3Key string
+	var ownerID int64
+	err = db.QueryRow(ctx, `
+		SELECT s3_key_original, owner_id FROM media WHERE id = $1 AND status = 'uploading'
+	`, req.MediaID).Scan(&s3Key, &ownerID)
+	if err != nil || ownerID != req.OwnerID {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+
+	// Guests can't be trusted to report sizes, so the stored size always counts
+	size := uploadedSize(ctx, s3Key, 0)
+	if size == 0 {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("file has not been uploaded").Err()
+	}
+	if req.MaxSizeBytes > 0 && size > req.MaxSizeBytes {
+		if client, err := getMinioClient(); err == nil {
+			removeMediaObjects(ctx, client, req.MediaID, s3Key, "")
+		}
+		if _, err := db.Exec(ctx, `DELETE FROM media WHERE id = $1`, req.MediaID); err != nil {
+			rlog.Error("failed to delete oversized guest upload", "error", err, "media_id", req.MediaID)
+		}
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg(fmt.Sprintf("file is larger than the limit of %d bytes", req.MaxSizeBytes)).Err()
+	}
+
+	resp, err := confirmUpload(ctx, userData, &ConfirmUploadRequest{
+		MediaID:   req.MediaID,
+		Title:     req.Title,
+		SizeBytes: size,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConfirmGuestUploadResponse{
+		MediaID:   resp.MediaID,
+		Status:    resp.Status,
+		SizeBytes: size,
+	}, nil
+}
+
+// DiscardGuestUploadRequest names a guest upload that was never confirmed
+type DiscardGuestUploadRequest struct {
+	OwnerID int64  `json:"owner_id"`
+	MediaID string `json:"media_id"`
+}
+
+// DiscardGuestUpload deletes a guest upload still 'uploading', with whatever
+// the guest stored, once its slot lapsed
+//
+//encore:api private
+func DiscardGuestUpload(ctx context.Context, req *DiscardGuestUploadRequest) error {
+	var s3Key string
+	err := db.QueryRow(ctx, `
+		DELETE FROM media WHERE id = $1 AND owner_id = $2 AND status = 'uploading'
+		RETURNING s3_key_original
+	`, req.MediaID, req.OwnerID).Scan(&s3Key)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		rlog.Error("failed to discard guest upload", "error", err, "media_id", req.MediaID)
+		return errs.B().Code(errs.Internal).Msg("failed to discard upload").Err()
+	}
+	if client, err := getMinioClient(); err == nil {
+		removeMediaObjects(ctx, client, req.MediaID, s3Key, "")
+	}
+	return nil
+}
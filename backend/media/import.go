@@ -0,0 +1,308 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// defaultImportLimit is how many objects one import call creates media for
+const defaultImportLimit = 1000
+
+// maxImportLimit caps the limit an import call may ask for
+const maxImportLimit = 10000
+
+// managedPrefixes hold objects the services write themselves; they can't be
+// imported
+var managedPrefixes = []string{"original", "processed", "thumbnails", "previews", "derived", "renditions", "exports"}
+
+// ImportObjectsRequest selects the objects to import and what to do with them
+type ImportObjectsRequest struct {
+	// Prefix is the part of the bucket to scan, e.g. "archive/2019/"
+	Prefix string `json:"prefix"`
+	// OwnerID owns every imported object. When 0, the first path segment
+	// after the prefix must be the owner's user ID ("archive/42/a.mp4").
+	OwnerID int64 `json:"owner_id,omitempty"`
+	// Process queues the imported media for processing; otherwise the
+	// originals are served as they are
+	Process bool `json:"process"`
+	// Packaging and Preset are passed on to processing
+	Packaging string `json:"packaging,omitempty"`
+	Preset    string `json:"preset,omitempty"`
+	// Tags are added to every imported item
+	Tags []string `json:"tags,omitempty"`
+	// Limit caps the objects imported in this call, 1000 by default
+	Limit int `json:"limit,omitempty"`
+	// DryRun reports what would be imported without importing anything
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// ImportedObject is an object that was (or, in a dry run, would be) imported
+type ImportedObject struct {
+	Key       string `json:"key"`
+	MediaID   string `json:"media_id,omitempty"`
+	OwnerID   int64  `json:"owner_id"`
+	MimeType  string `json:"mime_type"`
+	SizeBytes int64  `json:"size_bytes"`
+	Status    string `json:"status"`
+}
+
+// SkippedObject is an object that was not imported, and why
+type SkippedObject struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// ImportObjectsResponse reports the outcome of an import
+type ImportObjectsResponse struct {
+	Scanned int `json:"scanned"`
+	// AlreadyTracked counts objects that already belong to a media item
+	AlreadyTracked int              `json:"already_tracked"`
+	Imported       []ImportedObject `json:"imported"`
+	Skipped        []SkippedObject  `json:"skipped"`
+	// Truncated is set when the limit was reached; calling again with the
+	// same request continues where this call stopped
+	Truncated bool `json:"truncated"`
+}
+
+// ImportObjects creates media items for objects under a bucket prefix that
+// no media item tracks yet, e.g. when migrating an existing archive (admin
+// only). The objects stay where they are and become the items' originals;
+// they don't count against storage quotas. Repeating an import skips the
+// objects it already imported.
+//
+//encore:api auth method=POST path=/admin/media/import
+func ImportObjects(ctx context.Context, req *ImportObjectsRequest) (*ImportObjectsResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	userData := auth.Data().(*authpkg.UserData)
+
+	prefix := strings.TrimPrefix(req.Prefix, "/")
+	if prefix == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("prefix is required").Err()
+	}
+	first, _, _ := strings.Cut(prefix, "/")
+	for _, managed := range managedPrefixes {
+		if first == managed {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg(fmt.Sprintf("objects under %s/ are managed by the services", managed)).Err()
+		}
+	}
+	if req.Packaging != "" && req.Packaging != "mp4" && req.Packaging != "dash" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("packaging must be 'mp4' or 'dash'").Err()
+	}
+	limit := req.Limit
+	if limit < 1 {
+		limit = defaultImportLimit
+	}
+	if limit > maxImportLimit {
+		limit = maxImportLimit
+	}
+
+	// Owners are checked once each
+	owners := map[int64]bool{}
+	ownerExists := func(ownerID int64) bool {
+		exists, ok := owners[ownerID]
+		if !ok {
+			_, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: ownerID})
+			exists = err == nil
+			owners[ownerID] = exists
+		}
+		return exists
+	}
+	if req.OwnerID != 0 && !ownerExists(req.OwnerID) {
+		return nil, errs.B().Code(errs.NotFound).Msg("owner not found").Err()
+	}
+
+	tracked, err := trackedOriginals(ctx, prefix)
+	if err != nil {
+		rlog.Error("failed to load tracked originals", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to import objects").Err()
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		rlog.Error("failed to create MinIO client", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+
+	resp := &ImportObjectsResponse{Imported: []ImportedObject{}, Skipped: []SkippedObject{}}
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range client.ListObjects(listCtx, objectstore.Bucket(), minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			rlog.Error("failed to list objects", "error", object.Err, "prefix", prefix)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to list bucket").Err()
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		resp.Scanned++
+		if tracked[object.Key] {
+			resp.AlreadyTracked++
+			continue
+		}
+		if len(resp.Imported) >= limit {
+			resp.Truncated = true
+			break
+		}
+
+		ownerID := req.OwnerID
+		if ownerID == 0 {
+			segment, _, _ := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+			ownerID, err = strconv.ParseInt(segment, 10, 64)
+			if err != nil || ownerID <= 0 {
+				resp.Skipped = append(resp.Skipped, SkippedObject{Key: object.Key, Reason: "path does not start with a user ID"})
+				continue
+			}
+		}
+		if !ownerExists(ownerID) {
+			resp.Skipped = append(resp.Skipped, SkippedObject{Key: object.Key, Reason: fmt.Sprintf("user %d not found", ownerID)})
+			continue
+		}
+
+		mimeType := importMimeType(object)
+		if !strings.HasPrefix(mimeType, "video/") && !strings.HasPrefix(mimeType, "audio/") && !strings.HasPrefix(mimeType, "image/") {
+			resp.Skipped = append(resp.Skipped, SkippedObject{Key: object.Key, Reason: "not a video, audio or image file"})
+			continue
+		}
+		if object.Size == 0 {
+			resp.Skipped = append(resp.Skipped, SkippedObject{Key: object.Key, Reason: "empty object"})
+			continue
+		}
+
+		imported := ImportedObject{Key: object.Key, OwnerID: ownerID, MimeType: mimeType, SizeBytes: object.Size, Status: "ready"}
+		if req.Process {
+			imported.Status = "queued"
+		}
+		if !req.DryRun {
+			imported.MediaID, err = importObject(ctx, userData.UserID, req, imported)
+			if err != nil {
+				rlog.Error("failed to import object", "error", err, "key", object.Key)
+				resp.Skipped = append(resp.Skipped, SkippedObject{Key: object.Key, Reason: "failed to create media record"})
+				continue
+			}
+		}
+		resp.Imported = append(resp.Imported, imported)
+	}
+
+	if !req.DryRun {
+		rlog.Info("objects imported", "prefix", prefix, "imported", len(resp.Imported), "skipped", len(resp.Skipped),
+			"truncated", resp.Truncated)
+	}
+	return resp, nil
+}
+
+// trackedOriginals returns the original keys under a prefix that belong to
+// a media item
+func trackedOriginals(ctx context.Context, prefix string) (map[string]bool, error) {
+	rows, err := db.Query(ctx, `
+		SELECT s3_key_original FROM media WHERE starts_with(s3_key_original, $1)
+	`, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracked := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			tracked[key] = true
+		}
+	}
+	return tracked, rows.Err()
+}
+
+// importMimeType guesses the MIME type of an object from its extension,
+// falling back to the content type it was stored with
+func importMimeType(object minio.ObjectInfo) string {
+	mimeType := mime.TypeByExtension(strings.ToLower(path.Ext(object.Key)))
+	if mimeType == "" {
+		mimeType = object.ContentType
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.TrimSpace(mimeType)
+}
+
+// importObject creates the media item of an imported object, tags it and
+// queues it for processing when asked to
+func importObject(ctx context.Context, adminID int64, req *ImportObjectsRequest, obj ImportedObject) (string, error) {
+	mediaID := uuid.New().String()
+	filename := path.Base(obj.Key)
+	title := strings.TrimSuffix(filename, path.Ext(filename))
+
+	// Like uploads, imports that don't name a preset use the owner's preferred one
+	preset := req.Preset
+	if preset == "" && req.Process {
+		preset = authpkg.SettingsOrDefault(ctx, obj.OwnerID).PreferredPreset
+	}
+
+	// Queued items get their MediaUploaded event in the same transaction
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO media (id, owner_id, title, original_filename, s3_key_original, mime_type, size_bytes, status,
+			packaging, preset, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), NOW())
+	`, mediaID, obj.OwnerID, title, filename, obj.Key, obj.MimeType, obj.SizeBytes, obj.Status, req.Packaging, preset)
+	if err != nil {
+		return "", err
+	}
+	var outboxID int64
+	if req.Process {
+		outboxID, err = enqueue(ctx, tx, outboxMediaUploaded, &MediaUploaded{
+			MediaID:   mediaID,
+			S3Key:     obj.Key,
+			OwnerID:   obj.OwnerID,
+			Packaging: req.Packaging,
+			Preset:    preset,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	if outboxID != 0 {
+		publishNow(ctx, outboxID)
+	}
+
+	for _, tagName := range req.Tags {
+		var tagID int64
+		err := db.QueryRow(ctx, `
+			INSERT INTO tags (name) VALUES ($1)
+			ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id
+		`, tagName).Scan(&tagID)
+		if err != nil {
+			continue
+		}
+		_, _ = db.Exec(ctx, `
+			INSERT INTO media_tags (media_id, tag_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, mediaID, tagID)
+	}
+
+	recordAudit(ctx, adminID, auditMediaImported, mediaID, nil, mediaSnapshot(ctx, mediaID),
+		map[string]string{"key": obj.Key, "owner_id": strconv.FormatInt(obj.OwnerID, 10)})
+	publishStatus(ctx, obj.OwnerID, mediaID, obj.Status)
+	return mediaID, nil
+}
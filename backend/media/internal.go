@@ -0,0 +1,493 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// maxInternalBatch is the most media one internal call may look up
+const maxInternalBatch = 5000
+
+// MediaInfo is what other services need to know about a media item
+type MediaInfo struct {
+	ID               string `json:"id"`
+	OwnerID          int64  `json:"owner_id"`
+	Title            string `json:"title"`
+	OriginalFilename string `json:"original_filename"`
+	MimeType         string `json:"mime_type"`
+	Status           string `json:"status"`
+	Packaging        string `json:"packaging,omitempty"`
+	Width            int    `json:"width,omitempty"`
+	Height           int    `json:"height,omitempty"`
+	SizeBytes        int64  `json:"size_bytes"`
+	DurationSeconds  int64  `json:"duration_seconds"`
+	// ChecksumSHA256 is the SHA-256 of the processed file (of the manifest for DASH)
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	// HasProcessed is set once there is a processed file to stream
+	HasProcessed bool `json:"has_processed"`
+	// TeamID is set for media in a team
+	TeamID    string    `json:"team_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// PublishAt is set while the media is scheduled to be published; until
+	// then only its owner and team see it in collections
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// ExpiresAt is when the media is trashed or deleted, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// mediaInfoColumns are the columns scanned by scanMediaInfo
+const mediaInfoColumns = `
+	m.id::text, m.owner_id, COALESCE(m.title, ''), COALESCE(m.original_filename, ''), COALESCE(m.mime_type, ''),
+	m.status, COALESCE(m.packaging, ''), COALESCE(m.width, 0), COALESCE(m.height, 0), COALESCE(m.size_bytes, 0),
+	COALESCE(m.duration_seconds, 0), COALESCE(m.processed_sha256, ''), m.s3_key_processed IS NOT NULL,
+	m.created_at, COALESCE(m.team_id::text, ''), m.publish_at, m.expires_at`
+
+// scanMediaInfo scans mediaInfoColumns
+func scanMediaInfo(scan func(dest ...any) error) (MediaInfo, error) {
+	var m MediaInfo
+	err := scan(&m.ID, &m.OwnerID, &m.Title, &m.OriginalFilename, &m.MimeType, &m.Status, &m.Packaging, &m.Width,
+		&m.Height, &m.SizeBytes, &m.DurationSeconds, &m.ChecksumSHA256, &m.HasProcessed, &m.CreatedAt, &m.TeamID,
+		&m.PublishAt, &m.ExpiresAt)
+	return m, err
+}
+
+// GetMediaInfoRequest names the media to look up
+type GetMediaInfoRequest struct {
+	MediaIDs []string `json:"media_ids"`
+}
+
+// GetMediaInfoResponse contains the media found, in no particular order
+type GetMediaInfoResponse struct {
+	Media []MediaInfo `json:"media"`
+}
+
+// GetMediaInfo returns the metadata of a batch of media for other services;
+// unknown, trashed and malformed IDs are left out
+//
+//encore:api private
+func GetMediaInfo(ctx context.Context, req *GetMediaInfoRequest) (*GetMediaInfoResponse, error) {
+	if len(req.MediaIDs) > maxInternalBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("too many media IDs").Err()
+	}
+	resp := &GetMediaInfoResponse{Media: []MediaInfo{}}
+	mediaIDs := validMediaIDs(req.MediaIDs)
+	if len(mediaIDs) == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT `+mediaInfoColumns+` FROM media m WHERE m.id = ANY($1::uuid[]) AND m.trashed_at IS NULL`, mediaIDs)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get media").Err()
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMediaInfo(rows.Scan)
+		if err != nil {
+			continue
+		}
+		resp.Media = append(resp.Media, m)
+	}
+	return resp, nil
+}
+
+// FindMediaByContentRequest looks for a user's media by content
+type FindMediaByContentRequest struct {
+	OwnerID   int64    `json:"owner_id"`
+	Checksums []string `json:"checksums,omitempty"`
+	Filenames []string `json:"filenames,omitempty"`
+}
+
+// FindMediaByContent returns the user's media whose processed checksum or
+// original file name is one of those given, oldest first
+//
+//encore:api private
+func FindMediaByContent(ctx context.Context, req *FindMediaByContentRequest) (*GetMediaInfoResponse, error) {
+	if len(req.Checksums) > maxInternalBatch || len(req.Filenames) > maxInternalBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("too many checksums or file names").Err()
+	}
+	resp := &GetMediaInfoResponse{Media: []MediaInfo{}}
+	if len(req.Checksums) == 0 && len(req.Filenames) == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT `+mediaInfoColumns+` FROM media m
+		WHERE m.owner_id = $1 AND m.trashed_at IS NULL AND (m.processed_sha256 = ANY($2::text[]) OR m.original_filename = ANY($3::text[]))
+		ORDER BY m.created_at
+	`, req.OwnerID, req.Checksums, req.Filenames)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to find media").Err()
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m, err := scanMediaInfo(rows.Scan)
+		if err != nil {
+			continue
+		}
+		resp.Media = append(resp.Media, m)
+	}
+	return resp, nil
+}
+
+// maxIndexPage is the most media one ListIndexMedia page returns
+const maxIndexPage = 1000
+
+// ListIndexMediaRequest selects media for the search index: the given
+// media, or without MediaIDs a page of all media ordered by ID
+type ListIndexMediaRequest struct {
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// After is the Next of the previous page
+	After string `json:"after,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// IndexMedia is a media item with its tags
+type IndexMedia struct {
+	Media MediaInfo `json:"media"`
+	Tags  []string  `json:"tags"`
+}
+
+// ListIndexMediaResponse contains the media found; media still uploading
+// and trashed media are left out
+type ListIndexMediaResponse struct {
+	Media []IndexMedia `json:"media"`
+	// Next is the After of the next page, empty after the last page
+	Next string `json:"next,omitempty"`
+}
+
+// ListIndexMedia returns media with their tags for the search service
+//
+//encore:api private
+func ListIndexMedia(ctx context.Context, req *ListIndexMediaRequest) (*ListIndexMediaResponse, error) {
+	if len(req.MediaIDs) > maxInternalBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("too many media IDs").Err()
+	}
+	limit := req.Limit
+	if limit < 1 || limit > maxIndexPage {
+		limit = maxIndexPage
+	}
+	after := uuid.Nil.String()
+	if req.After != "" {
+		parsed, err := uuid.Parse(req.After)
+		if err != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("invalid after").Err()
+		}
+		after = parsed.String()
+	}
+
+	query := `
+		SELECT ` + mediaInfoColumns + `, ARRAY(
+			SELECT t.name FROM media_tags mt JOIN tags t ON t.id = mt.tag_id
+			WHERE mt.media_id = m.id ORDER BY t.name
+		)
+		FROM media m WHERE m.status <> 'uploading' AND m.trashed_at IS NULL AND `
+	args := []any{}
+	if req.MediaIDs != nil {
+		query += `m.id = ANY($1::uuid[])`
+		args = append(args, validMediaIDs(req.MediaIDs))
+	} else {
+		query += fmt.Sprintf(`m.id > $1::uuid ORDER BY m.id LIMIT %d`, limit)
+		args = append(args, after)
+	}
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list media").Err()
+	}
+	defer rows.Close()
+
+	resp := &ListIndexMediaResponse{Media: []IndexMedia{}}
+	scanned := 0
+	for rows.Next() {
+		scanned++
+		var tags []string
+		m, err := scanMediaInfo(func(dest ...any) error {
+			return rows.Scan(append(dest, &tags)...)
+		})
+		if err != nil {
+			continue
+		}
+		if tags == nil {
+			tags = []string{}
+		}
+		resp.Media = append(resp.Media, IndexMedia{Media: m, Tags: tags})
+	}
+	if req.MediaIDs == nil && scanned == limit && len(resp.Media) > 0 {
+		resp.Next = resp.Media[len(resp.Media)-1].Media.ID
+	}
+	return resp, nil
+}
+
+// MediaFilter selects a user's media, e.g. by the rules of a smart
+// collection; every field given must match
+type MediaFilter struct {
+	OwnerID int64 `json:"owner_id"`
+	// TagsAll matches media that has all of these tags
+	TagsAll []string `json:"tags_all,omitempty"`
+	// TagsAny matches media that has at least one of these tags
+	TagsAny []string `json:"tags_any,omitempty"`
+	Status  string   `json:"status,omitempty"`
+	// MediaType is "video", "audio" or "image"
+	MediaType string `json:"media_type,omitempty"`
+	// CreatedWithinDays matches media uploaded in the last this many days
+	CreatedWithinDays int        `json:"created_within_days,omitempty"`
+	CreatedAfter      *time.Time `json:"created_after,omitempty"`
+	// MediaIDs keeps just these media when not nil
+	MediaIDs []string `json:"media_ids,omitempty"`
+	// Published leaves out media scheduled to be published later
+	Published bool `json:"published,omitempty"`
+}
+
+// where returns the SQL conditions of the filter over media m and their
+// arguments. Media still uploading or in the trash never matches.
+func (f *MediaFilter) where() (string, []any) {
+	args := []any{f.OwnerID}
+	conditions := []string{"m.owner_id = $1", "m.status <> 'uploading'", "m.trashed_at IS NULL"}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Status != "" {
+		conditions = append(conditions, "m.status = "+arg(f.Status))
+	}
+	if f.MediaType != "" {
+		conditions = append(conditions, "m.mime_type LIKE "+arg(f.MediaType+"/%"))
+	}
+	if f.CreatedWithinDays > 0 {
+		conditions = append(conditions, "m.created_at > NOW() - make_interval(days => "+arg(f.CreatedWithinDays)+")")
+	}
+	if f.CreatedAfter != nil {
+		conditions = append(conditions, "m.created_at > "+arg(*f.CreatedAfter))
+	}
+	if f.MediaIDs != nil {
+		conditions = append(conditions, "m.id = ANY("+arg(validMediaIDs(f.MediaIDs))+"::uuid[])")
+	}
+	if f.Published {
+		conditions = append(conditions, "(m.publish_at IS NULL OR m.publish_at <= NOW())")
+	}
+	if len(f.TagsAll) > 0 {
+		p := arg(f.TagsAll)
+		conditions = append(conditions, `(
+			SELECT COUNT(*) FROM media_tags mt JOIN tags t ON t.id = mt.tag_id
+			WHERE mt.media_id = m.id AND t.name = ANY(`+p+`::text[])
+		) = cardinality(`+p+`::text[])`)
+	}
+	if len(f.TagsAny) > 0 {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM media_tags mt JOIN tags t ON t.id = mt.tag_id
+			WHERE mt.media_id = m.id AND t.name = ANY(`+arg(f.TagsAny)+`::text[])
+		)`)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// MatchMediaRequest selects a page of the media matching a filter
+type MatchMediaRequest struct {
+	Filter MediaFilter `json:"filter"`
+	// Limit is the most media returned from Offset, 0 for all of them
+	Limit  int `json:"limit,omitempty"`
+	Offset int `json:"offset,omitempty"`
+	// CountOnly returns the totals without any media
+	CountOnly bool `json:"count_only,omitempty"`
+}
+
+// MatchedMedia is a media item matching a filter
+type MatchedMedia struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MatchMediaResponse contains the matching media, newest first, and the
+// totals of all of them
+type MatchMediaResponse struct {
+	Media                []MatchedMedia `json:"media"`
+	Total                int            `json:"total"`
+	TotalSizeBytes       int64          `json:"total_size_bytes"`
+	TotalDurationSeconds int64          `json:"total_duration_seconds"`
+}
+
+// MatchMedia returns a user's media matching a filter, which is how smart
+// collections find their items
+//
+//encore:api private
+func MatchMedia(ctx context.Context, req *MatchMediaRequest) (*MatchMediaResponse, error) {
+	if len(req.Filter.MediaIDs) > maxInternalBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("too many media IDs").Err()
+	}
+	where, args := req.Filter.where()
+
+	resp := &MatchMediaResponse{Media: []MatchedMedia{}}
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(m.size_bytes), 0), COALESCE(SUM(m.duration_seconds), 0)
+		FROM media m WHERE `+where, args...).Scan(&resp.Total, &resp.TotalSizeBytes, &resp.TotalDurationSeconds)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to match media").Err()
+	}
+	if req.CountOnly || resp.Total == 0 {
+		return resp, nil
+	}
+
+	query := `SELECT m.id::text, m.created_at FROM media m WHERE ` + where + ` ORDER BY m.created_at DESC, m.id`
+	if req.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", req.Limit, max(req.Offset, 0))
+	}
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to match media").Err()
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m MatchedMedia
+		if err := rows.Scan(&m.ID, &m.CreatedAt); err != nil {
+			continue
+		}
+		resp.Media = append(resp.Media, m)
+	}
+	return resp, nil
+}
+
+// ResolveStreamURLRequest names the media to get stream URLs for
+type ResolveStreamURLRequest struct {
+	MediaIDs []string `json:"media_ids"`
+	// Progressive resolves DASH-packaged media to the original file, for
+	// downloads and players that can't read a manifest
+	Progressive bool `json:"progressive,omitempty"`
+	// StreamOnly never resolves to an original file; media without a
+	// processed file get no URL
+	StreamOnly bool `json:"stream_only,omitempty"`
+	// Thumbnails adds thumbnail URLs
+	Thumbnails bool `json:"thumbnails,omitempty"`
+	// Viewer is who the URLs are for (user:<id> or ip:<address>), so
+	// handing them out again doesn't count towards egress twice
+	Viewer string `json:"viewer,omitempty"`
+	// Proxied is set when the caller streams the files itself and reports
+	// the bytes it sent with RecordEgress
+	Proxied bool `json:"proxied,omitempty"`
+}
+
+// ResolvedStream is a presigned stream URL of a media item
+type ResolvedStream struct {
+	MediaID      string `json:"media_id"`
+	StreamURL    string `json:"stream_url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	// Processed is set when the URL points to the processed file
+	Processed bool      `json:"processed"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ResolveStreamURLResponse contains the URLs of the ready media, in no
+// particular order
+type ResolveStreamURLResponse struct {
+	Streams []ResolvedStream `json:"streams"`
+}
+
+// ResolveStreamURL returns presigned stream URLs of ready media for other
+// services. URLs follow the media owner's settings, whoever asks; media of
+// owners who reached the monthly egress limit get none.
+//
+//encore:api private
+func ResolveStreamURL(ctx context.Context, req *ResolveStreamURLRequest) (*ResolveStreamURLResponse, error) {
+	if len(req.MediaIDs) > maxInternalBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("too many media IDs").Err()
+	}
+	resp := &ResolveStreamURLResponse{Streams: []ResolvedStream{}}
+	mediaIDs := validMediaIDs(req.MediaIDs)
+	if len(mediaIDs) == 0 {
+		return resp, nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id::text, owner_id, s3_key_original,
+			   CASE WHEN $2 AND packaging = 'dash' THEN '' ELSE COALESCE(s3_key_processed, '') END,
+			   COALESCE(s3_key_thumbnail, '')
+		FROM media WHERE id = ANY($1::uuid[]) AND status = 'ready' AND trashed_at IS NULL
+	`, mediaIDs, req.Progressive)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get media").Err()
+	}
+	type objects struct {
+		mediaID, key, thumbnailKey string
+		ownerID                    int64
+		processed                  bool
+	}
+	var found []objects
+	for rows.Next() {
+		var o objects
+		var s3KeyOriginal, s3KeyProcessed string
+		if err := rows.Scan(&o.mediaID, &o.ownerID, &s3KeyOriginal, &s3KeyProcessed, &o.thumbnailKey); err != nil {
+			continue
+		}
+		o.key, o.processed = s3KeyProcessed, s3KeyProcessed != ""
+		if !o.processed {
+			if req.StreamOnly {
+				continue
+			}
+			o.key = s3KeyOriginal
+		}
+		found = append(found, o)
+	}
+	rows.Close()
+	if len(found) == 0 {
+		return resp, nil
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+	ttls := map[int64]time.Duration{}
+	limited := map[int64]bool{}
+	served := map[int64][]string{}
+	for _, o := range found {
+		if _, ok := ttls[o.ownerID]; !ok {
+			ttls[o.ownerID] = authpkg.SettingsOrDefault(ctx, o.ownerID).PresignTTL()
+			limited[o.ownerID] = checkEgress(ctx, o.ownerID) != nil
+		}
+		if limited[o.ownerID] {
+			continue
+		}
+		ttl := ttls[o.ownerID]
+		streamURL, err := objectstore.PlaybackURL(ctx, client, o.key, ttl)
+		if err != nil {
+			continue
+		}
+		served[o.ownerID] = append(served[o.ownerID], o.mediaID)
+		s := ResolvedStream{
+			MediaID:   o.mediaID,
+			StreamURL: streamURL.String(),
+			Processed: o.processed,
+			ExpiresAt: time.Now().Add(ttl),
+		}
+		if req.Thumbnails && o.thumbnailKey != "" {
+			if thumbnailURL, err := objectstore.PlaybackURL(ctx, client, o.thumbnailKey, ttl); err == nil {
+				s.ThumbnailURL = thumbnailURL.String()
+			}
+		}
+		resp.Streams = append(resp.Streams, s)
+	}
+	if !req.Proxied {
+		for ownerID, mediaIDs := range served {
+			recordPresignedEgress(ctx, req.Viewer, ttls[ownerID], mediaIDs...)
+		}
+	}
+	return resp, nil
+}
+
+// validMediaIDs returns the well-formed IDs among mediaIDs
+func validMediaIDs(mediaIDs []string) []string {
+	valid := []string{}
+	for _, mediaID := range mediaIDs {
+		if parsed, err := uuid.Parse(mediaID); err == nil {
+			valid = append(valid, parsed.String())
+		}
+	}
+	return valid
+}
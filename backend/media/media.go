@@ -3,8 +3,12 @@ package media
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"encore.dev/beta/auth"
@@ -14,9 +18,12 @@ import (
 	"encore.dev/storage/sqldb"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	authpkg "encore.app/auth"
+	"encore.app/idempotency"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
 )
 
 // Secrets for S3/MinIO
@@ -25,25 +32,17 @@ var secrets struct {
 	S3SecretKey string
 }
 
-// getS3Endpoint returns the S3 endpoint
-func getS3Endpoint() string {
-	if val := os.Getenv("S3_ENDPOINT"); val != "" {
-		return val
-	}
-	return "localhost:9000"
-}
-
-// getS3Bucket returns the S3 bucket name
-func getS3Bucket() string {
-	if val := os.Getenv("S3_BUCKET"); val != "" {
-		return val
+// skipProcessingByDefault reports whether uploads of this MIME type are served
+// as-is unless the upload asks for processing. MEDIA_SKIP_PROCESSING is a
+// comma-separated list of MIME types or prefixes, e.g. "image/,audio/flac".
+func skipProcessingByDefault(mimeType string) bool {
+	for _, entry := range strings.Split(os.Getenv("MEDIA_SKIP_PROCESSING"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && strings.HasPrefix(mimeType, entry) {
+			return true
+		}
 	}
-	return "media-vault"
-}
-
-// getS3UseSSL returns whether to use SSL for S3
-func getS3UseSSL() bool {
-	return os.Getenv("S3_USE_SSL") == "true"
+	return false
 }
 
 // Database for media
@@ -56,6 +55,12 @@ type MediaUploaded struct {
 	MediaID string `json:"media_id"`
 	S3Key   string `json:"s3_key"`
 	OwnerID int64  `json:"owner_id"`
+	// Packaging is the requested packaging target ("mp4" or "dash");
+	// empty means the processing service default
+	Packaging string `json:"packaging,omitempty"`
+	// Preset is the requested transcode preset; empty or unknown names use
+	// the processing service default
+	Preset string `json:"preset,omitempty"`
 }
 
 // MediaUploadedTopic is the Pub/Sub topic for media uploads
@@ -63,40 +68,166 @@ var MediaUploadedTopic = pubsub.NewTopic[*MediaUploaded]("media-uploaded", pubsu
 	DeliveryGuarantee: pubsub.AtLeastOnce,
 })
 
-// getMinioClient creates a MinIO client
+// MediaDeleted is published when a media item is deleted, by a user, when it
+// expires or with its owner's account
+type MediaDeleted struct {
+	MediaID string `json:"media_id"`
+	OwnerID int64  `json:"owner_id"`
+}
+
+// MediaDeletedTopic tells other services to drop their references to
+// deleted media, such as collection items
+var MediaDeletedTopic = pubsub.NewTopic[*MediaDeleted]("media-deleted", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// Upload counters, served on /metrics
+var (
+	uploadsStarted = metrics.NewCounter("surtr_uploads_started_total",
+		"Uploads a presigned upload URL was handed out for.")
+	uploadsConfirmed = metrics.NewCounter("surtr_uploads_confirmed_total",
+		"Confirmed uploads by resulting status: queued for processing, or ready as uploaded.", "status")
+)
+
+// getMinioClient returns the shared MinIO client of the media service
 func getMinioClient() (*minio.Client, error) {
-	return minio.New(getS3Endpoint(), &minio.Options{
-		Creds:  credentials.NewStaticV4(secrets.S3AccessKey, secrets.S3SecretKey, ""),
-		Secure: getS3UseSSL(),
-	})
+	return objectstore.Client("media", secrets.S3AccessKey, secrets.S3SecretKey)
+}
+
+// urlTTL returns the lifetime of the URLs in a response: the one requested,
+// within bounds, or else the user's
+func urlTTL(ctx context.Context, userID int64, seconds int) (time.Duration, error) {
+	if seconds == 0 {
+		return authpkg.SettingsOrDefault(ctx, userID).PresignTTL(), nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl < objectstore.MinStreamTTL || ttl > objectstore.MaxURLTTL {
+		return 0, errs.B().Code(errs.InvalidArgument).Msg("url_ttl_seconds must be between 300 and 604800").Err()
+	}
+	return ttl, nil
 }
 
 // SignUploadRequest contains parameters for generating a presigned upload URL
 type SignUploadRequest struct {
 	Filename string `json:"filename"`
 	MimeType string `json:"mime_type"`
+	// TeamID uploads into a team the caller is an editor of
+	TeamID string `json:"team_id,omitempty"`
+	// ExpiresInSeconds asks for a longer (or shorter) lived upload URL than
+	// UPLOAD_URL_TTL, e.g. for large files over slow links; at least 60 and
+	// at most UPLOAD_URL_MAX_TTL
+	ExpiresInSeconds int `json:"expires_in_seconds,omitempty"`
 }
 
 // SignUploadResponse contains the presigned URL and S3 key
 type SignUploadResponse struct {
 	UploadURL string `json:"upload_url"`
-	S3Key     string `json:"s3_key"`
-	MediaID   string `json:"media_id"`
+	// UploadHeaders must be sent with the PUT, such as the server-side
+	// encryption the URL was signed for
+	UploadHeaders map[string]string `json:"upload_headers,omitempty"`
+	// UploadFields is set for uploads with a size limit: instead of a PUT,
+	// POST upload_url as multipart form data with these fields, then the
+	// file as the last field named "file"
+	UploadFields map[string]string `json:"upload_fields,omitempty"`
+	S3Key        string            `json:"s3_key"`
+	MediaID      string            `json:"media_id"`
+	// ExpiresAt is when the upload must have started by; the URL is signed
+	// with PRESIGN_CLOCK_SKEW to spare
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // SignUpload generates a presigned PUT URL for direct upload to S3
 //
 //encore:api auth method=POST path=/media/upload/sign
 func SignUpload(ctx context.Context, req *SignUploadRequest) (*SignUploadResponse, error) {
-	userData := auth.Data().(*authpkg.UserData)
+	return signUpload(ctx, auth.Data().(*authpkg.UserData), req)
+}
 
-	if req.Filename == "" {
-		return nil, errs.B().Code(errs.InvalidArgument).Msg("filename is required").Err()
+// signUpload creates an uploading media record owned by userData's user
+func signUpload(ctx context.Context, userData *authpkg.UserData, req *SignUploadRequest) (*SignUploadResponse, error) {
+	uploads, err := signUploads(ctx, userData, req.TeamID, req.ExpiresInSeconds,
+		[]SignUploadFile{{Filename: req.Filename, MimeType: req.MimeType}})
+	if err != nil {
+		return nil, err
 	}
+	return &uploads[0], nil
+}
+
+// maxSignBatch is the most files one SignUploadBatch call may sign
+const maxSignBatch = 500
+
+// SignUploadFile is one file of a batch upload
+type SignUploadFile struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
 
-	// Generate unique S3 key
-	mediaID := uuid.New().String()
-	s3Key := fmt.Sprintf("original/%d/%s/%s", userData.UserID, mediaID, req.Filename)
+// SignUploadBatchRequest lists the files to upload, with the options of
+// SignUploadRequest applying to all of them
+type SignUploadBatchRequest struct {
+	Files            []SignUploadFile `json:"files"`
+	TeamID           string           `json:"team_id,omitempty"`
+	ExpiresInSeconds int              `json:"expires_in_seconds,omitempty"`
+}
+
+// SignUploadBatchResponse has an upload per file, in the order requested
+type SignUploadBatchResponse struct {
+	Uploads []SignUploadResponse `json:"uploads"`
+}
+
+// SignUploadBatch generates presigned PUT URLs for up to 500 files at once,
+// e.g. a dropped folder; each upload is confirmed on its own
+//
+//encore:api auth method=POST path=/media/upload/sign-batch
+func SignUploadBatch(ctx context.Context, req *SignUploadBatchRequest) (*SignUploadBatchResponse, error) {
+	if len(req.Files) == 0 || len(req.Files) > maxSignBatch {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("files must list 1 to 500 files").Err()
+	}
+	uploads, err := signUploads(ctx, auth.Data().(*authpkg.UserData), req.TeamID, req.ExpiresInSeconds, req.Files)
+	if err != nil {
+		return nil, err
+	}
+	return &SignUploadBatchResponse{Uploads: uploads}, nil
+}
+
+// signUploads creates an uploading media record per file, owned by
+// userData's user, all or none of them
+func signUploads(ctx context.Context, userData *authpkg.UserData, teamID string, expiresInSeconds int, files []SignUploadFile) ([]SignUploadResponse, error) {
+	for i, f := range files {
+		if f.Filename == "" {
+			if len(files) == 1 {
+				return nil, errs.B().Code(errs.InvalidArgument).Msg("filename is required").Err()
+			}
+			return nil, errs.B().Code(errs.InvalidArgument).Msg(fmt.Sprintf("files[%d]: filename is required", i)).Err()
+		}
+	}
+	ttl := objectstore.UploadTTL()
+	if expiresInSeconds != 0 {
+		ttl = time.Duration(expiresInSeconds) * time.Second
+		if maxTTL := objectstore.MaxUploadTTL(); ttl < objectstore.MinUploadTTL || ttl > maxTTL {
+			return nil, errs.B().Code(errs.InvalidArgument).
+				Msg(fmt.Sprintf("expires_in_seconds must be between 60 and %d", int(maxTTL.Seconds()))).Err()
+		}
+	}
+	// Generate unique media IDs and S3 keys
+	uploads := make([]SignUploadResponse, len(files))
+	for i, f := range files {
+		uploads[i].MediaID = uuid.New().String()
+		uploads[i].S3Key = fmt.Sprintf("original/%d/%s/%s", userData.UserID, uploads[i].MediaID, f.Filename)
+	}
+
+	// Users (or teams) already at their quota can't start another upload;
+	// team uploads count against the team's limits instead of the user's
+	if teamID != "" {
+		if err := requireTeamRole(ctx, userData.UserID, teamID, team.RoleEditor); err != nil {
+			return nil, err
+		}
+		if err := checkTeamQuota(ctx, teamID, uploads[0].MediaID, 0); err != nil {
+			return nil, err
+		}
+	} else if err := checkStorageQuota(ctx, userData, uploads[0].MediaID, 0); err != nil {
+		return nil, err
+	}
 
 	// Get MinIO client
 	client, err := getMinioClient()
@@ -105,29 +236,39 @@ func SignUpload(ctx context.Context, req *SignUploadRequest) (*SignUploadRespons
 		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
 	}
 
-	// Generate presigned URL (valid for 15 minutes)
-	presignedURL, err := client.PresignedPutObject(ctx, getS3Bucket(), s3Key, 15*time.Minute)
-	if err != nil {
-		rlog.Error("failed to generate presigned URL", "error", err)
-		return nil, errs.B().Code(errs.Internal).Msg("failed to generate upload URL").Err()
+	// Generate presigned URLs
+	expiresAt := time.Now().Add(ttl)
+	ids := make([]string, len(files))
+	keys := make([]string, len(files))
+	filenames := make([]string, len(files))
+	mimeTypes := make([]string, len(files))
+	for i, f := range files {
+		presignedURL, uploadHeaders, err := objectstore.PresignedPut(ctx, client, uploads[i].S3Key, ttl)
+		if err != nil {
+			rlog.Error("failed to generate presigned URL", "error", err)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to generate upload URL").Err()
+		}
+		uploads[i].UploadURL = presignedURL.String()
+		uploads[i].UploadHeaders = uploadHeaders
+		uploads[i].ExpiresAt = expiresAt
+		ids[i], keys[i], filenames[i], mimeTypes[i] = uploads[i].MediaID, uploads[i].S3Key, f.Filename, f.MimeType
 	}
 
-	// Create media record with 'uploading' status
+	// Create media records with 'uploading' status
 	_, err = db.Exec(ctx, `
-		INSERT INTO media (id, owner_id, original_filename, s3_key_original, mime_type, status, created_at)
-		VALUES ($1, $2, $3, $4, $5, 'uploading', NOW())
-	`, mediaID, userData.UserID, req.Filename, s3Key, req.MimeType)
+		INSERT INTO media (id, owner_id, original_filename, s3_key_original, mime_type, status, created_at, team_id,
+			upload_expires_at)
+		SELECT f.id, $1, f.filename, f.s3_key, f.mime_type, 'uploading', NOW(), NULLIF($6, '')::uuid, $7
+		FROM unnest($2::uuid[], $3::text[], $4::text[], $5::text[]) AS f(id, filename, s3_key, mime_type)
+	`, userData.UserID, ids, filenames, keys, mimeTypes, teamID, expiresAt)
 
 	if err != nil {
 		rlog.Error("failed to create media record", "error", err)
 		return nil, errs.B().Code(errs.Internal).Msg("failed to create media record").Err()
 	}
+	uploadsStarted.Add(float64(len(files)))
 
-	return &SignUploadResponse{
-		UploadURL: presignedURL.String(),
-		S3Key:     s3Key,
-		MediaID:   mediaID,
-	}, nil
+	return uploads, nil
 }
 
 // ConfirmUploadRequest contains the media ID to confirm upload
@@ -135,6 +276,26 @@ type ConfirmUploadRequest struct {
 	MediaID   string `json:"media_id"`
 	Title     string `json:"title,omitempty"`
 	SizeBytes int64  `json:"size_bytes,omitempty"`
+	// Packaging optionally selects the output packaging ("mp4" or "dash")
+	Packaging string `json:"packaging,omitempty"`
+	// Preset optionally selects a transcode preset (see GET /presets)
+	Preset string `json:"preset,omitempty"`
+	// AudioLanguages optionally keeps only audio tracks in these languages
+	// (ISO 639-2, e.g. "eng"); by default every audio track is kept
+	AudioLanguages []string `json:"audio_languages,omitempty"`
+	// Process set to false marks the media ready immediately and serves the
+	// original file; when omitted, MEDIA_SKIP_PROCESSING decides by MIME type
+	Process *bool `json:"process,omitempty"`
+	// TrimStart and TrimEnd optionally keep only this range (in seconds) of
+	// audio and video uploads; either end may be omitted
+	TrimStart *float64 `json:"trim_start,omitempty"`
+	TrimEnd   *float64 `json:"trim_end,omitempty"`
+	// ExpiresAt optionally trashes or deletes the media at this time, as
+	// the owner's expired_media setting says
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// IdempotencyKey makes retries return the first response instead of
+	// queueing the upload again
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 // ConfirmUploadResponse confirms the upload was processed
@@ -148,17 +309,39 @@ type ConfirmUploadResponse struct {
 //encore:api auth method=POST path=/media/upload/confirm
 func ConfirmUpload(ctx context.Context, req *ConfirmUploadRequest) (*ConfirmUploadResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
+	return idempotency.Do(ctx, db, userData.UserID, "media.ConfirmUpload", req.IdempotencyKey, req,
+		func() (*ConfirmUploadResponse, error) {
+			return confirmUpload(ctx, userData, req)
+		})
+}
 
+// confirmUpload queues or readies an upload of userData's user
+func confirmUpload(ctx context.Context, userData *authpkg.UserData, req *ConfirmUploadRequest) (*ConfirmUploadResponse, error) {
 	if req.MediaID == "" {
 		return nil, errs.B().Code(errs.InvalidArgument).Msg("media_id is required").Err()
 	}
+	if req.Packaging != "" && req.Packaging != "mp4" && req.Packaging != "dash" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("packaging must be 'mp4' or 'dash'").Err()
+	}
+	if (req.TrimStart != nil && *req.TrimStart < 0) || (req.TrimEnd != nil && *req.TrimEnd <= 0) ||
+		(req.TrimStart != nil && req.TrimEnd != nil && *req.TrimEnd <= *req.TrimStart) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("trim_end must be after trim_start").Err()
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("expires_at must be in the future").Err()
+	}
+	// Expired media may be deleted, so API keys need media:delete to set it
+	if req.ExpiresAt != nil && !userData.HasScope(authpkg.ScopeMediaDelete) {
+		return nil, errs.B().Code(errs.PermissionDenied).
+			Msg(fmt.Sprintf("missing scope %s", authpkg.ScopeMediaDelete)).Err()
+	}
 
 	// Verify ownership and get S3 key
-	var s3Key string
+	var s3Key, mimeType, teamID string
 	var ownerID int64
 	err := db.QueryRow(ctx, `
-		SELECT s3_key_original, owner_id FROM media WHERE id = $1
-	`, req.MediaID).Scan(&s3Key, &ownerID)
+		SELECT s3_key_original, owner_id, COALESCE(mime_type, ''), COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, req.MediaID).Scan(&s3Key, &ownerID, &mimeType, &teamID)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
@@ -168,31 +351,106 @@ func ConfirmUpload(ctx context.Context, req *ConfirmUploadRequest) (*ConfirmUplo
 		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
 	}
 
-	// Update status to 'queued' and optionally update title/size
-	_, err = db.Exec(ctx, `
+	// With a quota the stored size counts, not the one the client reports
+	if teamID != "" {
+		req.SizeBytes = uploadedSize(ctx, s3Key, req.SizeBytes)
+		if err := checkTeamQuota(ctx, teamID, req.MediaID, req.SizeBytes); err != nil {
+			return nil, err
+		}
+		defer reportTeamStorage(ctx, teamID)
+	} else if userData.StorageQuotaBytes > 0 {
+		req.SizeBytes = uploadedSize(ctx, s3Key, req.SizeBytes)
+		if err := checkStorageQuota(ctx, userData, req.MediaID, req.SizeBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	// Uploads that don't name a preset use the owner's preferred one
+	if req.Preset == "" {
+		req.Preset = authpkg.SettingsOrDefault(ctx, userData.UserID).PreferredPreset
+	}
+
+	process := !skipProcessingByDefault(mimeType)
+	if req.Process != nil {
+		process = *req.Process
+	}
+	if !process {
+		if req.TrimStart != nil || req.TrimEnd != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("trimming requires processing").Err()
+		}
+
+		// Pre-encoded upload: serve the original without another generation
+		_, err = db.Exec(ctx, `
+			UPDATE media
+			SET status = 'ready',
+				title = COALESCE(NULLIF($2, ''), title),
+				size_bytes = COALESCE(NULLIF($3, 0), size_bytes),
+				expires_at = COALESCE($4, expires_at)
+			WHERE id = $1
+		`, req.MediaID, req.Title, req.SizeBytes, req.ExpiresAt)
+		if err != nil {
+			rlog.Error("failed to update media status", "error", err)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+		}
+		recordAudit(ctx, userData.UserID, auditMediaUploaded, req.MediaID, nil, mediaSnapshot(ctx, req.MediaID), nil)
+		publishStatus(ctx, ownerID, req.MediaID, "ready")
+		uploadsConfirmed.Inc("ready")
+
+		return &ConfirmUploadResponse{
+			MediaID: req.MediaID,
+			Status:  "ready",
+		}, nil
+	}
+
+	// Update status to 'queued' and optionally update title/size/packaging/preset
+	// (the requested packaging and preset are kept so retries produce the same output).
+	// The MediaUploaded event goes to the outbox in the same transaction, so
+	// queued media is always handed to processing.
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		rlog.Error("failed to begin transaction", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
 		UPDATE media 
 		SET status = 'queued',
 			title = COALESCE(NULLIF($2, ''), title),
-			size_bytes = COALESCE(NULLIF($3, 0), size_bytes)
+			size_bytes = COALESCE(NULLIF($3, 0), size_bytes),
+			packaging = COALESCE(NULLIF($4, ''), packaging),
+			preset = COALESCE(NULLIF($5, ''), preset),
+			audio_languages = COALESCE($6, audio_languages),
+			trim_start_seconds = COALESCE($7, trim_start_seconds),
+			trim_end_seconds = COALESCE($8, trim_end_seconds),
+			expires_at = COALESCE($9, expires_at)
 		WHERE id = $1
-	`, req.MediaID, req.Title, req.SizeBytes)
+	`, req.MediaID, req.Title, req.SizeBytes, req.Packaging, req.Preset, req.AudioLanguages,
+		req.TrimStart, req.TrimEnd, req.ExpiresAt)
 
 	if err != nil {
 		rlog.Error("failed to update media status", "error", err)
 		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
 	}
 
-	// Publish event to processing topic
-	_, err = MediaUploadedTopic.Publish(ctx, &MediaUploaded{
-		MediaID: req.MediaID,
-		S3Key:   s3Key,
-		OwnerID: ownerID,
+	outboxID, err := enqueue(ctx, tx, outboxMediaUploaded, &MediaUploaded{
+		MediaID:   req.MediaID,
+		S3Key:     s3Key,
+		OwnerID:   ownerID,
+		Packaging: req.Packaging,
+		Preset:    req.Preset,
 	})
-
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		rlog.Error("failed to publish media uploaded event", "error", err)
-		// Don't fail the request, processing can be retried
+		rlog.Error("failed to queue media", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
 	}
+	publishNow(ctx, outboxID)
+	recordAudit(ctx, userData.UserID, auditMediaUploaded, req.MediaID, nil, mediaSnapshot(ctx, req.MediaID), nil)
+	publishStatus(ctx, ownerID, req.MediaID, "queued")
+	uploadsConfirmed.Inc("queued")
 
 	return &ConfirmUploadResponse{
 		MediaID: req.MediaID,
@@ -218,15 +476,19 @@ type UpdateTagsResponse struct {
 func UpdateTags(ctx context.Context, id string, req *UpdateTagsRequest) (*UpdateTagsResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
-	// Verify ownership
+	// Verify the caller may edit the media
 	var ownerID int64
-	err := db.QueryRow(ctx, `SELECT owner_id FROM media WHERE id = $1`, id).Scan(&ownerID)
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID)
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
 	}
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
 	}
+	before, _ := mediaTags(ctx, id)
 
 	// Add tags
 	for _, tagName := range req.AddTags {
@@ -256,14 +518,32 @@ func UpdateTags(ctx context.Context, id string, req *UpdateTagsRequest) (*Update
 		`, id, tagName)
 	}
 
-	// Get current tags
+	tags, err := mediaTags(ctx, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get tags").Err()
+	}
+	if !slices.Equal(before, tags) {
+		recordAudit(ctx, userData.UserID, auditMediaTagsUpdated, id,
+			map[string][]string{"tags": before}, map[string][]string{"tags": tags}, nil)
+		publishTags(ctx, ownerID, id, tags)
+	}
+
+	return &UpdateTagsResponse{
+		MediaID: id,
+		Tags:    tags,
+	}, nil
+}
+
+// mediaTags returns the tags of a media item by name
+func mediaTags(ctx context.Context, id string) ([]string, error) {
 	rows, err := db.Query(ctx, `
 		SELECT t.name FROM tags t
 		JOIN media_tags mt ON t.id = mt.tag_id
 		WHERE mt.media_id = $1
+		ORDER BY t.name
 	`, id)
 	if err != nil {
-		return nil, errs.B().Code(errs.Internal).Msg("failed to get tags").Err()
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -274,11 +554,7 @@ func UpdateTags(ctx context.Context, id string, req *UpdateTagsRequest) (*Update
 			tags = append(tags, name)
 		}
 	}
-
-	return &UpdateTagsResponse{
-		MediaID: id,
-		Tags:    tags,
-	}, nil
+	return tags, nil
 }
 
 // ListMediaRequest contains pagination and filter parameters
@@ -287,6 +563,11 @@ type ListMediaRequest struct {
 	PageSize int      `query:"page_size"`
 	Tags     []string `query:"tags"`
 	Status   string   `query:"status"`
+	// TeamID lists a team's media instead of the caller's own
+	TeamID string `query:"team_id"`
+	// URLTTLSeconds overrides the lifetime of the preview and thumbnail
+	// URLs (300 to 604800 seconds)
+	URLTTLSeconds int `query:"url_ttl_seconds"`
 }
 
 // MediaItem represents a media item in the list
@@ -299,7 +580,11 @@ type MediaItem struct {
 	DurationSeconds  int       `json:"duration_seconds"`
 	Status           string    `json:"status"`
 	Tags             []string  `json:"tags"`
+	PreviewURL       string    `json:"preview_url,omitempty"`
+	ThumbnailURL     string    `json:"thumbnail_url,omitempty"`
 	CreatedAt        time.Time `json:"created_at"`
+	// ExpiresAt is when the media is trashed or deleted, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // ListMediaResponse contains paginated media items
@@ -327,25 +612,35 @@ func ListMedia(ctx context.Context, req *ListMediaRequest) (*ListMediaResponse,
 	}
 	offset := (page - 1) * pageSize
 
+	// The caller's own media is what they uploaded outside of teams; trashed
+	// media is listed by GET /media-trash
+	scope := "m.owner_id = $1 AND m.team_id IS NULL AND m.trashed_at IS NULL"
+	args := []interface{}{userData.UserID}
+	if req.TeamID != "" {
+		if err := requireTeamRole(ctx, userData.UserID, req.TeamID, team.RoleViewer); err != nil {
+			return nil, err
+		}
+		scope = "m.team_id = $1 AND m.trashed_at IS NULL"
+		args = []interface{}{req.TeamID}
+	}
+
 	// Build query
 	query := `
 		SELECT DISTINCT m.id, m.title, m.original_filename, m.mime_type, 
 			   COALESCE(m.size_bytes, 0), COALESCE(m.duration_seconds, 0), 
-			   m.status, m.created_at
+			   m.status, m.created_at, COALESCE(m.s3_key_preview, ''), COALESCE(m.s3_key_thumbnail, ''),
+			   m.expires_at
 		FROM media m
 		LEFT JOIN media_tags mt ON m.id = mt.media_id
 		LEFT JOIN tags t ON mt.tag_id = t.id
-		WHERE m.owner_id = $1
-	`
+		WHERE ` + scope
 	countQuery := `
 		SELECT COUNT(DISTINCT m.id)
 		FROM media m
 		LEFT JOIN media_tags mt ON m.id = mt.media_id
 		LEFT JOIN tags t ON mt.tag_id = t.id
-		WHERE m.owner_id = $1
-	`
+		WHERE ` + scope
 
-	args := []interface{}{userData.UserID}
 	argIndex := 2
 
 	if req.Status != "" {
@@ -383,13 +678,37 @@ func ListMedia(ctx context.Context, req *ListMediaRequest) (*ListMediaResponse,
 	defer rows.Close()
 
 	var items []MediaItem
+	client, _ := getMinioClient()
+	ttl, err := urlTTL(ctx, userData.UserID, req.URLTTLSeconds)
+	if err != nil {
+		return nil, err
+	}
+
 	for rows.Next() {
 		var item MediaItem
+		var s3KeyPreview, s3KeyThumbnail string
 		if err := rows.Scan(&item.ID, &item.Title, &item.OriginalFilename, &item.MimeType,
-			&item.SizeBytes, &item.DurationSeconds, &item.Status, &item.CreatedAt); err != nil {
+			&item.SizeBytes, &item.DurationSeconds, &item.Status, &item.CreatedAt,
+			&s3KeyPreview, &s3KeyThumbnail, &item.ExpiresAt); err != nil {
 			continue
 		}
 
+		// Generate thumbnail URL (image thumbnail or video poster)
+		if s3KeyThumbnail != "" && client != nil {
+			thumbnailURL, err := objectstore.PlaybackURL(ctx, client, s3KeyThumbnail, ttl)
+			if err == nil {
+				item.ThumbnailURL = thumbnailURL.String()
+			}
+		}
+
+		// Generate preview URL for hover previews
+		if s3KeyPreview != "" && client != nil {
+			previewURL, err := objectstore.PlaybackURL(ctx, client, s3KeyPreview, ttl)
+			if err == nil {
+				item.PreviewURL = previewURL.String()
+			}
+		}
+
 		// Get tags for this media
 		tagRows, err := db.Query(ctx, `
 			SELECT t.name FROM tags t
@@ -421,45 +740,107 @@ func ListMedia(ctx context.Context, req *ListMediaRequest) (*ListMediaResponse,
 	}, nil
 }
 
+// AudioTrack describes an audio track of the processed rendition
+type AudioTrack struct {
+	Index    int    `json:"index"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	Default  bool   `json:"default"`
+}
+
 // GetMediaRequest is empty as ID comes from path
 type GetMediaResponse struct {
-	ID               string    `json:"id"`
-	Title            string    `json:"title"`
-	OriginalFilename string    `json:"original_filename"`
-	MimeType         string    `json:"mime_type"`
-	SizeBytes        int64     `json:"size_bytes"`
-	DurationSeconds  int       `json:"duration_seconds"`
-	Status           string    `json:"status"`
-	Tags             []string  `json:"tags"`
-	StreamURL        string    `json:"stream_url,omitempty"`
-	CreatedAt        time.Time `json:"created_at"`
+	ID               string       `json:"id"`
+	Title            string       `json:"title"`
+	OriginalFilename string       `json:"original_filename"`
+	MimeType         string       `json:"mime_type"`
+	SizeBytes        int64        `json:"size_bytes"`
+	DurationSeconds  int          `json:"duration_seconds"`
+	Status           string       `json:"status"`
+	Tags             []string     `json:"tags"`
+	Packaging        string       `json:"packaging,omitempty"`
+	Preset           string       `json:"preset,omitempty"`
+	Width            int          `json:"width,omitempty"`
+	Height           int          `json:"height,omitempty"`
+	ThumbnailURL     string       `json:"thumbnail_url,omitempty"`
+	PosterTimestamp  *float64     `json:"poster_timestamp,omitempty"`
+	AudioTracks      []AudioTrack `json:"audio_tracks,omitempty"`
+	StreamURL        string       `json:"stream_url,omitempty"`
+	SpriteURL        string       `json:"sprite_url,omitempty"`
+	ThumbnailsVTTURL string       `json:"thumbnails_vtt_url,omitempty"`
+	// ChecksumSHA256 is the SHA-256 of the processed file (of the manifest for DASH)
+	ChecksumSHA256 string `json:"checksum_sha256,omitempty"`
+	// SourceMediaID is set for clips and extracted audio and links to the
+	// media they were derived from
+	SourceMediaID    string   `json:"source_media_id,omitempty"`
+	ClipStartSeconds *float64 `json:"clip_start_seconds,omitempty"`
+	ClipEndSeconds   *float64 `json:"clip_end_seconds,omitempty"`
+	// TeamID is set for media in a team
+	TeamID string `json:"team_id,omitempty"`
+	// StorageTier is where the original is: "hot", "cold" or "restoring"
+	StorageTier string `json:"storage_tier"`
+	// EgressLimited is set when no stream URL was issued because the owner
+	// reached the monthly egress limit
+	EgressLimited bool      `json:"egress_limited,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	// PublishAt is set while the media is scheduled to be published
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// ExpiresAt is when the media is trashed or deleted, if ever
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// GetMediaRequest optionally sets the lifetime of the returned URLs
+type GetMediaRequest struct {
+	// URLTTLSeconds overrides the caller's presign_ttl_seconds for this
+	// response (300 to 604800 seconds)
+	URLTTLSeconds int `query:"url_ttl_seconds"`
 }
 
 // GetMedia returns details for a specific media item including stream URL
 //
 //encore:api auth method=GET path=/media/:id
-func GetMedia(ctx context.Context, id string) (*GetMediaResponse, error) {
+func GetMedia(ctx context.Context, id string, req *GetMediaRequest) (*GetMediaResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
+	ttl, err := urlTTL(ctx, userData.UserID, req.URLTTLSeconds)
+	if err != nil {
+		return nil, err
+	}
 
 	var resp GetMediaResponse
-	var s3KeyOriginal, s3KeyProcessed string
+	var s3KeyOriginal, s3KeyProcessed, s3KeySprite, s3KeyThumbnailsVTT, s3KeyThumbnail string
+	var audioTracks string
 	var ownerID int64
 
-	err := db.QueryRow(ctx, `
+	err = db.QueryRow(ctx, `
 		SELECT id, COALESCE(title, ''), COALESCE(original_filename, ''), COALESCE(mime_type, ''),
 			   COALESCE(size_bytes, 0), COALESCE(duration_seconds, 0), status, created_at,
-			   owner_id, s3_key_original, COALESCE(s3_key_processed, '')
-		FROM media WHERE id = $1
+			   owner_id, s3_key_original, COALESCE(s3_key_processed, ''), COALESCE(packaging, ''),
+			   COALESCE(preset, ''), COALESCE(s3_key_sprite, ''), COALESCE(s3_key_thumbnails_vtt, ''),
+			   COALESCE(width, 0), COALESCE(height, 0), COALESCE(s3_key_thumbnail, ''),
+			   COALESCE(audio_tracks::text, ''), poster_timestamp, COALESCE(source_media_id::text, ''),
+			   clip_start_seconds, clip_end_seconds, COALESCE(processed_sha256, ''),
+			   COALESCE(team_id::text, ''), storage_tier, publish_at, expires_at
+		FROM media WHERE id = $1 AND trashed_at IS NULL
 	`, id).Scan(&resp.ID, &resp.Title, &resp.OriginalFilename, &resp.MimeType,
 		&resp.SizeBytes, &resp.DurationSeconds, &resp.Status, &resp.CreatedAt,
-		&ownerID, &s3KeyOriginal, &s3KeyProcessed)
+		&ownerID, &s3KeyOriginal, &s3KeyProcessed, &resp.Packaging, &resp.Preset,
+		&s3KeySprite, &s3KeyThumbnailsVTT, &resp.Width, &resp.Height, &s3KeyThumbnail,
+		&audioTracks, &resp.PosterTimestamp, &resp.SourceMediaID,
+		&resp.ClipStartSeconds, &resp.ClipEndSeconds, &resp.ChecksumSHA256, &resp.TeamID, &resp.StorageTier,
+		&resp.PublishAt, &resp.ExpiresAt)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
 	}
 
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, resp.TeamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	if audioTracks != "" {
+		_ = json.Unmarshal([]byte(audioTracks), &resp.AudioTracks)
 	}
 
 	// Get tags
@@ -478,7 +859,7 @@ func GetMedia(ctx context.Context, id string) (*GetMediaResponse, error) {
 		tagRows.Close()
 	}
 
-	// Generate presigned URL for streaming if ready
+	// Generate URLs for streaming and scrub previews if ready
 	if resp.Status == "ready" {
 		client, err := getMinioClient()
 		if err == nil {
@@ -486,9 +867,31 @@ func GetMedia(ctx context.Context, id string) (*GetMediaResponse, error) {
 			if s3Key == "" {
 				s3Key = s3KeyOriginal
 			}
-			streamURL, err := client.PresignedGetObject(ctx, getS3Bucket(), s3Key, 4*time.Hour, nil)
-			if err == nil {
+
+			if checkEgress(ctx, ownerID) != nil {
+				resp.EgressLimited = true
+			} else if resp.Packaging == "dash" {
+				// DASH packages are served through the manifest endpoint, which
+				// presigns every segment reference
+				resp.StreamURL = "/media/" + id + "/manifest.mpd"
+			} else if streamURL, err := objectstore.PlaybackURL(ctx, client, s3Key, ttl); err == nil {
 				resp.StreamURL = streamURL.String()
+				recordPresignedEgress(ctx, userViewer(userData.UserID), ttl, id)
+			}
+
+			if s3KeyThumbnail != "" {
+				thumbnailURL, err := objectstore.PlaybackURL(ctx, client, s3KeyThumbnail, ttl)
+				if err == nil {
+					resp.ThumbnailURL = thumbnailURL.String()
+				}
+			}
+
+			if s3KeySprite != "" && s3KeyThumbnailsVTT != "" {
+				spriteURL, err := objectstore.PlaybackURL(ctx, client, s3KeySprite, ttl)
+				if err == nil {
+					resp.SpriteURL = spriteURL.String()
+					resp.ThumbnailsVTTURL = "/media/" + id + "/thumbnails.vtt"
+				}
 			}
 		}
 	}
@@ -507,36 +910,113 @@ type DeleteMediaResponse struct {
 func DeleteMedia(ctx context.Context, id string) (*DeleteMediaResponse, error) {
 	userData := auth.Data().(*authpkg.UserData)
 
-	// Verify ownership and get S3 keys
+	// Verify the caller may delete the media and get S3 keys
 	var ownerID int64
-	var s3KeyOriginal, s3KeyProcessed string
+	var teamID, s3KeyOriginal, s3KeyProcessed string
 	err := db.QueryRow(ctx, `
-		SELECT owner_id, s3_key_original, COALESCE(s3_key_processed, '')
+		SELECT owner_id, COALESCE(team_id::text, ''), s3_key_original, COALESCE(s3_key_processed, '')
 		FROM media WHERE id = $1
-	`, id).Scan(&ownerID, &s3KeyOriginal, &s3KeyProcessed)
+	`, id).Scan(&ownerID, &teamID, &s3KeyOriginal, &s3KeyProcessed)
 
 	if err != nil {
 		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
 	}
 
-	if ownerID != userData.UserID {
-		return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	before := mediaSnapshot(ctx, id)
+
+	deleted, err := deleteMedia(ctx, id, ownerID, s3KeyOriginal, s3KeyProcessed, "")
+	if err != nil {
+		rlog.Error("failed to delete media", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete media").Err()
+	}
+	if !deleted {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaDeleted, id, before, nil, nil)
+	publishStatus(ctx, ownerID, id, "deleted")
+	if teamID != "" {
+		reportTeamStorage(ctx, teamID)
+	}
+
+	return &DeleteMediaResponse{Success: true}, nil
+}
+
+// deleteMedia deletes a media item's row (cascade will remove media_tags)
+// and then its S3 objects, announcing the deletion through the outbox.
+// onlyIf is an SQL condition the media row must still meet, e.g. that it is
+// still expired; when it doesn't, nothing is deleted and deleteMedia
+// reports false.
+func deleteMedia(ctx context.Context, id string, ownerID int64, s3KeyOriginal, s3KeyProcessed, onlyIf string) (bool, error) {
+	if onlyIf == "" {
+		onlyIf = "TRUE"
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The row lock keeps the condition true until the deletion commits
+	var found bool
+	err = tx.QueryRow(ctx, `SELECT TRUE FROM media WHERE id = $1 AND (`+onlyIf+`) FOR UPDATE`, id).Scan(&found)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := releaseOriginal(ctx, tx, id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM media WHERE id = $1`, id); err != nil {
+		return false, err
+	}
+	outboxID, err := enqueue(ctx, tx, outboxMediaDeleted, &MediaDeleted{MediaID: id, OwnerID: ownerID})
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
 	}
+	publishNow(ctx, outboxID)
 
-	// Delete from S3
 	client, err := getMinioClient()
 	if err == nil {
-		_ = client.RemoveObject(ctx, getS3Bucket(), s3KeyOriginal, minio.RemoveObjectOptions{})
-		if s3KeyProcessed != "" {
-			_ = client.RemoveObject(ctx, getS3Bucket(), s3KeyProcessed, minio.RemoveObjectOptions{})
-		}
+		removeMediaObjects(ctx, client, id, s3KeyOriginal, s3KeyProcessed)
 	}
+	return true, nil
+}
 
-	// Delete from database (cascade will remove media_tags)
-	_, err = db.Exec(ctx, `DELETE FROM media WHERE id = $1`, id)
-	if err != nil {
-		return nil, errs.B().Code(errs.Internal).Msg("failed to delete media").Err()
+// removeMediaObjects deletes the original, the processed file and every
+// derived object of a media item, ignoring errors
+func removeMediaObjects(ctx context.Context, client *minio.Client, id, s3KeyOriginal, s3KeyProcessed string) {
+	// Blobs may be shared and are removed once nothing references them
+	if !isBlobKey(s3KeyOriginal) {
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), s3KeyOriginal, minio.RemoveObjectOptions{})
+		if coldBucket := objectstore.ColdBucket(); coldBucket != "" {
+			_ = client.RemoveObject(ctx, coldBucket, s3KeyOriginal, minio.RemoveObjectOptions{})
+		}
+	}
+	if s3KeyProcessed != "" {
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), s3KeyProcessed, minio.RemoveObjectOptions{})
 	}
+	// Derived files (DASH segments, scrub previews) live under per-media prefixes
+	removePrefix(ctx, client, "processed/"+id+"/")
+	removePrefix(ctx, client, "thumbnails/"+id+"/")
+	removePrefix(ctx, client, "derived/"+id+"/")
+	removePrefix(ctx, client, "renditions/"+id+"/")
+	_ = client.RemoveObject(ctx, objectstore.Bucket(), "previews/"+id+".webm", minio.RemoveObjectOptions{})
+}
 
-	return &DeleteMediaResponse{Success: true}, nil
+// removePrefix deletes every object under the given prefix, ignoring errors
+func removePrefix(ctx context.Context, client *minio.Client, prefix string) {
+	for object := range client.ListObjects(ctx, objectstore.Bucket(), minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			continue
+		}
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), object.Key, minio.RemoveObjectOptions{})
+	}
 }
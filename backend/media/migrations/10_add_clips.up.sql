@@ -0,0 +1,7 @@
+-- Clips are media items cut from a segment of another media item
+ALTER TABLE media ADD COLUMN source_media_id UUID REFERENCES media(id) ON DELETE SET NULL;
+ALTER TABLE media ADD COLUMN clip_start_seconds DOUBLE PRECISION;
+ALTER TABLE media ADD COLUMN clip_end_seconds DOUBLE PRECISION;
+ALTER TABLE media ADD COLUMN clip_reencode BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX idx_media_source ON media(source_media_id);
@@ -0,0 +1,3 @@
+-- Range of the upload kept by processing (trim-on-upload)
+ALTER TABLE media ADD COLUMN trim_start_seconds DOUBLE PRECISION;
+ALTER TABLE media ADD COLUMN trim_end_seconds DOUBLE PRECISION;
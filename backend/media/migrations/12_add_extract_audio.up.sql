@@ -0,0 +1,2 @@
+-- Audio-only media items extracted from a video (source_media_id)
+ALTER TABLE media ADD COLUMN extract_audio BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+-- SHA-256 of the processed rendition (of the manifest for DASH)
+ALTER TABLE media ADD COLUMN processed_sha256 TEXT;
@@ -0,0 +1,13 @@
+-- Additional qualities generated on demand the first time a client asks for them
+CREATE TABLE media_renditions (
+    media_id UUID NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+    height INTEGER NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, ready, failed
+    s3_key TEXT,
+    size_bytes BIGINT,
+    error_message TEXT,
+    requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    last_accessed_at TIMESTAMP,
+    PRIMARY KEY (media_id, height)
+);
@@ -0,0 +1,23 @@
+-- Storage usage taken daily from a listing of the bucket, for capacity planning
+CREATE TABLE storage_snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    taken_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    bucket_bytes BIGINT NOT NULL,
+    object_count BIGINT NOT NULL,
+    recorded_bytes BIGINT NOT NULL, -- sum of media.size_bytes, what quotas count
+    orphaned_bytes BIGINT NOT NULL, -- objects of media that no longer exists
+    by_prefix JSONB NOT NULL
+);
+
+CREATE INDEX idx_storage_snapshots_taken_at ON storage_snapshots(taken_at);
+
+CREATE TABLE storage_snapshot_users (
+    snapshot_id BIGINT NOT NULL REFERENCES storage_snapshots(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL,
+    bucket_bytes BIGINT NOT NULL,
+    object_count BIGINT NOT NULL,
+    recorded_bytes BIGINT NOT NULL,
+    PRIMARY KEY (snapshot_id, user_id)
+);
+
+CREATE INDEX idx_storage_snapshot_users_user ON storage_snapshot_users(user_id);
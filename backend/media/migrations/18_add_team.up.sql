@@ -0,0 +1,4 @@
+-- Media of a team belongs to the team; owner_id stays the uploader
+ALTER TABLE media ADD COLUMN team_id UUID;
+
+CREATE INDEX idx_media_team ON media(team_id, created_at DESC) WHERE team_id IS NOT NULL;
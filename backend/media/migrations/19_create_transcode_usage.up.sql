@@ -0,0 +1,13 @@
+-- Minutes of media transcoded, recorded by the processing service when a
+-- transcode finishes, for monthly team limits
+CREATE TABLE transcode_usage (
+    id BIGSERIAL PRIMARY KEY,
+    media_id UUID NOT NULL,
+    -- NULL once the uploader deleted their account
+    owner_id BIGINT,
+    team_id UUID,
+    seconds BIGINT NOT NULL,
+    recorded_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_transcode_usage_team ON transcode_usage(team_id, recorded_at) WHERE team_id IS NOT NULL;
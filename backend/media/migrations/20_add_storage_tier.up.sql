@@ -0,0 +1,10 @@
+-- Originals idle for long enough move to the cold storage bucket until a
+-- restore brings them back; original_used_at is when processing, a download
+-- or a restore last needed the original
+ALTER TABLE media
+    ADD COLUMN storage_tier TEXT NOT NULL DEFAULT 'hot' CHECK (storage_tier IN ('hot', 'cold', 'restoring')),
+    ADD COLUMN original_used_at TIMESTAMP,
+    ADD COLUMN tiered_at TIMESTAMP;
+
+CREATE INDEX idx_media_tiering ON media(COALESCE(original_used_at, created_at))
+    WHERE storage_tier = 'hot' AND status = 'ready';
@@ -0,0 +1,18 @@
+-- Originals stored once by content: media with the same SHA-256 point at
+-- one blob, which is removed once ref_count has been 0 for a while
+CREATE TABLE blobs (
+    sha256 TEXT PRIMARY KEY,
+    s3_key TEXT NOT NULL UNIQUE,
+    size_bytes BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    released_at TIMESTAMP
+);
+
+CREATE INDEX idx_blobs_released ON blobs(released_at) WHERE ref_count = 0;
+
+-- original_sha256 is set once the original was hashed, whether or not it
+-- moved to a blob
+ALTER TABLE media ADD COLUMN original_sha256 TEXT;
+
+CREATE INDEX idx_media_original_sha256 ON media(original_sha256);
@@ -0,0 +1,7 @@
+-- Progress of uploads still in flight, as reported by the uploading client;
+-- upload_expires_at is when the upload URL stops being accepted
+ALTER TABLE media
+    ADD COLUMN upload_bytes BIGINT,
+    ADD COLUMN upload_total_bytes BIGINT,
+    ADD COLUMN upload_progress_at TIMESTAMP,
+    ADD COLUMN upload_expires_at TIMESTAMP;
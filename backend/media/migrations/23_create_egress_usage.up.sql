@@ -0,0 +1,19 @@
+-- Bytes served of each owner's media, for monthly egress reports and caps.
+-- Presigned URLs count the media's size once per viewer per URL lifetime;
+-- proxied downloads count the bytes actually sent.
+CREATE TABLE egress_usage (
+    id BIGSERIAL PRIMARY KEY,
+    media_id UUID NOT NULL,
+    -- NULL once the owner deleted their account
+    owner_id BIGINT,
+    team_id UUID,
+    source TEXT NOT NULL CHECK (source IN ('presigned', 'proxy')),
+    -- Who the bytes went to: user:<id>, ip:<address> or empty when unknown
+    viewer TEXT NOT NULL DEFAULT '',
+    bytes BIGINT NOT NULL,
+    recorded_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_egress_usage_owner ON egress_usage(owner_id, recorded_at);
+CREATE INDEX idx_egress_usage_viewer ON egress_usage(media_id, viewer, recorded_at) WHERE source = 'presigned';
+CREATE INDEX idx_egress_usage_recorded ON egress_usage(recorded_at);
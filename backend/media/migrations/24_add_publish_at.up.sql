@@ -0,0 +1,5 @@
+-- Scheduled publishing: media stays hidden from collection viewers until
+-- publish_at, when the media-scheduled-publish job clears it
+ALTER TABLE media ADD COLUMN publish_at TIMESTAMP;
+
+CREATE INDEX idx_media_publish_at ON media (publish_at) WHERE publish_at IS NOT NULL;
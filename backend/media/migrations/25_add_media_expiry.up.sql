@@ -0,0 +1,7 @@
+-- Auto-expiration: the media-expiry job trashes or deletes media once
+-- expires_at passes; trashed_at is set while media is in the trash
+ALTER TABLE media ADD COLUMN expires_at TIMESTAMP;
+ALTER TABLE media ADD COLUMN trashed_at TIMESTAMP;
+
+CREATE INDEX idx_media_expires_at ON media (expires_at) WHERE expires_at IS NOT NULL AND trashed_at IS NULL;
+CREATE INDEX idx_media_trashed_at ON media (owner_id, trashed_at) WHERE trashed_at IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Tag-driven retention: the media-retention job deletes, trashes or moves
+-- to cold storage a user's media carrying tag once it is after_days old
+CREATE TABLE retention_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    owner_id BIGINT NOT NULL,
+    tag TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('delete', 'trash', 'cold_storage')),
+    after_days INTEGER NOT NULL CHECK (after_days BETWEEN 1 AND 3650),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (owner_id, tag, action)
+);
+
+-- Media restored from the trash is left alone by retention rules
+ALTER TABLE media ADD COLUMN retention_exempt BOOLEAN NOT NULL DEFAULT FALSE;
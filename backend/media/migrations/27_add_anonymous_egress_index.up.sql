@@ -0,0 +1,3 @@
+-- Anonymous viewers are counted for a limited number of media per hour
+CREATE INDEX idx_egress_usage_anonymous ON egress_usage(viewer, recorded_at)
+    WHERE source = 'presigned' AND viewer LIKE 'ip:%';
@@ -0,0 +1,2 @@
+-- Packaging target of the processed rendition (NULL until processed or for non-video files)
+ALTER TABLE media ADD COLUMN packaging TEXT CHECK (packaging IN ('mp4', 'dash'));
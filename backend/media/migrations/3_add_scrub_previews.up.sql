@@ -0,0 +1,3 @@
+-- Sprite sheet and WebVTT used by players for hover/scrub previews
+ALTER TABLE media ADD COLUMN s3_key_sprite TEXT;
+ALTER TABLE media ADD COLUMN s3_key_thumbnails_vtt TEXT;
@@ -0,0 +1,2 @@
+-- Short muted preview clip shown on hover in the library grid
+ALTER TABLE media ADD COLUMN s3_key_preview TEXT;
@@ -0,0 +1,2 @@
+-- Transcode preset requested for (or used by) the processed rendition
+ALTER TABLE media ADD COLUMN preset TEXT;
@@ -0,0 +1,4 @@
+-- Dimensions and thumbnail of processed images
+ALTER TABLE media ADD COLUMN width INT;
+ALTER TABLE media ADD COLUMN height INT;
+ALTER TABLE media ADD COLUMN s3_key_thumbnail TEXT;
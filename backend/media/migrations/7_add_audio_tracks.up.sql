@@ -0,0 +1,3 @@
+-- Requested audio languages (empty keeps every track) and the tracks kept in the processed rendition
+ALTER TABLE media ADD COLUMN audio_languages TEXT[];
+ALTER TABLE media ADD COLUMN audio_tracks JSONB;
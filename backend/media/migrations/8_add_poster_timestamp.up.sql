@@ -0,0 +1,2 @@
+-- Timestamp of the video frame used as poster (stored as the media thumbnail)
+ALTER TABLE media ADD COLUMN poster_timestamp DOUBLE PRECISION;
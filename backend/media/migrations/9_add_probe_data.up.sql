@@ -0,0 +1,2 @@
+-- Complete ffprobe output (format and streams) of the original upload
+ALTER TABLE media ADD COLUMN probe_data JSONB;
@@ -0,0 +1,180 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Topics of outbox messages
+const (
+	outboxMediaUploaded  = "media-uploaded"
+	outboxMediaDeleted   = "media-deleted"
+	outboxMediaScheduled = "media-schedule-changed"
+	outboxMediaTrashed   = "media-trashed"
+)
+
+// outboxBatch is the most messages one relay run publishes
+const outboxBatch = 500
+
+// outboxRetention is how long sent messages are kept
+const outboxRetention = 7 * 24 * time.Hour
+
+// enqueue writes a message to the outbox in the transaction that makes the
+// change it announces, so the message exists exactly when the change does.
+// Call publishNow with the returned ID after committing to publish it right
+// away; the relay job publishes whatever that misses.
+func enqueue(ctx context.Context, tx *sqldb.Tx, topic string, msg any) (int64, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO outbox (topic, payload, created_at) VALUES ($1, $2, NOW())
+		RETURNING id
+	`, topic, payload).Scan(&id)
+	return id, err
+}
+
+// The relay job publishes messages whose immediate publish failed
+var _ = cron.NewJob("media-outbox-relay", cron.JobConfig{
+	Title:    "Publish pending outbox messages",
+	Every:    1 * cron.Minute,
+	Endpoint: RelayOutbox,
+})
+
+// RelayOutboxResponse reports what the relay did
+type RelayOutboxResponse struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+// RelayOutbox publishes pending outbox messages, oldest first, and removes
+// sent messages older than a week
+//
+//encore:api private
+func RelayOutbox(ctx context.Context) (*RelayOutboxResponse, error) {
+	resp, err := relayOutbox(ctx, nil)
+	if err != nil {
+		rlog.Error("failed to relay outbox", "error", err)
+		return nil, err
+	}
+	if resp.Failed > 0 {
+		rlog.Warn("outbox messages not published", "failed", resp.Failed, "sent", resp.Sent)
+	}
+
+	_, err = db.Exec(ctx, `
+		DELETE FROM outbox WHERE sent_at < $1
+	`, time.Now().Add(-outboxRetention))
+	if err != nil {
+		rlog.Warn("failed to remove sent outbox messages", "error", err)
+	}
+	return resp, nil
+}
+
+// relayOutbox publishes the pending messages with the given IDs, or every
+// pending message when ids is nil. Rows are locked while they are
+// published, so the relay job and a request never publish the same message.
+func relayOutbox(ctx context.Context, ids []int64) (*RelayOutboxResponse, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, topic, payload FROM outbox
+		WHERE sent_at IS NULL AND ($1::bigint[] IS NULL OR id = ANY($1))
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, ids, outboxBatch)
+	if err != nil {
+		return nil, err
+	}
+	type pending struct {
+		id      int64
+		topic   string
+		payload []byte
+	}
+	var messages []pending
+	for rows.Next() {
+		var m pending
+		if err := rows.Scan(&m.id, &m.topic, &m.payload); err == nil {
+			messages = append(messages, m)
+		}
+	}
+	rows.Close()
+
+	resp := &RelayOutboxResponse{}
+	for _, m := range messages {
+		if err := publishOutboxMessage(ctx, m.topic, m.payload); err != nil {
+			rlog.Error("failed to publish outbox message", "error", err, "outbox_id", m.id, "topic", m.topic)
+			_, _ = tx.Exec(ctx, `
+				UPDATE outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1
+			`, m.id, err.Error())
+			resp.Failed++
+			continue
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE outbox SET attempts = attempts + 1, last_error = NULL, sent_at = NOW() WHERE id = $1
+		`, m.id); err != nil {
+			return nil, err
+		}
+		resp.Sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// publishOutboxMessage publishes a message to its topic
+func publishOutboxMessage(ctx context.Context, topic string, payload []byte) error {
+	switch topic {
+	case outboxMediaUploaded:
+		var msg MediaUploaded
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return err
+		}
+		_, err := MediaUploadedTopic.Publish(ctx, &msg)
+		return err
+	case outboxMediaDeleted:
+		var msg MediaDeleted
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return err
+		}
+		_, err := MediaDeletedTopic.Publish(ctx, &msg)
+		return err
+	case outboxMediaScheduled:
+		var msg MediaScheduleChanged
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return err
+		}
+		_, err := MediaScheduleChangedTopic.Publish(ctx, &msg)
+		return err
+	case outboxMediaTrashed:
+		var msg MediaTrashed
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return err
+		}
+		_, err := MediaTrashedTopic.Publish(ctx, &msg)
+		return err
+	}
+	return fmt.Errorf("unknown outbox topic %q", topic)
+}
+
+// publishNow publishes an enqueued message right after its transaction
+// committed. A failure is only logged: the relay job retries it.
+func publishNow(ctx context.Context, outboxID int64) {
+	if _, err := relayOutbox(ctx, []int64{outboxID}); err != nil {
+		rlog.Warn("outbox message left to the relay job", "error", err, "outbox_id", outboxID)
+	}
+}
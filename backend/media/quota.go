@@ -0,0 +1,88 @@
+package media
+
+import (
+	"context"
+	"fmt"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// storageUsed returns the total size of a user's personal media (team media
+// counts against the team's limit), except one item
+func storageUsed(ctx context.Context, ownerID int64, exceptMediaID string) (int64, error) {
+	var used int64
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(size_bytes), 0) FROM media WHERE owner_id = $1 AND team_id IS NULL AND id::text <> $2
+	`, ownerID, exceptMediaID).Scan(&used)
+	return used, err
+}
+
+// checkStorageQuota rejects adding size bytes as media mediaID when it would
+// take the user over their storage quota (granted by their roles)
+func checkStorageQuota(ctx context.Context, userData *authpkg.UserData, mediaID string, size int64) error {
+	if userData.StorageQuotaBytes <= 0 {
+		return nil
+	}
+
+	used, err := storageUsed(ctx, userData.UserID, mediaID)
+	if err != nil {
+		rlog.Error("failed to compute storage usage", "error", err, "user_id", userData.UserID)
+		return errs.B().Code(errs.Internal).Msg("failed to check storage quota").Err()
+	}
+	if used+size > userData.StorageQuotaBytes || (size == 0 && used >= userData.StorageQuotaBytes) {
+		return errs.B().Code(errs.ResourceExhausted).
+			Msg(fmt.Sprintf("storage quota exceeded: %d of %d bytes used", used, userData.StorageQuotaBytes)).Err()
+	}
+	return nil
+}
+
+// checkDerivedQuota rejects creating objects derived from existing media,
+// like clips or renditions, once the team (teamID) or, for personal media,
+// the user is at its quota. Their size is only known after processing.
+func checkDerivedQuota(ctx context.Context, userData *authpkg.UserData, teamID string) error {
+	if teamID != "" {
+		return checkTeamQuota(ctx, teamID, "", 0)
+	}
+	return checkStorageQuota(ctx, userData, "", 0)
+}
+
+// CheckDerivedQuotaRequest names the media item objects are derived from
+type CheckDerivedQuotaRequest struct {
+	MediaID string `json:"media_id"`
+}
+
+// CheckDerivedQuota lets other services check the quota before they store
+// objects derived from a media item, counted against its team or, for
+// personal media, the calling user
+//
+//encore:api private
+func CheckDerivedQuota(ctx context.Context, req *CheckDerivedQuotaRequest) error {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var teamID string
+	err := db.QueryRow(ctx, `SELECT COALESCE(team_id::text, '') FROM media WHERE id::text = $1`, req.MediaID).Scan(&teamID)
+	if err != nil {
+		return errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	return checkDerivedQuota(ctx, userData, teamID)
+}
+
+// uploadedSize returns the size of an uploaded original as stored, falling
+// back to the size the client reported
+func uploadedSize(ctx context.Context, s3Key string, reported int64) int64 {
+	client, err := getMinioClient()
+	if err != nil {
+		return reported
+	}
+	info, err := client.StatObject(ctx, objectstore.Bucket(), s3Key, minio.StatObjectOptions{})
+	if err != nil {
+		return reported
+	}
+	return info.Size
+}
@@ -0,0 +1,128 @@
+package media
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// maxRelated is the most related media one request returns
+const maxRelated = 50
+
+// relatedQuery scores the other ready media of the source's library (its
+// team's, or else its owner's personal media) against the source
+// item $1 and returns the best $2. Each signal scores 0 to 1 and is
+// weighted: the share of the source's tags an item has counts three times,
+// how close its duration is and how close its upload time is (halving at 30
+// days apart) count once, and the same kind of media (video, audio, image)
+// counts half. Items sharing no tag that are also more than twice as long
+// or short and uploaded over 30 days apart are left out.
+const relatedQuery = `
+	WITH source AS (
+		SELECT id, owner_id, team_id, COALESCE(duration_seconds, 0) AS duration, created_at,
+			   split_part(COALESCE(mime_type, ''), '/', 1) AS kind,
+			   (SELECT COUNT(*) FROM media_tags WHERE media_id = $1) AS tag_count
+		FROM media WHERE id = $1
+	), scored AS (
+		SELECT m.*,
+			   (SELECT COUNT(*) FROM media_tags mt
+				WHERE mt.media_id = m.id AND mt.tag_id IN (SELECT tag_id FROM media_tags WHERE media_id = $1)
+			   )::float8 / GREATEST(s.tag_count, 1) AS tag_score,
+			   CASE WHEN s.duration > 0 AND COALESCE(m.duration_seconds, 0) > 0
+					THEN 1 - ABS(m.duration_seconds - s.duration)::float8 / GREATEST(m.duration_seconds, s.duration)
+					ELSE 0 END AS duration_score,
+			   1 / (1 + ABS(EXTRACT(EPOCH FROM m.created_at - s.created_at))::float8 / (30 * 86400)) AS time_score,
+			   CASE WHEN split_part(COALESCE(m.mime_type, ''), '/', 1) = s.kind THEN 1 ELSE 0 END AS kind_score
+		FROM media m, source s
+		WHERE m.id <> s.id AND m.status = 'ready'
+		  AND (m.team_id = s.team_id OR (s.team_id IS NULL AND m.team_id IS NULL AND m.owner_id = s.owner_id))
+	)
+	SELECT id, COALESCE(title, ''), COALESCE(original_filename, ''), COALESCE(mime_type, ''),
+		   COALESCE(size_bytes, 0), COALESCE(duration_seconds, 0), status, created_at,
+		   COALESCE(s3_key_preview, ''), COALESCE(s3_key_thumbnail, ''),
+		   ARRAY(SELECT t.name FROM tags t JOIN media_tags mt ON t.id = mt.tag_id WHERE mt.media_id = scored.id ORDER BY t.name),
+		   3 * tag_score + duration_score + time_score + 0.5 * kind_score AS score
+	FROM scored
+	WHERE tag_score > 0 OR duration_score > 0.5 OR time_score > 0.5
+	ORDER BY score DESC, created_at DESC
+	LIMIT $2`
+
+// RelatedMediaRequest limits the related media returned
+type RelatedMediaRequest struct {
+	Limit int `query:"limit"`
+}
+
+// RelatedMediaResponse contains the related media, most alike first
+type RelatedMediaResponse struct {
+	MediaID string      `json:"media_id"`
+	Items   []MediaItem `json:"items"`
+}
+
+// GetRelatedMedia returns the ready media of a media item's library most
+// like it, by shared tags, similar duration and close upload time, for
+// "more like this" rails
+//
+//encore:api auth method=GET path=/media/:id/related
+func GetRelatedMedia(ctx context.Context, id string, req *RelatedMediaRequest) (*RelatedMediaResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	limit := req.Limit
+	if limit < 1 || limit > maxRelated {
+		limit = 12
+	}
+
+	rows, err := db.Query(ctx, relatedQuery, id, limit)
+	if err != nil {
+		rlog.Error("failed to query related media", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to find related media").Err()
+	}
+	defer rows.Close()
+
+	resp := &RelatedMediaResponse{MediaID: id, Items: []MediaItem{}}
+	client, _ := getMinioClient()
+	ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+	for rows.Next() {
+		var item MediaItem
+		var s3KeyPreview, s3KeyThumbnail string
+		var score float64
+		if err := rows.Scan(&item.ID, &item.Title, &item.OriginalFilename, &item.MimeType,
+			&item.SizeBytes, &item.DurationSeconds, &item.Status, &item.CreatedAt,
+			&s3KeyPreview, &s3KeyThumbnail, &item.Tags, &score); err != nil {
+			continue
+		}
+		if item.Tags == nil {
+			item.Tags = []string{}
+		}
+
+		if s3KeyThumbnail != "" && client != nil {
+			if thumbnailURL, err := objectstore.PlaybackURL(ctx, client, s3KeyThumbnail, ttl); err == nil {
+				item.ThumbnailURL = thumbnailURL.String()
+			}
+		}
+		if s3KeyPreview != "" && client != nil {
+			if previewURL, err := objectstore.PlaybackURL(ctx, client, s3KeyPreview, ttl); err == nil {
+				item.PreviewURL = previewURL.String()
+			}
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, nil
+}
@@ -0,0 +1,408 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// Actions of retention rules
+const (
+	// retentionDelete deletes the media
+	retentionDelete = "delete"
+	// retentionTrash moves the media to the trash
+	retentionTrash = "trash"
+	// retentionColdStorage moves the original to cold storage
+	retentionColdStorage = "cold_storage"
+)
+
+// Retention limits
+const (
+	// maxRetentionRules is the most rules a user may have
+	maxRetentionRules = 20
+	// maxRetentionDays is the longest a rule may wait
+	maxRetentionDays = 3650
+	// retentionBatch is the most media of a user one run (or preview)
+	// handles
+	retentionBatch = 500
+)
+
+// RetentionRule applies an action to a user's media carrying a tag once
+// the media is old enough
+type RetentionRule struct {
+	ID     string `json:"id"`
+	Tag    string `json:"tag"`
+	Action string `json:"action"`
+	// AfterDays is the age of the media, in days since upload, at which the
+	// action applies; for cold_storage, in days since the original was last
+	// used
+	AfterDays int       `json:"after_days"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListRetentionRulesResponse contains the caller's retention rules
+type ListRetentionRulesResponse struct {
+	Rules []RetentionRule `json:"rules"`
+}
+
+// ListRetentionRules returns the caller's retention rules
+//
+//encore:api auth method=GET path=/retention-rules
+func ListRetentionRules(ctx context.Context) (*ListRetentionRulesResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rules, err := loadRetentionRules(ctx, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list retention rules").Err()
+	}
+	return &ListRetentionRulesResponse{Rules: rules}, nil
+}
+
+// CreateRetentionRuleRequest describes a new retention rule
+type CreateRetentionRuleRequest struct {
+	Tag string `json:"tag"`
+	// Action is "delete", "trash" or "cold_storage"
+	Action    string `json:"action"`
+	AfterDays int    `json:"after_days"`
+}
+
+// CreateRetentionRule adds a retention rule for the caller's own media,
+// applied by the hourly media-retention job
+//
+//encore:api auth method=POST path=/retention-rules
+func CreateRetentionRule(ctx context.Context, req *CreateRetentionRuleRequest) (*RetentionRule, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rule, err := validateRetentionRule(req.Tag, req.Action, req.AfterDays)
+	if err != nil {
+		return nil, err
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM retention_rules WHERE owner_id = $1`, userData.UserID).Scan(&count); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create retention rule").Err()
+	}
+	if count >= maxRetentionRules {
+		return nil, errs.B().Code(errs.ResourceExhausted).Msg("at most 20 retention rules are allowed").Err()
+	}
+
+	err = db.QueryRow(ctx, `
+		INSERT INTO retention_rules (owner_id, tag, action, after_days, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (owner_id, tag, action) DO NOTHING
+		RETURNING id::text, created_at
+	`, userData.UserID, rule.Tag, rule.Action, rule.AfterDays).Scan(&rule.ID, &rule.CreatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.AlreadyExists).Msg("a rule with this tag and action already exists").Err()
+	}
+	if err != nil {
+		rlog.Error("failed to create retention rule", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create retention rule").Err()
+	}
+	return &rule, nil
+}
+
+// DeleteRetentionRule removes one of the caller's retention rules
+//
+//encore:api auth method=DELETE path=/retention-rules/:id
+func DeleteRetentionRule(ctx context.Context, id string) (*ListRetentionRulesResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("retention rule not found").Err()
+	}
+	result, err := db.Exec(ctx, `DELETE FROM retention_rules WHERE id = $1 AND owner_id = $2`, id, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete retention rule").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.NotFound).Msg("retention rule not found").Err()
+	}
+	return ListRetentionRules(ctx)
+}
+
+// PreviewRetentionRequest optionally describes a rule to preview instead
+// of the caller's rules
+type PreviewRetentionRequest struct {
+	Tag       string `query:"tag"`
+	Action    string `query:"action"`
+	AfterDays int    `query:"after_days"`
+}
+
+// RetentionPreviewItem is media a retention rule would act on
+type RetentionPreviewItem struct {
+	MediaID   string    `json:"media_id"`
+	Title     string    `json:"title"`
+	Tag       string    `json:"tag"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PreviewRetentionResponse lists what the next run would do, oldest media
+// first
+type PreviewRetentionResponse struct {
+	Items []RetentionPreviewItem `json:"items"`
+	// Truncated is set when more media is due than one run handles
+	Truncated bool `json:"truncated"`
+}
+
+// PreviewRetention is a dry run of the caller's retention rules, or of the
+// rule given in the query: it lists the media the job would act on now
+// without changing anything
+//
+//encore:api auth method=GET path=/retention-rules/preview
+func PreviewRetention(ctx context.Context, req *PreviewRetentionRequest) (*PreviewRetentionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var rules []RetentionRule
+	if req.Tag != "" || req.Action != "" || req.AfterDays != 0 {
+		rule, err := validateRetentionRule(req.Tag, req.Action, req.AfterDays)
+		if err != nil {
+			return nil, err
+		}
+		rules = []RetentionRule{rule}
+	} else {
+		var err error
+		if rules, err = loadRetentionRules(ctx, userData.UserID); err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to load retention rules").Err()
+		}
+	}
+
+	due, err := dueRetention(ctx, userData.UserID, rules, retentionBatch+1)
+	if err != nil {
+		rlog.Error("failed to preview retention", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to preview retention").Err()
+	}
+	resp := &PreviewRetentionResponse{Items: []RetentionPreviewItem{}}
+	if len(due) > retentionBatch {
+		due = due[:retentionBatch]
+		resp.Truncated = true
+	}
+	for _, m := range due {
+		resp.Items = append(resp.Items, RetentionPreviewItem{
+			MediaID:   m.id,
+			Title:     m.title,
+			Tag:       m.tag,
+			Action:    m.action,
+			CreatedAt: m.createdAt,
+		})
+	}
+	return resp, nil
+}
+
+// validateRetentionRule checks and normalizes a rule's fields
+func validateRetentionRule(tag, action string, afterDays int) (RetentionRule, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return RetentionRule{}, errs.B().Code(errs.InvalidArgument).Msg("tag is required").Err()
+	}
+	if action != retentionDelete && action != retentionTrash && action != retentionColdStorage {
+		return RetentionRule{}, errs.B().Code(errs.InvalidArgument).
+			Msg("action must be 'delete', 'trash' or 'cold_storage'").Err()
+	}
+	if afterDays < 1 || afterDays > maxRetentionDays {
+		return RetentionRule{}, errs.B().Code(errs.InvalidArgument).Msg("after_days must be between 1 and 3650").Err()
+	}
+	return RetentionRule{Tag: tag, Action: action, AfterDays: afterDays}, nil
+}
+
+// loadRetentionRules returns a user's retention rules, oldest first
+func loadRetentionRules(ctx context.Context, ownerID int64) ([]RetentionRule, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id::text, tag, action, after_days, created_at FROM retention_rules
+		WHERE owner_id = $1
+		ORDER BY created_at, id
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []RetentionRule{}
+	for rows.Next() {
+		var r RetentionRule
+		if err := rows.Scan(&r.ID, &r.Tag, &r.Action, &r.AfterDays, &r.CreatedAt); err == nil {
+			rules = append(rules, r)
+		}
+	}
+	return rules, rows.Err()
+}
+
+// retentionMatch is media a retention rule applies to
+type retentionMatch struct {
+	mediaObjects
+	title     string
+	tag       string
+	action    string
+	createdAt time.Time
+}
+
+// dueRetention returns up to limit of the owner's media that the rules
+// apply to now, oldest first. Only the owner's own media outside of teams
+// is considered. Media matched by several rules gets the strongest action:
+// delete, then trash, then cold storage.
+func dueRetention(ctx context.Context, ownerID int64, rules []RetentionRule, limit int) ([]retentionMatch, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	tags := make([]string, len(rules))
+	actions := make([]string, len(rules))
+	days := make([]int, len(rules))
+	for i, r := range rules {
+		tags[i], actions[i], days[i] = r.Tag, r.Action, r.AfterDays
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, s3_key_original, s3_key_processed, title, tag, action, created_at FROM (
+			SELECT DISTINCT ON (m.id) m.id::text AS id, m.s3_key_original,
+				   COALESCE(m.s3_key_processed, '') AS s3_key_processed, COALESCE(m.title, '') AS title,
+				   r.tag, r.action, m.created_at
+			FROM unnest($2::text[], $3::text[], $4::int[]) AS r(tag, action, after_days)
+			JOIN tags t ON t.name = r.tag
+			JOIN media_tags mt ON mt.tag_id = t.id
+			JOIN media m ON m.id = mt.media_id
+			WHERE m.owner_id = $1 AND m.team_id IS NULL AND m.trashed_at IS NULL
+			  AND NOT m.retention_exempt AND m.status <> 'uploading'
+			  AND CASE WHEN r.action = 'cold_storage'
+				  THEN $5 AND `+coldEligible+`
+					   AND COALESCE(m.original_used_at, m.created_at) < NOW() - make_interval(days => r.after_days)
+				  ELSE m.created_at < NOW() - make_interval(days => r.after_days)
+			  END
+			ORDER BY m.id, array_position(ARRAY['delete', 'trash', 'cold_storage'], r.action)
+		) due
+		ORDER BY created_at, id
+		LIMIT $6
+	`, ownerID, tags, actions, days, objectstore.ColdBucket() != "", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []retentionMatch
+	for rows.Next() {
+		m := retentionMatch{mediaObjects: mediaObjects{ownerID: ownerID}}
+		if err := rows.Scan(&m.id, &m.s3KeyOriginal, &m.s3KeyProcessed, &m.title, &m.tag, &m.action,
+			&m.createdAt); err == nil {
+			due = append(due, m)
+		}
+	}
+	return due, rows.Err()
+}
+
+// Retention rules are applied hourly
+var _ = cron.NewJob("media-retention", cron.JobConfig{
+	Title:    "Apply retention rules",
+	Every:    1 * cron.Hour,
+	Endpoint: ApplyRetentionRules,
+})
+
+// ApplyRetentionRulesResponse reports what the retention job did
+type ApplyRetentionRulesResponse struct {
+	Deleted int `json:"deleted"`
+	Trashed int `json:"trashed"`
+	Moved   int `json:"moved"`
+	Failed  int `json:"failed"`
+}
+
+// ApplyRetentionRules deletes, trashes or moves to cold storage the media
+// every user's retention rules apply to, up to retentionBatch per user
+//
+//encore:api private
+func ApplyRetentionRules(ctx context.Context) (*ApplyRetentionRulesResponse, error) {
+	rows, err := db.Query(ctx, `SELECT DISTINCT owner_id FROM retention_rules`)
+	if err != nil {
+		return nil, err
+	}
+	var owners []int64
+	for rows.Next() {
+		var ownerID int64
+		if err := rows.Scan(&ownerID); err == nil {
+			owners = append(owners, ownerID)
+		}
+	}
+	rows.Close()
+
+	resp := &ApplyRetentionRulesResponse{}
+	var client *minio.Client
+	for _, ownerID := range owners {
+		rules, err := loadRetentionRules(ctx, ownerID)
+		if err != nil {
+			rlog.Error("failed to load retention rules", "error", err, "user_id", ownerID)
+			continue
+		}
+		// Originals used after this are not moved
+		checkedAt := time.Now()
+		due, err := dueRetention(ctx, ownerID, rules, retentionBatch)
+		if err != nil {
+			rlog.Error("failed to find media due for retention", "error", err, "user_id", ownerID)
+			continue
+		}
+
+		for _, m := range due {
+			details := map[string]string{"retention_tag": m.tag}
+			switch m.action {
+			case retentionDelete:
+				before := mediaSnapshot(ctx, m.id)
+				deleted, err := deleteMedia(ctx, m.id, ownerID, m.s3KeyOriginal, m.s3KeyProcessed,
+					"trashed_at IS NULL AND NOT retention_exempt")
+				if err != nil {
+					rlog.Error("failed to delete media by retention rule", "error", err, "media_id", m.id)
+					resp.Failed++
+					continue
+				}
+				if !deleted {
+					continue
+				}
+				recordAudit(ctx, ownerID, auditMediaDeleted, m.id, before, nil, details)
+				publishStatus(ctx, ownerID, m.id, "deleted")
+				resp.Deleted++
+			case retentionTrash:
+				before := mediaSnapshot(ctx, m.id)
+				trashed, err := trashMedia(ctx, m.id, ownerID, false)
+				if err != nil {
+					rlog.Error("failed to trash media by retention rule", "error", err, "media_id", m.id)
+					resp.Failed++
+					continue
+				}
+				if trashed {
+					recordAudit(ctx, ownerID, auditMediaTrashed, m.id, before, mediaSnapshot(ctx, m.id), details)
+					publishStatus(ctx, ownerID, m.id, "trashed")
+					resp.Trashed++
+				}
+			case retentionColdStorage:
+				if client == nil {
+					if client, err = getMinioClient(); err != nil {
+						return nil, err
+					}
+				}
+				moved, err := moveToColdStorage(ctx, client, m.id, m.s3KeyOriginal, checkedAt)
+				if err != nil {
+					rlog.Warn("failed to move original to cold storage", "error", err, "media_id", m.id)
+					resp.Failed++
+					continue
+				}
+				if moved {
+					resp.Moved++
+				}
+			}
+		}
+	}
+
+	if resp.Deleted > 0 || resp.Trashed > 0 || resp.Moved > 0 || resp.Failed > 0 {
+		rlog.Info("retention rules applied", "deleted", resp.Deleted, "trashed", resp.Trashed,
+			"moved", resp.Moved, "failed", resp.Failed)
+	}
+	return resp, nil
+}
@@ -0,0 +1,232 @@
+package media
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// maxScheduleAhead is how far ahead media can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// publishBatch is the most media one publishing run releases
+const publishBatch = 500
+
+// MediaScheduleChanged is published when media is scheduled, or published
+// by the schedule or by its owner
+type MediaScheduleChanged struct {
+	MediaID string `json:"media_id"`
+	OwnerID int64  `json:"owner_id"`
+	// PublishAt is when the media will be published; nil once it is
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// ChangedAt orders the changes of a media item
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// MediaScheduleChangedTopic tells other services which media is hidden
+// until it is published, so the collection service can leave it out for
+// viewers and announce it once it appears
+var MediaScheduleChangedTopic = pubsub.NewTopic[*MediaScheduleChanged]("media-schedule-changed", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// ScheduleMediaRequest sets when a media item is published
+type ScheduleMediaRequest struct {
+	PublishAt time.Time `json:"publish_at"`
+}
+
+// ScheduleMediaResponse is the media's schedule
+type ScheduleMediaResponse struct {
+	MediaID string `json:"media_id"`
+	// PublishAt is nil when the media is published
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+// ScheduleMedia hides a media item from collection viewers until
+// publish_at, when it appears in its collections and their followers are
+// told. Scheduling it again moves the time.
+//
+//encore:api auth method=PUT path=/media/:id/schedule
+func ScheduleMedia(ctx context.Context, id string, req *ScheduleMediaRequest) (*ScheduleMediaResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if !req.PublishAt.After(time.Now()) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("publish_at must be in the future").Err()
+	}
+	if req.PublishAt.After(time.Now().Add(maxScheduleAhead)) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("publish_at must be within a year").Err()
+	}
+	ownerID, err := authorizeEdit(ctx, userData.UserID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	before := mediaSnapshot(ctx, id)
+	publishAt := req.PublishAt.UTC()
+	if err := setPublishAt(ctx, id, ownerID, &publishAt); err != nil {
+		rlog.Error("failed to schedule media", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to schedule media").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaScheduled, id, before, mediaSnapshot(ctx, id), nil)
+	return &ScheduleMediaResponse{MediaID: id, PublishAt: &publishAt}, nil
+}
+
+// UnscheduleMedia publishes a scheduled media item right away
+//
+//encore:api auth method=DELETE path=/media/:id/schedule
+func UnscheduleMedia(ctx context.Context, id string) (*ScheduleMediaResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	ownerID, err := authorizeEdit(ctx, userData.UserID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var scheduled bool
+	if err := db.QueryRow(ctx, `SELECT publish_at IS NOT NULL FROM media WHERE id = $1`, id).Scan(&scheduled); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if !scheduled {
+		return &ScheduleMediaResponse{MediaID: id}, nil
+	}
+
+	before := mediaSnapshot(ctx, id)
+	if err := setPublishAt(ctx, id, ownerID, nil); err != nil {
+		rlog.Error("failed to publish media", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to publish media").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaPublished, id, before, mediaSnapshot(ctx, id), nil)
+	return &ScheduleMediaResponse{MediaID: id}, nil
+}
+
+// authorizeEdit checks that the user may change when the media is
+// published or expires and returns its owner. Trashed media is not found.
+func authorizeEdit(ctx context.Context, userID int64, mediaID string) (int64, error) {
+	var ownerID int64
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1 AND trashed_at IS NULL
+	`, mediaID).Scan(&ownerID, &teamID)
+	if err != nil {
+		return 0, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userID, ownerID, teamID, team.RoleEditor); err != nil {
+		return 0, err
+	}
+	return ownerID, nil
+}
+
+// setPublishAt changes when a media item is published, nil publishing it
+// now, and announces the change through the outbox
+func setPublishAt(ctx context.Context, mediaID string, ownerID int64, publishAt *time.Time) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, `UPDATE media SET publish_at = $2 WHERE id = $1`, mediaID, publishAt); err != nil {
+		return err
+	}
+	outboxID, err := enqueue(ctx, tx, outboxMediaScheduled, &MediaScheduleChanged{
+		MediaID:   mediaID,
+		OwnerID:   ownerID,
+		PublishAt: publishAt,
+		ChangedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishNow(ctx, outboxID)
+	return nil
+}
+
+// Scheduled media is published every minute
+var _ = cron.NewJob("media-scheduled-publish", cron.JobConfig{
+	Title:    "Publish scheduled media",
+	Every:    1 * cron.Minute,
+	Endpoint: PublishScheduledMedia,
+})
+
+// PublishScheduledMediaResponse reports how many media were published
+type PublishScheduledMediaResponse struct {
+	Published int `json:"published"`
+}
+
+// PublishScheduledMedia publishes media whose publish_at has passed.
+// Collections already show them from then on; this announces them.
+//
+//encore:api private
+func PublishScheduledMedia(ctx context.Context) (*PublishScheduledMediaResponse, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+		UPDATE media SET publish_at = NULL
+		WHERE id IN (
+			SELECT id FROM media WHERE publish_at <= NOW()
+			ORDER BY publish_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id::text, owner_id
+	`, publishBatch)
+	if err != nil {
+		return nil, err
+	}
+	type published struct {
+		mediaID string
+		ownerID int64
+	}
+	var due []published
+	for rows.Next() {
+		var p published
+		if err := rows.Scan(&p.mediaID, &p.ownerID); err == nil {
+			due = append(due, p)
+		}
+	}
+	rows.Close()
+
+	var outboxIDs []int64
+	for _, p := range due {
+		outboxID, err := enqueue(ctx, tx, outboxMediaScheduled, &MediaScheduleChanged{
+			MediaID:   p.mediaID,
+			OwnerID:   p.ownerID,
+			ChangedAt: time.Now(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		outboxIDs = append(outboxIDs, outboxID)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(outboxIDs) > 0 {
+		if _, err := relayOutbox(ctx, outboxIDs); err != nil {
+			rlog.Warn("outbox messages left to the relay job", "error", err, "count", len(outboxIDs))
+		}
+	}
+
+	for _, p := range due {
+		recordAudit(ctx, p.ownerID, auditMediaPublished, p.mediaID, nil, nil, map[string]string{"scheduled": "true"})
+	}
+	if len(due) > 0 {
+		rlog.Info("scheduled media published", "count", len(due))
+	}
+	return &PublishScheduledMediaResponse{Published: len(due)}, nil
+}
@@ -0,0 +1,431 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+)
+
+// storageSnapshotRetention is how long storage snapshots are kept
+const storageSnapshotRetention = 365 * 24 * time.Hour
+
+// PrefixUsage is what is stored under one top-level prefix of the bucket
+// (original, processed, thumbnails, ...)
+type PrefixUsage struct {
+	Prefix  string `json:"prefix"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+}
+
+// UserStorageUsage is what one user has stored
+type UserStorageUsage struct {
+	UserID      int64 `json:"user_id"`
+	BucketBytes int64 `json:"bucket_bytes"`
+	ObjectCount int64 `json:"object_count"`
+	// RecordedBytes is the size of the user's media as counted against
+	// their quota
+	RecordedBytes int64 `json:"recorded_bytes"`
+}
+
+// StorageSnapshot is the storage usage at one point in time
+type StorageSnapshot struct {
+	TakenAt     time.Time `json:"taken_at"`
+	BucketBytes int64     `json:"bucket_bytes"`
+	ObjectCount int64     `json:"object_count"`
+	// RecordedBytes is the size of all media as counted against quotas;
+	// originals, thumbnails and renditions come on top in the bucket
+	RecordedBytes int64 `json:"recorded_bytes"`
+	// OrphanedBytes are stored for media or users that no longer exist
+	OrphanedBytes int64         `json:"orphaned_bytes"`
+	ByPrefix      []PrefixUsage `json:"by_prefix"`
+}
+
+// StorageTrendPoint is the usage of one snapshot in a trend
+type StorageTrendPoint struct {
+	TakenAt       time.Time `json:"taken_at"`
+	BucketBytes   int64     `json:"bucket_bytes"`
+	ObjectCount   int64     `json:"object_count"`
+	RecordedBytes int64     `json:"recorded_bytes"`
+}
+
+// StorageUsageRequest selects the trend period and how many users to list
+type StorageUsageRequest struct {
+	// Days of trend, 30 by default and at most 365
+	Days int `query:"days"`
+	// Users is how many of the biggest users to list, 50 by default and at
+	// most 500
+	Users int `query:"users"`
+}
+
+// StorageUsageResponse contains the latest snapshot, its biggest users and
+// the trend over the period
+type StorageUsageResponse struct {
+	Latest *StorageSnapshot    `json:"latest"`
+	Users  []UserStorageUsage  `json:"users"`
+	Trend  []StorageTrendPoint `json:"trend"`
+}
+
+// GetStorageUsage reports the bytes stored by prefix and by user, as of the
+// latest daily snapshot of the bucket, and how they changed over the period
+// (admin only). The first call takes a snapshot when there is none yet.
+//
+//encore:api auth method=GET path=/admin/storage
+func GetStorageUsage(ctx context.Context, req *StorageUsageRequest) (*StorageUsageResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	days := req.Days
+	if days < 1 || days > 365 {
+		days = 30
+	}
+	users := req.Users
+	if users < 1 || users > 500 {
+		users = 50
+	}
+
+	snapshotID, latest, err := latestStorageSnapshot(ctx)
+	if err != nil {
+		if snapshotID, latest, err = takeStorageSnapshot(ctx); err != nil {
+			rlog.Error("failed to take storage snapshot", "error", err)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to get storage usage").Err()
+		}
+	}
+
+	resp := &StorageUsageResponse{Latest: latest, Users: []UserStorageUsage{}, Trend: []StorageTrendPoint{}}
+	rows, err := db.Query(ctx, `
+		SELECT user_id, bucket_bytes, object_count, recorded_bytes FROM storage_snapshot_users
+		WHERE snapshot_id = $1
+		ORDER BY bucket_bytes DESC, user_id
+		LIMIT $2
+	`, snapshotID, users)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get storage usage").Err()
+	}
+	for rows.Next() {
+		var u UserStorageUsage
+		if err := rows.Scan(&u.UserID, &u.BucketBytes, &u.ObjectCount, &u.RecordedBytes); err != nil {
+			continue
+		}
+		resp.Users = append(resp.Users, u)
+	}
+	rows.Close()
+
+	rows, err = db.Query(ctx, `
+		SELECT taken_at, bucket_bytes, object_count, recorded_bytes FROM storage_snapshots
+		WHERE taken_at > $1
+		ORDER BY taken_at
+	`, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get storage usage").Err()
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p StorageTrendPoint
+		if err := rows.Scan(&p.TakenAt, &p.BucketBytes, &p.ObjectCount, &p.RecordedBytes); err != nil {
+			continue
+		}
+		resp.Trend = append(resp.Trend, p)
+	}
+	return resp, nil
+}
+
+// UserStorageUsageRequest selects the trend period
+type UserStorageUsageRequest struct {
+	// Days of trend, 30 by default and at most 365
+	Days int `query:"days"`
+}
+
+// UserStorageUsageResponse contains a user's usage in each snapshot of the
+// period, oldest first
+type UserStorageUsageResponse struct {
+	UserID int64               `json:"user_id"`
+	Trend  []StorageTrendPoint `json:"trend"`
+}
+
+// GetUserStorageUsage reports how much one user stored in each snapshot of
+// the period (admin only)
+//
+//encore:api auth method=GET path=/admin/storage/users/:userID
+func GetUserStorageUsage(ctx context.Context, userID int64, req *UserStorageUsageRequest) (*UserStorageUsageResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	days := req.Days
+	if days < 1 || days > 365 {
+		days = 30
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT s.taken_at, u.bucket_bytes, u.object_count, u.recorded_bytes
+		FROM storage_snapshot_users u
+		JOIN storage_snapshots s ON s.id = u.snapshot_id
+		WHERE u.user_id = $1 AND s.taken_at > $2
+		ORDER BY s.taken_at
+	`, userID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get storage usage").Err()
+	}
+	defer rows.Close()
+
+	resp := &UserStorageUsageResponse{UserID: userID, Trend: []StorageTrendPoint{}}
+	for rows.Next() {
+		var p StorageTrendPoint
+		if err := rows.Scan(&p.TakenAt, &p.BucketBytes, &p.ObjectCount, &p.RecordedBytes); err != nil {
+			continue
+		}
+		resp.Trend = append(resp.Trend, p)
+	}
+	return resp, nil
+}
+
+// RefreshStorageUsage takes a storage snapshot now rather than waiting for
+// the daily one (admin only). Listing a large bucket takes a while.
+//
+//encore:api auth method=POST path=/admin/storage/snapshot
+func RefreshStorageUsage(ctx context.Context) (*StorageSnapshot, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	_, snapshot, err := takeStorageSnapshot(ctx)
+	if err != nil {
+		rlog.Error("failed to take storage snapshot", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to take storage snapshot").Err()
+	}
+	return snapshot, nil
+}
+
+// Storage usage is snapshotted daily
+var _ = cron.NewJob("storage-usage-snapshot", cron.JobConfig{
+	Title:    "Snapshot storage usage",
+	Every:    24 * cron.Hour,
+	Endpoint: SnapshotStorageUsage,
+})
+
+// SnapshotStorageUsage takes the daily storage snapshot and removes
+// snapshots older than a year
+//
+//encore:api private
+func SnapshotStorageUsage(ctx context.Context) (*StorageSnapshot, error) {
+	_, snapshot, err := takeStorageSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(ctx, `
+		DELETE FROM storage_snapshots WHERE taken_at < $1
+	`, time.Now().Add(-storageSnapshotRetention))
+	if err != nil {
+		rlog.Warn("failed to remove old storage snapshots", "error", err)
+	}
+	return snapshot, nil
+}
+
+// latestStorageSnapshot loads the most recent snapshot and its ID
+func latestStorageSnapshot(ctx context.Context) (int64, *StorageSnapshot, error) {
+	var id int64
+	var s StorageSnapshot
+	var byPrefix []byte
+	err := db.QueryRow(ctx, `
+		SELECT id, taken_at, bucket_bytes, object_count, recorded_bytes, orphaned_bytes, by_prefix
+		FROM storage_snapshots ORDER BY taken_at DESC LIMIT 1
+	`).Scan(&id, &s.TakenAt, &s.BucketBytes, &s.ObjectCount, &s.RecordedBytes, &s.OrphanedBytes, &byPrefix)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := json.Unmarshal(byPrefix, &s.ByPrefix); err != nil || s.ByPrefix == nil {
+		s.ByPrefix = []PrefixUsage{}
+	}
+	return id, &s, nil
+}
+
+// takeStorageSnapshot lists the whole bucket, attributes each object to the
+// user whose media (or export) it belongs to and stores the result next to
+// the recorded media sizes
+func takeStorageSnapshot(ctx context.Context) (int64, *StorageSnapshot, error) {
+	owners := map[string]int64{}
+	// Imported originals keep the key they were imported from; a blob is
+	// attributed to one of the users sharing it
+	imported := map[string]int64{}
+	rows, err := db.Query(ctx, `SELECT id::text, owner_id, s3_key_original FROM media`)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var mediaID, originalKey string
+		var ownerID int64
+		if err := rows.Scan(&mediaID, &ownerID, &originalKey); err != nil {
+			continue
+		}
+		owners[mediaID] = ownerID
+		if !strings.HasPrefix(originalKey, "original/") {
+			imported[originalKey] = ownerID
+		}
+	}
+	rows.Close()
+
+	users := map[int64]*UserStorageUsage{}
+	user := func(userID int64) *UserStorageUsage {
+		if users[userID] == nil {
+			users[userID] = &UserStorageUsage{UserID: userID}
+		}
+		return users[userID]
+	}
+
+	snapshot := &StorageSnapshot{TakenAt: time.Now(), ByPrefix: []PrefixUsage{}}
+	rows, err = db.Query(ctx, `
+		SELECT owner_id, COALESCE(SUM(size_bytes), 0) FROM media GROUP BY owner_id
+	`)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var ownerID, recorded int64
+		if err := rows.Scan(&ownerID, &recorded); err != nil {
+			continue
+		}
+		user(ownerID).RecordedBytes = recorded
+		snapshot.RecordedBytes += recorded
+	}
+	rows.Close()
+
+	client, err := getMinioClient()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	prefixes := map[string]*PrefixUsage{}
+	for object := range client.ListObjects(ctx, objectstore.Bucket(), minio.ListObjectsOptions{Recursive: true}) {
+		// A partial listing would look like storage was freed
+		if object.Err != nil {
+			return 0, nil, fmt.Errorf("failed to list bucket: %w", object.Err)
+		}
+		snapshot.BucketBytes += object.Size
+		snapshot.ObjectCount++
+
+		prefix, _, _ := strings.Cut(object.Key, "/")
+		if prefixes[prefix] == nil {
+			prefixes[prefix] = &PrefixUsage{Prefix: prefix}
+		}
+		prefixes[prefix].Bytes += object.Size
+		prefixes[prefix].Objects++
+
+		if ownerID, ok := imported[object.Key]; ok {
+			u := user(ownerID)
+			u.BucketBytes += object.Size
+			u.ObjectCount++
+		} else if ownerID, ok := storageOwner(object.Key, owners); ok {
+			u := user(ownerID)
+			u.BucketBytes += object.Size
+			u.ObjectCount++
+		} else {
+			snapshot.OrphanedBytes += object.Size
+		}
+	}
+	for _, p := range prefixes {
+		snapshot.ByPrefix = append(snapshot.ByPrefix, *p)
+	}
+	sort.Slice(snapshot.ByPrefix, func(i, j int) bool {
+		return snapshot.ByPrefix[i].Bytes > snapshot.ByPrefix[j].Bytes
+	})
+
+	byPrefix, err := json.Marshal(snapshot.ByPrefix)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO storage_snapshots (taken_at, bucket_bytes, object_count, recorded_bytes, orphaned_bytes, by_prefix)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, snapshot.TakenAt, snapshot.BucketBytes, snapshot.ObjectCount, snapshot.RecordedBytes, snapshot.OrphanedBytes,
+		byPrefix).Scan(&id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var userIDs, bucketBytes, objectCounts, recordedBytes []int64
+	for _, u := range users {
+		userIDs = append(userIDs, u.UserID)
+		bucketBytes = append(bucketBytes, u.BucketBytes)
+		objectCounts = append(objectCounts, u.ObjectCount)
+		recordedBytes = append(recordedBytes, u.RecordedBytes)
+	}
+	if len(userIDs) > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO storage_snapshot_users (snapshot_id, user_id, bucket_bytes, object_count, recorded_bytes)
+			SELECT $1, u.user_id, u.bucket_bytes, u.object_count, u.recorded_bytes
+			FROM unnest($2::bigint[], $3::bigint[], $4::bigint[], $5::bigint[])
+				AS u(user_id, bucket_bytes, object_count, recorded_bytes)
+		`, id, userIDs, bucketBytes, objectCounts, recordedBytes)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	rlog.Info("storage snapshot taken", "bucket_bytes", snapshot.BucketBytes, "objects", snapshot.ObjectCount,
+		"orphaned_bytes", snapshot.OrphanedBytes)
+	return id, snapshot, nil
+}
+
+// storageOwner returns the user an object belongs to from its key: originals
+// and exports carry the user ID, everything else the media ID
+// (processed/<id>.mp4, thumbnails/<id>/..., ...)
+func storageOwner(key string, owners map[string]int64) (int64, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 2 {
+		return 0, false
+	}
+	switch parts[0] {
+	case "original":
+		if len(parts) > 2 {
+			if ownerID, ok := owners[parts[2]]; ok {
+				return ownerID, true
+			}
+		}
+		// Uploads that were never confirmed still count for the user
+		ownerID, err := strconv.ParseInt(parts[1], 10, 64)
+		return ownerID, err == nil
+	case "exports":
+		ownerID, err := strconv.ParseInt(parts[1], 10, 64)
+		return ownerID, err == nil
+	}
+	mediaID, err := uuid.Parse(strings.TrimSuffix(parts[1], path.Ext(parts[1])))
+	if err != nil {
+		return 0, false
+	}
+	ownerID, ok := owners[mediaID.String()]
+	return ownerID, ok
+}
+
+// requireAdmin returns an error unless the caller is an admin
+func requireAdmin() error {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+	return nil
+}
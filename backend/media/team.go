@@ -0,0 +1,141 @@
+package media
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// requireTeamRole returns an error unless the user has at least role min in
+// the team
+func requireTeamRole(ctx context.Context, userID int64, teamID string, min team.Role) error {
+	membership, err := team.GetMembership(ctx, &team.MembershipRequest{TeamID: teamID, UserID: userID})
+	if err != nil {
+		return errs.B().Code(errs.Internal).Msg("failed to check team membership").Err()
+	}
+	if membership.Role == "" {
+		return errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	if !membership.Role.AtLeast(min) {
+		return errs.B().Code(errs.PermissionDenied).Msg("your team role doesn't allow this").Err()
+	}
+	return nil
+}
+
+// authorizeMedia returns an error unless the user may act on a media item
+// uploaded by ownerID in teamID (empty for personal media): the uploader
+// always may, members of the team when their role is at least min
+func authorizeMedia(ctx context.Context, userID, ownerID int64, teamID string, min team.Role) error {
+	if ownerID == userID {
+		return nil
+	}
+	if teamID != "" {
+		membership, err := team.GetMembership(ctx, &team.MembershipRequest{TeamID: teamID, UserID: userID})
+		if err != nil {
+			return errs.B().Code(errs.Internal).Msg("failed to check team membership").Err()
+		}
+		if membership.Role.AtLeast(min) {
+			return nil
+		}
+	}
+	return errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+}
+
+// SetMediaTeamRequest names the team to move media to; empty makes it
+// personal media of its uploader again
+type SetMediaTeamRequest struct {
+	TeamID string `json:"team_id"`
+}
+
+// SetMediaTeamResponse confirms the move
+type SetMediaTeamResponse struct {
+	MediaID string `json:"media_id"`
+	TeamID  string `json:"team_id,omitempty"`
+}
+
+// SetMediaTeam moves a media item into a team the caller is an editor of,
+// or out of its team back to the uploader. The uploader may move their
+// media; team admins may also move any media out of their team.
+//
+//encore:api auth method=PUT path=/media/:id/team
+func SetMediaTeam(ctx context.Context, id string, req *SetMediaTeamRequest) (*SetMediaTeamResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID, size int64
+	var teamID string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), COALESCE(size_bytes, 0) FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &size)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if req.TeamID == teamID {
+		return &SetMediaTeamResponse{MediaID: id, TeamID: teamID}, nil
+	}
+
+	if ownerID != userData.UserID {
+		// Team admins may only hand media back to its uploader
+		if teamID == "" || req.TeamID != "" {
+			return nil, errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+		}
+		if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	if req.TeamID != "" {
+		if err := requireTeamRole(ctx, userData.UserID, req.TeamID, team.RoleEditor); err != nil {
+			return nil, err
+		}
+		limits, err := team.GetTeamLimits(ctx, &team.TeamLimitsRequest{TeamID: req.TeamID})
+		if err != nil {
+			return nil, err
+		}
+		if err := checkTeamStorage(ctx, limits, id, size); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = db.Exec(ctx, `UPDATE media SET team_id = NULLIF($2, '')::uuid WHERE id = $1`, id, req.TeamID)
+	if err != nil {
+		rlog.Error("failed to move media", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to move media").Err()
+	}
+	recordAudit(ctx, userData.UserID, auditMediaTeamChanged, id,
+		map[string]string{"team_id": teamID}, map[string]string{"team_id": req.TeamID}, nil)
+	for _, changed := range []string{teamID, req.TeamID} {
+		if changed != "" {
+			reportTeamStorage(ctx, changed)
+		}
+	}
+
+	return &SetMediaTeamResponse{MediaID: id, TeamID: req.TeamID}, nil
+}
+
+// A deleted team's media goes back to the members who uploaded it
+var _ = pubsub.NewSubscription(team.TeamDeletedTopic, "media-team-cleanup",
+	pubsub.SubscriptionConfig[*team.TeamDeleted]{
+		Handler: releaseTeamMedia,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// releaseTeamMedia makes the media of a deleted team personal media of
+// its uploaders
+func releaseTeamMedia(ctx context.Context, msg *team.TeamDeleted) error {
+	result, err := db.Exec(ctx, `UPDATE media SET team_id = NULL WHERE team_id = $1`, msg.TeamID)
+	if err != nil {
+		return err
+	}
+	rlog.Info("team media released", "team_id", msg.TeamID, "media", result.RowsAffected())
+	return nil
+}
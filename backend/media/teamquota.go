@@ -0,0 +1,207 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// teamStorageUsed returns the total size of a team's media, except one item
+func teamStorageUsed(ctx context.Context, teamID, exceptMediaID string) (int64, error) {
+	var used int64
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(size_bytes), 0) FROM media WHERE team_id = $1 AND id::text <> $2
+	`, teamID, exceptMediaID).Scan(&used)
+	return used, err
+}
+
+// teamTranscodeMinutes returns the minutes of a team's media transcoded this
+// month, rounded up
+func teamTranscodeMinutes(ctx context.Context, teamID string) (int64, error) {
+	var seconds int64
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(seconds), 0) FROM transcode_usage
+		WHERE team_id = $1 AND recorded_at >= date_trunc('month', NOW())
+	`, teamID).Scan(&seconds)
+	return (seconds + 59) / 60, err
+}
+
+// usagePeriod is the month transcode minutes are counted in
+func usagePeriod() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// checkTeamQuota rejects uploads to a team that has used up its monthly
+// transcode minutes, or whose storage limit adding size bytes as media
+// mediaID would exceed
+func checkTeamQuota(ctx context.Context, teamID, mediaID string, size int64) error {
+	limits, err := team.GetTeamLimits(ctx, &team.TeamLimitsRequest{TeamID: teamID})
+	if err != nil {
+		return err
+	}
+	if err := checkTeamStorage(ctx, limits, mediaID, size); err != nil {
+		return err
+	}
+
+	if limits.TranscodeMinutesLimit > 0 {
+		minutes, err := teamTranscodeMinutes(ctx, teamID)
+		if err != nil {
+			rlog.Error("failed to compute team transcode usage", "error", err, "team_id", teamID)
+			return errs.B().Code(errs.Internal).Msg("failed to check team transcode limit").Err()
+		}
+		if minutes >= limits.TranscodeMinutesLimit {
+			return errs.B().Code(errs.ResourceExhausted).
+				Msg(fmt.Sprintf("team transcode limit reached: %d of %d minutes used this month",
+					minutes, limits.TranscodeMinutesLimit)).Err()
+		}
+	}
+	return nil
+}
+
+// checkTeamStorage rejects adding size bytes as media mediaID when it would
+// take the team over its storage limit
+func checkTeamStorage(ctx context.Context, limits *team.Limits, mediaID string, size int64) error {
+	if limits.StorageLimitBytes <= 0 {
+		return nil
+	}
+	used, err := teamStorageUsed(ctx, limits.TeamID, mediaID)
+	if err != nil {
+		rlog.Error("failed to compute team storage usage", "error", err, "team_id", limits.TeamID)
+		return errs.B().Code(errs.Internal).Msg("failed to check team storage limit").Err()
+	}
+	if used+size > limits.StorageLimitBytes || (size == 0 && used >= limits.StorageLimitBytes) {
+		return errs.B().Code(errs.ResourceExhausted).
+			Msg(fmt.Sprintf("team storage limit exceeded: %d of %d bytes used", used, limits.StorageLimitBytes)).Err()
+	}
+	return nil
+}
+
+// reportTeamStorage tells the team service a team's storage usage after it
+// changed, so owners and admins are warned near the limit. Failures are
+// only logged.
+func reportTeamStorage(ctx context.Context, teamID string) {
+	used, err := teamStorageUsed(ctx, teamID, "")
+	if err == nil {
+		_, err = team.ReportUsage(ctx, &team.ReportUsageRequest{TeamID: teamID, Resource: team.ResourceStorage, Used: used})
+	}
+	if err != nil {
+		rlog.Warn("failed to report team storage usage", "error", err, "team_id", teamID)
+	}
+}
+
+// RecordTranscodeUsageRequest names a media item that was just transcoded
+type RecordTranscodeUsageRequest struct {
+	MediaID string `json:"media_id"`
+}
+
+// RecordTranscodeUsage counts the duration of a freshly transcoded media
+// item towards its team's monthly transcode minutes and reports the new
+// total to the team service. Images and untouched originals count nothing.
+//
+//encore:api private
+func RecordTranscodeUsage(ctx context.Context, req *RecordTranscodeUsageRequest) error {
+	var teamID string
+	err := db.QueryRow(ctx, `
+		INSERT INTO transcode_usage (media_id, owner_id, team_id, seconds, recorded_at)
+		SELECT id, owner_id, team_id, duration_seconds, NOW() FROM media
+		WHERE id::text = $1 AND COALESCE(duration_seconds, 0) > 0 AND COALESCE(s3_key_processed, '') <> ''
+		RETURNING COALESCE(team_id::text, '')
+	`, req.MediaID).Scan(&teamID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		rlog.Error("failed to record transcode usage", "error", err, "media_id", req.MediaID)
+		return errs.B().Code(errs.Internal).Msg("failed to record transcode usage").Err()
+	}
+	if teamID == "" {
+		return nil
+	}
+
+	// The total only feeds warnings, so failing to report it is only logged
+	minutes, err := teamTranscodeMinutes(ctx, teamID)
+	if err == nil {
+		_, err = team.ReportUsage(ctx, &team.ReportUsageRequest{
+			TeamID:   teamID,
+			Resource: team.ResourceTranscodeMinutes,
+			Used:     minutes,
+			Period:   usagePeriod(),
+		})
+	}
+	if err != nil {
+		rlog.Warn("failed to report team transcode usage", "error", err, "team_id", teamID)
+	}
+	return nil
+}
+
+// UsageMeter is the usage of one resource against its limit
+type UsageMeter struct {
+	Used int64 `json:"used"`
+	// Limit is 0 when unlimited
+	Limit int64 `json:"limit"`
+	// Percent of the limit used, 0 when unlimited
+	Percent float64 `json:"percent"`
+	// Level is "ok", "warning" (past the warning threshold) or "exceeded";
+	// uploads to the team are blocked while any resource is exceeded
+	Level string `json:"level"`
+}
+
+// TeamUsageResponse is a team's usage against its limits
+type TeamUsageResponse struct {
+	TeamID  string     `json:"team_id"`
+	Storage UsageMeter `json:"storage"`
+	// TranscodeMinutes counts the minutes transcoded in Period
+	TranscodeMinutes UsageMeter `json:"transcode_minutes"`
+	Period           string     `json:"period"`
+	WarnPercent      int        `json:"warn_percent"`
+}
+
+// GetTeamUsage returns a team's storage and this month's transcode minutes
+// against its limits; every member may see them
+//
+//encore:api auth method=GET path=/teams/:id/usage
+func GetTeamUsage(ctx context.Context, id string) (*TeamUsageResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if err := requireTeamRole(ctx, userData.UserID, id, team.RoleViewer); err != nil {
+		return nil, err
+	}
+	limits, err := team.GetTeamLimits(ctx, &team.TeamLimitsRequest{TeamID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := teamStorageUsed(ctx, id, "")
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to compute team usage").Err()
+	}
+	minutes, err := teamTranscodeMinutes(ctx, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to compute team usage").Err()
+	}
+
+	return &TeamUsageResponse{
+		TeamID:           id,
+		Storage:          usageMeter(limits, team.ResourceStorage, storage),
+		TranscodeMinutes: usageMeter(limits, team.ResourceTranscodeMinutes, minutes),
+		Period:           usagePeriod(),
+		WarnPercent:      limits.WarnPercent,
+	}, nil
+}
+
+// usageMeter measures used against the team's limit of a resource
+func usageMeter(limits *team.Limits, resource string, used int64) UsageMeter {
+	m := UsageMeter{Used: used, Limit: limits.Limit(resource), Level: limits.Level(resource, used)}
+	if m.Limit > 0 {
+		m.Percent = float64(used) * 100 / float64(m.Limit)
+	}
+	return m
+}
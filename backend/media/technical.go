@@ -0,0 +1,46 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// TechnicalResponse contains the ffprobe output of the original upload
+type TechnicalResponse struct {
+	MediaID string          `json:"media_id"`
+	Probe   json.RawMessage `json:"probe"`
+}
+
+// GetTechnical returns the full technical metadata (ffprobe streams and
+// format) of a media item
+//
+//encore:api auth method=GET path=/media/:id/technical
+func GetTechnical(ctx context.Context, id string) (*TechnicalResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID, probe string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), COALESCE(probe_data::text, '') FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &probe)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+	if probe == "" {
+		return nil, errs.B().Code(errs.NotFound).Msg("technical metadata not available yet").Err()
+	}
+
+	return &TechnicalResponse{
+		MediaID: id,
+		Probe:   json.RawMessage(probe),
+	}, nil
+}
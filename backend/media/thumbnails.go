@@ -0,0 +1,80 @@
+package media
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"encore.dev/beta/auth"
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// GetThumbnailsVTT serves the scrub preview WebVTT of a media item with the
+// sprite sheet reference rewritten into a presigned URL
+//
+//encore:api auth raw method=GET path=/media/:id/thumbnails.vtt
+func GetThumbnailsVTT(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	userData := auth.Data().(*authpkg.UserData)
+
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/media/"), "/thumbnails.vtt")
+
+	var ownerID int64
+	var teamID, spriteKey, vttKey string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), COALESCE(s3_key_sprite, ''), COALESCE(s3_key_thumbnails_vtt, '')
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &spriteKey, &vttKey)
+	if err != nil || spriteKey == "" || vttKey == "" {
+		http.Error(w, "thumbnails not found", http.StatusNotFound)
+		return
+	}
+	if authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer) != nil {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		rlog.Error("failed to create MinIO client", "error", err)
+		http.Error(w, "failed to create storage client", http.StatusInternalServerError)
+		return
+	}
+
+	object, err := client.GetObject(ctx, objectstore.Bucket(), vttKey, minio.GetObjectOptions{})
+	if err != nil {
+		rlog.Error("failed to get thumbnails VTT", "error", err, "media_id", id)
+		http.Error(w, "failed to get thumbnails", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	vtt, err := io.ReadAll(object)
+	if err != nil {
+		rlog.Error("failed to read thumbnails VTT", "error", err, "media_id", id)
+		http.Error(w, "failed to read thumbnails", http.StatusInternalServerError)
+		return
+	}
+
+	ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+	spriteURL, err := objectstore.PlaybackURL(ctx, client, spriteKey, ttl)
+	if err != nil {
+		rlog.Error("failed to presign sprite sheet", "error", err, "media_id", id)
+		http.Error(w, "failed to sign sprite sheet", http.StatusInternalServerError)
+		return
+	}
+
+	// Cues reference the sprite relatively as "<name>#xywh=..."; presigned URLs
+	// carry a query string, so the fragment still follows it
+	body := strings.ReplaceAll(string(vtt), path.Base(spriteKey)+"#", spriteURL.String()+"#")
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	_, _ = io.WriteString(w, body)
+}
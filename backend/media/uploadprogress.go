@@ -0,0 +1,183 @@
+package media
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/realtime"
+	"encore.app/team"
+)
+
+// Upload states reported by GetUploadProgress
+const (
+	UploadInProgress = "uploading"
+	// UploadStalled is an upload whose client stopped reporting progress
+	UploadStalled = "stalled"
+	// UploadExpired is an upload whose URL expired before it finished
+	UploadExpired = "expired"
+	// UploadComplete is an upload whose file is stored, waiting to be
+	// confirmed
+	UploadComplete = "complete"
+	// UploadConfirmed is media that is no longer uploading
+	UploadConfirmed = "confirmed"
+)
+
+// getUploadStallAfter returns how long an upload may go without a progress
+// report before it counts as stalled (UPLOAD_STALL_AFTER, default 2m)
+func getUploadStallAfter() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("UPLOAD_STALL_AFTER")); err == nil && d > 0 {
+		return d
+	}
+	return 2 * time.Minute
+}
+
+// ReportUploadProgressRequest is a progress heartbeat of an uploading client
+type ReportUploadProgressRequest struct {
+	BytesUploaded int64 `json:"bytes_uploaded"`
+	// TotalBytes is the size of the file being uploaded, if known
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+}
+
+// UploadProgress is how far an upload has come
+type UploadProgress struct {
+	MediaID string `json:"media_id"`
+	// State is uploading, stalled, expired, complete or confirmed
+	State         string `json:"state"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	TotalBytes    int64  `json:"total_bytes,omitempty"`
+	// Percent is set when the total is known
+	Percent float64 `json:"percent,omitempty"`
+	// LastReportAt is the last heartbeat; stalled uploads are those without
+	// one for UPLOAD_STALL_AFTER
+	LastReportAt *time.Time `json:"last_report_at,omitempty"`
+	// ExpiresAt is when the upload URL stops being accepted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ReportUploadProgress records how many bytes a client has sent of an
+// upload, e.g. every few seconds from the PUT's progress events. Progress
+// never goes backwards; the other tabs of the uploader get it as
+// upload.progress events.
+//
+//encore:api auth method=POST path=/media/:id/upload-progress
+func ReportUploadProgress(ctx context.Context, id string, req *ReportUploadProgressRequest) (*UploadProgress, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if req.BytesUploaded < 0 || req.TotalBytes < 0 || (req.TotalBytes > 0 && req.BytesUploaded > req.TotalBytes) {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg("bytes_uploaded must be between 0 and total_bytes").Err()
+	}
+
+	ownerID, teamID, status, err := uploadOwner(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "uploading" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is not uploading").Err()
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE media SET upload_bytes = GREATEST(COALESCE(upload_bytes, 0), $2),
+			upload_total_bytes = COALESCE(NULLIF($3, 0), upload_total_bytes), upload_progress_at = NOW()
+		WHERE id = $1 AND status = 'uploading'
+	`, id, req.BytesUploaded, req.TotalBytes)
+	if err != nil {
+		rlog.Error("failed to record upload progress", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to record upload progress").Err()
+	}
+
+	progress, err := uploadProgress(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(ctx, ownerID, id, realtime.TypeUploadProgress, realtime.UploadProgress{
+		MediaID:       id,
+		BytesUploaded: progress.BytesUploaded,
+		TotalBytes:    progress.TotalBytes,
+	})
+	return progress, nil
+}
+
+// GetUploadProgress returns how far an upload has come and whether it
+// stalled, so a UI can show progress of uploads started elsewhere and offer
+// to restart stalled ones
+//
+//encore:api auth method=GET path=/media/:id/upload-progress
+func GetUploadProgress(ctx context.Context, id string) (*UploadProgress, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	ownerID, teamID, _, err := uploadOwner(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+	return uploadProgress(ctx, id)
+}
+
+// uploadOwner returns who may see an upload and the media's status
+func uploadOwner(ctx context.Context, id string) (int64, string, string, error) {
+	var ownerID int64
+	var teamID, status string
+	err := db.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, ''), status FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID, &status)
+	if err != nil {
+		return 0, "", "", errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	return ownerID, teamID, status, nil
+}
+
+// uploadProgress loads the progress of an upload. An upload without
+// heartbeats for a while is checked in the bucket, since a single PUT only
+// shows up there once it has finished.
+func uploadProgress(ctx context.Context, id string) (*UploadProgress, error) {
+	p := UploadProgress{MediaID: id}
+	var status, s3Key string
+	var sizeBytes int64
+	err := db.QueryRow(ctx, `
+		SELECT status, s3_key_original, COALESCE(size_bytes, 0), COALESCE(upload_bytes, 0),
+			   COALESCE(upload_total_bytes, 0), upload_progress_at, upload_expires_at
+		FROM media WHERE id = $1
+	`, id).Scan(&status, &s3Key, &sizeBytes, &p.BytesUploaded, &p.TotalBytes, &p.LastReportAt, &p.ExpiresAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+
+	now := time.Now()
+	switch {
+	case status != "uploading":
+		p.State = UploadConfirmed
+		if sizeBytes > 0 {
+			p.BytesUploaded, p.TotalBytes = sizeBytes, sizeBytes
+		}
+	case p.LastReportAt != nil && now.Sub(*p.LastReportAt) < getUploadStallAfter():
+		p.State = UploadInProgress
+	default:
+		if size := uploadedSize(ctx, s3Key, -1); size >= 0 {
+			p.State = UploadComplete
+			p.BytesUploaded, p.TotalBytes = size, size
+		} else if p.ExpiresAt != nil && now.After(*p.ExpiresAt) {
+			p.State = UploadExpired
+		} else if p.LastReportAt != nil {
+			p.State = UploadStalled
+		} else {
+			// Clients that don't report progress are neither in progress
+			// nor stalled as far as we know
+			p.State = UploadInProgress
+		}
+	}
+	if p.TotalBytes > 0 {
+		p.Percent = float64(p.BytesUploaded) * 100 / float64(p.TotalBytes)
+	}
+	return &p, nil
+}
@@ -0,0 +1,248 @@
+// Package metrics keeps counters, histograms and gauges in memory and writes
+// them in the Prometheus text exposition format. It has no endpoints of its
+// own: the services record into it and the monitoring service serves it on
+// /metrics. Values are per instance and start over when it restarts.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are histogram buckets in seconds for fast operations
+// such as presigning and S3 requests
+var DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is anything that can be written out
+type metric interface {
+	write(ctx context.Context, w io.Writer) error
+}
+
+// registry holds every metric by name
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: map[string]metric{}}
+
+// register adds a metric; names are unique, so registering one twice is a
+// programming error
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry.metrics[name] = m
+}
+
+// desc is what every metric has
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// key joins label values into a map key, checking their count
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelString formats a key as {name="value",...}, with extra label pairs
+// appended
+func (d *desc) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sortedKeys returns the keys of a map in order, so output is stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, per combination of label values
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter; by convention its name ends in _total
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc adds one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(_ context.Context, w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.values[key]))
+	}
+	return nil
+}
+
+// Histogram counts observations into buckets, per combination of label values
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, in
+// ascending order; +Inf is added
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help, labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	register(name, h)
+	return h
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[key]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// ObserveSince records the seconds since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(_ context.Context, w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), hv.count)
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge read when metrics are written
+type GaugeFunc struct {
+	desc
+	fn func(ctx context.Context) (float64, error)
+}
+
+// NewGaugeFunc registers a gauge whose value fn reads on every scrape, e.g.
+// from a database. A gauge whose read fails is left out of that scrape.
+func NewGaugeFunc(name, help string, fn func(ctx context.Context) (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help}, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(ctx context.Context, w io.Writer) error {
+	v, err := g.fn(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", g.name, err)
+	}
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+	return nil
+}
+
+// Write writes every metric in the Prometheus text format, sorted by name.
+// Gauges that couldn't be read are skipped and their errors returned
+// together once the rest was written.
+func Write(ctx context.Context, w io.Writer) error {
+	registry.Lock()
+	names := sortedKeys(registry.metrics)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry.metrics[name]
+	}
+	registry.Unlock()
+
+	var failed []string
+	for _, m := range metrics {
+		if err := m.write(ctx, w); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to read gauges: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// formatFloat formats a value like Prometheus does
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	s3Requests = NewCounter("surtr_s3_requests_total",
+		"S3 requests by calling service, HTTP method and status code (0 for network errors).",
+		"service", "method", "code")
+	s3Errors = NewCounter("surtr_s3_errors_total",
+		"S3 requests that failed with a network error or a 5xx response.",
+		"service", "method")
+	s3Duration = NewHistogram("surtr_s3_request_duration_seconds",
+		"Time until S3 responded, by calling service and HTTP method.",
+		DurationBuckets, "service", "method")
+	presignDuration = NewHistogram("surtr_presign_duration_seconds",
+		"Time taken to presign an S3 URL or sign a CDN URL, by kind (get, put or cdn).",
+		DurationBuckets, "kind")
+)
+
+// s3Transports are the instrumented transports by service and TLS setting,
+// shared by the clients a service creates
+var s3Transports = struct {
+	sync.Mutex
+	byKey map[string]http.RoundTripper
+}{byKey: map[string]http.RoundTripper{}}
+
+// S3Transport returns the transport for the MinIO clients of a service,
+// which records the requests they make
+func S3Transport(service string, secure bool) (http.RoundTripper, error) {
+	key := service + ":" + strconv.FormatBool(secure)
+	s3Transports.Lock()
+	defer s3Transports.Unlock()
+	if t, ok := s3Transports.byKey[key]; ok {
+		return t, nil
+	}
+	base, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, err
+	}
+	t := &s3Transport{service: service, base: base}
+	s3Transports.byKey[key] = t
+	return t, nil
+}
+
+// s3Transport counts and times the requests of one service
+type s3Transport struct {
+	service string
+	base    http.RoundTripper
+}
+
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	s3Duration.ObserveSince(start, t.service, req.Method)
+
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+	s3Requests.Inc(t.service, req.Method, strconv.Itoa(code))
+	if err != nil || code >= 500 {
+		s3Errors.Inc(t.service, req.Method)
+	}
+	return resp, err
+}
+
+// PresignedGetObject presigns a download URL like the client method of the
+// same name, recording how long it took
+func PresignedGetObject(ctx context.Context, client *minio.Client, bucket, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	start := time.Now()
+	u, err := client.PresignedGetObject(ctx, bucket, key, expiry, params)
+	presignDuration.ObserveSince(start, "get")
+	return u, err
+}
+
+// PresignedPutObject presigns an upload URL like the client method of the
+// same name, recording how long it took
+func PresignedPutObject(ctx context.Context, client *minio.Client, bucket, key string, expiry time.Duration) (*url.URL, error) {
+	start := time.Now()
+	u, err := client.PresignedPutObject(ctx, bucket, key, expiry)
+	presignDuration.ObserveSince(start, "put")
+	return u, err
+}
+
+// ObservePresign records how long signing a URL of a kind took, for URLs
+// not presigned by a MinIO client such as CDN URLs
+func ObservePresign(kind string, start time.Time) {
+	presignDuration.ObserveSince(start, kind)
+}
@@ -0,0 +1,49 @@
+// Package monitoring serves the metrics the services record in Prometheus
+// text format, so the instance can be scraped by Prometheus and similar
+// tools.
+package monitoring
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"encore.dev/rlog"
+
+	"encore.app/metrics"
+)
+
+// Secrets for the metrics endpoint
+var secrets struct {
+	// MetricsToken is the bearer token scrapers send; /metrics is disabled
+	// while it is empty
+	MetricsToken string
+}
+
+// Metrics serves upload, processing, presign and S3 metrics in the
+// Prometheus text exposition format. Scrapers authenticate with
+// "Authorization: Bearer <METRICS_TOKEN>".
+//
+//encore:api public raw method=GET path=/metrics
+func Metrics(w http.ResponseWriter, req *http.Request) {
+	if secrets.MetricsToken == "" {
+		http.Error(w, "metrics are disabled", http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secrets.MetricsToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "invalid metrics token", http.StatusUnauthorized)
+		return
+	}
+
+	// Gauges that fail to read are left out rather than failing the scrape
+	var buf bytes.Buffer
+	if err := metrics.Write(req.Context(), &buf); err != nil {
+		rlog.Warn("some metrics could not be read", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
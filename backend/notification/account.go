@@ -0,0 +1,44 @@
+package notification
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Deleting an account removes its channel preferences and notifications
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "notification-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountNotifications,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteAccountNotifications deletes everything stored for a deleted account
+func deleteAccountNotifications(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	result, err := db.Exec(ctx, `DELETE FROM notification_deliveries WHERE user_id = $1`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	deleted := int(result.RowsAffected())
+
+	result, err = db.Exec(ctx, `DELETE FROM notification_preferences WHERE user_id = $1`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	deleted += int(result.RowsAffected())
+
+	rlog.Info("account notifications deleted", "user_id", msg.UserID, "deleted", deleted)
+	return authpkg.ReportDeletionProgress(ctx, &authpkg.DeletionProgress{
+		DeletionID:   msg.DeletionID,
+		Service:      "notification",
+		DeletedItems: deleted,
+	})
+}
@@ -0,0 +1,166 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// discordAPI is the base URL of the Discord REST API
+const discordAPI = "https://discord.com/api/v10"
+
+// maxDiscordMessage is the longest message content Discord accepts
+const maxDiscordMessage = 2000
+
+// permanentError is a delivery failure retrying won't fix, such as a user
+// who doesn't accept DMs from the bot or a rejected address
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// discordConfigured reports whether Discord DMs can be sent
+func discordConfigured() bool {
+	return secrets.DiscordBotToken != ""
+}
+
+// sendDiscordDM sends msg as a direct message from the bot. Discord only
+// delivers it when the user shares a server with the bot and allows DMs.
+func sendDiscordDM(ctx context.Context, discordID string, msg message) error {
+	var channel struct {
+		ID string `json:"id"`
+	}
+	if err := discordPost(ctx, "/users/@me/channels", map[string]string{"recipient_id": discordID}, &channel); err != nil {
+		return err
+	}
+
+	content := "**" + msg.Subject + "**\n" + msg.Body
+	if msg.Link != "" {
+		content += "\n" + msg.Link
+	}
+	if runes := []rune(content); len(runes) > maxDiscordMessage {
+		content = string(runes[:maxDiscordMessage-1]) + "…"
+	}
+	return discordPost(ctx, "/channels/"+channel.ID+"/messages", map[string]string{"content": content}, nil)
+}
+
+// discordPost calls the Discord API as the bot and decodes the response into
+// out unless it is nil
+func discordPost(ctx context.Context, path string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", discordAPI+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+secrets.DiscordBotToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("discord %s returned %d", path, resp.StatusCode)
+		// Rate limits and outages pass; other refusals, such as closed DMs, don't
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return err
+		}
+		return &permanentError{err}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// getSMTPHost returns the mail server; email notifications are off without one
+func getSMTPHost() string {
+	return os.Getenv("SMTP_HOST")
+}
+
+// getSMTPPort returns the mail server port (STARTTLS submission by default)
+func getSMTPPort() string {
+	if val := os.Getenv("SMTP_PORT"); val != "" {
+		return val
+	}
+	return "587"
+}
+
+// getSMTPFrom returns the sender of notification emails, with or without a
+// display name
+func getSMTPFrom() string {
+	if val := os.Getenv("SMTP_FROM"); val != "" {
+		return val
+	}
+	return "mediavault@localhost"
+}
+
+// smtpConfigured reports whether emails can be sent
+func smtpConfigured() bool {
+	return getSMTPHost() != ""
+}
+
+// sendEmail sends msg as a plain text email. The connection is upgraded
+// with STARTTLS when the server offers it; SMTP_USERNAME enables PLAIN auth.
+func sendEmail(to string, msg message) error {
+	body := msg.Body
+	if msg.Link != "" {
+		body += "\n\n" + msg.Link
+	}
+
+	var buf bytes.Buffer
+	headers := []string{
+		"From: " + getSMTPFrom(),
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, secrets.SMTPPassword, getSMTPHost())
+	}
+	sender := getSMTPFrom()
+	if addr, err := mail.ParseAddress(sender); err == nil {
+		sender = addr.Address
+	}
+	err := smtp.SendMail(net.JoinHostPort(getSMTPHost(), getSMTPPort()), auth, sender, []string{to}, buf.Bytes())
+
+	// 5xx replies, such as an unknown mailbox, won't change on a retry
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return &permanentError{err}
+	}
+	return err
+}
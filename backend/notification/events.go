@@ -0,0 +1,248 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/collection"
+	"encore.app/media"
+	"encore.app/processing"
+	"encore.app/team"
+)
+
+// maxReasonLength caps the failure reason quoted in a notification
+const maxReasonLength = 300
+
+// retryPolicy is shared by the notification subscriptions; deliveries that
+// already succeeded are skipped on redelivery
+var retryPolicy = &pubsub.RetryPolicy{
+	MinBackoff: 30 * time.Second,
+	MaxBackoff: 10 * time.Minute,
+}
+
+// Finished processing tells the owner their upload is ready or failed
+var _ = pubsub.NewSubscription(processing.ProcessingFinishedTopic, "notification-processing",
+	pubsub.SubscriptionConfig[*processing.ProcessingFinished]{
+		Handler:     notifyProcessingFinished,
+		RetryPolicy: retryPolicy,
+	},
+)
+
+// New items in a followed collection tell its followers
+var _ = pubsub.NewSubscription(collection.CollectionItemsAddedTopic, "notification-collection-updates",
+	pubsub.SubscriptionConfig[*collection.CollectionItemsAdded]{
+		Handler:     notifyCollectionItemsAdded,
+		RetryPolicy: retryPolicy,
+	},
+)
+
+// Logins from a new device or country alert the account owner
+var _ = pubsub.NewSubscription(authpkg.LoginAnomalyTopic, "notification-login-alerts",
+	pubsub.SubscriptionConfig[*authpkg.LoginAnomaly]{
+		Handler:     notifyLoginAnomaly,
+		RetryPolicy: retryPolicy,
+	},
+)
+
+// Team usage nearing or reaching a limit warns the team's owners and admins
+var _ = pubsub.NewSubscription(team.TeamUsageAlertTopic, "notification-team-usage",
+	pubsub.SubscriptionConfig[*team.TeamUsageAlert]{
+		Handler:     notifyTeamUsage,
+		RetryPolicy: retryPolicy,
+	},
+)
+
+// Published scheduled collections tell their owners
+var _ = pubsub.NewSubscription(collection.CollectionPublishedTopic, "notification-scheduled-publish",
+	pubsub.SubscriptionConfig[*collection.CollectionPublished]{
+		Handler:     notifyCollectionPublished,
+		RetryPolicy: retryPolicy,
+	},
+)
+
+// notifyProcessingFinished tells the owner of a media item how processing
+// ended, if their settings ask for it
+func notifyProcessingFinished(ctx context.Context, msg *processing.ProcessingFinished) error {
+	recipient, err := lookupRecipient(ctx, msg.OwnerID)
+	if recipient == nil {
+		return err
+	}
+
+	kind, enabled := kindProcessingComplete, recipient.Notifications.ProcessingComplete
+	if msg.Status != "ready" {
+		kind, enabled = kindProcessingFailed, recipient.Notifications.ProcessingFailed
+	}
+	if !enabled {
+		return nil
+	}
+
+	title := "Your upload"
+	info, err := media.GetMediaInfo(ctx, &media.GetMediaInfoRequest{MediaIDs: []string{msg.MediaID}})
+	if err != nil {
+		return err
+	}
+	if len(info.Media) == 0 {
+		// Deleted in the meantime
+		return nil
+	}
+	if m := info.Media[0]; m.Title != "" {
+		title = fmt.Sprintf("%q", m.Title)
+	} else if m.OriginalFilename != "" {
+		title = fmt.Sprintf("%q", m.OriginalFilename)
+	}
+
+	n := message{Link: getFrontendURL() + "/media/" + msg.MediaID}
+	if kind == kindProcessingComplete {
+		n.Subject = "Your upload is ready"
+		n.Body = title + " has been processed and is ready to watch."
+	} else {
+		n.Subject = "Your upload could not be processed"
+		n.Body = title + " could not be processed."
+		if reason := truncate(msg.Reason, maxReasonLength); reason != "" {
+			n.Body += " Reason: " + reason
+		}
+	}
+
+	eventKey := fmt.Sprintf("processing:%s:%s:%d", msg.MediaID, msg.Status, msg.FinishedAt.UnixNano())
+	return notify(ctx, eventKey, kind, recipient, n)
+}
+
+// notifyCollectionItemsAdded tells each follower of a collection about its
+// new items, if their settings ask for it
+func notifyCollectionItemsAdded(ctx context.Context, msg *collection.CollectionItemsAdded) error {
+	owner := "Someone"
+	if profile, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: msg.OwnerID}); err == nil {
+		owner = profile.DisplayName
+	}
+
+	items := "an item"
+	if len(msg.MediaIDs) != 1 {
+		items = fmt.Sprintf("%d items", len(msg.MediaIDs))
+	}
+	n := message{
+		Subject: fmt.Sprintf("New in %q", msg.Title),
+		Body:    fmt.Sprintf("%s added %s to %q, a collection you follow.", owner, items, msg.Title),
+		Link:    getFrontendURL() + "/collection/" + msg.CollectionID,
+	}
+	eventKey := fmt.Sprintf("collection:%s:%d", msg.CollectionID, msg.AddedAt.UnixNano())
+
+	// One follower failing doesn't hold up the others; the redelivery only
+	// reaches followers that weren't notified yet
+	var retry error
+	for _, followerID := range msg.FollowerIDs {
+		recipient, err := lookupRecipient(ctx, followerID)
+		if err != nil {
+			retry = err
+			continue
+		}
+		if recipient == nil || !recipient.Notifications.CollectionUpdates {
+			continue
+		}
+		if err := notify(ctx, eventKey, kindCollectionUpdates, recipient, n); err != nil {
+			retry = err
+		}
+	}
+	if retry != nil {
+		rlog.Warn("collection update not delivered to every follower", "error", retry, "collection_id", msg.CollectionID)
+	}
+	return retry
+}
+
+// notifyLoginAnomaly alerts a user about a login from a new device or
+// country, if their settings ask for it
+func notifyLoginAnomaly(ctx context.Context, msg *authpkg.LoginAnomaly) error {
+	recipient, err := lookupRecipient(ctx, msg.UserID)
+	if recipient == nil || !recipient.Notifications.NewLogin {
+		return err
+	}
+
+	var from []string
+	if msg.NewDevice {
+		from = append(from, "a new device ("+msg.Device+")")
+	}
+	if msg.NewCountry {
+		from = append(from, "a new country ("+msg.Country+")")
+	}
+	n := message{
+		Subject: "New login to your account",
+		Body: fmt.Sprintf("Someone logged in to your account with %s from %s on %s UTC. "+
+			"If this wasn't you, log out all sessions and check your linked accounts.",
+			msg.Provider, strings.Join(from, " and "), msg.LoggedInAt.UTC().Format("2006-01-02 15:04")),
+	}
+
+	eventKey := fmt.Sprintf("login:%d", msg.LoginSessionID)
+	return notify(ctx, eventKey, kindNewLogin, recipient, n)
+}
+
+// notifyCollectionPublished tells the owner of a scheduled collection that
+// it was published, if their settings ask for it
+func notifyCollectionPublished(ctx context.Context, msg *collection.CollectionPublished) error {
+	recipient, err := lookupRecipient(ctx, msg.OwnerID)
+	if recipient == nil || !recipient.Notifications.ScheduledPublish {
+		return err
+	}
+
+	n := message{
+		Subject: fmt.Sprintf("%q is now %s", msg.Title, msg.Visibility),
+		Body:    fmt.Sprintf("Your collection %q was published as scheduled and is now %s.", msg.Title, msg.Visibility),
+		Link:    getFrontendURL() + "/collection/" + msg.CollectionID,
+	}
+	eventKey := fmt.Sprintf("published:%s:%d", msg.CollectionID, msg.PublishedAt.UnixNano())
+	return notify(ctx, eventKey, kindScheduledPublish, recipient, n)
+}
+
+// notifyTeamUsage tells a team's owners and admins that its usage of a
+// resource reached the warning threshold or the limit, if their settings
+// ask for it
+func notifyTeamUsage(ctx context.Context, msg *team.TeamUsageAlert) error {
+	usage := fmt.Sprintf("%.1f of %.1f GB of storage", float64(msg.Used)/(1<<30), float64(msg.Limit)/(1<<30))
+	if msg.Resource == team.ResourceTranscodeMinutes {
+		usage = fmt.Sprintf("%d of %d transcode minutes this month", msg.Used, msg.Limit)
+	}
+	n := message{
+		Subject: fmt.Sprintf("%q is nearing its limit", msg.TeamName),
+		Body:    fmt.Sprintf("Your team %q has used %s. Uploads are blocked once the limit is reached.", msg.TeamName, usage),
+		Link:    getFrontendURL() + "/teams/" + msg.TeamID,
+	}
+	if msg.Level == team.LevelExceeded {
+		n.Subject = fmt.Sprintf("%q reached its limit", msg.TeamName)
+		n.Body = fmt.Sprintf("Your team %q has used %s. New uploads to the team are blocked until usage goes down "+
+			"or the limit is raised.", msg.TeamName, usage)
+	}
+	eventKey := fmt.Sprintf("team-usage:%s:%s:%s:%d", msg.TeamID, msg.Resource, msg.Level, msg.AlertedAt.UnixNano())
+
+	// Like collection updates, a redelivery only reaches recipients that
+	// weren't notified yet
+	var retry error
+	for _, userID := range msg.RecipientIDs {
+		recipient, err := lookupRecipient(ctx, userID)
+		if err != nil {
+			retry = err
+			continue
+		}
+		if recipient == nil || !recipient.Notifications.TeamUsage {
+			continue
+		}
+		if err := notify(ctx, eventKey, kindTeamUsage, recipient, n); err != nil {
+			retry = err
+		}
+	}
+	if retry != nil {
+		rlog.Warn("team usage alert not delivered to every recipient", "error", retry, "team_id", msg.TeamID)
+	}
+	return retry
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
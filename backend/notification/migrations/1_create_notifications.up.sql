@@ -0,0 +1,27 @@
+-- Channels a user's notifications are delivered through; users without a
+-- row get Discord only
+CREATE TABLE notification_preferences (
+    user_id BIGINT PRIMARY KEY,
+    discord_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    email_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- One row per notification and channel; event_key keeps redelivered events
+-- from notifying twice
+CREATE TABLE notification_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    event_key TEXT NOT NULL,
+    user_id BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    channel TEXT NOT NULL CHECK (channel IN ('discord', 'email')),
+    subject TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('sent', 'failed')),
+    error_message TEXT,
+    attempts INT NOT NULL DEFAULT 1,
+    created_at TIMESTAMP DEFAULT NOW(),
+    sent_at TIMESTAMP,
+    UNIQUE (event_key, user_id, channel)
+);
+
+CREATE INDEX idx_notification_deliveries_user ON notification_deliveries(user_id, created_at DESC);
@@ -0,0 +1,302 @@
+// Package notification tells users when their uploads are processed, when
+// collections they follow get new items and when someone logs in to their
+// account, by Discord DM or email.
+package notification
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+)
+
+// Secrets for the delivery channels
+var secrets struct {
+	DiscordBotToken string // sends the Discord DMs
+	SMTPPassword    string
+}
+
+// Database for channel preferences and sent notifications
+var db = sqldb.NewDatabase("notification", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+// Channels notifications are delivered through
+const (
+	channelDiscord = "discord"
+	channelEmail   = "email"
+)
+
+// Notification kinds; each is switched on or off by the notification
+// setting of /auth/settings with the same name
+const (
+	kindProcessingComplete = "processing_complete"
+	kindProcessingFailed   = "processing_failed"
+	kindNewLogin           = "new_login"
+	kindCollectionUpdates  = "collection_updates"
+	kindTeamUsage          = "team_usage"
+	kindScheduledPublish   = "scheduled_publish"
+)
+
+// message is a notification ready to be delivered on any channel
+type message struct {
+	Subject string
+	Body    string
+	// Link points to what the notification is about, if anything
+	Link string
+}
+
+// getFrontendURL returns the frontend URL notification links point to
+func getFrontendURL() string {
+	if val := os.Getenv("FRONTEND_URL"); val != "" {
+		return strings.TrimRight(val, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// Preferences are the channels a user's notifications are delivered
+// through; which notifications are sent is set in /auth/settings
+type Preferences struct {
+	Discord bool `json:"discord"`
+	Email   bool `json:"email"`
+	// DiscordAvailable and EmailAvailable report whether the channel is set
+	// up on this server and the account has an address on it
+	DiscordAvailable bool `json:"discord_available"`
+	EmailAvailable   bool `json:"email_available"`
+}
+
+// loadPreferences returns a user's channel preferences; Discord only for
+// users who never changed them
+func loadPreferences(ctx context.Context, userID int64) (*Preferences, error) {
+	p := &Preferences{Discord: true}
+	err := db.QueryRow(ctx, `
+		SELECT discord_enabled, email_enabled FROM notification_preferences WHERE user_id = $1
+	`, userID).Scan(&p.Discord, &p.Email)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// channelAvailable reports whether notifications can reach the recipient
+// through a channel
+func channelAvailable(channel string, recipient *authpkg.NotificationRecipient) bool {
+	switch channel {
+	case channelDiscord:
+		return discordConfigured() && recipient.DiscordID != ""
+	case channelEmail:
+		return smtpConfigured() && recipient.Email != ""
+	}
+	return false
+}
+
+// GetPreferences returns the caller's notification channels
+//
+//encore:api auth method=GET path=/notifications/preferences
+func GetPreferences(ctx context.Context) (*Preferences, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	recipient, err := authpkg.GetNotificationRecipient(ctx, &authpkg.UserSettingsRequest{UserID: userData.UserID})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load account").Err()
+	}
+	p, err := loadPreferences(ctx, userData.UserID)
+	if err != nil {
+		rlog.Error("failed to load notification preferences", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load preferences").Err()
+	}
+	p.DiscordAvailable = channelAvailable(channelDiscord, recipient)
+	p.EmailAvailable = channelAvailable(channelEmail, recipient)
+	return p, nil
+}
+
+// UpdatePreferencesRequest switches channels on or off; omitted ones are kept
+type UpdatePreferencesRequest struct {
+	Discord *bool `json:"discord,omitempty"`
+	Email   *bool `json:"email,omitempty"`
+}
+
+// UpdatePreferences changes the caller's notification channels. A channel
+// can only be switched on when it can reach the caller.
+//
+//encore:api auth method=PATCH path=/notifications/preferences
+func UpdatePreferences(ctx context.Context, req *UpdatePreferencesRequest) (*Preferences, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	recipient, err := authpkg.GetNotificationRecipient(ctx, &authpkg.UserSettingsRequest{UserID: userData.UserID})
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load account").Err()
+	}
+	p, err := loadPreferences(ctx, userData.UserID)
+	if err != nil {
+		rlog.Error("failed to load notification preferences", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load preferences").Err()
+	}
+	p.DiscordAvailable = channelAvailable(channelDiscord, recipient)
+	p.EmailAvailable = channelAvailable(channelEmail, recipient)
+
+	if req.Discord != nil {
+		if *req.Discord && !p.DiscordAvailable {
+			return nil, errs.B().Code(errs.FailedPrecondition).
+				Msg("Discord notifications need a linked Discord account and a bot token on the server").Err()
+		}
+		p.Discord = *req.Discord
+	}
+	if req.Email != nil {
+		if *req.Email && !p.EmailAvailable {
+			return nil, errs.B().Code(errs.FailedPrecondition).
+				Msg("email notifications need an email address on the account and SMTP on the server").Err()
+		}
+		p.Email = *req.Email
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO notification_preferences (user_id, discord_enabled, email_enabled, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET
+			discord_enabled = EXCLUDED.discord_enabled,
+			email_enabled = EXCLUDED.email_enabled,
+			updated_at = NOW()
+	`, userData.UserID, p.Discord, p.Email)
+	if err != nil {
+		rlog.Error("failed to save notification preferences", "error", err, "user_id", userData.UserID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to save preferences").Err()
+	}
+	return p, nil
+}
+
+// Delivery is a notification sent, or attempted, on one channel
+type Delivery struct {
+	ID           int64      `json:"id"`
+	Kind         string     `json:"kind"`
+	Channel      string     `json:"channel"`
+	Subject      string     `json:"subject"`
+	Status       string     `json:"status"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	Attempts     int        `json:"attempts"`
+	CreatedAt    time.Time  `json:"created_at"`
+	SentAt       *time.Time `json:"sent_at,omitempty"`
+}
+
+// ListNotificationsResponse contains the caller's recent notifications
+type ListNotificationsResponse struct {
+	Notifications []Delivery `json:"notifications"`
+}
+
+// ListNotifications returns the 50 most recent notifications of the caller
+//
+//encore:api auth method=GET path=/notifications
+func ListNotifications(ctx context.Context) (*ListNotificationsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT id, kind, channel, subject, status, COALESCE(error_message, ''), attempts, created_at, sent_at
+		FROM notification_deliveries
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 50
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list notifications").Err()
+	}
+	defer rows.Close()
+
+	resp := &ListNotificationsResponse{Notifications: []Delivery{}}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Channel, &d.Subject, &d.Status, &d.ErrorMessage,
+			&d.Attempts, &d.CreatedAt, &d.SentAt); err != nil {
+			continue
+		}
+		resp.Notifications = append(resp.Notifications, d)
+	}
+	return resp, nil
+}
+
+// notify delivers msg to the recipient on every channel they enabled that
+// can reach them. Channels an earlier delivery of the same event already
+// reached are skipped, so redelivered events don't notify twice. Only
+// failures worth retrying are returned.
+func notify(ctx context.Context, eventKey, kind string, recipient *authpkg.NotificationRecipient, msg message) error {
+	prefs, err := loadPreferences(ctx, recipient.UserID)
+	if err != nil {
+		return err
+	}
+
+	var retry error
+	for _, channel := range []string{channelDiscord, channelEmail} {
+		enabled := prefs.Discord
+		if channel == channelEmail {
+			enabled = prefs.Email
+		}
+		if !enabled || !channelAvailable(channel, recipient) {
+			continue
+		}
+
+		var sent bool
+		err := db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM notification_deliveries
+				WHERE event_key = $1 AND user_id = $2 AND channel = $3 AND status = 'sent'
+			)
+		`, eventKey, recipient.UserID, channel).Scan(&sent)
+		if err != nil {
+			return err
+		}
+		if sent {
+			continue
+		}
+
+		var sendErr error
+		if channel == channelDiscord {
+			sendErr = sendDiscordDM(ctx, recipient.DiscordID, msg)
+		} else {
+			sendErr = sendEmail(recipient.Email, msg)
+		}
+
+		status, errMessage := "sent", ""
+		if sendErr != nil {
+			status, errMessage = "failed", sendErr.Error()
+		}
+		_, err = db.Exec(ctx, `
+			INSERT INTO notification_deliveries (event_key, user_id, kind, channel, subject, status, error_message, sent_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), CASE WHEN $6 = 'sent' THEN NOW() END)
+			ON CONFLICT (event_key, user_id, channel) DO UPDATE SET
+				status = EXCLUDED.status,
+				error_message = EXCLUDED.error_message,
+				attempts = notification_deliveries.attempts + 1,
+				sent_at = EXCLUDED.sent_at
+		`, eventKey, recipient.UserID, kind, channel, msg.Subject, status, errMessage)
+		if err != nil {
+			rlog.Error("failed to record notification", "error", err, "user_id", recipient.UserID, "channel", channel)
+		}
+
+		if sendErr != nil {
+			rlog.Warn("failed to deliver notification", "error", sendErr,
+				"user_id", recipient.UserID, "kind", kind, "channel", channel)
+			var permanent *permanentError
+			if !errors.As(sendErr, &permanent) {
+				retry = sendErr
+			}
+		}
+	}
+	return retry
+}
+
+// lookupRecipient returns how to reach a user; nil without an error for
+// users that are gone or being deleted
+func lookupRecipient(ctx context.Context, userID int64) (*authpkg.NotificationRecipient, error) {
+	recipient, err := authpkg.GetNotificationRecipient(ctx, &authpkg.UserSettingsRequest{UserID: userID})
+	if errs.Code(err) == errs.NotFound {
+		return nil, nil
+	}
+	return recipient, err
+}
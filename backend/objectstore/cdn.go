@@ -0,0 +1,226 @@
+package objectstore
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/metrics"
+)
+
+// CDN providers playback URLs can be signed for
+const (
+	CDNCloudFront = "cloudfront"
+	CDNBunny      = "bunny"
+)
+
+// CDNConfig is the CDN processed media is served through; Provider is
+// empty when media is served by presigned bucket URLs
+type CDNConfig struct {
+	Provider string
+	// BaseURL is where the CDN serves the bucket's root, e.g.
+	// https://cdn.example.com
+	BaseURL string
+	// KeyPairID is the CloudFront public key (or key pair) ID
+	KeyPairID string
+	// SigningKey is the CloudFront private key in PEM or the Bunny token
+	// authentication key
+	SigningKey string
+	// Cookies makes DASH manifests use signed cookies for their segments
+	// instead of signing every segment URL (CloudFront only)
+	Cookies bool
+	// CookieDomain is the domain signed cookies are set for, shared by the
+	// API and the CDN
+	CookieDomain string
+}
+
+// LoadCDN returns the CDN settings from CDN_PROVIDER, CDN_BASE_URL,
+// CDN_KEY_PAIR_ID, CDN_SIGNING_KEY, CDN_SIGNED_COOKIES and
+// CDN_COOKIE_DOMAIN, which take per-environment overrides like the S3
+// settings. An incomplete configuration serves media from the bucket.
+func LoadCDN() CDNConfig {
+	cfg := CDNConfig{
+		Provider:     strings.ToLower(lookup("CDN_PROVIDER", "")),
+		BaseURL:      strings.TrimSuffix(lookup("CDN_BASE_URL", ""), "/"),
+		KeyPairID:    lookup("CDN_KEY_PAIR_ID", ""),
+		SigningKey:   strings.ReplaceAll(lookup("CDN_SIGNING_KEY", ""), `\n`, "\n"),
+		CookieDomain: lookup("CDN_COOKIE_DOMAIN", ""),
+	}
+	switch {
+	case cfg.BaseURL == "" || cfg.SigningKey == "":
+		cfg.Provider = ""
+	case cfg.Provider == CDNCloudFront:
+		if cfg.KeyPairID == "" {
+			cfg.Provider = ""
+		}
+		cfg.Cookies = lookup("CDN_SIGNED_COOKIES", "false") == "true"
+	case cfg.Provider != CDNBunny:
+		cfg.Provider = ""
+	}
+	return cfg
+}
+
+// PlaybackURL returns a URL that serves an object for ttl (plus the clock
+// skew allowance): signed for the CDN when one is configured, otherwise
+// presigned by the bucket. Only objects handed to players and browsers go
+// through here; workers and ffmpeg read from the bucket directly.
+func PlaybackURL(ctx context.Context, client *minio.Client, key string, ttl time.Duration) (*url.URL, error) {
+	ttl = signedTTL(ttl)
+	cfg := LoadCDN()
+	if cfg.Provider == "" {
+		return metrics.PresignedGetObject(ctx, client, Bucket(), key, ttl, nil)
+	}
+
+	start := time.Now()
+	u, err := cfg.SignURL(key, time.Now().Add(ttl))
+	metrics.ObservePresign("cdn", start)
+	return u, err
+}
+
+// ObjectURL returns the unsigned CDN URL of an object
+func (c CDNConfig) ObjectURL(key string) string {
+	return c.BaseURL + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// SignURL returns the CDN URL of an object, signed until expires
+func (c CDNConfig) SignURL(key string, expires time.Time) (*url.URL, error) {
+	u, err := url.Parse(c.ObjectURL(key))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	switch c.Provider {
+	case CDNCloudFront:
+		// A canned policy only limits the URL and expiry
+		policy := fmt.Sprintf(`{"Statement":[{"Resource":%q,"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+			u.String(), expires.Unix())
+		signature, err := c.signCloudFront(policy)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("Expires", strconv.FormatInt(expires.Unix(), 10))
+		q.Set("Signature", signature)
+		q.Set("Key-Pair-Id", c.KeyPairID)
+	case CDNBunny:
+		// Bunny token authentication hashes the key, path and expiry
+		sum := sha256.Sum256([]byte(c.SigningKey + u.EscapedPath() + strconv.FormatInt(expires.Unix(), 10)))
+		token := base64.StdEncoding.EncodeToString(sum[:])
+		token = strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(token)
+		q.Set("token", token)
+		q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	default:
+		return nil, errors.New("objectstore: no CDN configured")
+	}
+
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
+// SignedCookies returns CloudFront cookies granting access to every object
+// under prefix until expires
+func (c CDNConfig) SignedCookies(prefix string, expires time.Time) ([]*http.Cookie, error) {
+	if c.Provider != CDNCloudFront || !c.Cookies {
+		return nil, errors.New("objectstore: signed cookies need CloudFront with CDN_SIGNED_COOKIES")
+	}
+	// A custom policy allows a wildcard resource
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":%q,"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`,
+		c.ObjectURL(prefix)+"*", expires.Unix())
+	signature, err := c.signCloudFront(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{
+		"CloudFront-Policy":      cloudFrontEncode([]byte(policy)),
+		"CloudFront-Signature":   signature,
+		"CloudFront-Key-Pair-Id": c.KeyPairID,
+	}
+	var cookies []*http.Cookie
+	for _, name := range []string{"CloudFront-Policy", "CloudFront-Signature", "CloudFront-Key-Pair-Id"} {
+		cookies = append(cookies, &http.Cookie{
+			Name:     name,
+			Value:    values[name],
+			Path:     "/",
+			Domain:   c.CookieDomain,
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	return cookies, nil
+}
+
+// signCloudFront signs a policy with the CloudFront private key
+func (c CDNConfig) signCloudFront(policy string) (string, error) {
+	key, err := parsePrivateKey(c.SigningKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(policy))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return cloudFrontEncode(signature), nil
+}
+
+// cloudFrontEncode is base64 with the characters CloudFront substitutes to
+// keep it URL safe
+func cloudFrontEncode(data []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(data))
+}
+
+// privateKeys caches parsed signing keys, since a DASH manifest signs
+// every segment
+var privateKeys = struct {
+	sync.Mutex
+	byPEM map[string]*rsa.PrivateKey
+}{byPEM: map[string]*rsa.PrivateKey{}}
+
+// parsePrivateKey parses an RSA private key in PKCS #1 or PKCS #8 PEM
+func parsePrivateKey(pemData string) (*rsa.PrivateKey, error) {
+	privateKeys.Lock()
+	defer privateKeys.Unlock()
+	if key, ok := privateKeys.byPEM[pemData]; ok {
+		return key, nil
+	}
+
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil {
+		return nil, errors.New("objectstore: CDN_SIGNING_KEY is not a PEM key")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("objectstore: failed to parse CDN_SIGNING_KEY: %w", err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("objectstore: CDN_SIGNING_KEY is not an RSA key")
+		}
+		key = rsaKey
+	}
+	privateKeys.byPEM[pemData] = key
+	return key, nil
+}
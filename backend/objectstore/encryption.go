@@ -0,0 +1,159 @@
+package objectstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+
+	"encore.app/metrics"
+)
+
+// Server-side encryption modes
+const (
+	// SSENone stores objects as the bucket's defaults say
+	SSENone = ""
+	// SSES3 encrypts objects with keys managed by the storage (AES256)
+	SSES3 = "s3"
+	// SSEKMS encrypts objects with a key of the key management service
+	SSEKMS = "kms"
+)
+
+// EncryptionConfig is how objects written by the services and by uploaders
+// are encrypted at rest
+type EncryptionConfig struct {
+	Mode string
+	// KMSKeyID is the KMS key of SSEKMS; empty uses the storage's default
+	// key
+	KMSKeyID string
+}
+
+// LoadEncryption returns the encryption settings from SSE_MODE ("s3" or
+// "kms") and SSE_KMS_KEY_ID, which take per-environment overrides like the
+// S3 settings. Any other non-empty mode encrypts with SSE-S3 rather than
+// storing objects unencrypted by mistake.
+func LoadEncryption() EncryptionConfig {
+	cfg := EncryptionConfig{
+		Mode:     strings.ToLower(lookup("SSE_MODE", "")),
+		KMSKeyID: lookup("SSE_KMS_KEY_ID", ""),
+	}
+	switch cfg.Mode {
+	case SSENone, "none":
+		cfg.Mode = SSENone
+	case SSEKMS:
+	default:
+		cfg.Mode = SSES3
+	}
+	return cfg
+}
+
+// serverSide returns the encryption to request, nil for none
+func (c EncryptionConfig) serverSide() (encrypt.ServerSide, error) {
+	switch c.Mode {
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEKMS:
+		return encrypt.NewSSEKMS(c.KMSKeyID, nil)
+	}
+	return nil, nil
+}
+
+// putOptions adds the configured encryption to the options of an upload
+func putOptions(opts minio.PutObjectOptions) (minio.PutObjectOptions, error) {
+	sse, err := LoadEncryption().serverSide()
+	if err != nil {
+		return opts, err
+	}
+	if sse != nil {
+		opts.ServerSideEncryption = sse
+	}
+	return opts, nil
+}
+
+// PutObject uploads an object like the client method of the same name,
+// encrypted as configured
+func PutObject(ctx context.Context, client *minio.Client, key string, r io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	opts, err := putOptions(opts)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return client.PutObject(ctx, Bucket(), key, r, size, opts)
+}
+
+// FPutObject uploads a file like the client method of the same name,
+// encrypted as configured
+func FPutObject(ctx context.Context, client *minio.Client, key, path string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	opts, err := putOptions(opts)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return client.FPutObject(ctx, Bucket(), key, path, opts)
+}
+
+// PresignedPut presigns an upload URL for an object, valid for ttl plus
+// the clock skew allowance. With encryption on, the encryption headers are
+// part of the signature, so the uploader must send the returned headers
+// with the PUT.
+func PresignedPut(ctx context.Context, client *minio.Client, key string, ttl time.Duration) (*url.URL, map[string]string, error) {
+	ttl = signedTTL(ttl)
+	sse, err := LoadEncryption().serverSide()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sse == nil {
+		u, err := metrics.PresignedPutObject(ctx, client, Bucket(), key, ttl)
+		return u, nil, err
+	}
+
+	header := http.Header{}
+	sse.Marshal(header)
+	start := time.Now()
+	u, err := client.PresignHeader(ctx, http.MethodPut, Bucket(), key, ttl, nil, header)
+	metrics.ObservePresign("put", start)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string]string{}
+	for name := range header {
+		headers[name] = header.Get(name)
+	}
+	return u, headers, nil
+}
+
+// PresignedPost presigns a browser POST upload of an object limited to
+// maxSize bytes, valid for ttl plus the clock skew allowance. The uploader
+// sends the returned fields, then the file, as multipart form data; storage
+// rejects larger files before they are stored.
+func PresignedPost(ctx context.Context, client *minio.Client, key string, ttl time.Duration, maxSize int64) (*url.URL, map[string]string, error) {
+	sse, err := LoadEncryption().serverSide()
+	if err != nil {
+		return nil, nil, err
+	}
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(Bucket()); err != nil {
+		return nil, nil, err
+	}
+	if err := policy.SetKey(key); err != nil {
+		return nil, nil, err
+	}
+	if err := policy.SetExpires(time.Now().UTC().Add(signedTTL(ttl))); err != nil {
+		return nil, nil, err
+	}
+	if err := policy.SetContentLengthRange(1, maxSize); err != nil {
+		return nil, nil, err
+	}
+	if sse != nil {
+		policy.SetEncryption(sse)
+	}
+
+	start := time.Now()
+	u, fields, err := client.PresignedPostPolicy(ctx, policy)
+	metrics.ObservePresign("post", start)
+	return u, fields, err
+}
@@ -0,0 +1,109 @@
+// Package objectstore holds the S3 settings every service shares and the
+// MinIO clients built from them. It has no endpoints of its own: services
+// ask it for a client with their S3 secrets, since Encore secrets belong to
+// a service. Clients are created once per service and settings and reused,
+// so their connections are pooled by the transport underneath.
+package objectstore
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"encore.dev"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"encore.app/metrics"
+)
+
+// Config is where objects are stored
+type Config struct {
+	Endpoint string
+	Bucket   string
+	UseSSL   bool
+	// Region is empty to let the client look it up
+	Region string
+}
+
+// Load returns the S3 settings from S3_ENDPOINT, S3_BUCKET, S3_USE_SSL and
+// S3_REGION. Each can be overridden for one Encore environment by the same
+// variable suffixed with the environment's name, e.g. S3_BUCKET_STAGING.
+func Load() Config {
+	return Config{
+		Endpoint: lookup("S3_ENDPOINT", "localhost:9000"),
+		Bucket:   lookup("S3_BUCKET", "media-vault"),
+		UseSSL:   lookup("S3_USE_SSL", "false") == "true",
+		Region:   lookup("S3_REGION", ""),
+	}
+}
+
+// Bucket returns the bucket objects are stored in
+func Bucket() string {
+	return Load().Bucket
+}
+
+// lookup returns an environment variable, preferring its override for the
+// current environment
+func lookup(key, defaultVal string) string {
+	if suffix := envSuffix(); suffix != "" {
+		if val := os.Getenv(key + "_" + suffix); val != "" {
+			return val
+		}
+	}
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+// envSuffix returns the name of the current Encore environment as used in
+// override variables: upper case, with anything but letters and digits as _
+func envSuffix() string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, encore.Meta().Environment.Name)
+}
+
+// clients are the MinIO clients created so far, by service, settings and
+// access key; a client is safe for concurrent use
+var clients = struct {
+	sync.Mutex
+	byKey map[string]*minio.Client
+}{byKey: map[string]*minio.Client{}}
+
+// Client returns the MinIO client of a service for the current settings,
+// creating it on first use. The service name labels its S3 metrics.
+func Client(service, accessKey, secretKey string) (*minio.Client, error) {
+	cfg := Load()
+	key := strings.Join([]string{service, cfg.Endpoint, cfg.Region, strconv.FormatBool(cfg.UseSSL), accessKey, secretKey}, "\x00")
+
+	clients.Lock()
+	defer clients.Unlock()
+	if client, ok := clients.byKey[key]; ok {
+		return client, nil
+	}
+
+	transport, err := metrics.S3Transport(service, cfg.UseSSL)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:    cfg.UseSSL,
+		Region:    cfg.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clients.byKey[key] = client
+	return client, nil
+}
@@ -0,0 +1,65 @@
+package objectstore
+
+import (
+	"context"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ColdBucket returns the bucket rarely used originals are moved to
+// (COLD_STORAGE_BUCKET); empty when tiering is off
+func ColdBucket() string {
+	return lookup("COLD_STORAGE_BUCKET", "")
+}
+
+// ColdStorageClass returns the storage class of objects moved to the cold
+// bucket (COLD_STORAGE_CLASS, e.g. STANDARD_IA); empty keeps the bucket's
+// default
+func ColdStorageClass() string {
+	return lookup("COLD_STORAGE_CLASS", "")
+}
+
+// CopyObject copies an object to the same key in another bucket, encrypted
+// as configured and with storageClass unless it's empty. Objects larger
+// than a single copy allows are copied in parts.
+func CopyObject(ctx context.Context, client *minio.Client, key, srcBucket, dstBucket, storageClass string) error {
+	return copyObject(ctx, client, srcBucket, key, dstBucket, key, storageClass)
+}
+
+// CopyToKey copies an object to another key of the bucket, encrypted as
+// configured
+func CopyToKey(ctx context.Context, client *minio.Client, srcKey, dstKey string) error {
+	return copyObject(ctx, client, Bucket(), srcKey, Bucket(), dstKey, "")
+}
+
+func copyObject(ctx context.Context, client *minio.Client, srcBucket, srcKey, dstBucket, dstKey, storageClass string) error {
+	sse, err := LoadEncryption().serverSide()
+	if err != nil {
+		return err
+	}
+	dst := minio.CopyDestOptions{Bucket: dstBucket, Object: dstKey}
+	if sse != nil {
+		dst.Encryption = sse
+	}
+
+	// Setting the class replaces the metadata, so the original's is carried
+	// over
+	if storageClass != "" {
+		info, err := client.StatObject(ctx, srcBucket, srcKey, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = map[string]string{}
+		for name, value := range info.UserMetadata {
+			dst.UserMetadata[name] = value
+		}
+		if info.ContentType != "" {
+			dst.UserMetadata["Content-Type"] = info.ContentType
+		}
+		dst.UserMetadata["X-Amz-Storage-Class"] = storageClass
+	}
+
+	_, err = client.ComposeObject(ctx, dst, minio.CopySrcOptions{Bucket: srcBucket, Object: srcKey})
+	return err
+}
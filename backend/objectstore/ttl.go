@@ -0,0 +1,54 @@
+package objectstore
+
+import (
+	"time"
+)
+
+// Bounds of presigned URL lifetimes; S3 allows at most 7 days
+const (
+	MinUploadTTL = time.Minute
+	MinStreamTTL = 5 * time.Minute
+	MaxURLTTL    = 7 * 24 * time.Hour
+	// maxClockSkew is the most PRESIGN_CLOCK_SKEW may add
+	maxClockSkew = 15 * time.Minute
+)
+
+// UploadTTL returns how long presigned upload URLs are valid by default
+// (UPLOAD_URL_TTL, 15m)
+func UploadTTL() time.Duration {
+	return durationSetting("UPLOAD_URL_TTL", 15*time.Minute, MinUploadTTL, MaxURLTTL)
+}
+
+// MaxUploadTTL returns the longest upload URL lifetime a request may ask
+// for (UPLOAD_URL_MAX_TTL, 12h), never below UploadTTL
+func MaxUploadTTL() time.Duration {
+	return max(durationSetting("UPLOAD_URL_MAX_TTL", 12*time.Hour, MinUploadTTL, MaxURLTTL), UploadTTL())
+}
+
+// StreamTTL returns how long stream, thumbnail and other playback URLs are
+// valid for users who didn't choose a lifetime (STREAM_URL_TTL, 4h)
+func StreamTTL() time.Duration {
+	return durationSetting("STREAM_URL_TTL", 4*time.Hour, MinStreamTTL, MaxURLTTL)
+}
+
+// ClockSkew returns the slack added to the lifetime of every URL handed
+// out (PRESIGN_CLOCK_SKEW, 1m), so a storage or CDN clock running ahead of
+// ours doesn't end a URL early
+func ClockSkew() time.Duration {
+	return durationSetting("PRESIGN_CLOCK_SKEW", time.Minute, 0, maxClockSkew)
+}
+
+// signedTTL is the lifetime to sign a URL for that should be valid for ttl
+func signedTTL(ttl time.Duration) time.Duration {
+	return min(ttl+ClockSkew(), MaxURLTTL)
+}
+
+// durationSetting parses a duration setting, keeping it within bounds;
+// invalid values use the default
+func durationSetting(key string, defaultVal, minVal, maxVal time.Duration) time.Duration {
+	d, err := time.ParseDuration(lookup(key, ""))
+	if err != nil {
+		return defaultVal
+	}
+	return min(max(d, minVal), maxVal)
+}
@@ -0,0 +1,74 @@
+package processing
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+)
+
+// Deleting an account removes the processing history of the user's media
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "processing-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountJobs,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// Deleting media, also with its owner's account, removes its processing jobs
+var _ = pubsub.NewSubscription(media.MediaDeletedTopic, "processing-media-cleanup",
+	pubsub.SubscriptionConfig[*media.MediaDeleted]{
+		Handler: deleteMediaJobs,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteMediaJobs deletes the processing jobs of a deleted media item and
+// drops it from the bulk reprocess queue
+func deleteMediaJobs(ctx context.Context, msg *media.MediaDeleted) error {
+	if _, err := db.Exec(ctx, `DELETE FROM bulk_reprocess_queue WHERE media_id = $1`, msg.MediaID); err != nil {
+		return err
+	}
+	_, err := db.Exec(ctx, `DELETE FROM processing_jobs WHERE media_id = $1`, msg.MediaID)
+	return err
+}
+
+// deleteAccountJobs deletes the dead letters of a deleted account's media.
+// Their jobs go with the MediaDeleted messages the media service sends for
+// every item it deletes, so this doesn't race it for the media rows.
+func deleteAccountJobs(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM processing_jobs WHERE media_id IN (SELECT media_id FROM dead_letters WHERE owner_id = $1)
+	`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	deleted := int(result.RowsAffected())
+
+	result, err = db.Exec(ctx, `DELETE FROM dead_letters WHERE owner_id = $1`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	deleted += int(result.RowsAffected())
+
+	if _, err := db.Exec(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1`, msg.UserID); err != nil {
+		return err
+	}
+
+	rlog.Info("account processing history deleted", "user_id", msg.UserID, "deleted", deleted)
+	return authpkg.ReportDeletionProgress(ctx, &authpkg.DeletionProgress{
+		DeletionID:   msg.DeletionID,
+		Service:      "processing",
+		DeletedItems: deleted,
+	})
+}
@@ -0,0 +1,177 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// AdminListJobsRequest contains filters and pagination for the admin job listing
+type AdminListJobsRequest struct {
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+	Status   string `query:"status"`
+	// From and To bound the job creation time (RFC 3339)
+	From string `query:"from"`
+	To   string `query:"to"`
+	// MinDuration and MaxDuration bound the job run time in seconds
+	MinDuration int `query:"min_duration"`
+	MaxDuration int `query:"max_duration"`
+}
+
+// AdminJob is a processing job with its owner
+type AdminJob struct {
+	JobAttempt
+	MediaID string `json:"media_id"`
+	OwnerID int64  `json:"owner_id,omitempty"`
+}
+
+// AdminListJobsResponse contains matching jobs and pipeline health aggregates
+type AdminListJobsResponse struct {
+	Items      []AdminJob `json:"items"`
+	TotalCount int        `json:"total_count"`
+	Page       int        `json:"page"`
+	PageSize   int        `json:"page_size"`
+	// QueueDepth is the number of media waiting for a worker
+	QueueDepth int `json:"queue_depth"`
+	// Processing is the number of jobs currently running
+	Processing int `json:"processing"`
+	// AvgTranscodeSeconds is the mean run time of completed jobs matching the filters
+	AvgTranscodeSeconds float64 `json:"avg_transcode_seconds"`
+}
+
+// AdminListJobs lists processing jobs across all users (admin only)
+//
+//encore:api auth method=GET path=/admin/processing/jobs
+func AdminListJobs(ctx context.Context, req *AdminListJobsRequest) (*AdminListJobsResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	// Set defaults
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	// Build filters
+	where := " WHERE 1=1"
+	var args []interface{}
+	argIndex := 1
+
+	if req.Status != "" {
+		where += fmt.Sprintf(" AND status = $%d", argIndex)
+		args = append(args, req.Status)
+		argIndex++
+	}
+	if req.From != "" {
+		from, err := time.Parse(time.RFC3339, req.From)
+		if err != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("from must be an RFC 3339 timestamp").Err()
+		}
+		where += fmt.Sprintf(" AND created_at >= $%d", argIndex)
+		args = append(args, from)
+		argIndex++
+	}
+	if req.To != "" {
+		to, err := time.Parse(time.RFC3339, req.To)
+		if err != nil {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("to must be an RFC 3339 timestamp").Err()
+		}
+		where += fmt.Sprintf(" AND created_at < $%d", argIndex)
+		args = append(args, to)
+		argIndex++
+	}
+	if req.MinDuration > 0 {
+		where += fmt.Sprintf(" AND completed_at - started_at >= make_interval(secs => $%d)", argIndex)
+		args = append(args, req.MinDuration)
+		argIndex++
+	}
+	if req.MaxDuration > 0 {
+		where += fmt.Sprintf(" AND completed_at - started_at <= make_interval(secs => $%d)", argIndex)
+		args = append(args, req.MaxDuration)
+		argIndex++
+	}
+
+	// Aggregates over the filtered jobs
+	var resp AdminListJobsResponse
+	var avg *float64
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*),
+			   AVG(EXTRACT(EPOCH FROM (completed_at - started_at))) FILTER (WHERE status = 'completed')::float8
+		FROM processing_jobs`+where, args...).Scan(&resp.TotalCount, &avg); err != nil {
+		rlog.Error("failed to aggregate processing jobs", "error", err)
+	}
+	if avg != nil {
+		resp.AvgTranscodeSeconds = *avg
+	}
+
+	// Pipeline health, independent of the filters
+	_ = mediaDB.QueryRow(ctx, `SELECT COUNT(*) FROM media WHERE status = 'queued'`).Scan(&resp.QueueDepth)
+	_ = db.QueryRow(ctx, `SELECT COUNT(*) FROM processing_jobs WHERE status = 'processing'`).Scan(&resp.Processing)
+
+	// Add pagination
+	query := `
+		SELECT id, media_id, status, COALESCE(preset, ''), COALESCE(packaging, ''), COALESCE(attempt, 0),
+			   COALESCE(error_message, ''), started_at, completed_at,
+			   EXTRACT(EPOCH FROM (completed_at - started_at))::float8, created_at
+		FROM processing_jobs` + where
+	query += " ORDER BY created_at DESC"
+	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", argIndex, argIndex+1)
+	args = append(args, pageSize, offset)
+
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		rlog.Error("failed to query processing jobs", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list jobs").Err()
+	}
+	defer rows.Close()
+
+	var items []AdminJob
+	var mediaIDs []string
+	for rows.Next() {
+		var j AdminJob
+		if err := rows.Scan(&j.ID, &j.MediaID, &j.Status, &j.Preset, &j.Packaging, &j.Attempt,
+			&j.ErrorMessage, &j.StartedAt, &j.CompletedAt, &j.DurationSeconds, &j.CreatedAt); err != nil {
+			continue
+		}
+		items = append(items, j)
+		mediaIDs = append(mediaIDs, j.MediaID)
+	}
+
+	// Resolve owners from the media database
+	if len(mediaIDs) > 0 {
+		owners := make(map[string]int64)
+		ownerRows, err := mediaDB.Query(ctx, `SELECT id, owner_id FROM media WHERE id = ANY($1::uuid[])`, mediaIDs)
+		if err == nil {
+			for ownerRows.Next() {
+				var id string
+				var ownerID int64
+				if err := ownerRows.Scan(&id, &ownerID); err == nil {
+					owners[id] = ownerID
+				}
+			}
+			ownerRows.Close()
+		}
+		for i := range items {
+			items[i].OwnerID = owners[items[i].MediaID]
+		}
+	}
+
+	if items == nil {
+		items = []AdminJob{}
+	}
+
+	resp.Items = items
+	resp.Page = page
+	resp.PageSize = pageSize
+	return &resp, nil
+}
@@ -0,0 +1,200 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// Limits for animations rendered from a video segment
+const (
+	maxAnimationSeconds = 15
+	maxAnimationFPS     = 30
+	maxAnimationWidth   = 720
+)
+
+// CreateAnimationRequest selects the segment and size of an animation
+type CreateAnimationRequest struct {
+	StartSeconds    float64 `json:"start_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// FPS defaults to 12 and Width (pixels, height follows the aspect ratio) to 480
+	FPS   int `json:"fps,omitempty"`
+	Width int `json:"width,omitempty"`
+	// Format is "gif" (default) or "webp" (animated WebP)
+	Format string `json:"format,omitempty"`
+}
+
+// CreateAnimationResponse contains the rendered animation
+type CreateAnimationResponse struct {
+	MediaID   string    `json:"media_id"`
+	URL       string    `json:"url"`
+	SizeBytes int64     `json:"size_bytes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateAnimation renders a segment of a video as an optimized GIF or
+// animated WebP, stored next to the media's other derived files and counted
+// against the media's quota. Requests for the same segment, frame rate,
+// width and format reuse the stored animation. Rendering takes one of the
+// PROCESSING_MAX_CONCURRENCY slots.
+//
+//encore:api auth method=POST path=/media/:id/gif
+func CreateAnimation(ctx context.Context, id string, req *CreateAnimationRequest) (*CreateAnimationResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	fps := req.FPS
+	if fps == 0 {
+		fps = 12
+	}
+	width := req.Width
+	if width == 0 {
+		width = 480
+	}
+	format := req.Format
+	if format == "" {
+		format = "gif"
+	}
+	if format != "gif" && format != "webp" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("format must be 'gif' or 'webp'").Err()
+	}
+	if req.StartSeconds < 0 || req.DurationSeconds <= 0 || req.DurationSeconds > maxAnimationSeconds {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg(fmt.Sprintf("duration_seconds must be between 0 and %d", maxAnimationSeconds)).Err()
+	}
+	if fps < 1 || fps > maxAnimationFPS || width < 16 || width > maxAnimationWidth {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg(fmt.Sprintf("fps must be at most %d and width at most %d", maxAnimationFPS, maxAnimationWidth)).Err()
+	}
+
+	// Verify access
+	var ownerID int64
+	var s3Key, mimeType, status, teamID string
+	var duration int
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, s3_key_original, COALESCE(mime_type, ''), status, COALESCE(duration_seconds, 0),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &s3Key, &mimeType, &status, &duration, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "ready" || classifyMedia(mimeType, s3Key, nil) != kindVideo {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("animations are only available for ready videos").Err()
+	}
+	if duration > 0 && req.StartSeconds >= float64(duration) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("start_seconds is outside the video").Err()
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+
+	// The same segment and size is rendered once and served again after
+	animationKey := fmt.Sprintf("derived/%s/animation-%d-%d-%d-%d.%s", id,
+		int64(req.StartSeconds*1000), int64(req.DurationSeconds*1000), fps, width, format)
+	ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+	if info, err := client.StatObject(ctx, objectstore.Bucket(), animationKey, minio.StatObjectOptions{}); err == nil {
+		return animationResponse(ctx, client, id, animationKey, info.Size, ttl)
+	}
+
+	if err := media.CheckDerivedQuota(ctx, &media.CheckDerivedQuotaRequest{MediaID: id}); err != nil {
+		return nil, err
+	}
+	if err := useOriginal(ctx, id); err != nil {
+		return nil, err
+	}
+
+	// ffmpeg seeks over HTTP, so only the needed part of the original is read
+	inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), s3Key, streamingInputTTL(), nil)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign original").Err()
+	}
+
+	tempDir, err := os.MkdirTemp("", "media-animation-")
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create temp directory").Err()
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Renders share the transcode slots, so they can't starve the queue's
+	// workers of CPU; the request waits for one as long as the client does
+	if err := acquireSlot(ctx); err != nil {
+		return nil, errs.B().Code(errs.Unavailable).Msg("all transcode slots are busy, try again").Err()
+	}
+	defer releaseSlot()
+
+	outputPath := filepath.Join(tempDir, "animation."+format)
+	if err := renderAnimation(ctx, inputURL.String(), outputPath, req.StartSeconds, req.DurationSeconds, fps, width, format); err != nil {
+		rlog.Error("failed to render animation", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to render animation").Err()
+	}
+
+	info, err := objectstore.FPutObject(ctx, client, animationKey, outputPath,
+		minio.PutObjectOptions{ContentType: "image/" + format})
+	if err != nil {
+		rlog.Error("failed to upload animation", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to store animation").Err()
+	}
+
+	return animationResponse(ctx, client, id, animationKey, info.Size, ttl)
+}
+
+// animationResponse signs a stored animation
+func animationResponse(ctx context.Context, client *minio.Client, mediaID, key string, size int64, ttl time.Duration) (*CreateAnimationResponse, error) {
+	url, err := objectstore.PlaybackURL(ctx, client, key, ttl)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign animation").Err()
+	}
+
+	return &CreateAnimationResponse{
+		MediaID:   mediaID,
+		URL:       url.String(),
+		SizeBytes: size,
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
+
+// renderAnimation encodes a segment as a GIF with a palette generated for the
+// segment (much smaller and cleaner than the default palette) or as an
+// animated WebP
+func renderAnimation(ctx context.Context, inputURL, outputPath string, start, duration float64, fps, width int, format string) error {
+	filter := fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos", fps, width)
+	args := []string{
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-t", strconv.FormatFloat(duration, 'f', 3, 64),
+		"-i", inputURL,
+		"-an",
+	}
+
+	if format == "gif" {
+		args = append(args,
+			"-vf", filter+",split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer:bayer_scale=5:diff_mode=rectangle",
+		)
+	} else {
+		args = append(args, "-vf", filter, "-c:v", "libwebp", "-quality", "70", "-compression_level", "6")
+	}
+	args = append(args, "-loop", "0", "-y", outputPath)
+
+	if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+		return &ffmpegError{Op: "ffmpeg animation", Err: err, Output: string(output)}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package processing
+
+import (
+	"context"
+)
+
+func init() {
+	registerHandler(kindAudio, processAudio)
+}
+
+// audioPresetName is used for audio sources when the job's preset encodes video
+const audioPresetName = "audio-only"
+
+// processAudio transcodes an audio-only source with an audio preset
+func processAudio(ctx context.Context, job *pipelineJob) (pipelineResult, error) {
+	preset := job.Preset
+	if preset.Codec != "" {
+		preset = presets[audioPresetName]
+	}
+
+	tracks := selectAudioTracks(job.Probe, job.AudioLanguages)
+	recordAudioTracks(ctx, job.MediaID, tracks)
+	encoderArgs := append(streamMapArgs(tracks), preset.FFmpegArgs()...)
+	encoderArgs = applyLoudness(ctx, job, preset, encoderArgs)
+
+	processedKey, err := encodeFile(ctx, job, encoderArgs, preset)
+	if err != nil {
+		return pipelineResult{}, err
+	}
+	return pipelineResult{ProcessedKey: processedKey, Preset: preset.Name}, nil
+}
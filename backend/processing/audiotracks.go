@@ -0,0 +1,82 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"encore.dev/rlog"
+
+	"encore.app/media"
+)
+
+// selectAudioTracks returns the source audio tracks to keep: those matching
+// one of languages (ISO 639-2 codes, case-insensitive), or all of them when
+// languages is empty or none match
+func selectAudioTracks(probe *probeResult, languages []string) []media.AudioTrack {
+	if probe == nil {
+		return nil
+	}
+
+	var all, matched []media.AudioTrack
+	for _, s := range probe.Streams {
+		if s.CodecType != "audio" {
+			continue
+		}
+		track := media.AudioTrack{
+			Index:    len(all),
+			Codec:    s.CodecName,
+			Language: s.Tags.Language,
+			Title:    s.Tags.Title,
+			Channels: s.Channels,
+			Default:  s.Disposition.Default == 1,
+		}
+		all = append(all, track)
+
+		for _, lang := range languages {
+			if strings.EqualFold(lang, track.Language) {
+				matched = append(matched, track)
+				break
+			}
+		}
+	}
+
+	if len(matched) > 0 {
+		return matched
+	}
+	return all
+}
+
+// streamMapArgs returns ffmpeg -map arguments selecting the first video
+// stream and the given audio tracks. Without probe data it returns nil and
+// ffmpeg's default stream selection applies.
+func streamMapArgs(tracks []media.AudioTrack) []string {
+	if tracks == nil {
+		return nil
+	}
+
+	args := []string{"-map", "0:v:0?"}
+	for _, t := range tracks {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", t.Index))
+	}
+	return args
+}
+
+// recordAudioTracks stores the kept audio tracks on the media item, renumbered
+// in output order
+func recordAudioTracks(ctx context.Context, mediaID string, tracks []media.AudioTrack) {
+	out := make([]media.AudioTrack, len(tracks))
+	for i, t := range tracks {
+		t.Index = i
+		out[i] = t
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+	if _, err := mediaDB.Exec(ctx, `UPDATE media SET audio_tracks = $2 WHERE id = $1`, mediaID, string(data)); err != nil {
+		rlog.Error("failed to record audio tracks", "error", err, "media_id", mediaID)
+	}
+}
@@ -0,0 +1,271 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/idempotency"
+	"encore.app/media"
+)
+
+// getReprocessRate returns how many media items bulk reprocessing queues per second
+func getReprocessRate() float64 {
+	if r, err := strconv.ParseFloat(os.Getenv("PROCESSING_REPROCESS_RATE"), 64); err == nil && r > 0 {
+		return r
+	}
+	return 2
+}
+
+// BulkReprocessRequest selects the media items to encode again
+type BulkReprocessRequest struct {
+	OwnerID int64 `json:"owner_id,omitempty"`
+	// Status is "ready" or "failed"; both are matched when empty
+	Status string `json:"status,omitempty"`
+	// From and To bound the media creation time
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+	// Codec matches the codec of the original's video or audio stream (e.g. "h264")
+	Codec string `json:"codec,omitempty"`
+	// DryRun only counts the matching media
+	DryRun bool `json:"dry_run,omitempty"`
+	// IdempotencyKey makes retries return the first response instead of
+	// queueing the media again
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+// BulkReprocessResponse reports how many media items are being queued
+type BulkReprocessResponse struct {
+	Matched int     `json:"matched"`
+	Rate    float64 `json:"rate_per_second"`
+	DryRun  bool    `json:"dry_run,omitempty"`
+}
+
+// bulkItem is a media item selected for bulk reprocessing
+type bulkItem struct {
+	mediaID   string
+	ownerID   int64
+	status    string
+	s3Key     string
+	packaging string
+}
+
+// BulkReprocess re-queues all matching media with the current default preset,
+// throttled to PROCESSING_REPROCESS_RATE items per second by the drain job
+// (admin only)
+//
+//encore:api auth method=POST path=/processing/reprocess
+func BulkReprocess(ctx context.Context, req *BulkReprocessRequest) (*BulkReprocessResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+	userData := auth.Data().(*authpkg.UserData)
+	return idempotency.Do(ctx, db, userData.UserID, "processing.BulkReprocess", req.IdempotencyKey, req,
+		func() (*BulkReprocessResponse, error) {
+			return bulkReprocess(ctx, req)
+		})
+}
+
+// bulkReprocess selects the matching media and stores them for the drain job
+func bulkReprocess(ctx context.Context, req *BulkReprocessRequest) (*BulkReprocessResponse, error) {
+	if req.Status != "" && req.Status != "ready" && req.Status != "failed" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("status must be 'ready' or 'failed'").Err()
+	}
+
+	// Build query
+	query := `
+		SELECT id, owner_id, status, s3_key_original, COALESCE(packaging, '')
+		FROM media WHERE status IN ('ready', 'failed') AND storage_tier = 'hot'
+	`
+	var args []interface{}
+	argIndex := 1
+
+	if req.OwnerID != 0 {
+		query += fmt.Sprintf(" AND owner_id = $%d", argIndex)
+		args = append(args, req.OwnerID)
+		argIndex++
+	}
+	if req.Status != "" {
+		query += fmt.Sprintf(" AND status = $%d", argIndex)
+		args = append(args, req.Status)
+		argIndex++
+	}
+	if req.From != nil {
+		query += fmt.Sprintf(" AND created_at >= $%d", argIndex)
+		args = append(args, *req.From)
+		argIndex++
+	}
+	if req.To != nil {
+		query += fmt.Sprintf(" AND created_at < $%d", argIndex)
+		args = append(args, *req.To)
+		argIndex++
+	}
+	if req.Codec != "" {
+		query += fmt.Sprintf(` AND EXISTS (
+			SELECT 1 FROM jsonb_array_elements(probe_data->'streams') s
+			WHERE s->>'codec_name' = $%d
+		)`, argIndex)
+		args = append(args, req.Codec)
+		argIndex++
+	}
+	query += " ORDER BY created_at"
+
+	rows, err := mediaDB.Query(ctx, query, args...)
+	if err != nil {
+		rlog.Error("failed to query media for reprocessing", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list media").Err()
+	}
+	defer rows.Close()
+
+	var items []bulkItem
+	for rows.Next() {
+		var it bulkItem
+		if err := rows.Scan(&it.mediaID, &it.ownerID, &it.status, &it.s3Key, &it.packaging); err != nil {
+			continue
+		}
+		items = append(items, it)
+	}
+
+	rate := getReprocessRate()
+	if req.DryRun || len(items) == 0 {
+		return &BulkReprocessResponse{Matched: len(items), Rate: rate, DryRun: req.DryRun}, nil
+	}
+
+	// The drain job queues them, so large selections don't hold the request
+	// open and survive restarts. Items already waiting keep their place.
+	mediaIDs := make([]string, len(items))
+	ownerIDs := make([]int64, len(items))
+	statuses := make([]string, len(items))
+	for i, it := range items {
+		mediaIDs[i], ownerIDs[i], statuses[i] = it.mediaID, it.ownerID, it.status
+	}
+	_, err = db.Exec(ctx, `
+		INSERT INTO bulk_reprocess_queue (media_id, owner_id, status, created_at)
+		SELECT i.media_id, i.owner_id, i.status, NOW()
+		FROM unnest($1::uuid[], $2::bigint[], $3::text[]) WITH ORDINALITY AS i(media_id, owner_id, status, n)
+		ORDER BY i.n
+		ON CONFLICT (media_id) DO NOTHING
+	`, mediaIDs, ownerIDs, statuses)
+	if err != nil {
+		rlog.Error("failed to queue media for reprocessing", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue media").Err()
+	}
+
+	rlog.Info("bulk reprocess started", "matched", len(items), "rate", rate)
+
+	return &BulkReprocessResponse{Matched: len(items), Rate: rate}, nil
+}
+
+// bulkDrainWindow is how long one drain run queues items for; it stays under
+// the job's interval so runs don't overlap
+const bulkDrainWindow = 50 * time.Second
+
+// The drain job queues the items bulk reprocessing selected
+var _ = cron.NewJob("processing-bulk-drain", cron.JobConfig{
+	Title:    "Queue media selected for bulk reprocessing",
+	Every:    1 * cron.Minute,
+	Endpoint: DrainBulkReprocess,
+})
+
+// DrainBulkReprocessResponse reports what a drain run did
+type DrainBulkReprocessResponse struct {
+	Queued  int `json:"queued"`
+	Skipped int `json:"skipped"`
+}
+
+// DrainBulkReprocess re-queues the oldest items selected by bulk
+// reprocessing, one by one at PROCESSING_REPROCESS_RATE items per second
+//
+//encore:api private
+func DrainBulkReprocess(ctx context.Context) (*DrainBulkReprocessResponse, error) {
+	rate := getReprocessRate()
+	limit := int(rate * bulkDrainWindow.Seconds())
+	if limit < 1 {
+		limit = 1
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, media_id::text, owner_id, status FROM bulk_reprocess_queue ORDER BY id LIMIT $1
+	`, limit)
+	if err != nil {
+		rlog.Error("failed to list bulk reprocess queue", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list queue").Err()
+	}
+	type queuedItem struct {
+		id int64
+		bulkItem
+	}
+	var items []queuedItem
+	for rows.Next() {
+		var it queuedItem
+		if err := rows.Scan(&it.id, &it.mediaID, &it.ownerID, &it.status); err != nil {
+			continue
+		}
+		items = append(items, it)
+	}
+	rows.Close()
+
+	resp := &DrainBulkReprocessResponse{}
+	if len(items) == 0 {
+		return resp, nil
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for i, it := range items {
+		if i > 0 {
+			<-ticker.C
+		}
+		if queueBulkItem(ctx, it.bulkItem) {
+			resp.Queued++
+		} else {
+			resp.Skipped++
+		}
+		// Items whose publish failed were put back to their status and
+		// aren't retried, like items changed since they were selected
+		if _, err := db.Exec(ctx, `DELETE FROM bulk_reprocess_queue WHERE id = $1`, it.id); err != nil {
+			rlog.Warn("failed to remove bulk reprocess item", "error", err, "media_id", it.mediaID)
+		}
+	}
+
+	rlog.Info("bulk reprocess drained", "queued", resp.Queued, "skipped", resp.Skipped)
+	return resp, nil
+}
+
+// queueBulkItem re-queues one item, reporting whether it was queued. The
+// original's key and packaging are read now, as deduplication or tiering may
+// have moved the original since the item was selected.
+func queueBulkItem(ctx context.Context, it bulkItem) bool {
+	// Skip items whose status changed since they were selected, or whose
+	// original went to cold storage
+	err := mediaDB.QueryRow(ctx, `
+		UPDATE media SET status = 'queued', preset = NULL
+		WHERE id = $1 AND status = $2 AND storage_tier = 'hot'
+		RETURNING s3_key_original, COALESCE(packaging, '')
+	`, it.mediaID, it.status).Scan(&it.s3Key, &it.packaging)
+	if err != nil {
+		return false
+	}
+
+	_, err = media.MediaUploadedTopic.Publish(ctx, &media.MediaUploaded{
+		MediaID:   it.mediaID,
+		S3Key:     it.s3Key,
+		OwnerID:   it.ownerID,
+		Packaging: it.packaging,
+	})
+	if err != nil {
+		rlog.Error("failed to publish reprocess event", "error", err, "media_id", it.mediaID)
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = $2 WHERE id = $1`, it.mediaID, it.status)
+		return false
+	}
+	publishMediaStatus(ctx, it.mediaID, it.ownerID, "queued")
+	return true
+}
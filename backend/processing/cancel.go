@@ -0,0 +1,149 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// jobStatusPollInterval is how often a running job checks whether its media
+// was cancelled or deleted through another instance
+const jobStatusPollInterval = 5 * time.Second
+
+// runningJobs holds the cancel functions of jobs running on this instance,
+// keyed by media ID. Cancellations on other instances reach a job through
+// watchJob instead.
+var (
+	runningJobsMu sync.Mutex
+	runningJobs   = make(map[string]context.CancelFunc)
+)
+
+// trackJob derives a cancellable context for processing mediaID and registers
+// it so CancelJob can stop the running ffmpeg process. The returned release
+// function must be called once processing finishes.
+func trackJob(ctx context.Context, mediaID string) (context.Context, func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+
+	runningJobsMu.Lock()
+	runningJobs[mediaID] = cancel
+	runningJobsMu.Unlock()
+
+	go watchJob(jobCtx, cancel, mediaID)
+
+	return jobCtx, func() {
+		runningJobsMu.Lock()
+		delete(runningJobs, mediaID)
+		runningJobsMu.Unlock()
+		cancel()
+	}
+}
+
+// watchJob cancels a running job once its media leaves 'processing', i.e.
+// it was cancelled or deleted, wherever that request was handled
+func watchJob(ctx context.Context, cancel context.CancelFunc, mediaID string) {
+	ticker := time.NewTicker(jobStatusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var status string
+		err := mediaDB.QueryRow(ctx, `SELECT status FROM media WHERE id = $1`, mediaID).Scan(&status)
+		if errors.Is(err, sqldb.ErrNoRows) || (err == nil && status != "processing") {
+			rlog.Info("media left processing, stopping job", "media_id", mediaID, "status", status)
+			cancel()
+			return
+		}
+	}
+}
+
+// cancelRunningJob cancels the job for mediaID if it is running on this
+// instance and reports whether one was found
+func cancelRunningJob(mediaID string) bool {
+	runningJobsMu.Lock()
+	cancel, ok := runningJobs[mediaID]
+	runningJobsMu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// CancelJobResponse confirms the cancellation
+type CancelJobResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// CancelJob stops processing of a media item, terminating ffmpeg if it is
+// running. A job on another instance notices within jobStatusPollInterval.
+//
+//encore:api auth method=POST path=/processing/:mediaID/cancel
+func CancelJob(ctx context.Context, mediaID string) (*CancelJobResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	// Verify access and current status
+	var ownerID int64
+	var status, teamID string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, status, COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &status, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "queued" && status != "processing" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is not being processed").Err()
+	}
+
+	wasRunning := cancelRunningJob(mediaID)
+
+	result, err := db.Exec(ctx, `
+		UPDATE processing_jobs
+		SET status = 'cancelled', error_message = 'cancelled by user', completed_at = NOW()
+		WHERE media_id = $1 AND status IN ('pending', 'processing')
+	`, mediaID)
+	if err != nil {
+		rlog.Error("failed to cancel processing job", "error", err, "media_id", mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to cancel job").Err()
+	}
+
+	// Still queued: record the cancellation so the job history reflects it
+	if result.RowsAffected() == 0 {
+		_, _ = db.Exec(ctx, `
+			INSERT INTO processing_jobs (media_id, status, error_message, completed_at)
+			VALUES ($1, 'cancelled', 'cancelled by user', NOW())
+		`, mediaID)
+	}
+
+	// Reset media status so the queued message is skipped and the item can be retried
+	_, err = mediaDB.Exec(ctx, `
+		UPDATE media SET status = 'failed' WHERE id = $1 AND status IN ('queued', 'processing')
+	`, mediaID)
+	if err != nil {
+		rlog.Error("failed to reset media status", "error", err, "media_id", mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+
+	rlog.Info("processing job cancelled", "media_id", mediaID, "was_running", wasRunning)
+	publishMediaStatus(ctx, mediaID, ownerID, "failed")
+
+	return &CancelJobResponse{
+		MediaID: mediaID,
+		Status:  "cancelled",
+	}, nil
+}
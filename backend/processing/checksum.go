@@ -0,0 +1,96 @@
+package processing
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+// uploadResult describes a verified processed object
+type uploadResult struct {
+	Size   int64
+	SHA256 string
+}
+
+// uploadVerified uploads a local file and checks that the stored object has
+// the file's size and, for single-part uploads, its MD5 as ETag. A mismatched
+// object is removed and an error returned so the job fails instead of
+// producing broken "ready" media.
+func uploadVerified(ctx context.Context, client *minio.Client, key, path, contentType string) (uploadResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("failed to open output file: %w", err)
+	}
+	shaHash, md5Hash := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(shaHash, md5Hash), file)
+	file.Close()
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("failed to hash output file: %w", err)
+	}
+	sum := hex.EncodeToString(shaHash.Sum(nil))
+
+	_, err = objectstore.FPutObject(ctx, client, key, path, minio.PutObjectOptions{
+		ContentType:    contentType,
+		UserMetadata:   map[string]string{"sha256": sum},
+		SendContentMd5: true,
+	})
+	if err != nil {
+		return uploadResult{}, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	if err := verifyObject(ctx, client, key, size, hex.EncodeToString(md5Hash.Sum(nil))); err != nil {
+		return uploadResult{}, err
+	}
+	return uploadResult{Size: size, SHA256: sum}, nil
+}
+
+// verifyObject compares a stored object with the expected size and, when
+// md5Hex is set and the object was not uploaded in parts, its ETag
+func verifyObject(ctx context.Context, client *minio.Client, key string, size int64, md5Hex string) error {
+	info, err := client.StatObject(ctx, objectstore.Bucket(), key, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", key, err)
+	}
+
+	etag := strings.Trim(info.ETag, `"`)
+	// Multipart ETags ("<md5 of part md5s>-<parts>") are not the file's MD5
+	multipart := strings.Contains(etag, "-")
+	if info.Size != size || (md5Hex != "" && !multipart && etag != md5Hex) {
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), key, minio.RemoveObjectOptions{})
+		return fmt.Errorf("uploaded object %s does not match: size %d (expected %d), etag %s", key, info.Size, size, etag)
+	}
+	return nil
+}
+
+// hashingReader counts and hashes the bytes read through it
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.n += int64(n)
+	_, _ = h.hash.Write(p[:n])
+	return n, err
+}
+
+// sum returns the hex SHA-256 of everything read so far
+func (h *hashingReader) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
@@ -0,0 +1,88 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+)
+
+// dashManifestName is the file name of the MPD manifest inside a DASH package
+const dashManifestName = "manifest.mpd"
+
+// packageDASH transcodes the input into a DASH package (MPD manifest plus
+// fragmented MP4 segments) and uploads it under processed/<mediaID>/dash/.
+// It returns the S3 key of the manifest.
+//
+// Segments are listed explicitly in the manifest (no SegmentTemplate) so the
+// media service can rewrite every segment reference into a presigned URL.
+func packageDASH(ctx context.Context, client *minio.Client, mediaID, inputPath, tempDir string, encoderArgs []string) (string, error) {
+	outputDir := filepath.Join(tempDir, "dash")
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create DASH output directory: %w", err)
+	}
+	manifestPath := filepath.Join(outputDir, dashManifestName)
+
+	args := append([]string{"-i", inputPath}, encoderArgs...)
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", "4",
+		"-use_template", "0",
+		"-use_timeline", "0",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-y",
+		manifestPath,
+	)
+	cmd := ffmpegCommand(ctx, args...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		rlog.Error("ffmpeg DASH packaging failed", "error", err, "output", string(output))
+		return "", &ffmpegError{Op: "ffmpeg DASH packaging", Err: err, Output: string(output)}
+	}
+
+	duration := getVideoDuration(ctx, inputPath)
+	if duration > 0 {
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET duration_seconds = $2 WHERE id = $1`, mediaID, duration)
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read DASH output directory: %w", err)
+	}
+
+	prefix := fmt.Sprintf("processed/%s/dash/", mediaID)
+	var totalSize int64
+	var manifestSum string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		contentType := "video/iso.segment"
+		if strings.HasSuffix(entry.Name(), ".mpd") {
+			contentType = "application/dash+xml"
+		}
+
+		upload, err := uploadVerified(ctx, client, prefix+entry.Name(),
+			filepath.Join(outputDir, entry.Name()), contentType)
+		if err != nil {
+			return "", err
+		}
+		totalSize += upload.Size
+		if entry.Name() == dashManifestName {
+			manifestSum = upload.SHA256
+		}
+	}
+
+	// Update file size and the checksum of the manifest
+	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2, processed_sha256 = $3 WHERE id = $1`,
+		mediaID, totalSize, manifestSum)
+
+	return prefix + dashManifestName, nil
+}
@@ -0,0 +1,237 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+)
+
+// maxDeliveryAttempts is the number of times a media upload event is
+// processed before it is moved to the dead-letter table
+const maxDeliveryAttempts = 5
+
+// maxStoredOutput caps the ffmpeg output kept per dead letter (the tail is kept)
+const maxStoredOutput = 16 * 1024
+
+// deliveryAttempt returns the 1-based delivery attempt of the message being handled
+func deliveryAttempt() int {
+	if req := encore.CurrentRequest(); req != nil && req.Message != nil && req.Message.DeliveryAttempt > 0 {
+		return req.Message.DeliveryAttempt
+	}
+	return 1
+}
+
+// deadLetter persists a message that permanently failed processing
+func deadLetter(ctx context.Context, msg *media.MediaUploaded, packaging, preset string, attempts int, cause error) error {
+	var output string
+	var ffErr *ffmpegError
+	if errors.As(cause, &ffErr) {
+		output = ffErr.Output
+		if len(output) > maxStoredOutput {
+			output = output[len(output)-maxStoredOutput:]
+		}
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO dead_letters (media_id, owner_id, s3_key, packaging, preset, attempts, error_message, ffmpeg_output, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7, NULLIF($8, ''), NOW())
+	`, msg.MediaID, msg.OwnerID, msg.S3Key, packaging, preset, attempts, cause.Error(), output)
+	return err
+}
+
+// requireAdmin returns an error unless the caller is an admin
+func requireAdmin() error {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+	return nil
+}
+
+// DeadLetter represents a permanently failed processing message
+type DeadLetter struct {
+	ID           string     `json:"id"`
+	MediaID      string     `json:"media_id"`
+	OwnerID      int64      `json:"owner_id"`
+	S3Key        string     `json:"s3_key"`
+	Packaging    string     `json:"packaging,omitempty"`
+	Preset       string     `json:"preset,omitempty"`
+	Attempts     int        `json:"attempts"`
+	ErrorMessage string     `json:"error_message"`
+	FFmpegOutput string     `json:"ffmpeg_output,omitempty"`
+	RequeuedAt   *time.Time `json:"requeued_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// ListDeadLettersRequest contains pagination parameters
+type ListDeadLettersRequest struct {
+	Page            int  `query:"page"`
+	PageSize        int  `query:"page_size"`
+	IncludeRequeued bool `query:"include_requeued"`
+}
+
+// ListDeadLettersResponse contains dead-lettered jobs, newest first
+type ListDeadLettersResponse struct {
+	Items      []DeadLetter `json:"items"`
+	TotalCount int          `json:"total_count"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"page_size"`
+}
+
+// ListDeadLetters lists permanently failed processing jobs (admin only)
+//
+//encore:api auth method=GET path=/admin/processing/dead-letters
+func ListDeadLetters(ctx context.Context, req *ListDeadLettersRequest) (*ListDeadLettersResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	// Set defaults
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	offset := (page - 1) * pageSize
+
+	var totalCount int
+	if err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM dead_letters WHERE $1 OR requeued_at IS NULL
+	`, req.IncludeRequeued).Scan(&totalCount); err != nil {
+		totalCount = 0
+	}
+
+	// The list omits ffmpeg output; fetch a single dead letter to inspect it
+	rows, err := db.Query(ctx, `
+		SELECT id, media_id, owner_id, s3_key, COALESCE(packaging, ''), COALESCE(preset, ''), attempts,
+			   error_message, requeued_at, created_at
+		FROM dead_letters
+		WHERE $1 OR requeued_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $2 OFFSET $3
+	`, req.IncludeRequeued, pageSize, offset)
+	if err != nil {
+		rlog.Error("failed to query dead letters", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list dead letters").Err()
+	}
+	defer rows.Close()
+
+	var items []DeadLetter
+	for rows.Next() {
+		var d DeadLetter
+		if err := rows.Scan(&d.ID, &d.MediaID, &d.OwnerID, &d.S3Key, &d.Packaging, &d.Preset, &d.Attempts,
+			&d.ErrorMessage, &d.RequeuedAt, &d.CreatedAt); err != nil {
+			continue
+		}
+		items = append(items, d)
+	}
+
+	if items == nil {
+		items = []DeadLetter{}
+	}
+
+	return &ListDeadLettersResponse{
+		Items:      items,
+		TotalCount: totalCount,
+		Page:       page,
+		PageSize:   pageSize,
+	}, nil
+}
+
+// GetDeadLetter returns a dead-lettered job including its ffmpeg output (admin only)
+//
+//encore:api auth method=GET path=/admin/processing/dead-letters/:id
+func GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	var d DeadLetter
+	err := db.QueryRow(ctx, `
+		SELECT id, media_id, owner_id, s3_key, COALESCE(packaging, ''), COALESCE(preset, ''), attempts,
+			   error_message, COALESCE(ffmpeg_output, ''), requeued_at, created_at
+		FROM dead_letters WHERE id = $1
+	`, id).Scan(&d.ID, &d.MediaID, &d.OwnerID, &d.S3Key, &d.Packaging, &d.Preset, &d.Attempts,
+		&d.ErrorMessage, &d.FFmpegOutput, &d.RequeuedAt, &d.CreatedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("dead letter not found").Err()
+	}
+
+	return &d, nil
+}
+
+// RequeueDeadLetterResponse confirms the job was queued again
+type RequeueDeadLetterResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// RequeueDeadLetter publishes a dead-lettered job again, as long as its
+// media is still failed (admin only)
+//
+//encore:api auth method=POST path=/admin/processing/dead-letters/:id/requeue
+func RequeueDeadLetter(ctx context.Context, id string) (*RequeueDeadLetterResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	var msg media.MediaUploaded
+	var requeuedAt *time.Time
+	err := db.QueryRow(ctx, `
+		SELECT media_id, owner_id, s3_key, COALESCE(packaging, ''), COALESCE(preset, ''), requeued_at
+		FROM dead_letters WHERE id = $1
+	`, id).Scan(&msg.MediaID, &msg.OwnerID, &msg.S3Key, &msg.Packaging, &msg.Preset, &requeuedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("dead letter not found").Err()
+	}
+	if requeuedAt != nil {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("dead letter was already requeued").Err()
+	}
+
+	// Only media still failed is queued again; media reprocessed or replaced
+	// since then is left alone. The original may have moved meanwhile too.
+	err = mediaDB.QueryRow(ctx, `
+		UPDATE media SET status = 'queued' WHERE id = $1 AND status = 'failed'
+		RETURNING s3_key_original
+	`, msg.MediaID).Scan(&msg.S3Key)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		var exists bool
+		_ = mediaDB.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM media WHERE id = $1)`, msg.MediaID).Scan(&exists)
+		if !exists {
+			return nil, errs.B().Code(errs.NotFound).Msg("media no longer exists").Err()
+		}
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is no longer failed").Err()
+	}
+	if err != nil {
+		rlog.Error("failed to reset media status", "error", err, "media_id", msg.MediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+
+	if _, err := media.MediaUploadedTopic.Publish(ctx, &msg); err != nil {
+		rlog.Error("failed to publish requeued event", "error", err, "media_id", msg.MediaID)
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1 AND status = 'queued'`, msg.MediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue media").Err()
+	}
+
+	_, _ = db.Exec(ctx, `UPDATE dead_letters SET requeued_at = NOW() WHERE id = $1`, id)
+	publishMediaStatus(ctx, msg.MediaID, msg.OwnerID, "queued")
+
+	rlog.Info("dead letter requeued", "dead_letter_id", id, "media_id", msg.MediaID)
+
+	return &RequeueDeadLetterResponse{
+		MediaID: msg.MediaID,
+		Status:  "queued",
+	}, nil
+}
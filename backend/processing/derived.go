@@ -0,0 +1,85 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/metrics"
+	"encore.app/objectstore"
+)
+
+// materializeDerived produces the original of a media item derived from
+// another one: the cut segment of a clip or the audio extracted from a video.
+// It does nothing for uploads or when the original already exists (e.g. on
+// reprocessing).
+func materializeDerived(ctx context.Context, client *minio.Client, spec jobSpec, tempDir string) error {
+	var sourceKey *string
+	var start, end *float64
+	var reencode, extractAudio bool
+	err := mediaDB.QueryRow(ctx, `
+		SELECT s.s3_key_original, m.clip_start_seconds, m.clip_end_seconds, m.clip_reencode, m.extract_audio
+		FROM media m LEFT JOIN media s ON s.id = m.source_media_id
+		WHERE m.id = $1
+	`, spec.MediaID).Scan(&sourceKey, &start, &end, &reencode, &extractAudio)
+	if err != nil {
+		return fmt.Errorf("failed to read derivation: %w", err)
+	}
+	if !extractAudio && (start == nil || end == nil) {
+		return nil
+	}
+	if _, err := client.StatObject(ctx, objectstore.Bucket(), spec.S3Key, minio.StatObjectOptions{}); err == nil {
+		return nil
+	}
+	if sourceKey == nil {
+		return fmt.Errorf("source of %s no longer exists", spec.MediaID)
+	}
+
+	// ffmpeg seeks over HTTP, so only the needed part of the source is read
+	inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), *sourceKey, streamingInputTTL(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to presign source: %w", err)
+	}
+
+	outputPath := filepath.Join(tempDir, "derived"+filepath.Ext(spec.S3Key))
+	var args []string
+	if start != nil && end != nil {
+		args = append(args,
+			"-ss", strconv.FormatFloat(*start, 'f', 3, 64),
+			"-to", strconv.FormatFloat(*end, 'f', 3, 64),
+		)
+	}
+	args = append(args, "-i", inputURL.String())
+
+	switch {
+	case extractAudio:
+		// Every audio track is copied into Matroska; the audio pipeline encodes it
+		args = append(args, "-map", "0:a", "-vn", "-c:a", "copy")
+	case reencode:
+		// Frame-accurate: decode from the previous keyframe and re-encode at high quality
+		args = append(args, "-map", "0:v?", "-map", "0:a?",
+			"-c:v", "libx264", "-crf", "18", "-preset", "fast", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-b:a", "192k")
+	default:
+		// Keyframe-accurate stream copy
+		args = append(args, "-map", "0:v?", "-map", "0:a?", "-c", "copy", "-avoid_negative_ts", "make_zero")
+	}
+	args = append(args, "-y", outputPath)
+
+	if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+		return &ffmpegError{Op: "ffmpeg derive", Err: err, Output: string(output)}
+	}
+
+	info, err := objectstore.FPutObject(ctx, client, spec.S3Key, outputPath, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to upload derived original: %w", err)
+	}
+	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2 WHERE id = $1`, spec.MediaID, info.Size)
+
+	rlog.Info("derived media from source", "media_id", spec.MediaID, "extract_audio", extractAudio, "reencode", reencode)
+	return nil
+}
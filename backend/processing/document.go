@@ -0,0 +1,57 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+func init() {
+	registerHandler(kindDocument, processDocument)
+}
+
+// processDocument keeps the original document and renders the first page of
+// PDFs as a thumbnail
+func processDocument(ctx context.Context, job *pipelineJob) (pipelineResult, error) {
+	if strings.ToLower(filepath.Ext(job.S3Key)) != ".pdf" && job.MimeType != "application/pdf" {
+		return pipelineResult{}, nil
+	}
+
+	// Thumbnails are best-effort; the document itself is served as uploaded
+	if err := generateDocumentThumbnail(ctx, job); err != nil {
+		rlog.Error("failed to generate document thumbnail", "error", err, "media_id", job.MediaID)
+	}
+	return pipelineResult{}, nil
+}
+
+// generateDocumentThumbnail renders page 1 of a PDF with pdftoppm and stores
+// it as the media thumbnail
+func generateDocumentThumbnail(ctx context.Context, job *pipelineJob) error {
+	outputBase := filepath.Join(job.TempDir, "page")
+	cmd := exec.CommandContext(ctx, "pdftoppm",
+		"-jpeg",
+		"-f", "1", "-l", "1",
+		"-singlefile",
+		"-scale-to", fmt.Sprint(imageThumbnailWidth),
+		job.InputPath, outputBase,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pdftoppm failed: %w: %s", err, string(output))
+	}
+
+	thumbnailKey := fmt.Sprintf("thumbnails/%s/thumbnail.jpg", job.MediaID)
+	if _, err := objectstore.FPutObject(ctx, job.Client, thumbnailKey, outputBase+".jpg",
+		minio.PutObjectOptions{ContentType: "image/jpeg"}); err != nil {
+		return fmt.Errorf("failed to upload document thumbnail: %w", err)
+	}
+
+	_, err := mediaDB.Exec(ctx, `UPDATE media SET s3_key_thumbnail = $2 WHERE id = $1`, job.MediaID, thumbnailKey)
+	return err
+}
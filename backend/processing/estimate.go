@@ -0,0 +1,231 @@
+package processing
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// estimateHistory is how far back completed jobs are used to measure throughput
+const estimateHistory = 7 * 24 * time.Hour
+
+// EstimateResponse contains the expected remaining time until a media item is ready
+type EstimateResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+	// QueuePosition is the number of queued media ahead of this one
+	QueuePosition             int       `json:"queue_position"`
+	EstimatedQueueSeconds     float64   `json:"estimated_queue_seconds"`
+	EstimatedTranscodeSeconds float64   `json:"estimated_transcode_seconds"`
+	EstimatedReadyAt          time.Time `json:"estimated_ready_at"`
+	// SampleJobs is the number of completed jobs the estimate is based on;
+	// zero means there was no history and the estimate assumes real time
+	SampleJobs int `json:"sample_jobs"`
+}
+
+// throughput is the measured encoding speed of recent jobs
+type throughput struct {
+	// SecondsPerPixelSecond is transcode time per second of media per pixel
+	// of frame area, for jobs whose sources have a known resolution
+	SecondsPerPixelSecond float64
+	// SecondsPerMediaSecond is transcode time per second of media
+	SecondsPerMediaSecond float64
+	// AvgJobSeconds is the mean transcode time of a job
+	AvgJobSeconds float64
+	Samples       int
+}
+
+// jobSeconds estimates the transcode time of media with the given duration
+// and frame area, using the most specific measurement available
+func (t throughput) jobSeconds(duration float64, pixels int) float64 {
+	switch {
+	case duration > 0 && pixels > 0 && t.SecondsPerPixelSecond > 0:
+		return duration * float64(pixels) * t.SecondsPerPixelSecond
+	case duration > 0 && t.SecondsPerMediaSecond > 0:
+		return duration * t.SecondsPerMediaSecond
+	case duration > 0:
+		// No history: assume the encoder runs at real time
+		return duration
+	default:
+		return t.AvgJobSeconds
+	}
+}
+
+// EstimateJob estimates when a media item will be ready from its probed
+// duration and resolution, the queue ahead of it and the throughput of recent
+// jobs with the same preset
+//
+//encore:api auth method=GET path=/processing/:mediaID/estimate
+func EstimateJob(ctx context.Context, mediaID string) (*EstimateResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var status, presetName, teamID string
+	var createdAt time.Time
+	var duration float64
+	var pixels int
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, status, COALESCE(preset, ''), created_at,
+			   COALESCE((probe_data->'format'->>'duration')::float8, duration_seconds, 0),
+			   COALESCE((
+				   SELECT MAX((s->>'width')::int * (s->>'height')::int) FROM jsonb_array_elements(probe_data->'streams') s
+				   WHERE s->>'codec_type' = 'video'
+			   ), 0),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &status, &presetName, &createdAt, &duration, &pixels, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	resp := &EstimateResponse{
+		MediaID:          mediaID,
+		Status:           status,
+		EstimatedReadyAt: time.Now(),
+	}
+	if status != "queued" && status != "processing" {
+		// Ready, failed or not uploaded yet: nothing to wait for
+		return resp, nil
+	}
+
+	stats, err := measureThroughput(ctx, resolvePreset(presetName).Name)
+	if err != nil {
+		rlog.Error("failed to measure throughput", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to estimate job").Err()
+	}
+	resp.SampleJobs = stats.Samples
+	transcode := stats.jobSeconds(duration, pixels)
+
+	if status == "processing" {
+		// Subtract the time the running attempt has already taken
+		var startedAt *time.Time
+		_ = db.QueryRow(ctx, `
+			SELECT started_at FROM processing_jobs
+			WHERE media_id = $1 AND status = 'processing'
+			ORDER BY created_at DESC LIMIT 1
+		`, mediaID).Scan(&startedAt)
+		if startedAt != nil {
+			transcode = math.Max(transcode-time.Since(*startedAt).Seconds(), 0)
+		}
+	} else {
+		// Every queued item ahead and every running job has to free a slot
+		// first; slots work through them in parallel
+		var ahead, running int
+		err = mediaDB.QueryRow(ctx, `
+			SELECT COUNT(*) FILTER (WHERE status = 'queued' AND created_at < $1),
+				   COUNT(*) FILTER (WHERE status = 'processing')
+			FROM media
+		`, createdAt).Scan(&ahead, &running)
+		if err != nil {
+			rlog.Error("failed to count queue", "error", err)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to estimate job").Err()
+		}
+		resp.QueuePosition = ahead
+
+		jobSeconds := stats.AvgJobSeconds
+		if jobSeconds == 0 {
+			jobSeconds = transcode
+		}
+		resp.EstimatedQueueSeconds = float64(ahead+running) * jobSeconds / float64(getMaxConcurrency())
+	}
+
+	resp.EstimatedTranscodeSeconds = transcode
+	resp.EstimatedReadyAt = time.Now().Add(time.Duration((resp.EstimatedQueueSeconds + transcode) * float64(time.Second)))
+	return resp, nil
+}
+
+// measureThroughput computes encoding speed from the completed jobs of the
+// last week, preferring jobs with the given preset
+func measureThroughput(ctx context.Context, preset string) (throughput, error) {
+	rows, err := db.Query(ctx, `
+		SELECT media_id, EXTRACT(EPOCH FROM (completed_at - started_at))::float8
+		FROM processing_jobs
+		WHERE status = 'completed' AND started_at IS NOT NULL AND completed_at >= $1
+		  AND ($2 = '' OR preset = $2)
+		ORDER BY completed_at DESC
+		LIMIT 500
+	`, time.Now().Add(-estimateHistory), preset)
+	if err != nil {
+		return throughput{}, err
+	}
+	jobSeconds := make(map[string]float64)
+	var mediaIDs []string
+	for rows.Next() {
+		var mediaID string
+		var seconds float64
+		if err := rows.Scan(&mediaID, &seconds); err != nil {
+			continue
+		}
+		if _, ok := jobSeconds[mediaID]; !ok {
+			mediaIDs = append(mediaIDs, mediaID)
+		}
+		jobSeconds[mediaID] = seconds
+	}
+	rows.Close()
+
+	if len(mediaIDs) == 0 {
+		if preset != "" {
+			// No history for this preset yet, fall back to every preset
+			return measureThroughput(ctx, "")
+		}
+		return throughput{}, nil
+	}
+
+	// Durations and resolutions of the sources live in the media database
+	mediaRows, err := mediaDB.Query(ctx, `
+		SELECT id, COALESCE((probe_data->'format'->>'duration')::float8, duration_seconds, 0),
+			   COALESCE((
+				   SELECT MAX((s->>'width')::int * (s->>'height')::int) FROM jsonb_array_elements(probe_data->'streams') s
+				   WHERE s->>'codec_type' = 'video'
+			   ), 0)
+		FROM media WHERE id = ANY($1::uuid[])
+	`, mediaIDs)
+	if err != nil {
+		return throughput{}, err
+	}
+	defer mediaRows.Close()
+
+	var t throughput
+	var totalSeconds, timedSeconds, mediaSeconds, pixelSeconds, pixelJobSeconds float64
+	for mediaRows.Next() {
+		var id string
+		var duration float64
+		var pixels int
+		if err := mediaRows.Scan(&id, &duration, &pixels); err != nil {
+			continue
+		}
+		seconds := jobSeconds[id]
+		totalSeconds += seconds
+		t.Samples++
+		if duration <= 0 {
+			continue
+		}
+		timedSeconds += seconds
+		mediaSeconds += duration
+		if pixels > 0 {
+			pixelJobSeconds += seconds
+			pixelSeconds += duration * float64(pixels)
+		}
+	}
+
+	if t.Samples > 0 {
+		t.AvgJobSeconds = totalSeconds / float64(t.Samples)
+	}
+	if mediaSeconds > 0 {
+		t.SecondsPerMediaSecond = timedSeconds / mediaSeconds
+	}
+	if pixelSeconds > 0 {
+		t.SecondsPerPixelSecond = pixelJobSeconds / pixelSeconds
+	}
+	return t, nil
+}
@@ -0,0 +1,46 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"encore.dev/rlog"
+
+	"encore.app/realtime"
+)
+
+// publishMediaStatus pushes a media status change to the owner's event
+// streams; ownerID is looked up when 0. Deleted media is skipped and a
+// failed publish only logged, as clients also poll the status.
+func publishMediaStatus(ctx context.Context, mediaID string, ownerID int64, status string) {
+	if ownerID == 0 {
+		if err := mediaDB.QueryRow(ctx, `SELECT owner_id FROM media WHERE id = $1`, mediaID).Scan(&ownerID); err != nil {
+			return
+		}
+	}
+	publishEvent(ctx, ownerID, realtime.TypeMediaStatus, realtime.MediaStatus{MediaID: mediaID, Status: status})
+}
+
+// publishProgress pushes the progress of an external job to the media
+// owner's event streams
+func publishProgress(ctx context.Context, mediaID, jobID string, progress float64) {
+	var ownerID int64
+	if err := mediaDB.QueryRow(ctx, `SELECT owner_id FROM media WHERE id = $1`, mediaID).Scan(&ownerID); err != nil {
+		return
+	}
+	publishEvent(ctx, ownerID, realtime.TypeProcessingProgress,
+		realtime.ProcessingProgress{MediaID: mediaID, JobID: jobID, Progress: progress})
+}
+
+// publishEvent pushes an event to a user's event streams
+func publishEvent(ctx context.Context, userID int64, eventType string, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	ev := &realtime.Event{UserIDs: []int64{userID}, Type: eventType, Data: payload, OccurredAt: time.Now()}
+	if _, err := realtime.EventsTopic.Publish(ctx, ev); err != nil {
+		rlog.Warn("failed to publish realtime event", "error", err, "type", eventType)
+	}
+}
@@ -0,0 +1,339 @@
+package processing
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	"encore.app/metrics"
+	"encore.app/objectstore"
+)
+
+// externalHeartbeatTimeout is how long a claimed job may go without a
+// heartbeat before it is offered to other workers again
+const externalHeartbeatTimeout = 5 * time.Minute
+
+// errExternalJob is returned by a pipeline that handed its encode to an
+// external worker; the job finishes through CompleteExternalJob
+var errExternalJob = errors.New("encode handed to an external worker")
+
+// getExternalWorkersEnabled returns whether video encodes are left to
+// external workers instead of running on this instance
+func getExternalWorkersEnabled() bool {
+	return os.Getenv("PROCESSING_EXTERNAL_WORKERS") == "true"
+}
+
+// useExternalWorker reports whether the encode of a video job can be handed
+// to an external worker: a single progressive output read straight from the
+// original (trimmed uploads are encoded from a local intermediate)
+func useExternalWorker(job *pipelineJob) bool {
+	return getExternalWorkersEnabled() && job.Packaging != PackagingDASH && !job.trimmed()
+}
+
+// deferToExternalWorker stores the encoder arguments on the job and marks it
+// pending for an external worker to claim
+func deferToExternalWorker(ctx context.Context, job *pipelineJob, encoderArgs []string, preset Preset) error {
+	if job.JobID == "" {
+		return fmt.Errorf("no job record to hand to an external worker")
+	}
+
+	args, err := json.Marshal(encoderArgs)
+	if err != nil {
+		return err
+	}
+	outputKey := fmt.Sprintf("processed/%s.%s", job.MediaID, preset.Container)
+
+	_, err = db.Exec(ctx, `
+		UPDATE processing_jobs
+		SET status = 'pending', worker_args = $2, input_key = $3, output_key = $4, content_type = $5
+		WHERE id = $1
+	`, job.JobID, string(args), job.S3Key, outputKey, preset.ContentType)
+	if err != nil {
+		return fmt.Errorf("failed to queue external job: %w", err)
+	}
+
+	rlog.Info("encode handed to external workers", "media_id", job.MediaID, "job_id", job.JobID)
+	return errExternalJob
+}
+
+// WorkerAuth authenticates external workers with the ProcessingWorkerToken secret
+type WorkerAuth struct {
+	Token string `header:"X-Worker-Token"`
+}
+
+// check returns an error unless the token matches the configured secret
+func (a WorkerAuth) check() error {
+	if secrets.ProcessingWorkerToken == "" ||
+		subtle.ConstantTimeCompare([]byte(a.Token), []byte(secrets.ProcessingWorkerToken)) != 1 {
+		return errs.B().Code(errs.Unauthenticated).Msg("invalid worker token").Err()
+	}
+	return nil
+}
+
+// ClaimJobRequest identifies the claiming worker
+type ClaimJobRequest struct {
+	WorkerAuth
+	WorkerID string `json:"worker_id"`
+}
+
+// ExternalJob is an encode for an external worker. The worker runs
+// `ffmpeg -i <input_url> <args...> <output file>` (adding -movflags +faststart
+// for MP4) and uploads the result with a PUT to output_url, sending
+// output_headers along.
+type ExternalJob struct {
+	ID          string   `json:"id"`
+	MediaID     string   `json:"media_id"`
+	InputURL    string   `json:"input_url"`
+	Args        []string `json:"args"`
+	Container   string   `json:"container"`
+	ContentType string   `json:"content_type"`
+	OutputURL   string   `json:"output_url"`
+	// OutputHeaders are signed into output_url, e.g. server-side encryption
+	OutputHeaders map[string]string `json:"output_headers,omitempty"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+}
+
+// ClaimJobResponse contains the claimed job, or no job if none is pending
+type ClaimJobResponse struct {
+	Job *ExternalJob `json:"job"`
+}
+
+// ClaimJob hands the oldest pending encode to an external worker
+//
+//encore:api public method=POST path=/processing/jobs/claim
+func ClaimJob(ctx context.Context, req *ClaimJobRequest) (*ClaimJobResponse, error) {
+	if err := req.check(); err != nil {
+		return nil, err
+	}
+	if req.WorkerID == "" {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("worker_id is required").Err()
+	}
+
+	// SKIP LOCKED lets concurrent workers claim different jobs
+	var job ExternalJob
+	var args, inputKey, outputKey string
+	err := db.QueryRow(ctx, `
+		UPDATE processing_jobs
+		SET status = 'processing', worker_id = $1, heartbeat_at = NOW(), progress = 0, started_at = NOW()
+		WHERE id = (
+			SELECT id FROM processing_jobs
+			WHERE status = 'pending' AND worker_args IS NOT NULL
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, media_id, worker_args::text, input_key, output_key, content_type
+	`, req.WorkerID).Scan(&job.ID, &job.MediaID, &args, &inputKey, &outputKey, &job.ContentType)
+	if err != nil {
+		// No pending job
+		return &ClaimJobResponse{}, nil
+	}
+	if err := json.Unmarshal([]byte(args), &job.Args); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("corrupt job arguments").Err()
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+
+	ttl := streamingInputTTL()
+	inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), inputKey, ttl, nil)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign input").Err()
+	}
+	outputURL, outputHeaders, err := objectstore.PresignedPut(ctx, client, outputKey, ttl)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign output").Err()
+	}
+
+	job.InputURL = inputURL.String()
+	job.OutputURL = outputURL.String()
+	job.OutputHeaders = outputHeaders
+	job.Container = strings.TrimPrefix(filepath.Ext(outputKey), ".")
+	job.ExpiresAt = time.Now().Add(ttl)
+
+	rlog.Info("external job claimed", "job_id", job.ID, "media_id", job.MediaID, "worker_id", req.WorkerID)
+	publishProgress(ctx, job.MediaID, job.ID, 0)
+
+	return &ClaimJobResponse{Job: &job}, nil
+}
+
+// HeartbeatRequest reports the progress of a claimed job
+type HeartbeatRequest struct {
+	WorkerAuth
+	// WorkerID is the worker_id the job was claimed with
+	WorkerID string `json:"worker_id"`
+	// Progress is the completed fraction, 0 to 1
+	Progress float64 `json:"progress"`
+}
+
+// HeartbeatResponse tells the worker whether to continue
+type HeartbeatResponse struct {
+	// Continue is false when the job was cancelled or reassigned
+	Continue bool `json:"continue"`
+}
+
+// JobHeartbeat records the progress of a claimed job. Jobs without a heartbeat
+// for 5 minutes are offered to other workers again, after which the first
+// worker is told to stop.
+//
+//encore:api public method=POST path=/processing/jobs/:id/heartbeat
+func JobHeartbeat(ctx context.Context, id string, req *HeartbeatRequest) (*HeartbeatResponse, error) {
+	if err := req.check(); err != nil {
+		return nil, err
+	}
+
+	var mediaID string
+	err := db.QueryRow(ctx, `
+		UPDATE processing_jobs SET heartbeat_at = NOW(), progress = $2
+		WHERE id = $1 AND status = 'processing' AND worker_args IS NOT NULL AND worker_id = $3
+		RETURNING media_id
+	`, id, req.Progress, req.WorkerID).Scan(&mediaID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return &HeartbeatResponse{Continue: false}, nil
+	}
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to record heartbeat").Err()
+	}
+	publishProgress(ctx, mediaID, id, req.Progress)
+	return &HeartbeatResponse{Continue: true}, nil
+}
+
+// CompleteJobRequest reports the outcome of a claimed job
+type CompleteJobRequest struct {
+	WorkerAuth
+	// WorkerID is the worker_id the job was claimed with
+	WorkerID string `json:"worker_id"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	// SHA256 of the uploaded output
+	SHA256 string `json:"sha256,omitempty"`
+	// SizeBytes of the uploaded output, verified against the stored object
+	SizeBytes int64 `json:"size_bytes,omitempty"`
+}
+
+// CompleteJobResponse confirms the job outcome was recorded
+type CompleteJobResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// CompleteExternalJob finishes a claimed job: on success the uploaded output is
+// verified and the media marked ready, otherwise the media is marked failed.
+// Only the worker holding the claim can complete it.
+//
+//encore:api public method=POST path=/processing/jobs/:id/complete
+func CompleteExternalJob(ctx context.Context, id string, req *CompleteJobRequest) (*CompleteJobResponse, error) {
+	if err := req.check(); err != nil {
+		return nil, err
+	}
+
+	var mediaID, outputKey, preset, packaging string
+	err := db.QueryRow(ctx, `
+		SELECT media_id, output_key, COALESCE(preset, ''), COALESCE(packaging, '')
+		FROM processing_jobs
+		WHERE id = $1 AND status = 'processing' AND worker_args IS NOT NULL AND worker_id = $2
+	`, id, req.WorkerID).Scan(&mediaID, &outputKey, &preset, &packaging)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("no claimed job with this id").Err()
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+
+	if req.Success {
+		if err := verifyObject(ctx, client, outputKey, req.SizeBytes, ""); err != nil {
+			req.Success = false
+			req.Error = err.Error()
+		}
+	}
+
+	if !req.Success {
+		var seconds float64
+		err := db.QueryRow(ctx, `
+			UPDATE processing_jobs SET status = 'failed', error_message = $2, completed_at = NOW()
+			WHERE id = $1 AND status = 'processing' AND worker_id = $3
+			RETURNING EXTRACT(EPOCH FROM (completed_at - started_at))::float8
+		`, id, req.Error, req.WorkerID).Scan(&seconds)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return nil, errs.B().Code(errs.NotFound).Msg("no claimed job with this id").Err()
+		}
+		if err == nil {
+			transcodeDuration.Observe(seconds, "external", "failed")
+		}
+		failed, err := mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1 AND status = 'processing'`, mediaID)
+		rlog.Error("external job failed", "job_id", id, "media_id", mediaID, "error", req.Error)
+		if err == nil && failed.RowsAffected() > 0 {
+			publishFinished(ctx, mediaID, 0, "failed", "external worker failed")
+		}
+		return &CompleteJobResponse{MediaID: mediaID, Status: "failed"}, nil
+	}
+
+	// ffprobe reads the duration over HTTP from the moov atom
+	if outputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), outputKey, 15*time.Minute, nil); err == nil {
+		if duration := getVideoDuration(ctx, outputURL.String()); duration > 0 {
+			_, _ = mediaDB.Exec(ctx, `
+				UPDATE media SET duration_seconds = $2 WHERE id = $1 AND status = 'processing'
+			`, mediaID, duration)
+		}
+	}
+
+	done, err := mediaDB.Exec(ctx, `
+		UPDATE media
+		SET status = 'ready', s3_key_processed = $2, packaging = NULLIF($3, ''), preset = NULLIF($4, ''),
+			size_bytes = $5, processed_sha256 = NULLIF($6, '')
+		WHERE id = $1 AND status = 'processing'
+	`, mediaID, outputKey, packaging, preset, req.SizeBytes, req.SHA256)
+	if err != nil {
+		rlog.Error("failed to update media with processed key", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+	if done.RowsAffected() == 0 {
+		// Cancelled or deleted while the worker ran; its output is dropped
+		_, _ = db.Exec(ctx, `
+			UPDATE processing_jobs
+			SET status = 'cancelled', error_message = 'media changed while processing', completed_at = NOW()
+			WHERE id = $1 AND status = 'processing' AND worker_id = $2
+		`, id, req.WorkerID)
+		rlog.Info("external job outcome dropped", "job_id", id, "media_id", mediaID)
+		return &CompleteJobResponse{MediaID: mediaID, Status: "cancelled"}, nil
+	}
+	var seconds float64
+	err = db.QueryRow(ctx, `
+		UPDATE processing_jobs SET status = 'completed', progress = 1, completed_at = NOW()
+		WHERE id = $1 AND worker_id = $2
+		RETURNING EXTRACT(EPOCH FROM (completed_at - started_at))::float8
+	`, id, req.WorkerID).Scan(&seconds)
+	if err == nil {
+		transcodeDuration.Observe(seconds, "external", "completed")
+	}
+
+	rlog.Info("external job completed", "job_id", id, "media_id", mediaID)
+	publishFinished(ctx, mediaID, 0, "ready", "")
+	return &CompleteJobResponse{MediaID: mediaID, Status: "ready"}, nil
+}
+
+// releaseStaleExternalJobs offers claimed jobs whose worker stopped sending
+// heartbeats to other workers again
+func releaseStaleExternalJobs(ctx context.Context) {
+	result, err := db.Exec(ctx, `
+		UPDATE processing_jobs SET status = 'pending', worker_id = NULL, progress = NULL
+		WHERE status = 'processing' AND worker_args IS NOT NULL AND heartbeat_at < $1
+	`, time.Now().Add(-externalHeartbeatTimeout))
+	if err == nil && result.RowsAffected() > 0 {
+		rlog.Info("released stale external jobs", "count", result.RowsAffected())
+	}
+}
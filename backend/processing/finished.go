@@ -0,0 +1,49 @@
+package processing
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+// ProcessingFinished is published when processing of a media item ends for
+// good: the media is ready, or it failed and won't be retried
+type ProcessingFinished struct {
+	MediaID string `json:"media_id"`
+	OwnerID int64  `json:"owner_id"`
+	// Status is "ready" or "failed"
+	Status string `json:"status"`
+	// Reason says why processing failed
+	Reason     string    `json:"reason,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// ProcessingFinishedTopic carries processing outcomes to the notification
+// service, which tells the owners whose notification settings ask for it
+var ProcessingFinishedTopic = pubsub.NewTopic[*ProcessingFinished]("processing-finished", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// publishFinished announces the outcome of processing a media item; ownerID
+// is looked up when 0, and nothing is announced for media deleted in the
+// meantime. A failed publish is logged; the job keeps its outcome.
+func publishFinished(ctx context.Context, mediaID string, ownerID int64, status, reason string) {
+	if ownerID == 0 {
+		if err := mediaDB.QueryRow(ctx, `SELECT owner_id FROM media WHERE id = $1`, mediaID).Scan(&ownerID); err != nil {
+			return
+		}
+	}
+	publishMediaStatus(ctx, mediaID, ownerID, status)
+	if status == "ready" {
+		recordTranscodeUsage(ctx, mediaID)
+		// The original's idle time before cold storage starts now
+		_ = useOriginal(ctx, mediaID)
+	}
+
+	msg := &ProcessingFinished{MediaID: mediaID, OwnerID: ownerID, Status: status, Reason: reason, FinishedAt: time.Now()}
+	if _, err := ProcessingFinishedTopic.Publish(ctx, msg); err != nil {
+		rlog.Error("failed to publish processing outcome", "error", err, "media_id", mediaID)
+	}
+}
@@ -0,0 +1,109 @@
+package processing
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getMaxDuration returns the longest audio or video source that is processed
+func getMaxDuration() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROCESSING_MAX_DURATION")); err == nil && d > 0 {
+		return d
+	}
+	return 8 * time.Hour
+}
+
+// getMaxResolution returns the largest video frame that is processed as-is
+// (PROCESSING_MAX_RESOLUTION, "WIDTHxHEIGHT", 8K by default)
+func getMaxResolution() (int, int) {
+	if w, h, ok := strings.Cut(os.Getenv("PROCESSING_MAX_RESOLUTION"), "x"); ok {
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if errW == nil && errH == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return 7680, 4320
+}
+
+// getMaxSourceSize returns the largest original in bytes that is processed
+// (0 means unlimited)
+func getMaxSourceSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("PROCESSING_MAX_SOURCE_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// getDownscaleOversized returns whether videos above the maximum resolution are
+// scaled down to fit instead of being rejected
+func getDownscaleOversized() bool {
+	return os.Getenv("PROCESSING_OVERSIZE_RESOLUTION") == "downscale"
+}
+
+// rejectionError is returned for sources outside the input limits. Retrying
+// cannot help, so the job is marked 'rejected' instead of being retried.
+type rejectionError struct {
+	Reason string
+}
+
+func (e *rejectionError) Error() string {
+	return "source rejected: " + e.Reason
+}
+
+// checkGuardrails enforces the input limits on a probed source of size bytes.
+// For oversized video it returns a scale filter when downscaling is enabled.
+// Audio and video ffprobe couldn't read are rejected, as their duration and
+// resolution are unknown.
+func checkGuardrails(probe *probeResult, kind mediaKind, size int64) (string, error) {
+	if probe != nil {
+		if probed, err := strconv.ParseInt(probe.Format.Size, 10, 64); err == nil && probed > 0 {
+			size = probed
+		}
+	}
+	if maxSize := getMaxSourceSize(); maxSize > 0 && size > maxSize {
+		return "", &rejectionError{Reason: fmt.Sprintf("file is %d bytes, the limit is %d", size, maxSize)}
+	}
+
+	if kind != kindVideo && kind != kindAudio {
+		return "", nil
+	}
+	if probe == nil {
+		return "", &rejectionError{Reason: "the file could not be read as audio or video"}
+	}
+
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		if duration, maxDuration := time.Duration(seconds*float64(time.Second)), getMaxDuration(); duration > maxDuration {
+			return "", &rejectionError{Reason: fmt.Sprintf("duration %s exceeds the limit of %s",
+				duration.Round(time.Second), maxDuration)}
+		}
+	}
+
+	if kind != kindVideo {
+		return "", nil
+	}
+
+	maxWidth, maxHeight := getMaxResolution()
+	for _, s := range probe.Streams {
+		if s.CodecType != "video" || s.Disposition.AttachedPic != 0 {
+			continue
+		}
+		// Portrait video is compared with the limit turned sideways
+		long, short := max(s.Width, s.Height), min(s.Width, s.Height)
+		if long <= maxWidth && short <= maxHeight {
+			continue
+		}
+		if !getDownscaleOversized() {
+			return "", &rejectionError{Reason: fmt.Sprintf("resolution %dx%d exceeds the limit of %dx%d",
+				s.Width, s.Height, maxWidth, maxHeight)}
+		}
+		if s.Width >= s.Height {
+			return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2", maxWidth, maxHeight), nil
+		}
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2", maxHeight, maxWidth), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,86 @@
+package processing
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/team"
+)
+
+// JobAttempt represents a single processing attempt of a media item
+type JobAttempt struct {
+	ID              string     `json:"id"`
+	Status          string     `json:"status"`
+	Preset          string     `json:"preset,omitempty"`
+	Packaging       string     `json:"packaging,omitempty"`
+	Attempt         int        `json:"attempt,omitempty"`
+	ErrorMessage    string     `json:"error_message,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	DurationSeconds *float64   `json:"duration_seconds,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// ListJobsResponse contains the processing history of a media item, newest first
+type ListJobsResponse struct {
+	MediaID string       `json:"media_id"`
+	Jobs    []JobAttempt `json:"jobs"`
+}
+
+// ListJobs returns every processing attempt of a media item
+//
+//encore:api auth method=GET path=/processing/:mediaID/jobs
+func ListJobs(ctx context.Context, mediaID string) (*ListJobsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	// Verify access
+	var ownerID int64
+	var teamID string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, status, COALESCE(preset, ''), COALESCE(packaging, ''), COALESCE(attempt, 0),
+			   COALESCE(error_message, ''), started_at, completed_at,
+			   EXTRACT(EPOCH FROM (completed_at - started_at))::float8, created_at
+		FROM processing_jobs
+		WHERE media_id = $1
+		ORDER BY created_at DESC
+	`, mediaID)
+	if err != nil {
+		rlog.Error("failed to query processing jobs", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list jobs").Err()
+	}
+	defer rows.Close()
+
+	var jobs []JobAttempt
+	for rows.Next() {
+		var j JobAttempt
+		if err := rows.Scan(&j.ID, &j.Status, &j.Preset, &j.Packaging, &j.Attempt,
+			&j.ErrorMessage, &j.StartedAt, &j.CompletedAt, &j.DurationSeconds, &j.CreatedAt); err != nil {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	if jobs == nil {
+		jobs = []JobAttempt{}
+	}
+
+	return &ListJobsResponse{
+		MediaID: mediaID,
+		Jobs:    jobs,
+	}, nil
+}
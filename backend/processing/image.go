@@ -0,0 +1,135 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+func init() {
+	registerHandler(kindImage, processImage)
+}
+
+// imageThumbnailWidth is the width of generated image thumbnails
+const imageThumbnailWidth = 320
+
+// getImageFormat returns the output format for processed images ("webp" or "avif")
+func getImageFormat() string {
+	if val := os.Getenv("PROCESSING_IMAGE_FORMAT"); val == "avif" {
+		return val
+	}
+	return "webp"
+}
+
+// getStripImageMetadata returns whether EXIF/XMP metadata is removed from
+// processed images (enabled unless PROCESSING_STRIP_IMAGE_METADATA=false)
+func getStripImageMetadata() bool {
+	return os.Getenv("PROCESSING_STRIP_IMAGE_METADATA") != "false"
+}
+
+// processImage converts an image to WebP or AVIF, generates a thumbnail,
+// records its dimensions and returns the S3 key of the converted image
+func processImage(ctx context.Context, job *pipelineJob) (pipelineResult, error) {
+	client, mediaID, inputPath, tempDir := job.Client, job.MediaID, job.InputPath, job.TempDir
+
+	width, height := getImageDimensions(ctx, inputPath)
+	if width > 0 && height > 0 {
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET width = $2, height = $3 WHERE id = $1`, mediaID, width, height)
+	}
+
+	format := getImageFormat()
+	outputPath := filepath.Join(tempDir, "output."+format)
+	if err := convertImage(ctx, inputPath, outputPath, tempDir, format, ""); err != nil {
+		return pipelineResult{}, err
+	}
+
+	// Thumbnails are best-effort; the converted image is what matters
+	thumbnailPath := filepath.Join(tempDir, "thumbnail."+format)
+	thumbnailKey := fmt.Sprintf("thumbnails/%s/thumbnail.%s", mediaID, format)
+	scale := fmt.Sprintf("scale='min(%d,iw)':-2", imageThumbnailWidth)
+	if err := convertImage(ctx, inputPath, thumbnailPath, tempDir, format, scale); err == nil {
+		if _, err := objectstore.FPutObject(ctx, client, thumbnailKey, thumbnailPath,
+			minio.PutObjectOptions{ContentType: "image/" + format}); err == nil {
+			_, _ = mediaDB.Exec(ctx, `UPDATE media SET s3_key_thumbnail = $2 WHERE id = $1`, mediaID, thumbnailKey)
+		}
+	}
+
+	processedKey := fmt.Sprintf("processed/%s.%s", mediaID, format)
+	upload, err := uploadVerified(ctx, client, processedKey, outputPath, "image/"+format)
+	if err != nil {
+		return pipelineResult{}, err
+	}
+
+	// Update file size and checksum
+	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2, processed_sha256 = $3 WHERE id = $1`,
+		mediaID, upload.Size, upload.SHA256)
+
+	return pipelineResult{ProcessedKey: processedKey}, nil
+}
+
+// convertImage encodes inputPath as WebP (ffmpeg/libwebp) or AVIF (avifenc,
+// from an intermediate PNG), applying an optional ffmpeg video filter
+func convertImage(ctx context.Context, inputPath, outputPath, tempDir, format, filter string) error {
+	metadata := "0"
+	if getStripImageMetadata() {
+		metadata = "-1"
+	}
+
+	args := []string{"-i", inputPath, "-map_metadata", metadata, "-frames:v", "1"}
+	if filter != "" {
+		args = append(args, "-vf", filter)
+	}
+
+	if format == "webp" {
+		args = append(args, "-c:v", "libwebp", "-quality", "80", "-y", outputPath)
+		if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+			return &ffmpegError{Op: "ffmpeg WebP conversion", Err: err, Output: string(output)}
+		}
+		return nil
+	}
+
+	// AVIF: decode with ffmpeg (handles every input format), encode with avifenc
+	pngPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".png"
+	args = append(args, "-y", pngPath)
+	if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+		return &ffmpegError{Op: "ffmpeg PNG decode", Err: err, Output: string(output)}
+	}
+
+	avifArgs := []string{"--speed", "6", "--min", "20", "--max", "30"}
+	if getStripImageMetadata() {
+		avifArgs = append(avifArgs, "--ignore-exif", "--ignore-xmp")
+	}
+	avifArgs = append(avifArgs, pngPath, outputPath)
+	if output, err := exec.CommandContext(ctx, "avifenc", avifArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("avifenc failed: %w: %s", err, string(output))
+	}
+	return nil
+}
+
+// getImageDimensions returns the width and height of the first video stream
+// of an image, or zeros if they cannot be probed
+func getImageDimensions(ctx context.Context, filePath string) (int, int) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height",
+		"-of", "csv=s=x:p=0",
+		filePath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, 0
+	}
+
+	var width, height int
+	fmt.Sscanf(strings.TrimSpace(string(output)), "%dx%d", &width, &height)
+	return width, height
+}
@@ -0,0 +1,74 @@
+package processing
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// getMaxConcurrency returns the maximum number of media processed in parallel
+// on this instance
+func getMaxConcurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("PROCESSING_MAX_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 2
+}
+
+// getFFmpegThreads returns the ffmpeg thread limit per job (0 lets ffmpeg decide)
+func getFFmpegThreads() int {
+	if n, err := strconv.Atoi(os.Getenv("PROCESSING_FFMPEG_THREADS")); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// getJobTimeout returns the wall-clock limit for processing a single media item
+func getJobTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PROCESSING_JOB_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 2 * time.Hour
+}
+
+// transcodeSlots bounds the number of concurrently processed media items
+var (
+	transcodeSlotsOnce sync.Once
+	transcodeSlots     chan struct{}
+)
+
+// acquireSlot blocks until a processing slot is free or ctx is done
+func acquireSlot(ctx context.Context) error {
+	transcodeSlotsOnce.Do(func() {
+		transcodeSlots = make(chan struct{}, getMaxConcurrency())
+	})
+
+	select {
+	case transcodeSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseSlot frees a slot taken by acquireSlot
+func releaseSlot() {
+	<-transcodeSlots
+}
+
+// ffmpegCommand builds an ffmpeg invocation applying the per-job thread limit.
+// The last argument must be the output path; the limit is inserted before it
+// so it applies to the output encoders.
+func ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	if threads := getFFmpegThreads(); threads > 0 && len(args) > 0 {
+		last := len(args) - 1
+		limited := make([]string, 0, len(args)+2)
+		limited = append(limited, args[:last]...)
+		limited = append(limited, "-threads", strconv.Itoa(threads), args[last])
+		args = limited
+	}
+	return exec.CommandContext(ctx, "ffmpeg", args...)
+}
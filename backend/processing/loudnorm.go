@@ -0,0 +1,58 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// loudnessMeasurement is the JSON printed by the loudnorm filter's first pass
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudness runs the first loudnorm pass over the input's audio and
+// returns the measured values
+func measureLoudness(ctx context.Context, inputPath string, target LoudnessTarget) (*loudnessMeasurement, error) {
+	filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json",
+		target.IntegratedLUFS, target.TruePeakDBTP, target.LoudnessRange)
+	cmd := ffmpegCommand(ctx, "-i", inputPath, "-vn", "-af", filter, "-f", "null", "-")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, &ffmpegError{Op: "ffmpeg loudness measurement", Err: err, Output: string(output)}
+	}
+
+	// The measurement is the last JSON object in the log
+	start := strings.LastIndex(string(output), "{")
+	end := strings.LastIndex(string(output), "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("loudnorm measurement not found in ffmpeg output")
+	}
+
+	var m loudnessMeasurement
+	if err := json.Unmarshal(output[start:end+1], &m); err != nil {
+		return nil, fmt.Errorf("failed to parse loudnorm measurement: %w", err)
+	}
+	return &m, nil
+}
+
+// withLoudnorm returns encoder arguments that apply the second, linear
+// loudnorm pass using the first pass measurement
+func withLoudnorm(args []string, target LoudnessTarget, m *loudnessMeasurement) []string {
+	filter := fmt.Sprintf(
+		"loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		target.IntegratedLUFS, target.TruePeakDBTP, target.LoudnessRange,
+		m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset,
+	)
+
+	result := make([]string, 0, len(args)+4)
+	result = append(result, args...)
+	// loudnorm resamples to 192 kHz internally; bring the output back to 48 kHz
+	return append(result, "-af", filter, "-ar", "48000")
+}
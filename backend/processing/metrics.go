@@ -0,0 +1,243 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	"encore.app/metrics"
+)
+
+// transcodeDurationBuckets are histogram buckets in seconds for job run times
+var transcodeDurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// Pipeline metrics served on /metrics. Unlike GetPrometheusMetrics, which
+// reads the last 24 hours from the database, the histogram counts the jobs
+// this instance finished since it started.
+var (
+	transcodeDuration = metrics.NewHistogram("surtr_transcode_duration_seconds",
+		"Run time of finished processing jobs by worker (internal or external) and status.",
+		transcodeDurationBuckets, "worker", "status")
+
+	_ = metrics.NewGaugeFunc("surtr_queue_depth", "Media items waiting for a worker.",
+		func(ctx context.Context) (float64, error) {
+			var n int
+			err := mediaDB.QueryRow(ctx, `SELECT COUNT(*) FROM media WHERE status = 'queued'`).Scan(&n)
+			return float64(n), err
+		})
+
+	_ = metrics.NewGaugeFunc("surtr_jobs_running", "Processing jobs currently running.",
+		func(ctx context.Context) (float64, error) {
+			var n int
+			err := db.QueryRow(ctx, `SELECT COUNT(*) FROM processing_jobs WHERE status = 'processing'`).Scan(&n)
+			return float64(n), err
+		})
+)
+
+// queueWait returns the seconds since the message being handled was published,
+// which includes redelivery backoff and the wait for a processing slot
+func queueWait() *float64 {
+	req := encore.CurrentRequest()
+	if req == nil || req.Message == nil || req.Message.Published.IsZero() {
+		return nil
+	}
+	wait := time.Since(req.Message.Published).Seconds()
+	return &wait
+}
+
+// exitCode returns the exit status of a failed ffmpeg/ffprobe process, or nil
+// if the error did not come from a process exit
+func exitCode(err error) *int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		return &code
+	}
+	return nil
+}
+
+// MetricsRequest selects the time window of the metrics
+type MetricsRequest struct {
+	// WindowHours defaults to 24
+	WindowHours int `query:"window_hours"`
+}
+
+// DurationStats summarizes a duration distribution in seconds
+type DurationStats struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+// MetricsResponse describes pipeline health over the window
+type MetricsResponse struct {
+	WindowHours int `json:"window_hours"`
+	// QueueDepth and Processing are current values
+	QueueDepth int `json:"queue_depth"`
+	Processing int `json:"processing"`
+
+	Completed   int     `json:"completed"`
+	Failed      int     `json:"failed"`
+	Cancelled   int     `json:"cancelled"`
+	FailureRate float64 `json:"failure_rate"`
+
+	TranscodeSeconds DurationStats `json:"transcode_seconds"`
+	QueueWaitSeconds DurationStats `json:"queue_wait_seconds"`
+	// ExitCodes counts failed attempts by ffmpeg exit code
+	ExitCodes map[string]int `json:"exit_codes"`
+	// DeadLetters is the number of jobs dead-lettered in the window
+	DeadLetters int `json:"dead_letters"`
+}
+
+// GetMetrics returns processing pipeline health metrics (admin only)
+//
+//encore:api auth method=GET path=/processing/metrics
+func GetMetrics(ctx context.Context, req *MetricsRequest) (*MetricsResponse, error) {
+	if err := requireAdmin(); err != nil {
+		return nil, err
+	}
+
+	window := req.WindowHours
+	if window < 1 {
+		window = 24
+	}
+
+	resp, err := collectMetrics(ctx, window)
+	if err != nil {
+		rlog.Error("failed to collect processing metrics", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to collect metrics").Err()
+	}
+	return resp, nil
+}
+
+// collectMetrics aggregates the processing jobs created in the last window hours
+func collectMetrics(ctx context.Context, window int) (*MetricsResponse, error) {
+	resp := &MetricsResponse{
+		WindowHours: window,
+		ExitCodes:   map[string]int{},
+	}
+	since := time.Now().Add(-time.Duration(window) * time.Hour)
+
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FILTER (WHERE status = 'completed'),
+			   COUNT(*) FILTER (WHERE status = 'failed'),
+			   COUNT(*) FILTER (WHERE status = 'cancelled')
+		FROM processing_jobs WHERE created_at >= $1
+	`, since).Scan(&resp.Completed, &resp.Failed, &resp.Cancelled)
+	if err != nil {
+		return nil, err
+	}
+	if finished := resp.Completed + resp.Failed; finished > 0 {
+		resp.FailureRate = float64(resp.Failed) / float64(finished)
+	}
+
+	err = db.QueryRow(ctx, `
+		SELECT COALESCE(AVG(d), 0), COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY d), 0),
+			   COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY d), 0), COALESCE(MAX(d), 0)
+		FROM (
+			SELECT EXTRACT(EPOCH FROM (completed_at - started_at))::float8 AS d
+			FROM processing_jobs WHERE status = 'completed' AND created_at >= $1
+		) t
+	`, since).Scan(&resp.TranscodeSeconds.Avg, &resp.TranscodeSeconds.P50,
+		&resp.TranscodeSeconds.P95, &resp.TranscodeSeconds.Max)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.QueryRow(ctx, `
+		SELECT COALESCE(AVG(queue_wait_seconds), 0),
+			   COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY queue_wait_seconds), 0),
+			   COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY queue_wait_seconds), 0),
+			   COALESCE(MAX(queue_wait_seconds), 0)
+		FROM processing_jobs WHERE queue_wait_seconds IS NOT NULL AND created_at >= $1
+	`, since).Scan(&resp.QueueWaitSeconds.Avg, &resp.QueueWaitSeconds.P50,
+		&resp.QueueWaitSeconds.P95, &resp.QueueWaitSeconds.Max)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT exit_code, COUNT(*) FROM processing_jobs
+		WHERE exit_code IS NOT NULL AND created_at >= $1
+		GROUP BY exit_code
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code, count int
+		if err := rows.Scan(&code, &count); err == nil {
+			resp.ExitCodes[fmt.Sprint(code)] = count
+		}
+	}
+
+	_ = db.QueryRow(ctx, `SELECT COUNT(*) FROM dead_letters WHERE created_at >= $1`, since).Scan(&resp.DeadLetters)
+	_ = db.QueryRow(ctx, `SELECT COUNT(*) FROM processing_jobs WHERE status = 'processing'`).Scan(&resp.Processing)
+	_ = mediaDB.QueryRow(ctx, `SELECT COUNT(*) FROM media WHERE status = 'queued'`).Scan(&resp.QueueDepth)
+
+	return resp, nil
+}
+
+// GetPrometheusMetrics serves the metrics of the last 24 hours in the
+// Prometheus text exposition format (admin only)
+//
+//encore:api auth raw method=GET path=/processing/prometheus
+func GetPrometheusMetrics(w http.ResponseWriter, req *http.Request) {
+	if err := requireAdmin(); err != nil {
+		http.Error(w, "admin access required", http.StatusForbidden)
+		return
+	}
+
+	m, err := collectMetrics(req.Context(), 24)
+	if err != nil {
+		rlog.Error("failed to collect processing metrics", "error", err)
+		http.Error(w, "failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string, value float64, labels string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s%s %g\n", name, help, name, name, labels, value)
+	}
+	gauge("surtr_processing_queue_depth", "Media items waiting for a worker.", float64(m.QueueDepth), "")
+	gauge("surtr_processing_jobs_running", "Jobs currently being processed.", float64(m.Processing), "")
+	gauge("surtr_processing_failure_rate", "Share of finished jobs that failed in the last 24h.", m.FailureRate, "")
+	gauge("surtr_processing_dead_letters", "Jobs dead-lettered in the last 24h.", float64(m.DeadLetters), "")
+
+	fmt.Fprintf(&b, "# HELP surtr_processing_jobs Jobs created in the last 24h by final status.\n# TYPE surtr_processing_jobs gauge\n")
+	fmt.Fprintf(&b, "surtr_processing_jobs{status=\"completed\"} %d\n", m.Completed)
+	fmt.Fprintf(&b, "surtr_processing_jobs{status=\"failed\"} %d\n", m.Failed)
+	fmt.Fprintf(&b, "surtr_processing_jobs{status=\"cancelled\"} %d\n", m.Cancelled)
+
+	for _, d := range []struct {
+		name, help string
+		stats      DurationStats
+	}{
+		{"surtr_processing_transcode_seconds", "Run time of completed jobs in the last 24h.", m.TranscodeSeconds},
+		{"surtr_processing_queue_wait_seconds", "Time from publish to job start in the last 24h.", m.QueueWaitSeconds},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", d.name, d.help, d.name)
+		fmt.Fprintf(&b, "%s{stat=\"avg\"} %g\n", d.name, d.stats.Avg)
+		fmt.Fprintf(&b, "%s{stat=\"p50\"} %g\n", d.name, d.stats.P50)
+		fmt.Fprintf(&b, "%s{stat=\"p95\"} %g\n", d.name, d.stats.P95)
+		fmt.Fprintf(&b, "%s{stat=\"max\"} %g\n", d.name, d.stats.Max)
+	}
+
+	fmt.Fprintf(&b, "# HELP surtr_processing_exit_codes Failed attempts in the last 24h by ffmpeg exit code.\n# TYPE surtr_processing_exit_codes gauge\n")
+	for code, count := range m.ExitCodes {
+		fmt.Fprintf(&b, "surtr_processing_exit_codes{code=%q} %d\n", code, count)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
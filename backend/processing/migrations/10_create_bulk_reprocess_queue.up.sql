@@ -0,0 +1,11 @@
+-- Media selected by bulk reprocessing and not yet queued; the drain job
+-- queues them at the configured rate and removes them. status is the media
+-- status at selection, so items changed since then are skipped. The
+-- original's key is read when the item is queued, as it may move meanwhile.
+CREATE TABLE bulk_reprocess_queue (
+    id BIGSERIAL PRIMARY KEY,
+    media_id UUID NOT NULL UNIQUE,
+    owner_id BIGINT NOT NULL,
+    status TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+-- Allow jobs to be cancelled by their owner
+ALTER TABLE processing_jobs DROP CONSTRAINT processing_jobs_status_check;
+ALTER TABLE processing_jobs ADD CONSTRAINT processing_jobs_status_check
+    CHECK (status IN ('pending', 'processing', 'completed', 'failed', 'cancelled'));
@@ -0,0 +1,16 @@
+-- Messages that exhausted their processing attempts
+CREATE TABLE dead_letters (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    media_id UUID NOT NULL,
+    owner_id BIGINT NOT NULL,
+    s3_key TEXT NOT NULL,
+    packaging TEXT,
+    attempts INT NOT NULL,
+    error_message TEXT NOT NULL,
+    ffmpeg_output TEXT,
+    requeued_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_dead_letters_media ON dead_letters(media_id);
+CREATE INDEX idx_dead_letters_created ON dead_letters(created_at DESC);
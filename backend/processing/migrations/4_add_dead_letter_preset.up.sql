@@ -0,0 +1,2 @@
+-- Keep the requested preset so requeued jobs encode the same way
+ALTER TABLE dead_letters ADD COLUMN preset TEXT;
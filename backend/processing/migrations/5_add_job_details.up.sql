@@ -0,0 +1,6 @@
+-- Record how each attempt was configured for the per-media job history
+ALTER TABLE processing_jobs ADD COLUMN preset TEXT;
+ALTER TABLE processing_jobs ADD COLUMN packaging TEXT;
+ALTER TABLE processing_jobs ADD COLUMN attempt INT;
+
+CREATE INDEX idx_processing_jobs_created ON processing_jobs(created_at DESC);
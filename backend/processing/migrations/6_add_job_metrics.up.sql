@@ -0,0 +1,3 @@
+-- Pipeline health metrics per attempt
+ALTER TABLE processing_jobs ADD COLUMN queue_wait_seconds DOUBLE PRECISION;
+ALTER TABLE processing_jobs ADD COLUMN exit_code INT;
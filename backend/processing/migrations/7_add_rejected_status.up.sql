@@ -0,0 +1,4 @@
+-- Sources outside the configured input limits are rejected without retries
+ALTER TABLE processing_jobs DROP CONSTRAINT processing_jobs_status_check;
+ALTER TABLE processing_jobs ADD CONSTRAINT processing_jobs_status_check
+    CHECK (status IN ('pending', 'processing', 'completed', 'failed', 'cancelled', 'rejected'));
@@ -0,0 +1,10 @@
+-- Encodes handed to external workers (PROCESSING_EXTERNAL_WORKERS=true)
+ALTER TABLE processing_jobs ADD COLUMN worker_args JSONB;
+ALTER TABLE processing_jobs ADD COLUMN input_key TEXT;
+ALTER TABLE processing_jobs ADD COLUMN output_key TEXT;
+ALTER TABLE processing_jobs ADD COLUMN content_type TEXT;
+ALTER TABLE processing_jobs ADD COLUMN worker_id TEXT;
+ALTER TABLE processing_jobs ADD COLUMN heartbeat_at TIMESTAMP;
+ALTER TABLE processing_jobs ADD COLUMN progress DOUBLE PRECISION;
+
+CREATE INDEX idx_processing_jobs_external ON processing_jobs(created_at) WHERE status = 'pending' AND worker_args IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Idempotency-Key headers of mutating requests and the responses replayed
+-- to their retries
+CREATE TABLE idempotency_keys (
+    user_id BIGINT NOT NULL,
+    endpoint TEXT NOT NULL,
+    key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    -- NULL while the first request is running
+    response JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, endpoint, key)
+);
+
+CREATE INDEX idx_idempotency_keys_created ON idempotency_keys(user_id, created_at);
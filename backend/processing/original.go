@@ -0,0 +1,33 @@
+package processing
+
+import (
+	"context"
+	"errors"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+
+	"encore.app/media"
+)
+
+// useOriginal marks the original of a media item as used now, so the media
+// service doesn't move it to cold storage while a job reads it. It fails
+// unless the original is in the main bucket.
+func useOriginal(ctx context.Context, mediaID string) error {
+	var tier string
+	err := mediaDB.QueryRow(ctx, `
+		UPDATE media SET original_used_at = NOW() WHERE id = $1
+		RETURNING storage_tier
+	`, mediaID).Scan(&tier)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err != nil {
+		return errs.B().Code(errs.Internal).Msg("failed to check storage tier").Err()
+	}
+	if tier != media.TierHot {
+		return errs.B().Code(errs.FailedPrecondition).
+			Msg("the original is in cold storage; restore it with POST /media/:id/restore first").Err()
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package processing
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getPassthroughEnabled returns whether web-compatible sources are remuxed
+// instead of re-encoded (enabled unless PROCESSING_PASSTHROUGH=false)
+func getPassthroughEnabled() bool {
+	return os.Getenv("PROCESSING_PASSTHROUGH") != "false"
+}
+
+// getPassthroughMaxBitRate returns the highest source bit rate (bits per
+// second) still eligible for passthrough
+func getPassthroughMaxBitRate() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("PROCESSING_PASSTHROUGH_MAX_BITRATE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 8_000_000
+}
+
+// canPassthrough reports whether the probed source is already an MP4 with a
+// video codec accepted by the preset, AAC (or no) audio and a bit rate within
+// the target, so a remux with -c copy is enough
+func canPassthrough(probe *probeResult, preset Preset) bool {
+	// Normalizing loudness requires re-encoding the audio
+	if !getPassthroughEnabled() || probe == nil || preset.Loudness != nil {
+		return false
+	}
+	if !strings.Contains(probe.Format.FormatName, "mp4") {
+		return false
+	}
+
+	video, audio := probe.codecs()
+	if audio != "" && audio != "aac" {
+		return false
+	}
+	accepted := false
+	for _, codec := range preset.PassthroughCodecs {
+		if video == codec {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return false
+	}
+
+	bitRate := probe.bitRate()
+	return bitRate > 0 && bitRate <= getPassthroughMaxBitRate()
+}
+
+// passthroughArgs returns the ffmpeg encoder arguments for a remux-only copy
+func passthroughArgs(probe *probeResult) []string {
+	args := []string{"-c", "copy"}
+	if video, _ := probe.codecs(); video == "hevc" {
+		// Apple players require the hvc1 tag for HEVC in MP4
+		args = append(args, "-tag:v", "hvc1")
+	}
+	return args
+}
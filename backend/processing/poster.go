@@ -0,0 +1,177 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	authpkg "encore.app/auth"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// Scene detection tuning: frames whose scene score exceeds posterSceneThreshold
+// are candidates, and candidates with an average luma outside
+// [posterMinLuma, posterMaxLuma] are treated as black or blown-out frames
+const (
+	posterSceneThreshold = 0.3
+	posterMinLuma        = 30
+	posterMaxLuma        = 225
+)
+
+// showinfoPattern extracts the timestamp and mean luma of frames logged by
+// ffmpeg's showinfo filter
+var showinfoPattern = regexp.MustCompile(`pts_time:\s*([0-9.]+).*?mean:\[(\d+)`)
+
+// pickPosterTimestamp runs scene detection over the video's keyframes and
+// returns the timestamp of a representative, non-black frame: the first
+// scene change past 10% of the video, else the first usable one, else 10%
+// of the duration
+func pickPosterTimestamp(ctx context.Context, inputPath string, duration int) float64 {
+	fallback := float64(duration) / 10
+
+	cmd := ffmpegCommand(ctx,
+		"-skip_frame", "nokey",
+		"-i", inputPath,
+		"-vf", fmt.Sprintf("select='gt(scene,%g)',showinfo", posterSceneThreshold),
+		"-vsync", "vfr",
+		"-an",
+		"-f", "null",
+		"-",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fallback
+	}
+
+	first := -1.0
+	for _, match := range showinfoPattern.FindAllStringSubmatch(string(output), -1) {
+		ts, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			continue
+		}
+		luma, _ := strconv.Atoi(match[2])
+		if luma < posterMinLuma || luma > posterMaxLuma {
+			continue
+		}
+		if ts >= fallback {
+			return ts
+		}
+		if first < 0 {
+			first = ts
+		}
+	}
+
+	if first >= 0 {
+		return first
+	}
+	return fallback
+}
+
+// generatePoster extracts the frame at timestamp as a JPEG poster, uploads it
+// as the media thumbnail and records the timestamp
+func generatePoster(ctx context.Context, client *minio.Client, mediaID, inputPath, tempDir string, timestamp float64) error {
+	posterPath := filepath.Join(tempDir, "poster.jpg")
+	cmd := ffmpegCommand(ctx,
+		"-ss", strconv.FormatFloat(timestamp, 'f', 3, 64),
+		"-i", inputPath,
+		"-frames:v", "1",
+		"-q:v", "3",
+		"-y",
+		posterPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return &ffmpegError{Op: "ffmpeg poster extraction", Err: err, Output: string(output)}
+	}
+
+	posterKey := fmt.Sprintf("thumbnails/%s/poster.jpg", mediaID)
+	if _, err := objectstore.FPutObject(ctx, client, posterKey, posterPath,
+		minio.PutObjectOptions{ContentType: "image/jpeg"}); err != nil {
+		return fmt.Errorf("failed to upload poster: %w", err)
+	}
+
+	_, err := mediaDB.Exec(ctx, `
+		UPDATE media SET s3_key_thumbnail = $2, poster_timestamp = $3 WHERE id = $1
+	`, mediaID, posterKey, timestamp)
+	return err
+}
+
+// SetPosterRequest contains the timestamp of the frame to use as poster
+type SetPosterRequest struct {
+	TimestampSeconds float64 `json:"timestamp_seconds"`
+}
+
+// SetPosterResponse contains the new poster timestamp
+type SetPosterResponse struct {
+	MediaID          string  `json:"media_id"`
+	TimestampSeconds float64 `json:"timestamp_seconds"`
+}
+
+// SetPoster overrides the automatically picked poster with the frame at the
+// given timestamp of the original video
+//
+//encore:api auth method=PUT path=/processing/:mediaID/poster
+func SetPoster(ctx context.Context, mediaID string, req *SetPosterRequest) (*SetPosterResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	// Verify access
+	var ownerID int64
+	var s3Key, mimeType, teamID string
+	var duration int
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, s3_key_original, COALESCE(mime_type, ''), COALESCE(duration_seconds, 0),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &s3Key, &mimeType, &duration, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if classifyMedia(mimeType, s3Key, nil) != kindVideo {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("posters are only available for videos").Err()
+	}
+	if req.TimestampSeconds < 0 || (duration > 0 && req.TimestampSeconds >= float64(duration)) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("timestamp is outside the video").Err()
+	}
+	if err := useOriginal(ctx, mediaID); err != nil {
+		return nil, err
+	}
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+
+	// ffmpeg seeks over HTTP, so only the needed part of the original is read
+	inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), s3Key, streamingInputTTL(), nil)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to sign original").Err()
+	}
+
+	tempDir, err := os.MkdirTemp("", "media-poster-")
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create temp directory").Err()
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := generatePoster(ctx, client, mediaID, inputURL.String(), tempDir, req.TimestampSeconds); err != nil {
+		rlog.Error("failed to set poster", "error", err, "media_id", mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to extract poster").Err()
+	}
+
+	return &SetPosterResponse{
+		MediaID:          mediaID,
+		TimestampSeconds: req.TimestampSeconds,
+	}, nil
+}
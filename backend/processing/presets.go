@@ -0,0 +1,45 @@
+package processing
+
+import (
+	"context"
+	"sort"
+
+	"encore.app/transcode"
+)
+
+// Preset is a named set of ffmpeg encoding parameters
+type Preset = transcode.Preset
+
+// LoudnessTarget holds EBU R128 loudness normalization targets
+type LoudnessTarget = transcode.LoudnessTarget
+
+// presets are the transcode presets available to uploads and reprocess requests
+var presets = transcode.Presets
+
+// resolvePreset returns the named preset, falling back to the configured
+// default for empty or unknown names
+func resolvePreset(name string) Preset {
+	return transcode.Resolve(name)
+}
+
+// ListPresetsResponse contains the available transcode presets
+type ListPresetsResponse struct {
+	Presets []Preset `json:"presets"`
+	Default string   `json:"default"`
+}
+
+// ListPresets returns the available transcode presets and their parameters
+//
+//encore:api auth method=GET path=/presets
+func ListPresets(ctx context.Context) (*ListPresetsResponse, error) {
+	list := make([]Preset, 0, len(presets))
+	for _, preset := range presets {
+		list = append(list, preset)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return &ListPresetsResponse{
+		Presets: list,
+		Default: resolvePreset("").Name,
+	}, nil
+}
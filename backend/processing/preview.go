@@ -0,0 +1,65 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+// Preview clip layout: previewScenes one-second excerpts spread across the video
+const (
+	previewScenes = 4
+	previewWidth  = 320
+)
+
+// generatePreviewClip renders a short muted WebM made of one-second excerpts
+// taken at evenly spaced points of the video, uploads it under
+// previews/<mediaID>.webm and records its key on the media item.
+func generatePreviewClip(ctx context.Context, client *minio.Client, mediaID, inputPath, tempDir string) error {
+	duration := getVideoDuration(ctx, inputPath)
+	if duration <= 0 {
+		return fmt.Errorf("unknown video duration")
+	}
+
+	// Short videos are previewed from the start; longer ones sample scenes at
+	// 20%, 40%, 60% and 80% of their duration
+	filter := fmt.Sprintf("scale=%d:-2", previewWidth)
+	if duration > previewScenes+1 {
+		ranges := make([]string, 0, previewScenes)
+		for i := 1; i <= previewScenes; i++ {
+			start := duration * i / (previewScenes + 1)
+			ranges = append(ranges, fmt.Sprintf("between(t,%d,%d)", start, start+1))
+		}
+		filter = fmt.Sprintf("select='%s',setpts=N/FRAME_RATE/TB,%s", strings.Join(ranges, "+"), filter)
+	}
+
+	previewPath := filepath.Join(tempDir, "preview.webm")
+	cmd := ffmpegCommand(ctx,
+		"-i", inputPath,
+		"-vf", filter,
+		"-an",
+		"-t", fmt.Sprintf("%d", previewScenes),
+		"-c:v", "libvpx-vp9",
+		"-b:v", "300k",
+		"-deadline", "realtime",
+		"-y",
+		previewPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg preview generation failed: %w: %s", err, string(output))
+	}
+
+	previewKey := fmt.Sprintf("previews/%s.webm", mediaID)
+	if _, err := objectstore.FPutObject(ctx, client, previewKey, previewPath,
+		minio.PutObjectOptions{ContentType: "video/webm"}); err != nil {
+		return fmt.Errorf("failed to upload preview clip: %w", err)
+	}
+
+	_, err := mediaDB.Exec(ctx, `UPDATE media SET s3_key_preview = $2 WHERE id = $1`, mediaID, previewKey)
+	return err
+}
@@ -0,0 +1,101 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"encore.dev/rlog"
+)
+
+// probeResult is the subset of `ffprobe -show_format -show_streams` output
+// used to make processing decisions
+type probeResult struct {
+	Format  probeFormat   `json:"format"`
+	Streams []probeStream `json:"streams"`
+
+	// raw is the complete ffprobe JSON document
+	raw []byte
+}
+
+type probeFormat struct {
+	FormatName string `json:"format_name"`
+	Duration   string `json:"duration"`
+	Size       string `json:"size"`
+	BitRate    string `json:"bit_rate"`
+}
+
+type probeStream struct {
+	Index       int              `json:"index"`
+	CodecType   string           `json:"codec_type"`
+	CodecName   string           `json:"codec_name"`
+	Width       int              `json:"width,omitempty"`
+	Height      int              `json:"height,omitempty"`
+	Channels    int              `json:"channels,omitempty"`
+	Tags        probeTags        `json:"tags"`
+	Disposition probeDisposition `json:"disposition"`
+}
+
+type probeTags struct {
+	Language string `json:"language"`
+	Title    string `json:"title"`
+}
+
+type probeDisposition struct {
+	Default     int `json:"default"`
+	AttachedPic int `json:"attached_pic"`
+}
+
+// probeMedia runs ffprobe on a local file
+func probeMedia(ctx context.Context, filePath string) (*probeResult, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		filePath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	result.raw = output
+	return &result, nil
+}
+
+// recordProbe stores the complete ffprobe output on the media item
+func recordProbe(ctx context.Context, mediaID string, probe *probeResult) {
+	if probe == nil {
+		return
+	}
+	if _, err := mediaDB.Exec(ctx, `UPDATE media SET probe_data = $2 WHERE id = $1`, mediaID, string(probe.raw)); err != nil {
+		rlog.Error("failed to record probe data", "error", err, "media_id", mediaID)
+	}
+}
+
+// bitRate returns the overall bit rate in bits per second, or 0 if unknown
+func (p *probeResult) bitRate() int64 {
+	n, _ := strconv.ParseInt(p.Format.BitRate, 10, 64)
+	return n
+}
+
+// codecs returns the codec names of the first video and audio streams
+func (p *probeResult) codecs() (video, audio string) {
+	for _, s := range p.Streams {
+		switch {
+		case s.CodecType == "video" && video == "":
+			video = s.CodecName
+		case s.CodecType == "audio" && audio == "":
+			audio = s.CodecName
+		}
+	}
+	return video, audio
+}
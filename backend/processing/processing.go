@@ -3,47 +3,46 @@ package processing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
 	"encore.dev/storage/sqldb"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 
 	"encore.app/media"
+	"encore.app/metrics"
+	"encore.app/objectstore"
 )
 
 // Secrets for S3/MinIO
 var secrets struct {
 	S3AccessKey string
 	S3SecretKey string
+	// ProcessingWorkerToken authenticates external workers (X-Worker-Token)
+	ProcessingWorkerToken string
 }
 
-// getS3Endpoint returns the S3 endpoint
-func getS3Endpoint() string {
-	if val := os.Getenv("S3_ENDPOINT"); val != "" {
-		return val
-	}
-	return "localhost:9000"
-}
+// Packaging targets for processed video
+const (
+	PackagingMP4  = "mp4"
+	PackagingDASH = "dash"
+)
 
-// getS3Bucket returns the S3 bucket name
-func getS3Bucket() string {
-	if val := os.Getenv("S3_BUCKET"); val != "" {
+// getDefaultPackaging returns the packaging target used when a media item
+// does not request one explicitly
+func getDefaultPackaging() string {
+	if val := os.Getenv("PROCESSING_PACKAGING"); val == PackagingDASH {
 		return val
 	}
-	return "media-vault"
-}
-
-// getS3UseSSL returns whether to use SSL for S3
-func getS3UseSSL() bool {
-	return os.Getenv("S3_USE_SSL") == "true"
+	return PackagingMP4
 }
 
 // Database for processing jobs
@@ -54,69 +53,189 @@ var db = sqldb.NewDatabase("processing", sqldb.DatabaseConfig{
 // MediaDatabase for updating media status
 var mediaDB = sqldb.Named("media")
 
-// getMinioClient creates a MinIO client
+// getMinioClient returns the shared MinIO client of the processing service
 func getMinioClient() (*minio.Client, error) {
-	return minio.New(getS3Endpoint(), &minio.Options{
-		Creds:  credentials.NewStaticV4(secrets.S3AccessKey, secrets.S3SecretKey, ""),
-		Secure: getS3UseSSL(),
-	})
+	return objectstore.Client("processing", secrets.S3AccessKey, secrets.S3SecretKey)
 }
 
 // ProcessMediaSubscription handles media upload events
 var _ = pubsub.NewSubscription(media.MediaUploadedTopic, "processing-worker",
 	pubsub.SubscriptionConfig[*media.MediaUploaded]{
 		Handler: processMedia,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+			// processMedia dead-letters the message itself on its last attempt
+			MaxRetries: maxDeliveryAttempts,
+		},
 	},
 )
 
 func processMedia(ctx context.Context, msg *media.MediaUploaded) error {
-	rlog.Info("processing media", "media_id", msg.MediaID, "s3_key", msg.S3Key)
+	packaging := msg.Packaging
+	if packaging == "" {
+		packaging = getDefaultPackaging()
+	}
+	preset := resolvePreset(msg.Preset)
+
+	rlog.Info("processing media", "media_id", msg.MediaID, "s3_key", msg.S3Key,
+		"packaging", packaging, "preset", preset.Name)
+
+	// Skip media that was cancelled or deleted before the worker picked it up
+	var mediaStatus, mimeType string
+	var audioLanguages []string
+	var trimStart, trimEnd *float64
+	err := mediaDB.QueryRow(ctx, `
+		SELECT status, COALESCE(mime_type, ''), COALESCE(audio_languages, '{}'), trim_start_seconds, trim_end_seconds
+		FROM media WHERE id = $1
+	`, msg.MediaID).Scan(&mediaStatus, &mimeType, &audioLanguages, &trimStart, &trimEnd)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		rlog.Info("media no longer exists, skipping", "media_id", msg.MediaID)
+		return nil
+	}
+	if err != nil {
+		rlog.Error("failed to get media status", "error", err)
+		return err
+	}
+	if mediaStatus != "queued" {
+		// Also covers duplicate deliveries of a message whose media is already
+		// being processed or was completed by another delivery
+		rlog.Info("media is not queued, skipping", "media_id", msg.MediaID, "status", mediaStatus)
+		return nil
+	}
+
+	// Wait for a free slot; if the wait is interrupted the message is redelivered
+	if err := acquireSlot(ctx); err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	// Claim the media by moving it from 'queued' to 'processing' atomically, so
+	// of several deliveries of the same message only one transcodes. Media left
+	// in 'processing' by a crashed worker is re-queued by recovery.
+	claim, err := mediaDB.Exec(ctx, `
+		UPDATE media SET status = 'processing' WHERE id = $1 AND status = 'queued'
+	`, msg.MediaID)
+	if err != nil {
+		rlog.Error("failed to update media status", "error", err)
+		return err
+	}
+	if claim.RowsAffected() == 0 {
+		rlog.Info("media was claimed by another delivery, skipping", "media_id", msg.MediaID)
+		return nil
+	}
+	publishMediaStatus(ctx, msg.MediaID, msg.OwnerID, "processing")
 
 	// Create processing job record
 	var jobID string
-	err := db.QueryRow(ctx, `
-		INSERT INTO processing_jobs (media_id, status, started_at)
-		VALUES ($1, 'processing', NOW())
+	err = db.QueryRow(ctx, `
+		INSERT INTO processing_jobs (media_id, status, preset, packaging, attempt, queue_wait_seconds, started_at)
+		VALUES ($1, 'processing', $2, $3, $4, $5, NOW())
 		RETURNING id
-	`, msg.MediaID).Scan(&jobID)
+	`, msg.MediaID, preset.Name, packaging, deliveryAttempt(), queueWait()).Scan(&jobID)
 	if err != nil {
 		rlog.Error("failed to create processing job", "error", err)
 	}
 
-	// Update media status to 'processing'
-	_, err = mediaDB.Exec(ctx, `UPDATE media SET status = 'processing' WHERE id = $1`, msg.MediaID)
-	if err != nil {
-		rlog.Error("failed to update media status", "error", err)
-		return err
+	// Process the media; CancelJob may cancel jobCtx to terminate ffmpeg
+	jobCtx, release := trackJob(ctx, msg.MediaID)
+	defer release()
+	jobCtx, cancelTimeout := context.WithTimeout(jobCtx, getJobTimeout())
+	defer cancelTimeout()
+
+	started := time.Now()
+	result, err := runPipeline(jobCtx, jobSpec{
+		JobID:          jobID,
+		MediaID:        msg.MediaID,
+		S3Key:          msg.S3Key,
+		MimeType:       mimeType,
+		Packaging:      packaging,
+		Preset:         preset,
+		AudioLanguages: audioLanguages,
+		TrimStart:      trimStart,
+		TrimEnd:        trimEnd,
+	})
+	if err != nil && errors.Is(jobCtx.Err(), context.Canceled) && ctx.Err() == nil {
+		// CancelJob already updated the job and media status
+		rlog.Info("media processing cancelled", "media_id", msg.MediaID)
+		return nil
+	}
+	if errors.Is(err, errExternalJob) {
+		// The media stays 'processing' until a worker completes the job
+		return nil
+	}
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		// Limits are deterministic, so the message is not retried
+		rlog.Info("media rejected", "media_id", msg.MediaID, "reason", rejection.Reason)
+		transcodeDuration.ObserveSince(started, "internal", "rejected")
+		if !finishMedia(ctx, msg.MediaID, "failed") {
+			return nil
+		}
+		if jobID != "" {
+			_, _ = db.Exec(ctx, `
+				UPDATE processing_jobs
+				SET status = 'rejected', error_message = $2, completed_at = NOW()
+				WHERE id = $1
+			`, jobID, rejection.Error())
+		}
+		publishFinished(ctx, msg.MediaID, msg.OwnerID, "failed", rejection.Reason)
+		return nil
 	}
-
-	// Process the video
-	processedKey, err := transcodeVideo(ctx, msg.MediaID, msg.S3Key)
 	if err != nil {
-		rlog.Error("transcoding failed", "error", err, "media_id", msg.MediaID)
+		attempt := deliveryAttempt()
+		rlog.Error("transcoding failed", "error", err, "media_id", msg.MediaID, "attempt", attempt)
+		transcodeDuration.ObserveSince(started, "internal", "failed")
+
+		// Attempts left: keep the media queued and let pubsub redeliver;
+		// otherwise mark it failed
+		status := "queued"
+		if attempt >= maxDeliveryAttempts {
+			status = "failed"
+		}
+		if !finishMedia(ctx, msg.MediaID, status) {
+			return nil
+		}
 
-		// Update status to failed
-		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1`, msg.MediaID)
 		if jobID != "" {
 			_, _ = db.Exec(ctx, `
 				UPDATE processing_jobs 
-				SET status = 'failed', error_message = $2, completed_at = NOW()
+				SET status = 'failed', error_message = $2, exit_code = $3, completed_at = NOW()
 				WHERE id = $1
-			`, jobID, err.Error())
+			`, jobID, err.Error(), exitCode(err))
 		}
-		return err
+
+		if status == "queued" {
+			publishMediaStatus(ctx, msg.MediaID, msg.OwnerID, "queued")
+			return err
+		}
+
+		// Out of attempts: park the message in the dead-letter table
+		if dlErr := deadLetter(ctx, msg, packaging, preset.Name, attempt, err); dlErr != nil {
+			rlog.Error("failed to dead-letter message", "error", dlErr, "media_id", msg.MediaID)
+			return err
+		}
+		publishFinished(ctx, msg.MediaID, msg.OwnerID, "failed", "processing failed after repeated attempts")
+		return nil
 	}
 
-	// Update media with processed key and status
-	_, err = mediaDB.Exec(ctx, `
+	// Update media with processed key and status; packaging and preset are
+	// only recorded when the pipeline applied them. Media cancelled or
+	// deleted while the pipeline ran keeps its state.
+	done, err := mediaDB.Exec(ctx, `
 		UPDATE media 
-		SET status = 'ready', s3_key_processed = $2 
-		WHERE id = $1
-	`, msg.MediaID, processedKey)
+		SET status = 'ready', s3_key_processed = $2, packaging = NULLIF($3, ''), preset = NULLIF($4, ''),
+			processed_sha256 = CASE WHEN $2 = '' THEN NULL ELSE processed_sha256 END
+		WHERE id = $1 AND status = 'processing'
+	`, msg.MediaID, result.ProcessedKey, result.Packaging, result.Preset)
 	if err != nil {
 		rlog.Error("failed to update media with processed key", "error", err)
 		return err
 	}
+	if done.RowsAffected() == 0 {
+		rlog.Info("media changed while processing, dropping result", "media_id", msg.MediaID)
+		return nil
+	}
 
 	// Update processing job as completed
 	if jobID != "" {
@@ -127,70 +246,170 @@ func processMedia(ctx context.Context, msg *media.MediaUploaded) error {
 		`, jobID)
 	}
 
-	rlog.Info("media processing completed", "media_id", msg.MediaID, "processed_key", processedKey)
+	transcodeDuration.ObserveSince(started, "internal", "completed")
+	rlog.Info("media processing completed", "media_id", msg.MediaID, "processed_key", result.ProcessedKey)
+	publishFinished(ctx, msg.MediaID, msg.OwnerID, "ready", "")
 	return nil
 }
 
-func transcodeVideo(ctx context.Context, mediaID, s3Key string) (string, error) {
+// finishMedia moves media out of 'processing' into status and reports
+// whether it was still processing. Media cancelled or deleted meanwhile is
+// left alone, and the caller drops the job's outcome.
+func finishMedia(ctx context.Context, mediaID, status string) bool {
+	result, err := mediaDB.Exec(ctx, `
+		UPDATE media SET status = $2 WHERE id = $1 AND status = 'processing'
+	`, mediaID, status)
+	if err != nil {
+		rlog.Error("failed to update media status", "error", err, "media_id", mediaID)
+		return false
+	}
+	if result.RowsAffected() == 0 {
+		rlog.Info("media changed while processing, dropping outcome", "media_id", mediaID)
+		return false
+	}
+	return true
+}
+
+// jobSpec describes what a processing job should produce
+type jobSpec struct {
+	JobID     string
+	MediaID   string
+	S3Key     string
+	MimeType  string
+	Packaging string
+	Preset    Preset
+	// AudioLanguages restricts the kept audio tracks; empty keeps all of them
+	AudioLanguages []string
+	// TrimStart and TrimEnd restrict audio and video to this range in seconds
+	TrimStart *float64
+	TrimEnd   *float64
+}
+
+// runPipeline reads the original, routes it to the sub-pipeline registered for
+// its media kind and returns what that pipeline produced
+func runPipeline(ctx context.Context, spec jobSpec) (pipelineResult, error) {
 	client, err := getMinioClient()
 	if err != nil {
-		return "", fmt.Errorf("failed to create MinIO client: %w", err)
+		return pipelineResult{}, fmt.Errorf("failed to create MinIO client: %w", err)
 	}
 
 	// Create temp directory for processing
 	tempDir, err := os.MkdirTemp("", "media-processing-")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return pipelineResult{}, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
-	// Download original file
-	inputPath := filepath.Join(tempDir, "input"+filepath.Ext(s3Key))
-	object, err := client.GetObject(ctx, getS3Bucket(), s3Key, minio.GetObjectOptions{})
-	if err != nil {
-		return "", fmt.Errorf("failed to get object from S3: %w", err)
+	// Clips and extracted audio are cut from their source before being
+	// processed like any upload
+	if err := materializeDerived(ctx, client, spec, tempDir); err != nil {
+		return pipelineResult{}, err
+	}
+
+	// Files whose MIME type or extension rules out every pipeline are kept
+	// as uploaded without reading them
+	kind := classifyMedia(spec.MimeType, spec.S3Key, nil)
+	if kind == kindOther {
+		rlog.Info("file is not media, skipping processing", "s3_key", spec.S3Key, "mime_type", spec.MimeType)
+		return pipelineResult{}, nil
+	}
+
+	// In streaming mode ffmpeg reads videos straight from a presigned URL;
+	// otherwise the original is downloaded first
+	streaming := getStreamingEnabled() && kind == kindVideo
+	var inputPath string
+	if streaming {
+		inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), spec.S3Key, streamingInputTTL(), nil)
+		if err != nil {
+			return pipelineResult{}, fmt.Errorf("failed to presign input: %w", err)
+		}
+		inputPath = inputURL.String()
+	} else {
+		inputPath = filepath.Join(tempDir, "input"+filepath.Ext(spec.S3Key))
+		if err := downloadObject(ctx, client, spec.S3Key, inputPath); err != nil {
+			return pipelineResult{}, err
+		}
 	}
-	defer object.Close()
 
-	inputFile, err := os.Create(inputPath)
+	probe, err := probeMedia(ctx, inputPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create input file: %w", err)
+		rlog.Error("failed to probe source", "error", err, "media_id", spec.MediaID)
+	}
+	recordProbe(ctx, spec.MediaID, probe)
+
+	// The streams ffprobe found override the uploader's MIME type
+	kind = classifyMedia(spec.MimeType, spec.S3Key, probe)
+	handler, ok := handlers[kind]
+	if !ok {
+		rlog.Info("no pipeline for media kind, skipping processing", "s3_key", spec.S3Key, "kind", kind)
+		return pipelineResult{}, nil
 	}
 
-	_, err = io.Copy(inputFile, object)
-	inputFile.Close()
+	// Pathological sources are rejected before any expensive work; the stored
+	// size counts when ffprobe couldn't read the file
+	var size int64
+	if info, err := client.StatObject(ctx, objectstore.Bucket(), spec.S3Key, minio.StatObjectOptions{}); err == nil {
+		size = info.Size
+	}
+	downscale, err := checkGuardrails(probe, kind, size)
 	if err != nil {
-		return "", fmt.Errorf("failed to download file: %w", err)
+		return pipelineResult{}, err
+	}
+
+	// Only the video pipeline reads its input over HTTP
+	if streaming && kind != kindVideo {
+		streaming = false
+		inputPath = filepath.Join(tempDir, "input"+filepath.Ext(spec.S3Key))
+		if err := downloadObject(ctx, client, spec.S3Key, inputPath); err != nil {
+			return pipelineResult{}, err
+		}
+	}
+
+	// Trimmed uploads are processed from a local cut of the requested range
+	if spec.trimmed() && (kind == kindVideo || kind == kindAudio) {
+		trimmedPath, err := trimInput(ctx, spec, inputPath, tempDir, kind)
+		if err != nil {
+			return pipelineResult{}, err
+		}
+		inputPath = trimmedPath
+		streaming = false
 	}
 
+	rlog.Info("routing media", "media_id", spec.MediaID, "kind", kind)
+
+	return handler(ctx, &pipelineJob{
+		jobSpec:   spec,
+		Client:    client,
+		InputPath: inputPath,
+		TempDir:   tempDir,
+		Probe:     probe,
+		Streaming: streaming,
+		Downscale: downscale,
+	})
+}
+
+// encodeFile runs ffmpeg on a local file with the given encoder arguments,
+// uploads the (fast-start for MP4) output as processed/<id>.<container> and records its
+// duration and size
+func encodeFile(ctx context.Context, job *pipelineJob, encoderArgs []string, preset Preset) (string, error) {
+	mediaID := job.MediaID
+
 	// Prepare output path
-	outputPath := filepath.Join(tempDir, "output.mp4")
-
-	// Check if file is a video that needs transcoding
-	if !isVideoFile(s3Key) {
-		rlog.Info("file is not a video, skipping transcoding", "s3_key", s3Key)
-		// For non-video files, just mark as ready without transcoding
-		return "", nil
-	}
-
-	// Run FFMPEG transcoding
-	// Command: ffmpeg -i input -c:v libx265 -crf 28 -preset fast -tag:v hvc1 -c:a aac -movflags +faststart output.mp4
-	cmd := exec.CommandContext(ctx, "ffmpeg",
-		"-i", inputPath,
-		"-c:v", "libx265",
-		"-crf", "28",
-		"-preset", "fast",
-		"-tag:v", "hvc1",
-		"-c:a", "aac",
-		"-movflags", "+faststart",
-		"-y",
-		outputPath,
-	)
+	outputPath := filepath.Join(job.TempDir, "output."+preset.Container)
+
+	// Run FFMPEG transcoding with the encoder arguments, e.g. for archive-hevc:
+	// ffmpeg -i input -c:v libx265 -crf 28 -preset fast -tag:v hvc1 -c:a aac -movflags +faststart output.mp4
+	args := append([]string{"-i", job.InputPath}, encoderArgs...)
+	if preset.Container == "mp4" || preset.Container == "m4a" {
+		args = append(args, "-movflags", "+faststart")
+	}
+	args = append(args, "-y", outputPath)
+	cmd := ffmpegCommand(ctx, args...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		rlog.Error("ffmpeg failed", "error", err, "output", string(output))
-		return "", fmt.Errorf("ffmpeg transcoding failed: %w", err)
+		return "", &ffmpegError{Op: "ffmpeg transcoding", Err: err, Output: string(output)}
 	}
 
 	// Get video duration using ffprobe
@@ -200,40 +419,54 @@ func transcodeVideo(ctx context.Context, mediaID, s3Key string) (string, error)
 	}
 
 	// Upload processed file to S3
-	processedKey := fmt.Sprintf("processed/%s.mp4", mediaID)
+	processedKey := fmt.Sprintf("processed/%s.%s", mediaID, preset.Container)
+	upload, err := uploadVerified(ctx, job.Client, processedKey, outputPath, preset.ContentType)
+	if err != nil {
+		return "", err
+	}
 
-	outputFile, err := os.Open(outputPath)
+	// Update file size and checksum
+	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2, processed_sha256 = $3 WHERE id = $1`,
+		mediaID, upload.Size, upload.SHA256)
+
+	return processedKey, nil
+}
+
+// downloadObject copies an S3 object to a local file
+func downloadObject(ctx context.Context, client *minio.Client, s3Key, path string) error {
+	object, err := client.GetObject(ctx, objectstore.Bucket(), s3Key, minio.GetObjectOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to open output file: %w", err)
+		return fmt.Errorf("failed to get object from S3: %w", err)
 	}
-	defer outputFile.Close()
+	defer object.Close()
 
-	stat, err := outputFile.Stat()
+	file, err := os.Create(path)
 	if err != nil {
-		return "", fmt.Errorf("failed to stat output file: %w", err)
+		return fmt.Errorf("failed to create input file: %w", err)
 	}
 
-	_, err = client.PutObject(ctx, getS3Bucket(), processedKey, outputFile, stat.Size(),
-		minio.PutObjectOptions{ContentType: "video/mp4"})
+	_, err = io.Copy(file, object)
+	file.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to upload processed file: %w", err)
+		return fmt.Errorf("failed to download file: %w", err)
 	}
+	return nil
+}
 
-	// Update file size
-	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2 WHERE id = $1`, mediaID, stat.Size())
+// ffmpegError is returned when an ffmpeg invocation fails and keeps its
+// combined output for diagnostics
+type ffmpegError struct {
+	Op     string
+	Err    error
+	Output string
+}
 
-	return processedKey, nil
+func (e *ffmpegError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Op, e.Err)
 }
 
-func isVideoFile(key string) bool {
-	ext := strings.ToLower(filepath.Ext(key))
-	videoExts := []string{".mp4", ".mkv", ".avi", ".mov", ".wmv", ".flv", ".webm", ".m4v", ".mpeg", ".mpg", ".3gp"}
-	for _, e := range videoExts {
-		if ext == e {
-			return true
-		}
-	}
-	return false
+func (e *ffmpegError) Unwrap() error {
+	return e.Err
 }
 
 func getVideoDuration(ctx context.Context, filePath string) int {
@@ -0,0 +1,166 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/rlog"
+
+	"encore.app/media"
+)
+
+// staleJobGrace is added to the job timeout before a 'processing' job is
+// considered orphaned by a crashed worker
+const staleJobGrace = 15 * time.Minute
+
+// tempDirPrefixes are the prefixes of temporary directories created by this
+// service, removed by recovery when a crash left them behind
+var tempDirPrefixes = []string{"media-processing-", "media-animation-", "media-poster-", "media-rendition-"}
+
+// Service runs startup recovery for the processing service
+//
+//encore:service
+type Service struct{}
+
+func initService() (*Service, error) {
+	// Subscriptions may already be delivering, and other instances may share
+	// the temp directory, so only directories older than any job can run are
+	// removed, as in the periodic recovery
+	go func() {
+		ctx := context.Background()
+		cleanTempDirs(getJobTimeout() + staleJobGrace)
+		if _, err := recoverStaleJobs(ctx); err != nil {
+			rlog.Error("startup recovery failed", "error", err)
+		}
+	}()
+	return &Service{}, nil
+}
+
+// Recovery also runs periodically to catch crashes of other instances
+var _ = cron.NewJob("processing-recovery", cron.JobConfig{
+	Title:    "Recover processing jobs orphaned by worker crashes",
+	Every:    10 * cron.Minute,
+	Endpoint: RecoverStaleJobs,
+})
+
+// RecoverStaleJobsResponse reports what recovery did
+type RecoverStaleJobsResponse struct {
+	Requeued int `json:"requeued"`
+	Failed   int `json:"failed"`
+}
+
+// RecoverStaleJobs fails processing jobs that outlived the job timeout,
+// re-queues their media (or dead-letters it when out of attempts) and removes
+// stale temp directories
+//
+//encore:api private
+func RecoverStaleJobs(ctx context.Context) (*RecoverStaleJobsResponse, error) {
+	cleanTempDirs(getJobTimeout() + staleJobGrace)
+	releaseStaleExternalJobs(ctx)
+	return recoverStaleJobs(ctx)
+}
+
+// recoverStaleJobs handles 'processing' jobs started before the job timeout
+// plus grace, which no live worker can still be running. Jobs of external
+// workers are left to releaseStaleExternalJobs, which goes by heartbeats.
+func recoverStaleJobs(ctx context.Context) (*RecoverStaleJobsResponse, error) {
+	cutoff := time.Now().Add(-(getJobTimeout() + staleJobGrace))
+
+	rows, err := db.Query(ctx, `
+		UPDATE processing_jobs
+		SET status = 'failed', error_message = 'worker stopped while processing', completed_at = NOW()
+		WHERE status = 'processing' AND worker_args IS NULL AND started_at < $1
+		RETURNING media_id, COALESCE(attempt, 1), COALESCE(preset, ''), COALESCE(packaging, '')
+	`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	type staleJob struct {
+		mediaID, preset, packaging string
+		attempt                    int
+	}
+	var stale []staleJob
+	for rows.Next() {
+		var j staleJob
+		if err := rows.Scan(&j.mediaID, &j.attempt, &j.preset, &j.packaging); err == nil {
+			stale = append(stale, j)
+		}
+	}
+	rows.Close()
+
+	resp := &RecoverStaleJobsResponse{}
+	for _, j := range stale {
+		var msg media.MediaUploaded
+		err := mediaDB.QueryRow(ctx, `
+			SELECT id, s3_key_original, owner_id FROM media WHERE id = $1 AND status = 'processing'
+		`, j.mediaID).Scan(&msg.MediaID, &msg.S3Key, &msg.OwnerID)
+		if err != nil {
+			// Deleted, cancelled or already picked up again
+			continue
+		}
+		msg.Preset, msg.Packaging = j.preset, j.packaging
+
+		if j.attempt >= maxDeliveryAttempts {
+			_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1`, msg.MediaID)
+			cause := errors.New("worker stopped while processing")
+			if err := deadLetter(ctx, &msg, j.packaging, j.preset, j.attempt, cause); err != nil {
+				rlog.Error("failed to dead-letter stale job", "error", err, "media_id", msg.MediaID)
+			}
+			publishFinished(ctx, msg.MediaID, msg.OwnerID, "failed", cause.Error())
+			resp.Failed++
+			continue
+		}
+
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'queued' WHERE id = $1`, msg.MediaID)
+		if _, err := media.MediaUploadedTopic.Publish(ctx, &msg); err != nil {
+			rlog.Error("failed to requeue stale job", "error", err, "media_id", msg.MediaID)
+			_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1`, msg.MediaID)
+			publishMediaStatus(ctx, msg.MediaID, msg.OwnerID, "failed")
+			resp.Failed++
+			continue
+		}
+		publishMediaStatus(ctx, msg.MediaID, msg.OwnerID, "queued")
+		resp.Requeued++
+	}
+
+	if len(stale) > 0 {
+		rlog.Info("recovered stale processing jobs", "requeued", resp.Requeued, "failed", resp.Failed)
+	}
+	return resp, nil
+}
+
+// cleanTempDirs removes this service's temp directories older than maxAge
+func cleanTempDirs(maxAge time.Duration) {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !hasTempDirPrefix(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(os.TempDir(), entry.Name())); err == nil {
+			rlog.Info("removed stale temp directory", "name", entry.Name())
+		}
+	}
+}
+
+func hasTempDirPrefix(name string) bool {
+	for _, prefix := range tempDirPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
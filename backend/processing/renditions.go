@@ -0,0 +1,382 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+	"encore.app/metrics"
+	"encore.app/objectstore"
+	"encore.app/team"
+)
+
+// renditionHeights are the qualities that can be requested on demand
+var renditionHeights = map[string]int{
+	"240p":  240,
+	"360p":  360,
+	"480p":  480,
+	"720p":  720,
+	"1080p": 1080,
+	"1440p": 1440,
+	"2160p": 2160,
+}
+
+// renditionPreset encodes on-demand renditions; H.264 so every client that
+// asks for a lower quality can also play it
+const renditionPreset = "web-h264"
+
+// renditionRetryAfter is the polling interval suggested to clients while a
+// rendition is being prepared
+const renditionRetryAfter = 15
+
+// RenditionRequested is published when a client asks for a rendition that
+// has not been generated yet
+type RenditionRequested struct {
+	MediaID string `json:"media_id"`
+	Height  int    `json:"height"`
+}
+
+// RenditionRequestedTopic queues on-demand rendition encodes
+var RenditionRequestedTopic = pubsub.NewTopic[*RenditionRequested]("rendition-requested", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var _ = pubsub.NewSubscription(RenditionRequestedTopic, "rendition-worker",
+	pubsub.SubscriptionConfig[*RenditionRequested]{
+		Handler: generateRendition,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+			MaxRetries: maxDeliveryAttempts,
+		},
+	},
+)
+
+// RenditionResponse describes a rendition of a media item. While Status is
+// "preparing" clients should poll again after RetryAfterSeconds.
+type RenditionResponse struct {
+	MediaID           string     `json:"media_id"`
+	Quality           string     `json:"quality"`
+	Status            string     `json:"status"` // ready, preparing, failed
+	URL               string     `json:"url,omitempty"`
+	SizeBytes         int64      `json:"size_bytes,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	RetryAfterSeconds int        `json:"retry_after_seconds,omitempty"`
+	Error             string     `json:"error,omitempty"`
+}
+
+// GetRendition returns a lower quality rendition of a video. Renditions are
+// only encoded the first time they are requested; until then the response is
+// "preparing" and the encode is queued. Generated renditions are cached.
+//
+//encore:api auth method=GET path=/media/:id/renditions/:quality
+func GetRendition(ctx context.Context, id string, quality string) (*RenditionResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	height, ok := renditionHeights[quality]
+	if !ok {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown quality").Err()
+	}
+
+	// Verify access and find the source height
+	var ownerID int64
+	var s3Key, mimeType, status, teamID string
+	var sourceHeight int
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, s3_key_original, COALESCE(mime_type, ''), status,
+			   COALESCE((
+				   SELECT MAX((s->>'height')::int) FROM jsonb_array_elements(probe_data->'streams') s
+				   WHERE s->>'codec_type' = 'video'
+			   ), 0),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &s3Key, &mimeType, &status, &sourceHeight, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+	if status != "ready" || classifyMedia(mimeType, s3Key, nil) != kindVideo {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("renditions are only available for ready videos").Err()
+	}
+	if sourceHeight > 0 && height > sourceHeight {
+		return nil, errs.B().Code(errs.InvalidArgument).
+			Msg(fmt.Sprintf("source is only %dp", sourceHeight)).Err()
+	}
+
+	resp := &RenditionResponse{MediaID: id, Quality: quality}
+
+	var renditionStatus, renditionKey, errorMessage string
+	var sizeBytes int64
+	var requestedAt time.Time
+	err = mediaDB.QueryRow(ctx, `
+		SELECT status, COALESCE(s3_key, ''), COALESCE(size_bytes, 0), COALESCE(error_message, ''), requested_at
+		FROM media_renditions WHERE media_id = $1 AND height = $2
+	`, id, height).Scan(&renditionStatus, &renditionKey, &sizeBytes, &errorMessage, &requestedAt)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		rlog.Error("failed to get rendition", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to get rendition").Err()
+	}
+
+	switch {
+	case err == nil && renditionStatus == "ready":
+		client, err := getMinioClient()
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+		}
+		ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+		url, err := objectstore.PlaybackURL(ctx, client, renditionKey, ttl)
+		if err != nil {
+			return nil, errs.B().Code(errs.Internal).Msg("failed to sign rendition").Err()
+		}
+		_, _ = mediaDB.Exec(ctx, `
+			UPDATE media_renditions SET last_accessed_at = NOW() WHERE media_id = $1 AND height = $2
+		`, id, height)
+
+		expiresAt := time.Now().Add(ttl)
+		resp.Status = "ready"
+		resp.URL = url.String()
+		resp.SizeBytes = sizeBytes
+		resp.ExpiresAt = &expiresAt
+		return resp, nil
+
+	case err == nil && renditionStatus == "pending" && time.Since(requestedAt) < streamingInputTTL():
+		resp.Status = "preparing"
+		resp.RetryAfterSeconds = renditionRetryAfter
+		return resp, nil
+
+	case err == nil && renditionStatus == "failed" && time.Since(requestedAt) < time.Hour:
+		// Failed renditions can be requested again after an hour
+		resp.Status = "failed"
+		resp.Error = errorMessage
+		return resp, nil
+	}
+
+	// Missing, failed long ago or stuck: (re)queue the encode from the
+	// original. The conditional upsert makes concurrent requests publish only
+	// once.
+	if err := media.CheckDerivedQuota(ctx, &media.CheckDerivedQuotaRequest{MediaID: id}); err != nil {
+		return nil, err
+	}
+	if err := useOriginal(ctx, id); err != nil {
+		return nil, err
+	}
+	queued, err := mediaDB.Exec(ctx, `
+		INSERT INTO media_renditions (media_id, height, status, requested_at)
+		VALUES ($1, $2, 'pending', NOW())
+		ON CONFLICT (media_id, height) DO UPDATE
+		SET status = 'pending', error_message = NULL, requested_at = NOW()
+		WHERE media_renditions.status <> 'ready' AND media_renditions.requested_at = $3
+	`, id, height, requestedAt)
+	if err != nil {
+		rlog.Error("failed to queue rendition", "error", err, "media_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue rendition").Err()
+	}
+	if queued.RowsAffected() > 0 {
+		_, err = RenditionRequestedTopic.Publish(ctx, &RenditionRequested{MediaID: id, Height: height})
+		if err != nil {
+			rlog.Error("failed to publish rendition request", "error", err, "media_id", id)
+			_, _ = mediaDB.Exec(ctx, `
+				UPDATE media_renditions SET status = 'failed', error_message = 'failed to queue'
+				WHERE media_id = $1 AND height = $2
+			`, id, height)
+			return nil, errs.B().Code(errs.Internal).Msg("failed to queue rendition").Err()
+		}
+		rlog.Info("rendition queued", "media_id", id, "height", height)
+	}
+
+	resp.Status = "preparing"
+	resp.RetryAfterSeconds = renditionRetryAfter
+	return resp, nil
+}
+
+// ListRenditionsResponse contains the renditions of a media item
+type ListRenditionsResponse struct {
+	MediaID    string              `json:"media_id"`
+	Renditions []RenditionResponse `json:"renditions"`
+}
+
+// ListRenditions returns the renditions of a video that were requested so
+// far, lowest quality first. Unlike GetRendition it never queues an encode.
+//
+//encore:api auth method=GET path=/media/:id/renditions
+func ListRenditions(ctx context.Context, id string) (*ListRenditionsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	var ownerID int64
+	var teamID string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, COALESCE(team_id::text, '') FROM media WHERE id = $1
+	`, id).Scan(&ownerID, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := mediaDB.Query(ctx, `
+		SELECT height, status, COALESCE(s3_key, ''), COALESCE(size_bytes, 0), COALESCE(error_message, ''), requested_at
+		FROM media_renditions WHERE media_id = $1
+		ORDER BY height
+	`, id)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list renditions").Err()
+	}
+	defer rows.Close()
+
+	client, err := getMinioClient()
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create storage client").Err()
+	}
+	ttl := authpkg.SettingsOrDefault(ctx, userData.UserID).PresignTTL()
+
+	resp := &ListRenditionsResponse{MediaID: id, Renditions: []RenditionResponse{}}
+	for rows.Next() {
+		var height int
+		var status, s3Key, errorMessage string
+		var sizeBytes int64
+		var requestedAt time.Time
+		if err := rows.Scan(&height, &status, &s3Key, &sizeBytes, &errorMessage, &requestedAt); err != nil {
+			continue
+		}
+
+		r := RenditionResponse{MediaID: id, Quality: strconv.Itoa(height) + "p", Status: status}
+		switch status {
+		case "ready":
+			url, err := objectstore.PlaybackURL(ctx, client, s3Key, ttl)
+			if err != nil {
+				continue
+			}
+			expiresAt := time.Now().Add(ttl)
+			r.URL = url.String()
+			r.SizeBytes = sizeBytes
+			r.ExpiresAt = &expiresAt
+		case "pending":
+			r.Status = "preparing"
+			r.RetryAfterSeconds = renditionRetryAfter
+		case "failed":
+			r.Error = errorMessage
+		}
+		resp.Renditions = append(resp.Renditions, r)
+	}
+	return resp, nil
+}
+
+// generateRendition encodes a requested rendition from the original upload
+// and stores it as renditions/<id>/<height>p.mp4
+func generateRendition(ctx context.Context, msg *RenditionRequested) error {
+	spec := jobSpec{MediaID: msg.MediaID}
+	var probeData []byte
+	err := mediaDB.QueryRow(ctx, `
+		SELECT m.s3_key_original, COALESCE(m.audio_languages, '{}'), m.trim_start_seconds, m.trim_end_seconds,
+			   m.probe_data
+		FROM media_renditions r JOIN media m ON m.id = r.media_id
+		WHERE r.media_id = $1 AND r.height = $2 AND r.status = 'pending'
+	`, msg.MediaID, msg.Height).Scan(&spec.S3Key, &spec.AudioLanguages, &spec.TrimStart, &spec.TrimEnd, &probeData)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// Already generated, or the media was deleted
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := acquireSlot(ctx); err != nil {
+		return err
+	}
+	defer releaseSlot()
+
+	jobCtx, cancel := context.WithTimeout(ctx, getJobTimeout())
+	defer cancel()
+
+	// Without a stored probe every audio track is kept
+	var probe *probeResult
+	if len(probeData) > 0 {
+		probe = &probeResult{}
+		if err := json.Unmarshal(probeData, probe); err != nil {
+			probe = nil
+		}
+	}
+
+	upload, renditionKey, err := encodeRendition(jobCtx, spec, probe, msg.Height)
+	if err != nil {
+		attempt := deliveryAttempt()
+		rlog.Error("rendition failed", "error", err, "media_id", msg.MediaID, "height", msg.Height, "attempt", attempt)
+		if attempt < maxDeliveryAttempts {
+			return err
+		}
+		_, _ = mediaDB.Exec(ctx, `
+			UPDATE media_renditions SET status = 'failed', error_message = $3, completed_at = NOW()
+			WHERE media_id = $1 AND height = $2
+		`, msg.MediaID, msg.Height, err.Error())
+		return nil
+	}
+
+	_, err = mediaDB.Exec(ctx, `
+		UPDATE media_renditions
+		SET status = 'ready', s3_key = $3, size_bytes = $4, completed_at = NOW()
+		WHERE media_id = $1 AND height = $2
+	`, msg.MediaID, msg.Height, renditionKey, upload.Size)
+	if err != nil {
+		rlog.Error("failed to update rendition", "error", err, "media_id", msg.MediaID)
+		return err
+	}
+
+	rlog.Info("rendition ready", "media_id", msg.MediaID, "height", msg.Height, "size_bytes", upload.Size)
+	return nil
+}
+
+// encodeRendition scales the original down to the given height with the
+// rendition preset, reading it over a presigned URL. Like the main pipeline
+// it keeps only the upload's trim range and requested audio languages.
+func encodeRendition(ctx context.Context, spec jobSpec, probe *probeResult, height int) (uploadResult, string, error) {
+	mediaID, s3Key := spec.MediaID, spec.S3Key
+	client, err := getMinioClient()
+	if err != nil {
+		return uploadResult{}, "", fmt.Errorf("failed to create MinIO client: %w", err)
+	}
+	inputURL, err := metrics.PresignedGetObject(ctx, client, objectstore.Bucket(), s3Key, streamingInputTTL(), nil)
+	if err != nil {
+		return uploadResult{}, "", fmt.Errorf("failed to sign original: %w", err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "media-rendition-")
+	if err != nil {
+		return uploadResult{}, "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	preset := presets[renditionPreset]
+	outputPath := filepath.Join(tempDir, "rendition."+preset.Container)
+	args := append(trimArgs(spec), "-i", inputURL.String())
+	args = append(args, streamMapArgs(selectAudioTracks(probe, spec.AudioLanguages))...)
+	args = append(args, "-vf", "scale=-2:"+strconv.Itoa(height))
+	args = append(args, preset.FFmpegArgs()...)
+	args = append(args, "-movflags", "+faststart", "-y", outputPath)
+
+	if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+		return uploadResult{}, "", &ffmpegError{Op: "ffmpeg rendition", Err: err, Output: string(output)}
+	}
+
+	renditionKey := fmt.Sprintf("renditions/%s/%dp.%s", mediaID, height, preset.Container)
+	upload, err := uploadVerified(ctx, client, renditionKey, outputPath, preset.ContentType)
+	if err != nil {
+		return uploadResult{}, "", err
+	}
+	return upload, renditionKey, nil
+}
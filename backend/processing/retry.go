@@ -0,0 +1,161 @@
+package processing
+
+import (
+	"context"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+	"encore.app/team"
+)
+
+// RetryJobResponse confirms the media was queued again
+type RetryJobResponse struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// RetryJob queues a failed media item for processing again
+//
+//encore:api auth method=POST path=/processing/:mediaID/retry
+func RetryJob(ctx context.Context, mediaID string) (*RetryJobResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	// Verify access and current status
+	var ownerID int64
+	var status, s3Key, packaging, preset, teamID string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, status, s3_key_original, COALESCE(packaging, ''), COALESCE(preset, ''),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &status, &s3Key, &packaging, &preset, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "failed" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("only failed media can be retried").Err()
+	}
+
+	// Move back to 'queued' only if nobody else retried in the meantime
+	result, err := mediaDB.Exec(ctx, `
+		UPDATE media SET status = 'queued' WHERE id = $1 AND status = 'failed'
+	`, mediaID)
+	if err != nil {
+		rlog.Error("failed to reset media status", "error", err, "media_id", mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("only failed media can be retried").Err()
+	}
+
+	_, err = media.MediaUploadedTopic.Publish(ctx, &media.MediaUploaded{
+		MediaID:   mediaID,
+		S3Key:     s3Key,
+		OwnerID:   ownerID,
+		Packaging: packaging,
+		Preset:    preset,
+	})
+	if err != nil {
+		rlog.Error("failed to publish retry event", "error", err, "media_id", mediaID)
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = 'failed' WHERE id = $1`, mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue media").Err()
+	}
+
+	rlog.Info("processing retry queued", "media_id", mediaID)
+	publishMediaStatus(ctx, mediaID, ownerID, "queued")
+
+	return &RetryJobResponse{
+		MediaID: mediaID,
+		Status:  "queued",
+	}, nil
+}
+
+// ReprocessRequest selects how the media item should be encoded again
+type ReprocessRequest struct {
+	Preset    string `json:"preset,omitempty"`
+	Packaging string `json:"packaging,omitempty"`
+}
+
+// Reprocess queues a ready or failed media item for encoding with a
+// (possibly different) preset and packaging
+//
+//encore:api auth method=POST path=/processing/:mediaID/reprocess
+func Reprocess(ctx context.Context, mediaID string, req *ReprocessRequest) (*RetryJobResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	if req.Preset != "" {
+		if _, ok := presets[req.Preset]; !ok {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown preset").Err()
+		}
+	}
+	if req.Packaging != "" && req.Packaging != PackagingMP4 && req.Packaging != PackagingDASH {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("packaging must be 'mp4' or 'dash'").Err()
+	}
+
+	// Verify access and current status
+	var ownerID int64
+	var status, s3Key, packaging, preset, teamID string
+	err := mediaDB.QueryRow(ctx, `
+		SELECT owner_id, status, s3_key_original, COALESCE(packaging, ''), COALESCE(preset, ''),
+			   COALESCE(team_id::text, '')
+		FROM media WHERE id = $1
+	`, mediaID).Scan(&ownerID, &status, &s3Key, &packaging, &preset, &teamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("media not found").Err()
+	}
+	if err := authorizeMedia(ctx, userData.UserID, ownerID, teamID, team.RoleEditor); err != nil {
+		return nil, err
+	}
+	if status != "ready" && status != "failed" {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is still being processed").Err()
+	}
+	if err := useOriginal(ctx, mediaID); err != nil {
+		return nil, err
+	}
+
+	if req.Preset != "" {
+		preset = req.Preset
+	}
+	if req.Packaging != "" {
+		packaging = req.Packaging
+	}
+
+	result, err := mediaDB.Exec(ctx, `
+		UPDATE media SET status = 'queued', preset = NULLIF($2, '')
+		WHERE id = $1 AND status IN ('ready', 'failed')
+	`, mediaID, preset)
+	if err != nil {
+		rlog.Error("failed to reset media status", "error", err, "media_id", mediaID)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update media").Err()
+	}
+	if result.RowsAffected() == 0 {
+		return nil, errs.B().Code(errs.FailedPrecondition).Msg("media is still being processed").Err()
+	}
+
+	_, err = media.MediaUploadedTopic.Publish(ctx, &media.MediaUploaded{
+		MediaID:   mediaID,
+		S3Key:     s3Key,
+		OwnerID:   ownerID,
+		Packaging: packaging,
+		Preset:    preset,
+	})
+	if err != nil {
+		rlog.Error("failed to publish reprocess event", "error", err, "media_id", mediaID)
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET status = $2 WHERE id = $1`, mediaID, status)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to queue media").Err()
+	}
+
+	rlog.Info("reprocess queued", "media_id", mediaID, "preset", preset, "packaging", packaging)
+	publishMediaStatus(ctx, mediaID, ownerID, "queued")
+
+	return &RetryJobResponse{
+		MediaID: mediaID,
+		Status:  "queued",
+	}, nil
+}
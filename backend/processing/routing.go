@@ -0,0 +1,150 @@
+package processing
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// mediaKind selects the sub-pipeline a media item is processed by
+type mediaKind string
+
+const (
+	kindVideo    mediaKind = "video"
+	kindAudio    mediaKind = "audio"
+	kindImage    mediaKind = "image"
+	kindDocument mediaKind = "document"
+	// kindOther is kept as uploaded
+	kindOther mediaKind = "other"
+)
+
+// pipelineJob is the input of a sub-pipeline
+type pipelineJob struct {
+	jobSpec
+	Client *minio.Client
+	// InputPath is a local copy of the original, or a presigned URL when Streaming
+	InputPath string
+	TempDir   string
+	// Probe is nil if ffprobe could not read the original
+	Probe     *probeResult
+	Streaming bool
+	// Downscale is a scale filter for sources above the maximum resolution
+	Downscale string
+}
+
+// pipelineResult is what a sub-pipeline produced; empty fields mean the
+// original is served and no packaging or preset was applied
+type pipelineResult struct {
+	ProcessedKey string
+	Packaging    string
+	Preset       string
+}
+
+// mediaHandler processes one kind of media
+type mediaHandler func(ctx context.Context, job *pipelineJob) (pipelineResult, error)
+
+// handlers maps media kinds to their sub-pipelines; kinds without a handler
+// are kept as uploaded
+var handlers = map[mediaKind]mediaHandler{}
+
+// registerHandler registers the sub-pipeline for a media kind
+func registerHandler(kind mediaKind, handler mediaHandler) {
+	handlers[kind] = handler
+}
+
+// classifyMedia routes a media item by its streams when it was probed, then by
+// the uploaded MIME type, then by file extension. It returns "" if the kind
+// cannot be told without probing.
+func classifyMedia(mimeType, s3Key string, probe *probeResult) mediaKind {
+	kind := kindFromMIME(mimeType)
+	if kind == "" {
+		kind = kindFromExtension(s3Key)
+	}
+
+	// Images probe as single-frame video, so only audiovisual or unknown
+	// uploads are reclassified by their streams
+	if probe != nil && (kind == "" || kind == kindVideo || kind == kindAudio) {
+		if probed := kindFromProbe(probe); probed != "" {
+			kind = probed
+		}
+	}
+	return kind
+}
+
+// kindFromMIME maps a MIME type to a media kind; generic types return ""
+func kindFromMIME(mimeType string) mediaKind {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	switch {
+	case mimeType == "" || mimeType == "application/octet-stream":
+		return ""
+	case strings.HasPrefix(mimeType, "video/"):
+		return kindVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return kindAudio
+	case strings.HasPrefix(mimeType, "image/"):
+		return kindImage
+	case mimeType == "application/pdf",
+		strings.HasPrefix(mimeType, "text/"),
+		mimeType == "application/msword",
+		mimeType == "application/rtf",
+		strings.HasPrefix(mimeType, "application/vnd.openxmlformats-officedocument."),
+		strings.HasPrefix(mimeType, "application/vnd.oasis.opendocument."):
+		return kindDocument
+	}
+	return kindOther
+}
+
+// extensionKinds maps lower-case file extensions to media kinds
+var extensionKinds = map[string]mediaKind{
+	".mp4": kindVideo, ".mkv": kindVideo, ".avi": kindVideo, ".mov": kindVideo,
+	".wmv": kindVideo, ".flv": kindVideo, ".webm": kindVideo, ".m4v": kindVideo,
+	".mpeg": kindVideo, ".mpg": kindVideo, ".3gp": kindVideo,
+
+	".mp3": kindAudio, ".m4a": kindAudio, ".aac": kindAudio, ".flac": kindAudio,
+	".wav": kindAudio, ".ogg": kindAudio, ".opus": kindAudio, ".wma": kindAudio,
+
+	".jpg": kindImage, ".jpeg": kindImage, ".png": kindImage, ".gif": kindImage,
+	".bmp": kindImage, ".tif": kindImage, ".tiff": kindImage, ".webp": kindImage,
+	".heic": kindImage, ".avif": kindImage,
+
+	".pdf": kindDocument, ".txt": kindDocument, ".md": kindDocument, ".rtf": kindDocument,
+	".doc": kindDocument, ".docx": kindDocument, ".odt": kindDocument,
+}
+
+// kindFromExtension maps a file extension to a media kind; unknown extensions return ""
+func kindFromExtension(key string) mediaKind {
+	return extensionKinds[strings.ToLower(filepath.Ext(key))]
+}
+
+// kindFromProbe tells video from audio-only and still-image sources by their
+// streams; it returns "" if ffprobe found no audio or video
+func kindFromProbe(probe *probeResult) mediaKind {
+	// Image demuxers (image2, png_pipe, ...) yield one still frame
+	format := probe.Format.FormatName
+	stillImage := strings.Contains(format, "image2") || strings.HasSuffix(format, "_pipe")
+
+	hasVideo, hasAudio := false, false
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			// Cover art embedded in audio files is not a video stream
+			if s.Disposition.AttachedPic == 0 {
+				hasVideo = true
+			}
+		case "audio":
+			hasAudio = true
+		}
+	}
+
+	switch {
+	case hasVideo && stillImage && !hasAudio:
+		return kindImage
+	case hasVideo:
+		return kindVideo
+	case hasAudio:
+		return kindAudio
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+// Sprite sheet layout: up to spriteColumns*spriteRows frames of
+// spriteTileWidth x spriteTileHeight pixels in a single JPEG
+const (
+	spriteColumns    = 10
+	spriteRows       = 10
+	spriteTileWidth  = 160
+	spriteTileHeight = 90
+)
+
+// spriteFileName is the sprite sheet file name, referenced relatively from the VTT
+const spriteFileName = "sprite.jpg"
+
+// generateScrubPreviews renders a tiled sprite sheet of evenly spaced frames
+// plus a WebVTT file mapping time ranges to tiles, uploads both under
+// thumbnails/<mediaID>/ and records their keys on the media item.
+func generateScrubPreviews(ctx context.Context, client *minio.Client, mediaID, inputPath, tempDir string) error {
+	duration := getVideoDuration(ctx, inputPath)
+	if duration <= 0 {
+		return fmt.Errorf("unknown video duration")
+	}
+
+	// Spread the available tiles over the whole video, at least one second apart
+	maxTiles := spriteColumns * spriteRows
+	interval := (duration + maxTiles - 1) / maxTiles
+	if interval < 1 {
+		interval = 1
+	}
+	tiles := (duration + interval - 1) / interval
+
+	spritePath := filepath.Join(tempDir, spriteFileName)
+	filter := fmt.Sprintf(
+		"fps=1/%d,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		interval, spriteTileWidth, spriteTileHeight, spriteTileWidth, spriteTileHeight, spriteColumns, spriteRows,
+	)
+	cmd := ffmpegCommand(ctx,
+		"-i", inputPath,
+		"-vf", filter,
+		"-frames:v", "1",
+		"-q:v", "5",
+		"-y",
+		spritePath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg sprite generation failed: %w: %s", err, string(output))
+	}
+
+	vttPath := filepath.Join(tempDir, "thumbnails.vtt")
+	if err := os.WriteFile(vttPath, []byte(buildThumbnailsVTT(tiles, interval, duration)), 0o644); err != nil {
+		return fmt.Errorf("failed to write thumbnails VTT: %w", err)
+	}
+
+	prefix := fmt.Sprintf("thumbnails/%s/", mediaID)
+	spriteKey := prefix + spriteFileName
+	vttKey := prefix + "thumbnails.vtt"
+
+	if _, err := objectstore.FPutObject(ctx, client, spriteKey, spritePath,
+		minio.PutObjectOptions{ContentType: "image/jpeg"}); err != nil {
+		return fmt.Errorf("failed to upload sprite sheet: %w", err)
+	}
+	if _, err := objectstore.FPutObject(ctx, client, vttKey, vttPath,
+		minio.PutObjectOptions{ContentType: "text/vtt"}); err != nil {
+		return fmt.Errorf("failed to upload thumbnails VTT: %w", err)
+	}
+
+	_, err := mediaDB.Exec(ctx, `
+		UPDATE media SET s3_key_sprite = $2, s3_key_thumbnails_vtt = $3 WHERE id = $1
+	`, mediaID, spriteKey, vttKey)
+	return err
+}
+
+// buildThumbnailsVTT returns a WebVTT document with one cue per sprite tile,
+// pointing at the tile via a media fragment (sprite.jpg#xywh=x,y,w,h)
+func buildThumbnailsVTT(tiles, interval, duration int) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; i < tiles; i++ {
+		start := i * interval
+		end := start + interval
+		if end > duration {
+			end = duration
+		}
+		x := (i % spriteColumns) * spriteTileWidth
+		y := (i / spriteColumns) * spriteTileHeight
+		fmt.Fprintf(&b, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			formatVTTTimestamp(start), formatVTTTimestamp(end),
+			spriteFileName, x, y, spriteTileWidth, spriteTileHeight)
+	}
+	return b.String()
+}
+
+// formatVTTTimestamp formats whole seconds as a WebVTT timestamp (HH:MM:SS.mmm)
+func formatVTTTimestamp(seconds int) string {
+	d := time.Duration(seconds) * time.Second
+	return fmt.Sprintf("%02d:%02d:%02d.000", int(d.Hours()), int(d.Minutes())%60, seconds%60)
+}
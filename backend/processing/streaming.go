@@ -0,0 +1,103 @@
+package processing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"encore.dev/rlog"
+	"github.com/minio/minio-go/v7"
+
+	"encore.app/objectstore"
+)
+
+// getStreamingEnabled returns whether videos are transcoded without a local
+// copy: ffmpeg reads the original over HTTP and its output is uploaded as
+// it is produced (PROCESSING_STREAMING=true)
+func getStreamingEnabled() bool {
+	return os.Getenv("PROCESSING_STREAMING") == "true"
+}
+
+// streamingInputTTL returns how long the presigned input URL stays valid.
+// ffmpeg may issue range requests late in the job (e.g. for a trailing moov
+// atom), so it covers the whole job timeout, within the 7-day S3 limit.
+func streamingInputTTL() time.Duration {
+	ttl := getJobTimeout() + 15*time.Minute
+	if ttl > 7*24*time.Hour {
+		ttl = 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// streamingMuxerArgs returns the ffmpeg muxer arguments for writing a
+// preset's container to a pipe, or nil for containers that need a seekable
+// output. Since the output cannot be rewritten once uploaded, MP4 is
+// fragmented instead of +faststart; fragmented MP4 starts playing
+// immediately as well. Ogg is written front to back anyway.
+func streamingMuxerArgs(container string) []string {
+	switch container {
+	case "mp4", "m4a":
+		return []string{"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4"}
+	case "opus":
+		return []string{"-f", "ogg"}
+	}
+	return nil
+}
+
+// streamTranscode runs ffmpeg on inputURL and uploads its stdout to S3 with a
+// streaming multipart upload, muxed as streamingMuxerArgs picks for the
+// preset's container
+func streamTranscode(ctx context.Context, client *minio.Client, mediaID, inputURL string, encoderArgs []string, preset Preset) (string, error) {
+	args := append([]string{"-i", inputURL}, encoderArgs...)
+	args = append(args, streamingMuxerArgs(preset.Container)...)
+	args = append(args, "pipe:1")
+	cmd := ffmpegCommand(ctx, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("failed to open ffmpeg output pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	processedKey := fmt.Sprintf("processed/%s.%s", mediaID, preset.Container)
+
+	// Size -1 makes minio upload in parts as data arrives; the output is
+	// hashed on the way since it never exists as a local file
+	output := newHashingReader(stdout)
+	_, uploadErr := objectstore.PutObject(ctx, client, processedKey, output, -1,
+		minio.PutObjectOptions{ContentType: preset.ContentType})
+	if uploadErr != nil {
+		// Stop ffmpeg from blocking on a pipe nobody reads anymore
+		_ = stdout.Close()
+	}
+	waitErr := cmd.Wait()
+
+	if waitErr != nil && uploadErr == nil {
+		rlog.Error("ffmpeg failed", "error", waitErr, "output", stderr.String())
+		_ = client.RemoveObject(ctx, objectstore.Bucket(), processedKey, minio.RemoveObjectOptions{})
+		return "", &ffmpegError{Op: "ffmpeg streaming transcoding", Err: waitErr, Output: stderr.String()}
+	}
+	if uploadErr != nil {
+		return "", fmt.Errorf("failed to upload processed file: %w", uploadErr)
+	}
+	if err := verifyObject(ctx, client, processedKey, output.n, ""); err != nil {
+		return "", err
+	}
+
+	duration := getVideoDuration(ctx, inputURL)
+	if duration > 0 {
+		_, _ = mediaDB.Exec(ctx, `UPDATE media SET duration_seconds = $2 WHERE id = $1`, mediaID, duration)
+	}
+
+	// Update file size and checksum
+	_, _ = mediaDB.Exec(ctx, `UPDATE media SET size_bytes = $2, processed_sha256 = $3 WHERE id = $1`,
+		mediaID, output.n, output.sum())
+
+	return processedKey, nil
+}
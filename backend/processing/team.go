@@ -0,0 +1,29 @@
+package processing
+
+import (
+	"context"
+
+	"encore.dev/beta/errs"
+
+	"encore.app/team"
+)
+
+// authorizeMedia returns an error unless the user may act on a media item
+// uploaded by ownerID in teamID (empty for personal media), the same way the
+// media service decides: the uploader always may, members of the team when
+// their role is at least min
+func authorizeMedia(ctx context.Context, userID, ownerID int64, teamID string, min team.Role) error {
+	if ownerID == userID {
+		return nil
+	}
+	if teamID != "" {
+		membership, err := team.GetMembership(ctx, &team.MembershipRequest{TeamID: teamID, UserID: userID})
+		if err != nil {
+			return errs.B().Code(errs.Internal).Msg("failed to check team membership").Err()
+		}
+		if membership.Role.AtLeast(min) {
+			return nil
+		}
+	}
+	return errs.B().Code(errs.PermissionDenied).Msg("not authorized").Err()
+}
@@ -0,0 +1,51 @@
+package processing
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+
+	"encore.dev/rlog"
+)
+
+// trimmed reports whether the upload asked to keep only part of its range
+func (s jobSpec) trimmed() bool {
+	return s.TrimStart != nil || s.TrimEnd != nil
+}
+
+// trimInput cuts the requested range of an audio or video upload into a local
+// Matroska intermediate that the sub-pipeline reads instead of the original.
+// Video is re-encoded near-losslessly so the cut is frame-accurate; audio
+// streams are copied.
+func trimInput(ctx context.Context, spec jobSpec, inputPath, tempDir string, kind mediaKind) (string, error) {
+	args := append(trimArgs(spec), "-i", inputPath)
+
+	if kind == kindVideo {
+		args = append(args, "-map", "0:v:0", "-map", "0:a?",
+			"-c:v", "libx264", "-crf", "12", "-preset", "veryfast")
+	} else {
+		args = append(args, "-map", "0:a", "-vn")
+	}
+	outputPath := filepath.Join(tempDir, "trimmed.mkv")
+	args = append(args, "-c:a", "copy", "-y", outputPath)
+
+	if output, err := ffmpegCommand(ctx, args...).CombinedOutput(); err != nil {
+		return "", &ffmpegError{Op: "ffmpeg trim", Err: err, Output: string(output)}
+	}
+
+	rlog.Info("trimmed upload", "media_id", spec.MediaID, "trim_start", spec.TrimStart, "trim_end", spec.TrimEnd)
+	return outputPath, nil
+}
+
+// trimArgs returns the input options that seek to the requested range; they
+// go before -i
+func trimArgs(spec jobSpec) []string {
+	var args []string
+	if spec.TrimStart != nil {
+		args = append(args, "-ss", strconv.FormatFloat(*spec.TrimStart, 'f', 3, 64))
+	}
+	if spec.TrimEnd != nil {
+		args = append(args, "-to", strconv.FormatFloat(*spec.TrimEnd, 'f', 3, 64))
+	}
+	return args
+}
@@ -0,0 +1,18 @@
+package processing
+
+import (
+	"context"
+
+	"encore.dev/rlog"
+
+	"encore.app/media"
+)
+
+// recordTranscodeUsage has the media service count a freshly transcoded
+// media item towards its team's monthly transcode minutes. A failure is
+// only logged: the media is ready either way.
+func recordTranscodeUsage(ctx context.Context, mediaID string) {
+	if err := media.RecordTranscodeUsage(ctx, &media.RecordTranscodeUsageRequest{MediaID: mediaID}); err != nil {
+		rlog.Warn("failed to record transcode usage", "error", err, "media_id", mediaID)
+	}
+}
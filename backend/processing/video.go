@@ -0,0 +1,87 @@
+package processing
+
+import (
+	"context"
+
+	"encore.dev/rlog"
+)
+
+func init() {
+	registerHandler(kindVideo, processVideo)
+}
+
+// processVideo generates the previews of a video and transcodes it with the
+// job's preset into progressive MP4 or DASH
+func processVideo(ctx context.Context, job *pipelineJob) (pipelineResult, error) {
+	client, mediaID, inputPath, preset := job.Client, job.MediaID, job.InputPath, job.Preset
+
+	// Scrub previews, preview clips and posters are best-effort and never fail the job
+	if err := generateScrubPreviews(ctx, client, mediaID, inputPath, job.TempDir); err != nil {
+		rlog.Error("failed to generate scrub previews", "error", err, "media_id", mediaID)
+	}
+	if err := generatePreviewClip(ctx, client, mediaID, inputPath, job.TempDir); err != nil {
+		rlog.Error("failed to generate preview clip", "error", err, "media_id", mediaID)
+	}
+	if duration := getVideoDuration(ctx, inputPath); duration > 0 {
+		timestamp := pickPosterTimestamp(ctx, inputPath, duration)
+		if err := generatePoster(ctx, client, mediaID, inputPath, job.TempDir, timestamp); err != nil {
+			rlog.Error("failed to generate poster", "error", err, "media_id", mediaID)
+		}
+	}
+
+	// Keep every audio track (or the requested languages), not just the default one
+	tracks := selectAudioTracks(job.Probe, job.AudioLanguages)
+	recordAudioTracks(ctx, mediaID, tracks)
+	encoderArgs := append(streamMapArgs(tracks), preset.FFmpegArgs()...)
+	encoderArgs = applyLoudness(ctx, job, preset, encoderArgs)
+	if job.Downscale != "" {
+		encoderArgs = append(encoderArgs, "-vf", job.Downscale)
+	}
+
+	result := pipelineResult{Packaging: job.Packaging, Preset: preset.Name}
+	var err error
+
+	if job.Packaging == PackagingDASH {
+		result.ProcessedKey, err = packageDASH(ctx, client, mediaID, inputPath, job.TempDir, encoderArgs)
+		return result, err
+	}
+
+	// Sources that already match the preset are only remuxed for fast start
+	// (the probe describes the original, not a trimmed intermediate)
+	passthrough := !job.trimmed() && job.Downscale == "" && canPassthrough(job.Probe, preset)
+	if passthrough {
+		rlog.Info("source is web-compatible, remuxing without re-encoding", "media_id", mediaID)
+		encoderArgs = append(streamMapArgs(tracks), passthroughArgs(job.Probe)...)
+	}
+
+	// Heavy encodes go to external workers when enabled; remuxes stay local
+	if !passthrough && useExternalWorker(job) {
+		return result, deferToExternalWorker(ctx, job, encoderArgs, preset)
+	}
+
+	// Containers that can't be written to a pipe are encoded to a local file,
+	// still reading the original over HTTP
+	if job.Streaming && streamingMuxerArgs(preset.Container) != nil {
+		result.ProcessedKey, err = streamTranscode(ctx, client, mediaID, inputPath, encoderArgs, preset)
+		return result, err
+	}
+
+	result.ProcessedKey, err = encodeFile(ctx, job, encoderArgs, preset)
+	return result, err
+}
+
+// applyLoudness adds two-pass loudness normalization to the encoder arguments
+// when the preset asks for it. A failed measurement keeps the original levels
+// rather than failing the job.
+func applyLoudness(ctx context.Context, job *pipelineJob, preset Preset, encoderArgs []string) []string {
+	if preset.Loudness == nil {
+		return encoderArgs
+	}
+
+	measurement, err := measureLoudness(ctx, job.InputPath, *preset.Loudness)
+	if err != nil {
+		rlog.Error("failed to measure loudness", "error", err, "media_id", job.MediaID)
+		return encoderArgs
+	}
+	return withLoudnorm(encoderArgs, *preset.Loudness, measurement)
+}
@@ -0,0 +1,103 @@
+package realtime
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Database for events on their way to the streams
+var db = sqldb.NewDatabase("realtime", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+// pollInterval is how often each instance looks for new events
+const pollInterval = time.Second
+
+// pollWindow is how far back each poll looks. Rows can commit out of seq
+// order, so a poll reads every recent row and skips those already sent.
+const pollWindow = 10 * time.Second
+
+// eventRetention is how long events stay in the table
+const eventRetention = 5 * time.Minute
+
+// relay stores an event for the poller of every instance. The subscription
+// hands each message to one instance only, which is why the streams don't
+// get it from there directly. Events are dropped when they can't be stored.
+func relay(ctx context.Context, ev *Event) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO realtime_events (user_ids, type, data, occurred_at) VALUES ($1, $2, $3, $4)
+	`, ev.UserIDs, ev.Type, []byte(ev.Data), ev.OccurredAt)
+	if err != nil {
+		rlog.Warn("failed to relay event", "error", err, "type", ev.Type)
+	}
+	return nil
+}
+
+// startPolling starts this instance's poller once the first stream connects
+var startPolling sync.Once
+
+// pollEvents dispatches new events to the streams of this instance until
+// the process exits
+func pollEvents() {
+	ctx := context.Background()
+	// sent holds the events of the last poll that were already dispatched
+	sent := map[int64]bool{}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !hasStreams() {
+			continue
+		}
+		rows, err := db.Query(ctx, `
+			SELECT seq, user_ids, type, data, occurred_at FROM realtime_events
+			WHERE created_at > NOW() - make_interval(secs => $1)
+			ORDER BY seq
+		`, pollWindow.Seconds())
+		if err != nil {
+			rlog.Warn("failed to poll events", "error", err)
+			continue
+		}
+		// Events that left the window aren't read again, so they are forgotten
+		seen := map[int64]bool{}
+		for rows.Next() {
+			var seq int64
+			var ev Event
+			var data []byte
+			if err := rows.Scan(&seq, &ev.UserIDs, &ev.Type, &data, &ev.OccurredAt); err != nil {
+				continue
+			}
+			seen[seq] = true
+			if sent[seq] {
+				continue
+			}
+			ev.Data = data
+			dispatch(&ev)
+		}
+		rows.Close()
+		sent = seen
+	}
+}
+
+var _ = cron.NewJob("realtime-events-prune", cron.JobConfig{
+	Title:    "Remove delivered realtime events",
+	Every:    5 * cron.Minute,
+	Endpoint: PruneEvents,
+})
+
+// PruneEvents removes events every poller has read by now
+//
+//encore:api private
+func PruneEvents(ctx context.Context) error {
+	_, err := db.Exec(ctx, `
+		DELETE FROM realtime_events WHERE created_at < NOW() - make_interval(secs => $1)
+	`, eventRetention.Seconds())
+	if err != nil {
+		rlog.Error("failed to prune realtime events", "error", err)
+	}
+	return err
+}
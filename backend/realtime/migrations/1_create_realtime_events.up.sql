@@ -0,0 +1,12 @@
+-- Events on their way to the streams of every instance. Each instance polls
+-- for recent rows, and rows older than a few minutes are removed.
+CREATE TABLE realtime_events (
+    seq BIGSERIAL PRIMARY KEY,
+    user_ids BIGINT[] NOT NULL,
+    type TEXT NOT NULL,
+    data JSONB NOT NULL,
+    occurred_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_realtime_events_created ON realtime_events(created_at);
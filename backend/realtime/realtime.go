@@ -0,0 +1,233 @@
+// Package realtime pushes changes to users' media, processing jobs and
+// collections to connected frontends as a Server-Sent Events stream, so
+// they don't have to poll.
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Event types
+const (
+	// TypeMediaStatus is sent when a media item changes status; Data is a MediaStatus
+	TypeMediaStatus = "media.status"
+	// TypeMediaUpdated is sent when a media item's tags change; Data is a MediaUpdated
+	TypeMediaUpdated = "media.updated"
+	// TypeProcessingProgress is sent as an external worker reports
+	// progress; Data is a ProcessingProgress
+	TypeProcessingProgress = "processing.progress"
+	// TypeUploadProgress is sent as an uploading client reports progress;
+	// Data is an UploadProgress
+	TypeUploadProgress = "upload.progress"
+	// TypeCollectionUpdated is sent when a collection or its items change;
+	// Data is a CollectionUpdated
+	TypeCollectionUpdated = "collection.updated"
+)
+
+// Event is a change pushed to the event streams of the given users
+type Event struct {
+	UserIDs    []int64         `json:"user_ids"`
+	Type       string          `json:"type"`
+	Data       json.RawMessage `json:"data"`
+	OccurredAt time.Time       `json:"occurred_at"`
+}
+
+// MediaStatus is the data of a media.status event; Status is "deleted" for
+// deleted media
+type MediaStatus struct {
+	MediaID string `json:"media_id"`
+	Status  string `json:"status"`
+}
+
+// MediaUpdated is the data of a media.updated event
+type MediaUpdated struct {
+	MediaID string   `json:"media_id"`
+	Tags    []string `json:"tags"`
+}
+
+// ProcessingProgress is the data of a processing.progress event
+type ProcessingProgress struct {
+	MediaID string `json:"media_id"`
+	JobID   string `json:"job_id"`
+	// Progress is the completed fraction, 0 to 1
+	Progress float64 `json:"progress"`
+}
+
+// UploadProgress is the data of an upload.progress event
+type UploadProgress struct {
+	MediaID       string `json:"media_id"`
+	BytesUploaded int64  `json:"bytes_uploaded"`
+	// TotalBytes is 0 when the client didn't say
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+}
+
+// CollectionUpdated is the data of a collection.updated event
+type CollectionUpdated struct {
+	CollectionID string `json:"collection_id"`
+	// Change is items_added, items_removed, updated, deleted or restored
+	Change   string   `json:"change"`
+	MediaIDs []string `json:"media_ids,omitempty"`
+}
+
+// EventsTopic carries events from the services to the event streams
+var EventsTopic = pubsub.NewTopic[*Event]("realtime-events", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// Events are relayed to the streams of every instance through the database
+var _ = pubsub.NewSubscription(EventsTopic, "realtime-streams",
+	pubsub.SubscriptionConfig[*Event]{
+		Handler: relay,
+	},
+)
+
+// keepaliveInterval is how often an idle stream gets a comment, so proxies
+// don't close it
+const keepaliveInterval = 25 * time.Second
+
+// maxStreamsPerUser caps the open streams of a user, e.g. browser tabs
+const maxStreamsPerUser = 10
+
+// streamBuffer is how many events a stream can fall behind before it is closed
+const streamBuffer = 64
+
+// stream is one connected client
+type stream struct {
+	userID int64
+	types  []string
+	events chan *Event
+	// lagged is closed when the client fell behind and missed events
+	lagged    chan struct{}
+	closeOnce sync.Once
+}
+
+// streams holds the connected clients of this instance by user
+var streams = struct {
+	sync.Mutex
+	byUser map[int64][]*stream
+}{byUser: map[int64][]*stream{}}
+
+// eventSeq numbers the events written to streams
+var eventSeq atomic.Int64
+
+// register adds a stream unless the user has too many open
+func register(s *stream) bool {
+	startPolling.Do(func() { go pollEvents() })
+
+	streams.Lock()
+	defer streams.Unlock()
+	if len(streams.byUser[s.userID]) >= maxStreamsPerUser {
+		return false
+	}
+	streams.byUser[s.userID] = append(streams.byUser[s.userID], s)
+	return true
+}
+
+// hasStreams reports whether any client is connected to this instance
+func hasStreams() bool {
+	streams.Lock()
+	defer streams.Unlock()
+	return len(streams.byUser) > 0
+}
+
+// unregister removes a stream
+func unregister(s *stream) {
+	streams.Lock()
+	defer streams.Unlock()
+	remaining := slices.DeleteFunc(streams.byUser[s.userID], func(o *stream) bool { return o == s })
+	if len(remaining) == 0 {
+		delete(streams.byUser, s.userID)
+	} else {
+		streams.byUser[s.userID] = remaining
+	}
+}
+
+// dispatch hands an event to the streams of its users on this instance.
+// Streams that can't keep up are closed; clients reconnect and reload.
+func dispatch(ev *Event) {
+	streams.Lock()
+	defer streams.Unlock()
+	for _, userID := range ev.UserIDs {
+		for _, s := range streams.byUser[userID] {
+			if len(s.types) > 0 && !slices.Contains(s.types, ev.Type) {
+				continue
+			}
+			select {
+			case s.events <- ev:
+			default:
+				s.closeOnce.Do(func() { close(s.lagged) })
+			}
+		}
+	}
+}
+
+// StreamEvents streams the caller's events as Server-Sent Events until the
+// client disconnects. ?types= limits the stream to a comma-separated list
+// of event types. Events are not replayed, so clients should reload what
+// they show after reconnecting.
+//
+//encore:api auth raw method=GET path=/events
+func StreamEvents(w http.ResponseWriter, req *http.Request) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s := &stream{
+		userID: userData.UserID,
+		events: make(chan *Event, streamBuffer),
+		lagged: make(chan struct{}),
+	}
+	for _, t := range strings.Split(req.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s.types = append(s.types, t)
+		}
+	}
+	if !register(s) {
+		http.Error(w, "too many open event streams", http.StatusTooManyRequests)
+		return
+	}
+	defer unregister(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.lagged:
+			rlog.Warn("closing lagging event stream", "user_id", s.userID)
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-s.events:
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", eventSeq.Add(1), ev.Type, ev.Data)
+		}
+		flusher.Flush()
+	}
+}
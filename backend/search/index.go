@@ -0,0 +1,199 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+	"encore.app/media"
+	"encore.app/realtime"
+)
+
+// document is what the index holds of a media item
+type document struct {
+	ID               string `json:"id"`
+	OwnerID          int64  `json:"owner_id"`
+	Title            string `json:"title"`
+	OriginalFilename string `json:"original_filename"`
+	MimeType         string `json:"mime_type"`
+	// Type is video, audio, image or other
+	Type            string   `json:"type"`
+	Year            int      `json:"year"`
+	Tags            []string `json:"tags"`
+	Status          string   `json:"status"`
+	SizeBytes       int64    `json:"size_bytes"`
+	DurationSeconds int64    `json:"duration_seconds"`
+	// CreatedAt and IndexedAt are Unix seconds, so they can be sorted and filtered
+	CreatedAt int64 `json:"created_at"`
+	IndexedAt int64 `json:"indexed_at"`
+}
+
+// newDocument builds the document of a media item
+func newDocument(m media.IndexMedia, indexedAt time.Time) document {
+	mediaType, _, _ := strings.Cut(m.Media.MimeType, "/")
+	switch mediaType {
+	case "video", "audio", "image":
+	default:
+		mediaType = "other"
+	}
+	return document{
+		ID:               m.Media.ID,
+		OwnerID:          m.Media.OwnerID,
+		Title:            m.Media.Title,
+		OriginalFilename: m.Media.OriginalFilename,
+		MimeType:         m.Media.MimeType,
+		Type:             mediaType,
+		Year:             m.Media.CreatedAt.Year(),
+		Tags:             m.Tags,
+		Status:           m.Media.Status,
+		SizeBytes:        m.Media.SizeBytes,
+		DurationSeconds:  m.Media.DurationSeconds,
+		CreatedAt:        m.Media.CreatedAt.Unix(),
+		IndexedAt:        indexedAt.Unix(),
+	}
+}
+
+// Media changes reach the index through the realtime events the services
+// publish anyway
+var _ = pubsub.NewSubscription(realtime.EventsTopic, "search-indexer",
+	pubsub.SubscriptionConfig[*realtime.Event]{
+		Handler: indexEvent,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// indexEvent reindexes the media item a media.status or media.updated
+// event is about
+func indexEvent(ctx context.Context, ev *realtime.Event) error {
+	if !searchConfigured() {
+		return nil
+	}
+	if ev.Type != realtime.TypeMediaStatus && ev.Type != realtime.TypeMediaUpdated {
+		return nil
+	}
+	var data struct {
+		MediaID string `json:"media_id"`
+	}
+	if err := json.Unmarshal(ev.Data, &data); err != nil || data.MediaID == "" {
+		return nil
+	}
+	return indexMedia(ctx, []string{data.MediaID})
+}
+
+// indexMedia brings the documents of the given media up to date, removing
+// those of media that was deleted or isn't uploaded yet
+func indexMedia(ctx context.Context, mediaIDs []string) error {
+	resp, err := media.ListIndexMedia(ctx, &media.ListIndexMediaRequest{MediaIDs: mediaIDs})
+	if err != nil {
+		return fmt.Errorf("failed to load media: %w", err)
+	}
+
+	now := time.Now()
+	found := map[string]bool{}
+	var docs []document
+	for _, m := range resp.Media {
+		found[m.Media.ID] = true
+		docs = append(docs, newDocument(m, now))
+	}
+	var gone []string
+	for _, id := range mediaIDs {
+		if !found[id] {
+			gone = append(gone, id)
+		}
+	}
+
+	if err := upsertDocuments(ctx, docs); err != nil {
+		return fmt.Errorf("failed to index media: %w", err)
+	}
+	if err := deleteDocuments(ctx, gone); err != nil {
+		return fmt.Errorf("failed to remove media from index: %w", err)
+	}
+	return nil
+}
+
+// A deleted account's documents are removed at once; the media rows go
+// without events
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "search-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountDocuments,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteAccountDocuments removes every document of a deleted account
+func deleteAccountDocuments(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	if !searchConfigured() {
+		return nil
+	}
+	return deleteDocumentsWhere(ctx, fmt.Sprintf("owner_id = %d", msg.UserID))
+}
+
+// The nightly sync repairs whatever events were lost
+var _ = cron.NewJob("search-sync", cron.JobConfig{
+	Title:    "Sync the search index with all media",
+	Every:    24 * cron.Hour,
+	Endpoint: SyncIndex,
+})
+
+// SyncIndexResponse reports how many media were indexed
+type SyncIndexResponse struct {
+	Indexed int `json:"indexed"`
+}
+
+// SyncIndex indexes every media item and removes documents of media that
+// no longer exists
+//
+//encore:api private
+func SyncIndex(ctx context.Context) (*SyncIndexResponse, error) {
+	if !searchConfigured() {
+		return &SyncIndexResponse{}, nil
+	}
+	indexed, err := syncIndex(ctx)
+	if err != nil {
+		rlog.Error("failed to sync search index", "error", err, "indexed", indexed)
+		return nil, err
+	}
+	rlog.Info("search index synced", "indexed", indexed)
+	return &SyncIndexResponse{Indexed: indexed}, nil
+}
+
+// syncIndex writes every media item to the index page by page, then drops
+// the documents the pass didn't touch. Meilisearch applies the tasks of an
+// index in order, so the removal only sees the new documents.
+func syncIndex(ctx context.Context) (int, error) {
+	started := time.Now()
+	indexed := 0
+	after := ""
+	for {
+		resp, err := media.ListIndexMedia(ctx, &media.ListIndexMediaRequest{After: after})
+		if err != nil {
+			return indexed, fmt.Errorf("failed to list media: %w", err)
+		}
+		docs := make([]document, 0, len(resp.Media))
+		for _, m := range resp.Media {
+			docs = append(docs, newDocument(m, started))
+		}
+		if err := upsertDocuments(ctx, docs); err != nil {
+			return indexed, err
+		}
+		indexed += len(docs)
+		if resp.Next == "" {
+			break
+		}
+		after = resp.Next
+	}
+	return indexed, deleteDocumentsWhere(ctx, fmt.Sprintf("indexed_at < %d", started.Unix()))
+}
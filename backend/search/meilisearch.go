@@ -0,0 +1,172 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// getSearchURL returns the Meilisearch URL; search is off without one
+func getSearchURL() string {
+	return strings.TrimRight(os.Getenv("SEARCH_URL"), "/")
+}
+
+// getSearchIndex returns the name of the index media is kept in
+func getSearchIndex() string {
+	if val := os.Getenv("SEARCH_INDEX"); val != "" {
+		return val
+	}
+	return "media"
+}
+
+// searchConfigured reports whether a search engine is set up
+func searchConfigured() bool {
+	return getSearchURL() != ""
+}
+
+// indexSettings makes titles, file names and tags searchable with typo
+// tolerance and lets results be filtered, faceted and sorted
+var indexSettings = map[string]any{
+	"searchableAttributes": []string{"title", "tags", "original_filename"},
+	"filterableAttributes": []string{"owner_id", "tags", "type", "year", "status", "indexed_at"},
+	"sortableAttributes":   []string{"created_at", "size_bytes", "duration_seconds"},
+	"typoTolerance":        map[string]any{"enabled": true},
+	"pagination":           map[string]any{"maxTotalHits": 10000},
+}
+
+// indexReady is set once the index exists with indexSettings on this instance
+var indexReady = struct {
+	sync.Mutex
+	done bool
+}{}
+
+// ensureIndex creates the index and applies its settings once per
+// instance. Both are idempotent, so instances racing here is harmless.
+func ensureIndex(ctx context.Context) error {
+	indexReady.Lock()
+	defer indexReady.Unlock()
+	if indexReady.done {
+		return nil
+	}
+
+	// Creating an index that exists fails as a task, not as a request
+	if err := meiliRequest(ctx, "POST", "/indexes", map[string]string{
+		"uid":        getSearchIndex(),
+		"primaryKey": "id",
+	}, nil); err != nil {
+		return err
+	}
+	if err := meiliRequest(ctx, "PATCH", "/indexes/"+getSearchIndex()+"/settings", indexSettings, nil); err != nil {
+		return err
+	}
+	indexReady.done = true
+	return nil
+}
+
+// upsertDocuments adds documents or replaces those with the same ID
+func upsertDocuments(ctx context.Context, docs []document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	if err := ensureIndex(ctx); err != nil {
+		return err
+	}
+	return meiliRequest(ctx, "POST", "/indexes/"+getSearchIndex()+"/documents", docs, nil)
+}
+
+// deleteDocuments removes documents by ID
+func deleteDocuments(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := ensureIndex(ctx); err != nil {
+		return err
+	}
+	return meiliRequest(ctx, "POST", "/indexes/"+getSearchIndex()+"/documents/delete-batch", ids, nil)
+}
+
+// deleteDocumentsWhere removes the documents matching a filter expression
+func deleteDocumentsWhere(ctx context.Context, filter string) error {
+	if err := ensureIndex(ctx); err != nil {
+		return err
+	}
+	return meiliRequest(ctx, "POST", "/indexes/"+getSearchIndex()+"/documents/delete",
+		map[string]string{"filter": filter}, nil)
+}
+
+// meiliSearchRequest is the body of a Meilisearch search
+type meiliSearchRequest struct {
+	Q                    string   `json:"q"`
+	Filter               string   `json:"filter,omitempty"`
+	Facets               []string `json:"facets,omitempty"`
+	Sort                 []string `json:"sort,omitempty"`
+	HitsPerPage          int      `json:"hitsPerPage"`
+	Page                 int      `json:"page"`
+	AttributesToRetrieve []string `json:"attributesToRetrieve,omitempty"`
+}
+
+// meiliSearchResponse is the part of a Meilisearch search response we use
+type meiliSearchResponse struct {
+	Hits              []document                `json:"hits"`
+	TotalHits         int                       `json:"totalHits"`
+	FacetDistribution map[string]map[string]int `json:"facetDistribution"`
+	ProcessingTimeMs  int                       `json:"processingTimeMs"`
+}
+
+// searchDocuments runs a search
+func searchDocuments(ctx context.Context, req *meiliSearchRequest) (*meiliSearchResponse, error) {
+	if err := ensureIndex(ctx); err != nil {
+		return nil, err
+	}
+	var resp meiliSearchResponse
+	if err := meiliRequest(ctx, "POST", "/indexes/"+getSearchIndex()+"/search", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// meiliRequest calls the Meilisearch API and decodes the response into out
+// unless it is nil. Writes are queued as tasks and answered with 202.
+func meiliRequest(ctx context.Context, method, path string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, getSearchURL()+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if secrets.SearchAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+secrets.SearchAPIKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("meilisearch %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// quoteFilter quotes a value for a Meilisearch filter expression
+func quoteFilter(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
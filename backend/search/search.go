@@ -0,0 +1,191 @@
+// Package search keeps the titles, file names and tags of all media in a
+// Meilisearch index and searches a user's library with typo tolerance and
+// facets. It is optional: without SEARCH_URL the indexer does nothing and
+// /search answers Unavailable.
+package search
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Secrets for the search engine
+var secrets struct {
+	// SearchAPIKey is the Meilisearch API key, empty for an instance without one
+	SearchAPIKey string
+}
+
+// sortOrders maps the sort parameter to Meilisearch sort rules
+var sortOrders = map[string][]string{
+	"newest":   {"created_at:desc"},
+	"oldest":   {"created_at:asc"},
+	"largest":  {"size_bytes:desc"},
+	"longest":  {"duration_seconds:desc"},
+	"shortest": {"duration_seconds:asc"},
+}
+
+// SearchRequest is a search of the caller's library
+type SearchRequest struct {
+	Q string `query:"q"`
+	// Tags keeps media that has all of these tags
+	Tags []string `query:"tags"`
+	// Type is video, audio, image or other
+	Type string `query:"type"`
+	// Year is the year the media was uploaded
+	Year     int    `query:"year"`
+	Status   string `query:"status"`
+	Sort     string `query:"sort"`
+	Page     int    `query:"page"`
+	PageSize int    `query:"page_size"`
+}
+
+// SearchHit is a matching media item
+type SearchHit struct {
+	ID               string    `json:"id"`
+	Title            string    `json:"title"`
+	OriginalFilename string    `json:"original_filename"`
+	MimeType         string    `json:"mime_type"`
+	Type             string    `json:"type"`
+	Tags             []string  `json:"tags"`
+	Status           string    `json:"status"`
+	SizeBytes        int64     `json:"size_bytes"`
+	DurationSeconds  int64     `json:"duration_seconds"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// SearchFacets counts the matching media by tag, type and year
+type SearchFacets struct {
+	Tags  map[string]int `json:"tags"`
+	Types map[string]int `json:"types"`
+	Years map[string]int `json:"years"`
+}
+
+// SearchResponse contains a page of hits, most relevant first unless sorted
+type SearchResponse struct {
+	Hits       []SearchHit  `json:"hits"`
+	TotalCount int          `json:"total_count"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"page_size"`
+	Facets     SearchFacets `json:"facets"`
+	// ProcessingTimeMs is how long the search engine took
+	ProcessingTimeMs int `json:"processing_time_ms"`
+}
+
+// Search searches the caller's media by title, file name and tags,
+// tolerating typos, and counts the matches by tag, type and year
+//
+//encore:api auth method=GET path=/search
+func Search(ctx context.Context, req *SearchRequest) (*SearchResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !searchConfigured() {
+		return nil, errs.B().Code(errs.Unavailable).Msg("search is not configured").Err()
+	}
+
+	page := req.Page
+	if page < 1 {
+		page = 1
+	}
+	pageSize := req.PageSize
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	filters := []string{fmt.Sprintf("owner_id = %d", userData.UserID)}
+	for _, tag := range req.Tags {
+		filters = append(filters, "tags = "+quoteFilter(tag))
+	}
+	if req.Type != "" {
+		filters = append(filters, "type = "+quoteFilter(req.Type))
+	}
+	if req.Year != 0 {
+		filters = append(filters, fmt.Sprintf("year = %d", req.Year))
+	}
+	if req.Status != "" {
+		filters = append(filters, "status = "+quoteFilter(req.Status))
+	}
+	var sort []string
+	if req.Sort != "" {
+		var ok bool
+		if sort, ok = sortOrders[req.Sort]; !ok {
+			return nil, errs.B().Code(errs.InvalidArgument).Msg("sort must be newest, oldest, largest, longest or shortest").Err()
+		}
+	}
+
+	result, err := searchDocuments(ctx, &meiliSearchRequest{
+		Q:           req.Q,
+		Filter:      strings.Join(filters, " AND "),
+		Facets:      []string{"tags", "type", "year"},
+		Sort:        sort,
+		HitsPerPage: pageSize,
+		Page:        page,
+	})
+	if err != nil {
+		rlog.Error("search failed", "error", err)
+		return nil, errs.B().Code(errs.Unavailable).Msg("search failed, try again").Err()
+	}
+
+	resp := &SearchResponse{
+		Hits:             []SearchHit{},
+		TotalCount:       result.TotalHits,
+		Page:             page,
+		PageSize:         pageSize,
+		ProcessingTimeMs: result.ProcessingTimeMs,
+		Facets: SearchFacets{
+			Tags:  facet(result.FacetDistribution, "tags"),
+			Types: facet(result.FacetDistribution, "type"),
+			Years: facet(result.FacetDistribution, "year"),
+		},
+	}
+	for _, doc := range result.Hits {
+		resp.Hits = append(resp.Hits, SearchHit{
+			ID:               doc.ID,
+			Title:            doc.Title,
+			OriginalFilename: doc.OriginalFilename,
+			MimeType:         doc.MimeType,
+			Type:             doc.Type,
+			Tags:             doc.Tags,
+			Status:           doc.Status,
+			SizeBytes:        doc.SizeBytes,
+			DurationSeconds:  doc.DurationSeconds,
+			CreatedAt:        time.Unix(doc.CreatedAt, 0).UTC(),
+		})
+	}
+	return resp, nil
+}
+
+// facet returns the counts of a facet, never nil
+func facet(distribution map[string]map[string]int, name string) map[string]int {
+	if counts := distribution[name]; counts != nil {
+		return counts
+	}
+	return map[string]int{}
+}
+
+// AdminReindex rebuilds the search index from all media, e.g. after
+// connecting a new search engine
+//
+//encore:api auth method=POST path=/admin/search/reindex
+func AdminReindex(ctx context.Context) (*SyncIndexResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+	if !searchConfigured() {
+		return nil, errs.B().Code(errs.Unavailable).Msg("search is not configured").Err()
+	}
+
+	indexed, err := syncIndex(ctx)
+	if err != nil {
+		rlog.Error("failed to reindex search", "error", err, "indexed", indexed)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to reindex").Err()
+	}
+	return &SyncIndexResponse{Indexed: indexed}, nil
+}
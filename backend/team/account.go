@@ -0,0 +1,94 @@
+package team
+
+import (
+	"context"
+	"time"
+
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// Deleting an account removes its memberships
+var _ = pubsub.NewSubscription(authpkg.AccountDeletionRequestedTopic, "team-account-cleanup",
+	pubsub.SubscriptionConfig[*authpkg.AccountDeletionRequested]{
+		Handler: deleteAccountMemberships,
+		RetryPolicy: &pubsub.RetryPolicy{
+			MinBackoff: 30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+		},
+	},
+)
+
+// deleteAccountMemberships removes a deleted account from its teams. A team
+// the user was the only owner of gets its longest-standing admin (or else
+// member) as owner, and a team left without members is deleted.
+func deleteAccountMemberships(ctx context.Context, msg *authpkg.AccountDeletionRequested) error {
+	rows, err := db.Query(ctx, `SELECT team_id::text FROM team_members WHERE user_id = $1`, msg.UserID)
+	if err != nil {
+		return err
+	}
+	var teamIDs []string
+	for rows.Next() {
+		var teamID string
+		if err := rows.Scan(&teamID); err == nil {
+			teamIDs = append(teamIDs, teamID)
+		}
+	}
+	rows.Close()
+
+	// Each team is handled in a transaction, so a retry never finds a team
+	// the user left without an owner
+	for _, teamID := range teamIDs {
+		deleted, err := leaveTeam(ctx, teamID, msg.UserID)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			if _, err := TeamDeletedTopic.Publish(ctx, &TeamDeleted{TeamID: teamID}); err != nil {
+				rlog.Error("failed to publish team deletion", "error", err, "team_id", teamID)
+			}
+		}
+	}
+
+	rlog.Info("account team memberships deleted", "user_id", msg.UserID, "deleted", len(teamIDs))
+	return authpkg.ReportDeletionProgress(ctx, &authpkg.DeletionProgress{
+		DeletionID:   msg.DeletionID,
+		Service:      "team",
+		DeletedItems: len(teamIDs),
+	})
+}
+
+// leaveTeam removes a deleted user from a team, appoints a new owner when
+// needed and deletes the team when nobody is left; it reports whether the
+// team was deleted
+func leaveTeam(ctx context.Context, teamID string, userID int64) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ctx, `DELETE FROM team_members WHERE team_id = $1 AND user_id = $2`, teamID, userID); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE team_members SET role = 'owner'
+		WHERE team_id = $1 AND user_id = (
+			SELECT user_id FROM team_members WHERE team_id = $1
+			ORDER BY CASE role WHEN 'admin' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END, added_at
+			LIMIT 1
+		) AND NOT EXISTS (SELECT 1 FROM team_members WHERE team_id = $1 AND role = 'owner')
+	`, teamID)
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(ctx, `
+		DELETE FROM teams t WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM team_members WHERE team_id = t.id)
+	`, teamID)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, tx.Commit()
+}
@@ -0,0 +1,60 @@
+package team
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"encore.dev"
+	"encore.dev/rlog"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Audit log events of the team service
+const (
+	auditTeamCreated       = "team_created"
+	auditTeamUpdated       = "team_updated"
+	auditTeamDeleted       = "team_deleted"
+	auditMemberAdded       = "team_member_added"
+	auditMemberUpdated     = "team_member_updated"
+	auditMemberRemoved     = "team_member_removed"
+	auditTeamLimitsUpdated = "team_limits_updated"
+)
+
+// recordAudit publishes a change the caller made to a team to the audit
+// log; before and after are snapshots, nil when there is none. A failure is
+// only logged.
+func recordAudit(ctx context.Context, userID int64, event, teamID string, before, after any, details map[string]string) {
+	record := &authpkg.AuditRecord{
+		EventID:      uuid.New().String(),
+		UserID:       userID,
+		Event:        event,
+		Service:      "team",
+		ResourceType: "team",
+		ResourceID:   teamID,
+		Details:      details,
+		Before:       auditSnapshot(before),
+		After:        auditSnapshot(after),
+		OccurredAt:   time.Now(),
+	}
+	if req := encore.CurrentRequest(); req != nil && req.Headers != nil {
+		record.IP = strings.TrimSpace(strings.Split(req.Headers.Get("X-Forwarded-For"), ",")[0])
+		record.UserAgent = req.Headers.Get("User-Agent")
+	}
+
+	if _, err := authpkg.AuditTopic.Publish(ctx, record); err != nil {
+		rlog.Error("failed to publish audit event", "error", err, "event", event, "team_id", teamID)
+	}
+}
+
+// auditSnapshot encodes a snapshot, nil for none
+func auditSnapshot(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
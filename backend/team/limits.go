@@ -0,0 +1,311 @@
+package team
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Resources with a per-team limit
+const (
+	// ResourceStorage is the bytes stored by the team's media
+	ResourceStorage = "storage"
+	// ResourceTranscodeMinutes is the minutes of the team's media transcoded
+	// in the current month
+	ResourceTranscodeMinutes = "transcode_minutes"
+)
+
+// Usage levels of a resource against its limit
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"
+	LevelExceeded = "exceeded"
+)
+
+const gigabyte = 1 << 30
+
+// getDefaultStorageLimit returns the storage limit in bytes of teams without
+// their own (TEAM_STORAGE_LIMIT_GB); 0 means unlimited
+func getDefaultStorageLimit() int64 {
+	gb, err := strconv.ParseFloat(os.Getenv("TEAM_STORAGE_LIMIT_GB"), 64)
+	if err != nil || gb <= 0 {
+		return 0
+	}
+	return int64(gb * gigabyte)
+}
+
+// getDefaultTranscodeMinutes returns the monthly transcode minutes of teams
+// without their own limit (TEAM_TRANSCODE_MINUTES); 0 means unlimited
+func getDefaultTranscodeMinutes() int64 {
+	n, err := strconv.ParseInt(os.Getenv("TEAM_TRANSCODE_MINUTES"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// getDefaultWarnPercent returns the share of a limit at which team admins
+// are warned (TEAM_USAGE_WARN_PERCENT, 80 by default)
+func getDefaultWarnPercent() int {
+	n, err := strconv.Atoi(os.Getenv("TEAM_USAGE_WARN_PERCENT"))
+	if err != nil || n < 1 || n > 100 {
+		return 80
+	}
+	return n
+}
+
+// Limits are the usage limits of a team; a limit of 0 is unlimited
+type Limits struct {
+	TeamID                string `json:"team_id"`
+	StorageLimitBytes     int64  `json:"storage_limit_bytes"`
+	TranscodeMinutesLimit int64  `json:"transcode_minutes_limit"`
+	// WarnPercent of a limit warns the team's owners and admins
+	WarnPercent int `json:"warn_percent"`
+}
+
+// Limit returns the limit of a resource, 0 for unlimited
+func (l *Limits) Limit(resource string) int64 {
+	switch resource {
+	case ResourceStorage:
+		return l.StorageLimitBytes
+	case ResourceTranscodeMinutes:
+		return l.TranscodeMinutesLimit
+	}
+	return 0
+}
+
+// Level returns how close used is to the limit of a resource
+func (l *Limits) Level(resource string, used int64) string {
+	limit := l.Limit(resource)
+	switch {
+	case limit <= 0:
+		return LevelOK
+	case used >= limit:
+		return LevelExceeded
+	case used*100 >= limit*int64(l.WarnPercent):
+		return LevelWarning
+	}
+	return LevelOK
+}
+
+// loadLimits returns a team's limits with the defaults filled in
+func loadLimits(ctx context.Context, teamID string) (*Limits, error) {
+	var storage, minutes *int64
+	var warnPercent *int
+	err := db.QueryRow(ctx, `
+		SELECT storage_limit_bytes, transcode_minutes_limit, warn_percent FROM teams WHERE id = $1
+	`, teamID).Scan(&storage, &minutes, &warnPercent)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := &Limits{
+		TeamID:                teamID,
+		StorageLimitBytes:     getDefaultStorageLimit(),
+		TranscodeMinutesLimit: getDefaultTranscodeMinutes(),
+		WarnPercent:           getDefaultWarnPercent(),
+	}
+	if storage != nil {
+		limits.StorageLimitBytes = *storage
+	}
+	if minutes != nil {
+		limits.TranscodeMinutesLimit = *minutes
+	}
+	if warnPercent != nil {
+		limits.WarnPercent = *warnPercent
+	}
+	return limits, nil
+}
+
+// TeamLimitsRequest names the team whose limits to read
+type TeamLimitsRequest struct {
+	TeamID string `json:"team_id"`
+}
+
+// GetTeamLimits returns a team's limits, for the services enforcing them
+//
+//encore:api private
+func GetTeamLimits(ctx context.Context, req *TeamLimitsRequest) (*Limits, error) {
+	if _, err := uuid.Parse(req.TeamID); err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	limits, err := loadLimits(ctx, req.TeamID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to load team limits").Err()
+	}
+	return limits, nil
+}
+
+// SetTeamLimitsRequest changes a team's limits; omitted ones are kept, 0
+// makes a limit unlimited and a negative value goes back to the default
+type SetTeamLimitsRequest struct {
+	StorageLimitBytes     *int64 `json:"storage_limit_bytes,omitempty"`
+	TranscodeMinutesLimit *int64 `json:"transcode_minutes_limit,omitempty"`
+	WarnPercent           *int   `json:"warn_percent,omitempty"`
+}
+
+// SetTeamLimits sets a team's storage and monthly transcode limits; only
+// admins may
+//
+//encore:api auth method=PUT path=/admin/teams/:id/limits
+func SetTeamLimits(ctx context.Context, id string, req *SetTeamLimitsRequest) (*Limits, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if !userData.IsAdmin {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("admin access required").Err()
+	}
+	if req.WarnPercent != nil && (*req.WarnPercent == 0 || *req.WarnPercent > 100) {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("warn_percent must be between 1 and 100").Err()
+	}
+
+	before, err := GetTeamLimits(ctx, &TeamLimitsRequest{TeamID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each column is kept when omitted and reset to NULL when negative
+	_, err = db.Exec(ctx, `
+		UPDATE teams SET
+			storage_limit_bytes = CASE WHEN $2::bigint IS NULL THEN storage_limit_bytes
+				WHEN $2 < 0 THEN NULL ELSE $2 END,
+			transcode_minutes_limit = CASE WHEN $3::bigint IS NULL THEN transcode_minutes_limit
+				WHEN $3 < 0 THEN NULL ELSE $3 END,
+			warn_percent = CASE WHEN $4::int IS NULL THEN warn_percent
+				WHEN $4 < 0 THEN NULL ELSE $4 END
+		WHERE id = $1
+	`, id, req.StorageLimitBytes, req.TranscodeMinutesLimit, req.WarnPercent)
+	if err != nil {
+		rlog.Error("failed to set team limits", "error", err, "team_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to set team limits").Err()
+	}
+
+	after, err := GetTeamLimits(ctx, &TeamLimitsRequest{TeamID: id})
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, userData.UserID, auditTeamLimitsUpdated, id, before, after, nil)
+	return after, nil
+}
+
+// TeamUsageAlert is published when a team's usage of a resource reaches
+// the warning threshold or its limit
+type TeamUsageAlert struct {
+	TeamID   string `json:"team_id"`
+	TeamName string `json:"team_name"`
+	Resource string `json:"resource"`
+	// Level is "warning" or "exceeded"
+	Level string `json:"level"`
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+	// Period is the month ("2006-01") of transcode minutes, empty for storage
+	Period string `json:"period,omitempty"`
+	// RecipientIDs are the team's owners and admins
+	RecipientIDs []int64   `json:"recipient_ids"`
+	AlertedAt    time.Time `json:"alerted_at"`
+}
+
+// TeamUsageAlertTopic carries usage alerts to the notification service
+var TeamUsageAlertTopic = pubsub.NewTopic[*TeamUsageAlert]("team-usage-alerts", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// ReportUsageRequest is a team's current usage of a resource
+type ReportUsageRequest struct {
+	TeamID   string `json:"team_id"`
+	Resource string `json:"resource"`
+	Used     int64  `json:"used"`
+	// Period is the month ("2006-01") of transcode minutes, empty for storage
+	Period string `json:"period,omitempty"`
+}
+
+// ReportUsageResponse is the level the usage is at
+type ReportUsageResponse struct {
+	Level string `json:"level"`
+}
+
+// ReportUsage is called by the services measuring usage whenever it grows
+// or shrinks. The first time in a period that usage reaches the warning
+// threshold or the limit, the team's owners and admins are alerted; once it
+// falls back below, the threshold alerts again.
+//
+//encore:api private
+func ReportUsage(ctx context.Context, req *ReportUsageRequest) (*ReportUsageResponse, error) {
+	if req.Resource != ResourceStorage && req.Resource != ResourceTranscodeMinutes {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg("unknown resource").Err()
+	}
+	limits, err := GetTeamLimits(ctx, &TeamLimitsRequest{TeamID: req.TeamID})
+	if err != nil {
+		return nil, err
+	}
+	level := limits.Level(req.Resource, req.Used)
+
+	// Forget alerts of earlier periods and of levels usage fell back below
+	_, err = db.Exec(ctx, `
+		DELETE FROM team_usage_alerts
+		WHERE team_id = $1 AND resource = $2
+		  AND (period <> $3 OR (level = 'exceeded' AND $4 <> 'exceeded') OR (level = 'warning' AND $4 = 'ok'))
+	`, req.TeamID, req.Resource, req.Period, level)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to record team usage").Err()
+	}
+	resp := &ReportUsageResponse{Level: level}
+	if level == LevelOK {
+		return resp, nil
+	}
+
+	alert := &TeamUsageAlert{
+		TeamID:   req.TeamID,
+		Resource: req.Resource,
+		Level:    level,
+		Used:     req.Used,
+		Limit:    limits.Limit(req.Resource),
+		Period:   req.Period,
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO team_usage_alerts (team_id, resource, period, level, used, alerted_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT DO NOTHING
+		RETURNING alerted_at
+	`, req.TeamID, req.Resource, req.Period, level, req.Used).Scan(&alert.AlertedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// Already alerted
+		return resp, nil
+	}
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to record team usage").Err()
+	}
+
+	_ = db.QueryRow(ctx, `SELECT name FROM teams WHERE id = $1`, req.TeamID).Scan(&alert.TeamName)
+	rows, err := db.Query(ctx, `
+		SELECT user_id FROM team_members WHERE team_id = $1 AND role IN ('owner', 'admin')
+	`, req.TeamID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to record team usage").Err()
+	}
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err == nil {
+			alert.RecipientIDs = append(alert.RecipientIDs, userID)
+		}
+	}
+	rows.Close()
+
+	if _, err := TeamUsageAlertTopic.Publish(ctx, alert); err != nil {
+		rlog.Error("failed to publish team usage alert", "error", err, "team_id", req.TeamID)
+	}
+	rlog.Info("team usage alert", "team_id", req.TeamID, "resource", req.Resource, "level", level, "used", req.Used)
+	return resp, nil
+}
@@ -0,0 +1,235 @@
+package team
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+
+	authpkg "encore.app/auth"
+)
+
+// maxTeamMembers caps the size of a team
+const maxTeamMembers = 200
+
+// Member is a member of a team
+type Member struct {
+	UserID      int64     `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Role        Role      `json:"role"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+// listMembers returns the members of a team, most privileged first
+func listMembers(ctx context.Context, teamID string) ([]Member, error) {
+	rows, err := db.Query(ctx, `
+		SELECT user_id, role, added_at FROM team_members WHERE team_id = $1
+		ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 WHEN 'editor' THEN 2 ELSE 3 END, added_at
+	`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Role, &m.AddedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+
+	for i := range members {
+		if profile, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: members[i].UserID}); err == nil {
+			members[i].DisplayName = profile.DisplayName
+			members[i].AvatarURL = profile.AvatarURL
+		}
+	}
+	return members, nil
+}
+
+// validRole checks a role given in a request
+func validRole(role Role) error {
+	if _, ok := roleRanks[role]; !ok {
+		return errs.B().Code(errs.InvalidArgument).Msg("role must be owner, admin, editor or viewer").Err()
+	}
+	return nil
+}
+
+// AddMemberRequest names a user to add and their role
+type AddMemberRequest struct {
+	// User is a user ID or Discord username
+	User string `json:"user"`
+	Role Role   `json:"role"`
+}
+
+// AddMember adds a user to a team. Admins add editors, viewers and other
+// admins; only owners add owners.
+//
+//encore:api auth method=POST path=/teams/:id/members
+func AddMember(ctx context.Context, id string, req *AddMemberRequest) (*Member, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	callerRole, err := requireRole(ctx, id, userData.UserID, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if err := validRole(req.Role); err != nil {
+		return nil, err
+	}
+	if req.Role == RoleOwner && callerRole != RoleOwner {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("only owners may add owners").Err()
+	}
+
+	profile, err := authpkg.ResolveUser(ctx, &authpkg.ResolveUserRequest{Identifier: req.User})
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("user not found").Err()
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM team_members WHERE team_id = $1`, id).Scan(&count); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to add member").Err()
+	}
+	if count >= maxTeamMembers {
+		return nil, errs.B().Code(errs.ResourceExhausted).Msg("a team can have at most 200 members").Err()
+	}
+
+	resp := &Member{UserID: profile.UserID, DisplayName: profile.DisplayName, AvatarURL: profile.AvatarURL, Role: req.Role}
+	err = db.QueryRow(ctx, `
+		INSERT INTO team_members (team_id, user_id, role, added_by, added_at) VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT DO NOTHING
+		RETURNING added_at
+	`, id, profile.UserID, req.Role, userData.UserID).Scan(&resp.AddedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.AlreadyExists).Msg("user is already a member").Err()
+	}
+
+	recordAudit(ctx, userData.UserID, auditMemberAdded, id, nil, resp, map[string]string{
+		"member_id": strconv.FormatInt(profile.UserID, 10),
+	})
+	return resp, nil
+}
+
+// UpdateMemberRequest changes a member's role
+type UpdateMemberRequest struct {
+	Role Role `json:"role"`
+}
+
+// UpdateMember changes the role of a member. Admins change the roles of
+// editors, viewers and admins; only owners appoint or demote owners. The
+// last owner can't be demoted.
+//
+//encore:api auth method=PATCH path=/teams/:id/members/:userID
+func UpdateMember(ctx context.Context, id string, userID int64, req *UpdateMemberRequest) (*Member, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	callerRole, err := requireRole(ctx, id, userData.UserID, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if err := validRole(req.Role); err != nil {
+		return nil, err
+	}
+
+	current, err := GetMembership(ctx, &MembershipRequest{TeamID: id, UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	if current.Role == "" {
+		return nil, errs.B().Code(errs.NotFound).Msg("member not found").Err()
+	}
+	if (current.Role == RoleOwner || req.Role == RoleOwner) && callerRole != RoleOwner {
+		return nil, errs.B().Code(errs.PermissionDenied).Msg("only owners may appoint or demote owners").Err()
+	}
+	if current.Role == RoleOwner && req.Role != RoleOwner {
+		if err := keepAnOwner(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &Member{UserID: userID, Role: req.Role}
+	err = db.QueryRow(ctx, `
+		UPDATE team_members SET role = $3 WHERE team_id = $1 AND user_id = $2
+		RETURNING added_at
+	`, id, userID, req.Role).Scan(&resp.AddedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update member").Err()
+	}
+	if profile, err := authpkg.GetPublicProfile(ctx, &authpkg.ProfileRequest{UserID: userID}); err == nil {
+		resp.DisplayName = profile.DisplayName
+		resp.AvatarURL = profile.AvatarURL
+	}
+
+	if current.Role != req.Role {
+		recordAudit(ctx, userData.UserID, auditMemberUpdated, id,
+			map[string]Role{"role": current.Role}, map[string]Role{"role": req.Role},
+			map[string]string{"member_id": strconv.FormatInt(userID, 10)})
+	}
+	return resp, nil
+}
+
+// RemoveMemberResponse confirms the removal
+type RemoveMemberResponse struct {
+	Success bool `json:"success"`
+}
+
+// RemoveMember removes a member from a team, or lets a member leave it.
+// Admins remove editors, viewers and admins; only owners remove owners.
+// The last owner can't leave; they delete the team instead. Media and
+// collections the member added stay with the team.
+//
+//encore:api auth method=DELETE path=/teams/:id/members/:userID
+func RemoveMember(ctx context.Context, id string, userID int64) (*RemoveMemberResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	minRole := RoleAdmin
+	if userID == userData.UserID {
+		minRole = RoleViewer
+	}
+	callerRole, err := requireRole(ctx, id, userData.UserID, minRole)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := GetMembership(ctx, &MembershipRequest{TeamID: id, UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	if current.Role == "" {
+		return nil, errs.B().Code(errs.NotFound).Msg("member not found").Err()
+	}
+	if current.Role == RoleOwner {
+		if userID != userData.UserID && callerRole != RoleOwner {
+			return nil, errs.B().Code(errs.PermissionDenied).Msg("only owners may remove owners").Err()
+		}
+		if err := keepAnOwner(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := db.Exec(ctx, `DELETE FROM team_members WHERE team_id = $1 AND user_id = $2`, id, userID); err != nil {
+		rlog.Error("failed to remove team member", "error", err, "team_id", id)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to remove member").Err()
+	}
+
+	recordAudit(ctx, userData.UserID, auditMemberRemoved, id, map[string]Role{"role": current.Role}, nil,
+		map[string]string{"member_id": strconv.FormatInt(userID, 10)})
+	return &RemoveMemberResponse{Success: true}, nil
+}
+
+// keepAnOwner fails unless the team has another owner, so it is never
+// left without one
+func keepAnOwner(ctx context.Context, teamID string) error {
+	var owners int
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM team_members WHERE team_id = $1 AND role = 'owner'
+	`, teamID).Scan(&owners)
+	if err != nil {
+		return errs.B().Code(errs.Internal).Msg("failed to check team owners").Err()
+	}
+	if owners < 2 {
+		return errs.B().Code(errs.FailedPrecondition).Msg("a team needs an owner; appoint another one or delete the team").Err()
+	}
+	return nil
+}
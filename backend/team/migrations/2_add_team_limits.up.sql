@@ -0,0 +1,16 @@
+-- Per-team limits; NULL uses the TEAM_* defaults, 0 is unlimited
+ALTER TABLE teams ADD COLUMN storage_limit_bytes BIGINT;
+ALTER TABLE teams ADD COLUMN transcode_minutes_limit BIGINT;
+ALTER TABLE teams ADD COLUMN warn_percent INT CHECK (warn_percent BETWEEN 1 AND 100);
+
+-- Usage alerts already sent, so each threshold notifies once per period
+-- (empty for storage, the month for transcode minutes)
+CREATE TABLE team_usage_alerts (
+    team_id UUID NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    resource TEXT NOT NULL CHECK (resource IN ('storage', 'transcode_minutes')),
+    period TEXT NOT NULL,
+    level TEXT NOT NULL CHECK (level IN ('warning', 'exceeded')),
+    used BIGINT NOT NULL,
+    alerted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (team_id, resource, period, level)
+);
@@ -0,0 +1,296 @@
+// Package team lets users share a library: media and collections can belong
+// to a team instead of a single user, and the team's members see and edit
+// them according to their role.
+package team
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/google/uuid"
+
+	authpkg "encore.app/auth"
+)
+
+// Database for teams and their members
+var db = sqldb.NewDatabase("team", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+// Role is what a member may do in a team; every role may do what the roles
+// below it may
+type Role string
+
+// Team roles, from most to least privileged
+const (
+	// RoleOwner renames and deletes the team and appoints other owners
+	RoleOwner Role = "owner"
+	// RoleAdmin adds and removes members
+	RoleAdmin Role = "admin"
+	// RoleEditor uploads, tags, deletes and organizes the team's media and
+	// collections
+	RoleEditor Role = "editor"
+	// RoleViewer sees and plays the team's media and collections
+	RoleViewer Role = "viewer"
+)
+
+// roleRanks orders the roles; a non-member's empty role ranks 0
+var roleRanks = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// AtLeast reports whether a member with role r may do what min may; the
+// empty role of a non-member never may
+func (r Role) AtLeast(min Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[min]
+}
+
+// maxTeamNameLength is the longest team name
+const maxTeamNameLength = 100
+
+// TeamDeleted is published when a team is deleted; the services hand its
+// media and collections back to the members who created them
+type TeamDeleted struct {
+	TeamID string `json:"team_id"`
+}
+
+// TeamDeletedTopic announces deleted teams
+var TeamDeletedTopic = pubsub.NewTopic[*TeamDeleted]("team-deleted", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// Team is a team the caller belongs to
+type Team struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Role is the caller's role in the team
+	Role        Role      `json:"role"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Members are only listed by GetTeam
+	Members []Member `json:"members,omitempty"`
+}
+
+// CreateTeamRequest names a new team
+type CreateTeamRequest struct {
+	Name string `json:"name"`
+}
+
+// CreateTeam creates a team with the caller as its owner
+//
+//encore:api auth method=POST path=/teams
+func CreateTeam(ctx context.Context, req *CreateTeamRequest) (*Team, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	name, err := teamName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create team").Err()
+	}
+	defer tx.Rollback()
+
+	resp := &Team{Name: name, Role: RoleOwner, MemberCount: 1}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO teams (name, created_by, created_at) VALUES ($1, $2, NOW())
+		RETURNING id::text, created_at
+	`, name, userData.UserID).Scan(&resp.ID, &resp.CreatedAt)
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO team_members (team_id, user_id, role, added_by, added_at) VALUES ($1, $2, 'owner', $2, NOW())
+		`, resp.ID, userData.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		rlog.Error("failed to create team", "error", err)
+		return nil, errs.B().Code(errs.Internal).Msg("failed to create team").Err()
+	}
+
+	recordAudit(ctx, userData.UserID, auditTeamCreated, resp.ID, nil, map[string]string{"name": name}, nil)
+	return resp, nil
+}
+
+// ListTeamsResponse lists the caller's teams
+type ListTeamsResponse struct {
+	Teams []Team `json:"teams"`
+}
+
+// ListTeams lists the teams the caller belongs to, by name
+//
+//encore:api auth method=GET path=/teams
+func ListTeams(ctx context.Context) (*ListTeamsResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+
+	rows, err := db.Query(ctx, `
+		SELECT t.id::text, t.name, m.role, t.created_at,
+			   (SELECT COUNT(*) FROM team_members WHERE team_id = t.id)
+		FROM teams t JOIN team_members m ON m.team_id = t.id
+		WHERE m.user_id = $1
+		ORDER BY LOWER(t.name), t.created_at
+	`, userData.UserID)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list teams").Err()
+	}
+	defer rows.Close()
+
+	resp := &ListTeamsResponse{Teams: []Team{}}
+	for rows.Next() {
+		var t Team
+		if err := rows.Scan(&t.ID, &t.Name, &t.Role, &t.CreatedAt, &t.MemberCount); err != nil {
+			continue
+		}
+		resp.Teams = append(resp.Teams, t)
+	}
+	return resp, nil
+}
+
+// GetTeam returns a team the caller belongs to with its members
+//
+//encore:api auth method=GET path=/teams/:id
+func GetTeam(ctx context.Context, id string) (*Team, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	role, err := requireRole(ctx, id, userData.UserID, RoleViewer)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Team{ID: id, Role: role}
+	err = db.QueryRow(ctx, `SELECT name, created_at FROM teams WHERE id = $1`, id).Scan(&resp.Name, &resp.CreatedAt)
+	if err != nil {
+		return nil, errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	if resp.Members, err = listMembers(ctx, id); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to list members").Err()
+	}
+	resp.MemberCount = len(resp.Members)
+	return resp, nil
+}
+
+// UpdateTeamRequest renames a team
+type UpdateTeamRequest struct {
+	Name string `json:"name"`
+}
+
+// UpdateTeam renames a team; admins and owners may
+//
+//encore:api auth method=PATCH path=/teams/:id
+func UpdateTeam(ctx context.Context, id string, req *UpdateTeamRequest) (*Team, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	role, err := requireRole(ctx, id, userData.UserID, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	name, err := teamName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var before string
+	resp := &Team{ID: id, Name: name, Role: role}
+	err = db.QueryRow(ctx, `
+		UPDATE teams t SET name = $2 FROM teams old
+		WHERE t.id = $1 AND old.id = t.id
+		RETURNING old.name, t.created_at, (SELECT COUNT(*) FROM team_members WHERE team_id = t.id)
+	`, id, name).Scan(&before, &resp.CreatedAt, &resp.MemberCount)
+	if err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to update team").Err()
+	}
+
+	recordAudit(ctx, userData.UserID, auditTeamUpdated, id, map[string]string{"name": before}, map[string]string{"name": name}, nil)
+	return resp, nil
+}
+
+// DeleteTeamResponse confirms the deletion
+type DeleteTeamResponse struct {
+	Success bool `json:"success"`
+}
+
+// DeleteTeam deletes a team; only owners may. The team's media and
+// collections go back to the members who uploaded or created them.
+//
+//encore:api auth method=DELETE path=/teams/:id
+func DeleteTeam(ctx context.Context, id string) (*DeleteTeamResponse, error) {
+	userData := auth.Data().(*authpkg.UserData)
+	if _, err := requireRole(ctx, id, userData.UserID, RoleOwner); err != nil {
+		return nil, err
+	}
+
+	var name string
+	if err := db.QueryRow(ctx, `DELETE FROM teams WHERE id = $1 RETURNING name`, id).Scan(&name); err != nil {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to delete team").Err()
+	}
+	if _, err := TeamDeletedTopic.Publish(ctx, &TeamDeleted{TeamID: id}); err != nil {
+		rlog.Error("failed to publish team deletion", "error", err, "team_id", id)
+	}
+
+	recordAudit(ctx, userData.UserID, auditTeamDeleted, id, map[string]string{"name": name}, nil, nil)
+	return &DeleteTeamResponse{Success: true}, nil
+}
+
+// MembershipRequest asks for a user's role in a team
+type MembershipRequest struct {
+	TeamID string `json:"team_id"`
+	UserID int64  `json:"user_id"`
+}
+
+// Membership is a user's role in a team, empty when they are not a member
+type Membership struct {
+	TeamID string `json:"team_id"`
+	Role   Role   `json:"role"`
+}
+
+// GetMembership returns a user's role in a team, for the services checking
+// access to team media and collections
+//
+//encore:api private
+func GetMembership(ctx context.Context, req *MembershipRequest) (*Membership, error) {
+	resp := &Membership{TeamID: req.TeamID}
+	if _, err := uuid.Parse(req.TeamID); err != nil {
+		return resp, nil
+	}
+	err := db.QueryRow(ctx, `
+		SELECT role FROM team_members WHERE team_id = $1 AND user_id = $2
+	`, req.TeamID, req.UserID).Scan(&resp.Role)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.Internal).Msg("failed to check team membership").Err()
+	}
+	return resp, nil
+}
+
+// requireRole returns the caller's role in a team unless it is below min.
+// Non-members are told the team doesn't exist.
+func requireRole(ctx context.Context, teamID string, userID int64, min Role) (Role, error) {
+	membership, err := GetMembership(ctx, &MembershipRequest{TeamID: teamID, UserID: userID})
+	if err != nil {
+		return "", err
+	}
+	if membership.Role == "" {
+		return "", errs.B().Code(errs.NotFound).Msg("team not found").Err()
+	}
+	if !membership.Role.AtLeast(min) {
+		return "", errs.B().Code(errs.PermissionDenied).Msg("only team " + string(min) + "s and above may do this").Err()
+	}
+	return membership.Role, nil
+}
+
+// teamName validates a team name
+func teamName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errs.B().Code(errs.InvalidArgument).Msg("name is required").Err()
+	}
+	if utf8.RuneCountInString(name) > maxTeamNameLength {
+		return "", errs.B().Code(errs.InvalidArgument).Msg("name must be at most 100 characters").Err()
+	}
+	return name, nil
+}
@@ -0,0 +1,166 @@
+// Package transcode holds the transcode presets: the processing service
+// encodes with them and the auth service checks preferred presets against
+// them.
+package transcode
+
+import (
+	"os"
+	"strconv"
+)
+
+// videoCodec maps a codec name to its ffmpeg encoder and the encoder-specific
+// spelling of the quality and speed options
+type videoCodec struct {
+	Encoder     string
+	QualityFlag string
+	SpeedFlag   string
+	// Extra arguments every encode with this codec needs
+	Extra []string
+}
+
+// videoCodecs are the video codecs presets can select
+var videoCodecs = map[string]videoCodec{
+	"h264": {Encoder: "libx264", QualityFlag: "-crf", SpeedFlag: "-preset",
+		Extra: []string{"-pix_fmt", "yuv420p"}},
+	"hevc": {Encoder: "libx265", QualityFlag: "-crf", SpeedFlag: "-preset",
+		Extra: []string{"-tag:v", "hvc1"}},
+	// -b:v 0 switches libvpx to constant quality mode
+	"vp9": {Encoder: "libvpx-vp9", QualityFlag: "-crf", SpeedFlag: "-cpu-used",
+		Extra: []string{"-b:v", "0", "-row-mt", "1", "-pix_fmt", "yuv420p"}},
+	"av1": {Encoder: "libsvtav1", QualityFlag: "-crf", SpeedFlag: "-preset",
+		Extra: []string{"-pix_fmt", "yuv420p10le"}},
+}
+
+// Preset is a named set of ffmpeg encoding parameters
+type Preset struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Container   string `json:"container"`
+	ContentType string `json:"content_type"`
+	// Codec selects the video encoder from videoCodecs; Quality and Speed are
+	// passed with that encoder's flags. Empty for audio-only presets.
+	Codec   string `json:"codec,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+	Speed   string `json:"speed,omitempty"`
+	// Args are appended after the video codec arguments (audio settings etc.)
+	Args []string `json:"args"`
+	// PassthroughCodecs lists source video codecs that are remuxed instead of
+	// re-encoded when the source is already web-compatible
+	PassthroughCodecs []string `json:"passthrough_codecs,omitempty"`
+	// Loudness enables two-pass EBU R128 loudness normalization of the audio
+	Loudness *LoudnessTarget `json:"loudness,omitempty"`
+}
+
+// LoudnessTarget holds EBU R128 loudness normalization targets
+type LoudnessTarget struct {
+	// IntegratedLUFS is the integrated loudness target (I)
+	IntegratedLUFS float64 `json:"integrated_lufs"`
+	// TruePeakDBTP is the maximum true peak (TP)
+	TruePeakDBTP float64 `json:"true_peak_dbtp"`
+	// LoudnessRange is the loudness range target (LRA)
+	LoudnessRange float64 `json:"loudness_range"`
+}
+
+// Presets are the transcode presets available to uploads and reprocess
+// requests, by name
+var Presets = map[string]Preset{
+	"archive-hevc": {
+		Name:        "archive-hevc",
+		Description: "H.265/HEVC with AAC audio, small files for long-term storage",
+		Container:   "mp4",
+		ContentType: "video/mp4",
+		Codec:       "hevc",
+		Quality:     28,
+		Speed:       "fast",
+		Args:        []string{"-c:a", "aac"},
+		// Re-encoding H.264 to HEVC only loses quality for already-optimized uploads
+		PassthroughCodecs: []string{"h264", "hevc"},
+	},
+	"web-h264": {
+		Name:              "web-h264",
+		Description:       "H.264 High profile with AAC audio, plays in every browser",
+		Container:         "mp4",
+		ContentType:       "video/mp4",
+		Codec:             "h264",
+		Quality:           23,
+		Speed:             "medium",
+		Args:              []string{"-profile:v", "high", "-c:a", "aac", "-b:a", "128k"},
+		PassthroughCodecs: []string{"h264"},
+	},
+	"archive-av1": {
+		Name:        "archive-av1",
+		Description: "AV1 (SVT-AV1) with Opus audio, smallest files but slow to encode",
+		Container:   "mp4",
+		ContentType: "video/mp4",
+		Codec:       "av1",
+		Quality:     35,
+		Speed:       "6",
+		Args:        []string{"-c:a", "libopus", "-b:a", "128k"},
+		// AV1 sources are already as small as this preset would make them
+		PassthroughCodecs: []string{"av1"},
+	},
+	"web-vp9": {
+		Name:        "web-vp9",
+		Description: "VP9 with Opus audio, royalty-free and smaller than H.264",
+		Container:   "mp4",
+		ContentType: "video/mp4",
+		Codec:       "vp9",
+		Quality:     32,
+		Speed:       "2",
+		Args:        []string{"-c:a", "libopus", "-b:a", "128k"},
+	},
+	"audio-only": {
+		Name:        "audio-only",
+		Description: "Drops the video stream and keeps 192 kbps AAC audio",
+		Container:   "m4a",
+		ContentType: "audio/mp4",
+		Args:        []string{"-vn", "-c:a", "aac", "-b:a", "192k"},
+		Loudness:    &LoudnessTarget{IntegratedLUFS: -23, TruePeakDBTP: -1, LoudnessRange: 7},
+	},
+	"audio-opus": {
+		Name:        "audio-opus",
+		Description: "Drops the video stream and keeps 96 kbps Opus audio in Ogg",
+		Container:   "opus",
+		ContentType: "audio/ogg",
+		Args:        []string{"-vn", "-c:a", "libopus", "-b:a", "96k"},
+		Loudness:    &LoudnessTarget{IntegratedLUFS: -16, TruePeakDBTP: -1, LoudnessRange: 11},
+	},
+}
+
+// FFmpegArgs returns the encoder arguments of the preset, e.g. for archive-hevc:
+// -c:v libx265 -crf 28 -preset fast -tag:v hvc1 -c:a aac
+func (p Preset) FFmpegArgs() []string {
+	var args []string
+	if codec, ok := videoCodecs[p.Codec]; ok {
+		args = append(args, "-c:v", codec.Encoder)
+		if p.Quality > 0 {
+			args = append(args, codec.QualityFlag, strconv.Itoa(p.Quality))
+		}
+		if p.Speed != "" {
+			args = append(args, codec.SpeedFlag, p.Speed)
+		}
+		args = append(args, codec.Extra...)
+	}
+	return append(args, p.Args...)
+}
+
+// defaultPresetName is used when neither the upload nor PROCESSING_PRESET picks a preset
+const defaultPresetName = "archive-hevc"
+
+// Resolve returns the named preset, falling back to the configured default
+// for empty or unknown names
+func Resolve(name string) Preset {
+	if preset, ok := Presets[name]; ok {
+		return preset
+	}
+	if preset, ok := Presets[os.Getenv("PROCESSING_PRESET")]; ok {
+		return preset
+	}
+	return Presets[defaultPresetName]
+}
+
+// Exists reports whether name is a preset
+func Exists(name string) bool {
+	_, ok := Presets[name]
+	return ok
+}